@@ -0,0 +1,326 @@
+// Package apierr defines typed API errors that carry the HTTP status, error
+// code, and optional structured data to send to the client, along with a
+// mapping table from domain errors (like "does not exist") to API errors.
+//
+// Handlers return or write these errors rather than hand-rolling status
+// codes, so each kind of error is always reported the same way.
+package apierr
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Error codes sent to clients in the "error" field of error responses.
+const (
+	CodeAlreadyExists        = "already-exists"
+	CodeConflict             = "conflict"
+	CodeDatabase             = "database"
+	CodeDatabaseFull         = "database-full"
+	CodeForbidden            = "forbidden"
+	CodeGone                 = "gone"
+	CodeIdempotencyKeyReused = "idempotency-key-reused"
+	CodeInternal             = "internal"
+	CodeInvalidID            = "invalid-id"
+	CodeMaintenance          = "maintenance"
+	CodeMalformedJSON        = "malformed-json"
+	CodeMethodNotAllowed     = "method-not-allowed"
+	CodeNotFound             = "not-found"
+	CodeOutOfStock           = "out-of-stock"
+	CodeOverloaded           = "overloaded"
+	CodePaymentDeclined      = "payment-declined"
+	CodePreconditionRequired = "precondition-required"
+	CodeRateLimited          = "rate-limited"
+	CodeReadOnly             = "read-only"
+	CodeReferenced           = "referenced"
+	CodeTimeout              = "timeout"
+	CodeTooLarge             = "too-large"
+	CodeUnauthorized         = "unauthorized"
+	CodeUnavailable          = "unavailable"
+	CodeUnsupportedMedia     = "unsupported-media-type"
+	CodeValidation           = "validation"
+)
+
+// titles are short human-readable summaries of each error code, used as
+// the "title" of RFC 7807 problem details.
+var titles = map[string]string{
+	CodeAlreadyExists:        "Resource already exists",
+	CodeConflict:             "Version conflict",
+	CodeDatabase:             "Database error",
+	CodeDatabaseFull:         "Database full",
+	CodeForbidden:            "Forbidden",
+	CodeGone:                 "Resource no longer available",
+	CodeIdempotencyKeyReused: "Idempotency key reused",
+	CodeInternal:             "Internal server error",
+	CodeInvalidID:            "Invalid ID",
+	CodeMaintenance:          "Down for maintenance",
+	CodeMalformedJSON:        "Malformed JSON",
+	CodeMethodNotAllowed:     "Method not allowed",
+	CodeNotFound:             "Not found",
+	CodeOutOfStock:           "Out of stock",
+	CodeOverloaded:           "Server overloaded",
+	CodePaymentDeclined:      "Payment declined",
+	CodePreconditionRequired: "Precondition required",
+	CodeRateLimited:          "Too many requests",
+	CodeReadOnly:             "Server is read-only",
+	CodeReferenced:           "Resource is referenced",
+	CodeTimeout:              "Request timed out",
+	CodeTooLarge:             "Request body too large",
+	CodeUnauthorized:         "Unauthorized",
+	CodeUnavailable:          "Service unavailable",
+	CodeUnsupportedMedia:     "Unsupported media type",
+	CodeValidation:           "Validation failed",
+}
+
+// Title returns a short human-readable summary of the error code, and
+// false if the code isn't known.
+func Title(code string) (string, bool) {
+	title, ok := titles[code]
+	return title, ok
+}
+
+// Error is an API error. Status, Code, Data, and Retry are sent to the
+// client; Err is the underlying cause (if any), which is logged but not
+// sent.
+type Error struct {
+	Status int
+	Code   string
+	Data   map[string]interface{}
+	Retry  *Retry
+	Err    error
+}
+
+// Retry is machine-readable advice on whether a client should retry a
+// request that failed, so clients don't have to guess from the status
+// code. Errors without it may or may not succeed if retried unchanged.
+type Retry struct {
+	Retryable bool `json:"retryable" xml:"retryable"`
+
+	// AfterSeconds is the suggested delay before retrying, which clients
+	// should increase exponentially (with jitter) if the retry fails too.
+	// It's zero if the request isn't retryable.
+	AfterSeconds int `json:"after_seconds,omitempty" xml:"after_seconds,omitempty"`
+}
+
+// New returns a new API error with the given status and code.
+func New(status int, code string) *Error {
+	return &Error{Status: status, Code: code}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Code + ": " + e.Err.Error()
+	}
+	return e.Code
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an *Error with the same code, so that
+// errors.Is(err, apierr.NotFound()) works as expected.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithData returns a copy of e with the given structured data.
+func (e *Error) WithData(data map[string]interface{}) *Error {
+	copy := *e
+	copy.Data = data
+	return &copy
+}
+
+// WithRetry returns a copy of e with the given retry advice.
+func (e *Error) WithRetry(retryable bool, afterSeconds int) *Error {
+	copy := *e
+	copy.Retry = &Retry{Retryable: retryable, AfterSeconds: afterSeconds}
+	return &copy
+}
+
+// WithCause returns a copy of e with the given underlying cause.
+func (e *Error) WithCause(err error) *Error {
+	copy := *e
+	copy.Err = err
+	return &copy
+}
+
+func AlreadyExists() *Error {
+	return New(http.StatusConflict, CodeAlreadyExists)
+}
+
+// Conflict returns an error for a write based on a stale version of a
+// resource.
+func Conflict() *Error {
+	return New(http.StatusConflict, CodeConflict)
+}
+
+// Database returns an error for an unexpected database failure. These
+// are usually transient, so they're retryable.
+func Database(cause error) *Error {
+	return New(http.StatusInternalServerError, CodeDatabase).WithRetry(true, 1).WithCause(cause)
+}
+
+// DatabaseFull returns an error for a write the database has no room for,
+// which won't succeed if retried until something is deleted.
+func DatabaseFull(cause error) *Error {
+	return New(http.StatusInsufficientStorage, CodeDatabaseFull).WithRetry(false, 0).WithCause(cause)
+}
+
+// Forbidden returns an error for a request the client isn't allowed to
+// make, such as an admin-only request without admin credentials.
+func Forbidden() *Error {
+	return New(http.StatusForbidden, CodeForbidden)
+}
+
+// Gone returns an error for a route or resource that's been removed for
+// good, which won't succeed if retried.
+func Gone() *Error {
+	return New(http.StatusGone, CodeGone).WithRetry(false, 0)
+}
+
+// IdempotencyKeyReused returns an error for a request that reuses an
+// idempotency key from an earlier request with different content.
+func IdempotencyKeyReused() *Error {
+	return New(http.StatusUnprocessableEntity, CodeIdempotencyKeyReused)
+}
+
+// Internal returns an error for an unexpected server failure.
+func Internal(cause error) *Error {
+	return New(http.StatusInternalServerError, CodeInternal).WithCause(cause)
+}
+
+// InvalidID returns an error for a URL with an ID in its path that can't
+// be valid, with the issues keyed by the name of the path parameter, as
+// for Validation.
+func InvalidID(issues map[string]interface{}) *Error {
+	return New(http.StatusBadRequest, CodeInvalidID).WithData(issues)
+}
+
+// Maintenance returns an error for a request made while the server is
+// down for maintenance, which can be retried after the given number of
+// seconds.
+func Maintenance(afterSeconds int) *Error {
+	return New(http.StatusServiceUnavailable, CodeMaintenance).WithRetry(true, afterSeconds)
+}
+
+// MalformedJSON returns an error for a request body that isn't valid JSON
+// (or doesn't match the expected structure).
+func MalformedJSON(cause error) *Error {
+	data := map[string]interface{}{"message": cause.Error()}
+	return New(http.StatusBadRequest, CodeMalformedJSON).WithData(data)
+}
+
+func MethodNotAllowed() *Error {
+	return New(http.StatusMethodNotAllowed, CodeMethodNotAllowed)
+}
+
+func NotFound() *Error {
+	return New(http.StatusNotFound, CodeNotFound)
+}
+
+// OutOfStock returns an error for a purchase of an item that has none
+// left.
+func OutOfStock() *Error {
+	return New(http.StatusConflict, CodeOutOfStock).WithRetry(false, 0)
+}
+
+// Overloaded returns an error for a request turned away because the
+// server is too busy, which can be retried after a short delay.
+func Overloaded() *Error {
+	return New(http.StatusServiceUnavailable, CodeOverloaded).WithRetry(true, 1)
+}
+
+// PaymentDeclined returns an error for a payment the payment provider
+// refused.
+func PaymentDeclined() *Error {
+	return New(http.StatusPaymentRequired, CodePaymentDeclined).WithRetry(false, 0)
+}
+
+// PreconditionRequired returns an error for a write that must say which
+// version of a resource it's based on, but didn't.
+func PreconditionRequired() *Error {
+	return New(http.StatusPreconditionRequired, CodePreconditionRequired)
+}
+
+// RateLimited returns an error for a client that's made too many
+// requests, which can retry after the given number of seconds.
+func RateLimited(afterSeconds int) *Error {
+	return New(http.StatusTooManyRequests, CodeRateLimited).WithRetry(true, afterSeconds)
+}
+
+// ReadOnly returns an error for a write made while the server is in
+// read-only mode, which can be retried after the given number of seconds.
+func ReadOnly(afterSeconds int) *Error {
+	return New(http.StatusServiceUnavailable, CodeReadOnly).WithRetry(true, afterSeconds)
+}
+
+// Referenced returns an error for a resource that can't be deleted because
+// other resources refer to it.
+func Referenced() *Error {
+	return New(http.StatusConflict, CodeReferenced)
+}
+
+// Timeout returns an error for a request that took too long to handle.
+// It may have been slow because the server was busy, so it's retryable
+// after a longer delay than Overloaded.
+func Timeout() *Error {
+	return New(http.StatusServiceUnavailable, CodeTimeout).WithRetry(true, 2)
+}
+
+// TooLarge returns an error for a request body bigger than maxBytes.
+func TooLarge(maxBytes int) *Error {
+	data := map[string]interface{}{"max_bytes": maxBytes}
+	return New(http.StatusRequestEntityTooLarge, CodeTooLarge).WithData(data)
+}
+
+// Unauthorized returns an error for a request with invalid credentials.
+func Unauthorized() *Error {
+	return New(http.StatusUnauthorized, CodeUnauthorized)
+}
+
+// Unavailable returns an error for when a dependency like the database
+// is down, which is retryable, but not immediately.
+func Unavailable(cause error) *Error {
+	return New(http.StatusServiceUnavailable, CodeUnavailable).WithRetry(true, 5).WithCause(cause)
+}
+
+// UnsupportedMediaType returns an error for a request body that isn't one
+// of the supported media types.
+func UnsupportedMediaType(supported []string) *Error {
+	data := map[string]interface{}{"supported": supported}
+	return New(http.StatusUnsupportedMediaType, CodeUnsupportedMedia).WithData(data)
+}
+
+// Validation returns an error for invalid input, with issues keyed by
+// field name.
+func Validation(issues map[string]interface{}) *Error {
+	return New(http.StatusBadRequest, CodeValidation).WithData(issues)
+}
+
+// Mapping maps domain errors to the API errors they're reported as.
+type Mapping []MappingEntry
+
+// MappingEntry is a single entry in a Mapping: errors matching Err (using
+// errors.Is) are reported as API.
+type MappingEntry struct {
+	Err error
+	API *Error
+}
+
+// Lookup returns the API error to report err as. The first entry in the
+// mapping that matches err wins; otherwise if err is (or wraps) an *Error,
+// that's returned. Anything else is an internal error.
+func (m Mapping) Lookup(err error) *Error {
+	for _, entry := range m {
+		if errors.Is(err, entry.Err) {
+			return entry.API.WithCause(err)
+		}
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return Internal(err)
+}
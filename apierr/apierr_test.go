@@ -0,0 +1,118 @@
+package apierr_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+var (
+	errMissing = errors.New("missing")
+	errFull    = errors.New("full")
+)
+
+var mapping = apierr.Mapping{
+	{Err: errMissing, API: apierr.NotFound()},
+	{Err: errFull, API: apierr.DatabaseFull(nil)},
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"sentinel", errMissing, http.StatusNotFound, "not-found"},
+		{"wrapped sentinel", fmt.Errorf("getting album: %w", errFull), http.StatusInsufficientStorage, "database-full"},
+		{"sentinel inside API error", apierr.Database(errMissing), http.StatusNotFound, "not-found"},
+		{"API error", apierr.Timeout(), http.StatusServiceUnavailable, "timeout"},
+		{"wrapped API error", fmt.Errorf("x: %w", apierr.Database(errors.New("boom"))), http.StatusInternalServerError, "database"},
+		{"unknown", errors.New("boom"), http.StatusInternalServerError, "internal"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := mapping.Lookup(test.err)
+			if got.Status != test.status || got.Code != test.code {
+				t.Fatalf("got %d %q, want %d %q", got.Status, got.Code, test.status, test.code)
+			}
+			if !errors.Is(got, test.err) && !errors.Is(test.err, got) {
+				t.Fatalf("%v should wrap or be %v", got, test.err)
+			}
+		})
+	}
+}
+
+func TestError(t *testing.T) {
+	err := apierr.Database(errors.New("connection refused"))
+	if err.Error() != "database: connection refused" {
+		t.Fatalf("bad Error(): %q", err.Error())
+	}
+	if !errors.Is(err, apierr.Database(nil)) {
+		t.Fatalf("errors.Is should match by code")
+	}
+	if errors.Is(err, apierr.Internal(nil)) {
+		t.Fatalf("errors.Is shouldn't match different code")
+	}
+
+	data := map[string]interface{}{"id": "x"}
+	withData := apierr.NotFound().WithData(data)
+	if withData.Data["id"] != "x" || apierr.NotFound().Data != nil {
+		t.Fatalf("WithData should return a modified copy")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		err  *apierr.Error
+		want *apierr.Retry
+	}{
+		{apierr.Database(nil), &apierr.Retry{Retryable: true, AfterSeconds: 1}},
+		{apierr.DatabaseFull(nil), &apierr.Retry{Retryable: false}},
+		{apierr.Overloaded(), &apierr.Retry{Retryable: true, AfterSeconds: 1}},
+		{apierr.RateLimited(30), &apierr.Retry{Retryable: true, AfterSeconds: 30}},
+		{apierr.Timeout(), &apierr.Retry{Retryable: true, AfterSeconds: 2}},
+		{apierr.Unavailable(nil), &apierr.Retry{Retryable: true, AfterSeconds: 5}},
+		{apierr.Internal(nil), nil},
+		{apierr.NotFound(), nil},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.err.Retry, test.want) {
+			t.Errorf("%s: got retry %+v, want %+v", test.err.Code, test.err.Retry, test.want)
+		}
+	}
+
+	// The advice survives mapping, which adds the cause
+	got := mapping.Lookup(fmt.Errorf("wrapped: %w", errFull))
+	if got.Retry == nil || got.Retry.Retryable {
+		t.Fatalf("got retry %+v, want not retryable", got.Retry)
+	}
+}
+
+func TestTitle(t *testing.T) {
+	title, ok := apierr.Title(apierr.CodeNotFound)
+	if !ok || title != "Not found" {
+		t.Fatalf("got %q, %v", title, ok)
+	}
+	_, ok = apierr.Title("no-such-code")
+	if ok {
+		t.Fatalf("unknown code has a title")
+	}
+
+	// Every error constructor's code has a title
+	for _, err := range []*apierr.Error{
+		apierr.AlreadyExists(), apierr.Conflict(), apierr.Database(nil), apierr.DatabaseFull(nil),
+		apierr.Forbidden(), apierr.IdempotencyKeyReused(), apierr.Internal(nil),
+		apierr.Maintenance(1), apierr.MalformedJSON(errors.New("x")), apierr.MethodNotAllowed(), apierr.NotFound(),
+		apierr.Overloaded(), apierr.PreconditionRequired(), apierr.RateLimited(1), apierr.ReadOnly(1), apierr.Referenced(), apierr.Timeout(),
+		apierr.TooLarge(1), apierr.Unavailable(nil), apierr.UnsupportedMediaType(nil), apierr.Validation(nil),
+	} {
+		if _, ok := apierr.Title(err.Code); !ok {
+			t.Errorf("code %q has no title", err.Code)
+		}
+	}
+}
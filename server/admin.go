@@ -0,0 +1,59 @@
+// Admin access using a shared bearer token
+
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// WithAdminToken sets the token that admin requests must send in an
+// "Authorization: Bearer <token>" header. With the default of no token,
+// admin-only requests are always forbidden.
+func WithAdminToken(token string) Option {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
+// adminTokenAuthenticator authenticates requests with the admin token.
+// Other bearer tokens are passed on to the rest of the chain, as they may
+// be for another scheme.
+type adminTokenAuthenticator struct {
+	token string
+}
+
+func (a adminTokenAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	if a.token == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return Principal{}, ErrNoCredentials
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		return Principal{}, ErrNoCredentials
+	}
+	return Principal{ID: "admin", Role: RoleAdmin}, nil
+}
+
+// isAdmin reports whether the request was made by an admin: with the admin
+// token, or credentials another authenticator gives the admin role.
+func (s *Server) isAdmin(r *http.Request) bool {
+	return s.principal(r).Role >= RoleAdmin
+}
+
+// requireAdmin writes a 403 Forbidden error if the request isn't from an
+// admin. It returns true if the request is from an admin; the
+// caller should return from the handler early if it returns false.
+func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !s.isAdmin(r) {
+		s.writeError(w, r, apierr.Forbidden())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+// Tests for admin access
+
+package server
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+func TestIsAdmin(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          bool
+	}{
+		{"valid", "s3cret", "Bearer s3cret", true},
+		{"wrong-token", "s3cret", "Bearer s3cre", false},
+		{"wrong-scheme", "s3cret", "Basic s3cret", false},
+		{"missing", "s3cret", "", false},
+		{"no-token-configured", "", "Bearer ", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithAdminToken(test.token))
+			request := newRequest(t, "GET", "/albums", nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			got := server.isAdmin(request)
+			if got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+// Admin HTML interface for browsing, adding, and deleting albums
+//
+// The pages are rendered on the server from templates embedded in the
+// binary, so operators only need a browser. Logging in with the admin
+// token sets a session cookie, which only the admin UI accepts: the API
+// still needs the token in the Authorization header, so a page on another
+// site can't use the cookie to call it. Each form has a CSRF token derived
+// from the session, and the cookie is SameSite=Strict as well.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+const (
+	adminSessionCookie = "admin_session"
+	adminSessionTTL    = 12 * time.Hour
+)
+
+//go:embed templates/admin/*.html
+var adminTemplateFiles embed.FS
+
+var adminTemplates = template.Must(template.ParseFS(adminTemplateFiles, "templates/admin/*.html"))
+
+// adminPage is the data for an admin UI template. CSRFToken is only set
+// when the user is logged in.
+type adminPage struct {
+	Title     string
+	Tenant    string
+	CSRFToken string
+	Errors    []string
+	Albums    []adminAlbum
+	Form      adminAlbumForm
+}
+
+// adminAlbum is an album as listed in the admin UI. DeleteURL is the path
+// its delete form posts to, with the ID escaped, as html/template doesn't
+// escape slashes or question marks in URLs.
+type adminAlbum struct {
+	ID        string
+	Title     string
+	Artist    string
+	Price     string
+	Published bool
+	DeleteURL string
+}
+
+// adminAlbumForm is the input of the add album form, so it can be shown
+// again if it's not valid.
+type adminAlbumForm struct {
+	ID     string
+	Title  string
+	Artist string
+	Price  string
+}
+
+// adminSessionMAC returns the signature of an admin session cookie (or,
+// with the "csrf" purpose, the CSRF token for a session). It's keyed by
+// the admin token, so changing the token logs everyone out.
+func (s *Server) adminSessionMAC(purpose, value string) string {
+	mac := hmac.New(sha256.New, []byte(s.adminToken))
+	mac.Write([]byte("admin-" + purpose + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newAdminSession returns a session cookie value, which is its expiry time
+// and signature.
+func (s *Server) newAdminSession() string {
+	expires := strconv.FormatInt(s.now().Add(adminSessionTTL).Unix(), 10)
+	return expires + "." + s.adminSessionMAC("session", expires)
+}
+
+// adminSession returns the request's admin session cookie value, or "" if
+// it doesn't have a valid one.
+func (s *Server) adminSession(r *http.Request) string {
+	if s.adminToken == "" {
+		return ""
+	}
+	cookie, err := r.Cookie(adminSessionCookie)
+	if err != nil {
+		return ""
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.adminSessionMAC("session", parts[0]))) {
+		return ""
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || !s.now().Before(time.Unix(expires, 0)) {
+		return ""
+	}
+	return cookie.Value
+}
+
+// setAdminSessionCookie sets the session cookie, or clears it if value is
+// empty.
+func setAdminSessionCookie(w http.ResponseWriter, r *http.Request, value string) {
+	cookie := &http.Cookie{
+		Name:     adminSessionCookie,
+		Value:    value,
+		Path:     "/admin",
+		MaxAge:   int(adminSessionTTL / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// adminUIAllowed reports whether the admin UI can be used for this
+// request's tenant. The session is for the admin token, which isn't for a
+// tenant, so that's only allowed with WithCrossTenantAdmin.
+func (s *Server) adminUIAllowed(w http.ResponseWriter) bool {
+	if s.tenants != nil && !s.crossTenantAdmin {
+		s.writeAdminPage(w, http.StatusForbidden, "error.html", adminPage{
+			Title:  "Forbidden",
+			Errors: []string{"admin credentials that aren't for a tenant can't access tenants' data"},
+		})
+		return false
+	}
+	return true
+}
+
+// adminAction checks that a form submission is from a logged-in admin,
+// with the right CSRF token. It returns the request with an admin
+// Principal (for auditing) and true on success; otherwise it writes an
+// error page and returns false.
+func (s *Server) adminAction(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if !s.adminUIAllowed(w) {
+		return nil, false
+	}
+	session := s.adminSession(r)
+	if session == "" {
+		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+		return nil, false
+	}
+	want := s.adminSessionMAC("csrf", session)
+	if !hmac.Equal([]byte(r.PostFormValue("csrf_token")), []byte(want)) {
+		s.writeAdminPage(w, http.StatusForbidden, "error.html", adminPage{
+			Title:  "Forbidden",
+			Errors: []string{"The form has expired or came from another site. Go back, reload the page, and try again."},
+		})
+		return nil, false
+	}
+	principal := Principal{ID: "admin", Role: RoleAdmin}
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)), true
+}
+
+func (s *Server) getAdmin(w http.ResponseWriter, r *http.Request) {
+	if !s.adminUIAllowed(w) {
+		return
+	}
+	session := s.adminSession(r)
+	if session == "" {
+		s.writeAdminPage(w, http.StatusOK, "login.html", adminPage{Title: "Log in"})
+		return
+	}
+	s.writeAdminAlbums(w, r, session, http.StatusOK, adminAlbumForm{}, nil)
+}
+
+func (s *Server) postAdminLogin(w http.ResponseWriter, r *http.Request) {
+	if !s.adminUIAllowed(w) {
+		return
+	}
+	token := r.PostFormValue("token")
+	if s.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		s.writeAdminPage(w, http.StatusUnauthorized, "login.html", adminPage{
+			Title:  "Log in",
+			Errors: []string{"That isn't the admin token."},
+		})
+		return
+	}
+	setAdminSessionCookie(w, r, s.newAdminSession())
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+func (s *Server) postAdminLogout(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.adminAction(w, r); !ok {
+		return
+	}
+	setAdminSessionCookie(w, r, "")
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+func (s *Server) postAdminAlbum(w http.ResponseWriter, r *http.Request) {
+	r, ok := s.adminAction(w, r)
+	if !ok {
+		return
+	}
+	form := adminAlbumForm{
+		ID:     strings.TrimSpace(r.PostFormValue("id")),
+		Title:  strings.TrimSpace(r.PostFormValue("title")),
+		Artist: strings.TrimSpace(r.PostFormValue("artist")),
+		Price:  strings.TrimSpace(r.PostFormValue("price")),
+	}
+	// The price is validated like a JSON number, so the price input rules
+	// are the same as the API's
+	input := albumInput{
+		Album: Album{ID: form.ID, Title: form.Title, Artist: form.Artist},
+		Price: json.RawMessage(form.Price),
+	}
+	session := s.adminSession(r)
+	album, issues, err := s.validateAlbum(input, "")
+	if err != nil {
+		err = apierr.Database(err)
+	} else if len(issues) > 0 {
+		err = apierr.Validation(issues)
+	} else {
+		_, err = s.createAlbum(r, album)
+	}
+	if err != nil {
+		s.writeAdminAlbums(w, r, session, errorMapping.Lookup(err).Status, form, err)
+		return
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+func (s *Server) postAdminDeleteAlbum(w http.ResponseWriter, r *http.Request, id string) {
+	r, ok := s.adminAction(w, r)
+	if !ok {
+		return
+	}
+	err := s.removeAlbum(r, id, false)
+	if err != nil {
+		s.writeAdminAlbums(w, r, s.adminSession(r), errorMapping.Lookup(err).Status, adminAlbumForm{}, err)
+		return
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// writeAdminAlbums writes the album list page, with the add album form
+// filled in with form, and err described if it's not nil. Albums that
+// haven't been published yet are listed too, but not deleted ones.
+func (s *Server) writeAdminAlbums(w http.ResponseWriter, r *http.Request, session string, status int, form adminAlbumForm, err error) {
+	page := adminPage{
+		Title:     "Albums",
+		CSRFToken: s.adminSessionMAC("csrf", session),
+		Form:      form,
+	}
+	if err != nil {
+		page.Errors = s.adminErrors(r, err)
+	}
+	albums, dbErr := s.db.GetAlbums()
+	if dbErr != nil {
+		s.log.Printf("error fetching albums for admin UI: %v", dbErr)
+		page.Errors = append(page.Errors, "Couldn't fetch albums: "+s.errorTitle(r, apierr.Database(dbErr)))
+		status = http.StatusInternalServerError
+	}
+	locale := matchLocale(r.Header.Get("Accept-Language"))
+	for _, album := range albums {
+		if album.DeletedAt != nil {
+			continue
+		}
+		page.Albums = append(page.Albums, adminAlbum{
+			ID:        album.ID,
+			Title:     album.Title,
+			Artist:    album.Artist,
+			Price:     locale.formatPrice(album.Price),
+			Published: album.published(s.now()),
+			DeleteURL: "/admin/albums/" + url.PathEscape(album.ID) + "/delete",
+		})
+	}
+	s.writeAdminPage(w, status, "albums.html", page)
+}
+
+// adminErrors describes an error for an admin UI page, with a line for
+// each validation issue.
+func (s *Server) adminErrors(r *http.Request, err error) []string {
+	apiErr := errorMapping.Lookup(err)
+	if apiErr.Status >= 500 {
+		s.log.Printf("error handling %s %s: %v", r.Method, r.URL.Path, apiErr)
+	}
+	if apiErr.Code != apierr.CodeValidation {
+		message := s.errorTitle(r, apiErr)
+		if detail, ok := apiErr.Data["message"].(string); ok {
+			message += ": " + detail
+		}
+		return []string{message}
+	}
+	var errors []string
+	for field, issue := range apiErr.Data {
+		message := field + ": " + fmt.Sprint(issue)
+		if issue, ok := issue.(validationIssue); ok {
+			message = field + ": " + issue.Error
+			if issue.Message != "" {
+				message = field + ": " + issue.Message
+			}
+		}
+		errors = append(errors, message)
+	}
+	sort.Strings(errors)
+	return errors
+}
+
+// writeAdminPage renders the named admin UI template. The pages aren't
+// cached, can't be framed by other sites, and can only load their own
+// inline styles.
+func (s *Server) writeAdminPage(w http.ResponseWriter, status int, name string, page adminPage) {
+	page.Tenant = s.tenant
+	var buf bytes.Buffer
+	err := adminTemplates.ExecuteTemplate(&buf, name, page)
+	if err != nil {
+		s.log.Printf("error rendering admin template %s: %v", name, err)
+		http.Error(w, "error rendering page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		s.log.Printf("error writing HTML: %v", err)
+	}
+}
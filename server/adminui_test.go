@@ -0,0 +1,233 @@
+// Tests for the admin HTML interface
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var reCSRFToken = regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`)
+
+// postAdminForm posts the form to the admin UI with the session cookie (if
+// not nil).
+func postAdminForm(t *testing.T, server *Server, path string, cookie *http.Cookie, form url.Values) *http.Response {
+	t.Helper()
+	request := newRequest(t, "POST", path, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	return serve(t, server, request)
+}
+
+// getAdminPage fetches the admin UI's home page, returning its HTML.
+func getAdminPage(t *testing.T, server *Server, cookie *http.Cookie) string {
+	t.Helper()
+	request := newRequest(t, "GET", "/admin", nil)
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	if result.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("got Content-Type %q, want HTML", result.Header.Get("Content-Type"))
+	}
+	b, err := io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func adminLogin(t *testing.T, server *Server) *http.Cookie {
+	t.Helper()
+	result := postAdminForm(t, server, "/admin/login", nil, url.Values{"token": {testAdminToken}})
+	ensureStatus(t, result, http.StatusSeeOther)
+	for _, cookie := range result.Cookies() {
+		if cookie.Name == adminSessionCookie && cookie.HttpOnly && cookie.SameSite == http.SameSiteStrictMode {
+			return cookie
+		}
+	}
+	t.Fatalf("no session cookie in %v", result.Header["Set-Cookie"])
+	return nil
+}
+
+func TestAdminUI(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000})
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithAuditStore(NewMemoryAuditStore()),
+	)
+
+	// Logging in needs the admin token
+	page := getAdminPage(t, server, nil)
+	if !strings.Contains(page, `name="token"`) {
+		t.Fatalf("no login form in page:\n%s", page)
+	}
+	result := postAdminForm(t, server, "/admin/login", nil, url.Values{"token": {"wrong"}})
+	ensureStatus(t, result, http.StatusUnauthorized)
+	cookie := adminLogin(t, server)
+
+	page = getAdminPage(t, server, cookie)
+	if !strings.Contains(page, "9th Symphony") || !strings.Contains(page, "Hey Jude") {
+		t.Fatalf("albums not listed in page:\n%s", page)
+	}
+	matches := reCSRFToken.FindStringSubmatch(page)
+	if matches == nil {
+		t.Fatalf("no CSRF token in page:\n%s", page)
+	}
+	csrfToken := matches[1]
+
+	// Forms need the CSRF token for the session
+	form := url.Values{"id": {"a3"}, "title": {"Abbey Road"}, "artist": {"The Beatles"}, "price": {"1600"}}
+	result = postAdminForm(t, server, "/admin/albums", cookie, form)
+	ensureStatus(t, result, http.StatusForbidden)
+	form.Set("csrf_token", strings.Repeat("0", len(csrfToken)))
+	result = postAdminForm(t, server, "/admin/albums", cookie, form)
+	ensureStatus(t, result, http.StatusForbidden)
+	form.Set("csrf_token", csrfToken)
+	result = postAdminForm(t, server, "/admin/albums", nil, form)
+	ensureStatus(t, result, http.StatusSeeOther)
+	if _, err := server.db.GetAlbumByID("a3"); err == nil {
+		t.Fatal("album added without a session")
+	}
+
+	// Adding an album
+	result = postAdminForm(t, server, "/admin/albums", cookie, form)
+	ensureStatus(t, result, http.StatusSeeOther)
+	album, err := server.db.GetAlbumByID("a3")
+	if err != nil || album.Title != "Abbey Road" || album.Price != 1600 {
+		t.Fatalf("got album %+v, %v", album, err)
+	}
+	entries, err := server.auditStore.GetAuditEntries(AuditFilter{})
+	if err != nil || len(entries) != 1 || entries[0].Actor != "admin" {
+		t.Fatalf("got audit entries %+v, %v", entries, err)
+	}
+
+	// Invalid input is shown again with the validation issues
+	form = url.Values{"csrf_token": {csrfToken}, "title": {"Help!"}, "price": {"abc"}}
+	result = postAdminForm(t, server, "/admin/albums", cookie, form)
+	ensureStatus(t, result, http.StatusBadRequest)
+	b, _ := io.ReadAll(result.Body)
+	for _, want := range []string{"artist: required", "price: price must be a number", `value="Help!"`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("page doesn't contain %q:\n%s", want, b)
+		}
+	}
+	form = url.Values{"csrf_token": {csrfToken}, "id": {"a1"}, "title": {"Help!"}, "artist": {"The Beatles"}}
+	result = postAdminForm(t, server, "/admin/albums", cookie, form)
+	ensureStatus(t, result, http.StatusConflict)
+
+	// Deleting an album
+	result = postAdminForm(t, server, "/admin/albums/a1/delete", cookie, url.Values{"csrf_token": {csrfToken}})
+	ensureStatus(t, result, http.StatusSeeOther)
+	if page := getAdminPage(t, server, cookie); strings.Contains(page, "9th Symphony") {
+		t.Fatalf("deleted album listed in page:\n%s", page)
+	}
+	result = postAdminForm(t, server, "/admin/albums/a1/delete", cookie, url.Values{"csrf_token": {csrfToken}})
+	ensureStatus(t, result, http.StatusNotFound)
+
+	// The session cookie isn't accepted by the API
+	request := newRequest(t, "GET", "/audit", nil)
+	request.AddCookie(cookie)
+	result = serve(t, server, request)
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+
+	// Logging out clears the cookie
+	result = postAdminForm(t, server, "/admin/logout", cookie, url.Values{"csrf_token": {csrfToken}})
+	ensureStatus(t, result, http.StatusSeeOther)
+	cookies := result.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != adminSessionCookie || cookies[0].MaxAge >= 0 {
+		t.Fatalf("cookie not cleared: %v", result.Header["Set-Cookie"])
+	}
+}
+
+func TestAdminUIDeleteEscapedID(t *testing.T) {
+	// IDs can have characters that aren't allowed in a path segment
+	db := NewMemoryDatabase()
+	for _, id := range []string{"a/b", "x?y#z"} {
+		db.AddAlbum(Album{ID: id, Title: "Title " + id, Artist: "Artist", Price: 100})
+	}
+	server := NewServer(db, log.New(io.Discard, "", 0), WithAdminToken(testAdminToken))
+	cookie := adminLogin(t, server)
+	page := getAdminPage(t, server, cookie)
+	csrfToken := reCSRFToken.FindStringSubmatch(page)[1]
+	for _, path := range []string{"/admin/albums/a%2Fb/delete", "/admin/albums/x%3Fy%23z/delete"} {
+		if !strings.Contains(page, `action="`+path+`"`) {
+			t.Fatalf("no form for %s in page:\n%s", path, page)
+		}
+		result := postAdminForm(t, server, path, cookie, url.Values{"csrf_token": {csrfToken}})
+		ensureStatus(t, result, http.StatusSeeOther)
+	}
+	albums, err := db.GetAlbums()
+	if err != nil || len(albums) != 2 || albums[0].DeletedAt == nil || albums[1].DeletedAt == nil {
+		t.Fatalf("albums not deleted: %+v, %v", albums, err)
+	}
+}
+
+func TestAdminSession(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return now }),
+	)
+	cookie := adminLogin(t, server)
+	request := newRequest(t, "GET", "/admin", nil)
+	request.AddCookie(cookie)
+	if server.adminSession(request) == "" {
+		t.Fatal("session not valid")
+	}
+
+	// Sessions expire, and can't be forged or used with another token
+	now = now.Add(adminSessionTTL)
+	if server.adminSession(request) != "" {
+		t.Fatal("expired session still valid")
+	}
+	now = now.Add(-time.Minute)
+	forged := request.Clone(request.Context())
+	forged.Header.Del("Cookie")
+	forged.AddCookie(&http.Cookie{Name: adminSessionCookie, Value: "99999999999." + strings.Repeat("0", 64)})
+	if server.adminSession(forged) != "" {
+		t.Fatal("forged session valid")
+	}
+	server = NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithAdminToken("another-token"),
+		WithClock(func() time.Time { return now }),
+	)
+	if server.adminSession(request) != "" {
+		t.Fatal("session valid after changing the admin token")
+	}
+
+	// Without an admin token no one can log in
+	server = NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0))
+	result := postAdminForm(t, server, "/admin/login", nil, url.Values{"token": {""}})
+	ensureStatus(t, result, http.StatusUnauthorized)
+}
+
+func TestAdminUITenants(t *testing.T) {
+	server := newTenantTestServer(t)
+	request := newRequest(t, "GET", "http://acme.albums.example.com/admin", nil)
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusForbidden)
+
+	server = newTenantTestServer(t, WithCrossTenantAdmin(true))
+	result = postAdminForm(t, server, "http://acme.albums.example.com/admin/login", nil, url.Values{"token": {testAdminToken}})
+	ensureStatus(t, result, http.StatusSeeOther)
+	request = newRequest(t, "GET", "http://acme.albums.example.com/admin", nil)
+	request.AddCookie(result.Cookies()[0])
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	b, _ := io.ReadAll(result.Body)
+	if !strings.Contains(string(b), "Help! (acme)") {
+		t.Fatalf("acme's albums not listed:\n%s", b)
+	}
+}
@@ -0,0 +1,221 @@
+// Wiring of the server's components, with ordered startup and shutdown
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Component is a subsystem with a lifecycle, like the HTTP listener or a
+// store with background work. Start must return once the component is
+// running (long-running work happens in goroutines), and Stop must stop
+// it, returning early with an error if ctx is done first.
+type Component interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+// failer is implemented by components that can fail after they've started,
+// for example a listener whose Serve returns an error. The channel
+// receives at most one error, and is closed once the component has
+// stopped running.
+type failer interface {
+	Failed() <-chan error
+}
+
+// App runs a set of components: they're started in the order they were
+// added, and stopped in reverse order, so each component can rely on the
+// ones added before it. Embedders can add their own components alongside
+// the server's.
+type App struct {
+	log        *log.Logger
+	components []namedComponent
+	started    int // number of components started, from the start
+}
+
+type namedComponent struct {
+	name string
+	Component
+}
+
+// NewApp creates an app with no components that logs to log.
+func NewApp(log *log.Logger) *App {
+	return &App{log: log}
+}
+
+// Add adds a component to be started after those already added. It must
+// be called before Start.
+func (a *App) Add(name string, component Component) {
+	a.components = append(a.components, namedComponent{name, component})
+}
+
+// Start starts the components in order. If one fails to start, it stops
+// the ones already started (in reverse order) and returns the start error
+// along with any errors stopping them.
+func (a *App) Start(ctx context.Context) error {
+	for _, c := range a.components[a.started:] {
+		err := c.Start(ctx)
+		if err != nil {
+			err = fmt.Errorf("starting %s: %w", c.name, err)
+			stopErr := a.Stop(ctx)
+			if stopErr != nil {
+				return componentErrors{err, stopErr}
+			}
+			return err
+		}
+		a.started++
+	}
+	return nil
+}
+
+// Stop stops the started components in reverse order. It stops every
+// component even if some fail, and returns all the errors together.
+func (a *App) Stop(ctx context.Context) error {
+	var errs componentErrors
+	for ; a.started > 0; a.started-- {
+		c := a.components[a.started-1]
+		err := c.Stop(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stopping %s: %w", c.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Run starts the components and waits until ctx is done (for example on
+// SIGTERM) or a component fails, then stops them, allowing up to
+// stopTimeout. It returns the error that caused it to stop, if any, along
+// with any errors stopping.
+func (a *App) Run(ctx context.Context, stopTimeout time.Duration) error {
+	err := a.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	failed := make(chan error, len(a.components))
+	for _, c := range a.components {
+		if f, ok := c.Component.(failer); ok {
+			name, ch := c.name, f.Failed()
+			go func() {
+				err, ok := <-ch
+				if ok {
+					failed <- fmt.Errorf("%s failed: %w", name, err)
+				}
+			}()
+		}
+	}
+	var runErr error
+	select {
+	case <-ctx.Done():
+		a.log.Printf("shutting down")
+	case runErr = <-failed:
+		a.log.Printf("%v, shutting down", runErr)
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	stopErr := a.Stop(stopCtx)
+	switch {
+	case runErr != nil && stopErr != nil:
+		return componentErrors{runErr, stopErr}
+	case runErr != nil:
+		return runErr
+	default:
+		return stopErr
+	}
+}
+
+// componentErrors is a list of errors from several components.
+type componentErrors []error
+
+func (e componentErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Is reports whether any of the errors matches target, so errors.Is works
+// on the list as a whole.
+func (e componentErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start implements Component. The server's background components are
+// started by NewServer, so there's nothing more to do.
+func (s *Server) Start(ctx context.Context) error {
+	return nil
+}
+
+// Stop implements Component by calling Shutdown.
+func (s *Server) Stop(ctx context.Context) error {
+	return s.Shutdown(ctx)
+}
+
+// httpComponent runs an http.Server as a Component. Stopping it stops
+// accepting connections and waits for in-flight requests to finish.
+type httpComponent struct {
+	server *http.Server
+	log    *log.Logger
+	failed chan error
+
+	// inherited is the listener to serve on instead of listening on the
+	// server's address, if it was passed from the process that started
+	// this one (see restarter). listener is the one Start listens on.
+	inherited net.Listener
+	listener  net.Listener
+}
+
+func newHTTPComponent(server *http.Server, log *log.Logger) *httpComponent {
+	return &httpComponent{server: server, log: log, failed: make(chan error, 1)}
+}
+
+// Start listens on the server's address (so that, for example, a port
+// that's already in use fails startup), or uses the inherited listener,
+// and starts serving.
+func (h *httpComponent) Start(ctx context.Context) error {
+	listener := h.inherited
+	if listener != nil {
+		h.log.Printf("listening on http://%s (inherited)", listener.Addr())
+	} else {
+		var err error
+		listener, err = net.Listen("tcp", h.server.Addr)
+		if err != nil {
+			return err
+		}
+		h.log.Printf("listening on http://%s", listener.Addr())
+	}
+	h.listener = listener
+	go func() {
+		err := h.server.Serve(listener)
+		if err != http.ErrServerClosed {
+			h.failed <- err
+		}
+		close(h.failed)
+	}()
+	return nil
+}
+
+func (h *httpComponent) Stop(ctx context.Context) error {
+	return h.server.Shutdown(ctx)
+}
+
+func (h *httpComponent) Failed() <-chan error {
+	return h.failed
+}
@@ -0,0 +1,172 @@
+// Tests for the component wiring
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testComponent records its starts and stops in events.
+type testComponent struct {
+	name     string
+	events   *[]string
+	startErr error
+	stopErr  error
+	failed   chan error
+}
+
+func (c *testComponent) Start(ctx context.Context) error {
+	*c.events = append(*c.events, "start "+c.name)
+	return c.startErr
+}
+
+func (c *testComponent) Stop(ctx context.Context) error {
+	*c.events = append(*c.events, "stop "+c.name)
+	return c.stopErr
+}
+
+func newTestApp(events *[]string, components ...*testComponent) *App {
+	app := NewApp(log.New(io.Discard, "", 0))
+	for _, c := range components {
+		c.events = events
+		app.Add(c.name, c)
+	}
+	return app
+}
+
+func TestAppStartStop(t *testing.T) {
+	var events []string
+	app := newTestApp(&events, &testComponent{name: "a"}, &testComponent{name: "b"}, &testComponent{name: "c"})
+	err := app.Start(context.Background())
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	err = app.Stop(context.Background())
+	if err != nil {
+		t.Fatalf("error stopping: %v", err)
+	}
+	want := []string{"start a", "start b", "start c", "stop c", "stop b", "stop a"}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got events %q, want %q", events, want)
+	}
+
+	// Stopping again does nothing
+	events = nil
+	err = app.Stop(context.Background())
+	if err != nil || len(events) != 0 {
+		t.Fatalf("got events %q, error %v stopping again", events, err)
+	}
+}
+
+func TestAppStartError(t *testing.T) {
+	var events []string
+	errNoPort := errors.New("no port")
+	errStuck := errors.New("stuck")
+	app := newTestApp(&events,
+		&testComponent{name: "a"},
+		&testComponent{name: "b", stopErr: errStuck},
+		&testComponent{name: "c", startErr: errNoPort},
+		&testComponent{name: "d"},
+	)
+	err := app.Start(context.Background())
+	if err == nil || err.Error() != "starting c: no port; stopping b: stuck" {
+		t.Fatalf("got error %v", err)
+	}
+	if !errors.Is(err, errNoPort) || !errors.Is(err, errStuck) {
+		t.Fatalf("errors.Is doesn't match all errors in %v", err)
+	}
+	want := []string{"start a", "start b", "start c", "stop b", "stop a"}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got events %q, want %q", events, want)
+	}
+}
+
+func TestAppStopErrors(t *testing.T) {
+	var events []string
+	app := newTestApp(&events,
+		&testComponent{name: "a", stopErr: errors.New("a error")},
+		&testComponent{name: "b"},
+		&testComponent{name: "c", stopErr: errors.New("c error")},
+	)
+	err := app.Start(context.Background())
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	err = app.Stop(context.Background())
+	if err == nil || err.Error() != "stopping c: c error; stopping a: a error" {
+		t.Fatalf("got error %v", err)
+	}
+	if len(events) != 6 {
+		t.Fatalf("not all components stopped: %q", events)
+	}
+}
+
+func TestAppRun(t *testing.T) {
+	var events []string
+	app := newTestApp(&events, &testComponent{name: "a"}, &testComponent{name: "b"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := app.Run(ctx, time.Second)
+	if err != nil {
+		t.Fatalf("error running: %v", err)
+	}
+	want := []string{"start a", "start b", "stop b", "stop a"}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got events %q, want %q", events, want)
+	}
+}
+
+func TestAppRunFailure(t *testing.T) {
+	db := NewMemoryDatabase()
+	server := NewServer(db, log.New(io.Discard, "", 0))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer listener.Close()
+
+	// The second listener can't use the same port, so startup fails and
+	// the server is stopped again
+	app := NewApp(log.New(io.Discard, "", 0))
+	app.Add("server", server)
+	app.Add("http", newHTTPComponent(&http.Server{Addr: listener.Addr().String(), Handler: server}, log.New(io.Discard, "", 0)))
+	err = app.Run(context.Background(), time.Second)
+	if err == nil || !strings.HasPrefix(err.Error(), "starting http: ") {
+		t.Fatalf("got error %v, want start error", err)
+	}
+}
+
+func TestHTTPComponent(t *testing.T) {
+	server := newTestServer()
+	component := newHTTPComponent(&http.Server{Addr: "127.0.0.1:0", Handler: server}, log.New(io.Discard, "", 0))
+	app := NewApp(log.New(io.Discard, "", 0))
+	app.Add("server", server)
+	app.Add("http", component)
+	err := app.Start(context.Background())
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	err = app.Stop(context.Background())
+	if err != nil {
+		t.Fatalf("error stopping: %v", err)
+	}
+
+	// A clean shutdown isn't a failure
+	select {
+	case err, ok := <-component.Failed():
+		if ok {
+			t.Fatalf("got failure %v after shutdown", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Failed channel not closed after shutdown")
+	}
+}
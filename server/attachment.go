@@ -0,0 +1,374 @@
+// Album attachments, like PDF liner notes: upload, list, download, delete
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Albums can have files attached, like liner notes or lyrics, which are
+// stored in the database's BlobStore like covers. As with covers, uploads
+// are treated as hostile: only PDFs and UTF-8 text are accepted, the type
+// is decided by sniffing the content (and the client's Content-Type must
+// agree), and downloads are always sent as attachments with nosniff and a
+// sandboxing CSP, so a browser never renders one as a page on our origin.
+//
+// Upload with a POST of the raw file to /albums/:id/attachments?filename=x,
+// list with a GET of the same URL, and GET or DELETE
+// /albums/:id/attachments/:attachment_id to download or delete one.
+const (
+	maxAttachmentBytes        = 20 << 20 // size of each file
+	maxAttachmentsPerAlbum    = 20
+	maxAttachmentFilenameSize = 255 // bytes
+)
+
+// attachmentTypes are the accepted attachment types.
+var attachmentTypes = []string{"application/pdf", "text/plain", "text/markdown"}
+
+// Attachment is a file attached to an album.
+type Attachment struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int       `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	// Data is the file's content, which is only set by GetAttachment.
+	// Hash is its SHA-256 hash (the key it's stored by in a BlobStore),
+	// set by the AttachmentStore along with Size.
+	Data []byte `json:"-"`
+	Hash string `json:"-"`
+}
+
+// AttachmentStore is an optional interface a Database can implement to
+// store album attachments. Without it, the attachment endpoints return 404
+// Not Found.
+type AttachmentStore interface {
+	// GetAttachments returns the album's attachments without their data,
+	// oldest first, or ErrDoesNotExist if the album doesn't exist.
+	GetAttachments(albumID string) ([]Attachment, error)
+
+	// GetAttachment returns the attachment with its data, or
+	// ErrDoesNotExist if the album or attachment doesn't exist.
+	GetAttachment(albumID, id string) (Attachment, error)
+
+	// AddAttachment stores a new attachment for the album, returning it
+	// as stored (without its data). It returns ErrDoesNotExist if the
+	// album doesn't exist, and ErrAlreadyExists if it already has an
+	// attachment with the same ID.
+	AddAttachment(albumID string, attachment Attachment) (Attachment, error)
+
+	// DeleteAttachment deletes the attachment, returning ErrDoesNotExist
+	// if the album or attachment doesn't exist. Deleting the album deletes
+	// its attachments too.
+	DeleteAttachment(albumID, id string) error
+}
+
+// errUnsupportedAttachment means the uploaded file isn't one of
+// attachmentTypes.
+var errUnsupportedAttachment = errors.New("unsupported attachment type")
+
+// attachmentType checks that data is an acceptable attachment and returns
+// the content type to store it with. The kind of file (PDF or text) is
+// sniffed from the data; declaredType, the request's Content-Type, must
+// agree if given, and picks between the text types. It returns
+// errUnsupportedAttachment if the file isn't an accepted type, or
+// validation issues if it's not valid.
+func attachmentType(data []byte, declaredType string) (string, map[string]interface{}, error) {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if sniffed != "application/pdf" && sniffed != "text/plain" {
+		return "", nil, errUnsupportedAttachment
+	}
+	contentType := sniffed
+	if declaredType != "" {
+		mediaType, _, _ := mime.ParseMediaType(declaredType)
+		if !isAttachmentType(mediaType) {
+			return "", nil, errUnsupportedAttachment
+		}
+		if (mediaType == "application/pdf") != (sniffed == "application/pdf") {
+			issues := map[string]interface{}{
+				"Content-Type": validationIssue{"mismatch", fmt.Sprintf("Content-Type is %s but the file is %s", mediaType, sniffed)},
+			}
+			return "", issues, nil
+		}
+		contentType = mediaType
+	}
+	if sniffed == "text/plain" {
+		if !utf8.Valid(data) {
+			issues := map[string]interface{}{
+				"attachment": validationIssue{"invalid", "text attachments must be UTF-8"},
+			}
+			return "", issues, nil
+		}
+		contentType += "; charset=utf-8"
+	}
+	return contentType, nil, nil
+}
+
+func isAttachmentType(mediaType string) bool {
+	for _, typ := range attachmentTypes {
+		if mediaType == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFilename returns a validation issue if the attachment filename
+// isn't valid, or nil if it is. It's shown to users and used as the
+// download's filename, so it can't contain a path or control characters.
+func validateFilename(filename string) interface{} {
+	switch {
+	case filename == "":
+		return validationIssue{"required", "filename is required"}
+	case len(filename) > maxAttachmentFilenameSize:
+		return validationIssue{"too-long", fmt.Sprintf("filename must be at most %d bytes", maxAttachmentFilenameSize)}
+	case !utf8.ValidString(filename) || filename == "." || filename == ".." ||
+		strings.ContainsAny(filename, `/\`) || strings.IndexFunc(filename, unicode.IsControl) >= 0:
+		return validationIssue{"invalid", "filename must be a file name without a path or control characters"}
+	}
+	return nil
+}
+
+// attachmentStore returns the database's attachment store, or writes a
+// 404 Not Found error and returns nil if it doesn't have one or the album
+// isn't visible.
+func (s *Server) attachmentStore(w http.ResponseWriter, r *http.Request, albumID string) AttachmentStore {
+	store, ok := s.db.(AttachmentStore)
+	if !ok {
+		s.writeError(w, r, apierr.NotFound())
+		return nil
+	}
+	album, err := s.db.GetAlbumByID(albumID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return nil
+	}
+	if !album.visible(s.now()) {
+		s.writeError(w, r, apierr.NotFound())
+		return nil
+	}
+	return store
+}
+
+func (s *Server) getAttachments(w http.ResponseWriter, r *http.Request, albumID string) {
+	store := s.attachmentStore(w, r, albumID)
+	if store == nil {
+		return
+	}
+	attachments, err := store.GetAttachments(albumID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	if attachments == nil {
+		attachments = []Attachment{}
+	}
+	s.writeJSON(w, r, http.StatusOK, attachments)
+}
+
+func (s *Server) addAttachment(w http.ResponseWriter, r *http.Request, albumID string) {
+	store := s.attachmentStore(w, r, albumID)
+	if store == nil {
+		return
+	}
+	filename := r.URL.Query().Get("filename")
+	if issue := validateFilename(filename); issue != nil {
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{"filename": issue}))
+		return
+	}
+	existing, err := store.GetAttachments(albumID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	if len(existing) >= maxAttachmentsPerAlbum {
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{
+			"attachments": validationIssue{"too-many", fmt.Sprintf("an album can have at most %d attachments", maxAttachmentsPerAlbum)},
+		}))
+		return
+	}
+
+	// Only read the file once everything else is known to be OK
+	data, ok := s.readUpload(w, r, maxAttachmentBytes, "attachment")
+	if !ok {
+		return
+	}
+	contentType, issues, err := attachmentType(data, r.Header.Get("Content-Type"))
+	if errors.Is(err, errUnsupportedAttachment) {
+		s.writeError(w, r, apierr.UnsupportedMediaType(attachmentTypes))
+		return
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+
+	id, err := s.idGenerator.NewID()
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("generating attachment ID: %w", err)))
+		return
+	}
+	attachment, err := store.AddAttachment(albumID, Attachment{
+		ID:          id,
+		Filename:    filename,
+		ContentType: contentType,
+		CreatedAt:   s.now().UTC(),
+		Data:        data,
+	})
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("adding attachment: %w", err)))
+		return
+	}
+	s.audit(r, "create", "attachment", attachment.ID, nil, snapshot(attachment))
+	w.Header().Set("Location", s.albumURL(r, albumID)+"/attachments/"+url.PathEscape(attachment.ID))
+	s.writeJSON(w, r, http.StatusCreated, attachment)
+}
+
+func (s *Server) getAttachment(w http.ResponseWriter, r *http.Request, albumID, id string) {
+	store := s.attachmentStore(w, r, albumID)
+	if store == nil {
+		return
+	}
+	attachment, err := store.GetAttachment(albumID, id)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	s.writeWithETag(w, r, attachment.ContentType, attachment.Data)
+}
+
+func (s *Server) deleteAttachment(w http.ResponseWriter, r *http.Request, albumID, id string) {
+	store := s.attachmentStore(w, r, albumID)
+	if store == nil {
+		return
+	}
+	err := store.DeleteAttachment(albumID, id)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("deleting attachment: %w", err)))
+		return
+	}
+	s.audit(r, "delete", "attachment", id, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetAttachments implements AttachmentStore.
+func (d *MemoryDatabase) GetAttachments(albumID string) ([]Attachment, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	if _, ok := d.albums[albumID]; !ok {
+		return nil, ErrDoesNotExist
+	}
+	return append([]Attachment(nil), d.attachments[albumID]...), nil
+}
+
+// GetAttachment implements AttachmentStore, reading the attachment's
+// content from the blob store.
+func (d *MemoryDatabase) GetAttachment(albumID, id string) (Attachment, error) {
+	d.lock.RLock()
+	var attachment Attachment
+	found := false
+	for _, a := range d.attachments[albumID] {
+		if a.ID == id {
+			attachment, found = a, true
+			break
+		}
+	}
+	d.lock.RUnlock()
+	if !found {
+		return Attachment{}, ErrDoesNotExist
+	}
+	data, err := d.Blobs.Get(attachment.Hash)
+	if err != nil {
+		return Attachment{}, fmt.Errorf("getting attachment blob: %w", err)
+	}
+	attachment.Data = data
+	return attachment, nil
+}
+
+// AddAttachment implements AttachmentStore, storing the attachment's
+// content in the blob store. Attachments count towards MaxBytes.
+func (d *MemoryDatabase) AddAttachment(albumID string, attachment Attachment) (Attachment, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	album, ok := d.albums[albumID]
+	if !ok || album.DeletedAt != nil {
+		return Attachment{}, ErrDoesNotExist
+	}
+	for _, a := range d.attachments[albumID] {
+		if a.ID == attachment.ID {
+			return Attachment{}, ErrAlreadyExists
+		}
+	}
+	size := int64(len(attachment.Data))
+	if d.MaxBytes > 0 && d.bytes+size > d.MaxBytes {
+		return Attachment{}, fmt.Errorf("%w: max bytes %d reached", ErrFull, d.MaxBytes)
+	}
+	hash, err := d.Blobs.Put(attachment.Data)
+	if err != nil {
+		return Attachment{}, fmt.Errorf("putting attachment blob: %w", err)
+	}
+	attachment.Hash = hash
+	attachment.Size = len(attachment.Data)
+	attachment.Data = nil
+	d.attachments[albumID] = append(d.attachments[albumID], attachment)
+	// Keep them oldest first, even if they're added (say, by a backfill)
+	// out of order
+	sort.SliceStable(d.attachments[albumID], func(i, j int) bool {
+		return d.attachments[albumID][i].CreatedAt.Before(d.attachments[albumID][j].CreatedAt)
+	})
+	d.bytes += size
+	return attachment, nil
+}
+
+// DeleteAttachment implements AttachmentStore.
+func (d *MemoryDatabase) DeleteAttachment(albumID, id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	attachments := d.attachments[albumID]
+	for i, attachment := range attachments {
+		if attachment.ID == id {
+			d.attachments[albumID] = append(attachments[:i:i], attachments[i+1:]...)
+			if len(d.attachments[albumID]) == 0 {
+				delete(d.attachments, albumID)
+			}
+			d.releaseAttachment(attachment)
+			return nil
+		}
+	}
+	return ErrDoesNotExist
+}
+
+// releaseAttachments removes all the album's attachments, releasing their
+// blobs. The caller must hold the write lock.
+func (d *MemoryDatabase) releaseAttachments(albumID string) {
+	for _, attachment := range d.attachments[albumID] {
+		d.releaseAttachment(attachment)
+	}
+	delete(d.attachments, albumID)
+}
+
+// releaseAttachment releases a removed attachment's blob. The caller must
+// hold the write lock.
+func (d *MemoryDatabase) releaseAttachment(attachment Attachment) {
+	d.bytes -= int64(attachment.Size)
+	// As for covers, the only possible error is that it's already gone
+	_ = d.Blobs.Release(attachment.Hash)
+}
@@ -0,0 +1,193 @@
+// Tests for album attachments
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testPDF = "%PDF-1.4\n1 0 obj << >> endobj\ntrailer << >>\n%%EOF\n"
+
+func addAttachmentRequest(t *testing.T, albumID, filename, contentType, body string) *http.Request {
+	t.Helper()
+	request := newRequest(t, "POST", "/albums/"+albumID+"/attachments?filename="+filename, strings.NewReader(body))
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	return request
+}
+
+func TestAttachments(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, addAttachmentRequest(t, "a1", "notes.pdf", "application/pdf", testPDF))
+	ensureStatus(t, result, http.StatusCreated)
+	var notes Attachment
+	unmarshalResponse(t, result, &notes)
+	if notes.ID == "" || notes.Filename != "notes.pdf" || notes.ContentType != "application/pdf" || notes.Size != len(testPDF) {
+		t.Fatalf("bad attachment: %#v", notes)
+	}
+	if got, want := result.Header.Get("Location"), "/albums/a1/attachments/"+notes.ID; got != want {
+		t.Fatalf("got Location %q, want %q", got, want)
+	}
+
+	// Text files can be sent as Markdown, and default to plain text
+	result = serve(t, server, addAttachmentRequest(t, "a1", "lyrics.md", "text/markdown", "# Ode to Joy\n"))
+	ensureStatus(t, result, http.StatusCreated)
+	result = serve(t, server, addAttachmentRequest(t, "a1", "credits.txt", "", "Conductor: Karajan\n"))
+	ensureStatus(t, result, http.StatusCreated)
+	var credits Attachment
+	unmarshalResponse(t, result, &credits)
+	if credits.ContentType != "text/plain; charset=utf-8" {
+		t.Fatalf("got content type %q", credits.ContentType)
+	}
+
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/attachments", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var attachments []Attachment
+	unmarshalResponse(t, result, &attachments)
+	if len(attachments) != 3 || attachments[0].ID != notes.ID {
+		t.Fatalf("bad attachments: %#v", attachments)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/albums/a2/attachments", nil))
+	ensureStatus(t, result, http.StatusOK)
+	unmarshalResponse(t, result, &attachments)
+	if len(attachments) != 0 {
+		t.Fatalf("got %d attachments, want 0", len(attachments))
+	}
+
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/attachments/"+notes.ID, nil))
+	ensureStatus(t, result, http.StatusOK)
+	body, _ := io.ReadAll(result.Body)
+	if string(body) != testPDF {
+		t.Fatalf("got body %q", body)
+	}
+	for header, want := range map[string]string{
+		"Content-Type":           "application/pdf",
+		"Content-Disposition":    `attachment; filename=notes.pdf`,
+		"X-Content-Type-Options": "nosniff",
+	} {
+		if got := result.Header.Get(header); got != want {
+			t.Errorf("got %s %q, want %q", header, got, want)
+		}
+	}
+	result = serve(t, server, newRequest(t, "GET", "/albums/a2/attachments/"+notes.ID, nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a1/attachments/"+notes.ID, nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/attachments/"+notes.ID, nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a1/attachments/"+notes.ID, nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestAttachmentLocationEscaped(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a/b c?", Title: "Pianoman", Artist: "Billy Joel"})
+	server := NewServer(db, log.New(io.Discard, "", 0))
+	result := serve(t, server, addAttachmentRequest(t, "a%2Fb%20c%3F", "notes.pdf", "application/pdf", testPDF))
+	ensureStatus(t, result, http.StatusCreated)
+	var notes Attachment
+	unmarshalResponse(t, result, &notes)
+	location := result.Header.Get("Location")
+	if want := "/albums/a%2Fb%20c%3F/attachments/" + notes.ID; location != want {
+		t.Fatalf("got Location %q, want %q", location, want)
+	}
+	result = serve(t, server, newRequest(t, "GET", location, nil))
+	ensureStatus(t, result, http.StatusOK)
+}
+
+func TestAttachmentValidation(t *testing.T) {
+	server := newTestServer()
+	tests := []struct {
+		name        string
+		filename    string
+		contentType string
+		body        string
+		status      int
+		code        string
+		data        map[string]interface{}
+	}{
+		{"no filename", "", "", "text", http.StatusBadRequest, "validation", map[string]interface{}{
+			"filename": map[string]interface{}{"error": "required", "message": "filename is required"},
+		}},
+		{"path", "..%2Fnotes.txt", "", "text", http.StatusBadRequest, "validation", map[string]interface{}{
+			"filename": map[string]interface{}{"error": "invalid", "message": "filename must be a file name without a path or control characters"},
+		}},
+		{"html", "page.html", "", "<html><script>alert(1)</script></html>", http.StatusUnsupportedMediaType, "unsupported-media-type", map[string]interface{}{
+			"supported": []interface{}{"application/pdf", "text/plain", "text/markdown"},
+		}},
+		{"declared html", "notes.txt", "text/html", "text", http.StatusUnsupportedMediaType, "unsupported-media-type", map[string]interface{}{
+			"supported": []interface{}{"application/pdf", "text/plain", "text/markdown"},
+		}},
+		{"mismatch", "notes.pdf", "application/pdf", "not a PDF", http.StatusBadRequest, "validation", map[string]interface{}{
+			"Content-Type": map[string]interface{}{"error": "mismatch", "message": "Content-Type is application/pdf but the file is text/plain"},
+		}},
+		{"binary", "notes.txt", "", "\x00\x01\x02", http.StatusUnsupportedMediaType, "unsupported-media-type", map[string]interface{}{
+			"supported": []interface{}{"application/pdf", "text/plain", "text/markdown"},
+		}},
+		{"not UTF-8", "notes.txt", "text/plain", "caf\xe9", http.StatusBadRequest, "validation", map[string]interface{}{
+			"attachment": map[string]interface{}{"error": "invalid", "message": "text attachments must be UTF-8"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := serve(t, server, addAttachmentRequest(t, "a1", test.filename, test.contentType, test.body))
+			ensureError(t, result, test.status, test.code, test.data)
+		})
+	}
+
+	result := serve(t, server, addAttachmentRequest(t, "a1", "big.txt", "", strings.Repeat("x", maxAttachmentBytes+1)))
+	ensureStatus(t, result, http.StatusRequestEntityTooLarge)
+	result = serve(t, server, addAttachmentRequest(t, "x", "notes.txt", "", "text"))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	for i := 0; i < maxAttachmentsPerAlbum; i++ {
+		ensureStatus(t, serve(t, server, addAttachmentRequest(t, "a2", "notes.txt", "", "text")), http.StatusCreated)
+	}
+	result = serve(t, server, addAttachmentRequest(t, "a2", "notes.txt", "", "text"))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"attachments": map[string]interface{}{"error": "too-many", "message": "an album can have at most 20 attachments"},
+	})
+}
+
+func TestAttachmentBlobs(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles"})
+	blobs := db.Blobs.(*MemoryBlobStore)
+	albumBytes := albumSize(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+
+	// The same file attached to two albums is stored once
+	for _, albumID := range []string{"a1", "a2"} {
+		_, err := db.AddAttachment(albumID, Attachment{ID: "n1", ContentType: "application/pdf", Data: []byte(testPDF)})
+		if err != nil {
+			t.Fatalf("error adding attachment: %v", err)
+		}
+	}
+	hash := blobHash([]byte(testPDF))
+	if refs := blobRefs(blobs, hash); refs != 2 {
+		t.Fatalf("got %d refs, want 2", refs)
+	}
+	if err := db.SoftDeleteAlbum("a2", db.now()); err != nil {
+		t.Fatalf("error deleting album: %v", err)
+	}
+	if _, err := db.AddAttachment("a2", Attachment{ID: "n2", Data: []byte("x")}); err != ErrDoesNotExist {
+		t.Fatalf("got error %v, want ErrDoesNotExist", err)
+	}
+
+	// Releasing the attachments releases their blobs
+	if err := db.DeleteAttachment("a1", "n1"); err != nil {
+		t.Fatalf("error deleting attachment: %v", err)
+	}
+	if _, err := db.PurgeDeletedAlbums(db.now().Add(1)); err != nil {
+		t.Fatalf("error purging albums: %v", err)
+	}
+	if refs := blobRefs(blobs, hash); refs != 0 || db.bytes != albumBytes {
+		t.Fatalf("got %d refs and %d bytes, want 0 and %d", refs, db.bytes, albumBytes)
+	}
+}
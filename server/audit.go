@@ -0,0 +1,227 @@
+// Audit log of changes made through the API
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// AuditEntry records a single change: who made it, when, and what the
+// resource looked like before and after.
+type AuditEntry struct {
+	// ID is assigned by the AuditStore, increasing with each entry.
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+
+	// Actor is who made the change: the ID of the request's Principal,
+	// like "admin" for requests with the admin token, or "anonymous".
+	// ClientIP is where the request came from.
+	Actor    string `json:"actor"`
+	ClientIP string `json:"client_ip"`
+
+	// Action is "create", "update", "delete", or "restore", and Resource
+	// is the type of resource changed ("album", "genre", "order", or "user").
+	Action     string `json:"action"`
+	Resource   string `json:"resource"`
+	ResourceID string `json:"resource_id"`
+
+	// Before and After are JSON snapshots of the resource, as returned by
+	// the API. Before is omitted for creates.
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+
+	// Tenant is the ID of the tenant whose data changed, if there are
+	// tenants (see tenants.go).
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// AuditFilter selects audit entries. Zero fields match all entries, except
+// Tenant: entries are always only for the given tenant, or for no tenant if
+// it's empty, so tenants can't see each other's changes.
+type AuditFilter struct {
+	AlbumID string
+	Since   time.Time // entries at or after this time
+	Until   time.Time // entries before this time
+	Tenant  string
+}
+
+// matches reports whether the entry is selected by the filter.
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	if entry.Tenant != f.Tenant {
+		return false
+	}
+	if f.AlbumID != "" && (entry.Resource != "album" || entry.ResourceID != f.AlbumID) {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditStore is the interface used by the server to record and query the
+// audit log.
+type AuditStore interface {
+	// AddAuditEntry records entry, assigning its ID.
+	AddAuditEntry(entry AuditEntry) error
+
+	// GetAuditEntries returns the entries selected by filter, in the order
+	// they were added.
+	GetAuditEntries(filter AuditFilter) ([]AuditEntry, error)
+}
+
+// WithAuditStore sets the store the server records changes in. The
+// default is no audit log, in which case GET /audit isn't available.
+func WithAuditStore(store AuditStore) Option {
+	return func(s *Server) {
+		s.auditStore = store
+	}
+}
+
+// audit records a change made by the request in the audit log, if it's
+// enabled, and publishes it as an Event. The change has already been made,
+// so errors are only logged.
+func (s *Server) audit(r *http.Request, action, resource, id string, before, after json.RawMessage) {
+	s.publish(action, resource, id, after)
+	if s.auditStore == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:       s.now().UTC(),
+		Actor:      s.principal(r).ID,
+		ClientIP:   clientIP(r),
+		Action:     action,
+		Resource:   resource,
+		ResourceID: id,
+		Before:     before,
+		After:      after,
+		Tenant:     s.tenant,
+	}
+	err := s.auditStore.AddAuditEntry(entry)
+	if err != nil {
+		s.log.Printf("error recording audit entry for %s %s %q: %v", action, resource, id, err)
+	}
+}
+
+// snapshot marshals v to JSON for the audit log.
+func snapshot(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil // can't happen for our types
+	}
+	return b
+}
+
+// albumSnapshot fetches a snapshot of the album with the given ID for the
+// audit log and events. It returns nil if the album can't be fetched.
+func (s *Server) albumSnapshot(id string) json.RawMessage {
+	album, err := s.db.GetAlbumByID(id)
+	if err != nil {
+		return nil
+	}
+	return snapshot(album)
+}
+
+func (s *Server) getAudit(w http.ResponseWriter, r *http.Request) {
+	if s.auditStore == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	issues := make(map[string]interface{})
+	filter := AuditFilter{
+		AlbumID: query.Get("album_id"),
+		Since:   timeParam(query.Get("since"), "since", issues),
+		Until:   timeParam(query.Get("until"), "until", issues),
+		Tenant:  s.tenant,
+	}
+	if len(issues) == 0 && !filter.Since.IsZero() && !filter.Until.IsZero() && !filter.Until.After(filter.Since) {
+		issues["until"] = validationIssue{"out-of-range", "until must be after since"}
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+
+	entries, err := s.auditStore.GetAuditEntries(filter)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("fetching audit entries: %w", err)))
+		return
+	}
+	if len(entries) > streamListThreshold {
+		s.streamJSONArray(w, r, http.StatusOK, len(entries), func(i int) interface{} { return entries[i] })
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, entries)
+}
+
+// timeParam parses an optional RFC 3339 time query parameter, returning
+// the zero time if it's empty. If it's not a valid time, it adds an issue
+// to issues for the given parameter name.
+func timeParam(value string, name string, issues map[string]interface{}) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		issues[name] = validationIssue{"invalid", name + " must be an RFC 3339 time, like 2021-06-01T12:00:00Z"}
+		return time.Time{}
+	}
+	return t
+}
+
+// MemoryAuditStore is an AuditStore that keeps entries in memory.
+type MemoryAuditStore struct {
+	// MaxEntries limits the number of entries kept, discarding the oldest
+	// when it's exceeded. Zero means no limit. This must be set before use.
+	MaxEntries int
+
+	lock    sync.RWMutex
+	entries []AuditEntry
+	nextID  int64
+}
+
+// NewMemoryAuditStore creates a new in-memory audit store.
+func NewMemoryAuditStore() *MemoryAuditStore {
+	return &MemoryAuditStore{nextID: 1}
+}
+
+func (m *MemoryAuditStore) AddAuditEntry(entry AuditEntry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry.ID = m.nextID
+	m.nextID++
+	m.entries = append(m.entries, entry)
+	if m.MaxEntries > 0 && len(m.entries) > m.MaxEntries {
+		// The discarded entries are freed when append next reallocates
+		m.entries = m.entries[len(m.entries)-m.MaxEntries:]
+	}
+	return nil
+}
+
+func (m *MemoryAuditStore) GetAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	entries := []AuditEntry{}
+	for _, entry := range m.entries {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,195 @@
+// Tests for the audit log
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithAuditStore(NewMemoryAuditStore()),
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return now }),
+	)
+
+	// Make a change each minute
+	requests := []*http.Request{
+		newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a3", "title": "Pianoman", "artist": "Billy Joel"}`)),
+		newRequest(t, "POST", "/albums/a3/tracks", strings.NewReader(`{"title": "Piano Man", "duration": 338}`)),
+		newAdminRequest(t, "PUT", "/albums/a3", strings.NewReader(`{"title": "Piano Man", "artist": "Billy Joel", "version": 2}`)),
+		newRequest(t, "DELETE", "/albums/a3", nil),
+		newAdminRequest(t, "POST", "/albums/a3/restore", nil),
+		newRequest(t, "POST", "/genres", strings.NewReader(`{"id": "pop", "name": "Pop"}`)),
+		newRequest(t, "POST", "/albums", strings.NewReader(`{"title": ""}`)), // invalid, so not audited
+	}
+	for _, request := range requests {
+		request.RemoteAddr = "192.0.2.1:1234"
+		serve(t, server, request)
+		now = now.Add(time.Minute)
+	}
+
+	result := serve(t, server, newAdminRequest(t, "GET", "/audit", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var entries []AuditEntry
+	unmarshalResponse(t, result, &entries)
+	type summary struct {
+		ID                          int64
+		Minute                      int
+		Actor, ClientIP             string
+		Action, Resource, ResID     string
+		BeforeVersion, AfterVersion int
+	}
+	want := []summary{
+		{1, 0, "anonymous", "192.0.2.1", "create", "album", "a3", 0, 1},
+		{2, 1, "anonymous", "192.0.2.1", "update", "album", "a3", 1, 2},
+		{3, 2, "admin", "192.0.2.1", "update", "album", "a3", 2, 3},
+		{4, 3, "anonymous", "192.0.2.1", "delete", "album", "a3", 3, 4},
+		{5, 4, "admin", "192.0.2.1", "restore", "album", "a3", 4, 5},
+		{6, 5, "anonymous", "192.0.2.1", "create", "genre", "pop", 0, 0},
+	}
+	var got []summary
+	for _, entry := range entries {
+		got = append(got, summary{
+			entry.ID, int(entry.Time.Sub(start) / time.Minute),
+			entry.Actor, entry.ClientIP,
+			entry.Action, entry.Resource, entry.ResourceID,
+			snapshotVersion(t, entry.Before), snapshotVersion(t, entry.After),
+		})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad audit entries: got vs want:\n%+v\n%+v", got, want)
+	}
+
+	// Snapshots show what changed
+	var before, after testAlbum
+	unmarshalSnapshot(t, entries[2].Before, &before)
+	unmarshalSnapshot(t, entries[2].After, &after)
+	if before.Title != "Pianoman" || after.Title != "Piano Man" || len(before.Tracks) != 1 || len(after.Tracks) != 0 {
+		t.Fatalf("bad update snapshots: before %+v, after %+v", before, after)
+	}
+	var deleted struct {
+		DeletedAt string `json:"deleted_at"`
+	}
+	unmarshalSnapshot(t, entries[3].After, &deleted)
+	if deleted.DeletedAt != "2021-06-01T12:03:00Z" {
+		t.Fatalf("bad deleted_at in delete snapshot: %q", deleted.DeletedAt)
+	}
+}
+
+func TestAuditLogFilter(t *testing.T) {
+	store := NewMemoryAuditStore()
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, id := range []string{"a1", "a2", "a1", "a1"} {
+		store.AddAuditEntry(AuditEntry{Time: start.Add(time.Duration(i) * time.Hour), Action: "update", Resource: "album", ResourceID: id})
+	}
+	store.AddAuditEntry(AuditEntry{Time: start, Action: "create", Resource: "genre", ResourceID: "a1"})
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithAuditStore(store),
+		WithAdminToken(testAdminToken),
+	)
+
+	tests := []struct {
+		query string
+		want  []int64
+	}{
+		{"", []int64{1, 2, 3, 4, 5}},
+		{"?album_id=a1", []int64{1, 3, 4}},
+		{"?album_id=a3", []int64{}},
+		{"?since=2021-06-01T13:00:00Z", []int64{2, 3, 4}},
+		{"?until=2021-06-01T13:00:00Z", []int64{1, 5}},
+		{"?album_id=a1&since=2021-06-01T12:30:00Z&until=2021-06-01T15:00:00Z", []int64{3}},
+		{"?until=2021-06-02T01:00:00%2B12:00", []int64{1, 5}}, // same as 13:00 UTC
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			result := serve(t, server, newAdminRequest(t, "GET", "/audit"+test.query, nil))
+			ensureStatus(t, result, http.StatusOK)
+			var entries []AuditEntry
+			unmarshalResponse(t, result, &entries)
+			got := []int64{}
+			for _, entry := range entries {
+				got = append(got, entry.ID)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got entry IDs %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAuditLogErrors(t *testing.T) {
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithAuditStore(NewMemoryAuditStore()),
+		WithAdminToken(testAdminToken),
+	)
+
+	result := serve(t, server, newRequest(t, "GET", "/audit", nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+
+	result = serve(t, server, newAdminRequest(t, "GET", "/audit?since=yesterday&until=2021-06-01", nil))
+	data := map[string]interface{}{
+		"since": map[string]interface{}{"error": "invalid", "message": "since must be an RFC 3339 time, like 2021-06-01T12:00:00Z"},
+		"until": map[string]interface{}{"error": "invalid", "message": "until must be an RFC 3339 time, like 2021-06-01T12:00:00Z"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+
+	result = serve(t, server, newAdminRequest(t, "GET", "/audit?since=2021-06-01T12:00:00Z&until=2021-06-01T12:00:00Z", nil))
+	data = map[string]interface{}{
+		"until": map[string]interface{}{"error": "out-of-range", "message": "until must be after since"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+
+	// Without an audit store, there's no audit log
+	server = NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithAdminToken(testAdminToken))
+	result = serve(t, server, newAdminRequest(t, "GET", "/audit", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestMemoryAuditStoreMaxEntries(t *testing.T) {
+	store := NewMemoryAuditStore()
+	store.MaxEntries = 3
+	for i := 0; i < 10; i++ {
+		store.AddAuditEntry(AuditEntry{Action: "create", Resource: "album"})
+	}
+	entries, err := store.GetAuditEntries(AuditFilter{})
+	if err != nil {
+		t.Fatalf("error getting entries: %v", err)
+	}
+	if len(entries) != 3 || entries[0].ID != 8 || entries[2].ID != 10 {
+		t.Fatalf("got %d entries from ID %d, want 3 from ID 8", len(entries), entries[0].ID)
+	}
+}
+
+// snapshotVersion returns the "version" field of an audit snapshot, or 0
+// if there's no snapshot or it's not versioned.
+func snapshotVersion(t *testing.T, snapshot json.RawMessage) int {
+	t.Helper()
+	if snapshot == nil {
+		return 0
+	}
+	var v struct {
+		Version int `json:"version"`
+	}
+	unmarshalSnapshot(t, snapshot, &v)
+	return v.Version
+}
+
+func unmarshalSnapshot(t *testing.T, snapshot json.RawMessage, v interface{}) {
+	t.Helper()
+	err := json.Unmarshal(snapshot, v)
+	if err != nil {
+		t.Fatalf("error unmarshaling snapshot %s: %v", snapshot, err)
+	}
+}
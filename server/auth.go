@@ -0,0 +1,114 @@
+// Pluggable request authentication
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Each request is authenticated by a chain of Authenticators, tried in
+// order until one recognizes the request's credentials. The built-in admin
+// token (see WithAdminToken) is always first, then users' session tokens
+// if there's a UserStore (see users.go), followed by any added with
+// WithAuthenticators, so embedders can add their own schemes, like mTLS
+// client certificates, headers set by an internal SSO proxy, or custom
+// tokens, without changing the rest of the server. An authenticator that
+// doesn't recognize a request returns ErrNoCredentials to pass it to the
+// next one; any other error means the credentials were its kind but were
+// invalid, and the request is rejected with 401 Unauthorized. A request
+// no authenticator recognizes is anonymous, with the public role.
+
+// Principal is who a request was made by.
+type Principal struct {
+	// ID identifies the caller, like "admin" or a user or client ID, and
+	// is recorded as the actor in the audit log.
+	ID string
+
+	// Role decides what the caller can do and see.
+	Role Role
+
+	// UserID is the ID of the user account the request was made by, for
+	// requests with a user's session token (see users.go).
+	UserID string
+
+	// Tenant is the ID of the tenant the caller's credentials are for, if
+	// they're only for one, like an API key issued to a tenant. Requests
+	// with them can only access that tenant's data (see tenants.go).
+	Tenant string
+}
+
+// anonymous is the principal of requests without credentials.
+var anonymous = Principal{ID: "anonymous", Role: RolePublic}
+
+// Authenticator authenticates requests.
+type Authenticator interface {
+	// Authenticate returns who made the request. It returns
+	// ErrNoCredentials if the request doesn't have credentials it
+	// recognizes, or another error if they're invalid.
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// AuthenticatorFunc is a function that implements Authenticator.
+type AuthenticatorFunc func(r *http.Request) (Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (Principal, error) {
+	return f(r)
+}
+
+// ErrNoCredentials is returned by an Authenticator to pass the request on
+// to the next one in the chain.
+var ErrNoCredentials = errors.New("no credentials")
+
+// WithAuthenticators adds authenticators to the chain, after the admin
+// token, to be tried in the order given.
+func WithAuthenticators(authenticators ...Authenticator) Option {
+	return func(s *Server) {
+		s.authenticators = append(s.authenticators, authenticators...)
+	}
+}
+
+// principalKey is the context key for the request's Principal.
+type principalKey struct{}
+
+// authenticate runs the chain of authenticators on the request.
+func (s *Server) authenticate(r *http.Request) (Principal, error) {
+	for _, authenticator := range s.authChain {
+		principal, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return anonymous, nil
+}
+
+// principal returns who made the request (anonymous if the credentials
+// were invalid).
+func (s *Server) principal(r *http.Request) Principal {
+	if principal, ok := r.Context().Value(principalKey{}).(Principal); ok {
+		return principal
+	}
+	principal, err := s.authenticate(r)
+	if err != nil {
+		return anonymous
+	}
+	return principal
+}
+
+// authHandler authenticates each request once, rejecting it if its
+// credentials are invalid, and adds its Principal to the context for the
+// handlers.
+func (s *Server) authHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := s.authenticate(r)
+		if err != nil {
+			s.writeError(w, r, apierr.Unauthorized().WithCause(err))
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
@@ -0,0 +1,111 @@
+// Tests for pluggable request authentication
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// headerAuthenticator trusts the user set by an SSO proxy in a header.
+func headerAuthenticator(r *http.Request) (Principal, error) {
+	user := r.Header.Get("X-Sso-User")
+	switch {
+	case user == "":
+		return Principal{}, ErrNoCredentials
+	case user == "nobody":
+		return Principal{}, errors.New("unknown user")
+	case strings.HasSuffix(user, "@ops.example.com"):
+		return Principal{ID: user, Role: RoleAdmin}, nil
+	default:
+		return Principal{ID: user, Role: RolePublic}, nil
+	}
+}
+
+// certAuthenticator authenticates clients by TLS client certificate.
+func certAuthenticator(r *http.Request) (Principal, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return Principal{}, ErrNoCredentials
+	}
+	return Principal{ID: "cert:" + r.TLS.PeerCertificates[0].Subject.CommonName, Role: RoleAdmin}, nil
+}
+
+func TestAuthenticators(t *testing.T) {
+	auditStore := NewMemoryAuditStore()
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithAuditStore(auditStore),
+		WithAuthenticators(AuthenticatorFunc(headerAuthenticator), AuthenticatorFunc(certAuthenticator)),
+	)
+
+	tests := []struct {
+		name    string
+		setup   func(r *http.Request)
+		status  int // of an admin-only request
+		actorID string
+	}{
+		{"anonymous", func(r *http.Request) {}, http.StatusForbidden, "anonymous"},
+		{"admin-token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+testAdminToken) }, http.StatusOK, "admin"},
+		{"other-bearer-token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }, http.StatusForbidden, "anonymous"},
+		{"sso-admin", func(r *http.Request) { r.Header.Set("X-Sso-User", "kim@ops.example.com") }, http.StatusOK, "kim@ops.example.com"},
+		{"sso-public", func(r *http.Request) { r.Header.Set("X-Sso-User", "lee@example.com") }, http.StatusForbidden, "lee@example.com"},
+		{"sso-invalid", func(r *http.Request) { r.Header.Set("X-Sso-User", "nobody") }, http.StatusUnauthorized, ""},
+		{"client-cert", func(r *http.Request) {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "billing"}}}}
+		}, http.StatusOK, "cert:billing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// An admin-only route
+			request := newRequest(t, "GET", "/deprecations", nil)
+			test.setup(request)
+			result := serve(t, server, request)
+			ensureStatus(t, result, test.status)
+			if test.status == http.StatusUnauthorized {
+				ensureError(t, result, http.StatusUnauthorized, "unauthorized", nil)
+				return
+			}
+
+			// Changes are audited with the principal's ID
+			request = newRequest(t, "POST", "/genres", strings.NewReader(`{"name": "Test", "id": "`+test.name+`"}`))
+			test.setup(request)
+			result = serve(t, server, request)
+			ensureStatus(t, result, http.StatusCreated)
+			entries, _ := auditStore.GetAuditEntries(AuditFilter{})
+			if got := entries[len(entries)-1].Actor; got != test.actorID {
+				t.Fatalf("got actor %q, want %q", got, test.actorID)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorChainOrder(t *testing.T) {
+	var calls []string
+	authenticator := func(name string, err error) Authenticator {
+		return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+			calls = append(calls, name)
+			return Principal{ID: name}, err
+		})
+	}
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithAuthenticators(authenticator("first", ErrNoCredentials), authenticator("second", nil)),
+		WithAuthenticators(authenticator("third", nil)),
+	)
+	principal := server.principal(newRequest(t, "GET", "/albums", nil))
+	if principal.ID != "second" || strings.Join(calls, ",") != "first,second" {
+		t.Fatalf("got principal %+v after calls %q", principal, calls)
+	}
+
+	// Without any authenticators the request is anonymous
+	server = NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0))
+	if principal := server.principal(newRequest(t, "GET", "/albums", nil)); principal != anonymous {
+		t.Fatalf("got principal %+v, want anonymous", principal)
+	}
+}
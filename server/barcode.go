@@ -0,0 +1,180 @@
+// Album catalog number barcodes (Code 128) as PNG images
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Limits on barcode contents and image size parameters.
+const (
+	maxCatalogNumberLen = 48
+
+	defaultBarcodeScale  = 2
+	maxBarcodeScale      = 10
+	defaultBarcodeHeight = 100
+	minBarcodeHeight     = 10
+	maxBarcodeHeight     = 1000
+)
+
+// validateCatalogNumber adds an issue to issues if the catalog number can't
+// be encoded as a Code 128 barcode.
+func validateCatalogNumber(catalogNumber string, issues map[string]interface{}) {
+	if len(catalogNumber) > maxCatalogNumberLen {
+		issues["catalog_number"] = validationIssue{"too-long", fmt.Sprintf("catalog_number must be at most %d characters", maxCatalogNumberLen)}
+		return
+	}
+	for i := 0; i < len(catalogNumber); i++ {
+		if catalogNumber[i] < ' ' || catalogNumber[i] > '~' {
+			issues["catalog_number"] = validationIssue{"invalid", "catalog_number must be printable ASCII"}
+			return
+		}
+	}
+}
+
+func (s *Server) getBarcode(w http.ResponseWriter, r *http.Request, albumID string) {
+	query := r.URL.Query()
+	issues := make(map[string]interface{})
+	scale := intParam(query.Get("scale"), defaultBarcodeScale, 1, maxBarcodeScale, "scale", issues)
+	height := intParam(query.Get("height"), defaultBarcodeHeight, minBarcodeHeight, maxBarcodeHeight, "height", issues)
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+
+	album, err := s.db.GetAlbumByID(albumID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	if !album.visible(s.now()) {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if album.CatalogNumber == "" {
+		s.writeError(w, r, apierr.NotFound().WithData(map[string]interface{}{
+			"message": "album has no catalog number",
+		}))
+		return
+	}
+
+	// The image only depends on the catalog number and size, so clients
+	// (and proxies) can cache it and revalidate with the ETag
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d\n%d", album.CatalogNumber, scale, height)))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, code128Image(album.CatalogNumber, scale, height))
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("encoding barcode PNG: %w", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		s.log.Printf("error writing barcode: %v", err)
+	}
+}
+
+// intParam parses an optional integer query parameter, returning def if
+// it's empty. If it's not an integer between min and max, it adds an issue
+// to issues for the given parameter name.
+func intParam(value string, def, min, max int, name string, issues map[string]interface{}) int {
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		issues[name] = validationIssue{"out-of-range", fmt.Sprintf("%s must be an integer between %d and %d", name, min, max)}
+		return def
+	}
+	return n
+}
+
+// code128Image renders text (which must be printable ASCII) as a Code 128
+// barcode, with each module (narrowest bar) scale pixels wide.
+func code128Image(text string, scale, height int) *image.Paletted {
+	modules := code128Modules(text)
+	palette := color.Palette{color.White, color.Black}
+	img := image.NewPaletted(image.Rect(0, 0, len(modules)*scale, height), palette)
+	for i, black := range modules {
+		if !black {
+			continue
+		}
+		for x := i * scale; x < (i+1)*scale; x++ {
+			for y := 0; y < height; y++ {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return img
+}
+
+// Number of blank modules required either side of a Code 128 barcode.
+const code128QuietZone = 10
+
+// code128Modules encodes text using Code 128 code set B, returning the
+// modules from left to right (true for a bar, false for a space),
+// including the quiet zones.
+func code128Modules(text string) []bool {
+	// Start code, then data, then a checksum: the start code plus the sum
+	// of each symbol times its position, modulo 103
+	symbols := []int{code128StartB}
+	checksum := code128StartB
+	for i := 0; i < len(text); i++ {
+		symbol := int(text[i] - ' ')
+		symbols = append(symbols, symbol)
+		checksum += symbol * (i + 1)
+	}
+	symbols = append(symbols, checksum%103, code128Stop)
+
+	modules := make([]bool, code128QuietZone, code128QuietZone+11*len(symbols)+2+code128QuietZone)
+	for _, symbol := range symbols {
+		// Widths alternate bar, space, bar, ...
+		for i, width := range code128Patterns[symbol] {
+			for j := 0; j < int(width-'0'); j++ {
+				modules = append(modules, i%2 == 0)
+			}
+		}
+	}
+	return append(modules, make([]bool, code128QuietZone)...)
+}
+
+const (
+	code128StartB = 104
+	code128Stop   = 106
+)
+
+// code128Patterns holds the bar and space widths (in modules) of each Code
+// 128 symbol value. Each symbol is 11 modules wide, except the stop symbol,
+// which is 13.
+var code128Patterns = [...]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
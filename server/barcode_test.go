@@ -0,0 +1,166 @@
+// Tests for album barcode images
+
+package server
+
+import (
+	"fmt"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCode128Patterns(t *testing.T) {
+	seen := make(map[string]bool)
+	for symbol, pattern := range code128Patterns {
+		want := 11
+		if symbol == code128Stop {
+			want = 13
+		}
+		total := 0
+		for _, c := range pattern {
+			total += int(c - '0')
+		}
+		if total != want || seen[pattern] {
+			t.Fatalf("bad or duplicate pattern %d: %q", symbol, pattern)
+		}
+		seen[pattern] = true
+	}
+}
+
+func TestGetBarcode(t *testing.T) {
+	server := newTestServer()
+	body := `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel", "catalog_number": "CBS-32002"}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	result = serve(t, server, newRequest(t, "GET", "/albums/a9/barcode.png?scale=3&height=50", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Content-Type"); got != "image/png" {
+		t.Fatalf("bad Content-Type: got %q, want %q", got, "image/png")
+	}
+	if got := result.Header.Get("Cache-Control"); got != "public, max-age=300" {
+		t.Fatalf("bad Cache-Control: got %q", got)
+	}
+	img, err := png.Decode(result.Body)
+	if err != nil {
+		t.Fatalf("error decoding PNG: %v", err)
+	}
+	bounds := img.Bounds()
+	if bounds.Dy() != 50 {
+		t.Fatalf("bad height: got %d, want 50", bounds.Dy())
+	}
+
+	// Read the bars back from a row of pixels and decode them
+	var modules []bool
+	for x := 0; x < bounds.Dx(); x += 3 {
+		r, _, _, _ := img.At(x, 25).RGBA()
+		modules = append(modules, r == 0)
+	}
+	got, err := decodeCode128(modules)
+	if err != nil {
+		t.Fatalf("error decoding barcode: %v", err)
+	}
+	if got != "CBS-32002" {
+		t.Fatalf("bad barcode text: got %q, want %q", got, "CBS-32002")
+	}
+
+	// Conditional GET
+	etag := result.Header.Get("ETag")
+	ensureConditionalGet(t, server, "/albums/a9/barcode.png?scale=3&height=50", etag, http.StatusNotModified, etag)
+	result = ensureConditionalGet(t, server, "/albums/a9/barcode.png", etag, http.StatusOK, "")
+	if result.Header.Get("ETag") == etag {
+		t.Fatalf("ETag should depend on size parameters")
+	}
+}
+
+func TestGetBarcodeErrors(t *testing.T) {
+	server := newTestServer()
+
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1/barcode.png", nil))
+	ensureStatus(t, result, http.StatusNotFound)
+	ensureError(t, result, http.StatusNotFound, "not-found", map[string]interface{}{"message": "album has no catalog number"})
+
+	result = serve(t, server, newRequest(t, "GET", "/albums/a3/barcode.png", nil))
+	ensureStatus(t, result, http.StatusNotFound)
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/barcode.png?scale=0&height=x", nil))
+	ensureStatus(t, result, http.StatusBadRequest)
+	data := map[string]interface{}{
+		"scale":  map[string]interface{}{"error": "out-of-range", "message": "scale must be an integer between 1 and 10"},
+		"height": map[string]interface{}{"error": "out-of-range", "message": "height must be an integer between 10 and 1000"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+}
+
+func TestAddAlbumBadCatalogNumber(t *testing.T) {
+	server := newTestServer()
+	tests := []struct {
+		catalogNumber string
+		issue         map[string]interface{}
+	}{
+		{"CBSé", map[string]interface{}{"error": "invalid", "message": "catalog_number must be printable ASCII"}},
+		{strings.Repeat("1", 49), map[string]interface{}{"error": "too-long", "message": "catalog_number must be at most 48 characters"}},
+	}
+	for _, test := range tests {
+		body := fmt.Sprintf(`{"title": "Pianoman", "artist": "Billy Joel", "catalog_number": %q}`, test.catalogNumber)
+		result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+		ensureStatus(t, result, http.StatusBadRequest)
+		ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{"catalog_number": test.issue})
+	}
+}
+
+// decodeCode128 decodes Code 128 (code set B) modules back to text,
+// checking the quiet zones, start and stop codes, and checksum.
+func decodeCode128(modules []bool) (string, error) {
+	for i := 0; i < code128QuietZone; i++ {
+		if modules[i] || modules[len(modules)-1-i] {
+			return "", fmt.Errorf("missing quiet zone")
+		}
+	}
+	modules = modules[code128QuietZone : len(modules)-code128QuietZone]
+
+	patterns := make(map[string]int)
+	for symbol, pattern := range code128Patterns {
+		patterns[pattern] = symbol
+	}
+	var symbols []int
+	for len(modules) > 0 {
+		n := 11
+		if len(modules) == 13 {
+			n = 13
+		}
+		// Run-length encode the symbol's modules to get its widths
+		var pattern []byte
+		for i := 0; i < n; {
+			j := i
+			for j < n && modules[j] == modules[i] {
+				j++
+			}
+			pattern = append(pattern, byte('0'+j-i))
+			i = j
+		}
+		symbol, ok := patterns[string(pattern)]
+		if !ok {
+			return "", fmt.Errorf("unknown pattern %q", pattern)
+		}
+		symbols = append(symbols, symbol)
+		modules = modules[n:]
+	}
+
+	if len(symbols) < 3 || symbols[0] != code128StartB || symbols[len(symbols)-1] != code128Stop {
+		return "", fmt.Errorf("bad start or stop code: %v", symbols)
+	}
+	data := symbols[1 : len(symbols)-2]
+	checksum := code128StartB
+	var text strings.Builder
+	for i, symbol := range data {
+		checksum += symbol * (i + 1)
+		text.WriteByte(byte(symbol + ' '))
+	}
+	if checksum%103 != symbols[len(symbols)-2] {
+		return "", fmt.Errorf("bad checksum")
+	}
+	return text.String(), nil
+}
@@ -0,0 +1,194 @@
+// Content-addressable blob storage, with deduplication and scrubbing
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// ErrBlobCorrupt means a blob's content no longer matches its hash.
+var ErrBlobCorrupt = errors.New("blob corrupt")
+
+// BlobStore stores immutable blobs, like cover art, by the SHA-256 hash of
+// their content, so identical blobs are only stored once. Each blob is
+// reference counted: every Put adds a reference, and the blob is deleted
+// when the last reference is released. Implementations must be safe for
+// concurrent use.
+type BlobStore interface {
+	// Put adds a reference to the blob with the given content, storing
+	// it if it's not already stored, and returns its hash.
+	Put(data []byte) (string, error)
+
+	// Get returns the content of the blob with the given hash, or
+	// ErrDoesNotExist. It verifies the content against the hash, and
+	// returns ErrBlobCorrupt if it doesn't match.
+	Get(hash string) ([]byte, error)
+
+	// Release removes a reference to the blob added by Put, deleting the
+	// blob when there are none left. It returns ErrDoesNotExist if there's
+	// no blob with the given hash.
+	Release(hash string) error
+
+	// Scrub verifies every blob's content against its hash, reporting
+	// the ones that are corrupt.
+	Scrub() (BlobScrubReport, error)
+}
+
+// BlobScrubReport is the outcome of a blob scrub.
+type BlobScrubReport struct {
+	Blobs   int      `json:"blobs"`   // number of blobs checked
+	Bytes   int64    `json:"bytes"`   // total size of the blobs checked
+	Corrupt []string `json:"corrupt"` // hashes of corrupt blobs, sorted
+}
+
+// BlobScrubber is an optional interface a Database that stores blobs can
+// implement to support scrubbing them (see WithBlobScrubInterval).
+type BlobScrubber interface {
+	ScrubBlobs() (BlobScrubReport, error)
+}
+
+// blobHash returns the hash a blob with the given content is stored by.
+func blobHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryBlobStore is a BlobStore that keeps blobs in memory.
+type MemoryBlobStore struct {
+	lock  sync.Mutex
+	blobs map[string]*memoryBlob
+}
+
+type memoryBlob struct {
+	data []byte
+	refs int
+}
+
+// NewMemoryBlobStore creates a new, empty in-memory blob store.
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: make(map[string]*memoryBlob)}
+}
+
+func (b *MemoryBlobStore) Put(data []byte) (string, error) {
+	hash := blobHash(data)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	blob, ok := b.blobs[hash]
+	if !ok {
+		// Copy the data, so the caller can't change it after it's hashed
+		blob = &memoryBlob{data: append([]byte(nil), data...)}
+		b.blobs[hash] = blob
+	}
+	blob.refs++
+	return hash, nil
+}
+
+func (b *MemoryBlobStore) Get(hash string) ([]byte, error) {
+	b.lock.Lock()
+	blob, ok := b.blobs[hash]
+	b.lock.Unlock()
+	if !ok {
+		return nil, ErrDoesNotExist
+	}
+	if blobHash(blob.data) != hash {
+		return nil, fmt.Errorf("%w: blob %s", ErrBlobCorrupt, hash)
+	}
+	return blob.data, nil
+}
+
+func (b *MemoryBlobStore) Release(hash string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	blob, ok := b.blobs[hash]
+	if !ok {
+		return ErrDoesNotExist
+	}
+	blob.refs--
+	if blob.refs <= 0 {
+		delete(b.blobs, hash)
+	}
+	return nil
+}
+
+func (b *MemoryBlobStore) Scrub() (BlobScrubReport, error) {
+	b.lock.Lock()
+	blobs := make(map[string][]byte, len(b.blobs))
+	for hash, blob := range b.blobs {
+		blobs[hash] = blob.data
+	}
+	b.lock.Unlock()
+
+	// Hash outside the lock, as it can take a while
+	report := BlobScrubReport{Corrupt: []string{}}
+	for hash, data := range blobs {
+		report.Blobs++
+		report.Bytes += int64(len(data))
+		if blobHash(data) != hash {
+			report.Corrupt = append(report.Corrupt, hash)
+		}
+	}
+	sort.Strings(report.Corrupt)
+	return report, nil
+}
+
+// ScrubBlobs implements BlobScrubber by scrubbing the database's blob
+// store.
+func (d *MemoryDatabase) ScrubBlobs() (BlobScrubReport, error) {
+	return d.Blobs.Scrub()
+}
+
+// WithBlobScrubInterval sets how often the database's blobs (if it stores
+// any, see BlobScrubber) are checked for corruption in the background.
+// Corrupt blobs are logged; they can't be repaired here, but they're
+// reported so they can be restored from a backup. The default of zero
+// disables background scrubs, though admins can still run one with a POST
+// to /blobs/scrub.
+func WithBlobScrubInterval(interval time.Duration) Option {
+	return func(s *Server) {
+		s.blobScrubInterval = interval
+	}
+}
+
+// scrubJob returns the scheduled job that scrubs the blobs. A run that
+// finds corrupt blobs fails, so they show up in the job's stats.
+func (s *Server) scrubJob(scrubber BlobScrubber) Job {
+	return Job{Name: "scrub-blobs", Interval: s.blobScrubInterval, Run: func(ctx context.Context) error {
+		report, err := scrubber.ScrubBlobs()
+		if err != nil {
+			return fmt.Errorf("scrubbing blobs: %w", err)
+		}
+		if len(report.Corrupt) > 0 {
+			return fmt.Errorf("scrubbed %d blobs: %d corrupt: %v", report.Blobs, len(report.Corrupt), report.Corrupt)
+		}
+		return nil
+	}}
+}
+
+func (s *Server) scrubBlobs(w http.ResponseWriter, r *http.Request) {
+	scrubber, ok := s.db.(BlobScrubber)
+	if !ok {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	report, err := scrubber.ScrubBlobs()
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("scrubbing blobs: %w", err)))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, report)
+}
@@ -0,0 +1,167 @@
+// Tests for content-addressable blob storage
+
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// blobRefs returns the number of references to the blob with the given
+// hash, or 0 if it's not stored.
+func blobRefs(b *MemoryBlobStore, hash string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	blob, ok := b.blobs[hash]
+	if !ok {
+		return 0
+	}
+	return blob.refs
+}
+
+// corruptBlob changes the content of the blob with the given hash in
+// place, as a bad disk might.
+func corruptBlob(b *MemoryBlobStore, hash string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.blobs[hash].data[0] ^= 0xff
+}
+
+func TestMemoryBlobStore(t *testing.T) {
+	store := NewMemoryBlobStore()
+	data := []byte("cover")
+	hash, err := store.Put(data)
+	if err != nil {
+		t.Fatalf("error putting blob: %v", err)
+	}
+	if hash != blobHash(data) {
+		t.Fatalf("got hash %q, want %q", hash, blobHash(data))
+	}
+	data[0] = 'C' // the store has its own copy
+	again, err := store.Put([]byte("cover"))
+	if err != nil || again != hash {
+		t.Fatalf("got %q, %v putting same content; want %q, nil", again, err, hash)
+	}
+	if refs := blobRefs(store, hash); refs != 2 {
+		t.Fatalf("got %d refs, want 2", refs)
+	}
+	got, err := store.Get(hash)
+	if err != nil || string(got) != "cover" {
+		t.Fatalf("got %q, %v; want \"cover\", nil", got, err)
+	}
+
+	// The blob is deleted when the last reference is released
+	if err := store.Release(hash); err != nil {
+		t.Fatalf("error releasing blob: %v", err)
+	}
+	if _, err := store.Get(hash); err != nil {
+		t.Fatalf("error getting blob with one ref left: %v", err)
+	}
+	if err := store.Release(hash); err != nil {
+		t.Fatalf("error releasing blob: %v", err)
+	}
+	if _, err := store.Get(hash); !errors.Is(err, ErrDoesNotExist) {
+		t.Fatalf("got error %v, want ErrDoesNotExist", err)
+	}
+	if err := store.Release(hash); !errors.Is(err, ErrDoesNotExist) {
+		t.Fatalf("got error %v, want ErrDoesNotExist", err)
+	}
+}
+
+func TestMemoryBlobStoreCorrupt(t *testing.T) {
+	store := NewMemoryBlobStore()
+	good, _ := store.Put([]byte("good"))
+	bad, _ := store.Put([]byte("bad"))
+	corruptBlob(store, bad)
+
+	if _, err := store.Get(good); err != nil {
+		t.Fatalf("error getting good blob: %v", err)
+	}
+	if _, err := store.Get(bad); !errors.Is(err, ErrBlobCorrupt) {
+		t.Fatalf("got error %v, want ErrBlobCorrupt", err)
+	}
+	report, err := store.Scrub()
+	if err != nil {
+		t.Fatalf("error scrubbing: %v", err)
+	}
+	want := BlobScrubReport{Blobs: 2, Bytes: 7, Corrupt: []string{bad}}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("got report %#v, want %#v", report, want)
+	}
+}
+
+func TestCoverBlobsShared(t *testing.T) {
+	db := NewMemoryDatabase()
+	mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+	mustAddAlbum(t, db, Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles"})
+	cover := Cover{ContentType: "image/png", Data: []byte("png"), Width: 1, Height: 1}
+	for _, id := range []string{"a1", "a2"} {
+		if err := db.PutCover(id, cover); err != nil {
+			t.Fatalf("error putting cover: %v", err)
+		}
+	}
+	blobs := db.Blobs.(*MemoryBlobStore)
+	hash := blobHash(cover.Data)
+	if len(blobs.blobs) != 1 || blobRefs(blobs, hash) != 2 {
+		t.Fatalf("got %d blobs with %d refs, want 1 with 2", len(blobs.blobs), blobRefs(blobs, hash))
+	}
+
+	// Deleting one album keeps the blob for the other
+	if err := db.DeleteAlbum("a1"); err != nil {
+		t.Fatalf("error deleting album: %v", err)
+	}
+	if got, err := db.GetCover("a2"); err != nil || string(got.Data) != "png" {
+		t.Fatalf("got %q, %v; want \"png\", nil", got.Data, err)
+	}
+
+	// Replacing the last cover using a blob deletes it
+	if err := db.PutCover("a2", Cover{ContentType: "image/png", Data: []byte("new")}); err != nil {
+		t.Fatalf("error putting cover: %v", err)
+	}
+	if blobRefs(blobs, hash) != 0 || len(blobs.blobs) != 1 {
+		t.Fatalf("old blob not deleted")
+	}
+
+	// A corrupt blob is an error, not bad data
+	corruptBlob(blobs, blobHash([]byte("new")))
+	if _, err := db.GetCover("a2"); !errors.Is(err, ErrBlobCorrupt) {
+		t.Fatalf("got error %v, want ErrBlobCorrupt", err)
+	}
+}
+
+func TestScrubBlobs(t *testing.T) {
+	db := NewMemoryDatabase()
+	mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+	server := NewServer(db, log.New(io.Discard, "", 0), WithAdminToken(testAdminToken))
+	result := serve(t, server, putCoverRequest(t, "image/png", encodeImage(t, "png", 1, 1)))
+	ensureStatus(t, result, http.StatusOK)
+
+	result = serve(t, server, newRequest(t, "POST", "/blobs/scrub", nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+
+	result = serve(t, server, newAdminRequest(t, "POST", "/blobs/scrub", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var report BlobScrubReport
+	unmarshalResponse(t, result, &report)
+	if report.Blobs != 1 || len(report.Corrupt) != 0 {
+		t.Fatalf("got report %#v, want 1 blob and none corrupt", report)
+	}
+
+	cover, err := db.GetCover("a1")
+	if err != nil {
+		t.Fatalf("error getting cover: %v", err)
+	}
+	corruptBlob(db.Blobs.(*MemoryBlobStore), cover.Hash)
+	result = serve(t, server, newAdminRequest(t, "POST", "/blobs/scrub", nil))
+	ensureStatus(t, result, http.StatusOK)
+	unmarshalResponse(t, result, &report)
+	if !reflect.DeepEqual(report.Corrupt, []string{cover.Hash}) {
+		t.Fatalf("got corrupt %v, want [%s]", report.Corrupt, cover.Hash)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/cover", nil))
+	ensureError(t, result, http.StatusInternalServerError, "database", nil)
+}
@@ -0,0 +1,379 @@
+// Publishing album changes to a message broker (NATS or Kafka)
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Album changes can be published to a message broker for downstream data
+// pipelines, configured with a URL (see WithEventBroker). A URL like
+// nats://host:4222/subject publishes to a NATS subject; the user info can
+// be a user and password, or just a token. A URL like
+// kafka+http://host:8082/topic (or kafka+https) publishes to a Kafka
+// topic via a Kafka REST Proxy, rather than the broker's binary protocol,
+// which would need a client library. Kafka messages are keyed by album ID,
+// so each album's changes stay in order.
+//
+// Messages are a BrokerMessage, in JSON. Events are queued and sent in
+// order by a background goroutine, which retries a failed publish with
+// backoff until it succeeds, so a broker outage delays events rather than
+// losing them; events that don't fit in the queue meanwhile, or are still
+// queued at shutdown, are dropped (and logged).
+const (
+	eventSchemaVersion   = 1 // bump when BrokerMessage changes incompatibly
+	brokerQueueSize      = 1000
+	brokerTimeout        = 10 * time.Second
+	defaultBrokerBackoff = time.Second
+	defaultNATSPort      = "4222"
+)
+
+// BrokerMessage is the payload published to the broker for each album
+// change: the Event (as sent to webhooks), with the version of this
+// schema so consumers can handle changes to it.
+type BrokerMessage struct {
+	SchemaVersion int `json:"schema_version"`
+	Event
+}
+
+// WithEventBroker publishes album changes to the message broker with the
+// given URL. The default is not to. If the URL isn't valid, an error is
+// logged and events aren't published.
+func WithEventBroker(brokerURL string) Option {
+	return func(s *Server) {
+		s.eventBrokerURL = brokerURL
+	}
+}
+
+// eventBroker is a connection to a message broker. It's only used by one
+// goroutine at a time.
+type eventBroker interface {
+	// publish sends payload to the broker, with the given partitioning key
+	// (if the broker uses one).
+	publish(ctx context.Context, key string, payload []byte) error
+
+	// close closes any open connection.
+	close()
+}
+
+// parseEventBroker returns the broker for the given URL. It doesn't
+// connect to it, as that's done (and retried) when publishing.
+func parseEventBroker(rawURL string) (eventBroker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("%q must be like nats://host/subject or kafka+http://host/topic", rawURL)
+	}
+	switch u.Scheme {
+	case "nats":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), defaultNATSPort)
+		}
+		if strings.ContainsAny(name, " \t\r\n") {
+			return nil, fmt.Errorf("NATS subject %q can't contain whitespace", name)
+		}
+		broker := &natsBroker{addr: addr, subject: name}
+		if u.User != nil {
+			broker.user = u.User.Username()
+			broker.pass, _ = u.User.Password()
+		}
+		return broker, nil
+	case "kafka+http", "kafka+https":
+		base := url.URL{Scheme: strings.TrimPrefix(u.Scheme, "kafka+"), User: u.User, Host: u.Host}
+		return &kafkaRESTBroker{
+			url:    base.String() + "/topics/" + url.PathEscape(name),
+			client: &http.Client{Timeout: brokerTimeout},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown event broker scheme %q (want nats, kafka+http, or kafka+https)", u.Scheme)
+	}
+}
+
+// startEventBroker starts publishing events to the configured broker.
+func (s *Server) startEventBroker() {
+	broker, err := parseEventBroker(s.eventBrokerURL)
+	if err != nil {
+		s.log.Printf("error configuring event broker: %v", err)
+		return
+	}
+	publisher := newBrokerPublisher(broker, s.log, defaultBrokerBackoff)
+	s.publishers = append(s.publishers, publisher)
+	s.background.Go("event-broker", publisher.run)
+}
+
+// brokerPublisher is the EventPublisher that queues album changes for the
+// broker.
+type brokerPublisher struct {
+	broker  eventBroker
+	log     *log.Logger
+	backoff time.Duration // initial retry backoff
+	queue   chan brokerItem
+}
+
+type brokerItem struct {
+	eventID string
+	key     string
+	payload []byte
+}
+
+func newBrokerPublisher(broker eventBroker, log *log.Logger, backoff time.Duration) *brokerPublisher {
+	return &brokerPublisher{
+		broker:  broker,
+		log:     log,
+		backoff: backoff,
+		queue:   make(chan brokerItem, brokerQueueSize),
+	}
+}
+
+// Publish implements EventPublisher by queueing album events. It never
+// blocks.
+func (p *brokerPublisher) Publish(event Event) {
+	if !strings.HasPrefix(event.Type, "album.") {
+		return
+	}
+	payload, err := json.Marshal(BrokerMessage{SchemaVersion: eventSchemaVersion, Event: event})
+	if err != nil {
+		return // can't happen for our types
+	}
+	select {
+	case p.queue <- brokerItem{event.ID, event.ResourceID, payload}:
+	default:
+		p.log.Printf("event broker: queue full, dropping event %s", event.ID)
+	}
+}
+
+// run sends queued events until ctx is done.
+func (p *brokerPublisher) run(ctx context.Context) {
+	defer p.broker.close()
+	for {
+		select {
+		case item := <-p.queue:
+			p.send(ctx, item)
+		case <-ctx.Done():
+			if n := len(p.queue); n > 0 {
+				p.log.Printf("event broker: dropping %d queued events at shutdown", n)
+			}
+			return
+		}
+	}
+}
+
+// send publishes one event, retrying with backoff until it succeeds or ctx
+// is done. Later events wait, so they're published in order.
+func (p *brokerPublisher) send(ctx context.Context, item brokerItem) {
+	for attempt := 1; ; attempt++ {
+		err := p.broker.publish(ctx, item.key, item.payload)
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		backoff := webhookBackoff(p.backoff, attempt)
+		p.log.Printf("event broker: error publishing event %s (attempt %d, retrying in %s): %v",
+			item.eventID, attempt, backoff.Round(time.Millisecond), err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// natsBroker publishes to a NATS subject using the NATS client protocol,
+// which is simple enough not to need a library: after the server's INFO
+// line, the client sends CONNECT, then "PUB <subject> <size>" followed by
+// the payload for each message. Each publish is followed by a PING, and
+// waiting for the PONG confirms the server has processed it.
+type natsBroker struct {
+	addr    string
+	subject string
+	user    string
+	pass    string
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (b *natsBroker) publish(ctx context.Context, key string, payload []byte) error {
+	if b.conn == nil {
+		err := b.connect(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	b.setDeadline(ctx)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "PUB %s %d\r\n", b.subject, len(payload))
+	buf.Write(payload)
+	buf.WriteString("\r\nPING\r\n")
+	_, err := b.conn.Write(buf.Bytes())
+	if err == nil {
+		err = b.waitForPong()
+	}
+	if err != nil {
+		b.close() // reconnect next time
+		return err
+	}
+	return nil
+}
+
+func (b *natsBroker) connect(ctx context.Context) error {
+	var dialer net.Dialer
+	ctx, cancel := context.WithTimeout(ctx, brokerTimeout)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", b.addr)
+	if err != nil {
+		return err
+	}
+	b.conn = conn
+	b.reader = bufio.NewReader(conn)
+	b.setDeadline(ctx)
+
+	line, err := b.readLine()
+	if err == nil && !strings.HasPrefix(line, "INFO ") {
+		err = fmt.Errorf("expected INFO from NATS server, got %q", line)
+	}
+	if err == nil {
+		options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "web-service-stdlib"}
+		switch {
+		case b.pass != "":
+			options["user"] = b.user
+			options["pass"] = b.pass
+		case b.user != "":
+			options["auth_token"] = b.user
+		}
+		encoded, _ := json.Marshal(options)
+		_, err = fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", encoded)
+	}
+	if err == nil {
+		err = b.waitForPong()
+	}
+	if err != nil {
+		b.close()
+		return fmt.Errorf("connecting to NATS: %w", err)
+	}
+	return nil
+}
+
+// waitForPong reads until the server's PONG, answering its PINGs, and
+// returns an error if the server sends one.
+func (b *natsBroker) waitForPong() error {
+	for {
+		line, err := b.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			_, err := io.WriteString(b.conn, "PONG\r\n")
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// Ignore anything else, like +OK or updated INFO
+	}
+}
+
+func (b *natsBroker) readLine() (string, error) {
+	line, err := b.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// setDeadline sets the connection's deadline for the next exchange with
+// the server.
+func (b *natsBroker) setDeadline(ctx context.Context) {
+	deadline := time.Now().Add(brokerTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = b.conn.SetDeadline(deadline)
+}
+
+func (b *natsBroker) close() {
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+		b.reader = nil
+	}
+}
+
+// kafkaRESTBroker publishes to a Kafka topic using the Kafka REST Proxy
+// (v2 API).
+type kafkaRESTBroker struct {
+	url    string // of the topic
+	client *http.Client
+}
+
+func (b *kafkaRESTBroker) publish(ctx context.Context, key string, payload []byte) error {
+	type record struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	}
+	body, err := json.Marshal(map[string][]record{"records": {{key, payload}}})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", b.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	request.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	response, err := b.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024)) // so the connection can be reused
+		return fmt.Errorf("Kafka REST Proxy returned %s", response.Status)
+	}
+
+	// Records can fail individually, even with a 200 OK
+	var result struct {
+		Offsets []struct {
+			Error *string `json:"error"`
+		} `json:"offsets"`
+	}
+	err = json.NewDecoder(io.LimitReader(response.Body, 64*1024)).Decode(&result)
+	if err != nil {
+		return fmt.Errorf("decoding Kafka REST Proxy response: %w", err)
+	}
+	if len(result.Offsets) != 1 {
+		return errors.New("Kafka REST Proxy didn't return the record's offset")
+	}
+	if result.Offsets[0].Error != nil {
+		return fmt.Errorf("Kafka error: %s", *result.Offsets[0].Error)
+	}
+	return nil
+}
+
+func (b *kafkaRESTBroker) close() {
+	b.client.CloseIdleConnections()
+}
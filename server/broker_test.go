@@ -0,0 +1,239 @@
+// Tests for publishing album changes to a message broker
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNATS is a minimal NATS server that sends the payload of each PUB on
+// messages. If dropFirst is set, it closes the first connection as soon as
+// a message is published on it, without acknowledging it.
+type fakeNATS struct {
+	listener  net.Listener
+	connects  chan string // CONNECT options
+	messages  chan string
+	dropFirst bool
+}
+
+func newFakeNATS(t *testing.T, dropFirst bool) *fakeNATS {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	f := &fakeNATS{
+		listener:  listener,
+		connects:  make(chan string, 10),
+		messages:  make(chan string, 10),
+		dropFirst: dropFirst,
+	}
+	go f.serve()
+	t.Cleanup(func() { listener.Close() })
+	return f
+}
+
+func (f *fakeNATS) serve() {
+	for n := 0; ; n++ {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn, f.dropFirst && n == 0)
+	}
+}
+
+func (f *fakeNATS) handle(conn net.Conn, drop bool) {
+	defer conn.Close()
+	fmt.Fprint(conn, "INFO {\"server_id\":\"fake\"}\r\n")
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "CONNECT "):
+			f.connects <- strings.TrimPrefix(line, "CONNECT ")
+		case line == "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		case strings.HasPrefix(line, "PUB "):
+			fields := strings.Fields(line)
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2) // including the CRLF
+			_, err := io.ReadFull(reader, payload)
+			if err != nil {
+				return
+			}
+			if drop {
+				return
+			}
+			f.messages <- fields[1] + " " + string(payload[:size])
+		}
+	}
+}
+
+func (f *fakeNATS) receive(t *testing.T) (subject string, message BrokerMessage) {
+	t.Helper()
+	select {
+	case received := <-f.messages:
+		parts := strings.SplitN(received, " ", 2)
+		err := json.Unmarshal([]byte(parts[1]), &message)
+		if err != nil {
+			t.Fatalf("error unmarshaling message: %v", err)
+		}
+		return parts[0], message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for message")
+		return "", BrokerMessage{}
+	}
+}
+
+func TestNATSBroker(t *testing.T) {
+	nats := newFakeNATS(t, false)
+	db := NewMemoryDatabase()
+	brokerURL := "nats://tok3n@" + nats.listener.Addr().String() + "/albums.changes"
+	server := NewServer(db, log.New(io.Discard, "", 0), WithEventBroker(brokerURL))
+	defer server.Close()
+
+	// Only album changes are published
+	result := serve(t, server, newRequest(t, "POST", "/genres", strings.NewReader(`{"id": "rock", "name": "Rock"}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a1", "title": "Hey Jude", "artist": "The Beatles", "price": 2000}`)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	subject, message := nats.receive(t)
+	if subject != "albums.changes" || message.SchemaVersion != eventSchemaVersion ||
+		message.Type != "album.created" || message.ResourceID != "a1" || message.ID == "" {
+		t.Fatalf("got %s %#v", subject, message)
+	}
+	var album Album
+	err := json.Unmarshal(message.Data, &album)
+	if err != nil || album.Title != "Hey Jude" {
+		t.Fatalf("got album %#v, error %v", album, err)
+	}
+	var options map[string]interface{}
+	json.Unmarshal([]byte(<-nats.connects), &options)
+	if options["auth_token"] != "tok3n" || options["verbose"] != false {
+		t.Fatalf("bad CONNECT options: %v", options)
+	}
+}
+
+func TestNATSBrokerReconnects(t *testing.T) {
+	nats := newFakeNATS(t, true)
+	broker, err := parseEventBroker("nats://user:pass@" + nats.listener.Addr().String() + "/albums")
+	if err != nil {
+		t.Fatalf("error parsing broker URL: %v", err)
+	}
+	publisher := newBrokerPublisher(broker, log.New(io.Discard, "", 0), time.Millisecond)
+	lifecycle := newLifecycle()
+	lifecycle.Go("event-broker", publisher.run)
+	defer lifecycle.Stop(context.Background())
+
+	// The first attempt is dropped, so it's retried on a new connection
+	publisher.Publish(Event{ID: "e1", Type: "album.updated", ResourceID: "a1"})
+	publisher.Publish(Event{ID: "e2", Type: "album.deleted", ResourceID: "a1"})
+	for _, want := range []string{"e1", "e2"} {
+		_, message := nats.receive(t)
+		if message.ID != want {
+			t.Fatalf("got event %q, want %q", message.ID, want)
+		}
+	}
+	var options map[string]interface{}
+	json.Unmarshal([]byte(<-nats.connects), &options)
+	if options["user"] != "user" || options["pass"] != "pass" {
+		t.Fatalf("bad CONNECT options: %v", options)
+	}
+}
+
+func TestKafkaRESTBroker(t *testing.T) {
+	type record struct {
+		Key   string        `json:"key"`
+		Value BrokerMessage `json:"value"`
+	}
+	records := make(chan record, 10)
+	failures := 1
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/albums" || r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var body struct {
+			Records []record `json:"records"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/vnd.kafka.v2+json")
+		if failures > 0 {
+			// Errors can be reported for the record with a 200 OK
+			failures--
+			fmt.Fprint(w, `{"offsets": [{"partition": null, "offset": null, "error_code": 50003, "error": "timeout"}]}`)
+			return
+		}
+		for _, rec := range body.Records {
+			records <- rec
+		}
+		fmt.Fprint(w, `{"offsets": [{"partition": 0, "offset": 1, "error_code": null, "error": null}]}`)
+	}))
+	defer proxy.Close()
+
+	broker, err := parseEventBroker("kafka+" + proxy.URL + "/albums")
+	if err != nil {
+		t.Fatalf("error parsing broker URL: %v", err)
+	}
+	publisher := newBrokerPublisher(broker, log.New(io.Discard, "", 0), time.Millisecond)
+	lifecycle := newLifecycle()
+	lifecycle.Go("event-broker", publisher.run)
+	defer lifecycle.Stop(context.Background())
+
+	publisher.Publish(Event{ID: "e1", Type: "album.created", ResourceID: "a1", Data: json.RawMessage(`{"id":"a1"}`)})
+	select {
+	case rec := <-records:
+		if rec.Key != "a1" || rec.Value.ID != "e1" || rec.Value.SchemaVersion != eventSchemaVersion || string(rec.Value.Data) != `{"id":"a1"}` {
+			t.Fatalf("bad record: %#v", rec)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for record")
+	}
+}
+
+func TestParseEventBroker(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"nats://localhost/albums", "nats localhost:4222 albums"},
+		{"nats://nats.example:4333/albums.changes", "nats nats.example:4333 albums.changes"},
+		{"kafka+http://proxy:8082/albums", "kafka http://proxy:8082/topics/albums"},
+		{"kafka+https://proxy/album%20changes", "kafka https://proxy/topics/album%20changes"},
+		{"nats://localhost", "error"},
+		{"nats://localhost/a/b", "error"},
+		{"kafka://broker:9092/albums", "error"},
+		{"/albums", "error"},
+	}
+	for _, test := range tests {
+		broker, err := parseEventBroker(test.url)
+		got := "error"
+		switch b := broker.(type) {
+		case *natsBroker:
+			got = "nats " + b.addr + " " + b.subject
+		case *kafkaRESTBroker:
+			got = "kafka " + b.url
+		}
+		if got != test.want || (err != nil) != (test.want == "error") {
+			t.Errorf("%q: got %q, error %v, want %q", test.url, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Pooled buffers for encoding responses, and streamed JSON arrays
+//
+// Responses with an ETag (see etag.go) have to be encoded in full before
+// they're written, as the ETag is a hash of the body. Rather than
+// allocating a new slice for each one (which makes work for the garbage
+// collector at high request rates), they're encoded into buffers from
+// bufferPool, which are reused once the response is written. Buffers that
+// grew very large for an unusually big response aren't kept, so one huge
+// response doesn't pin its memory in the pool.
+//
+// Big collections are streamed instead: streamJSONArray encodes one item at
+// a time into a pooled buffer and writes it out in chunks, so a response
+// only ever uses one chunk of memory however many items it has. Streamed
+// responses can't have an ETag, so they're only used when a list is too
+// big for conditional requests to be worth buffering it for (see
+// streamListThreshold).
+
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+)
+
+const (
+	// maxPooledBuffer is the capacity of the largest buffer put back in
+	// the pool.
+	maxPooledBuffer = 1024 * 1024
+
+	// streamChunkSize is how much of a streamed response is encoded before
+	// it's written.
+	streamChunkSize = 32 * 1024
+
+	// streamListThreshold is the number of items above which album lists
+	// and the audit log are streamed rather than encoded in full.
+	streamListThreshold = 500
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool. Return it with
+// putBuffer once its contents have been written.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer resets buf and puts it back in the pool, unless it's too big.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// streamJSONArray writes a JSON array of n items with the given status,
+// getting each item with item(i) and writing the response in chunks. The
+// output is the same as writeJSON's for the whole slice. If the client
+// goes away part way through, it stops early.
+func (s *Server) streamJSONArray(w http.ResponseWriter, r *http.Request, status int, n int, item func(i int) interface{}) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	pretty := s.prettyJSON(r)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteByte('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if pretty {
+			buf.WriteString("\n    ")
+		}
+		err := s.encodeJSON(buf, r, item(i), "    ")
+		if err != nil {
+			// Too late to change the status, so cut the response short
+			s.log.Printf("error marshaling JSON: %v", err)
+			return
+		}
+		buf.Truncate(buf.Len() - 1) // Encode adds a newline after each item
+		if buf.Len() >= streamChunkSize {
+			if !s.writeChunk(w, r, buf) {
+				return
+			}
+		}
+	}
+	if pretty && n > 0 {
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("]\n")
+	s.writeChunk(w, r, buf)
+}
+
+// writeChunk writes and resets buf, returning false if the response should
+// stop because the write failed or the client has gone away.
+func (s *Server) writeChunk(w http.ResponseWriter, r *http.Request, buf *bytes.Buffer) bool {
+	_, err := w.Write(buf.Bytes())
+	buf.Reset()
+	if err != nil {
+		s.log.Printf("error writing JSON: %v", err)
+		return false
+	}
+	return r.Context().Err() == nil
+}
@@ -0,0 +1,92 @@
+// Tests for pooled buffers and streamed JSON arrays
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStreamJSONArray(t *testing.T) {
+	// Enough albums to stream the list, in several chunks
+	db := NewMemoryDatabase()
+	var albums []Album
+	for i := 0; i < streamListThreshold+100; i++ {
+		album := Album{ID: fmt.Sprintf("a%04d", i), Title: strings.Repeat("x", 100), Artist: "Various", Price: 100}
+		db.AddAlbum(album)
+		albums = append(albums, album)
+	}
+	server := NewServer(db, log.New(io.Discard, "", 0))
+	stored, err := db.GetAlbums()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, url := range []string{"/albums", "/albums?pretty=1"} {
+		result := serve(t, server, newRequest(t, "GET", url, nil))
+		ensureStatus(t, result, http.StatusOK)
+		if etag := result.Header.Get("ETag"); etag != "" {
+			t.Fatalf("%s: got ETag %s for streamed list", url, etag)
+		}
+		got, _ := io.ReadAll(result.Body)
+		if len(got) < 2*streamChunkSize {
+			t.Fatalf("%s: response is only %d bytes, want more than one chunk", url, len(got))
+		}
+
+		// The same as encoding the whole list at once
+		var want bytes.Buffer
+		encoder := json.NewEncoder(&want)
+		if strings.Contains(url, "pretty") {
+			encoder.SetIndent("", "    ")
+		}
+		err := encoder.Encode(stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Fatalf("%s: streamed list differs from encoded list:\n%.200s\n%.200s", url, got, want.Bytes())
+		}
+		var decoded []Album
+		unmarshalJSON(t, got, &decoded)
+		if len(decoded) != len(albums) {
+			t.Fatalf("%s: got %d albums, want %d", url, len(decoded), len(albums))
+		}
+	}
+
+	// Empty arrays are the same too
+	for _, url := range []string{"/", "/?pretty=1"} {
+		recorder := httptest.NewRecorder()
+		server.streamJSONArray(recorder, newRequest(t, "GET", url, nil), http.StatusOK, 0, nil)
+		if got := recorder.Body.String(); got != "[]\n" {
+			t.Fatalf("%s: got %q for empty array", url, got)
+		}
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	buf := getBuffer()
+	if buf.Len() != 0 {
+		t.Fatalf("got buffer with %d bytes", buf.Len())
+	}
+	buf.WriteString("hello")
+	putBuffer(buf)
+	if buf.Len() != 0 {
+		t.Fatal("buffer wasn't reset")
+	}
+
+	// Huge buffers aren't kept
+	buf = getBuffer()
+	buf.Grow(2 * maxPooledBuffer)
+	buf.WriteString("big")
+	putBuffer(buf)
+	if buf.Len() == 0 {
+		t.Fatal("huge buffer was put back in the pool")
+	}
+}
@@ -0,0 +1,101 @@
+// Build information: which version of the server is running
+//
+// The version, commit, and build date can be set with linker flags when
+// building, like:
+//
+//	pkg=github.com/benhoyt/web-service-stdlib/server
+//	go build -ldflags "-X $pkg.version=v1.2.0 -X $pkg.commit=$(git rev-parse HEAD) -X $pkg.buildDate=$(date -u +%FT%TZ)"
+//
+// Any that aren't come from what the Go toolchain records in the binary
+// (see debug.ReadBuildInfo): the module version when installed with
+// go install, and (since Go 1.18) the commit and its time when built in a
+// git checkout. GET /version returns the lot, the Server header of every
+// response gives the version, and the server logs it on startup.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Set with the linker's -X flag, using this package's import path (see
+// above).
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// buildInfo is the response to GET /version.
+type buildInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit,omitempty"`
+	CommitDate string `json:"commit_date,omitempty"`
+	Modified   bool   `json:"modified,omitempty"` // built with uncommitted changes
+	BuildDate  string `json:"build_date,omitempty"`
+	GoVersion  string `json:"go_version"`
+}
+
+// readBuildInfo returns the server's build information, from the linker
+// flags, or failing that from debug.ReadBuildInfo.
+func readBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	goInfo, ok := debug.ReadBuildInfo()
+	if info.Version == "" {
+		info.Version = "(devel)"
+		if ok && goInfo.Main.Version != "" {
+			info.Version = goInfo.Main.Version
+		}
+	}
+	if info.Commit == "" && ok {
+		info.Commit, info.CommitDate, info.Modified = vcsBuildInfo(goInfo)
+	}
+	return info
+}
+
+// buildVersion returns the version of the server, or "(devel)" if it
+// wasn't built from a tagged version or given one with -ldflags.
+func buildVersion() string {
+	return readBuildInfo().Version
+}
+
+// String returns the build information for logging, like "v1.2.0 (commit
+// 3e0084b, built 2026-10-14T07:00:00Z, go1.22.1)".
+func (b buildInfo) String() string {
+	var details []string
+	if b.Commit != "" {
+		short := b.Commit
+		if len(short) > 7 {
+			short = short[:7]
+		}
+		if b.Modified {
+			short += "+modified"
+		}
+		details = append(details, "commit "+short)
+	}
+	if b.BuildDate != "" {
+		details = append(details, "built "+b.BuildDate)
+	}
+	details = append(details, b.GoVersion)
+	return fmt.Sprintf("%s (%s)", b.Version, strings.Join(details, ", "))
+}
+
+// serverHeader returns the value of the Server response header, like
+// "web-service-stdlib/v1.2.0". A version isn't allowed parentheses, so
+// "(devel)" is given as "devel".
+func serverHeader(version string) string {
+	return "web-service-stdlib/" + strings.Trim(version, "()")
+}
+
+func (s *Server) getVersion(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, r, http.StatusOK, readBuildInfo())
+}
@@ -0,0 +1,13 @@
+//go:build !go1.18
+
+// Before Go 1.18, the toolchain didn't record version control information
+
+package server
+
+import "runtime/debug"
+
+// vcsBuildInfo returns nothing, as Go 1.17 binaries don't record the
+// commit they were built from.
+func vcsBuildInfo(info *debug.BuildInfo) (commit, commitDate string, modified bool) {
+	return "", "", false
+}
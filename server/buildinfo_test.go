@@ -0,0 +1,65 @@
+// Tests for build information
+
+package server
+
+import (
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+func TestGetVersion(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/version", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var info buildInfo
+	unmarshalResponse(t, result, &info)
+	if info.Version == "" || info.GoVersion != runtime.Version() {
+		t.Fatalf("bad build info: %+v", info)
+	}
+	if got, want := result.Header.Get("Server"), serverHeader(info.Version); got != want {
+		t.Fatalf("got Server header %q, want %q", got, want)
+	}
+
+	// Every response has the Server header, even errors
+	result = serve(t, server, newRequest(t, "GET", "/albums/missing", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	if result.Header.Get("Server") == "" {
+		t.Fatal("no Server header on error response")
+	}
+}
+
+func TestBuildInfoLinkerFlags(t *testing.T) {
+	oldVersion, oldCommit, oldBuildDate := version, commit, buildDate
+	defer func() {
+		version, commit, buildDate = oldVersion, oldCommit, oldBuildDate
+	}()
+	version = "v1.2.0"
+	commit = "3e0084b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7"
+	buildDate = "2026-10-14T07:00:00Z"
+
+	info := readBuildInfo()
+	want := buildInfo{
+		Version:   "v1.2.0",
+		Commit:    "3e0084b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7",
+		BuildDate: "2026-10-14T07:00:00Z",
+		GoVersion: runtime.Version(),
+	}
+	if info != want {
+		t.Fatalf("got %+v, want %+v", info, want)
+	}
+	if got, want := info.String(), "v1.2.0 (commit 3e0084b, built 2026-10-14T07:00:00Z, "+runtime.Version()+")"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got := buildVersion(); got != "v1.2.0" {
+		t.Fatalf("got buildVersion %q, want v1.2.0", got)
+	}
+
+	info = buildInfo{Version: "(devel)", Commit: "abc", Modified: true, GoVersion: "go1.17"}
+	if got, want := info.String(), "(devel) (commit abc+modified, go1.17)"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got := serverHeader("(devel)"); got != "web-service-stdlib/devel" {
+		t.Fatalf("got Server header %q", got)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build go1.18
+
+// Build information recorded by the Go 1.18+ toolchain
+
+package server
+
+import "runtime/debug"
+
+// vcsBuildInfo returns the commit the binary was built from, the time of
+// the commit, and whether there were uncommitted changes, if it was built
+// in a version-controlled checkout.
+func vcsBuildInfo(info *debug.BuildInfo) (commit, commitDate string, modified bool) {
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			commit = setting.Value
+		case "vcs.time":
+			commitDate = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	return commit, commitDate, modified
+}
@@ -0,0 +1,191 @@
+// Bulk album imports, throttled to protect interactive traffic
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Admins can add many albums in one request with POST /albums/import,
+// whose body is newline-delimited JSON with an album on each line, as for
+// POST /albums. Each album is validated and added separately, so one bad
+// line doesn't stop the rest; the response counts the albums created and
+// lists the lines that failed. Only a database error that's likely to
+// fail every line (a 5xx) stops the import part way through.
+//
+// A bulk import (or a migration backfill, which also writes album by
+// album) can write much faster than interactive clients, and if it's
+// allowed to, it can slow the database down enough that storefront
+// requests time out. WithImportRate limits these bulk writes to a number
+// of rows per second, and also makes them give way to interactive
+// requests: before each write, while any read or write requests (see
+// classifyRequest) are in flight, the import waits importYieldInterval, up
+// to maxImportYields times, so a steady stream of traffic slows it down
+// but can't stall it completely. Imports aren't subject to the handler
+// timeout, as a throttled one can take a long time.
+const (
+	maxImportLineSize   = 1 << 20 // 1MB
+	importYieldInterval = 10 * time.Millisecond
+	maxImportYields     = 20
+)
+
+// WithImportRate limits bulk imports and migration backfills to
+// rowsPerSecond writes per second, and makes them give way to interactive
+// requests. The default of zero means they're not throttled.
+func WithImportRate(rowsPerSecond float64) Option {
+	return func(s *Server) {
+		s.importRate = rowsPerSecond
+	}
+}
+
+// writeThrottle paces bulk writes (see WithImportRate).
+type writeThrottle struct {
+	limiter     *rateLimiter
+	interactive int64 // number of interactive requests in flight, accessed atomically
+}
+
+func newWriteThrottle(rowsPerSecond float64) *writeThrottle {
+	return &writeThrottle{limiter: newRateLimiter(rowsPerSecond)}
+}
+
+// wait blocks until the next bulk write can go ahead, or ctx is done. The
+// rate limit uses real time, not the server's clock, as it sleeps.
+func (t *writeThrottle) wait(ctx context.Context) error {
+	for {
+		ok, delay := t.limiter.allow(time.Now())
+		if ok {
+			break
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < maxImportYields && atomic.LoadInt64(&t.interactive) > 0; i++ {
+		if err := sleepContext(ctx, importYieldInterval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sleepContext sleeps for d, returning early with ctx's error if it's done
+// first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttleHandler counts the interactive requests in flight, for the write
+// throttle to give way to.
+func (s *Server) throttleHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := classifyRequest(r)
+		if class != ClassRead && class != ClassWrite {
+			h.ServeHTTP(w, r)
+			return
+		}
+		atomic.AddInt64(&s.importThrottle.interactive, 1)
+		defer atomic.AddInt64(&s.importThrottle.interactive, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// waitToWrite waits for the write throttle, if there is one. It returns an
+// error if the request's context is done first.
+func (s *Server) waitToWrite(r *http.Request) error {
+	if s.importThrottle == nil {
+		return nil
+	}
+	return s.importThrottle.wait(r.Context())
+}
+
+// importResult is the response to POST /albums/import.
+type importResult struct {
+	Created int             `json:"created"`
+	Failed  []importFailure `json:"failed"`
+
+	// Stopped is true if the import stopped before the end of the input,
+	// because of the last failure.
+	Stopped bool `json:"stopped,omitempty"`
+}
+
+// importFailure is a line of an import that couldn't be added, with the
+// same error and data as POST /albums would have responded with.
+type importFailure struct {
+	Line  int                    `json:"line"` // starting at 1
+	ID    string                 `json:"id,omitempty"`
+	Error string                 `json:"error"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+}
+
+func (s *Server) importAlbums(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	result := importResult{Failed: []importFailure{}}
+	fail := func(line int, id string, err error) {
+		apiErr := errorMapping.Lookup(err)
+		if apiErr.Status >= 500 {
+			s.log.Printf("error importing line %d: %v", line, apiErr)
+			result.Stopped = true
+		}
+		result.Failed = append(result.Failed, importFailure{Line: line, ID: id, Error: apiErr.Code, Data: apiErr.Data})
+	}
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, maxImportLineSize)
+	line := 0
+	for !result.Stopped && scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var input albumInput
+		err := s.codec.Decode(scanner.Bytes(), &input)
+		if err != nil {
+			fail(line, "", apierr.MalformedJSON(err))
+			continue
+		}
+		album, issues, err := s.validateAlbum(input, "")
+		if err != nil {
+			fail(line, input.ID, apierr.Database(err))
+			continue
+		}
+		if len(issues) > 0 {
+			fail(line, input.ID, apierr.Validation(issues))
+			continue
+		}
+		err = s.waitToWrite(r)
+		if err != nil {
+			// The client went away, so there's no one to respond to
+			return
+		}
+		_, err = s.createAlbum(r, album)
+		if err != nil {
+			fail(line, album.ID, err)
+			continue
+		}
+		result.Created++
+	}
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		fail(line+1, "", apierr.TooLarge(maxImportLineSize))
+		result.Stopped = true
+	} else if err != nil {
+		fail(line+1, "", apierr.Internal(fmt.Errorf("reading import: %w", err)))
+	}
+	s.writeJSON(w, r, http.StatusOK, result)
+}
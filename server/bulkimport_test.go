@@ -0,0 +1,118 @@
+// Tests for bulk imports and write throttling
+
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestImportAlbums(t *testing.T) {
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithImportRate(1000),
+	)
+	input := strings.Join([]string{
+		`{"id": "i1", "title": "Help!", "artist": "The Beatles", "price": 1500}`,
+		`{"id": "i2", "title": "Abbey Road", "artist": "The Beatles", "price": "$16"}`,
+		``,
+		`{"id": "i3", "title": "", "artist": "The Beatles"}`,
+		`{"id": "i1", "title": "Help!", "artist": "The Beatles"}`,
+		`{"id": "i4",`,
+	}, "\n")
+
+	result := serve(t, server, newRequest(t, "POST", "/albums/import", strings.NewReader(input)))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	result = serve(t, server, newAdminRequest(t, "POST", "/albums/import", strings.NewReader(input)))
+	ensureStatus(t, result, http.StatusOK)
+	var imported importResult
+	unmarshalResponse(t, result, &imported)
+	if imported.Created != 1 || imported.Stopped || len(imported.Failed) != 4 {
+		t.Fatalf("bad result: %+v", imported)
+	}
+	for i, want := range []importFailure{
+		{Line: 2, ID: "i2", Error: "validation"},
+		{Line: 4, ID: "i3", Error: "validation"},
+		{Line: 5, ID: "i1", Error: "already-exists"},
+		{Line: 6, Error: "malformed-json"},
+	} {
+		got := imported.Failed[i]
+		if got.Line != want.Line || got.ID != want.ID || got.Error != want.Error {
+			t.Errorf("failure %d: got %+v, want %+v", i, got, want)
+		}
+	}
+	if _, err := server.db.GetAlbumByID("i1"); err != nil {
+		t.Fatalf("imported album not added: %v", err)
+	}
+
+	result = serve(t, server, newAdminRequest(t, "POST", "/albums/import", strings.NewReader(strings.Repeat("x", maxImportLineSize+1))))
+	ensureStatus(t, result, http.StatusOK)
+	imported = importResult{}
+	unmarshalResponse(t, result, &imported)
+	if !imported.Stopped || len(imported.Failed) != 1 || imported.Failed[0].Error != "too-large" {
+		t.Fatalf("bad result for long line: %+v", imported)
+	}
+}
+
+func TestWriteThrottle(t *testing.T) {
+	throttle := newWriteThrottle(1000)
+	ctx := context.Background()
+
+	// After the burst is used up, writes are spaced out
+	for i := 0; i < 1000; i++ {
+		if err := throttle.wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := throttle.wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 4*time.Millisecond {
+		t.Fatalf("5 writes took %s, want at least 4ms", elapsed)
+	}
+
+	// Writes give way to interactive requests, but not forever
+	throttle = newWriteThrottle(1000)
+	atomic.StoreInt64(&throttle.interactive, 1)
+	start = time.Now()
+	if err := throttle.wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < maxImportYields*importYieldInterval {
+		t.Fatalf("write took %s, want at least %s", elapsed, maxImportYields*importYieldInterval)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := throttle.wait(cancelled); err != context.Canceled {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+}
+
+func TestThrottledBackfill(t *testing.T) {
+	oldDB := NewMemoryDatabase()
+	for _, id := range []string{"a1", "a2", "a3"} {
+		oldDB.AddAlbum(Album{ID: id, Title: "Help!", Artist: "The Beatles"})
+	}
+	db := NewMigratingDatabase(oldDB, NewMemoryDatabase(), log.New(io.Discard, "", 0))
+	waits := 0
+	result, err := db.backfill(func() error {
+		waits++
+		return nil
+	})
+	if err != nil || result.Albums != 3 || waits != 3 {
+		t.Fatalf("got %+v, %v after %d waits", result, err, waits)
+	}
+
+	server := NewServer(db, log.New(io.Discard, "", 0), WithAdminToken(testAdminToken), WithImportRate(1000))
+	response := serve(t, server, newAdminRequest(t, "POST", "/migration/backfill", nil))
+	ensureStatus(t, response, http.StatusOK)
+}
@@ -0,0 +1,371 @@
+// In-process response cache for album reads
+//
+// GET /albums and GET /albums/{id} are by far the most common requests,
+// and the album list is the most expensive to build (it's filtered,
+// redacted, and encoded on every request). With WithResponseCache, their
+// successful responses are kept in memory for the TTL and served again to
+// identical requests without calling the handler.
+//
+// Two requests are identical if they're for the same tenant, caller role
+// (admins see fields and deleted albums that others don't), host, and URL
+// (including the /v1 prefix, which changes links), and have the same
+// values of the request headers the response varies on, as listed in its
+// Vary header: Accept for the encoding, Accept-Language for translations,
+// and so on. A response with "Vary: *" isn't cached.
+//
+// Every request with a method that can make changes (anything but GET,
+// HEAD, and OPTIONS) clears the cache for its tenant before and after it's
+// handled, so clients see their own writes straight away, and a read that
+// overlaps a write isn't cached. Requests to global routes (like
+// /migration/backfill) clear the cache for every tenant. Changes that
+// aren't made by requests, like albums being published at their release
+// time or purged by the background job, are seen once the TTL is up.
+//
+// Cached responses are sent with "Cache-Control: max-age=<TTL>" (public,
+// or private for admins) and an Age header saying how long ago they were
+// made, so clients and CDNs can cache them for the rest of the TTL too. A
+// route's cache_ttl in -route-config replaces the Cache-Control header,
+// but not the TTL of the server's own cache. A request with "Cache-Control:
+// no-cache" skips the cache, and one with "no-store" isn't cached either.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// responseCacheMaxEntries limits the number of cached responses. When
+	// the cache is full, new responses aren't cached until entries expire.
+	responseCacheMaxEntries = 1000
+
+	// responseCacheMaxBody is the size of the largest response cached.
+	responseCacheMaxBody = 1024 * 1024
+)
+
+// WithResponseCache enables the in-process cache of album responses,
+// which are kept for ttl. The default of zero disables the cache.
+func WithResponseCache(ttl time.Duration) Option {
+	return func(s *Server) {
+		s.responseCacheTTL = ttl
+	}
+}
+
+// responseCache is the cache of album responses, which is shared by the
+// copies of the server for each tenant.
+type responseCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[responseCacheKey][]*cachedResponse // variants, by Vary values
+	size    int
+
+	// Each invalidation increments the tenant's generation, or the global
+	// one for all tenants. Responses are only stored if it's still the
+	// generation they were made in.
+	generation  uint64
+	generations map[string]uint64 // by tenant
+}
+
+type responseCacheKey struct {
+	tenant string
+	role   Role
+	host   string
+	uri    string // with the API prefix
+}
+
+// cachedResponse is a stored response, and the values of the request
+// headers it varies on.
+type cachedResponse struct {
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	vary       []string // canonical header names
+	varyValues []string
+}
+
+func newResponseCache(ttl time.Duration) *responseCache {
+	return &responseCache{
+		ttl:         ttl,
+		entries:     make(map[responseCacheKey][]*cachedResponse),
+		generations: make(map[string]uint64),
+	}
+}
+
+// currentGeneration returns the tenant's current generation.
+func (c *responseCache) currentGeneration(tenant string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation + c.generations[tenant]
+}
+
+// invalidate removes the tenant's cached responses, or every tenant's if
+// tenant is "".
+func (c *responseCache) invalidate(tenant string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if tenant == "" {
+		c.generation++
+		c.entries = make(map[responseCacheKey][]*cachedResponse)
+		c.size = 0
+		return
+	}
+	c.generations[tenant]++
+	for key, variants := range c.entries {
+		if key.tenant == tenant {
+			delete(c.entries, key)
+			c.size -= len(variants)
+		}
+	}
+}
+
+// get returns the unexpired response for the request, if there's one.
+func (c *responseCache) get(key responseCacheKey, r *http.Request, now time.Time) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, response := range c.entries[key] {
+		if now.Before(response.stored.Add(c.ttl)) && response.matches(r) {
+			return response
+		}
+	}
+	return nil
+}
+
+// put stores the response, unless the tenant's generation has changed
+// since it was made or the cache is full.
+func (c *responseCache) put(key responseCacheKey, generation uint64, response *cachedResponse, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation+c.generations[key.tenant] != generation {
+		return
+	}
+	if c.size >= responseCacheMaxEntries {
+		c.removeExpired(now)
+		if c.size >= responseCacheMaxEntries {
+			return
+		}
+	}
+	// Replace the response for the same variant, if there's one
+	existing := c.entries[key]
+	variants := make([]*cachedResponse, 0, len(existing)+1)
+	for _, variant := range existing {
+		if !variant.sameVariant(response) {
+			variants = append(variants, variant)
+		}
+	}
+	variants = append(variants, response)
+	c.size += len(variants) - len(existing)
+	c.entries[key] = variants
+}
+
+// removeExpired removes the responses whose TTL is up. The caller must
+// hold c.mu.
+func (c *responseCache) removeExpired(now time.Time) {
+	for key, variants := range c.entries {
+		unexpired := variants[:0]
+		for _, response := range variants {
+			if now.Before(response.stored.Add(c.ttl)) {
+				unexpired = append(unexpired, response)
+			}
+		}
+		c.size -= len(variants) - len(unexpired)
+		if len(unexpired) == 0 {
+			delete(c.entries, key)
+		} else {
+			c.entries[key] = unexpired
+		}
+	}
+}
+
+// matches reports whether r has the same values of the varying headers as
+// the request the response was made for.
+func (cr *cachedResponse) matches(r *http.Request) bool {
+	for i, name := range cr.vary {
+		if varyValue(r, name) != cr.varyValues[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameVariant reports whether the two responses are for requests with the
+// same values of the varying headers.
+func (cr *cachedResponse) sameVariant(other *cachedResponse) bool {
+	if len(cr.vary) != len(other.vary) {
+		return false
+	}
+	for i := range cr.vary {
+		if cr.vary[i] != other.vary[i] || cr.varyValues[i] != other.varyValues[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// varyValue returns all the request's values of the named header, joined.
+func varyValue(r *http.Request, name string) string {
+	return strings.Join(r.Header.Values(name), ",")
+}
+
+// parseVary returns the canonical header names in a response's Vary
+// header values, and false if they include "*".
+func parseVary(values []string) ([]string, bool) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names, true
+}
+
+// isCachedRoute reports whether the request's responses can be cached.
+func isCachedRoute(r *http.Request) bool {
+	if r.Method != "GET" || isStreaming(r) {
+		return false
+	}
+	rte, _ := apiRoutes.match(r)
+	return rte != nil && (rte.pattern == "/albums" || rte.pattern == "/albums/{id:album}")
+}
+
+// isSafeMethod reports whether requests with the method don't make
+// changes.
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// cachedRoute routes the request like route, but serves album reads from
+// the response cache, and clears it when the request could make changes.
+func (s *Server) cachedRoute(w http.ResponseWriter, r *http.Request) {
+	cache := s.responseCache
+	switch {
+	case cache == nil:
+		s.route(w, r)
+	case !isSafeMethod(r.Method):
+		cache.invalidate(s.tenant)
+		defer cache.invalidate(s.tenant)
+		s.route(w, r)
+	case isCachedRoute(r):
+		s.serveCached(w, r, cache)
+	default:
+		s.route(w, r)
+	}
+}
+
+// serveCached writes the cached response for the request if there's one,
+// otherwise routes it and caches a successful response.
+func (s *Server) serveCached(w http.ResponseWriter, r *http.Request, cache *responseCache) {
+	principal := s.principal(r)
+	key := responseCacheKey{
+		tenant: s.tenant,
+		role:   principal.Role,
+		host:   r.Host,
+		uri:    apiPrefix(r) + r.URL.RequestURI(),
+	}
+	requestCacheControl := strings.ToLower(r.Header.Get("Cache-Control"))
+	now := s.now()
+	if !strings.Contains(requestCacheControl, "no-cache") && !strings.Contains(requestCacheControl, "no-store") {
+		if response := cache.get(key, r, now); response != nil {
+			s.writeCached(w, r, response, now)
+			return
+		}
+	}
+
+	visibility := "public"
+	if principal.Role >= RoleAdmin {
+		visibility = "private"
+	}
+	before := w.Header().Clone()
+	generation := cache.currentGeneration(s.tenant)
+	cw := &responseCacheWriter{
+		recordingWriter: recordingWriter{ResponseWriter: w},
+		cacheControl:    fmt.Sprintf("%s, max-age=%d", visibility, int(cache.ttl/time.Second)),
+	}
+	s.route(cw, r)
+	if cw.status != http.StatusOK || cw.buf.Len() > responseCacheMaxBody || strings.Contains(requestCacheControl, "no-store") {
+		return
+	}
+	vary, ok := parseVary(w.Header().Values("Vary"))
+	if !ok {
+		return
+	}
+	response := &cachedResponse{
+		header: changedHeaders(before, w.Header()),
+		body:   cw.buf.Bytes(),
+		stored: now,
+		vary:   vary,
+	}
+	for _, name := range vary {
+		response.varyValues = append(response.varyValues, varyValue(r, name))
+	}
+	cache.put(key, generation, response, now)
+}
+
+// writeCached writes a cached response, or 304 Not Modified if the client
+// has the same version of it.
+func (s *Server) writeCached(w http.ResponseWriter, r *http.Request, response *cachedResponse, now time.Time) {
+	dst := w.Header()
+	for k, vv := range response.header {
+		dst[k] = vv
+	}
+	dst.Set("Age", strconv.Itoa(int(now.Sub(response.stored)/time.Second)))
+	if etag := dst.Get("ETag"); etag != "" && etagMatch(r.Header.Get("If-None-Match"), etag) {
+		dst.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(response.body)
+	if err != nil {
+		s.log.Printf("error writing response: %v", err)
+	}
+}
+
+// changedHeaders returns the headers in after that the handler set, that
+// is, that differ from before. Headers set further out in the chain (like
+// the request ID) are set again on each request, so they're not stored.
+func changedHeaders(before, after http.Header) http.Header {
+	changed := make(http.Header)
+	for k, vv := range after {
+		if strings.Join(before[k], "\n") != strings.Join(vv, "\n") {
+			changed[k] = append([]string(nil), vv...)
+		}
+	}
+	return changed
+}
+
+// responseCacheWriter records the response for the cache, and sets the
+// Cache-Control and Age headers of successful ones, replacing any the
+// handler set.
+type responseCacheWriter struct {
+	recordingWriter
+	cacheControl string
+}
+
+func (cw *responseCacheWriter) WriteHeader(status int) {
+	if !cw.wroteHeader && status == http.StatusOK {
+		cw.Header().Set("Cache-Control", cw.cacheControl)
+		cw.Header().Set("Age", "0")
+	}
+	cw.recordingWriter.WriteHeader(status)
+}
+
+func (cw *responseCacheWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.recordingWriter.Write(p)
+}
@@ -0,0 +1,157 @@
+// Tests for the in-process response cache
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithResponseCache(time.Minute),
+		WithClock(func() time.Time { return now }))
+	getTitles := func(request *http.Request, wantAge string) string {
+		t.Helper()
+		result := serve(t, server, request)
+		ensureStatus(t, result, http.StatusOK)
+		if got := result.Header.Get("Age"); got != wantAge {
+			t.Fatalf("got Age %q, want %q", got, wantAge)
+		}
+		var albums []Album
+		unmarshalResponse(t, result, &albums)
+		var titles []string
+		for _, album := range albums {
+			titles = append(titles, album.Title)
+		}
+		return strings.Join(titles, ", ")
+	}
+
+	result := serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Cache-Control"); got != "public, max-age=60" {
+		t.Fatalf("got Cache-Control %q", got)
+	}
+	etag := result.Header.Get("ETag")
+
+	// Changes that aren't made by requests aren't seen until the TTL is up
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000})
+	now = now.Add(30 * time.Second)
+	if got := getTitles(newRequest(t, "GET", "/albums", nil), "30"); got != "9th Symphony" {
+		t.Fatalf("got %q from cache", got)
+	}
+	request := newRequest(t, "GET", "/albums", nil)
+	request.Header.Set("If-None-Match", etag)
+	ensureStatus(t, serve(t, server, request), http.StatusNotModified)
+	request = newRequest(t, "GET", "/albums", nil)
+	request.Header.Set("Cache-Control", "no-cache")
+	if got := getTitles(request, "0"); got != "9th Symphony, Hey Jude" {
+		t.Fatalf("got %q with no-cache", got)
+	}
+	now = now.Add(time.Minute)
+	if got := getTitles(newRequest(t, "GET", "/albums", nil), "0"); got != "9th Symphony, Hey Jude" {
+		t.Fatalf("got %q after TTL", got)
+	}
+
+	// Admins get their own private copies
+	result = serve(t, server, newAdminRequest(t, "GET", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Cache-Control"); got != "private, max-age=60" {
+		t.Fatalf("got Cache-Control %q for admin", got)
+	}
+
+	// Writes clear the cache straight away
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a3", "title": "Pianoman", "artist": "Billy Joel"}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	if got := getTitles(newRequest(t, "GET", "/albums", nil), "0"); got != "9th Symphony, Hey Jude, Pianoman" {
+		t.Fatalf("got %q after write", got)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/albums/a3", nil))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a3", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newRequest(t, "GET", "/albums/a3", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	// Responses are cached separately for each value of the headers they
+	// vary on
+	request = newRequest(t, "GET", "/albums/a1", nil)
+	request.Header.Set("Accept", "application/xml")
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+		t.Fatalf("got Content-Type %q after XML response was cached", got)
+	}
+}
+
+func TestResponseCacheTenants(t *testing.T) {
+	server := newTenantTestServer(t, WithResponseCache(time.Minute))
+	getTitle := func(tenant string) string {
+		t.Helper()
+		return getTenantAlbum(t, server, newTenantRequest(t, "GET", "/albums/t1", tenant, "", nil)).Title
+	}
+	if got := getTitle("acme"); got != "Help! (acme)" {
+		t.Fatalf("got %q for acme", got)
+	}
+	if got := getTitle("globex"); got != "Help! (globex)" {
+		t.Fatalf("got %q for globex", got)
+	}
+
+	// A write for one tenant only clears its own cached responses
+	body := strings.NewReader(`{"title": "Help!", "artist": "The Beatles", "version": 1}`)
+	result := serve(t, server, newTenantRequest(t, "PUT", "/albums/t1", "acme", "acme-admin", body))
+	ensureStatus(t, result, http.StatusOK)
+	if got := getTitle("acme"); got != "Help!" {
+		t.Fatalf("got %q for acme after write", got)
+	}
+	if got := getTitle("globex"); got != "Help! (globex)" {
+		t.Fatalf("got %q for globex after acme write", got)
+	}
+	if n := len(server.responseCache.entries); n != 2 {
+		t.Fatalf("got %d cache entries, want 2", n)
+	}
+}
+
+func TestResponseCacheGeneration(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cache := newResponseCache(time.Minute)
+	key := responseCacheKey{tenant: "acme", uri: "/albums"}
+	request := newRequest(t, "GET", "/albums", nil)
+
+	// A response made before a write finished isn't stored
+	generation := cache.currentGeneration("acme")
+	cache.invalidate("acme")
+	cache.put(key, generation, &cachedResponse{stored: now}, now)
+	if cache.get(key, request, now) != nil {
+		t.Fatal("stored response from before invalidation")
+	}
+	cache.put(key, cache.currentGeneration("acme"), &cachedResponse{stored: now}, now)
+	if cache.get(key, request, now) == nil {
+		t.Fatal("didn't store response")
+	}
+	cache.invalidate("globex")
+	if cache.get(key, request, now) == nil {
+		t.Fatal("other tenant's write cleared response")
+	}
+	cache.invalidate("")
+	if cache.get(key, request, now) != nil || cache.size != 0 {
+		t.Fatal("global write didn't clear response")
+	}
+
+	if names, ok := parseVary([]string{"accept, X-Tenant", "Accept"}); !ok || strings.Join(names, " ") != "Accept X-Tenant" {
+		t.Fatalf("got %q, %v", names, ok)
+	}
+	if _, ok := parseVary([]string{"Accept, *"}); ok {
+		t.Fatal("expected Vary: * not to be cacheable")
+	}
+}
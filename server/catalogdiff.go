@@ -0,0 +1,173 @@
+// Diff the album catalogs of two deployments
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// To check that a migration or region replication copied everything, run
+// the server with -diff-from and -diff-to, each either the base URL of a
+// running server (whose full export is fetched from GET /export, using
+// -admin-token) or a snapshot file written by the snapshot job. It
+// prints a JSON catalogDiff of the albums added, removed, and changed
+// going from the first catalog to the second, and exits with status 0 if
+// they're the same, 1 if they differ, or 2 if either couldn't be loaded.
+//
+// Fields assigned by each database (the version and timestamps) are
+// ignored, as they're expected to differ between deployments.
+var catalogDiffIgnored = map[string]bool{
+	"version":    true,
+	"created_at": true,
+	"updated_at": true,
+}
+
+// getExport returns a snapshot of the whole database, including deleted
+// albums, in the same format as the snapshot job's file.
+func (s *Server) getExport(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	snapshot, err := takeDatabaseSnapshot(s.db, s.now())
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, snapshot)
+}
+
+// catalogDiff is the difference between two catalogs.
+type catalogDiff struct {
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Added   []Album        `json:"added"`   // in To but not From
+	Removed []Album        `json:"removed"` // in From but not To
+	Changed []changedAlbum `json:"changed"`
+}
+
+// changedAlbum is an album that's in both catalogs, but differs.
+type changedAlbum struct {
+	ID      string        `json:"id"`
+	Changes []fieldChange `json:"changes"`
+}
+
+// empty reports whether the catalogs were the same.
+func (d catalogDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// diffCatalogs compares the albums in two snapshots, sorted by ID.
+func diffCatalogs(from, to DatabaseSnapshot) catalogDiff {
+	diff := catalogDiff{Added: []Album{}, Removed: []Album{}, Changed: []changedAlbum{}}
+	fromAlbums := make(map[string]Album, len(from.Albums))
+	for _, album := range from.Albums {
+		fromAlbums[album.ID] = album
+	}
+	toAlbums := make(map[string]Album, len(to.Albums))
+	for _, album := range to.Albums {
+		toAlbums[album.ID] = album
+		old, ok := fromAlbums[album.ID]
+		if !ok {
+			diff.Added = append(diff.Added, album)
+			continue
+		}
+		var changes []fieldChange
+		for _, change := range diffAlbums(old, album) {
+			if !catalogDiffIgnored[change.Field] {
+				changes = append(changes, change)
+			}
+		}
+		if len(changes) > 0 {
+			diff.Changed = append(diff.Changed, changedAlbum{album.ID, changes})
+		}
+	}
+	for _, album := range from.Albums {
+		if _, ok := toAlbums[album.ID]; !ok {
+			diff.Removed = append(diff.Removed, album)
+		}
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].ID < diff.Added[j].ID })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].ID < diff.Removed[j].ID })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].ID < diff.Changed[j].ID })
+	return diff
+}
+
+// loadCatalog loads a snapshot from source, which is either the base URL
+// of a server (fetched from its /export route with adminToken) or the
+// path of a snapshot file.
+func loadCatalog(source, adminToken string, client *http.Client) (DatabaseSnapshot, error) {
+	var snapshot DatabaseSnapshot
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		b, err := os.ReadFile(source)
+		if err != nil {
+			return snapshot, err
+		}
+		err = json.Unmarshal(b, &snapshot)
+		if err != nil {
+			return snapshot, fmt.Errorf("parsing %s: %w", source, err)
+		}
+		return snapshot, nil
+	}
+
+	request, err := http.NewRequest("GET", strings.TrimSuffix(source, "/")+"/export", nil)
+	if err != nil {
+		return snapshot, err
+	}
+	if adminToken != "" {
+		request.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return snapshot, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return snapshot, fmt.Errorf("fetching export from %s: %s: %s", source, response.Status, strings.TrimSpace(string(b)))
+	}
+	err = json.NewDecoder(response.Body).Decode(&snapshot)
+	if err != nil {
+		return snapshot, fmt.Errorf("parsing export from %s: %w", source, err)
+	}
+	return snapshot, nil
+}
+
+// diffCatalogCommand writes the diff of the catalogs at from and to (see
+// loadCatalog) to w as JSON. It returns the process exit code: 0 if
+// they're the same, 1 if they differ, or 2 if either couldn't be loaded.
+func diffCatalogCommand(from, to, adminToken string, w io.Writer) int {
+	client := &http.Client{Timeout: time.Minute}
+	fromSnapshot, err := loadCatalog(from, adminToken, client)
+	if err != nil {
+		fmt.Fprintf(w, "error loading %s: %v\n", from, err)
+		return 2
+	}
+	toSnapshot, err := loadCatalog(to, adminToken, client)
+	if err != nil {
+		fmt.Fprintf(w, "error loading %s: %v\n", to, err)
+		return 2
+	}
+
+	diff := diffCatalogs(fromSnapshot, toSnapshot)
+	diff.From, diff.To = from, to
+	b, err := json.MarshalIndent(diff, "", "    ")
+	if err != nil {
+		fmt.Fprintf(w, "error encoding diff: %v\n", err)
+		return 2
+	}
+	fmt.Fprintln(w, string(b))
+	if diff.empty() {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,118 @@
+// Tests for diffing the album catalogs of two deployments
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	server := newSoftDeleteTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/export", nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+
+	result = serve(t, server, newAdminRequest(t, "DELETE", "/albums/a2", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newAdminRequest(t, "GET", "/export", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var snapshot DatabaseSnapshot
+	unmarshalResponse(t, result, &snapshot)
+	if len(snapshot.Albums) != 2 || snapshot.Albums[1].ID != "a2" || snapshot.Albums[1].DeletedAt == nil {
+		t.Fatalf("export should include deleted albums: %+v", snapshot.Albums)
+	}
+}
+
+func TestDiffCatalogs(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	from := DatabaseSnapshot{Albums: []Album{
+		{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795, Version: 1, CreatedAt: now},
+		{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000},
+		{ID: "a3", Title: "Pianoman", Artist: "Billy Joel"},
+	}}
+	to := DatabaseSnapshot{Albums: []Album{
+		{ID: "a4", Title: "Blue", Artist: "Joni Mitchell"},
+		{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2500},
+		// Database-assigned fields are ignored
+		{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795, Version: 3, CreatedAt: now.Add(time.Hour)},
+	}}
+	diff := diffCatalogs(from, to)
+	want := catalogDiff{
+		Added:   []Album{to.Albums[0]},
+		Removed: []Album{from.Albums[2]},
+		Changed: []changedAlbum{
+			{ID: "a2", Changes: []fieldChange{{Field: "price", Old: json.RawMessage("2000"), New: json.RawMessage("2500")}}},
+		},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Fatalf("got diff:\n%+v\nwant:\n%+v", diff, want)
+	}
+	if diff.empty() || !diffCatalogs(from, from).empty() {
+		t.Fatalf("bad empty()")
+	}
+}
+
+func TestDiffCatalogCommand(t *testing.T) {
+	server := httptest.NewServer(newSoftDeleteTestServer())
+	defer server.Close()
+
+	// A snapshot file the same as the server's catalog
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000})
+	snapshot, err := takeDatabaseSnapshot(db, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "albums.json")
+	err = writeSnapshotFile(path, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	code := diffCatalogCommand(server.URL, path, testAdminToken, &out)
+	if code != 0 {
+		t.Fatalf("got exit code %d, want 0:\n%s", code, out.String())
+	}
+
+	// And one with an album missing
+	snapshot.Albums = snapshot.Albums[:1]
+	writeSnapshotFile(path, snapshot)
+	out.Reset()
+	code = diffCatalogCommand(server.URL+"/", path, testAdminToken, &out)
+	if code != 1 {
+		t.Fatalf("got exit code %d, want 1:\n%s", code, out.String())
+	}
+	var diff catalogDiff
+	err = json.Unmarshal(out.Bytes(), &diff)
+	if err != nil {
+		t.Fatalf("parsing output: %v\n%s", err, out.String())
+	}
+	if diff.From != server.URL+"/" || diff.To != path || len(diff.Removed) != 1 || diff.Removed[0].ID != "a2" {
+		t.Fatalf("bad diff: %+v", diff)
+	}
+
+	// Errors loading either catalog
+	for _, sources := range [][2]string{
+		{server.URL, filepath.Join(t.TempDir(), "missing.json")},
+		{server.URL + "/nowhere", path},
+	} {
+		out.Reset()
+		code = diffCatalogCommand(sources[0], sources[1], testAdminToken, &out)
+		if code != 2 || !strings.HasPrefix(out.String(), "error loading ") {
+			t.Errorf("%q: got exit code %d, want 2:\n%s", sources, code, out.String())
+		}
+	}
+	out.Reset()
+	code = diffCatalogCommand(server.URL, path, "wrong", &out)
+	if code != 2 || !strings.Contains(out.String(), "403 Forbidden") {
+		t.Errorf("got exit code %d, want 2:\n%s", code, out.String())
+	}
+}
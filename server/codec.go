@@ -0,0 +1,81 @@
+// Pluggable JSON codec for requests and responses
+//
+// The server encodes JSON responses and decodes JSON request bodies with a
+// Codec, which is encoding/json (JSONCodec) by default. WithCodec swaps in
+// another implementation, like a faster third-party encoder, without
+// changing any handlers. Built with GOEXPERIMENT=jsonv2, JSONv2Codec uses
+// the experimental encoding/json/v2 package (see codec_jsonv2.go).
+//
+// Only the API's own requests and responses go through the codec: writeJSON
+// and readJSON, ETagged and streamed responses, NDJSON, and bulk imports.
+// Configuration files, snapshots, and the payloads of other services (like
+// webhooks and the event broker) always use encoding/json.
+//
+// A replacement codec must produce the same JSON for the server's types as
+// encoding/json does, including honouring struct tags and MarshalJSON and
+// UnmarshalJSON methods (prices and timestamps rely on them), or clients
+// will see the difference. The benchmarks in codec_test.go compare codecs
+// on typical responses and requests:
+//
+//	go test -run=^$ -bench=Codec
+//	GOEXPERIMENT=jsonv2 go test -run=^$ -bench=Codec
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// Codec is the interface used by the server to encode and decode JSON.
+type Codec interface {
+	// Encode writes the JSON encoding of v to w, followed by a newline. If
+	// indent is non-empty, the JSON is indented: each element of an
+	// object or array starts on a new line beginning with prefix and then
+	// copies of indent, like json.MarshalIndent. Otherwise it's compact,
+	// and prefix is ignored. Encode must marshal all of v before writing
+	// any of it to w, so that if marshaling fails the server can still
+	// write an error response.
+	Encode(w io.Writer, v interface{}, prefix, indent string) error
+
+	// Decode unmarshals the JSON in data into v, like json.Unmarshal.
+	Decode(data []byte, v interface{}) error
+}
+
+// WithCodec sets the codec used to encode and decode JSON. The default
+// (or nil) is JSONCodec.
+func WithCodec(codec Codec) Option {
+	return func(s *Server) {
+		s.codec = codec
+	}
+}
+
+// encodeJSON encodes v to w with the server's codec for the response to r.
+// If prettyJSON says to, it's indented, with each line after the first
+// starting with prefix.
+func (s *Server) encodeJSON(w io.Writer, r *http.Request, v interface{}, prefix string) error {
+	indent := ""
+	if s.prettyJSON(r) {
+		indent = "    "
+	}
+	return s.codec.Encode(w, v, prefix, indent)
+}
+
+// JSONCodec is a Codec that uses the standard library's encoding/json.
+type JSONCodec struct{}
+
+// Encode implements Codec.Encode with a json.Encoder, which buffers each
+// value in full before writing it.
+func (JSONCodec) Encode(w io.Writer, v interface{}, prefix, indent string) error {
+	encoder := json.NewEncoder(w)
+	if indent != "" {
+		encoder.SetIndent(prefix, indent)
+	}
+	return encoder.Encode(v)
+}
+
+// Decode implements Codec.Decode with json.Unmarshal.
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
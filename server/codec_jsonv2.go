@@ -0,0 +1,52 @@
+//go:build goexperiment.jsonv2
+
+// JSON codec using the experimental encoding/json/v2 package
+
+package server
+
+import (
+	jsonv1 "encoding/json"
+	"encoding/json/jsontext"
+	jsonv2 "encoding/json/v2"
+	"io"
+)
+
+// JSONv2Codec is a Codec that uses encoding/json/v2, which is only
+// available when built with GOEXPERIMENT=jsonv2.
+//
+// Options are passed to every call. The default (nil) is the options that
+// give the same results as encoding/json, so clients can't tell the
+// difference. Use jsonv2.DefaultOptionsV2() for v2's own behaviour, which
+// is faster but different: for example, it writes nil slices as [] rather
+// than null, doesn't escape HTML characters, and matches field names case
+// sensitively when decoding.
+type JSONv2Codec struct {
+	Options jsonv2.Options
+}
+
+func (c JSONv2Codec) options() jsonv2.Options {
+	if c.Options == nil {
+		return jsonv1.DefaultOptionsV1()
+	}
+	return c.Options
+}
+
+// Encode implements Codec.Encode with jsonv2.Marshal, so nothing is
+// written if marshaling fails.
+func (c JSONv2Codec) Encode(w io.Writer, v interface{}, prefix, indent string) error {
+	opts := []jsonv2.Options{c.options()}
+	if indent != "" {
+		opts = append(opts, jsontext.Multiline(true), jsontext.WithIndentPrefix(prefix), jsontext.WithIndent(indent))
+	}
+	b, err := jsonv2.Marshal(v, opts...)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Decode implements Codec.Decode with jsonv2.Unmarshal.
+func (c JSONv2Codec) Decode(data []byte, v interface{}) error {
+	return jsonv2.Unmarshal(data, v, c.options())
+}
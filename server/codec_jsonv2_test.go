@@ -0,0 +1,42 @@
+//go:build goexperiment.jsonv2
+
+// Tests for the encoding/json/v2 codec
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	jsonv2 "encoding/json/v2"
+)
+
+func init() {
+	testCodecs["jsonv2"] = JSONv2Codec{}
+	benchmarkCodecs["jsonv2-native"] = JSONv2Codec{Options: jsonv2.DefaultOptionsV2()}
+}
+
+func TestJSONv2Codec(t *testing.T) {
+	// With the default options, responses are the same as with JSONCodec
+	get := func(codec Codec, url string) string {
+		t.Helper()
+		now := func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+		db := NewMemoryDatabase()
+		db.Now = now
+		server := NewServer(db, log.New(io.Discard, "", 0), WithCodec(codec), WithClock(now))
+		result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a1", "title": "<Pianoman>", "artist": "Billy Joel", "price": 999}`)))
+		ensureStatus(t, result, http.StatusCreated)
+		result = serve(t, server, newRequest(t, "GET", url, nil))
+		b, _ := io.ReadAll(result.Body)
+		return string(b)
+	}
+	for _, url := range []string{"/albums", "/albums/a1?pretty=1", "/albums/x"} {
+		if got, want := get(JSONv2Codec{}, url), get(JSONCodec{}, url); got != want {
+			t.Fatalf("%s: got vs want:\n%s\n%s", url, got, want)
+		}
+	}
+}
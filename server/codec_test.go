@@ -0,0 +1,224 @@
+// Tests and benchmarks for the JSON codec
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCodecs are the codecs that must give the same results as
+// encoding/json, by name, and benchmarkCodecs others that are only
+// benchmarked. Codecs that need build tags are added by their own test
+// files.
+var (
+	testCodecs = map[string]Codec{
+		"json": JSONCodec{},
+	}
+	benchmarkCodecs = map[string]Codec{}
+)
+
+// allCodecs returns the tested and benchmarked codecs, by name.
+func allCodecs() map[string]Codec {
+	codecs := make(map[string]Codec)
+	for _, m := range []map[string]Codec{testCodecs, benchmarkCodecs} {
+		for name, codec := range m {
+			codecs[name] = codec
+		}
+	}
+	return codecs
+}
+
+// countingCodec is a Codec that counts its calls.
+type countingCodec struct {
+	Codec
+	encodes, decodes int
+	indents          []string
+}
+
+func (c *countingCodec) Encode(w io.Writer, v interface{}, prefix, indent string) error {
+	c.encodes++
+	c.indents = append(c.indents, indent)
+	return c.Codec.Encode(w, v, prefix, indent)
+}
+
+func (c *countingCodec) Decode(data []byte, v interface{}) error {
+	c.decodes++
+	return c.Codec.Decode(data, v)
+}
+
+func TestCodec(t *testing.T) {
+	codec := &countingCodec{Codec: JSONCodec{}}
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithCodec(codec))
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a1", "title": "Pianoman", "artist": "Billy Joel"}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	result = serve(t, server, newRequest(t, "GET", "/albums?pretty=1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newRequest(t, "GET", "/albums/x", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	if codec.decodes != 1 || codec.encodes != 3 || strings.Join(codec.indents, "|") != "|    |" {
+		t.Fatalf("got %d decodes and %d encodes with indents %q", codec.decodes, codec.encodes, codec.indents)
+	}
+}
+
+func TestCodecsMatchEncodingJSON(t *testing.T) {
+	albums := benchmarkAlbums(3)
+	albums[0].Tracks = nil // omitted
+	albums[1].Genres = []string{}
+	for name, codec := range testCodecs {
+		for _, indent := range []string{"", "\t"} {
+			var want bytes.Buffer
+			encoder := json.NewEncoder(&want)
+			if indent != "" {
+				encoder.SetIndent("  ", indent)
+			}
+			err := encoder.Encode(albums)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			err = codec.Encode(&got, albums, "  ", indent)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if got.String() != want.String() {
+				t.Fatalf("%s: indent %q: got vs want:\n%s\n%s", name, indent, got.String(), want.String())
+			}
+		}
+
+		// Embedded structs, raw messages, and field names (which are
+		// matched case-insensitively) decode like encoding/json
+		var input albumInput
+		err := codec.Decode([]byte(`{"ID": "a1", "title": "Pianoman", "price": 1099}`), &input)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if input.ID != "a1" || input.Title != "Pianoman" || string(input.Price) != "1099" {
+			t.Fatalf("%s: got %+v", name, input)
+		}
+		if err := codec.Decode([]byte(`{"title": `), &input); err == nil {
+			t.Fatalf("%s: expected error for malformed JSON", name)
+		}
+
+		// Nothing is written if marshaling fails
+		var buf bytes.Buffer
+		err = codec.Encode(&buf, map[string]interface{}{"ok": 1, "bad": func() {}}, "", "")
+		if err == nil || buf.Len() != 0 {
+			t.Fatalf("%s: got %v and %q for value that can't be marshaled", name, err, buf.String())
+		}
+	}
+}
+
+// benchmarkAlbums returns n albums like typical catalog entries.
+func benchmarkAlbums(n int) []Album {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	albums := make([]Album, n)
+	for i := range albums {
+		albums[i] = Album{
+			ID:        fmt.Sprintf("a%d", i),
+			Title:     "Sgt. Pepper's Lonely Hearts Club Band",
+			Artist:    "The Beatles",
+			Price:     1999,
+			Genres:    []string{"rock", "pop"},
+			Version:   3,
+			CreatedAt: created,
+			UpdatedAt: created.Add(time.Hour),
+		}
+		for j := 1; j <= 10; j++ {
+			albums[i].Tracks = append(albums[i].Tracks, Track{Number: j, Title: fmt.Sprintf("Track %d", j), Duration: 180 + j})
+		}
+	}
+	return albums
+}
+
+func BenchmarkCodecEncode(b *testing.B) {
+	albums := benchmarkAlbums(100)
+	for name, codec := range allCodecs() {
+		for _, indent := range []string{"", "    "} {
+			b.Run(fmt.Sprintf("%s/indent=%t", name, indent != ""), func(b *testing.B) {
+				buf := getBuffer()
+				defer putBuffer(buf)
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					buf.Reset()
+					err := codec.Encode(buf, albums, "", indent)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.SetBytes(int64(buf.Len()))
+			})
+		}
+	}
+}
+
+func BenchmarkCodecDecode(b *testing.B) {
+	body := []byte(`{"id": "a1", "title": "Sgt. Pepper's Lonely Hearts Club Band", "artist": "The Beatles",
+		"price": 1999, "genres": ["rock", "pop"], "tracks": [{"title": "Sgt. Pepper's Lonely Hearts Club Band", "duration": 122},
+		{"title": "With a Little Help from My Friends", "duration": 164}, {"title": "Lucy in the Sky with Diamonds", "duration": 208}]}`)
+	for name, codec := range allCodecs() {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				var input albumInput
+				err := codec.Decode(body, &input)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCodecGetAlbums(b *testing.B) {
+	// The whole request, to show how much of it is encoding
+	for name, codec := range allCodecs() {
+		b.Run(name, func(b *testing.B) {
+			db := NewMemoryDatabase()
+			for _, album := range benchmarkAlbums(100) {
+				db.AddAlbum(album)
+			}
+			server := NewServer(db, log.New(io.Discard, "", 0), WithCodec(codec))
+			request, err := http.NewRequest("GET", "/albums", nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				recorder := discardRecorder{header: make(http.Header)}
+				server.ServeHTTP(&recorder, request)
+				if recorder.status != http.StatusOK {
+					b.Fatalf("got status %d", recorder.status)
+				}
+			}
+		})
+	}
+}
+
+// discardRecorder is a ResponseWriter that only records the status, so
+// benchmarks don't measure buffering the body.
+type discardRecorder struct {
+	header http.Header
+	status int
+}
+
+func (d *discardRecorder) Header() http.Header { return d.header }
+
+func (d *discardRecorder) WriteHeader(status int) {
+	if d.status == 0 {
+		d.status = status
+	}
+}
+
+func (d *discardRecorder) Write(p []byte) (int, error) {
+	d.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
@@ -0,0 +1,723 @@
+// Conformance tests that every Database implementation must pass
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryDatabaseConformance(t *testing.T) {
+	testDatabaseConformance(t, func() Database {
+		return NewMemoryDatabase()
+	})
+}
+
+// testDatabaseConformance runs the conformance suite against databases
+// created by newDatabase, which must return a new empty database each time
+// it's called. Call this from a TestXyzDatabaseConformance function for
+// each backend.
+func testDatabaseConformance(t *testing.T, newDatabase func() Database) {
+	// IDs chosen to catch locale-aware or case-insensitive collation, and
+	// numeric rather than string comparison
+	ids := []string{"b", "a10", "B", "a9", "é", "z", "A", "a", "_", "a1"}
+	wantIDs := []string{"A", "B", "_", "a", "a1", "a10", "a9", "b", "z", "é"}
+
+	t.Run("GetAlbumsOrder", func(t *testing.T) {
+		db := newDatabase()
+		for _, id := range ids {
+			mustAddAlbum(t, db, Album{ID: id, Title: "Title " + id, Artist: "Artist"})
+		}
+		albums, err := db.GetAlbums()
+		if err != nil {
+			t.Fatalf("error getting albums: %v", err)
+		}
+		ensureIDs(t, albums, wantIDs)
+
+		// Order must be stable across calls too
+		albums, err = db.GetAlbums()
+		if err != nil {
+			t.Fatalf("error getting albums: %v", err)
+		}
+		ensureIDs(t, albums, wantIDs)
+	})
+
+	t.Run("GetAlbumsEmpty", func(t *testing.T) {
+		db := newDatabase()
+		albums, err := db.GetAlbums()
+		if err != nil {
+			t.Fatalf("error getting albums: %v", err)
+		}
+		if albums == nil || len(albums) != 0 {
+			t.Fatalf("got %#v, want empty non-nil slice", albums)
+		}
+	})
+
+	t.Run("StreamAlbumsOrder", func(t *testing.T) {
+		db := newDatabase()
+		if _, ok := db.(AlbumStreamer); !ok {
+			t.Skip("database doesn't implement AlbumStreamer")
+		}
+		for _, id := range ids {
+			mustAddAlbum(t, db, Album{ID: id, Title: "Title " + id, Artist: "Artist"})
+		}
+		var albums []Album
+		err := streamAlbums(db, func(album Album) error {
+			albums = append(albums, album)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("error streaming albums: %v", err)
+		}
+		ensureIDs(t, albums, wantIDs)
+
+		// Stops at the callback's first error
+		errStop := errors.New("stop")
+		n := 0
+		err = streamAlbums(db, func(album Album) error {
+			n++
+			return errStop
+		})
+		if err != errStop || n != 1 {
+			t.Fatalf("got error %v after %d albums, want %v after 1", err, n, errStop)
+		}
+	})
+
+	t.Run("FilterAlbums", func(t *testing.T) {
+		db := newDatabase()
+		if _, ok := db.(AlbumFilterer); !ok {
+			t.Skip("database doesn't implement AlbumFilterer")
+		}
+		for i, id := range ids {
+			mustAddAlbum(t, db, Album{ID: id, Title: "Title " + id, Artist: "Artist", Price: i * 100})
+		}
+
+		// Must match what the filter matches in Go, in the same order
+		for _, q := range []string{
+			`price >= 300 AND NOT (id = "z" OR id ~ "A1")`,
+			`title ~ "TITLE" AND version = 1`,
+			`price < 0`,
+		} {
+			filter, err := parseFilter(q)
+			if err != nil {
+				t.Fatalf("error parsing filter %q: %v", q, err)
+			}
+			albums, err := filterAlbums(db, filter)
+			if err != nil {
+				t.Fatalf("error filtering albums: %v", err)
+			}
+			all, err := db.GetAlbums()
+			if err != nil {
+				t.Fatalf("error getting albums: %v", err)
+			}
+			want := []string{}
+			for _, album := range filterMatching(all, compileFilter(filter)) {
+				want = append(want, album.ID)
+			}
+			ensureIDs(t, albums, want)
+		}
+	})
+
+	t.Run("SearchAlbumsOrder", func(t *testing.T) {
+		db := newDatabase()
+		for _, id := range ids {
+			mustAddAlbum(t, db, Album{ID: id, Title: "Title " + id, Artist: "Artist"})
+		}
+		mustAddAlbum(t, db, Album{ID: "other", Title: "Other", Artist: "Someone"})
+		albums, err := db.SearchAlbums("artist")
+		if err != nil {
+			t.Fatalf("error searching albums: %v", err)
+		}
+		ensureIDs(t, albums, wantIDs)
+	})
+
+	t.Run("GetAlbumByID", func(t *testing.T) {
+		db := newDatabase()
+		want := Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795}
+		mustAddAlbum(t, db, want)
+		want.Version = 1
+		got, err := db.GetAlbumByID("a1")
+		if err != nil {
+			t.Fatalf("error getting album: %v", err)
+		}
+		ensureTimestamps(t, got)
+		want.CreatedAt, want.UpdatedAt = got.CreatedAt, got.UpdatedAt
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("bad album: got vs want:\n%#v\n%#v", got, want)
+		}
+		_, err = db.GetAlbumByID("A1")
+		if !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist (IDs must be case-sensitive)", err)
+		}
+	})
+
+	t.Run("GetAlbumsByIDs", func(t *testing.T) {
+		db := newDatabase()
+		for _, id := range ids {
+			mustAddAlbum(t, db, Album{ID: id, Title: "Title " + id, Artist: "Artist"})
+		}
+		albums, err := db.GetAlbumsByIDs([]string{"z", "missing", "a10", "A", "a10", "a9"})
+		if err != nil {
+			t.Fatalf("error getting albums: %v", err)
+		}
+		ensureIDs(t, albums, []string{"A", "a10", "a9", "z"})
+
+		albums, err = db.GetAlbumsByIDs([]string{"missing"})
+		if err != nil {
+			t.Fatalf("error getting albums: %v", err)
+		}
+		if albums == nil || len(albums) != 0 {
+			t.Fatalf("got %#v, want empty non-nil slice", albums)
+		}
+	})
+
+	t.Run("PutAlbum", func(t *testing.T) {
+		db := newDatabase()
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		want := Album{ID: "a1", Title: "5th Symphony", Artist: "Beethoven", Price: 500}
+		stored, err := db.PutAlbum(want, 1)
+		if err != nil {
+			t.Fatalf("error putting album: %v", err)
+		}
+		want.Version = 2
+		ensureTimestamps(t, stored)
+		want.CreatedAt, want.UpdatedAt = stored.CreatedAt, stored.UpdatedAt
+		if !reflect.DeepEqual(stored, want) {
+			t.Fatalf("bad stored album: got vs want:\n%#v\n%#v", stored, want)
+		}
+		got, err := db.GetAlbumByID("a1")
+		if err != nil {
+			t.Fatalf("error getting album: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("bad album: got vs want:\n%#v\n%#v", got, want)
+		}
+
+		stored, err = db.PutAlbum(Album{ID: "a0", Title: "Hey Jude", Artist: "The Beatles"}, 0)
+		if err != nil || stored.Version != 1 {
+			t.Fatalf("got version %d, error %v; want 1, nil", stored.Version, err)
+		}
+		albums, err := db.GetAlbums()
+		if err != nil {
+			t.Fatalf("error getting albums: %v", err)
+		}
+		ensureIDs(t, albums, []string{"a0", "a1"})
+
+		// Search reflects the replaced title
+		albums, err = db.SearchAlbums("9th")
+		if err != nil {
+			t.Fatalf("error searching albums: %v", err)
+		}
+		ensureIDs(t, albums, []string{})
+		albums, err = db.SearchAlbums("5th")
+		if err != nil {
+			t.Fatalf("error searching albums: %v", err)
+		}
+		ensureIDs(t, albums, []string{"a1"})
+	})
+
+	t.Run("PutAlbumVersionConflict", func(t *testing.T) {
+		db := newDatabase()
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		_, err := db.AddTrack("a1", Track{Title: "T", Duration: 1}) // now version 2
+		if err != nil {
+			t.Fatalf("error adding track: %v", err)
+		}
+		for _, version := range []int{0, 1, 3} {
+			_, err = db.PutAlbum(Album{ID: "a1", Title: "Foo", Artist: "Bar"}, version)
+			if !errors.Is(err, ErrVersionConflict) {
+				t.Fatalf("version %d: got error %v, want ErrVersionConflict", version, err)
+			}
+		}
+		_, err = db.PutAlbum(Album{ID: "a2", Title: "Foo", Artist: "Bar"}, 1)
+		if !errors.Is(err, ErrVersionConflict) {
+			t.Fatalf("got error %v, want ErrVersionConflict", err)
+		}
+		album, err := db.GetAlbumByID("a1")
+		if err != nil || album.Title != "9th Symphony" || album.Version != 2 {
+			t.Fatalf("got album %#v, error %v; want unchanged at version 2", album, err)
+		}
+	})
+
+	t.Run("AddAlbumAlreadyExists", func(t *testing.T) {
+		db := newDatabase()
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		_, err := db.AddAlbum(Album{ID: "a1", Title: "Foo", Artist: "Bar"})
+		if !errors.Is(err, ErrAlreadyExists) {
+			t.Fatalf("got error %v, want ErrAlreadyExists", err)
+		}
+	})
+
+	t.Run("DeleteAlbum", func(t *testing.T) {
+		db := newDatabase()
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		mustAddAlbum(t, db, Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles"})
+		err := db.DeleteAlbum("a1")
+		if err != nil {
+			t.Fatalf("error deleting album: %v", err)
+		}
+		albums, err := db.GetAlbums()
+		if err != nil {
+			t.Fatalf("error getting albums: %v", err)
+		}
+		ensureIDs(t, albums, []string{"a2"})
+		albums, err = db.SearchAlbums("beethoven")
+		if err != nil {
+			t.Fatalf("error searching albums: %v", err)
+		}
+		ensureIDs(t, albums, []string{})
+		err = db.DeleteAlbum("a1")
+		if !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+
+		// ID can be reused after deletion
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "5th Symphony", Artist: "Beethoven"})
+	})
+
+	t.Run("SoftDeleteAlbum", func(t *testing.T) {
+		db := newDatabase()
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		deletedAt := time.Date(2021, 6, 1, 12, 0, 0, 0, time.FixedZone("NZST", 12*60*60))
+		err := db.SoftDeleteAlbum("a1", deletedAt)
+		if err != nil {
+			t.Fatalf("error soft deleting album: %v", err)
+		}
+		album, err := db.GetAlbumByID("a1")
+		if err != nil || album.DeletedAt == nil || !album.DeletedAt.Equal(deletedAt) || album.Version != 2 {
+			t.Fatalf("got album %#v, error %v; want deleted at version 2", album, err)
+		}
+		albums, err := db.SearchAlbums("beethoven")
+		if err != nil {
+			t.Fatalf("error searching albums: %v", err)
+		}
+		ensureIDs(t, albums, []string{"a1"})
+
+		// Deleted albums can't be deleted again or changed, and their IDs
+		// can't be reused
+		err = db.SoftDeleteAlbum("a1", deletedAt)
+		if !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+		_, err = db.AddTrack("a1", Track{Title: "T", Duration: 1})
+		if !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+		_, err = db.PutAlbum(Album{ID: "a1", Title: "Foo", Artist: "Bar"}, 2)
+		if !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+		_, err = db.PutAlbum(Album{ID: "a1", Title: "Foo", Artist: "Bar"}, 0)
+		if !errors.Is(err, ErrAlreadyExists) {
+			t.Fatalf("got error %v, want ErrAlreadyExists", err)
+		}
+		_, err = db.AddAlbum(Album{ID: "a1", Title: "Foo", Artist: "Bar"})
+		if !errors.Is(err, ErrAlreadyExists) {
+			t.Fatalf("got error %v, want ErrAlreadyExists", err)
+		}
+		err = db.SoftDeleteAlbum("a2", deletedAt)
+		if !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+	})
+
+	t.Run("RestoreAlbum", func(t *testing.T) {
+		db := newDatabase()
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		err := db.SoftDeleteAlbum("a1", time.Now())
+		if err != nil {
+			t.Fatalf("error soft deleting album: %v", err)
+		}
+		album, err := db.RestoreAlbum("a1")
+		if err != nil || album.DeletedAt != nil || album.Version != 3 {
+			t.Fatalf("got album %#v, error %v; want restored at version 3", album, err)
+		}
+		album, err = db.GetAlbumByID("a1")
+		if err != nil || album.DeletedAt != nil || album.Version != 3 {
+			t.Fatalf("got album %#v, error %v; want restored at version 3", album, err)
+		}
+
+		// Restoring an album that isn't deleted does nothing
+		album, err = db.RestoreAlbum("a1")
+		if err != nil || album.Version != 3 {
+			t.Fatalf("got album %#v, error %v; want unchanged at version 3", album, err)
+		}
+		_, err = db.RestoreAlbum("a2")
+		if !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+	})
+
+	t.Run("PurgeDeletedAlbums", func(t *testing.T) {
+		db := newDatabase()
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		mustAddAlbum(t, db, Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles"})
+		mustAddAlbum(t, db, Album{ID: "a3", Title: "Pianoman", Artist: "Billy Joel"})
+		start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+		for i, id := range []string{"a1", "a2"} {
+			err := db.SoftDeleteAlbum(id, start.Add(time.Duration(i)*time.Hour))
+			if err != nil {
+				t.Fatalf("error soft deleting album: %v", err)
+			}
+		}
+		n, err := db.PurgeDeletedAlbums(start.Add(time.Minute))
+		if err != nil || n != 1 {
+			t.Fatalf("got %d purged, error %v; want 1 purged", n, err)
+		}
+		albums, err := db.GetAlbums()
+		if err != nil {
+			t.Fatalf("error getting albums: %v", err)
+		}
+		ensureIDs(t, albums, []string{"a2", "a3"})
+		albums, err = db.SearchAlbums("beethoven")
+		if err != nil {
+			t.Fatalf("error searching albums: %v", err)
+		}
+		ensureIDs(t, albums, []string{})
+
+		// ID can be reused after purging
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "5th Symphony", Artist: "Beethoven"})
+	})
+
+	t.Run("Timestamps", func(t *testing.T) {
+		db := newDatabase()
+		ignored := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		added, err := db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", CreatedAt: ignored, UpdatedAt: ignored})
+		if err != nil {
+			t.Fatalf("error adding album: %v", err)
+		}
+		ensureTimestamps(t, added)
+		if !added.CreatedAt.Equal(added.UpdatedAt) || added.CreatedAt.Equal(ignored) {
+			t.Fatalf("bad new album timestamps: created %v, updated %v", added.CreatedAt, added.UpdatedAt)
+		}
+
+		_, err = db.AddTrack("a1", Track{Title: "Ode to Joy", Duration: 600})
+		if err != nil {
+			t.Fatalf("error adding track: %v", err)
+		}
+		album, err := db.GetAlbumByID("a1")
+		if err != nil {
+			t.Fatalf("error getting album: %v", err)
+		}
+		if !album.CreatedAt.Equal(added.CreatedAt) || album.UpdatedAt.Before(added.UpdatedAt) {
+			t.Fatalf("bad timestamps after adding track: created %v, updated %v", album.CreatedAt, album.UpdatedAt)
+		}
+
+		stored, err := db.PutAlbum(Album{ID: "a1", Title: "5th Symphony", Artist: "Beethoven", CreatedAt: ignored}, album.Version)
+		if err != nil {
+			t.Fatalf("error putting album: %v", err)
+		}
+		if !stored.CreatedAt.Equal(added.CreatedAt) || stored.UpdatedAt.Before(album.UpdatedAt) {
+			t.Fatalf("bad timestamps after replacing: created %v, updated %v", stored.CreatedAt, stored.UpdatedAt)
+		}
+	})
+
+	t.Run("AlbumVersions", func(t *testing.T) {
+		db := newDatabase()
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		_, err := db.AddTrack("a1", Track{Title: "Ode to Joy", Duration: 600})
+		if err != nil {
+			t.Fatalf("error adding track: %v", err)
+		}
+		_, err = db.PutAlbum(Album{ID: "a1", Title: "5th Symphony", Artist: "Beethoven"}, 2)
+		if err != nil {
+			t.Fatalf("error putting album: %v", err)
+		}
+		err = db.SoftDeleteAlbum("a1", time.Now())
+		if err != nil {
+			t.Fatalf("error deleting album: %v", err)
+		}
+
+		versions, err := db.GetAlbumVersions("a1")
+		if err != nil {
+			t.Fatalf("error getting versions: %v", err)
+		}
+		var got []string
+		for _, v := range versions {
+			got = append(got, fmt.Sprintf("%d %s %d %v", v.Version, v.Title, len(v.Tracks), v.DeletedAt != nil))
+		}
+		want := []string{"1 9th Symphony 0 false", "2 9th Symphony 1 false", "3 5th Symphony 0 false", "4 5th Symphony 0 true"}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("bad versions: got %q, want %q", got, want)
+		}
+		for i, v := range versions[1:] {
+			if v.UpdatedAt.Before(versions[i].UpdatedAt) {
+				t.Fatalf("version %d updated before version %d", v.Version, versions[i].Version)
+			}
+		}
+
+		album, err := db.GetAlbumAt("a1", versions[0].UpdatedAt)
+		if err != nil || album.Version < 1 {
+			t.Fatalf("got version %d, error %v at creation time", album.Version, err)
+		}
+		album, err = db.GetAlbumAt("a1", versions[3].UpdatedAt.Add(time.Hour))
+		if err != nil || album.Version != 4 {
+			t.Fatalf("got version %d, error %v; want 4, nil", album.Version, err)
+		}
+		_, err = db.GetAlbumAt("a1", versions[0].UpdatedAt.Add(-time.Nanosecond))
+		if !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v before creation, want ErrDoesNotExist", err)
+		}
+		_, err = db.GetAlbumVersions("a2")
+		if !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+		_, err = db.GetAlbumAt("a2", time.Now())
+		if !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+
+		// Permanently deleting an album deletes its history
+		err = db.DeleteAlbum("a1")
+		if err != nil {
+			t.Fatalf("error deleting album: %v", err)
+		}
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		versions, err = db.GetAlbumVersions("a1")
+		if err != nil || len(versions) != 1 {
+			t.Fatalf("got %d versions, error %v after re-adding; want 1, nil", len(versions), err)
+		}
+	})
+
+	t.Run("Covers", func(t *testing.T) {
+		db := newDatabase()
+		store, ok := db.(CoverStore)
+		if !ok {
+			t.Skip("database doesn't implement CoverStore")
+		}
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		if _, err := store.GetCover("a1"); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+		cover := Cover{ContentType: "image/png", Data: []byte("png"), Width: 1, Height: 2}
+		if err := store.PutCover("a1", cover); err != nil {
+			t.Fatalf("error putting cover: %v", err)
+		}
+		got, err := store.GetCover("a1")
+		if err != nil {
+			t.Fatalf("error getting cover: %v", err)
+		}
+		want := cover
+		want.Hash = blobHash(cover.Data)
+		want.Size = len(cover.Data)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got cover %#v, want %#v", got, want)
+		}
+		if direct, ok := db.(DirectCoverStore); ok {
+			got, err := direct.GetCoverMetadata("a1")
+			want.Data = nil
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Fatalf("got cover metadata %#v, %v; want %#v, nil", got, err, want)
+			}
+		}
+		if err := store.PutCover("a2", cover); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+
+		if err := store.DeleteCover("a1"); err != nil {
+			t.Fatalf("error deleting cover: %v", err)
+		}
+		if err := store.DeleteCover("a1"); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+
+		// Deleting the album deletes its cover
+		if err := store.PutCover("a1", cover); err != nil {
+			t.Fatalf("error putting cover: %v", err)
+		}
+		if err := db.DeleteAlbum("a1"); err != nil {
+			t.Fatalf("error deleting album: %v", err)
+		}
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		if _, err := store.GetCover("a1"); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+	})
+
+	t.Run("Thumbnails", func(t *testing.T) {
+		db := newDatabase()
+		store, ok := db.(ThumbnailStore)
+		if !ok {
+			t.Skip("database doesn't implement ThumbnailStore")
+		}
+		covers := db.(CoverStore)
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		thumbnail := Cover{ContentType: "image/png", Data: []byte("small png"), Width: 1, Height: 1}
+		if err := store.PutThumbnail("a1", "small", blobHash([]byte("png")), thumbnail); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+		if err := covers.PutCover("a1", Cover{ContentType: "image/png", Data: []byte("png"), Width: 2, Height: 2}); err != nil {
+			t.Fatalf("error putting cover: %v", err)
+		}
+		if _, err := store.GetThumbnail("a1", "small"); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+
+		// A thumbnail of a cover that's since been replaced isn't stored
+		if err := store.PutThumbnail("a1", "small", blobHash([]byte("old png")), thumbnail); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+		if err := store.PutThumbnail("a1", "small", blobHash([]byte("png")), thumbnail); err != nil {
+			t.Fatalf("error putting thumbnail: %v", err)
+		}
+		got, err := store.GetThumbnail("a1", "small")
+		if err != nil {
+			t.Fatalf("error getting thumbnail: %v", err)
+		}
+		want := thumbnail
+		want.Hash = blobHash(thumbnail.Data)
+		want.Size = len(thumbnail.Data)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got thumbnail %#v, want %#v", got, want)
+		}
+
+		// Replacing the cover deletes its thumbnails
+		if err := covers.PutCover("a1", Cover{ContentType: "image/png", Data: []byte("new png"), Width: 2, Height: 2}); err != nil {
+			t.Fatalf("error putting cover: %v", err)
+		}
+		if _, err := store.GetThumbnail("a1", "small"); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+	})
+
+	t.Run("Attachments", func(t *testing.T) {
+		db := newDatabase()
+		store, ok := db.(AttachmentStore)
+		if !ok {
+			t.Skip("database doesn't implement AttachmentStore")
+		}
+		if _, err := store.GetAttachments("a1"); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		attachments, err := store.GetAttachments("a1")
+		if err != nil || len(attachments) != 0 {
+			t.Fatalf("got %v, error %v, want no attachments", attachments, err)
+		}
+		created := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+		notes := Attachment{ID: "n1", Filename: "notes.pdf", ContentType: "application/pdf", CreatedAt: created, Data: []byte("%PDF-")}
+		lyrics := Attachment{ID: "n2", Filename: "lyrics.txt", ContentType: "text/plain", CreatedAt: created.Add(time.Second), Data: []byte("la")}
+		for _, attachment := range []Attachment{lyrics, notes} {
+			added, err := store.AddAttachment("a1", attachment)
+			if err != nil {
+				t.Fatalf("error adding attachment: %v", err)
+			}
+			if added.Hash != blobHash(attachment.Data) || added.Size != len(attachment.Data) || added.Data != nil {
+				t.Fatalf("bad added attachment %#v", added)
+			}
+		}
+		if _, err := store.AddAttachment("a1", notes); !errors.Is(err, ErrAlreadyExists) {
+			t.Fatalf("got error %v, want ErrAlreadyExists", err)
+		}
+		if _, err := store.AddAttachment("a2", notes); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+
+		// Listed oldest first, without their data
+		attachments, err = store.GetAttachments("a1")
+		if err != nil || len(attachments) != 2 || attachments[0].ID != "n1" || attachments[1].ID != "n2" || attachments[0].Data != nil {
+			t.Fatalf("got %#v, error %v", attachments, err)
+		}
+		got, err := store.GetAttachment("a1", "n1")
+		if err != nil {
+			t.Fatalf("error getting attachment: %v", err)
+		}
+		want := notes
+		want.Hash = blobHash(notes.Data)
+		want.Size = len(notes.Data)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got attachment %#v, want %#v", got, want)
+		}
+
+		if err := store.DeleteAttachment("a1", "n1"); err != nil {
+			t.Fatalf("error deleting attachment: %v", err)
+		}
+		if _, err := store.GetAttachment("a1", "n1"); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+		if err := store.DeleteAttachment("a1", "n1"); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+
+		// Deleting the album deletes its attachments
+		if err := db.DeleteAlbum("a1"); err != nil {
+			t.Fatalf("error deleting album: %v", err)
+		}
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		if _, err := store.GetAttachment("a1", "n2"); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+	})
+
+	t.Run("TracksOrder", func(t *testing.T) {
+		db := newDatabase()
+		mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+		for _, number := range []int{3, 1, 10, 2} {
+			_, err := db.AddTrack("a1", Track{Number: number, Title: "T", Duration: 1})
+			if err != nil {
+				t.Fatalf("error adding track: %v", err)
+			}
+		}
+		track, err := db.AddTrack("a1", Track{Title: "Next", Duration: 1})
+		if err != nil {
+			t.Fatalf("error adding track: %v", err)
+		}
+		if track.Number != 11 {
+			t.Fatalf("got next track number %d, want 11", track.Number)
+		}
+		album, err := db.GetAlbumByID("a1")
+		if err != nil {
+			t.Fatalf("error getting album: %v", err)
+		}
+		var numbers []int
+		for _, track := range album.Tracks {
+			numbers = append(numbers, track.Number)
+		}
+		want := []int{1, 2, 3, 10, 11}
+		if !reflect.DeepEqual(numbers, want) {
+			t.Fatalf("bad track order: got %v, want %v", numbers, want)
+		}
+
+		_, err = db.AddTrack("a1", Track{Number: 2, Title: "T", Duration: 1})
+		if !errors.Is(err, ErrAlreadyExists) {
+			t.Fatalf("got error %v, want ErrAlreadyExists", err)
+		}
+		_, err = db.AddTrack("a2", Track{Title: "T", Duration: 1})
+		if !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want ErrDoesNotExist", err)
+		}
+	})
+}
+
+func mustAddAlbum(t *testing.T, db Database, album Album) {
+	t.Helper()
+	_, err := db.AddAlbum(album)
+	if err != nil {
+		t.Fatalf("error adding album %q: %v", album.ID, err)
+	}
+}
+
+// ensureTimestamps checks that the album's timestamps were set, in UTC.
+func ensureTimestamps(t *testing.T, album Album) {
+	t.Helper()
+	if album.CreatedAt.IsZero() || album.UpdatedAt.IsZero() {
+		t.Fatalf("timestamps not set: created %v, updated %v", album.CreatedAt, album.UpdatedAt)
+	}
+	if album.CreatedAt.Location() != time.UTC || album.UpdatedAt.Location() != time.UTC {
+		t.Fatalf("timestamps not in UTC: created %v, updated %v", album.CreatedAt, album.UpdatedAt)
+	}
+}
+
+func ensureIDs(t *testing.T, albums []Album, want []string) {
+	t.Helper()
+	got := []string{}
+	for _, album := range albums {
+		got = append(got, album.ID)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad album order: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,174 @@
+// Detect breaking changes to the API contract (OpenAPI spec)
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// checkContract compares the current OpenAPI spec against the baseline spec
+// in the given file and writes a report of any breaking changes to w. It
+// returns the process exit code: 0 if there are no breaking changes, 1 if
+// there are, or 2 if the baseline couldn't be loaded.
+func checkContract(baselinePath string, w io.Writer) int {
+	b, err := os.ReadFile(baselinePath)
+	if err != nil {
+		fmt.Fprintf(w, "error reading baseline: %v\n", err)
+		return 2
+	}
+	var baseline openAPIDoc
+	err = json.Unmarshal(b, &baseline)
+	if err != nil {
+		fmt.Fprintf(w, "error parsing baseline %s: %v\n", baselinePath, err)
+		return 2
+	}
+
+	changes := breakingChanges(&baseline, openAPISpec())
+	if len(changes) == 0 {
+		fmt.Fprintf(w, "no breaking changes from %s\n", baselinePath)
+		return 0
+	}
+	fmt.Fprintf(w, "%d breaking change(s) from %s:\n", len(changes), baselinePath)
+	for _, change := range changes {
+		fmt.Fprintf(w, "- %s\n", change)
+	}
+	return 1
+}
+
+// breakingChanges returns a sorted list of human-readable descriptions of
+// the changes from old to new that could break existing clients: removed
+// operations, parameters, responses, or fields; changed types; and newly
+// required parameters or request fields.
+func breakingChanges(old, new *openAPIDoc) []string {
+	var changes []string
+	report := func(format string, args ...interface{}) {
+		changes = append(changes, fmt.Sprintf(format, args...))
+	}
+
+	for path, oldMethods := range old.Paths {
+		for method, oldOp := range oldMethods {
+			where := fmt.Sprintf("%s %s", method, path)
+			newOp := new.Paths[path][method]
+			if newOp == nil {
+				report("%s: operation removed", where)
+				continue
+			}
+			diffOperation(where, oldOp, newOp, report)
+		}
+	}
+
+	sort.Strings(changes)
+	return changes
+}
+
+func diffOperation(where string, old, new *openAPIOperation, report func(string, ...interface{})) {
+	// Parameters are identified by location and name
+	oldParams := make(map[string]openAPIParameter)
+	for _, param := range old.Parameters {
+		oldParams[param.In+":"+param.Name] = param
+	}
+	newParams := make(map[string]openAPIParameter)
+	for _, param := range new.Parameters {
+		newParams[param.In+":"+param.Name] = param
+	}
+	for key, oldParam := range oldParams {
+		newParam, ok := newParams[key]
+		if !ok {
+			report("%s: %s parameter %q removed", where, oldParam.In, oldParam.Name)
+			continue
+		}
+		if newParam.Required && !oldParam.Required {
+			report("%s: %s parameter %q is now required", where, newParam.In, newParam.Name)
+		}
+		paramWhere := fmt.Sprintf("%s: %s parameter %q", where, newParam.In, newParam.Name)
+		diffSchema(paramWhere, oldParam.Schema, newParam.Schema, true, report)
+	}
+	for key, newParam := range newParams {
+		if _, ok := oldParams[key]; !ok && newParam.Required {
+			report("%s: new required %s parameter %q", where, newParam.In, newParam.Name)
+		}
+	}
+
+	// Request body
+	switch {
+	case old.RequestBody == nil && new.RequestBody != nil && new.RequestBody.Required:
+		report("%s: request body is now required", where)
+	case old.RequestBody != nil && new.RequestBody == nil:
+		report("%s: request body removed", where)
+	case old.RequestBody != nil && new.RequestBody != nil:
+		for mediaType, oldContent := range old.RequestBody.Content {
+			newContent, ok := new.RequestBody.Content[mediaType]
+			if !ok {
+				report("%s: request body media type %q removed", where, mediaType)
+				continue
+			}
+			diffSchema(where+": request body", oldContent.Schema, newContent.Schema, true, report)
+		}
+	}
+
+	// Responses
+	for status, oldResponse := range old.Responses {
+		newResponse, ok := new.Responses[status]
+		if !ok {
+			report("%s: %s response removed", where, status)
+			continue
+		}
+		for mediaType, oldContent := range oldResponse.Content {
+			newContent, ok := newResponse.Content[mediaType]
+			if !ok {
+				report("%s: %s response media type %q removed", where, status, mediaType)
+				continue
+			}
+			diffSchema(where+": "+status+" response", oldContent.Schema, newContent.Schema, false, report)
+		}
+	}
+}
+
+// diffSchema reports breaking changes between old and new schemas. For
+// request schemas (isRequest true), newly required fields are breaking; for
+// responses, removed fields are breaking.
+func diffSchema(where string, old, new *openAPISchema, isRequest bool, report func(string, ...interface{})) {
+	if old == nil || new == nil {
+		return
+	}
+	if old.Type != new.Type || old.Format != new.Format {
+		report("%s: type changed from %s to %s", where, schemaTypeName(old), schemaTypeName(new))
+		return
+	}
+
+	for name, oldProp := range old.Properties {
+		newProp, ok := new.Properties[name]
+		if !ok {
+			if !isRequest {
+				report("%s: field %q removed", where, name)
+			}
+			continue
+		}
+		diffSchema(fmt.Sprintf("%s: field %q", where, name), oldProp, newProp, isRequest, report)
+	}
+
+	if isRequest {
+		oldRequired := make(map[string]bool)
+		for _, name := range old.Required {
+			oldRequired[name] = true
+		}
+		for _, name := range new.Required {
+			if !oldRequired[name] {
+				report("%s: field %q is now required", where, name)
+			}
+		}
+	}
+
+	diffSchema(where+": items", old.Items, new.Items, isRequest, report)
+}
+
+func schemaTypeName(schema *openAPISchema) string {
+	if schema.Format != "" {
+		return schema.Type + " (" + schema.Format + ")"
+	}
+	return schema.Type
+}
@@ -0,0 +1,104 @@
+// Tests for the API contract-change detector
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The committed baseline spec should never have breaking changes from the
+// current spec. If this fails, either fix the change or (if it's really
+// intended) regenerate the baseline in the repo root with
+// "go run . -print-openapi > openapi.json".
+func TestContractBaseline(t *testing.T) {
+	var out bytes.Buffer
+	code := checkContract("../openapi.json", &out)
+	if code != 0 {
+		t.Fatalf("got exit code %d, want 0:\n%s", code, out.String())
+	}
+}
+
+func TestCheckContractReport(t *testing.T) {
+	old := openAPISpec()
+	old.Paths["/albums"]["delete"] = &openAPIOperation{Summary: "Gone"}
+	path := filepath.Join(t.TempDir(), "openapi.json")
+	writeJSONFile(t, path, old)
+
+	var out bytes.Buffer
+	code := checkContract(path, &out)
+	if code != 1 {
+		t.Fatalf("got exit code %d, want 1:\n%s", code, out.String())
+	}
+	want := "1 breaking change(s) from " + path + ":\n- delete /albums: operation removed\n"
+	if out.String() != want {
+		t.Fatalf("bad report: got vs want:\n%s\n%s", out.String(), want)
+	}
+
+	code = checkContract(filepath.Join(t.TempDir(), "missing.json"), &out)
+	if code != 2 {
+		t.Fatalf("got exit code %d, want 2", code)
+	}
+}
+
+func TestBreakingChanges(t *testing.T) {
+	old := openAPISpec()
+	new := openAPISpec()
+
+	// Non-breaking changes: new optional field, new path, new optional param
+	album := schemaFor(reflect.TypeOf(Album{}))
+	album.Properties["label"] = &openAPISchema{Type: "string"}
+	new.Paths["/albums/{id}"]["get"].Responses["200"].Content["application/json"] = openAPIMediaType{Schema: album}
+	new.Paths["/labels"] = map[string]*openAPIOperation{"get": {Summary: "List labels"}}
+	getAlbums := new.Paths["/albums"]["get"]
+	getAlbums.Parameters = append(getAlbums.Parameters, openAPIParameter{Name: "sort", In: "query", Schema: &openAPISchema{Type: "string"}})
+	if changes := breakingChanges(old, new); len(changes) != 0 {
+		t.Fatalf("unexpected breaking changes: %q", changes)
+	}
+
+	// Breaking changes
+	delete(album.Properties, "artist")
+	album.Properties["price"] = &openAPISchema{Type: "string"}
+	search := new.Paths["/albums/search"]["get"]
+	search.Parameters = append(search.Parameters, openAPIParameter{Name: "limit", In: "query", Required: true, Schema: &openAPISchema{Type: "integer"}})
+	getAlbums.Parameters[len(getAlbums.Parameters)-1].Required = true
+	old.Paths["/albums"]["get"].Parameters = []openAPIParameter{{Name: "label", In: "query", Schema: &openAPISchema{Type: "string"}}}
+	postContent := new.Paths["/albums"]["post"].RequestBody.Content
+	request := *postContent["application/json"].Schema // PUT shares this schema
+	request.Required = append(append([]string(nil), request.Required...), "label")
+	postContent["application/json"] = openAPIMediaType{Schema: &request}
+	delete(new.Paths["/albums"]["post"].Responses, "409")
+	delete(new.Paths, "/openapi.json")
+
+	got := breakingChanges(old, new)
+	want := []string{
+		`get /albums/search: new required query parameter "limit"`,
+		`get /albums/{id}: 200 response: field "artist" removed`,
+		`get /albums/{id}: 200 response: field "price": type changed from integer to string`,
+		`get /albums: new required query parameter "sort"`,
+		`get /albums: query parameter "label" removed`,
+		`get /openapi.json: operation removed`,
+		`post /albums: 409 response removed`,
+		`post /albums: request body: field "label" is now required`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad changes: got vs want:\n%s\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func writeJSONFile(t *testing.T, path string, v interface{}) {
+	t.Helper()
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		t.Fatalf("error marshaling JSON: %v", err)
+	}
+	err = os.WriteFile(path, b, 0o644)
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+// Album cover art: upload, validation, and re-encoding
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // register the GIF decoder for image.Decode
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Covers can be uploaded by anyone who can add albums, so they're treated
+// as hostile: only PNG, JPEG, and GIF images are accepted (never SVG or
+// anything else that can contain script), the format is decided by the
+// image's magic bytes rather than the client's Content-Type, the image
+// size is checked from its header before it's decoded (to stop
+// decompression bombs), and the decoded pixels are re-encoded, which
+// drops EXIF and any other metadata, and anything appended to the file.
+const (
+	maxCoverBytes  = 10 << 20   // size of the uploaded file
+	maxCoverSide   = 4000       // width or height, in pixels
+	maxCoverPixels = 12_000_000 // width times height, which bounds the memory needed to decode it
+	coverQuality   = 90         // JPEG quality for re-encoded JPEG covers
+)
+
+// coverTypes are the accepted cover image types.
+var coverTypes = []string{"image/png", "image/jpeg", "image/gif"}
+
+// Cover is an album's cover art, as stored.
+type Cover struct {
+	ContentType string // "image/png" or "image/jpeg"
+	Data        []byte
+	Width       int
+	Height      int
+
+	// Hash and Size are the SHA-256 hash of Data (the key it's stored by
+	// in a BlobStore) and its length. They're set by the CoverStore.
+	Hash string
+	Size int
+}
+
+// coverInfo describes a stored cover, as returned on upload.
+type coverInfo struct {
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Size        int    `json:"size"`
+}
+
+func (c Cover) info() coverInfo {
+	return coverInfo{c.ContentType, c.Width, c.Height, len(c.Data)}
+}
+
+// CoverStore is an optional interface a Database can implement to store
+// album cover art. Without it, the cover endpoints return 404 Not Found.
+type CoverStore interface {
+	// GetCover returns the album's cover, or ErrDoesNotExist if the album
+	// doesn't exist or has no cover.
+	GetCover(albumID string) (Cover, error)
+
+	// PutCover sets or replaces the album's cover, returning
+	// ErrDoesNotExist if the album doesn't exist.
+	PutCover(albumID string, cover Cover) error
+
+	// DeleteCover deletes the album's cover, returning ErrDoesNotExist if
+	// the album doesn't exist or has no cover. Deleting the album deletes
+	// its cover too.
+	DeleteCover(albumID string) error
+}
+
+// errUnsupportedCover means the uploaded cover isn't one of coverTypes.
+var errUnsupportedCover = errors.New("unsupported cover image type")
+
+// processCover checks that data is a safe cover image and re-encodes it.
+// The format is sniffed from the data; declaredType, the request's
+// Content-Type, must agree if given. It returns errUnsupportedCover if the
+// image isn't an accepted type, or validation issues if it's not valid.
+func processCover(data []byte, declaredType string) (Cover, map[string]interface{}, error) {
+	issues := make(map[string]interface{})
+	sniffed := http.DetectContentType(data)
+	if !isCoverType(sniffed) {
+		return Cover{}, nil, errUnsupportedCover
+	}
+	if declaredType != "" {
+		mediaType, _, _ := mime.ParseMediaType(declaredType)
+		if !isCoverType(mediaType) {
+			return Cover{}, nil, errUnsupportedCover
+		}
+		if mediaType != sniffed {
+			issues["Content-Type"] = validationIssue{"mismatch", fmt.Sprintf("Content-Type is %s but the image is %s", mediaType, sniffed)}
+			return Cover{}, issues, nil
+		}
+	}
+	format := strings.TrimPrefix(sniffed, "image/")
+
+	// Check the size from the header before decoding the pixels
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		issues["cover"] = validationIssue{"invalid", fmt.Sprintf("cover isn't a valid %s image", strings.ToUpper(format))}
+		return Cover{}, issues, nil
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxCoverSide || config.Height > maxCoverSide ||
+		config.Width*config.Height > maxCoverPixels {
+		issues["cover"] = validationIssue{"too-large", fmt.Sprintf("cover must be at most %dx%d pixels, and %d pixels in all", maxCoverSide, maxCoverSide, maxCoverPixels)}
+		return Cover{}, issues, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		issues["cover"] = validationIssue{"invalid", fmt.Sprintf("cover isn't a valid %s image", strings.ToUpper(format))}
+		return Cover{}, issues, nil
+	}
+
+	// Re-encode from the pixels alone. GIFs become PNGs (only the first
+	// frame of an animated GIF is kept).
+	var buf bytes.Buffer
+	cover := Cover{Width: config.Width, Height: config.Height}
+	if format == "jpeg" {
+		cover.ContentType = "image/jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: coverQuality})
+	} else {
+		cover.ContentType = "image/png"
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return Cover{}, nil, fmt.Errorf("re-encoding cover: %w", err)
+	}
+	cover.Data = buf.Bytes()
+	return cover, nil, nil
+}
+
+func isCoverType(mediaType string) bool {
+	for _, typ := range coverTypes {
+		if mediaType == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// coverStore returns the database's cover store, or writes a 404 Not
+// Found error and returns nil if it doesn't have one or the album isn't
+// visible.
+func (s *Server) coverStore(w http.ResponseWriter, r *http.Request, albumID string) CoverStore {
+	store, ok := s.db.(CoverStore)
+	if !ok {
+		s.writeError(w, r, apierr.NotFound())
+		return nil
+	}
+	album, err := s.db.GetAlbumByID(albumID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return nil
+	}
+	if !album.visible(s.now()) {
+		s.writeError(w, r, apierr.NotFound())
+		return nil
+	}
+	return store
+}
+
+func (s *Server) getCover(w http.ResponseWriter, r *http.Request, albumID string) {
+	store := s.coverStore(w, r, albumID)
+	if store == nil {
+		return
+	}
+	size := r.URL.Query().Get("size")
+	side, ok := s.thumbnailSizes[size]
+	if size != "" && !ok {
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{
+			"size": validationIssue{"invalid", "size must be one of " + strings.Join(s.thumbnailSizeNames(), ", ")},
+		}))
+		return
+	}
+	cover, err := store.GetCover(albumID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	if size != "" {
+		cover, err = s.coverThumbnail(albumID, cover, size, side)
+		if err != nil {
+			s.writeError(w, r, apierr.Internal(fmt.Errorf("making %s thumbnail: %w", size, err)))
+			return
+		}
+	}
+	// Belt and braces: browsers mustn't guess a different type, or run
+	// anything if the image is opened directly
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	s.writeWithETag(w, r, cover.ContentType, cover.Data)
+}
+
+func (s *Server) putCover(w http.ResponseWriter, r *http.Request, albumID string) {
+	store := s.coverStore(w, r, albumID)
+	if store == nil {
+		return
+	}
+	data, ok := s.readUpload(w, r, maxCoverBytes, "cover")
+	if !ok {
+		return
+	}
+	s.storeCover(w, r, store, albumID, data, r.Header.Get("Content-Type"))
+}
+
+// storeCover checks and re-encodes the uploaded cover image, and stores it
+// as the album's cover.
+func (s *Server) storeCover(w http.ResponseWriter, r *http.Request, store CoverStore, albumID string, data []byte, contentType string) {
+	cover, issues, err := processCover(data, contentType)
+	if errors.Is(err, errUnsupportedCover) {
+		s.writeError(w, r, apierr.UnsupportedMediaType(coverTypes))
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(err))
+		return
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+
+	err = store.PutCover(albumID, cover)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("putting cover: %w", err)))
+		return
+	}
+	s.audit(r, "update", "cover", albumID, nil, snapshot(cover.info()))
+	s.writeJSON(w, r, http.StatusOK, cover.info())
+}
+
+func (s *Server) deleteCover(w http.ResponseWriter, r *http.Request, albumID string) {
+	store := s.coverStore(w, r, albumID)
+	if store == nil {
+		return
+	}
+	err := store.DeleteCover(albumID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("deleting cover: %w", err)))
+		return
+	}
+	s.audit(r, "delete", "cover", albumID, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetCover implements CoverStore, reading the cover's content from the
+// blob store.
+func (d *MemoryDatabase) GetCover(albumID string) (Cover, error) {
+	d.lock.RLock()
+	cover, ok := d.covers[albumID]
+	d.lock.RUnlock()
+	if !ok {
+		return Cover{}, ErrDoesNotExist
+	}
+	data, err := d.Blobs.Get(cover.Hash)
+	if err != nil {
+		return Cover{}, fmt.Errorf("getting cover blob: %w", err)
+	}
+	cover.Data = data
+	return cover, nil
+}
+
+// PutCover implements CoverStore, storing the cover's content in the blob
+// store (so covers shared by several albums are stored once). Covers count
+// towards MaxBytes, once for each album.
+func (d *MemoryDatabase) PutCover(albumID string, cover Cover) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	album, ok := d.albums[albumID]
+	if !ok || album.DeletedAt != nil {
+		return ErrDoesNotExist
+	}
+	old, hasOld := d.covers[albumID]
+	size := int64(len(cover.Data)) - int64(old.Size)
+	if d.MaxBytes > 0 && size > 0 && d.bytes+size > d.MaxBytes {
+		return fmt.Errorf("%w: max bytes %d reached", ErrFull, d.MaxBytes)
+	}
+	hash, err := d.Blobs.Put(cover.Data)
+	if err != nil {
+		return fmt.Errorf("putting cover blob: %w", err)
+	}
+	if hasOld {
+		d.releaseCover(albumID)
+	}
+	cover.Hash = hash
+	cover.Size = len(cover.Data)
+	cover.Data = nil
+	d.covers[albumID] = cover
+	d.bytes += int64(cover.Size)
+	return nil
+}
+
+// DeleteCover implements CoverStore.
+func (d *MemoryDatabase) DeleteCover(albumID string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.covers[albumID]; !ok {
+		return ErrDoesNotExist
+	}
+	d.releaseCover(albumID)
+	return nil
+}
+
+// releaseCover removes the album's cover (if it has one), releasing its
+// blob. The caller must hold the write lock.
+func (d *MemoryDatabase) releaseCover(albumID string) {
+	cover, ok := d.covers[albumID]
+	if !ok {
+		return
+	}
+	delete(d.covers, albumID)
+	d.bytes -= int64(cover.Size)
+	d.releaseThumbnails(albumID)
+	// The only possible error is that the blob is already gone, in which
+	// case there's nothing left to release
+	_ = d.Blobs.Release(cover.Hash)
+}
@@ -0,0 +1,153 @@
+// Tests for album cover art
+
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// encodeImage returns a w x h image encoded in the given format ("png",
+// "jpeg", or "gif").
+func encodeImage(t *testing.T, format string, w, h int) []byte {
+	t.Helper()
+	img := image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.Black, color.White})
+	img.Set(0, 0, color.White)
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatalf("error encoding %s: %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+func putCoverRequest(t *testing.T, contentType string, data []byte) *http.Request {
+	t.Helper()
+	request := newRequest(t, "PUT", "/albums/a1/cover", bytes.NewReader(data))
+	request.Header.Set("Content-Type", contentType)
+	return request
+}
+
+func TestCover(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1/cover", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	// Metadata and anything after the image data are removed: here an EXIF
+	// segment straight after the JPEG's start-of-image marker
+	jpegData := encodeImage(t, "jpeg", 30, 20)
+	exif := append([]byte{0xff, 0xe1, 0x00, 0x10}, "Exif\x00\x00GPS 51N 0W"...)
+	withExif := append(append(append([]byte{}, jpegData[:2]...), exif...), jpegData[2:]...)
+	withExif = append(withExif, "<script>alert(1)</script>"...)
+	result = serve(t, server, putCoverRequest(t, "image/jpeg", withExif))
+	ensureStatus(t, result, http.StatusOK)
+	var info coverInfo
+	unmarshalResponse(t, result, &info)
+	if info.ContentType != "image/jpeg" || info.Width != 30 || info.Height != 20 {
+		t.Fatalf("bad cover info: %#v", info)
+	}
+
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/cover", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Content-Type"); got != "image/jpeg" {
+		t.Fatalf("bad Content-Type: got %q", got)
+	}
+	if got := result.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Fatalf("bad X-Content-Type-Options: got %q", got)
+	}
+	stored, err := io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("error reading cover: %v", err)
+	}
+	if bytes.Contains(stored, []byte("Exif")) || bytes.Contains(stored, []byte("script")) {
+		t.Fatalf("metadata not removed from cover")
+	}
+	if len(stored) != info.Size {
+		t.Fatalf("got %d bytes, want %d", len(stored), info.Size)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stored)); err != nil {
+		t.Fatalf("stored cover isn't a JPEG: %v", err)
+	}
+
+	// GIFs are stored as PNGs
+	result = serve(t, server, putCoverRequest(t, "image/gif", encodeImage(t, "gif", 5, 5)))
+	ensureStatus(t, result, http.StatusOK)
+	unmarshalResponse(t, result, &info)
+	if info.ContentType != "image/png" {
+		t.Fatalf("got content type %q, want image/png", info.ContentType)
+	}
+
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a1/cover", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/cover", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	result = serve(t, server, newRequest(t, "GET", "/albums/x/cover", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestCoverRejected(t *testing.T) {
+	server := newTestServer()
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`)
+	pngData := encodeImage(t, "png", 10, 10)
+	unsupported := map[string]interface{}{"supported": []interface{}{"image/png", "image/jpeg", "image/gif"}}
+
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		status      int
+		code        string
+		errData     map[string]interface{}
+	}{
+		{"svg", "image/svg+xml", svg, http.StatusUnsupportedMediaType, "unsupported-media-type", unsupported},
+		{"svg as png", "image/png", svg, http.StatusUnsupportedMediaType, "unsupported-media-type", unsupported},
+		{"png as svg", "image/svg+xml", pngData, http.StatusUnsupportedMediaType, "unsupported-media-type", unsupported},
+		{"bmp", "image/bmp", []byte("BM" + string(make([]byte, 100))), http.StatusUnsupportedMediaType, "unsupported-media-type", unsupported},
+		{"mismatch", "image/jpeg", pngData, http.StatusBadRequest, "validation", map[string]interface{}{
+			"Content-Type": map[string]interface{}{"error": "mismatch", "message": "Content-Type is image/jpeg but the image is image/png"},
+		}},
+		{"truncated", "image/png", pngData[:40], http.StatusBadRequest, "validation", map[string]interface{}{
+			"cover": map[string]interface{}{"error": "invalid", "message": "cover isn't a valid PNG image"},
+		}},
+		{"too wide", "image/png", encodeImage(t, "png", maxCoverSide+1, 1), http.StatusBadRequest, "validation", map[string]interface{}{
+			"cover": map[string]interface{}{"error": "too-large", "message": "cover must be at most 4000x4000 pixels, and 12000000 pixels in all"},
+		}},
+		{"too many pixels", "image/gif", encodeImage(t, "gif", 3500, 3500), http.StatusBadRequest, "validation", map[string]interface{}{
+			"cover": map[string]interface{}{"error": "too-large", "message": "cover must be at most 4000x4000 pixels, and 12000000 pixels in all"},
+		}},
+		{"too big", "image/png", append(pngData, make([]byte, maxCoverBytes)...), http.StatusRequestEntityTooLarge, "too-large",
+			map[string]interface{}{"max_bytes": float64(maxCoverBytes)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := serve(t, server, putCoverRequest(t, test.contentType, test.data))
+			ensureError(t, result, test.status, test.code, test.errData)
+		})
+	}
+}
+
+func TestCoverHiddenAlbum(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, putCoverRequest(t, "image/png", encodeImage(t, "png", 1, 1)))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newAdminRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/cover", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
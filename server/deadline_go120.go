@@ -0,0 +1,18 @@
+//go:build go1.20
+
+// Per-response write deadlines, with net/http's ResponseController
+
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// setWriteDeadline sets the deadline for writing the rest of the response,
+// overriding the http.Server's WriteTimeout, which would otherwise end
+// long-lived streams. It returns an error if w (or the ResponseWriter it
+// wraps) doesn't support deadlines, as httptest.ResponseRecorder doesn't.
+func setWriteDeadline(w http.ResponseWriter, deadline time.Time) error {
+	return http.NewResponseController(w).SetWriteDeadline(deadline)
+}
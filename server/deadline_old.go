@@ -0,0 +1,18 @@
+//go:build !go1.20
+
+// Per-response write deadlines aren't supported by net/http before Go 1.20
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// setWriteDeadline returns an error, as net/http can't change a response's
+// write deadline, so long-lived streams end at the http.Server's
+// WriteTimeout.
+func setWriteDeadline(w http.ResponseWriter, deadline time.Time) error {
+	return errors.New("write deadlines need the server to be built with Go 1.20 or later")
+}
@@ -0,0 +1,42 @@
+// Runtime debug endpoints, on a separate listener for operators
+//
+// With -debug-addr, the server also listens on a second address for
+// net/http/pprof's profiles under /debug/pprof/ (for example, go tool
+// pprof http://localhost:6060/debug/pprof/profile for a 30-second CPU
+// profile) and expvar's /debug/vars, which has the memory statistics and
+// command line. They're not served by the API's listener at all, so they
+// can't be reached through a public load balancer; bind the debug address
+// to localhost or a private network only operators can reach.
+
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// newDebugHandler returns the handler for the debug listener.
+func newDebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index) // also serves the named profiles, like /debug/pprof/heap
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// newDebugServer returns the http.Server for the debug listener. It has no
+// write timeout, as CPU profiles and traces take as long as the client
+// asks for (and pprof refuses ones longer than the write timeout).
+func newDebugServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           newDebugHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+}
@@ -0,0 +1,53 @@
+// Tests for the runtime debug endpoints
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	handler := newDebugHandler()
+	get := func(path string) *http.Response {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder.Result()
+	}
+
+	result := get("/debug/vars")
+	ensureStatus(t, result, http.StatusOK)
+	var vars map[string]json.RawMessage
+	b, _ := io.ReadAll(result.Body)
+	unmarshalJSON(t, b, &vars)
+	if vars["memstats"] == nil || vars["cmdline"] == nil {
+		t.Fatalf("missing memstats or cmdline in /debug/vars: %s", b)
+	}
+
+	result = get("/debug/pprof/")
+	ensureStatus(t, result, http.StatusOK)
+	b, _ = io.ReadAll(result.Body)
+	if !strings.Contains(string(b), "goroutine") {
+		t.Fatalf("pprof index doesn't list the goroutine profile: %s", b)
+	}
+	ensureStatus(t, get("/debug/pprof/heap"), http.StatusOK)
+	ensureStatus(t, get("/debug/pprof/goroutine?debug=1"), http.StatusOK)
+	ensureStatus(t, get("/debug/pprof/cmdline"), http.StatusOK)
+
+	// Only the debug endpoints are on the debug listener, and the API
+	// doesn't serve them
+	ensureStatus(t, get("/albums"), http.StatusNotFound)
+	for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+		result := serve(t, newTestServer(), newRequest(t, "GET", path, nil))
+		ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	}
+
+	if server := newDebugServer("localhost:6060"); server.WriteTimeout != 0 || server.Addr != "localhost:6060" {
+		t.Fatalf("bad debug server: %+v", server)
+	}
+}
@@ -0,0 +1,395 @@
+// Diagnostics bundles, for capturing the server's state during an incident
+
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// When something goes wrong in production, it's often gone by the time
+// someone can attach a debugger. Instead, sending the server SIGQUIT (or
+// an admin calling POST /diagnostics) writes a diagnostics bundle: a zip
+// file in the diagnostics directory (see WithDiagnostics) containing
+//
+//   - goroutines.txt: the stack of every goroutine, as Go prints on a crash
+//   - requests.json: the last maxLoggedRequests requests, including any still
+//     in progress (those have no status yet), oldest first
+//   - config.json: the version, enabled features, and command line flags,
+//     with secrets redacted
+//   - metrics.json: runtime memory and goroutine counts, concurrency
+//     limiter state, and job stats, as in GET /stats
+//   - database.json: the database's type, availability, and size stats
+//
+// Go's default for SIGQUIT is to print the goroutines and exit; the server
+// keeps running instead, so the signal can be sent more than once as an
+// incident unfolds. The bundle can contain client IPs and request paths,
+// so it's only readable by the server's user.
+const maxLoggedRequests = 200
+
+// WithDiagnostics sets the directory diagnostics bundles are written to
+// (the default is os.TempDir()), and the command line flags to include in
+// them, which should already be redacted (see redactFlags).
+func WithDiagnostics(dir string, flags map[string]string) Option {
+	return func(s *Server) {
+		s.diagnosticsDir = dir
+		s.diagnosticsFlags = flags
+	}
+}
+
+// requestLogEntry is a request in the request log. The query string isn't
+// recorded, in case it contains anything sensitive.
+type requestLogEntry struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	ClientIP string    `json:"client_ip"`
+	Status   int       `json:"status,omitempty"` // zero if still in progress
+	Duration float64   `json:"duration_seconds"`
+}
+
+// requestLog is a ring buffer of the most recent requests.
+type requestLog struct {
+	mu      sync.Mutex
+	entries []*requestLogEntry
+	next    int // index to add the next entry at, once entries is full
+}
+
+func newRequestLog(size int) *requestLog {
+	return &requestLog{entries: make([]*requestLogEntry, 0, size)}
+}
+
+// add adds an entry, replacing the oldest one if the buffer is full.
+func (l *requestLog) add(entry *requestLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+// finish records that the request for entry finished with the given
+// status after duration.
+func (l *requestLog) finish(entry *requestLogEntry, status int, duration time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.Status = status
+	entry.Duration = duration.Seconds()
+}
+
+// list returns a copy of the entries, oldest first.
+func (l *requestLog) list() []requestLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]requestLogEntry, 0, len(l.entries))
+	for i := range l.entries {
+		list = append(list, *l.entries[(l.next+i)%len(l.entries)])
+	}
+	return list
+}
+
+// requestLogHandler records each request in the request log. It's the
+// outermost handler, so it sees /v1 paths as requested.
+func (s *Server) requestLogHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := s.now()
+		entry := &requestLogEntry{Time: start.UTC(), Method: r.Method, Path: r.URL.Path, ClientIP: clientIP(r)}
+		s.requestLog.add(entry)
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			s.requestLog.finish(entry, status, s.now().Sub(start))
+		}()
+		h.ServeHTTP(sw, r)
+	})
+}
+
+// statusWriter records the status of a response. Unlike the other
+// wrappers, it's used for every request, so it passes through flushes
+// (for event streams) and hijacking (for WebSockets).
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the wrapped ResponseWriter, so http.ResponseController
+// can set its deadlines.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer doesn't support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// diagnosticsConfig is config.json in a diagnostics bundle.
+type diagnosticsConfig struct {
+	Version   string            `json:"version"`
+	GoVersion string            `json:"go_version"`
+	Features  []string          `json:"features"`
+	Flags     map[string]string `json:"flags,omitempty"`
+}
+
+// diagnosticsMetrics is metrics.json in a diagnostics bundle.
+type diagnosticsMetrics struct {
+	Goroutines int               `json:"goroutines"`
+	Memory     diagnosticsMemory `json:"memory"`
+	Limiter    *limiterStats     `json:"limiter,omitempty"`
+	Jobs       []JobStats        `json:"jobs,omitempty"`
+}
+
+// diagnosticsMemory is a summary of runtime.MemStats.
+type diagnosticsMemory struct {
+	HeapAlloc  uint64  `json:"heap_alloc_bytes"`
+	HeapInUse  uint64  `json:"heap_in_use_bytes"`
+	Sys        uint64  `json:"sys_bytes"`
+	NumGC      uint32  `json:"num_gc"`
+	PauseTotal float64 `json:"gc_pause_total_seconds"`
+}
+
+// diagnosticsDatabase is database.json in a diagnostics bundle.
+type diagnosticsDatabase struct {
+	Type  string         `json:"type"`
+	Read  string         `json:"read,omitempty"`  // as in GET /readyz
+	Write string         `json:"write,omitempty"` // as in GET /readyz
+	Stats *DatabaseStats `json:"stats,omitempty"`
+	Blobs string         `json:"blob_store,omitempty"`
+}
+
+// writeDiagnostics writes a diagnostics bundle to a new file in the
+// diagnostics directory, returning its path.
+func (s *Server) writeDiagnostics() (string, error) {
+	dir := s.diagnosticsDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	f, err := os.CreateTemp(dir, "diagnostics-"+s.now().UTC().Format("20060102T150405Z")+"-*.zip")
+	if err != nil {
+		return "", err
+	}
+	err = s.writeDiagnosticsBundle(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeDiagnosticsBundle writes the diagnostics bundle's zip file to f.
+func (s *Server) writeDiagnosticsBundle(f *os.File) error {
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("goroutines.txt")
+	if err != nil {
+		return err
+	}
+	err = pprof.Lookup("goroutine").WriteTo(w, 2)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		v    interface{}
+	}{
+		{"requests.json", s.requestLog.list()},
+		{"config.json", diagnosticsConfig{
+			Version:   buildVersion(),
+			GoVersion: runtime.Version(),
+			Features:  s.enabledFeatures(),
+			Flags:     s.diagnosticsFlags,
+		}},
+		{"metrics.json", s.diagnosticsMetrics()},
+		{"database.json", s.diagnosticsDatabase()},
+	}
+	for _, file := range files {
+		w, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(file.v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (s *Server) diagnosticsMetrics() diagnosticsMetrics {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return diagnosticsMetrics{
+		Goroutines: runtime.NumGoroutine(),
+		Memory: diagnosticsMemory{
+			HeapAlloc:  mem.HeapAlloc,
+			HeapInUse:  mem.HeapInuse,
+			Sys:        mem.Sys,
+			NumGC:      mem.NumGC,
+			PauseTotal: time.Duration(mem.PauseTotalNs).Seconds(),
+		},
+		Limiter: s.limiterStats(),
+		Jobs:    s.jobStats(),
+	}
+}
+
+func (s *Server) diagnosticsDatabase() diagnosticsDatabase {
+	database := diagnosticsDatabase{Type: typeName(s.db)}
+	if checker, ok := s.db.(AvailabilityChecker); ok {
+		readErr, writeErr := checker.CheckAvailability()
+		database.Read = availabilityString(readErr)
+		database.Write = availabilityString(writeErr)
+	}
+	if reporter, ok := s.db.(StatsReporter); ok {
+		stats := reporter.Stats()
+		database.Stats = &stats
+	}
+	if memory, ok := s.db.(*MemoryDatabase); ok && memory.Blobs != nil {
+		database.Blobs = typeName(memory.Blobs)
+	}
+	return database
+}
+
+// diagnosticsResponse is the response of POST /diagnostics.
+type diagnosticsResponse struct {
+	Path string `json:"path"`
+}
+
+func (s *Server) postDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	path, err := s.writeDiagnostics()
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("writing diagnostics: %w", err)))
+		return
+	}
+	s.log.Printf("wrote diagnostics to %s", path)
+	s.writeJSON(w, r, http.StatusOK, diagnosticsResponse{Path: path})
+}
+
+// dumpDiagnosticsOn writes a diagnostics bundle whenever the process
+// receives one of the given signals, until the returned stop function is
+// called.
+func (s *Server) dumpDiagnosticsOn(signals ...os.Signal) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, signals...)
+	go func() {
+		for {
+			select {
+			case sig := <-ch:
+				path, err := s.writeDiagnostics()
+				if err != nil {
+					s.log.Printf("error writing diagnostics on %v: %v", sig, err)
+					continue
+				}
+				s.log.Printf("wrote diagnostics on %v to %s", sig, path)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// secretFlagWords are the words in the names of flags whose values are
+// secret, like -admin-token and -webhook-secret.
+var secretFlagWords = []string{"token", "secret", "password"}
+
+// redactFlags returns the values of the flags in fs, by name, with secrets
+// replaced by "xxxxx" (as url.URL.Redacted does): the values of flags
+// whose names suggest they're secret, and passwords in URLs. Flags that
+// weren't set are included too, with their defaults.
+func redactFlags(fs *flag.FlagSet) map[string]string {
+	flags := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		for _, word := range secretFlagWords {
+			if strings.Contains(f.Name, word) && value != "" {
+				value = "xxxxx"
+			}
+		}
+		flags[f.Name] = redactURLPasswords(value)
+	})
+	return flags
+}
+
+// redactURLPasswords redacts the passwords in a URL, or a comma-separated
+// list of them, like -webhooks.
+func redactURLPasswords(value string) string {
+	if !strings.Contains(value, "@") {
+		return value
+	}
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		u, err := url.Parse(part)
+		if err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				parts[i] = u.Redacted()
+			}
+		}
+	}
+	return strings.Join(parts, ",")
+}
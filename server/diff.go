@@ -0,0 +1,159 @@
+// Field-level diffs between album revisions
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// albumDiff is the response of GET /albums/:id/diff.
+type albumDiff struct {
+	ID      string        `json:"id"`
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Changes []fieldChange `json:"changes"`
+}
+
+// fieldChange is one changed field, with its JSON name and its old and new
+// values as they appear in the album's JSON. Old or New is omitted if the
+// field wasn't set (for example a price added to a free album).
+type fieldChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old,omitempty"`
+	New   json.RawMessage `json:"new,omitempty"`
+}
+
+// getAlbumDiff lists the fields that changed from revision ?from= to
+// revision ?to= (the current revision if not given), using the kept
+// version history. Browsers get an HTML table, for support staff
+// investigating what changed when.
+func (s *Server) getAlbumDiff(w http.ResponseWriter, r *http.Request, id string) {
+	includeDeleted, ok := s.includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	issues := make(map[string]interface{})
+	from := intParam(query.Get("from"), 0, 1, math.MaxInt32, "from", issues)
+	to := intParam(query.Get("to"), 0, 1, math.MaxInt32, "to", issues)
+	if query.Get("from") == "" {
+		issues["from"] = validationIssue{"required", ""}
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+
+	versions, err := s.db.GetAlbumVersions(id)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("fetching versions of album ID %q: %w", id, err)))
+		return
+	}
+	current := versions[len(versions)-1]
+	if !current.published(s.now()) || current.DeletedAt != nil && !includeDeleted {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if to == 0 {
+		to = current.Version
+	}
+	oldAlbum, ok := findVersion(versions, from)
+	if !ok {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	newAlbum, ok := findVersion(versions, to)
+	if !ok {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+
+	diff := albumDiff{ID: id, From: from, To: to, Changes: diffAlbums(s.redactAlbum(r, oldAlbum), s.redactAlbum(r, newAlbum))}
+	w.Header().Add("Vary", "Accept")
+	if wantsHTML(r) {
+		s.writeDiffHTML(w, r, diff)
+		return
+	}
+	s.writeJSONWithETag(w, r, diff)
+}
+
+// findVersion returns the album with the given version from versions.
+func findVersion(versions []Album, version int) (Album, bool) {
+	for _, album := range versions {
+		if album.Version == version {
+			return album, true
+		}
+	}
+	return Album{}, false
+}
+
+// diffAlbums returns the fields that differ between old and new, sorted by
+// field name. Fields are compared by their JSON encoding, so nested values
+// like tracks are reported as a whole.
+func diffAlbums(old, new Album) []fieldChange {
+	oldFields := albumFields(old)
+	newFields := albumFields(new)
+	names := make([]string, 0, len(oldFields))
+	for name := range oldFields {
+		names = append(names, name)
+	}
+	for name := range newFields {
+		if _, ok := oldFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []fieldChange{}
+	for _, name := range names {
+		if !bytes.Equal(oldFields[name], newFields[name]) {
+			changes = append(changes, fieldChange{name, oldFields[name], newFields[name]})
+		}
+	}
+	return changes
+}
+
+// albumFields returns the album's JSON fields and their encoded values.
+func albumFields(album Album) map[string]json.RawMessage {
+	var fields map[string]json.RawMessage
+	json.Unmarshal(snapshot(album), &fields) // can't fail for an Album
+	return fields
+}
+
+var diffTemplate = template.Must(template.New("diff").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Album {{.ID}}: revision {{.From}} to {{.To}}</title>
+</head>
+<body>
+<h1>Album {{.ID}}: revision {{.From}} to {{.To}}</h1>
+{{if .Changes}}<table>
+<tr><th>Field</th><th>Old</th><th>New</th></tr>
+{{range .Changes}}<tr><td>{{.Field}}</td><td><del>{{printf "%s" .Old}}</del></td><td><ins>{{printf "%s" .New}}</ins></td></tr>
+{{end}}</table>{{else}}<p>No changes.</p>{{end}}
+</body>
+</html>
+`))
+
+func (s *Server) writeDiffHTML(w http.ResponseWriter, r *http.Request, diff albumDiff) {
+	var buf bytes.Buffer
+	err := diffTemplate.Execute(&buf, diff)
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		s.log.Printf("error writing response: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+// Tests for diffs between album revisions
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testFieldChange is a fieldChange with decoded values, for comparison.
+type testFieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+func TestGetAlbumDiff(t *testing.T) {
+	server := newHistoryTestServer(t)
+
+	tests := []struct {
+		query string
+		from  int
+		to    int
+		want  []testFieldChange
+	}{
+		{"from=1&to=2", 1, 2, []testFieldChange{
+			{"title", "9th Symphony", "Ninth Symphony"},
+			{"updated_at", "2021-06-01T12:00:00Z", "2021-06-01T12:01:00Z"},
+			{"version", 1.0, 2.0},
+		}},
+		{"from=2", 2, 3, []testFieldChange{
+			{"tracks", nil, []interface{}{map[string]interface{}{"number": 1.0, "title": "Ode to Joy", "duration": 600.0}}},
+			{"updated_at", "2021-06-01T12:01:00Z", "2021-06-01T12:02:00Z"},
+			{"version", 2.0, 3.0},
+		}},
+		{"from=3&to=1", 3, 1, []testFieldChange{
+			{"title", "Ninth Symphony", "9th Symphony"},
+			{"tracks", []interface{}{map[string]interface{}{"number": 1.0, "title": "Ode to Joy", "duration": 600.0}}, nil},
+			{"updated_at", "2021-06-01T12:02:00Z", "2021-06-01T12:00:00Z"},
+			{"version", 3.0, 1.0},
+		}},
+		{"from=2&to=2", 2, 2, []testFieldChange{}},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			result := serve(t, server, newRequest(t, "GET", "/albums/a1/diff?"+test.query, nil))
+			ensureStatus(t, result, http.StatusOK)
+			var diff struct {
+				ID      string            `json:"id"`
+				From    int               `json:"from"`
+				To      int               `json:"to"`
+				Changes []testFieldChange `json:"changes"`
+			}
+			unmarshalResponse(t, result, &diff)
+			if diff.ID != "a1" || diff.From != test.from || diff.To != test.to {
+				t.Fatalf("bad diff header: %+v", diff)
+			}
+			if !reflect.DeepEqual(diff.Changes, test.want) {
+				t.Fatalf("got vs want:\n%#v\n%#v", diff.Changes, test.want)
+			}
+		})
+	}
+}
+
+func TestGetAlbumDiffHTML(t *testing.T) {
+	server := newHistoryTestServer(t)
+	request := newRequest(t, "GET", "/albums/a1/diff?from=1&to=2", nil)
+	request.Header.Set("Accept", browserAccept)
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Fatalf("bad Content-Type: got %q", got)
+	}
+	b, err := io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	want := `<tr><td>title</td><td><del>&#34;9th Symphony&#34;</del></td><td><ins>&#34;Ninth Symphony&#34;</ins></td></tr>`
+	if !strings.Contains(string(b), want) {
+		t.Fatalf("page doesn't contain %s:\n%s", want, b)
+	}
+}
+
+func TestGetAlbumDiffErrors(t *testing.T) {
+	server := newHistoryTestServer(t)
+
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1/diff", nil))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"from": map[string]interface{}{"error": "required"},
+	})
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/diff?from=0&to=x", nil))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"from": map[string]interface{}{"error": "out-of-range", "message": "from must be an integer between 1 and 2147483647"},
+		"to":   map[string]interface{}{"error": "out-of-range", "message": "to must be an integer between 1 and 2147483647"},
+	})
+
+	// Unknown revisions and albums
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/diff?from=1&to=4", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newRequest(t, "GET", "/albums/a2/diff?from=1", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newRequest(t, "POST", "/albums/a1/diff?from=1", nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+
+	// Deleted albums are hidden, except from admins
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/diff?from=1", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newAdminRequest(t, "GET", "/albums/a1/diff?from=3&include_deleted=true", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var diff struct {
+		Changes []fieldChange `json:"changes"`
+	}
+	unmarshalResponse(t, result, &diff)
+	var fields []string
+	for _, change := range diff.Changes {
+		fields = append(fields, change.Field)
+	}
+	if !reflect.DeepEqual(fields, []string{"deleted_at", "updated_at", "version"}) {
+		t.Fatalf("got changed fields %q", fields)
+	}
+	if !json.Valid(diff.Changes[0].New) || diff.Changes[0].Old != nil {
+		t.Fatalf("bad deleted_at change: %+v", diff.Changes[0])
+	}
+}
@@ -0,0 +1,90 @@
+// Verifying checksums of uploads (Content-Digest)
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// Clients can send a checksum of an upload in a Content-Digest field (RFC
+// 9530), like "Content-Digest: sha-256=:<base64 of the hash>:", so a file
+// corrupted in transit is rejected rather than silently stored. If the
+// client streams the file and doesn't know the checksum until the end, it
+// can send the field as a trailer instead of a header (declared with
+// "Trailer: Content-Digest" and a chunked body). The file is verified
+// once it's been read, before anything is stored, and a mismatch is a
+// validation error, so the client can simply retry the upload.
+//
+// SHA-256 and SHA-512 are supported. Other algorithms in the field are
+// ignored (as the RFC allows), but a field with none we support is
+// rejected, so a client that asked for verification never goes without it.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// checkContentDigest verifies the request's Content-Digest header or
+// trailer (which is only available once the body has been read) against
+// data, the whole body. It returns nil if it matches or there isn't one.
+func checkContentDigest(r *http.Request, data []byte) *validationIssue {
+	field := r.Header.Get("Content-Digest")
+	if field == "" {
+		field = r.Trailer.Get("Content-Digest")
+	}
+	if field == "" {
+		return nil
+	}
+	digests, ok := parseContentDigest(field)
+	if !ok {
+		return &validationIssue{"invalid", "Content-Digest must be like sha-256=:<base64 digest>:"}
+	}
+	checked := false
+	for algorithm, want := range digests {
+		newHash, ok := digestAlgorithms[algorithm]
+		if !ok {
+			continue
+		}
+		h := newHash()
+		h.Write(data)
+		if !bytes.Equal(h.Sum(nil), want) {
+			return &validationIssue{"mismatch", fmt.Sprintf("%s digest doesn't match the uploaded data", algorithm)}
+		}
+		checked = true
+	}
+	if !checked {
+		return &validationIssue{"unsupported", "Content-Digest must include a sha-256 or sha-512 digest"}
+	}
+	return nil
+}
+
+// parseContentDigest parses a Content-Digest field, a structured field
+// dictionary of algorithms and byte sequences like
+// "sha-256=:X48E...=:, sha-512=:WZDP...=:". Keys are lowercased; it
+// returns false if the field is malformed.
+func parseContentDigest(field string) (map[string][]byte, bool) {
+	digests := make(map[string][]byte)
+	for _, member := range strings.Split(field, ",") {
+		member = strings.TrimSpace(member)
+		equals := strings.IndexByte(member, '=')
+		if equals <= 0 {
+			return nil, false
+		}
+		algorithm, value := strings.ToLower(member[:equals]), member[equals+1:]
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return nil, false
+		}
+		digest, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			return nil, false
+		}
+		digests[algorithm] = digest
+	}
+	return digests, true
+}
@@ -0,0 +1,87 @@
+// Tests for verifying checksums of uploads (Content-Digest)
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sha256Digest(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func TestContentDigest(t *testing.T) {
+	server := newTestServer()
+	sum512 := sha512.Sum512([]byte("text"))
+	tests := []struct {
+		name   string
+		digest string
+		issue  map[string]interface{} // nil if it should be accepted
+	}{
+		{"none", "", nil},
+		{"sha-256", sha256Digest("text"), nil},
+		{"sha-512 and unknown", "md5=:AAAA:, SHA-512=:" + base64.StdEncoding.EncodeToString(sum512[:]) + ":", nil},
+		{"mismatch", sha256Digest("txet"), map[string]interface{}{"error": "mismatch", "message": "sha-256 digest doesn't match the uploaded data"}},
+		{"malformed", "sha-256=abc", map[string]interface{}{"error": "invalid", "message": "Content-Digest must be like sha-256=:<base64 digest>:"}},
+		{"bad base64", "sha-256=:!!:", map[string]interface{}{"error": "invalid", "message": "Content-Digest must be like sha-256=:<base64 digest>:"}},
+		{"unsupported", "md5=:AAAA:", map[string]interface{}{"error": "unsupported", "message": "Content-Digest must include a sha-256 or sha-512 digest"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := addAttachmentRequest(t, "a1", "notes.txt", "", "text")
+			if test.digest != "" {
+				request.Header.Set("Content-Digest", test.digest)
+			}
+			result := serve(t, server, request)
+			if test.issue == nil {
+				ensureStatus(t, result, http.StatusCreated)
+				return
+			}
+			ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{"Content-Digest": test.issue})
+		})
+	}
+}
+
+func TestContentDigestTrailer(t *testing.T) {
+	httpServer := httptest.NewServer(newTestServer())
+	defer httpServer.Close()
+
+	for _, test := range []struct {
+		data   string
+		status int
+	}{
+		{"Conductor: Karajan\n", http.StatusCreated},
+		{"Conductor: Karajam\n", http.StatusBadRequest},
+	} {
+		// The trailer's value is set as the body is streamed, after the
+		// request has started
+		body, writer := io.Pipe()
+		request, err := http.NewRequest("POST", httpServer.URL+"/albums/a1/attachments?filename=credits.txt", body)
+		if err != nil {
+			t.Fatalf("error creating request: %v", err)
+		}
+		request.Trailer = http.Header{"Content-Digest": nil}
+		go func(data string) {
+			io.WriteString(writer, data)
+			request.Trailer.Set("Content-Digest", sha256Digest("Conductor: Karajan\n"))
+			writer.Close()
+		}(test.data)
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("error sending request: %v", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != test.status {
+			t.Errorf("%q: got status %d, want %d", strings.TrimSpace(test.data), response.StatusCode, test.status)
+		}
+	}
+}
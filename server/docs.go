@@ -0,0 +1,239 @@
+// Request and response examples for the API documentation
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// example is a single documented API call. The examples are executed by
+// the tests against a server seeded with exampleAlbums, so the canonical
+// responses here can't drift from what the server actually does.
+type example struct {
+	Name        string
+	Description string
+	Method      string
+	Path        string
+	Body        string // request body (JSON), or "" for none
+	Status      int    // expected response status code
+	Response    string // expected response body (JSON)
+}
+
+// exampleTime is the database clock the examples are run with, so the
+// timestamps in the responses are stable.
+var exampleTime = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// exampleAlbums are the fixture albums the examples are run against.
+var exampleAlbums = []Album{
+	{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795},
+	{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000},
+}
+
+var examples = []example{
+	{
+		Name:        "list-albums",
+		Description: "List all published albums, sorted by ID.",
+		Method:      "GET",
+		Path:        "/albums",
+		Status:      http.StatusOK,
+		Response: `[
+    {"id": "a1", "title": "9th Symphony", "artist": "Beethoven", "price": 795, "version": 1, "created_at": "2021-06-01T12:00:00Z", "updated_at": "2021-06-01T12:00:00Z"},
+    {"id": "a2", "title": "Hey Jude", "artist": "The Beatles", "price": 2000, "version": 1, "created_at": "2021-06-01T12:00:00Z", "updated_at": "2021-06-01T12:00:00Z"}
+]`,
+	},
+	{
+		Name:        "get-album",
+		Description: "Fetch a single album by ID.",
+		Method:      "GET",
+		Path:        "/albums/a2",
+		Status:      http.StatusOK,
+		Response:    `{"id": "a2", "title": "Hey Jude", "artist": "The Beatles", "price": 2000, "version": 1, "created_at": "2021-06-01T12:00:00Z", "updated_at": "2021-06-01T12:00:00Z"}`,
+	},
+	{
+		Name:        "get-album-not-found",
+		Description: "Fetching an album that doesn't exist returns a not-found error.",
+		Method:      "GET",
+		Path:        "/albums/a9",
+		Status:      http.StatusNotFound,
+		Response:    `{"status": 404, "error": "not-found"}`,
+	},
+	{
+		Name:        "add-album",
+		Description: "Add a new album. The price is in cents.",
+		Method:      "POST",
+		Path:        "/albums",
+		Body:        `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel", "price": 1234}`,
+		Status:      http.StatusCreated,
+		Response:    `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel", "price": 1234, "version": 1, "created_at": "2021-06-01T12:00:00Z", "updated_at": "2021-06-01T12:00:00Z"}`,
+	},
+	{
+		Name:        "add-album-validation",
+		Description: "Adding an album with missing or invalid fields returns a validation error with details for each field.",
+		Method:      "POST",
+		Path:        "/albums",
+		Body:        `{"id": "a9", "price": 100000}`,
+		Status:      http.StatusBadRequest,
+		Response: `{
+    "status": 400,
+    "error": "validation",
+    "data": {
+        "artist": {"error": "required"},
+        "price": {"error": "out-of-range", "message": "price must be between 0 and $1000"},
+        "title": {"error": "required"}
+    }
+}`,
+	},
+	{
+		Name:        "add-album-already-exists",
+		Description: "Adding an album whose ID is already used returns an already-exists error.",
+		Method:      "POST",
+		Path:        "/albums",
+		Body:        `{"id": "a1", "title": "5th Symphony", "artist": "Beethoven"}`,
+		Status:      http.StatusConflict,
+		Response:    `{"status": 409, "error": "already-exists"}`,
+	},
+}
+
+func (s *Server) getExamples(w http.ResponseWriter, r *http.Request) {
+	type renderedExample struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Method      string          `json:"method"`
+		Path        string          `json:"path"`
+		Body        json.RawMessage `json:"body,omitempty"`
+		Status      int             `json:"status"`
+		Response    json.RawMessage `json:"response"`
+		Curl        string          `json:"curl"`
+		Go          string          `json:"go"`
+		JS          string          `json:"js"`
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	baseURL := scheme + "://" + r.Host
+
+	rendered := make([]renderedExample, 0, len(examples))
+	for _, ex := range examples {
+		goCode, err := goExample(baseURL, ex)
+		if err != nil {
+			s.writeError(w, r, apierr.Internal(fmt.Errorf("generating Go example %q: %w", ex.Name, err)))
+			return
+		}
+		var body json.RawMessage
+		if ex.Body != "" {
+			body = json.RawMessage(ex.Body)
+		}
+		rendered = append(rendered, renderedExample{
+			Name:        ex.Name,
+			Description: ex.Description,
+			Method:      ex.Method,
+			Path:        ex.Path,
+			Body:        body,
+			Status:      ex.Status,
+			Response:    json.RawMessage(ex.Response),
+			Curl:        curlExample(baseURL, ex),
+			Go:          goCode,
+			JS:          jsExample(baseURL, ex),
+		})
+	}
+	s.writeJSON(w, r, http.StatusOK, rendered)
+}
+
+// curlExample returns a curl command line that runs the example.
+func curlExample(baseURL string, ex example) string {
+	var b strings.Builder
+	b.WriteString("curl")
+	if ex.Method != "GET" {
+		b.WriteString(" -X " + ex.Method)
+	}
+	b.WriteString(" " + shellQuote(baseURL+ex.Path))
+	if ex.Body != "" {
+		b.WriteString(" -H 'Content-Type: application/json' -d " + shellQuote(ex.Body))
+	}
+	return b.String()
+}
+
+// shellQuote quotes s in single quotes for use in a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// goExample returns a complete, gofmt'd Go program that runs the example.
+func goExample(baseURL string, ex example) (string, error) {
+	var b strings.Builder
+	b.WriteString("package main\n\nimport (\n")
+	b.WriteString("\"fmt\"\n\"io\"\n\"log\"\n\"net/http\"\n")
+	if ex.Body != "" {
+		b.WriteString("\"strings\"\n")
+	}
+	b.WriteString(")\n\nfunc main() {\n")
+	body := "nil"
+	if ex.Body != "" {
+		b.WriteString("body := strings.NewReader(" + goRawString(ex.Body) + ")\n")
+		body = "body"
+	}
+	fmt.Fprintf(&b, "request, err := http.NewRequest(%q, %q, %s)\n", ex.Method, baseURL+ex.Path, body)
+	b.WriteString("if err != nil {\nlog.Fatal(err)\n}\n")
+	if ex.Body != "" {
+		b.WriteString("request.Header.Set(\"Content-Type\", \"application/json\")\n")
+	}
+	b.WriteString(`response, err := http.DefaultClient.Do(request)
+if err != nil {
+log.Fatal(err)
+}
+defer response.Body.Close()
+b, err := io.ReadAll(response.Body)
+if err != nil {
+log.Fatal(err)
+}
+fmt.Println(response.Status)
+fmt.Println(string(b))
+}
+`)
+	formatted, err := format.Source([]byte(b.String()))
+	if err != nil {
+		return "", err
+	}
+	return string(formatted), nil
+}
+
+// goRawString returns s as a Go raw string literal if possible, otherwise
+// as an interpreted string literal.
+func goRawString(s string) string {
+	if strings.Contains(s, "`") {
+		return fmt.Sprintf("%q", s)
+	}
+	return "`" + s + "`"
+}
+
+// jsExample returns JavaScript code using fetch() that runs the example.
+func jsExample(baseURL string, ex example) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "const response = await fetch(%s", jsString(baseURL+ex.Path))
+	if ex.Method != "GET" || ex.Body != "" {
+		fmt.Fprintf(&b, ", {\n  method: %s,\n", jsString(ex.Method))
+		if ex.Body != "" {
+			b.WriteString("  headers: {\"Content-Type\": \"application/json\"},\n")
+			fmt.Fprintf(&b, "  body: JSON.stringify(%s),\n", ex.Body)
+		}
+		b.WriteString("}")
+	}
+	b.WriteString(");\nconsole.log(response.status, await response.json());\n")
+	return b.String()
+}
+
+// jsString returns s as a JavaScript string literal (JSON strings are
+// valid JavaScript).
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
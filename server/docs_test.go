@@ -0,0 +1,106 @@
+// Tests for the documentation examples
+
+package server
+
+import (
+	"encoding/json"
+	"go/parser"
+	"go/token"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run every documented example against a freshly-seeded server and ensure
+// the response matches the canonical one in the docs.
+func TestExamples(t *testing.T) {
+	for _, ex := range examples {
+		t.Run(ex.Name, func(t *testing.T) {
+			db := NewMemoryDatabase()
+			db.Now = func() time.Time { return exampleTime }
+			for _, album := range exampleAlbums {
+				db.AddAlbum(album)
+			}
+			server := NewServer(db, log.New(io.Discard, "", 0))
+
+			var body io.Reader
+			if ex.Body != "" {
+				body = strings.NewReader(ex.Body)
+			}
+			result := serve(t, server, newRequest(t, ex.Method, ex.Path, body))
+			ensureStatus(t, result, ex.Status)
+
+			var got interface{}
+			unmarshalResponse(t, result, &got)
+			var want interface{}
+			err := json.Unmarshal([]byte(ex.Response), &want)
+			if err != nil {
+				t.Fatalf("error unmarshaling example response: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("bad response: got vs want:\n%#v\n%#v", got, want)
+			}
+		})
+	}
+}
+
+func TestGetExamples(t *testing.T) {
+	server := newTestServer()
+	request := newRequest(t, "GET", "/docs/examples", nil)
+	request.Host = "example.com"
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+
+	var got []struct {
+		Name     string          `json:"name"`
+		Method   string          `json:"method"`
+		Path     string          `json:"path"`
+		Body     json.RawMessage `json:"body"`
+		Status   int             `json:"status"`
+		Response json.RawMessage `json:"response"`
+		Curl     string          `json:"curl"`
+		Go       string          `json:"go"`
+		JS       string          `json:"js"`
+	}
+	unmarshalResponse(t, result, &got)
+	if len(got) != len(examples) {
+		t.Fatalf("bad number of examples: got %d, want %d", len(got), len(examples))
+	}
+	for _, ex := range got {
+		_, err := parser.ParseFile(token.NewFileSet(), ex.Name+".go", ex.Go, 0)
+		if err != nil {
+			t.Fatalf("example %q: Go code doesn't parse: %v\n%s", ex.Name, err, ex.Go)
+		}
+		if !strings.Contains(ex.Curl, "'http://example.com"+ex.Path+"'") {
+			t.Fatalf("example %q: curl command doesn't use request host: %s", ex.Name, ex.Curl)
+		}
+	}
+
+	add := got[3]
+	wantCurl := `curl -X POST 'http://example.com/albums' -H 'Content-Type: application/json' -d '{"id": "a9", "title": "Pianoman", "artist": "Billy Joel", "price": 1234}'`
+	if add.Curl != wantCurl {
+		t.Fatalf("bad curl command: got vs want:\n%s\n%s", add.Curl, wantCurl)
+	}
+	wantJS := `const response = await fetch("http://example.com/albums", {
+  method: "POST",
+  headers: {"Content-Type": "application/json"},
+  body: JSON.stringify({"id": "a9", "title": "Pianoman", "artist": "Billy Joel", "price": 1234}),
+});
+console.log(response.status, await response.json());
+`
+	if add.JS != wantJS {
+		t.Fatalf("bad JS code: got vs want:\n%s\n%s", add.JS, wantJS)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	got := shellQuote(`{"title": "Don't Stop"}`)
+	want := `'{"title": "Don'\''t Stop"}'`
+	if got != want {
+		t.Fatalf("bad quoting: got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+// Duplicate request detection middleware
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Warning header added to responses replayed for a duplicate request.
+const duplicateWarning = `299 - "Duplicate request: original response returned"`
+
+// WithDuplicateWindow enables detection of duplicate POST requests, such
+// as an accidental double-click on a UI's submit button. If the same
+// client POSTs an identical body to the same URL within window of an
+// earlier request, the earlier request's response is returned again (with
+// a Warning header) instead of performing the action twice. The default
+// of zero disables detection.
+//
+// This is independent of idempotency keys (requests with an Idempotency-Key
+// header are left to WithIdempotencyTTL, if enabled), and is only a
+// heuristic: the client is identified by its IP address, so it can't tell
+// apart clients behind the same proxy that send exactly the same request.
+func WithDuplicateWindow(window time.Duration) Option {
+	return func(s *Server) {
+		s.duplicateWindow = window
+	}
+}
+
+// duplicateHandler returns the original response to POST requests that
+// duplicate a request seen within the detection window. If the original
+// request is still in progress, the duplicate waits for it to finish.
+func (s *Server) duplicateHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || s.idempotency != nil && r.Header.Get("Idempotency-Key") != "" {
+			// Requests with an idempotency key are handled by that instead
+			h.ServeHTTP(w, r)
+			return
+		}
+		if expectsContinue(r) {
+			// Reading the body would tell the client to send it before
+			// the handler has checked the request (see readUpload)
+			h.ServeHTTP(w, r)
+			return
+		}
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+
+		key := s.tenantReplayScope(r) + duplicateKey(r, body)
+		original, isDuplicate := s.duplicates.start(key, "", s.now())
+		if isDuplicate {
+			s.replay(w, r, original, "Warning", duplicateWarning)
+			return
+		}
+		s.serveAndRecord(w, r, h, s.duplicates, key, original)
+	})
+}
+
+// duplicateKey returns the key identifying requests that are duplicates of
+// each other: from the same client IP, to the same URL, with the same body.
+func duplicateKey(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n", clientIP(r), r.URL.RequestURI())
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,116 @@
+// Tests for the duplicate request detection middleware
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDuplicatePost(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	db := NewMemoryDatabase()
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithDuplicateWindow(5*time.Second),
+		WithIDGenerator(&SequentialIDGenerator{}),
+		WithClock(func() time.Time { return now }),
+	)
+	defer server.Close()
+	post := func(body, remoteAddr string) *http.Response {
+		request := newRequest(t, "POST", "/albums", strings.NewReader(body))
+		request.RemoteAddr = remoteAddr
+		return serve(t, server, request)
+	}
+	body := `{"title": "Pianoman", "artist": "Billy Joel"}`
+
+	result := post(body, "1.2.3.4:1000")
+	ensureStatus(t, result, http.StatusCreated)
+	ensureDuplicate(t, result, false, "/albums/id1")
+
+	// Same client (even from a different port), same body: original
+	// response is returned and no new album is added
+	now = now.Add(4 * time.Second)
+	result = post(body, "1.2.3.4:2000")
+	ensureStatus(t, result, http.StatusCreated)
+	ensureDuplicate(t, result, true, "/albums/id1")
+	var got testAlbum
+	unmarshalResponse(t, result, &got)
+	if got.ID != "id1" {
+		t.Fatalf("bad replayed ID: got %q, want %q", got.ID, "id1")
+	}
+	ensureAlbumIDs(t, server, []string{"id1"})
+
+	// Different body or client is not a duplicate
+	result = post(`{"title": "Pianoman", "artist": "Billy Joel", "price": 100}`, "1.2.3.4:1000")
+	ensureStatus(t, result, http.StatusCreated)
+	ensureDuplicate(t, result, false, "/albums/id2")
+	result = post(body, "5.6.7.8:1000")
+	ensureStatus(t, result, http.StatusCreated)
+	ensureDuplicate(t, result, false, "/albums/id3")
+
+	// After the window, the same request is handled afresh
+	now = now.Add(6 * time.Second)
+	result = post(body, "1.2.3.4:1000")
+	ensureStatus(t, result, http.StatusCreated)
+	ensureDuplicate(t, result, false, "/albums/id4")
+	ensureAlbumIDs(t, server, []string{"id1", "id2", "id3", "id4"})
+}
+
+func TestDuplicatePostServerError(t *testing.T) {
+	server := NewServer(errorDatabase{}, log.New(io.Discard, "", 0), WithDuplicateWindow(time.Minute))
+	defer server.Close()
+	for i := 0; i < 2; i++ {
+		body := `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel"}`
+		result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+		ensureStatus(t, result, http.StatusInternalServerError)
+		// Server errors aren't remembered, so the retry isn't a duplicate
+		ensureDuplicate(t, result, false, "")
+	}
+}
+
+func TestDuplicateWaitsForOriginal(t *testing.T) {
+	db := newSlowDatabase()
+	server := NewServer(db, log.New(io.Discard, "", 0), WithDuplicateWindow(time.Minute))
+	defer server.Close()
+
+	results := make(chan *http.Response, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			body := `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel"}`
+			request, _ := http.NewRequest("POST", "/albums", strings.NewReader(body))
+			results <- serve(t, server, request)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(db.release)
+
+	duplicates := 0
+	for i := 0; i < 2; i++ {
+		result := <-results
+		ensureStatus(t, result, http.StatusCreated)
+		if result.Header.Get("Warning") != "" {
+			duplicates++
+		}
+	}
+	if duplicates != 1 {
+		t.Fatalf("got %d duplicates, want 1", duplicates)
+	}
+}
+
+func ensureDuplicate(t *testing.T, result *http.Response, duplicate bool, location string) {
+	t.Helper()
+	warning := result.Header.Get("Warning")
+	if duplicate && warning != duplicateWarning {
+		t.Fatalf("bad Warning header: got %q, want %q", warning, duplicateWarning)
+	}
+	if !duplicate && warning != "" {
+		t.Fatalf("got unexpected Warning header %q", warning)
+	}
+	if got := result.Header.Get("Location"); got != location {
+		t.Fatalf("bad Location header: got %q, want %q", got, location)
+	}
+}
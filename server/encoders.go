@@ -0,0 +1,89 @@
+// Pluggable response encoders for album responses
+
+package server
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// ResponseEncoder encodes album responses in a media type other than
+// JSON, for clients that ask for it in their Accept header. Encoders are
+// registered by media type with WithResponseEncoder; MessagePack and
+// protobuf encoders are built in.
+type ResponseEncoder interface {
+	// EncodeAlbum appends the encoding of a single album to buf.
+	EncodeAlbum(buf *bytes.Buffer, album Album) error
+
+	// EncodeAlbums appends the encoding of a list of albums to buf.
+	EncodeAlbums(buf *bytes.Buffer, albums []Album) error
+}
+
+type responseEncoder struct {
+	mediaType string
+	encoder   ResponseEncoder
+}
+
+// defaultEncoders returns the built-in response encoders.
+func defaultEncoders() []responseEncoder {
+	return []responseEncoder{
+		{msgpackContentType, msgpackEncoder{}},
+		{protobufContentType, protobufEncoder{}},
+	}
+}
+
+// WithResponseEncoder registers an encoder for album responses in the
+// given media type (for example "application/cbor"), replacing any
+// encoder already registered for it, including the built-in ones.
+func WithResponseEncoder(mediaType string, encoder ResponseEncoder) Option {
+	return func(s *Server) {
+		for i, e := range s.encoders {
+			if e.mediaType == mediaType {
+				s.encoders[i].encoder = encoder
+				return
+			}
+		}
+		s.encoders = append(s.encoders, responseEncoder{mediaType, encoder})
+	}
+}
+
+// negotiateEncoder returns the registered encoder that the request's
+// Accept header prefers to both JSON and HTML (like wantsXML, so that a
+// browser's "*/*" doesn't select one), along with its media type. If there
+// are several, it returns the one with the highest quality, or the first
+// registered if they're equal. It returns nil if the client should get
+// JSON.
+func (s *Server) negotiateEncoder(r *http.Request) (string, ResponseEncoder) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return "", nil
+	}
+	best := acceptQuality(accept, "application/json")
+	if q := acceptQuality(accept, "text/html"); q > best {
+		best = q
+	}
+	var mediaType string
+	var encoder ResponseEncoder
+	for _, e := range s.encoders {
+		q := acceptQuality(accept, e.mediaType)
+		if q > best {
+			best, mediaType, encoder = q, e.mediaType, e.encoder
+		}
+	}
+	return mediaType, encoder
+}
+
+// writeEncoded writes the response encoded by encode, with an ETag like
+// the JSON responses.
+func (s *Server) writeEncoded(w http.ResponseWriter, r *http.Request, mediaType string, encode func(buf *bytes.Buffer) error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err := encode(buf)
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(err))
+		return
+	}
+	s.writeWithETag(w, r, mediaType, buf.Bytes())
+}
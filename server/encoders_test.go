@@ -0,0 +1,106 @@
+// Tests for the response encoder registry
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// csvEncoder is a toy encoder for testing registration.
+type csvEncoder struct{}
+
+func (csvEncoder) EncodeAlbum(buf *bytes.Buffer, album Album) error {
+	buf.WriteString(album.ID + "," + album.Title + "\n")
+	return nil
+}
+
+func (e csvEncoder) EncodeAlbums(buf *bytes.Buffer, albums []Album) error {
+	for _, album := range albums {
+		e.EncodeAlbum(buf, album)
+	}
+	return nil
+}
+
+func TestNegotiateEncoder(t *testing.T) {
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithResponseEncoder("text/csv", csvEncoder{}))
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"*/*", ""},
+		{"application/json", ""},
+		{browserAccept, ""},
+		{"application/msgpack", msgpackContentType},
+		{"application/x-protobuf", protobufContentType},
+		{"application/msgpack;q=0.5, application/json", ""},
+		{"application/msgpack;q=0.5, application/x-protobuf;q=0.8, application/json;q=0.1", protobufContentType},
+		{"application/*", ""},
+		{"text/csv", "text/csv"},
+	}
+	for _, test := range tests {
+		t.Run(test.accept, func(t *testing.T) {
+			request := newRequest(t, "GET", "/albums", nil)
+			request.Header.Set("Accept", test.accept)
+			mediaType, encoder := server.negotiateEncoder(request)
+			if mediaType != test.want || (encoder == nil) != (test.want == "") {
+				t.Fatalf("got %q (encoder %v), want %q", mediaType, encoder, test.want)
+			}
+		})
+	}
+}
+
+func TestRegisteredEncoder(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles"})
+	server := NewServer(db, log.New(io.Discard, "", 0), WithResponseEncoder("text/csv", csvEncoder{}))
+
+	for _, test := range []struct {
+		path string
+		want string
+	}{
+		{"/albums", "a1,9th Symphony\na2,Hey Jude\n"},
+		{"/albums/a2", "a2,Hey Jude\n"},
+	} {
+		request := newRequest(t, "GET", test.path, nil)
+		request.Header.Set("Accept", "text/csv")
+		result := serve(t, server, request)
+		ensureStatus(t, result, http.StatusOK)
+		if got := result.Header.Get("Content-Type"); got != "text/csv" {
+			t.Fatalf("bad Content-Type: got %q", got)
+		}
+		if result.Header.Get("ETag") == "" {
+			t.Fatalf("no ETag in response")
+		}
+		b, err := io.ReadAll(result.Body)
+		if err != nil {
+			t.Fatalf("error reading response: %v", err)
+		}
+		if string(b) != test.want {
+			t.Fatalf("got body %q, want %q", b, test.want)
+		}
+	}
+
+	// Errors are still JSON
+	request := newRequest(t, "GET", "/albums/a3", nil)
+	request.Header.Set("Accept", "text/csv")
+	result := serve(t, server, request)
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	// Registering the same media type replaces the encoder
+	server = NewServer(db, log.New(io.Discard, "", 0), WithResponseEncoder(msgpackContentType, csvEncoder{}))
+	request = newRequest(t, "GET", "/albums/a1", nil)
+	request.Header.Set("Accept", msgpackContentType)
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	b, _ := io.ReadAll(result.Body)
+	if !strings.HasPrefix(string(b), "a1,") {
+		t.Fatalf("got body %q from replaced encoder", b)
+	}
+}
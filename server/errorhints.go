@@ -0,0 +1,94 @@
+// Example payloads and schema links in validation errors (dev mode)
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// WithDevMode sets whether the server runs in development mode, which adds
+// hints for integrators to validation errors: "$schema", a link to the
+// OpenAPI schema for the request body (or parameters, if there's no body),
+// and "$example", a minimal valid request body, where there is one. The
+// "$" prefix keeps them apart from the field names. This makes error
+// responses bigger and isn't meant for production. The default is false.
+func WithDevMode(enabled bool) Option {
+	return func(s *Server) {
+		s.devMode = enabled
+	}
+}
+
+// requestExamples are minimal valid request bodies, keyed by method and
+// OpenAPI path. The tests check that each one is accepted.
+var requestExamples = map[string]string{
+	"POST /albums":             `{"title": "Pianoman", "artist": "Billy Joel"}`,
+	"PUT /albums/{id}":         `{"title": "Pianoman", "artist": "Billy Joel"}`,
+	"POST /albums/{id}/tracks": `{"title": "Piano Man", "duration": 336}`,
+	"POST /albums/lookup":      `{"ids": ["a1", "a2"]}`,
+	"POST /genres":             `{"id": "soft-rock", "name": "Soft rock"}`,
+}
+
+var (
+	openAPIDocOnce  sync.Once
+	openAPIDocument *openAPIDoc
+)
+
+// openAPIOperationFor returns the OpenAPI path (like "/albums/{id}") of the
+// route that matches the request, and its operation, or nil if there's
+// none.
+func openAPIOperationFor(r *http.Request) (string, *openAPIOperation) {
+	openAPIDocOnce.Do(func() {
+		openAPIDocument = openAPISpec()
+	})
+	rte, _ := apiRoutes.match(r)
+	if rte == nil {
+		return "", nil
+	}
+	operation := openAPIDocument.Paths[rte.path][strings.ToLower(r.Method)]
+	if operation == nil {
+		return "", nil
+	}
+	return rte.path, operation
+}
+
+// jsonPointerToken escapes a JSON pointer token (RFC 6901) for use in a
+// URL fragment.
+func jsonPointerToken(token string) string {
+	token = strings.ReplaceAll(token, "~", "~0")
+	token = strings.ReplaceAll(token, "/", "~1")
+	return url.PathEscape(token)
+}
+
+// addErrorHints returns a copy of the validation error with the dev mode
+// hints added to its data (see WithDevMode).
+func (s *Server) addErrorHints(r *http.Request, apiErr *apierr.Error) *apierr.Error {
+	path, operation := openAPIOperationFor(r)
+	if operation == nil {
+		return apiErr
+	}
+
+	data := make(map[string]interface{}, len(apiErr.Data)+2)
+	for k, v := range apiErr.Data {
+		data[k] = v
+	}
+	pointer := "#/paths/" + jsonPointerToken(path) + "/" + strings.ToLower(r.Method)
+	if operation.RequestBody != nil {
+		pointer += "/requestBody/content/" + jsonPointerToken("application/json") + "/schema"
+	} else {
+		pointer += "/parameters"
+	}
+	data["$schema"] = s.absoluteURL(r, "/openapi.json") + pointer
+	if example, ok := requestExamples[r.Method+" "+path]; ok {
+		data["$example"] = json.RawMessage(example)
+	}
+
+	hinted := *apiErr
+	hinted.Data = data
+	return &hinted
+}
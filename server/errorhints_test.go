@@ -0,0 +1,143 @@
+// Tests for dev mode hints in validation errors
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newDevTestServer() *Server {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000})
+	return NewServer(db, log.New(io.Discard, "", 0), WithDevMode(true))
+}
+
+func TestErrorHints(t *testing.T) {
+	server := newDevTestServer()
+	const albumSchema = "http://example.com/openapi.json#/paths/~1albums/post/requestBody/content/application~1json/schema"
+
+	request := newRequest(t, "POST", "/albums", strings.NewReader(`{"artist": "Billy Joel"}`))
+	request.Host = "example.com"
+	result := serve(t, server, request)
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"title":    map[string]interface{}{"error": "required"},
+		"$schema":  albumSchema,
+		"$example": map[string]interface{}{"title": "Pianoman", "artist": "Billy Joel"},
+	})
+
+	// Literal paths are matched before templates, and requests without a
+	// body link to the parameters
+	request = newRequest(t, "POST", "/albums/lookup", strings.NewReader(`{}`))
+	request.Host = "example.com"
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusBadRequest)
+	var got struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	unmarshalResponse(t, result, &got)
+	if got.Data["$schema"] != "http://example.com/openapi.json#/paths/~1albums~1lookup/post/requestBody/content/application~1json/schema" {
+		t.Fatalf("bad lookup schema link: %v", got.Data["$schema"])
+	}
+
+	request = newRequest(t, "GET", "/albums/a1/diff", nil)
+	request.Host = "example.com"
+	result = serve(t, server, request)
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"from":    map[string]interface{}{"error": "required"},
+		"$schema": "http://example.com/openapi.json#/paths/~1albums~1%7Bid%7D~1diff/get/parameters",
+	})
+
+	// Other errors don't have hints
+	result = serve(t, server, newRequest(t, "GET", "/albums/a9", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestErrorHintsJSONAPI(t *testing.T) {
+	server := newDevTestServer()
+	result := serve(t, server, newJSONAPIRequest(t, "POST", "/genres", strings.NewReader(`{"id": "soft-rock"}`)))
+	ensureStatus(t, result, http.StatusBadRequest)
+	doc := readJSONAPI(t, result)
+	if errs := doc["errors"].([]interface{}); len(errs) != 1 {
+		t.Fatalf("got %d error objects, want 1: %#v", len(errs), errs)
+	}
+	meta := doc["meta"].(map[string]interface{})
+	if meta["$example"] == nil || !strings.HasSuffix(meta["$schema"].(string), "/openapi.json#/paths/~1genres/post/requestBody/content/application~1json/schema") {
+		t.Fatalf("bad meta: %#v", meta)
+	}
+}
+
+// resolvePointer resolves a JSON pointer fragment (like "#/paths/~1albums")
+// in the JSON document doc.
+func resolvePointer(t *testing.T, doc interface{}, fragment string) interface{} {
+	t.Helper()
+	fragment, err := url.PathUnescape(strings.TrimPrefix(fragment, "#"))
+	if err != nil {
+		t.Fatalf("bad fragment %q: %v", fragment, err)
+	}
+	for _, token := range strings.Split(fragment, "/")[1:] {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		object, ok := doc.(map[string]interface{})
+		if !ok {
+			t.Fatalf("can't resolve %q in %#v", token, doc)
+		}
+		doc, ok = object[token]
+		if !ok {
+			t.Fatalf("no %q in %s", token, fragment)
+		}
+	}
+	return doc
+}
+
+// Every example must be accepted by its endpoint, and have a schema link
+// that exists in the OpenAPI document.
+func TestRequestExamples(t *testing.T) {
+	b, err := json.Marshal(openAPISpec())
+	if err != nil {
+		t.Fatalf("error marshaling OpenAPI spec: %v", err)
+	}
+	var spec interface{}
+	err = json.Unmarshal(b, &spec)
+	if err != nil {
+		t.Fatalf("error unmarshaling OpenAPI spec: %v", err)
+	}
+
+	for key, body := range requestExamples {
+		t.Run(key, func(t *testing.T) {
+			space := strings.IndexByte(key, ' ')
+			method, path := key[:space], strings.ReplaceAll(key[space+1:], "{id}", "a1")
+			if method == "PUT" {
+				path = strings.ReplaceAll(key[space+1:], "{id}", "a9") // a new album
+			}
+
+			server := newDevTestServer()
+			result := serve(t, server, newRequest(t, method, path, strings.NewReader(body)))
+			if result.StatusCode < 200 || result.StatusCode > 299 {
+				b, _ := io.ReadAll(result.Body)
+				t.Fatalf("example rejected with %d: %s", result.StatusCode, b)
+			}
+
+			// An invalid body gets a schema link that resolves
+			result = serve(t, server, newRequest(t, method, path, strings.NewReader(`{"title": ""}`)))
+			ensureStatus(t, result, http.StatusBadRequest)
+			var got struct {
+				Data map[string]interface{} `json:"data"`
+			}
+			unmarshalResponse(t, result, &got)
+			if got.Data["$example"] == nil {
+				t.Fatalf("no example in %#v", got.Data)
+			}
+			link := got.Data["$schema"].(string)
+			schema := resolvePointer(t, spec, link[strings.IndexByte(link, '#'):])
+			if _, ok := schema.(map[string]interface{}); !ok {
+				t.Fatalf("schema link %q resolved to %#v", link, schema)
+			}
+		})
+	}
+}
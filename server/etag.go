@@ -0,0 +1,64 @@
+// ETags and conditional GETs for album list and feed responses
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// writeJSONWithETag is like writeJSON with status 200, but also sets an
+// ETag derived from the response body, so that clients can cache the
+// response and revalidate it with If-None-Match. If the client's copy is
+// still current, it writes 304 Not Modified with no body.
+//
+// Because the ETag is a hash of the exact response, each distinct list
+// (for example GET /albums?genre=rock) gets its own ETag, and it changes
+// whenever the albums in that list change.
+func (s *Server) writeJSONWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err := s.encodeJSON(buf, r, v, "")
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(err))
+		return
+	}
+	s.writeWithETag(w, r, "application/json; charset=utf-8", buf.Bytes())
+}
+
+// writeWithETag writes the response body b with status 200 and the given
+// content type, setting an ETag derived from b and handling If-None-Match
+// as described for writeJSONWithETag.
+func (s *Server) writeWithETag(w http.ResponseWriter, r *http.Request, contentType string, b []byte) {
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache") // cache, but always revalidate
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(b)
+	if err != nil {
+		s.log.Printf("error writing response: %v", err)
+	}
+}
+
+// etagMatch reports whether the If-None-Match header value matches etag,
+// using the weak comparison that RFC 7232 specifies for If-None-Match.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
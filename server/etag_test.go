@@ -0,0 +1,64 @@
+// Tests for ETags and conditional GETs
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGetAlbumsETag(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+	etag := result.Header.Get("ETag")
+	if len(etag) != 34 || etag[0] != '"' || etag[33] != '"' {
+		t.Fatalf("bad ETag: %q", etag)
+	}
+	if got := result.Header.Get("Cache-Control"); got != "no-cache" {
+		t.Fatalf("bad Cache-Control: got %q, want %q", got, "no-cache")
+	}
+
+	// ETag is deterministic, and a matching If-None-Match gives a 304
+	ensureConditionalGet(t, server, "/albums", etag, http.StatusNotModified, etag)
+	ensureConditionalGet(t, server, "/albums", `"other", W/`+etag, http.StatusNotModified, etag)
+	ensureConditionalGet(t, server, "/albums", `"other"`, http.StatusOK, etag)
+
+	// Each distinct list has its own ETag
+	result = serve(t, server, newRequest(t, "GET", "/albums/search?q=jude", nil))
+	ensureStatus(t, result, http.StatusOK)
+	searchETag := result.Header.Get("ETag")
+	if searchETag == etag {
+		t.Fatalf("search ETag %q should differ from list ETag", searchETag)
+	}
+	ensureConditionalGet(t, server, "/albums/search?q=jude", searchETag, http.StatusNotModified, searchETag)
+
+	// Changing the collection changes the ETag
+	body := `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel"}`
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	result = ensureConditionalGet(t, server, "/albums", etag, http.StatusOK, "")
+	if result.Header.Get("ETag") == etag {
+		t.Fatalf("ETag didn't change after adding album")
+	}
+}
+
+func ensureConditionalGet(t *testing.T, server *Server, path, ifNoneMatch string, status int, etag string) *http.Response {
+	t.Helper()
+	request := newRequest(t, "GET", path, nil)
+	request.Header.Set("If-None-Match", ifNoneMatch)
+	result := serve(t, server, request)
+	ensureStatus(t, result, status)
+	if etag != "" && result.Header.Get("ETag") != etag {
+		t.Fatalf("bad ETag: got %q, want %q", result.Header.Get("ETag"), etag)
+	}
+	if status == http.StatusNotModified {
+		b, _ := io.ReadAll(result.Body)
+		if len(b) != 0 {
+			t.Fatalf("got body %q for 304 response, want empty", b)
+		}
+	}
+	return result
+}
@@ -0,0 +1,237 @@
+// Event bus: every change is published to pluggable publishers
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Event is a change made through the API, published to every
+// EventPublisher. Type is the resource and the past tense of the action,
+// like "album.updated", and Data is the resource after the change (as
+// returned by the API), which is omitted for deletes of resources that no
+// longer exist.
+type Event struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Time       time.Time       `json:"time"`
+	ResourceID string          `json:"resource_id"`
+	Data       json.RawMessage `json:"data,omitempty"`
+
+	// Tenant is the ID of the tenant whose data changed, if there are
+	// tenants (see tenants.go).
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// EventPublisher is the interface integrations implement to be told about
+// every change. Publish is called on the goroutine of the request that made
+// the change, after it's been made, so it mustn't block: publishers that
+// do I/O should queue the event and send it in the background (as webhooks
+// do).
+type EventPublisher interface {
+	Publish(event Event)
+}
+
+// EventPublisherFunc is an adapter that allows an ordinary function to be
+// used as an EventPublisher.
+type EventPublisherFunc func(event Event)
+
+// Publish implements EventPublisher by calling f(event).
+func (f EventPublisherFunc) Publish(event Event) {
+	f(event)
+}
+
+// WithEventPublisher adds a publisher that's sent every event, after the
+// built-in ones (webhooks, WebSocket clients, and /events streams). A nil
+// publisher is ignored.
+func WithEventPublisher(publisher EventPublisher) Option {
+	return func(s *Server) {
+		if publisher != nil {
+			s.publishers = append(s.publishers, publisher)
+		}
+	}
+}
+
+// LogPublisher is an EventPublisher that logs each event.
+type LogPublisher struct {
+	Log *log.Logger
+}
+
+func (p LogPublisher) Publish(event Event) {
+	p.Log.Printf("event %s: %s %q", event.ID, event.Type, event.ResourceID)
+}
+
+// publish sends an event for the change to every publisher. Event IDs are
+// ULIDs, so they sort in the order the events happened (to the
+// millisecond).
+func (s *Server) publish(action, resource, id string, after json.RawMessage) {
+	eventID, err := ULIDGenerator{Now: s.now}.NewID()
+	if err != nil {
+		s.log.Printf("error generating event ID: %v", err)
+		return
+	}
+	// All the actions end in "e": create, update, delete, restore, and
+	// purchase
+	event := Event{
+		ID:         eventID,
+		Type:       resource + "." + action + "d",
+		Time:       s.now().UTC(),
+		ResourceID: id,
+		Data:       after,
+		Tenant:     s.tenant,
+	}
+	for _, publisher := range s.publishers {
+		publisher.Publish(event)
+	}
+}
+
+// Admins can follow events as they happen with a GET to /events, which
+// streams them as server-sent events (the text/event-stream format used
+// by the browser's EventSource), optionally only the given types or
+// resources (/events?type=album,genre.created). Events aren't buffered,
+// so clients should re-fetch what they need after reconnecting. Public
+// clients should use /ws instead, which hides admin-only albums and
+// fields.
+const (
+	eventStreamBuffer       = 64               // events queued per stream
+	eventStreamHeartbeat    = 15 * time.Second // keeps idle streams open through proxies
+	eventStreamWriteTimeout = 10 * time.Second // max time to write each event
+)
+
+// eventStreams is the EventPublisher for /events streams.
+type eventStreams struct {
+	heartbeat time.Duration // eventStreamHeartbeat, except in tests
+
+	mu       sync.Mutex
+	streams  map[chan Event]struct{}
+	done     chan struct{} // closed when the server is shutting down
+	doneOnce sync.Once
+}
+
+func newEventStreams() *eventStreams {
+	return &eventStreams{
+		heartbeat: eventStreamHeartbeat,
+		streams:   make(map[chan Event]struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Publish implements EventPublisher. A stream that can't keep up is ended
+// (by closing its channel) rather than holding up the request.
+func (e *eventStreams) Publish(event Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for stream := range e.streams {
+		select {
+		case stream <- event:
+		default:
+			delete(e.streams, stream)
+			close(stream)
+		}
+	}
+}
+
+func (e *eventStreams) add() chan Event {
+	stream := make(chan Event, eventStreamBuffer)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.streams[stream] = struct{}{}
+	return stream
+}
+
+func (e *eventStreams) remove(stream chan Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.streams[stream]; ok {
+		delete(e.streams, stream)
+		close(stream)
+	}
+}
+
+// stop ends all streams. It's registered with http.Server.RegisterOnShutdown,
+// as http.Server.Shutdown would otherwise wait for the streams to end.
+func (e *eventStreams) stop() {
+	e.doneOnce.Do(func() { close(e.done) })
+}
+
+func (s *Server) getEvents(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("streaming not supported")))
+		return
+	}
+	var types []string
+	for _, param := range paramValues(r, "type") {
+		types = append(types, strings.Split(param, ",")...)
+	}
+
+	// The http.Server's WriteTimeout is a deadline for the whole response,
+	// which would end the stream, so it's replaced by one for each write.
+	// That still drops clients that stop reading.
+	extendDeadline := func() {
+		setWriteDeadline(w, time.Now().Add(eventStreamWriteTimeout))
+	}
+
+	stream := s.events.add()
+	defer s.events.remove(stream)
+	extendDeadline()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": subscribed\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(s.events.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-stream:
+			if !ok {
+				return // too slow
+			}
+			if event.Tenant != s.tenant || !eventMatches(event, types) {
+				continue
+			}
+			b, err := json.Marshal(event)
+			if err != nil {
+				continue // can't happen for our types
+			}
+			extendDeadline()
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, b)
+		case <-heartbeat.C:
+			extendDeadline()
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		case <-s.events.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// eventMatches reports whether the event has one of the given types, or
+// is for one of the given resources. If there are none, all events match.
+func eventMatches(event Event, types []string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, typ := range types {
+		typ = strings.TrimSpace(typ)
+		if event.Type == typ || strings.HasPrefix(event.Type, typ+".") {
+			return true
+		}
+	}
+	return false
+}
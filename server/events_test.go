@@ -0,0 +1,187 @@
+// Tests for the event bus
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventPublisher(t *testing.T) {
+	var mu sync.Mutex
+	var events []Event
+	publisher := EventPublisherFunc(func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	})
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	server := NewServer(db, log.New(io.Discard, "", 0), WithAdminToken(testAdminToken), WithEventPublisher(publisher))
+
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a2", "title": "Hey Jude", "artist": "The Beatles", "price": 2000}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	result = serve(t, server, newRequest(t, "POST", "/genres", strings.NewReader(`{"id": "rock", "name": "Rock"}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	result = serve(t, server, newAdminRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newAdminRequest(t, "POST", "/albums/a1/restore", nil))
+	ensureStatus(t, result, http.StatusOK)
+
+	mu.Lock()
+	defer mu.Unlock()
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type+" "+event.ResourceID)
+	}
+	want := []string{"album.created a2", "genre.created rock", "album.deleted a1", "album.restored a1"}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("got events %q, want %q", types, want)
+	}
+	ids := make(map[string]bool)
+	for _, event := range events {
+		if len(event.ID) != 26 || ids[event.ID] {
+			t.Fatalf("bad or duplicate event ID %q", event.ID)
+		}
+		ids[event.ID] = true
+	}
+	var album Album
+	err := json.Unmarshal(events[0].Data, &album)
+	if err != nil || album.Title != "Hey Jude" {
+		t.Fatalf("got album %#v, error %v", album, err)
+	}
+}
+
+func TestLogPublisher(t *testing.T) {
+	var buf bytes.Buffer
+	LogPublisher{Log: log.New(&buf, "", 0)}.Publish(Event{ID: "e1", Type: "album.updated", ResourceID: "a1"})
+	if got, want := buf.String(), "event e1: album.updated \"a1\"\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestEventMatches(t *testing.T) {
+	event := Event{Type: "album.updated"}
+	tests := []struct {
+		types []string
+		want  bool
+	}{
+		{nil, true},
+		{[]string{"album"}, true},
+		{[]string{"genre", " album.updated"}, true},
+		{[]string{"album.created"}, false},
+		{[]string{"alb"}, false},
+	}
+	for _, test := range tests {
+		if got := eventMatches(event, test.types); got != test.want {
+			t.Errorf("eventMatches(%q) = %v, want %v", test.types, got, test.want)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	server := newSoftDeleteTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/events", nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	request := newAdminRequest(t, "GET", httpServer.URL+"/events?type=album.updated,genre", nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("error opening stream: %v", err)
+	}
+	defer response.Body.Close()
+	if got := response.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("got Content-Type %q", got)
+	}
+	reader := bufio.NewReader(response.Body)
+	readMessage := func() []string {
+		t.Helper()
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("error reading stream: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				return lines
+			}
+			lines = append(lines, line)
+		}
+	}
+	// Wait till we're subscribed before making changes
+	if lines := readMessage(); !reflect.DeepEqual(lines, []string{": subscribed"}) {
+		t.Fatalf("got %q, want subscribed comment", lines)
+	}
+
+	// The album.created event isn't sent, as it doesn't match the filter
+	ensureStatus(t, serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a3", "title": "Kind of Blue", "artist": "Miles Davis", "price": 1000}`))), http.StatusCreated)
+	request = newRequest(t, "PUT", "/albums/a1", strings.NewReader(`{"id": "a1", "title": "5th Symphony", "artist": "Beethoven", "price": 795}`))
+	request.Header.Set("If-Match", `"1"`)
+	ensureStatus(t, serve(t, server, request), http.StatusOK)
+	lines := readMessage()
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "id: ") || lines[1] != "event: album.updated" || !strings.HasPrefix(lines[2], "data: ") {
+		t.Fatalf("bad message %q", lines)
+	}
+	var event Event
+	err = json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &event)
+	if err != nil || event.ResourceID != "a1" || "id: "+event.ID != lines[0] {
+		t.Fatalf("got event %#v, error %v", event, err)
+	}
+
+	// Shutting down ends the stream
+	server.events.stop()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(reader)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("error reading to end of stream: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for stream to end")
+	}
+}
+
+func TestEventStreamWriteTimeout(t *testing.T) {
+	// The stream outlasts the http.Server's WriteTimeout, as long as each
+	// write is quick
+	server := newSoftDeleteTestServer()
+	server.events.heartbeat = 300 * time.Millisecond
+	httpServer := httptest.NewUnstartedServer(server)
+	httpServer.Config.WriteTimeout = 100 * time.Millisecond
+	httpServer.Start()
+	defer httpServer.Close()
+
+	request := newAdminRequest(t, "GET", httpServer.URL+"/events", nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("error opening stream: %v", err)
+	}
+	defer response.Body.Close()
+	reader := bufio.NewReader(response.Body)
+	for _, want := range []string{": subscribed", "", ": heartbeat", "", ": heartbeat", ""} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading stream: %v", err)
+		}
+		if line != want+"\n" {
+			t.Fatalf("got line %q, want %q", line, want)
+		}
+	}
+}
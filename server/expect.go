@@ -0,0 +1,63 @@
+// Reading uploads, and Expect: 100-continue
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// A client uploading a large file can send "Expect: 100-continue" and wait
+// for the server's go-ahead (an interim "100 Continue" response) before
+// sending the body, so it doesn't waste bandwidth uploading a file that's
+// going to be rejected anyway. Go's server sends the 100 Continue the first
+// time the handler reads the body, and if the handler responds without
+// reading it, the client is told no and never sends it.
+//
+// So the upload handlers (PUT /albums/:id/cover, POST
+// /albums/:id/attachments, and PUT /uploads/:token) make every check they
+// can before calling readUpload: the album or upload token exists, the
+// album has room for another attachment, the file name is valid, and the
+// declared Content-Length is within the limit. Middleware mustn't read the
+// body first either, so the duplicate request detector skips requests that
+// expect a 100 Continue. The idempotency middleware does still read the
+// body of a request with an Idempotency-Key, because it needs the body to
+// tell a retry from a misused key, so clients uploading large files
+// shouldn't send one.
+
+// readUpload reads an uploaded file of at most max bytes from the request
+// body, and verifies its checksum if the client sent one (see
+// checkContentDigest), writing an error response and returning false if
+// it can't. The what argument describes the file in error messages.
+func (s *Server) readUpload(w http.ResponseWriter, r *http.Request, max int, what string) ([]byte, bool) {
+	if r.ContentLength > int64(max) {
+		// Rejected before reading, so the client needn't send it at all
+		s.writeError(w, r, apierr.TooLarge(max))
+		return nil, false
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, int64(max)+1))
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("reading %s: %w", what, err)))
+		return nil, false
+	}
+	if len(data) > max {
+		// Chunked bodies don't declare their size up front
+		s.writeError(w, r, apierr.TooLarge(max))
+		return nil, false
+	}
+	if issue := checkContentDigest(r, data); issue != nil {
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{"Content-Digest": issue}))
+		return nil, false
+	}
+	return data, true
+}
+
+// expectsContinue reports whether the client is waiting for a 100 Continue
+// before sending the request body.
+func expectsContinue(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
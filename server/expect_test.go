@@ -0,0 +1,114 @@
+// Tests for reading uploads, and Expect: 100-continue
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendExpectContinue sends the headers of a request with "Expect:
+// 100-continue" to the server at addr, and returns the first response.
+// If that's a 100 Continue, it sends body and returns the final response
+// as well.
+func sendExpectContinue(t *testing.T, addr, method, path string, contentLength int, body string) (first, final *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n",
+		method, path, addr, contentLength)
+
+	reader := bufio.NewReader(conn)
+	first, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	if first.StatusCode != http.StatusContinue {
+		return first, nil
+	}
+	fmt.Fprint(conn, body)
+	final, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("error reading final response: %v", err)
+	}
+	return first, final
+}
+
+func TestExpectContinue(t *testing.T) {
+	server := newTestServer()
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	addr := httpServer.Listener.Addr().String()
+
+	// Requests that will be rejected are rejected before the body is sent
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		contentLength int
+		status        int
+	}{
+		{"no album", "POST", "/albums/x/attachments?filename=notes.txt", 10, http.StatusNotFound},
+		{"bad filename", "POST", "/albums/a1/attachments", 10, http.StatusBadRequest},
+		{"too large", "POST", "/albums/a1/attachments?filename=notes.txt", maxAttachmentBytes + 1, http.StatusRequestEntityTooLarge},
+		{"cover too large", "PUT", "/albums/a1/cover", maxCoverBytes + 1, http.StatusRequestEntityTooLarge},
+		{"bad token", "PUT", "/uploads/abc", 10, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first, _ := sendExpectContinue(t, addr, test.method, test.path, test.contentLength, "")
+			if first.StatusCode != test.status {
+				t.Fatalf("got status %d, want %d", first.StatusCode, test.status)
+			}
+		})
+	}
+
+	// Otherwise the client is told to continue
+	first, final := sendExpectContinue(t, addr, "POST", "/albums/a1/attachments?filename=notes.txt", 4, "text")
+	if first.StatusCode != http.StatusContinue || final.StatusCode != http.StatusCreated {
+		t.Fatalf("got statuses %d and %v, want 100 and 201", first.StatusCode, final)
+	}
+
+	// Once the album has as many attachments as it can, there's no point
+	// sending another
+	for i := 1; i < maxAttachmentsPerAlbum; i++ {
+		ensureStatus(t, serve(t, server, addAttachmentRequest(t, "a1", "notes.txt", "", "text")), http.StatusCreated)
+	}
+	first, _ = sendExpectContinue(t, addr, "POST", "/albums/a1/attachments?filename=notes.txt", 4, "text")
+	if first.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d, want 400", first.StatusCode)
+	}
+}
+
+func TestExpectContinueDuplicates(t *testing.T) {
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithDuplicateWindow(time.Minute))
+	defer server.Close()
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	// The duplicate detector doesn't read the body before the handler
+	first, _ := sendExpectContinue(t, httpServer.Listener.Addr().String(), "POST", "/albums/x/attachments?filename=notes.txt", 10, "")
+	if first.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %d, want 404", first.StatusCode)
+	}
+}
+
+func TestReadUploadChunked(t *testing.T) {
+	server := newTestServer()
+	request := newRequest(t, "PUT", "/albums/a1/cover", strings.NewReader(strings.Repeat("x", maxCoverBytes+1)))
+	request.ContentLength = -1 // unknown, as for a chunked body
+	result := serve(t, server, request)
+	ensureError(t, result, http.StatusRequestEntityTooLarge, "too-large", map[string]interface{}{"max_bytes": float64(maxCoverBytes)})
+}
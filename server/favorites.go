@@ -0,0 +1,238 @@
+// Per-user favorite albums
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Logged-in users (see users.go) can mark albums as favorites with PUT
+// /albums/:id/favorite and unmark them with DELETE, and list them, most
+// recently favorited first, with GET /me/favorites. Both are idempotent:
+// favoriting an album twice or unfavoriting one that isn't a favorite
+// succeeds and changes nothing. Only visible albums can be favorited, but
+// favorites of an album that's later deleted are kept (and just not
+// listed), so they come back if the album is restored.
+//
+// Albums returned by GET /albums and GET /albums/:id include the number of
+// users who've favorited them. The count isn't part of the album's
+// version, so it's not covered by the album's ETag.
+
+// Favorite records that a user has favorited an album.
+type Favorite struct {
+	UserID    string
+	AlbumID   string
+	CreatedAt time.Time
+}
+
+// FavoriteStore is the interface used by the server to store favorites.
+type FavoriteStore interface {
+	// AddFavorite adds a favorite, or does nothing if the user has already
+	// favorited the album.
+	AddFavorite(favorite Favorite) error
+
+	// DeleteFavorite deletes the user's favorite of the album, or does
+	// nothing if it isn't one of their favorites.
+	DeleteFavorite(userID, albumID string) error
+
+	// GetFavorites returns the user's favorites, most recent first.
+	GetFavorites(userID string) ([]Favorite, error)
+
+	// CountFavorites returns the number of users who've favorited each of
+	// the given albums, by album ID. Albums without favorites may be left
+	// out.
+	CountFavorites(albumIDs []string) (map[string]int, error)
+}
+
+// WithFavoriteStore sets the store for favorites. The default is none, in
+// which case the favorites routes aren't available and albums don't have
+// favorite counts.
+func WithFavoriteStore(store FavoriteStore) Option {
+	return func(s *Server) {
+		s.favoriteStore = store
+	}
+}
+
+// addFavoriteCounts sets the Favorites field of each album, in place.
+func (s *Server) addFavoriteCounts(albums []Album) error {
+	if s.favoriteStore == nil || len(albums) == 0 {
+		return nil
+	}
+	ids := make([]string, len(albums))
+	for i, album := range albums {
+		ids[i] = album.ID
+	}
+	counts, err := s.favoriteStore.CountFavorites(ids)
+	if err != nil {
+		return fmt.Errorf("counting favorites: %w", err)
+	}
+	for i := range albums {
+		albums[i].Favorites = counts[albums[i].ID]
+	}
+	return nil
+}
+
+// favoriteUser returns the logged-in user's ID for a favorites route,
+// writing an error and returning "" if favorites aren't available or the
+// caller isn't logged in.
+func (s *Server) favoriteUser(w http.ResponseWriter, r *http.Request) string {
+	if s.favoriteStore == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return ""
+	}
+	return s.requireUser(w, r)
+}
+
+func (s *Server) putFavorite(w http.ResponseWriter, r *http.Request, albumID string) {
+	userID := s.favoriteUser(w, r)
+	if userID == "" {
+		return
+	}
+	album, err := s.db.GetAlbumByID(albumID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	if !album.visible(s.now()) {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	err = s.favoriteStore.AddFavorite(Favorite{UserID: userID, AlbumID: albumID, CreatedAt: s.now()})
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("adding favorite: %w", err)))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deleteFavorite(w http.ResponseWriter, r *http.Request, albumID string) {
+	userID := s.favoriteUser(w, r)
+	if userID == "" {
+		return
+	}
+	err := s.favoriteStore.DeleteFavorite(userID, albumID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("deleting favorite: %w", err)))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getFavorites(w http.ResponseWriter, r *http.Request) {
+	userID := s.favoriteUser(w, r)
+	if userID == "" {
+		return
+	}
+	favorites, err := s.favoriteStore.GetFavorites(userID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("getting favorites: %w", err)))
+		return
+	}
+	ids := make([]string, len(favorites))
+	for i, favorite := range favorites {
+		ids[i] = favorite.AlbumID
+	}
+	found, err := s.db.GetAlbumsByIDs(ids)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("getting %d favorite albums: %w", len(ids), err)))
+		return
+	}
+	found = filterVisible(found, s.now(), false)
+	byID := make(map[string]Album, len(found))
+	for _, album := range found {
+		byID[album.ID] = album
+	}
+
+	// Keep the favorites' order, skipping albums that aren't visible
+	albums := make([]Album, 0, len(byID))
+	for _, id := range ids {
+		if album, ok := byID[id]; ok {
+			albums = append(albums, album)
+		}
+	}
+	err = s.addFavoriteCounts(albums)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, s.redactAlbums(r, albums))
+}
+
+// MemoryFavoriteStore is a FavoriteStore that keeps favorites in memory.
+type MemoryFavoriteStore struct {
+	lock      sync.RWMutex
+	favorites map[string]map[string]time.Time // time favorited by user ID and album ID
+	counts    map[string]int                  // by album ID
+}
+
+// NewMemoryFavoriteStore creates a new, empty in-memory favorite store.
+func NewMemoryFavoriteStore() *MemoryFavoriteStore {
+	return &MemoryFavoriteStore{
+		favorites: make(map[string]map[string]time.Time),
+		counts:    make(map[string]int),
+	}
+}
+
+func (m *MemoryFavoriteStore) AddFavorite(favorite Favorite) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	albums := m.favorites[favorite.UserID]
+	if albums == nil {
+		albums = make(map[string]time.Time)
+		m.favorites[favorite.UserID] = albums
+	}
+	if _, ok := albums[favorite.AlbumID]; ok {
+		return nil
+	}
+	albums[favorite.AlbumID] = favorite.CreatedAt
+	m.counts[favorite.AlbumID]++
+	return nil
+}
+
+func (m *MemoryFavoriteStore) DeleteFavorite(userID, albumID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.favorites[userID][albumID]; !ok {
+		return nil
+	}
+	delete(m.favorites[userID], albumID)
+	m.counts[albumID]--
+	if m.counts[albumID] == 0 {
+		delete(m.counts, albumID)
+	}
+	return nil
+}
+
+func (m *MemoryFavoriteStore) GetFavorites(userID string) ([]Favorite, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	favorites := make([]Favorite, 0, len(m.favorites[userID]))
+	for albumID, createdAt := range m.favorites[userID] {
+		favorites = append(favorites, Favorite{UserID: userID, AlbumID: albumID, CreatedAt: createdAt})
+	}
+	sort.Slice(favorites, func(i, j int) bool {
+		if !favorites[i].CreatedAt.Equal(favorites[j].CreatedAt) {
+			return favorites[i].CreatedAt.After(favorites[j].CreatedAt)
+		}
+		return favorites[i].AlbumID < favorites[j].AlbumID
+	})
+	return favorites, nil
+}
+
+func (m *MemoryFavoriteStore) CountFavorites(albumIDs []string) (map[string]int, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	counts := make(map[string]int, len(albumIDs))
+	for _, id := range albumIDs {
+		if n := m.counts[id]; n > 0 {
+			counts[id] = n
+		}
+	}
+	return counts, nil
+}
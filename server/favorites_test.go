@@ -0,0 +1,144 @@
+// Tests for per-user favorites
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFavoritesTestServer(now *time.Time) *Server {
+	db := NewMemoryDatabase()
+	for _, album := range []Album{
+		{ID: "a1", Title: "Help!", Artist: "The Beatles", Price: 1500},
+		{ID: "a2", Title: "Abbey Road", Artist: "The Beatles", Price: 1600},
+	} {
+		db.AddAlbum(album)
+	}
+	return NewServer(db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return *now }),
+		WithIDGenerator(&SequentialIDGenerator{}),
+		WithUserStore(NewMemoryUserStore()),
+		WithFavoriteStore(NewMemoryFavoriteStore()),
+	)
+}
+
+// newTestUser signs up and logs in a user, returning their session token.
+func newTestUser(t *testing.T, server *Server, email string) string {
+	t.Helper()
+	input := `{"email": "` + email + `", "password": "correct horse"}`
+	result := serve(t, server, newRequest(t, "POST", "/users", strings.NewReader(input)))
+	ensureStatus(t, result, http.StatusCreated)
+	result = serve(t, server, newRequest(t, "POST", "/users/login", strings.NewReader(input)))
+	ensureStatus(t, result, http.StatusOK)
+	var login loginResponse
+	unmarshalResponse(t, result, &login)
+	return login.Token
+}
+
+func getFavoriteIDs(t *testing.T, server *Server, token string) []string {
+	t.Helper()
+	result := serve(t, server, newSessionRequest(t, "GET", "/me/favorites", token))
+	ensureStatus(t, result, http.StatusOK)
+	var albums []Album
+	unmarshalResponse(t, result, &albums)
+	ids := []string{}
+	for _, album := range albums {
+		ids = append(ids, album.ID)
+	}
+	return ids
+}
+
+func TestFavorites(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	server := newFavoritesTestServer(&now)
+	kim := newTestUser(t, server, "kim@example.com")
+	lee := newTestUser(t, server, "lee@example.com")
+
+	for _, favorite := range []struct {
+		token   string
+		albumID string
+	}{{kim, "a1"}, {kim, "a2"}, {kim, "a1"}, {lee, "a1"}} {
+		now = now.Add(time.Minute)
+		result := serve(t, server, newSessionRequest(t, "PUT", "/albums/"+favorite.albumID+"/favorite", favorite.token))
+		ensureStatus(t, result, http.StatusNoContent)
+	}
+	if got := strings.Join(getFavoriteIDs(t, server, kim), ","); got != "a2,a1" {
+		t.Fatalf("got favorites %s, want a2,a1", got)
+	}
+
+	// Albums have favorite counts
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var album Album
+	unmarshalResponse(t, result, &album)
+	if album.Favorites != 2 {
+		t.Fatalf("got %d favorites, want 2", album.Favorites)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var albums []Album
+	unmarshalResponse(t, result, &albums)
+	if len(albums) != 2 || albums[0].Favorites != 2 || albums[1].Favorites != 1 {
+		t.Fatalf("bad albums: %+v", albums)
+	}
+
+	// Unfavoriting is idempotent, and clients can't set the count
+	for i := 0; i < 2; i++ {
+		result = serve(t, server, newSessionRequest(t, "DELETE", "/albums/a1/favorite", kim))
+		ensureStatus(t, result, http.StatusNoContent)
+	}
+	if got := strings.Join(getFavoriteIDs(t, server, kim), ","); got != "a2" {
+		t.Fatalf("got favorites %s, want a2", got)
+	}
+	result = serve(t, server, newRequest(t, "PUT", "/albums/a1", strings.NewReader(`{"title": "Help!", "artist": "The Beatles", "price": 1500, "favorites": 99, "version": 1}`)))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	album = Album{}
+	unmarshalResponse(t, result, &album)
+	if album.Favorites != 1 {
+		t.Fatalf("got %d favorites, want 1", album.Favorites)
+	}
+
+	// Deleted albums aren't listed, or can't be favorited, but come back
+	// if restored
+	result = serve(t, server, newAdminRequest(t, "DELETE", "/albums/a2", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	if got := getFavoriteIDs(t, server, kim); len(got) != 0 {
+		t.Fatalf("got favorites %v, want none", got)
+	}
+	result = serve(t, server, newSessionRequest(t, "PUT", "/albums/a2/favorite", lee))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newSessionRequest(t, "PUT", "/albums/nope/favorite", lee))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newAdminRequest(t, "POST", "/albums/a2/restore", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got := strings.Join(getFavoriteIDs(t, server, kim), ","); got != "a2" {
+		t.Fatalf("got favorites %s, want a2", got)
+	}
+}
+
+func TestFavoritesUnauthorized(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	server := newFavoritesTestServer(&now)
+	for _, request := range []*http.Request{
+		newRequest(t, "PUT", "/albums/a1/favorite", nil),
+		newRequest(t, "DELETE", "/albums/a1/favorite", nil),
+		newRequest(t, "GET", "/me/favorites", nil),
+		newAdminRequest(t, "GET", "/me/favorites", nil),
+	} {
+		result := serve(t, server, request)
+		ensureError(t, result, http.StatusUnauthorized, "unauthorized", nil)
+	}
+
+	// Without a favorite store, the routes aren't available
+	server = newTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/me/favorites", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
@@ -0,0 +1,259 @@
+// Sitemap and Atom feed of the public album catalog
+
+package server
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+const (
+	// Maximum number of URLs in a single sitemap, from sitemaps.org. Larger
+	// catalogs are split into pages listed by a sitemap index.
+	sitemapPageSize = 50000
+
+	// Number of albums on each page of the Atom feed.
+	feedPageSize = 50
+
+	// Largest page number accepted for the sitemap and feed.
+	maxFeedPage = 10000
+)
+
+// albumModified returns when the album last changed as far as the public
+// is concerned: when it was updated, or when it was published if that's
+// later (a scheduled album appears without being changed).
+func albumModified(album Album) time.Time {
+	if album.PublishAt != nil && album.PublishAt.After(album.UpdatedAt) {
+		return album.PublishAt.UTC()
+	}
+	return album.UpdatedAt
+}
+
+// albumPublished returns when the album first became publicly visible.
+func albumPublished(album Album) time.Time {
+	if album.PublishAt != nil && album.PublishAt.After(album.CreatedAt) {
+		return album.PublishAt.UTC()
+	}
+	return album.CreatedAt
+}
+
+// visibleAlbums fetches the publicly visible albums, writing an error
+// response and returning false for ok if that fails.
+func (s *Server) visibleAlbums(w http.ResponseWriter, r *http.Request) (albums []Album, ok bool) {
+	albums, err := s.db.GetAlbums()
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return nil, false
+	}
+	return filterVisible(albums, s.now(), false), true
+}
+
+// pageParam parses the optional "page" query parameter, returning 0 if it
+// isn't given. It writes an error response and returns false for ok if the
+// parameter is invalid.
+func (s *Server) pageParam(w http.ResponseWriter, r *http.Request) (page int, ok bool) {
+	issues := make(map[string]interface{})
+	page = intParam(r.URL.Query().Get("page"), 0, 1, maxFeedPage, "page", issues)
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return 0, false
+	}
+	return page, true
+}
+
+// writeXML encodes v as an XML document and writes it with an ETag.
+func (s *Server) writeXML(w http.ResponseWriter, r *http.Request, contentType string, v interface{}) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(buf)
+	encoder.Indent("", "  ")
+	err := encoder.Encode(v)
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(err))
+		return
+	}
+	buf.WriteByte('\n')
+	s.writeWithETag(w, r, contentType, buf.Bytes())
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// getSitemap serves a sitemap of the public album pages. If there are too
+// many albums for one sitemap, GET /sitemap.xml returns a sitemap index,
+// and the albums are listed by GET /sitemap.xml?page=N.
+func (s *Server) getSitemap(w http.ResponseWriter, r *http.Request) {
+	page, ok := s.pageParam(w, r)
+	if !ok {
+		return
+	}
+	albums, ok := s.visibleAlbums(w, r)
+	if !ok {
+		return
+	}
+
+	numPages := (len(albums) + sitemapPageSize - 1) / sitemapPageSize
+	if page == 0 && numPages > 1 {
+		index := sitemapIndex{}
+		for i := 1; i <= numPages; i++ {
+			// The sitemap's lastmod is that of its most recent album
+			var lastMod time.Time
+			for _, album := range albums[(i-1)*sitemapPageSize : minInt(i*sitemapPageSize, len(albums))] {
+				if modified := albumModified(album); modified.After(lastMod) {
+					lastMod = modified
+				}
+			}
+			index.Sitemaps = append(index.Sitemaps, sitemapURL{
+				Loc:     s.absoluteURL(r, "/sitemap.xml?page="+strconv.Itoa(i)),
+				LastMod: lastMod.Format(time.RFC3339),
+			})
+		}
+		s.writeXML(w, r, "application/xml; charset=utf-8", index)
+		return
+	}
+
+	if page > 1 && page > numPages {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if page > 0 {
+		albums = albums[(page-1)*sitemapPageSize : minInt(page*sitemapPageSize, len(albums))]
+	}
+	urlSet := sitemapURLSet{URLs: []sitemapURL{}}
+	for _, album := range albums {
+		urlSet.URLs = append(urlSet.URLs, sitemapURL{
+			Loc:     s.publicAlbumURL(r, album.ID),
+			LastMod: albumModified(album).Format(time.RFC3339),
+		})
+	}
+	s.writeXML(w, r, "application/xml; charset=utf-8", urlSet)
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Links     []atomLink `xml:"link"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Author    atomPerson `xml:"author"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+// getFeed serves an Atom feed of the public albums, most recently added or
+// updated first. It's paged as described in RFC 5005, with ?page=N and
+// first, last, next, and previous links.
+func (s *Server) getFeed(w http.ResponseWriter, r *http.Request) {
+	page, ok := s.pageParam(w, r)
+	if !ok {
+		return
+	}
+	if page == 0 {
+		page = 1
+	}
+	albums, ok := s.visibleAlbums(w, r)
+	if !ok {
+		return
+	}
+	sort.SliceStable(albums, func(i, j int) bool {
+		mi, mj := albumModified(albums[i]), albumModified(albums[j])
+		if !mi.Equal(mj) {
+			return mi.After(mj)
+		}
+		return albums[i].ID < albums[j].ID
+	})
+
+	numPages := (len(albums) + feedPageSize - 1) / feedPageSize
+	if numPages == 0 {
+		numPages = 1 // an empty feed still has its first page
+	}
+	if page > numPages {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+
+	// The feed was last updated when its most recent album was
+	updated := s.now().UTC()
+	if len(albums) > 0 {
+		updated = albumModified(albums[0])
+	}
+	albums = albums[(page-1)*feedPageSize : minInt(page*feedPageSize, len(albums))]
+
+	feed := atomFeed{
+		ID:      s.absoluteURL(r, "/feed.atom"),
+		Title:   "Albums",
+		Updated: updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Href: s.feedPageURL(r, page)},
+			{Rel: "first", Href: s.feedPageURL(r, 1)},
+			{Rel: "last", Href: s.feedPageURL(r, numPages)},
+		},
+	}
+	if page > 1 {
+		feed.Links = append(feed.Links, atomLink{Rel: "previous", Href: s.feedPageURL(r, page-1)})
+	}
+	if page < numPages {
+		feed.Links = append(feed.Links, atomLink{Rel: "next", Href: s.feedPageURL(r, page+1)})
+	}
+	for _, album := range albums {
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        s.absoluteURL(r, "/albums/"+url.PathEscape(album.ID)),
+			Title:     album.Title,
+			Links:     []atomLink{{Rel: "alternate", Href: s.publicAlbumURL(r, album.ID)}},
+			Published: albumPublished(album).Format(time.RFC3339),
+			Updated:   albumModified(album).Format(time.RFC3339),
+			Author:    atomPerson{Name: album.Artist},
+		})
+	}
+	s.writeXML(w, r, "application/atom+xml; charset=utf-8", feed)
+}
+
+// feedPageURL returns the absolute URL of the given page of the feed.
+func (s *Server) feedPageURL(r *http.Request, page int) string {
+	if page == 1 {
+		return s.absoluteURL(r, "/feed.atom")
+	}
+	return s.absoluteURL(r, "/feed.atom?page="+strconv.Itoa(page))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
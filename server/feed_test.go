@@ -0,0 +1,212 @@
+// Tests for the sitemap and Atom feed
+
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newFeedTestServer creates a server whose albums were added a minute
+// apart from 2021-06-01 12:00 UTC, in the order given.
+func newFeedTestServer(albums []Album, options ...Option) *Server {
+	db := NewMemoryDatabase()
+	added := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	db.Now = func() time.Time { return added }
+	for _, album := range albums {
+		db.AddAlbum(album)
+		added = added.Add(time.Minute)
+	}
+	now := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	options = append([]Option{WithClock(func() time.Time { return now })}, options...)
+	return NewServer(db, log.New(io.Discard, "", 0), options...)
+}
+
+func unmarshalXML(t *testing.T, response *http.Response, contentType string, v interface{}) {
+	t.Helper()
+	if got := response.Header.Get("Content-Type"); got != contentType {
+		t.Fatalf("bad Content-Type: got %q, want %q", got, contentType)
+	}
+	b, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	err = xml.Unmarshal(b, v)
+	if err != nil {
+		t.Fatalf("error unmarshaling XML: %v\n%s", err, b)
+	}
+}
+
+func TestGetSitemap(t *testing.T) {
+	publishAt := time.Date(2021, 6, 15, 0, 0, 0, 0, time.UTC)
+	future := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	server := newFeedTestServer([]Album{
+		{ID: "a2", Title: "Hey Jude", Artist: "The Beatles"},
+		{ID: "a 1", Title: "9th Symphony", Artist: "Beethoven"},
+		{ID: "a3", Title: "Pianoman", Artist: "Billy Joel", PublishAt: &publishAt},
+		{ID: "a4", Title: "Thriller", Artist: "Michael Jackson", PublishAt: &future},
+		{ID: "a5", Title: "Abbey Road", Artist: "The Beatles"},
+	}, WithPublicURLTemplate("https://shop.example.com/catalog/{id}"))
+	result := serve(t, server, newRequest(t, "DELETE", "/albums/a5", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+
+	result = serve(t, server, newRequest(t, "GET", "/sitemap.xml", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var got sitemapURLSet
+	unmarshalXML(t, result, "application/xml; charset=utf-8", &got)
+	if got.XMLName.Space != "http://www.sitemaps.org/schemas/sitemap/0.9" {
+		t.Fatalf("bad namespace: %q", got.XMLName.Space)
+	}
+	want := []sitemapURL{
+		{"https://shop.example.com/catalog/a%201", "2021-06-01T12:01:00Z"},
+		{"https://shop.example.com/catalog/a2", "2021-06-01T12:00:00Z"},
+		{"https://shop.example.com/catalog/a3", "2021-06-15T00:00:00Z"}, // when it was published
+	}
+	if !reflect.DeepEqual(got.URLs, want) {
+		t.Fatalf("bad sitemap URLs: got vs want:\n%+v\n%+v", got.URLs, want)
+	}
+
+	// Conditional GET
+	request := newRequest(t, "GET", "/sitemap.xml", nil)
+	request.Header.Set("If-None-Match", result.Header.Get("ETag"))
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusNotModified)
+
+	result = serve(t, server, newRequest(t, "GET", "/sitemap.xml?page=2", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newRequest(t, "POST", "/sitemap.xml", nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+}
+
+func TestGetSitemapIndex(t *testing.T) {
+	albums := make([]Album, sitemapPageSize+1)
+	for i := range albums {
+		albums[i] = Album{ID: fmt.Sprintf("a%05d", i), Title: "Title", Artist: "Artist"}
+	}
+	db := NewMemoryDatabase()
+	for _, album := range albums {
+		db.AddAlbum(album)
+	}
+	server := NewServer(db, log.New(io.Discard, "", 0))
+
+	request := newRequest(t, "GET", "/sitemap.xml", nil)
+	request.Host = "example.com"
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	var index sitemapIndex
+	unmarshalXML(t, result, "application/xml; charset=utf-8", &index)
+	if len(index.Sitemaps) != 2 || index.Sitemaps[1].Loc != "http://example.com/sitemap.xml?page=2" {
+		t.Fatalf("bad sitemap index: %+v", index.Sitemaps)
+	}
+
+	request = newRequest(t, "GET", "/sitemap.xml?page=2", nil)
+	request.Host = "example.com"
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	var urlSet sitemapURLSet
+	unmarshalXML(t, result, "application/xml; charset=utf-8", &urlSet)
+	if len(urlSet.URLs) != 1 || urlSet.URLs[0].Loc != "http://example.com/albums/a50000" {
+		t.Fatalf("bad sitemap page 2: %+v", urlSet.URLs)
+	}
+
+	result = serve(t, server, newRequest(t, "GET", "/sitemap.xml?page=3", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestGetFeed(t *testing.T) {
+	publishAt := time.Date(2021, 6, 15, 0, 0, 0, 0, time.UTC)
+	var albums []Album
+	for i := 0; i < 2*feedPageSize+1; i++ {
+		albums = append(albums, Album{ID: fmt.Sprintf("a%03d", i), Title: fmt.Sprintf("Title %d", i), Artist: "Artist"})
+	}
+	albums[0].PublishAt = &publishAt
+	server := newFeedTestServer(albums, WithBaseURL(mustParseBaseURL(t, "https://example.com/api")))
+
+	result := serve(t, server, newRequest(t, "GET", "/feed.atom", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var feed atomFeed
+	unmarshalXML(t, result, "application/atom+xml; charset=utf-8", &feed)
+	if feed.XMLName.Space != "http://www.w3.org/2005/Atom" || feed.ID != "https://example.com/api/feed.atom" {
+		t.Fatalf("bad feed: namespace %q, ID %q", feed.XMLName.Space, feed.ID)
+	}
+	if feed.Updated != "2021-06-15T00:00:00Z" {
+		t.Fatalf("bad feed updated time: %q", feed.Updated)
+	}
+	wantLinks := []atomLink{
+		{"self", "https://example.com/api/feed.atom"},
+		{"first", "https://example.com/api/feed.atom"},
+		{"last", "https://example.com/api/feed.atom?page=3"},
+		{"next", "https://example.com/api/feed.atom?page=2"},
+	}
+	if !reflect.DeepEqual(feed.Links, wantLinks) {
+		t.Fatalf("bad feed links: got vs want:\n%+v\n%+v", feed.Links, wantLinks)
+	}
+	if len(feed.Entries) != feedPageSize {
+		t.Fatalf("got %d entries, want %d", len(feed.Entries), feedPageSize)
+	}
+
+	// The scheduled album is newest because it was published most recently,
+	// then the rest are most recently added first
+	want := atomEntry{
+		ID:        "https://example.com/api/albums/a000",
+		Title:     "Title 0",
+		Links:     []atomLink{{"alternate", "https://example.com/api/albums/a000"}},
+		Published: "2021-06-15T00:00:00Z",
+		Updated:   "2021-06-15T00:00:00Z",
+		Author:    atomPerson{"Artist"},
+	}
+	if !reflect.DeepEqual(feed.Entries[0], want) {
+		t.Fatalf("bad first entry: got vs want:\n%+v\n%+v", feed.Entries[0], want)
+	}
+	if feed.Entries[1].ID != "https://example.com/api/albums/a100" || feed.Entries[1].Published != "2021-06-01T13:40:00Z" {
+		t.Fatalf("bad second entry: %+v", feed.Entries[1])
+	}
+
+	result = serve(t, server, newRequest(t, "GET", "/feed.atom?page=3", nil))
+	ensureStatus(t, result, http.StatusOK)
+	feed = atomFeed{}
+	unmarshalXML(t, result, "application/atom+xml; charset=utf-8", &feed)
+	wantLinks = []atomLink{
+		{"self", "https://example.com/api/feed.atom?page=3"},
+		{"first", "https://example.com/api/feed.atom"},
+		{"last", "https://example.com/api/feed.atom?page=3"},
+		{"previous", "https://example.com/api/feed.atom?page=2"},
+	}
+	if !reflect.DeepEqual(feed.Links, wantLinks) {
+		t.Fatalf("bad feed links: got vs want:\n%+v\n%+v", feed.Links, wantLinks)
+	}
+	if len(feed.Entries) != 1 || feed.Entries[0].ID != "https://example.com/api/albums/a001" {
+		t.Fatalf("bad last page entries: %+v", feed.Entries)
+	}
+}
+
+func TestGetFeedErrors(t *testing.T) {
+	server := newFeedTestServer(nil)
+
+	// An empty catalog still has a first page
+	result := serve(t, server, newRequest(t, "GET", "/feed.atom", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var feed atomFeed
+	unmarshalXML(t, result, "application/atom+xml; charset=utf-8", &feed)
+	if len(feed.Entries) != 0 || feed.Updated != "2021-07-01T00:00:00Z" {
+		t.Fatalf("bad empty feed: %+v", feed)
+	}
+
+	result = serve(t, server, newRequest(t, "GET", "/feed.atom?page=2", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	result = serve(t, server, newRequest(t, "GET", "/feed.atom?page=0", nil))
+	data := map[string]interface{}{
+		"page": map[string]interface{}{"error": "out-of-range", "message": "page must be an integer between 1 and 10000"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+
+	result = serve(t, server, newRequest(t, "DELETE", "/feed.atom", nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+}
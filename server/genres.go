@@ -0,0 +1,144 @@
+// Genres taxonomy, and filtering albums by genre
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Genre represents a single music genre.
+type Genre struct {
+	ID   string `json:"id"` // lowercase slug, like "hip-hop"
+	Name string `json:"name"`
+}
+
+// Genre IDs are lowercase slugs.
+var reGenreID = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// filterGenre returns only the albums in any of the given genres. It
+// filters in place, overwriting the albums slice.
+func filterGenre(albums []Album, genres ...string) []Album {
+	filtered := albums[:0]
+	for _, album := range albums {
+		if inGenre(album, genres) {
+			filtered = append(filtered, album)
+		}
+	}
+	return filtered
+}
+
+// inGenre reports whether the album is in any of the given genres.
+func inGenre(album Album, genres []string) bool {
+	for _, g := range album.Genres {
+		for _, genre := range genres {
+			if g == genre {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateAlbumGenres checks that all of an album's genres exist, adding an
+// issue to issues if not. It returns the genres sorted and de-duplicated,
+// or an error if the genres couldn't be fetched from the database.
+func (s *Server) validateAlbumGenres(genres []string, issues map[string]interface{}) ([]string, error) {
+	if len(genres) == 0 {
+		return genres, nil
+	}
+	allGenres, err := s.db.GetGenres()
+	if err != nil {
+		return nil, fmt.Errorf("fetching genres: %w", err)
+	}
+	exists := make(map[string]bool, len(allGenres))
+	for _, genre := range allGenres {
+		exists[genre.ID] = true
+	}
+
+	seen := make(map[string]bool, len(genres))
+	var unique, unknown []string
+	for _, genre := range genres {
+		if seen[genre] {
+			continue
+		}
+		seen[genre] = true
+		unique = append(unique, genre)
+		if !exists[genre] {
+			unknown = append(unknown, fmt.Sprintf("%q", genre))
+		}
+	}
+	if len(unknown) > 0 {
+		issues["genres"] = validationIssue{"unknown", "unknown genre(s) " + strings.Join(unknown, ", ")}
+	}
+	sort.Strings(unique)
+	return unique, nil
+}
+
+func (s *Server) getGenres(w http.ResponseWriter, r *http.Request) {
+	genres, err := s.db.GetGenres()
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, genres)
+}
+
+func (s *Server) addGenre(w http.ResponseWriter, r *http.Request) {
+	var genre Genre
+	if !s.readJSON(w, r, &genre) {
+		return
+	}
+
+	issues := make(map[string]interface{})
+	if genre.ID == "" {
+		issues["id"] = validationIssue{"required", ""}
+	} else if !reGenreID.MatchString(genre.ID) {
+		issues["id"] = validationIssue{"invalid", "id must be lowercase letters and digits separated by hyphens"}
+	}
+	if genre.Name == "" {
+		issues["name"] = validationIssue{"required", ""}
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+
+	err := s.db.AddGenre(genre)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("adding genre ID %q: %w", genre.ID, err)))
+		return
+	}
+	s.audit(r, "create", "genre", genre.ID, nil, snapshot(genre))
+	s.writeJSON(w, r, http.StatusCreated, genre)
+}
+
+func (d *MemoryDatabase) GetGenres() ([]Genre, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	genres := make([]Genre, 0, len(d.genres))
+	for _, genre := range d.genres {
+		genres = append(genres, genre)
+	}
+	sort.Slice(genres, func(i, j int) bool {
+		return genres[i].ID < genres[j].ID
+	})
+	return genres, nil
+}
+
+func (d *MemoryDatabase) AddGenre(genre Genre) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.genres[genre.ID]; ok {
+		return ErrAlreadyExists
+	}
+	d.genres[genre.ID] = genre
+	return nil
+}
@@ -0,0 +1,91 @@
+// Tests for genres and filtering albums by genre
+
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGenres(t *testing.T) {
+	server := newTestServer()
+	ensureGenres(t, server, []Genre{})
+
+	for _, body := range []string{`{"id": "rock", "name": "Rock"}`, `{"id": "classical", "name": "Classical"}`} {
+		result := serve(t, server, newRequest(t, "POST", "/genres", strings.NewReader(body)))
+		ensureStatus(t, result, http.StatusCreated)
+	}
+	ensureGenres(t, server, []Genre{{"classical", "Classical"}, {"rock", "Rock"}})
+
+	result := serve(t, server, newRequest(t, "POST", "/genres", strings.NewReader(`{"id": "rock", "name": "Rock 'n' Roll"}`)))
+	ensureStatus(t, result, http.StatusConflict)
+	ensureError(t, result, http.StatusConflict, "already-exists", nil)
+
+	result = serve(t, server, newRequest(t, "POST", "/genres", strings.NewReader(`{"id": "Hip Hop"}`)))
+	ensureStatus(t, result, http.StatusBadRequest)
+	data := map[string]interface{}{
+		"id":   map[string]interface{}{"error": "invalid", "message": "id must be lowercase letters and digits separated by hyphens"},
+		"name": map[string]interface{}{"error": "required"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+}
+
+func TestAlbumGenres(t *testing.T) {
+	server := newTestServer()
+	server.db.AddGenre(Genre{ID: "rock", Name: "Rock"})
+	server.db.AddGenre(Genre{ID: "pop", Name: "Pop"})
+
+	body := `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel", "genres": ["rock", "jazz", "polka"]}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusBadRequest)
+	data := map[string]interface{}{
+		"genres": map[string]interface{}{"error": "unknown", "message": `unknown genre(s) "jazz", "polka"`},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+
+	body = `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel", "genres": ["rock", "pop", "rock"]}`
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	var got testAlbum
+	unmarshalResponse(t, result, &got)
+	want := testAlbum{ID: "a9", Title: "Pianoman", Artist: "Billy Joel", Genres: []string{"pop", "rock"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad response: got vs want:\n%#v\n%#v", got, want)
+	}
+
+	body = `{"id": "a3", "title": "Abbey Road", "artist": "The Beatles", "genres": ["rock"]}`
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	result = serve(t, server, newRequest(t, "GET", "/albums?genre=rock", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var albums []testAlbum
+	unmarshalResponse(t, result, &albums)
+	ids := []string{}
+	for _, album := range albums {
+		ids = append(ids, album.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"a3", "a9"}) {
+		t.Fatalf("bad album IDs: got %q, want %q", ids, []string{"a3", "a9"})
+	}
+
+	result = serve(t, server, newRequest(t, "GET", "/albums?genre=polka", nil))
+	ensureStatus(t, result, http.StatusOK)
+	unmarshalResponse(t, result, &albums)
+	if len(albums) != 0 {
+		t.Fatalf("got albums %#v, want none", albums)
+	}
+}
+
+func ensureGenres(t *testing.T, server *Server, want []Genre) {
+	t.Helper()
+	result := serve(t, server, newRequest(t, "GET", "/genres", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var got []Genre
+	unmarshalResponse(t, result, &got)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad genres: got vs want:\n%#v\n%#v", got, want)
+	}
+}
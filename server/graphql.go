@@ -0,0 +1,1202 @@
+// GraphQL endpoint for albums
+
+package server
+
+// This is a small GraphQL implementation, just enough of the language for
+// clients to fetch exactly the album fields they need in one request:
+// queries and mutations with fields, aliases, arguments, and variables.
+// Fragments, directives, subscriptions, and introspection (other than
+// __typename) aren't supported. The schema is in graphQLTypes, and is
+// served as SDL at /graphql/schema.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+const (
+	maxGraphQLQueryLen = 10000
+	maxGraphQLDepth    = 10 // of selection sets and list or object values
+)
+
+// graphQLFieldDef defines a field of an object or input type in the schema.
+type graphQLFieldDef struct {
+	typ  string            // GraphQL type, like "[Album!]!"
+	args map[string]string // argument types by name
+}
+
+// graphQLTypes are the object types in the schema. Album and Track fields
+// are the camelCase versions of their JSON names (see jsonFieldName).
+var graphQLTypes = map[string]map[string]graphQLFieldDef{
+	"Query": {
+		"album":  {"Album", map[string]string{"id": "ID!"}},
+		"albums": {"[Album!]!", map[string]string{"q": "String", "genre": "String", "first": "Int", "offset": "Int"}},
+	},
+	"Mutation": {
+		"addAlbum": {"Album", map[string]string{"input": "AlbumInput!"}},
+	},
+	"Album": {
+		"id":            {typ: "ID!"},
+		"title":         {typ: "String!"},
+		"artist":        {typ: "String!"},
+		"price":         {typ: "Int"},
+		"publishAt":     {typ: "String"},
+		"tracks":        {typ: "[Track!]"},
+		"genres":        {typ: "[String!]"},
+		"version":       {typ: "Int!"},
+		"createdAt":     {typ: "String!"},
+		"updatedAt":     {typ: "String!"},
+		"catalogNumber": {typ: "String"},
+		"stock":         {typ: "Int"},
+		"upc":           {typ: "String"},
+		"musicbrainzId": {typ: "String"},
+	},
+	"Track": {
+		"number":        {typ: "Int!"},
+		"title":         {typ: "String!"},
+		"duration":      {typ: "Int!"},
+		"isrc":          {typ: "String"},
+		"musicbrainzId": {typ: "String"},
+	},
+}
+
+// graphQLInputTypes are the input object types in the schema, with their
+// field types by name.
+var graphQLInputTypes = map[string]map[string]string{
+	"AlbumInput": {
+		"id":            "ID",
+		"title":         "String!",
+		"artist":        "String!",
+		"price":         "Int",
+		"publishAt":     "String",
+		"tracks":        "[TrackInput!]",
+		"genres":        "[String!]",
+		"catalogNumber": "String",
+		"stock":         "Int",
+		"upc":           "String",
+		"musicbrainzId": "String",
+	},
+	"TrackInput": {
+		"number":        "Int!",
+		"title":         "String!",
+		"duration":      "Int!",
+		"isrc":          "String",
+		"musicbrainzId": "String",
+	},
+}
+
+// graphQLScalars are the built-in scalar types the schema uses.
+var graphQLScalars = map[string]bool{"ID": true, "String": true, "Int": true, "Boolean": true}
+
+// graphQLSDL returns the schema in GraphQL's schema definition language,
+// with types and fields sorted by name.
+func graphQLSDL() string {
+	var buf strings.Builder
+	write := func(kind, name string, fields map[string]string) {
+		names := make([]string, 0, len(fields))
+		for field := range fields {
+			names = append(names, field)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&buf, "%s %s {\n", kind, name)
+		for _, field := range names {
+			fmt.Fprintf(&buf, "  %s%s\n", field, fields[field])
+		}
+		buf.WriteString("}\n\n")
+	}
+	var typeNames, inputNames []string
+	for name := range graphQLTypes {
+		typeNames = append(typeNames, name)
+	}
+	for name := range graphQLInputTypes {
+		inputNames = append(inputNames, name)
+	}
+	sort.Strings(typeNames)
+	sort.Strings(inputNames)
+	for _, name := range typeNames {
+		fields := make(map[string]string)
+		for field, def := range graphQLTypes[name] {
+			var args []string
+			for arg, typ := range def.args {
+				args = append(args, arg+": "+typ)
+			}
+			sort.Strings(args)
+			signature := ": " + def.typ
+			if len(args) > 0 {
+				signature = "(" + strings.Join(args, ", ") + ")" + signature
+			}
+			fields[field] = signature
+		}
+		write("type", name, fields)
+	}
+	for _, name := range inputNames {
+		fields := make(map[string]string)
+		for field, typ := range graphQLInputTypes[name] {
+			fields[field] = ": " + typ
+		}
+		write("input", name, fields)
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// jsonFieldName returns the JSON name of a camelCase GraphQL field, like
+// "created_at" for "createdAt".
+func jsonFieldName(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			b.WriteByte('_')
+			c += 'a' - 'A'
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// graphQLTypeName returns the named type at the core of a type, like
+// "Album" for "[Album!]!".
+func graphQLTypeName(typ string) string {
+	return strings.Trim(typ, "[]!")
+}
+
+// graphQLError is an error in a GraphQL response.
+type graphQLError struct {
+	Message    string                 `json:"message"`
+	Locations  []graphQLLocation      `json:"locations,omitempty"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// graphQLLocation is a position in the query, starting from line 1 and
+// column 1.
+type graphQLLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (e *graphQLError) Error() string {
+	return e.Message
+}
+
+// newGraphQLError returns an error at the given byte offset in query.
+func newGraphQLError(query string, pos int, format string, args ...interface{}) *graphQLError {
+	line := 1 + strings.Count(query[:pos], "\n")
+	column := 1 + pos - (strings.LastIndexByte(query[:pos], '\n') + 1)
+	return &graphQLError{
+		Message:   fmt.Sprintf(format, args...),
+		Locations: []graphQLLocation{{line, column}},
+	}
+}
+
+type graphQLToken struct {
+	kind  rune // 'n' for a name, 'i' an int, 'f' a float, 's' a string, 'p' punctuation, 0 the end
+	value string
+	pos   int // byte offset in the query
+}
+
+// lexGraphQL splits a query into tokens, skipping whitespace, commas, and
+// comments.
+func lexGraphQL(query string) ([]graphQLToken, error) {
+	var tokens []graphQLToken
+	i := 0
+	for i < len(query) {
+		c := query[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(query[i:], "..."):
+			tokens = append(tokens, graphQLToken{'p', "...", start})
+			i += 3
+		case strings.IndexByte("!$()[]{}:=@|&", c) >= 0:
+			tokens = append(tokens, graphQLToken{'p', string(c), start})
+			i++
+		case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+			for i < len(query) && (query[i] == '_' || isAlnum(query[i])) {
+				i++
+			}
+			tokens = append(tokens, graphQLToken{'n', query[start:i], start})
+		case c == '-' || c >= '0' && c <= '9':
+			kind := 'i'
+			i++
+			digits := func() {
+				for i < len(query) && query[i] >= '0' && query[i] <= '9' {
+					i++
+				}
+			}
+			digits()
+			if i < len(query) && query[i] == '.' {
+				kind = 'f'
+				i++
+				digits()
+			}
+			if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+				kind = 'f'
+				i++
+				if i < len(query) && (query[i] == '+' || query[i] == '-') {
+					i++
+				}
+				digits()
+			}
+			value := query[start:i]
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, newGraphQLError(query, start, "Syntax Error: Invalid number %q.", value)
+			}
+			tokens = append(tokens, graphQLToken{kind, value, start})
+		case c == '"':
+			if strings.HasPrefix(query[i:], `"""`) {
+				return nil, newGraphQLError(query, start, "Syntax Error: Block strings aren't supported.")
+			}
+			i++
+			for i < len(query) && query[i] != '"' && query[i] != '\n' {
+				if query[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(query) || query[i] != '"' {
+				return nil, newGraphQLError(query, start, "Syntax Error: Unterminated string.")
+			}
+			i++
+			// GraphQL string escapes are the same as JSON's
+			var value string
+			if err := json.Unmarshal([]byte(query[start:i]), &value); err != nil {
+				return nil, newGraphQLError(query, start, "Syntax Error: Invalid string.")
+			}
+			tokens = append(tokens, graphQLToken{'s', value, start})
+		default:
+			return nil, newGraphQLError(query, start, "Syntax Error: Unexpected character %q.", c)
+		}
+	}
+	return append(tokens, graphQLToken{0, "", len(query)}), nil
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// graphQLOperation is a query or mutation in a GraphQL document.
+type graphQLOperation struct {
+	kind       string // "query" or "mutation"
+	name       string
+	variables  []graphQLVariableDef
+	selections []*graphQLSelection
+}
+
+type graphQLVariableDef struct {
+	name       string
+	typ        string
+	value      interface{} // default value, if hasDefault
+	hasDefault bool
+	pos        int
+}
+
+// graphQLSelection is a field in a selection set.
+type graphQLSelection struct {
+	alias      string
+	name       string
+	args       []graphQLArgument
+	selections []*graphQLSelection
+	pos        int
+
+	argValues map[string]interface{} // coerced arguments, set by validation
+}
+
+// responseKey returns the field's key in the response: its alias if it has
+// one, otherwise its name.
+func (f *graphQLSelection) responseKey() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type graphQLArgument struct {
+	name  string
+	value interface{}
+	pos   int
+}
+
+// Values in a query are nil (null), bool, int64, float64, string,
+// []interface{} (a list), map[string]interface{} (an input object),
+// graphQLEnum, or graphQLVariable.
+type (
+	graphQLEnum     string
+	graphQLVariable string
+)
+
+type graphQLParser struct {
+	query  string
+	tokens []graphQLToken
+	i      int
+	depth  int
+}
+
+// parseGraphQL parses a GraphQL document into its operations.
+func parseGraphQL(query string) ([]*graphQLOperation, error) {
+	tokens, err := lexGraphQL(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &graphQLParser{query: query, tokens: tokens}
+	var operations []*graphQLOperation
+	for p.peek().kind != 0 {
+		operation, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, operation)
+	}
+	if len(operations) == 0 {
+		return nil, p.errorf(p.peek(), "Syntax Error: Unexpected <EOF>.")
+	}
+	return operations, nil
+}
+
+func (p *graphQLParser) peek() graphQLToken {
+	return p.tokens[p.i]
+}
+
+func (p *graphQLParser) next() graphQLToken {
+	token := p.tokens[p.i]
+	if token.kind != 0 {
+		p.i++
+	}
+	return token
+}
+
+func (p *graphQLParser) errorf(token graphQLToken, format string, args ...interface{}) error {
+	return newGraphQLError(p.query, token.pos, format, args...)
+}
+
+func (p *graphQLParser) unexpected(token graphQLToken) error {
+	if token.kind == 0 {
+		return p.errorf(token, "Syntax Error: Unexpected <EOF>.")
+	}
+	if token.kind == 's' {
+		return p.errorf(token, "Syntax Error: Unexpected string %q.", token.value)
+	}
+	return p.errorf(token, "Syntax Error: Unexpected %q.", token.value)
+}
+
+func (p *graphQLParser) isPunct(value string) bool {
+	token := p.peek()
+	return token.kind == 'p' && token.value == value
+}
+
+func (p *graphQLParser) expectPunct(value string) error {
+	if !p.isPunct(value) {
+		token := p.peek()
+		if token.kind == 0 {
+			return p.errorf(token, "Syntax Error: Expected %q, found <EOF>.", value)
+		}
+		return p.errorf(token, "Syntax Error: Expected %q, found %q.", value, token.value)
+	}
+	p.next()
+	return nil
+}
+
+func (p *graphQLParser) name() (string, error) {
+	token := p.next()
+	if token.kind != 'n' {
+		return "", p.unexpected(token)
+	}
+	return token.value, nil
+}
+
+// unsupported returns an error if the next token starts a part of the
+// language this implementation doesn't support.
+func (p *graphQLParser) unsupported() error {
+	switch {
+	case p.isPunct("..."):
+		return p.errorf(p.peek(), "Fragments aren't supported.")
+	case p.isPunct("@"):
+		return p.errorf(p.peek(), "Directives aren't supported.")
+	}
+	return nil
+}
+
+func (p *graphQLParser) operation() (*graphQLOperation, error) {
+	operation := &graphQLOperation{kind: "query"}
+	if p.isPunct("{") {
+		// Query shorthand, with no name or variables
+		selections, err := p.selectionSet()
+		operation.selections = selections
+		return operation, err
+	}
+	token := p.next()
+	switch {
+	case token.kind == 'n' && (token.value == "query" || token.value == "mutation"):
+		operation.kind = token.value
+	case token.kind == 'n' && token.value == "subscription":
+		return nil, p.errorf(token, "Subscriptions aren't supported.")
+	case token.kind == 'n' && token.value == "fragment":
+		return nil, p.errorf(token, "Fragments aren't supported.")
+	default:
+		return nil, p.unexpected(token)
+	}
+	if p.peek().kind == 'n' {
+		operation.name = p.next().value
+	}
+	if p.isPunct("(") {
+		p.next()
+		for !p.isPunct(")") {
+			def, err := p.variableDefinition()
+			if err != nil {
+				return nil, err
+			}
+			operation.variables = append(operation.variables, def)
+		}
+		p.next()
+	}
+	if err := p.unsupported(); err != nil {
+		return nil, err
+	}
+	selections, err := p.selectionSet()
+	operation.selections = selections
+	return operation, err
+}
+
+func (p *graphQLParser) variableDefinition() (graphQLVariableDef, error) {
+	def := graphQLVariableDef{pos: p.peek().pos}
+	if err := p.expectPunct("$"); err != nil {
+		return def, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return def, err
+	}
+	def.name = name
+	if err := p.expectPunct(":"); err != nil {
+		return def, err
+	}
+	def.typ, err = p.typeRef()
+	if err != nil {
+		return def, err
+	}
+	if p.isPunct("=") {
+		p.next()
+		def.value, err = p.value(true)
+		def.hasDefault = true
+	}
+	return def, err
+}
+
+func (p *graphQLParser) typeRef() (string, error) {
+	var typ string
+	if p.isPunct("[") {
+		p.next()
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expectPunct("]"); err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		typ = name
+	}
+	if p.isPunct("!") {
+		p.next()
+		typ += "!"
+	}
+	return typ, nil
+}
+
+func (p *graphQLParser) selectionSet() ([]*graphQLSelection, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxGraphQLDepth {
+		return nil, p.errorf(p.peek(), "Query nested too deeply.")
+	}
+	var selections []*graphQLSelection
+	for !p.isPunct("}") {
+		if err := p.unsupported(); err != nil {
+			return nil, err
+		}
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, field)
+	}
+	if len(selections) == 0 {
+		return nil, p.unexpected(p.peek())
+	}
+	p.next()
+	return selections, nil
+}
+
+func (p *graphQLParser) field() (*graphQLSelection, error) {
+	field := &graphQLSelection{pos: p.peek().pos}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	field.name = name
+	if p.isPunct(":") {
+		p.next()
+		field.alias = name
+		field.name, err = p.name()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("(") {
+		p.next()
+		for !p.isPunct(")") {
+			arg := graphQLArgument{pos: p.peek().pos}
+			arg.name, err = p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(":"); err != nil {
+				return nil, err
+			}
+			arg.value, err = p.value(false)
+			if err != nil {
+				return nil, err
+			}
+			field.args = append(field.args, arg)
+		}
+		p.next()
+	}
+	if err := p.unsupported(); err != nil {
+		return nil, err
+	}
+	if p.isPunct("{") {
+		field.selections, err = p.selectionSet()
+	}
+	return field, err
+}
+
+// value parses a value. If constant is true, variables aren't allowed.
+func (p *graphQLParser) value(constant bool) (interface{}, error) {
+	token := p.next()
+	switch token.kind {
+	case 'i':
+		n, err := strconv.ParseInt(token.value, 10, 64)
+		if err != nil {
+			return nil, p.errorf(token, "Int cannot represent non 32-bit signed integer value: %s", token.value)
+		}
+		return n, nil
+	case 'f':
+		f, _ := strconv.ParseFloat(token.value, 64) // checked by the lexer
+		return f, nil
+	case 's':
+		return token.value, nil
+	case 'n':
+		switch token.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return graphQLEnum(token.value), nil
+	}
+	switch {
+	case token.value == "$" && !constant:
+		name, err := p.name()
+		return graphQLVariable(name), err
+	case token.value == "[" || token.value == "{":
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > maxGraphQLDepth {
+			return nil, p.errorf(token, "Query nested too deeply.")
+		}
+	}
+	switch token.value {
+	case "[":
+		list := []interface{}{}
+		for !p.isPunct("]") {
+			item, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		p.next()
+		return list, nil
+	case "{":
+		object := make(map[string]interface{})
+		for !p.isPunct("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(":"); err != nil {
+				return nil, err
+			}
+			object[name], err = p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+		return object, nil
+	}
+	return nil, p.unexpected(token)
+}
+
+// graphQLObject is an object in a GraphQL response, which keeps its
+// fields in the order they were selected.
+type graphQLObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newGraphQLObject() *graphQLObject {
+	return &graphQLObject{values: make(map[string]interface{})}
+}
+
+func (o *graphQLObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *graphQLObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// graphQLExecutor validates and executes one operation.
+type graphQLExecutor struct {
+	s         *Server
+	r         *http.Request
+	query     string
+	varDefs   map[string]graphQLVariableDef
+	variables map[string]interface{} // coerced variable values
+	errors    []*graphQLError
+}
+
+// coerceVariables checks the variable definitions and coerces the values
+// given in the request (or the defaults) to their types.
+func (e *graphQLExecutor) coerceVariables(operation *graphQLOperation, values map[string]interface{}) error {
+	e.varDefs = make(map[string]graphQLVariableDef)
+	e.variables = make(map[string]interface{})
+	for _, def := range operation.variables {
+		name := graphQLTypeName(def.typ)
+		if !graphQLScalars[name] && graphQLInputTypes[name] == nil {
+			return newGraphQLError(e.query, def.pos, "Unknown type %q.", name)
+		}
+		e.varDefs[def.name] = def
+		value, ok := values[def.name]
+		if !ok {
+			value = def.value
+			if !def.hasDefault && strings.HasSuffix(def.typ, "!") {
+				return newGraphQLError(e.query, def.pos, "Variable \"$%s\" of required type %q was not provided.", def.name, def.typ)
+			}
+		}
+		coerced, err := e.coerce(def.typ, value)
+		if err != nil {
+			return newGraphQLError(e.query, def.pos, "Variable \"$%s\" got invalid value: %v", def.name, err)
+		}
+		e.variables[def.name] = coerced
+	}
+	return nil
+}
+
+// coerce converts a value (from a query, or variables decoded from JSON)
+// to the given input type, returning an error if it's not valid. Input
+// objects are converted to maps keyed by JSON field name.
+func (e *graphQLExecutor) coerce(typ string, value interface{}) (interface{}, error) {
+	if name, ok := value.(graphQLVariable); ok {
+		def, ok := e.varDefs[string(name)]
+		if !ok {
+			return nil, fmt.Errorf("variable \"$%s\" is not defined", name)
+		}
+		if def.typ != typ && def.typ != typ+"!" {
+			return nil, fmt.Errorf("variable \"$%s\" of type %q used in position expecting type %q", name, def.typ, typ)
+		}
+		value = e.variables[string(name)]
+		if value == nil && strings.HasSuffix(typ, "!") {
+			return nil, fmt.Errorf("expected non-null value of type %q", typ)
+		}
+		return value, nil
+	}
+	if strings.HasSuffix(typ, "!") {
+		if value == nil {
+			return nil, fmt.Errorf("expected non-null value of type %q", typ)
+		}
+		typ = strings.TrimSuffix(typ, "!")
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(typ, "[") {
+		inner := typ[1 : len(typ)-1]
+		list, ok := value.([]interface{})
+		if !ok {
+			// A single value is coerced to a list of one
+			list = []interface{}{value}
+		}
+		coerced := make([]interface{}, len(list))
+		for i, item := range list {
+			var err error
+			coerced[i], err = e.coerce(inner, item)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return coerced, nil
+	}
+
+	if fields, ok := graphQLInputTypes[typ]; ok {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected an object of type %q", typ)
+		}
+		coerced := make(map[string]interface{}, len(object))
+		for name, fieldType := range fields {
+			fieldValue, given := object[name]
+			if !given && strings.HasSuffix(fieldType, "!") {
+				return nil, fmt.Errorf("field %q of required type %q was not provided", name, fieldType)
+			}
+			if !given {
+				continue
+			}
+			v, err := e.coerce(fieldType, fieldValue)
+			if err != nil {
+				return nil, fmt.Errorf("in field %q: %v", name, err)
+			}
+			coerced[jsonFieldName(name)] = v
+		}
+		for name := range object {
+			if _, ok := fields[name]; !ok {
+				return nil, fmt.Errorf("field %q is not defined by type %q", name, typ)
+			}
+		}
+		return coerced, nil
+	}
+
+	switch typ {
+	case "String", "ID":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case int64:
+			if typ == "ID" {
+				return strconv.FormatInt(v, 10), nil
+			}
+		case float64:
+			if typ == "ID" && v == math.Trunc(v) {
+				return strconv.FormatFloat(v, 'f', -1, 64), nil
+			}
+		}
+		return nil, fmt.Errorf("%s cannot represent value %s", typ, graphQLPrint(value))
+	case "Int":
+		var n float64
+		switch v := value.(type) {
+		case int64:
+			n = float64(v)
+		case float64:
+			n = v
+		default:
+			return nil, fmt.Errorf("Int cannot represent non-integer value %s", graphQLPrint(value))
+		}
+		if n != math.Trunc(n) || n < math.MinInt32 || n > math.MaxInt32 {
+			return nil, fmt.Errorf("Int cannot represent non 32-bit signed integer value %s", graphQLPrint(value))
+		}
+		return int(n), nil
+	case "Boolean":
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("Boolean cannot represent a non boolean value %s", graphQLPrint(value))
+	}
+	return nil, fmt.Errorf("unknown type %q", typ)
+}
+
+// graphQLPrint formats a value for an error message.
+func graphQLPrint(value interface{}) string {
+	switch v := value.(type) {
+	case graphQLEnum:
+		return string(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+// validate checks the selections against the schema for the given object
+// type, and coerces their arguments.
+func (e *graphQLExecutor) validate(typeName string, selections []*graphQLSelection) error {
+	for _, f := range selections {
+		if f.name == "__typename" {
+			if len(f.args) > 0 || len(f.selections) > 0 {
+				return newGraphQLError(e.query, f.pos, "Field \"__typename\" must not have arguments or a selection.")
+			}
+			continue
+		}
+		def, ok := graphQLTypes[typeName][f.name]
+		if !ok {
+			return newGraphQLError(e.query, f.pos, "Cannot query field %q on type %q.", f.name, typeName)
+		}
+
+		f.argValues = make(map[string]interface{})
+		for _, arg := range f.args {
+			argType, ok := def.args[arg.name]
+			if !ok {
+				return newGraphQLError(e.query, arg.pos, "Unknown argument %q on field \"%s.%s\".", arg.name, typeName, f.name)
+			}
+			value, err := e.coerce(argType, arg.value)
+			if err != nil {
+				return newGraphQLError(e.query, arg.pos, "Argument %q has invalid value: %v", arg.name, err)
+			}
+			f.argValues[arg.name] = value
+		}
+		for name, argType := range def.args {
+			if _, ok := f.argValues[name]; !ok && strings.HasSuffix(argType, "!") {
+				return newGraphQLError(e.query, f.pos, "Field %q argument %q of type %q is required, but it was not provided.", f.name, name, argType)
+			}
+		}
+
+		fieldType := graphQLTypeName(def.typ)
+		_, isObject := graphQLTypes[fieldType]
+		switch {
+		case isObject && len(f.selections) == 0:
+			return newGraphQLError(e.query, f.pos, "Field %q of type %q must have a selection of subfields.", f.name, def.typ)
+		case !isObject && len(f.selections) > 0:
+			return newGraphQLError(e.query, f.pos, "Field %q must not have a selection since type %q has no subfields.", f.name, def.typ)
+		case isObject:
+			if err := e.validate(fieldType, f.selections); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// execute runs the operation's root fields in order, returning the data
+// (nil if a root field that can't be null failed).
+func (e *graphQLExecutor) execute(operation *graphQLOperation) *graphQLObject {
+	rootType := "Query"
+	if operation.kind == "mutation" {
+		rootType = "Mutation"
+	}
+	data := newGraphQLObject()
+	for _, f := range operation.selections {
+		key := f.responseKey()
+		if f.name == "__typename" {
+			data.set(key, rootType)
+			continue
+		}
+		typ := graphQLTypes[rootType][f.name].typ
+		value, err := e.resolve(f)
+		if err != nil {
+			gqlErr := e.fieldError(err)
+			gqlErr.Locations = newGraphQLError(e.query, f.pos, "").Locations
+			gqlErr.Path = []interface{}{key}
+			e.errors = append(e.errors, gqlErr)
+			if strings.HasSuffix(typ, "!") {
+				return nil
+			}
+		}
+		data.set(key, complete(typ, value, f.selections))
+	}
+	return data
+}
+
+// fieldError converts an error from a resolver to a GraphQL error, with
+// the API error code (and data, if any) in its extensions.
+func (e *graphQLExecutor) fieldError(err error) *graphQLError {
+	apiErr := errorMapping.Lookup(err)
+	if apiErr.Status >= 500 {
+		e.s.log.Printf("error handling GraphQL %s: %v", e.r.URL.Path, apiErr)
+	}
+	message, ok := apierr.Title(apiErr.Code)
+	if !ok {
+		message = http.StatusText(apiErr.Status)
+	}
+	extensions := map[string]interface{}{"code": apiErr.Code}
+	if len(apiErr.Data) > 0 {
+		extensions["data"] = apiErr.Data
+	}
+	return &graphQLError{Message: message, Extensions: extensions}
+}
+
+// complete builds the response value for a resolved value of the given
+// type, picking out the selected fields of objects. Object values are
+// maps keyed by JSON field name, as decoded from an album's JSON.
+func complete(typ string, value interface{}, selections []*graphQLSelection) interface{} {
+	if value == nil {
+		return nil
+	}
+	typ = strings.TrimSuffix(typ, "!")
+	if strings.HasPrefix(typ, "[") {
+		list := value.([]interface{})
+		completed := make([]interface{}, len(list))
+		for i, item := range list {
+			completed[i] = complete(typ[1:len(typ)-1], item, selections)
+		}
+		return completed
+	}
+	fields, ok := graphQLTypes[typ]
+	if !ok {
+		return value
+	}
+	values := value.(map[string]interface{})
+	object := newGraphQLObject()
+	for _, f := range selections {
+		if f.name == "__typename" {
+			object.set(f.responseKey(), typ)
+			continue
+		}
+		object.set(f.responseKey(), complete(fields[f.name].typ, values[jsonFieldName(f.name)], f.selections))
+	}
+	return object
+}
+
+// albumValue converts an album to a value for complete.
+func albumValue(album Album) interface{} {
+	var value map[string]interface{}
+	json.Unmarshal(snapshot(album), &value) // can't fail for an Album
+	return value
+}
+
+// resolve fetches the value of a root field, backed by the database.
+func (e *graphQLExecutor) resolve(f *graphQLSelection) (interface{}, error) {
+	s := e.s
+	switch f.name {
+	case "album":
+		album, err := s.db.GetAlbumByID(f.argValues["id"].(string))
+		if errors.Is(err, ErrDoesNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, apierr.Database(err)
+		}
+		if !album.visible(s.now()) {
+			return nil, nil
+		}
+		return albumValue(s.redactAlbum(e.r, album)), nil
+
+	case "albums":
+		issues := make(map[string]interface{})
+		var filter Filter
+		if q, _ := f.argValues["q"].(string); q != "" {
+			var err error
+			filter, err = s.parseCallerFilter(e.r, q)
+			if err != nil {
+				issues["q"] = validationIssue{"invalid", err.Error()}
+			}
+		}
+		first, hasFirst := f.argValues["first"].(int)
+		offset, _ := f.argValues["offset"].(int)
+		if first < 0 {
+			issues["first"] = validationIssue{"out-of-range", "first must not be negative"}
+		}
+		if offset < 0 {
+			issues["offset"] = validationIssue{"out-of-range", "offset must not be negative"}
+		}
+		if len(issues) > 0 {
+			return nil, apierr.Validation(issues)
+		}
+
+		var albums []Album
+		var err error
+		if filter != nil {
+			albums, err = filterAlbums(s.db, filter)
+		} else {
+			albums, err = s.db.GetAlbums()
+		}
+		if err != nil {
+			return nil, apierr.Database(err)
+		}
+		albums = filterVisible(albums, s.now(), false)
+		if genre, _ := f.argValues["genre"].(string); genre != "" {
+			albums = filterGenre(albums, genre)
+		}
+		if offset > len(albums) {
+			offset = len(albums)
+		}
+		albums = albums[offset:]
+		if hasFirst && first < len(albums) {
+			albums = albums[:first]
+		}
+		values := make([]interface{}, len(albums))
+		for i, album := range s.redactAlbums(e.r, albums) {
+			values[i] = albumValue(album)
+		}
+		return values, nil
+
+	case "addAlbum":
+		// Validate the input just like a POST to /albums, by way of JSON
+		fields := f.argValues["input"].(map[string]interface{})
+		if publishAt, ok := fields["publish_at"].(string); ok {
+			if _, err := time.Parse(time.RFC3339, publishAt); err != nil {
+				issues := map[string]interface{}{
+					"publish_at": validationIssue{"invalid", "publishAt must be an RFC 3339 time, like 2021-06-01T12:00:00Z"},
+				}
+				return nil, apierr.Validation(issues)
+			}
+		}
+		var input albumInput
+		json.Unmarshal(snapshot(fields), &input) // can't fail: the fields have been coerced
+		album, issues, err := s.validateAlbum(input, "")
+		if err != nil {
+			return nil, apierr.Database(err)
+		}
+		if len(issues) > 0 {
+			return nil, apierr.Validation(issues)
+		}
+		stored, err := s.createAlbum(e.r, album)
+		if err != nil {
+			return nil, err
+		}
+		return albumValue(s.redactAlbum(e.r, stored)), nil
+	}
+	return nil, fmt.Errorf("no resolver for field %q", f.name) // can't happen after validation
+}
+
+// graphQLRequest is a GraphQL request, as a POST body or GET parameters.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// graphQLResponse is a GraphQL response. Data is left out if the request
+// failed before execution started.
+type graphQLResponse struct {
+	Data   interface{}     `json:"data,omitempty"`
+	Errors []*graphQLError `json:"errors,omitempty"`
+}
+
+// graphQL serves GraphQL requests, as a POST with a JSON body or a GET
+// with query parameters (for queries only, so they can be cached). Errors
+// in the request itself, like a syntax error, are 400 Bad Request with no
+// data; errors resolving fields (a validation error in addAlbum, say) are
+// reported in "errors" with a 200 OK, as GraphQL clients expect.
+func (s *Server) graphQL(w http.ResponseWriter, r *http.Request) {
+	var request graphQLRequest
+	if r.Method == "GET" || r.Method == "HEAD" {
+		query := r.URL.Query()
+		request.Query = query.Get("query")
+		request.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			err := json.Unmarshal([]byte(variables), &request.Variables)
+			if err != nil {
+				s.writeError(w, r, apierr.MalformedJSON(err))
+				return
+			}
+		}
+	} else if !s.readJSON(w, r, &request) {
+		return
+	}
+
+	requestError := func(status int, err error) {
+		gqlErr, ok := err.(*graphQLError)
+		if !ok {
+			gqlErr = &graphQLError{Message: err.Error()}
+		}
+		s.writeJSON(w, r, status, graphQLResponse{Errors: []*graphQLError{gqlErr}})
+	}
+	switch {
+	case request.Query == "":
+		requestError(http.StatusBadRequest, errors.New("Must provide query string."))
+		return
+	case len(request.Query) > maxGraphQLQueryLen:
+		requestError(http.StatusBadRequest, fmt.Errorf("Query must be at most %d characters.", maxGraphQLQueryLen))
+		return
+	}
+	operations, err := parseGraphQL(request.Query)
+	if err != nil {
+		requestError(http.StatusBadRequest, err)
+		return
+	}
+	var operation *graphQLOperation
+	for _, op := range operations {
+		if request.OperationName == "" && len(operations) == 1 || op.name == request.OperationName {
+			operation = op
+			break
+		}
+	}
+	if operation == nil {
+		if request.OperationName == "" {
+			err = errors.New("Must provide operation name if query contains multiple operations.")
+		} else {
+			err = fmt.Errorf("Unknown operation named %q.", request.OperationName)
+		}
+		requestError(http.StatusBadRequest, err)
+		return
+	}
+	if operation.kind == "mutation" && r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		requestError(http.StatusMethodNotAllowed, errors.New("Can only perform a mutation operation from a POST request."))
+		return
+	}
+
+	e := &graphQLExecutor{s: s, r: r, query: request.Query}
+	err = e.coerceVariables(operation, request.Variables)
+	if err == nil {
+		rootType := "Query"
+		if operation.kind == "mutation" {
+			rootType = "Mutation"
+		}
+		err = e.validate(rootType, operation.selections)
+	}
+	if err != nil {
+		requestError(http.StatusBadRequest, err)
+		return
+	}
+
+	response := graphQLResponse{Data: json.RawMessage("null")}
+	if data := e.execute(operation); data != nil {
+		response.Data = data
+	}
+	response.Errors = e.errors
+	s.writeJSON(w, r, http.StatusOK, response)
+}
+
+// getGraphQLSchema serves the GraphQL schema as SDL, for client tooling.
+func (s *Server) getGraphQLSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := w.Write([]byte(graphQLSDL()))
+	if err != nil {
+		s.log.Printf("error writing response: %v", err)
+	}
+}
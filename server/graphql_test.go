@@ -0,0 +1,270 @@
+// Tests for the GraphQL endpoint
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// postGraphQL posts a GraphQL request and checks the response status.
+func postGraphQL(t *testing.T, server *Server, query string, variables map[string]interface{}, status int) *http.Response {
+	t.Helper()
+	body, err := json.Marshal(graphQLRequest{Query: query, Variables: variables})
+	if err != nil {
+		t.Fatalf("error marshaling request: %v", err)
+	}
+	result := serve(t, server, newRequest(t, "POST", "/graphql", bytes.NewReader(body)))
+	ensureStatus(t, result, status)
+	return result
+}
+
+// ensureGraphQL checks that a GraphQL response body is the JSON in want,
+// including the order of object keys.
+func ensureGraphQL(t *testing.T, response *http.Response, want string) {
+	t.Helper()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	var got, wantCompact bytes.Buffer
+	if err := json.Compact(&got, body); err != nil {
+		t.Fatalf("error compacting response: %v", err)
+	}
+	if err := json.Compact(&wantCompact, []byte(want)); err != nil {
+		t.Fatalf("error compacting want: %v", err)
+	}
+	if got.String() != wantCompact.String() {
+		t.Fatalf("got vs want:\n%s\n%s", got.String(), wantCompact.String())
+	}
+}
+
+func TestGraphQLQuery(t *testing.T) {
+	server := newTestServer()
+	server.db.AddAlbum(Album{
+		ID: "a3", Title: "Abbey Road", Artist: "The Beatles", Price: 1500,
+		Tracks: []Track{{Number: 1, Title: "Come Together", Duration: 259}, {Number: 2, Title: "Something", Duration: 182}},
+	})
+
+	result := postGraphQL(t, server, `
+		# Fields come back in the order they're selected
+		query Albums {
+			albums(q: "artist ~ \"beatles\"") { title id }
+			abbey: album(id: "a3") { __typename artist tracks { number title } }
+			missing: album(id: "x") { id }
+		}`, nil, http.StatusOK)
+	ensureGraphQL(t, result, `{"data": {
+		"albums": [{"title": "Hey Jude", "id": "a2"}, {"title": "Abbey Road", "id": "a3"}],
+		"abbey": {"__typename": "Album", "artist": "The Beatles", "tracks": [
+			{"number": 1, "title": "Come Together"}, {"number": 2, "title": "Something"}
+		]},
+		"missing": null
+	}}`)
+}
+
+func TestGraphQLPagination(t *testing.T) {
+	server := newTestServer()
+	server.db.AddAlbum(Album{ID: "a3", Title: "Abbey Road", Artist: "The Beatles", Price: 1500})
+
+	query := `query Page($first: Int = 2, $offset: Int) { albums(first: $first, offset: $offset) { id } }`
+	tests := []struct {
+		variables map[string]interface{}
+		want      string
+	}{
+		{nil, `{"data": {"albums": [{"id": "a1"}, {"id": "a2"}]}}`},
+		{map[string]interface{}{"offset": 1}, `{"data": {"albums": [{"id": "a2"}, {"id": "a3"}]}}`},
+		{map[string]interface{}{"first": 10, "offset": 2}, `{"data": {"albums": [{"id": "a3"}]}}`},
+		{map[string]interface{}{"first": 0}, `{"data": {"albums": []}}`},
+		{map[string]interface{}{"offset": 5}, `{"data": {"albums": []}}`},
+	}
+	for _, test := range tests {
+		result := postGraphQL(t, server, query, test.variables, http.StatusOK)
+		ensureGraphQL(t, result, test.want)
+	}
+
+	// The list can't be null, so an error in it nulls the whole data
+	result := postGraphQL(t, server, query, map[string]interface{}{"first": -1}, http.StatusOK)
+	ensureGraphQL(t, result, `{
+		"data": null,
+		"errors": [{
+			"message": "Validation failed",
+			"locations": [{"line": 1, "column": 45}],
+			"path": ["albums"],
+			"extensions": {"code": "validation", "data": {"first": {"error": "out-of-range", "message": "first must not be negative"}}}
+		}]
+	}`)
+}
+
+func TestGraphQLGet(t *testing.T) {
+	server := newTestServer()
+	query := url.Values{
+		"query":     {`query ($id: ID!) { album(id: $id) { title price } }`},
+		"variables": {`{"id": "a1"}`},
+	}
+	result := serve(t, server, newRequest(t, "GET", "/graphql?"+query.Encode(), nil))
+	ensureStatus(t, result, http.StatusOK)
+	ensureGraphQL(t, result, `{"data": {"album": {"title": "9th Symphony", "price": 795}}}`)
+
+	// Mutations need a POST
+	query = url.Values{"query": {`mutation { addAlbum(input: {title: "x", artist: "y"}) { id } }`}}
+	result = serve(t, server, newRequest(t, "GET", "/graphql?"+query.Encode(), nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+	if got := result.Header.Get("Allow"); got != "POST" {
+		t.Fatalf("bad Allow header: got %q", got)
+	}
+	if _, err := server.db.GetAlbumByID("x"); err == nil {
+		t.Fatalf("album was added")
+	}
+}
+
+func TestGraphQLAddAlbum(t *testing.T) {
+	server := newTestServer()
+	query := `mutation Add($input: AlbumInput!) { addAlbum(input: $input) { id title version tracks { title } } }`
+	input := map[string]interface{}{
+		"id":     "a3",
+		"title":  "Abbey Road",
+		"artist": "The Beatles",
+		"price":  1500,
+		"tracks": []interface{}{map[string]interface{}{"number": 1, "title": "Come Together", "duration": 259}},
+	}
+	result := postGraphQL(t, server, query, map[string]interface{}{"input": input}, http.StatusOK)
+	ensureGraphQL(t, result, `{"data": {"addAlbum": {"id": "a3", "title": "Abbey Road", "version": 1, "tracks": [{"title": "Come Together"}]}}}`)
+	album, err := server.db.GetAlbumByID("a3")
+	if err != nil {
+		t.Fatalf("error fetching album: %v", err)
+	}
+	if album.Price != 1500 || len(album.Tracks) != 1 {
+		t.Fatalf("bad stored album: %#v", album)
+	}
+
+	// Adding it again fails like the REST API, with the same error code
+	result = postGraphQL(t, server, query, map[string]interface{}{"input": input}, http.StatusOK)
+	ensureGraphQL(t, result, `{
+		"data": {"addAlbum": null},
+		"errors": [{"message": "Resource already exists", "locations": [{"line": 1, "column": 37}], "path": ["addAlbum"], "extensions": {"code": "already-exists"}}]
+	}`)
+
+	// Validation issues are in the error's extensions
+	result = postGraphQL(t, server, `mutation { addAlbum(input: {title: "", artist: "y", price: 100000, publishAt: "soon"}) { id } }`, nil, http.StatusOK)
+	var response struct {
+		Data   map[string]interface{}
+		Errors []graphQLError
+	}
+	unmarshalResponse(t, result, &response)
+	if len(response.Errors) != 1 || response.Errors[0].Extensions["code"] != "validation" {
+		t.Fatalf("bad errors: %#v", response.Errors)
+	}
+	wantData := map[string]interface{}{
+		"publish_at": map[string]interface{}{"error": "invalid", "message": "publishAt must be an RFC 3339 time, like 2021-06-01T12:00:00Z"},
+	}
+	if got := response.Errors[0].Extensions["data"]; !reflect.DeepEqual(got, wantData) {
+		t.Fatalf("bad error data: got %v, want %v", got, wantData)
+	}
+	result = postGraphQL(t, server, `mutation { addAlbum(input: {title: "", artist: "y", price: 100000}) { id } }`, nil, http.StatusOK)
+	unmarshalResponse(t, result, &response)
+	wantData = map[string]interface{}{
+		"title": map[string]interface{}{"error": "required"},
+		"price": map[string]interface{}{"error": "out-of-range", "message": "price must be between 0 and $1000"},
+	}
+	if got := response.Errors[0].Extensions["data"]; !reflect.DeepEqual(got, wantData) {
+		t.Fatalf("bad error data: got %v, want %v", got, wantData)
+	}
+}
+
+func TestGraphQLRequestErrors(t *testing.T) {
+	server := newTestServer()
+	tests := []struct {
+		query   string
+		message string
+		line    int
+		column  int
+	}{
+		{`{ albums { id }`, `Syntax Error: Unexpected <EOF>.`, 1, 16},
+		{"{\n  albums { colour }\n}", `Cannot query field "colour" on type "Album".`, 2, 12},
+		{`{ album { id } }`, `Field "album" argument "id" of type "ID!" is required, but it was not provided.`, 1, 3},
+		{`{ album(id: "a1", x: 1) { id } }`, `Unknown argument "x" on field "Query.album".`, 1, 19},
+		{`{ albums(first: "2") { id } }`, `Argument "first" has invalid value: Int cannot represent non-integer value "2"`, 1, 10},
+		{`{ albums }`, `Field "albums" of type "[Album!]!" must have a selection of subfields.`, 1, 3},
+		{`{ albums { id { x } } }`, `Field "id" must not have a selection since type "ID!" has no subfields.`, 1, 12},
+		{`{ albums { ...AlbumFields } }`, `Fragments aren't supported.`, 1, 12},
+		{`query ($id: ID!) { album(id: $id) { id } }`, `Variable "$id" of required type "ID!" was not provided.`, 1, 8},
+		{`query ($n: String) { albums(first: $n) { id } }`, `Argument "first" has invalid value: variable "$n" of type "String" used in position expecting type "Int"`, 1, 29},
+		{`mutation { addAlbum(input: {title: "x", artist: "y", colour: "red"}) { id } }`, `Argument "input" has invalid value: field "colour" is not defined by type "AlbumInput"`, 1, 21},
+		{`query A { albums { id } } query B { albums { id } }`, "Must provide operation name if query contains multiple operations.", 0, 0},
+		{"", "Must provide query string.", 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			result := postGraphQL(t, server, test.query, nil, http.StatusBadRequest)
+			var response map[string]interface{}
+			unmarshalResponse(t, result, &response)
+			if _, ok := response["data"]; ok {
+				t.Fatalf("unexpected data in response: %v", response)
+			}
+			want := map[string]interface{}{"message": test.message}
+			if test.line > 0 {
+				want["locations"] = []interface{}{map[string]interface{}{"line": float64(test.line), "column": float64(test.column)}}
+			}
+			if got := response["errors"]; !reflect.DeepEqual(got, []interface{}{want}) {
+				t.Fatalf("got errors %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestGraphQLHiddenFields(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithFieldPolicy(FieldPolicy{"price": RoleAdmin}),
+	)
+	result := postGraphQL(t, server, `{ album(id: "a1") { title price } }`, nil, http.StatusOK)
+	ensureGraphQL(t, result, `{"data": {"album": {"title": "9th Symphony", "price": null}}}`)
+
+	// And public callers can't filter on them either
+	result = postGraphQL(t, server, `{ albums(q: "price > 700") { id } }`, nil, http.StatusOK)
+	var response struct {
+		Errors []graphQLError
+	}
+	unmarshalResponse(t, result, &response)
+	want := map[string]interface{}{"q": map[string]interface{}{"error": "invalid", "message": `unknown field "price"`}}
+	if len(response.Errors) != 1 || !reflect.DeepEqual(response.Errors[0].Extensions["data"], want) {
+		t.Fatalf("bad errors: %#v", response.Errors)
+	}
+}
+
+func TestGraphQLSchema(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/graphql/schema", nil))
+	ensureStatus(t, result, http.StatusOK)
+	body, err := io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %v", err)
+	}
+	for _, want := range []string{
+		"type Query {\n  album(id: ID!): Album\n  albums(first: Int, genre: String, offset: Int, q: String): [Album!]!\n}",
+		"type Mutation {\n  addAlbum(input: AlbumInput!): Album\n}",
+		"  createdAt: String!\n",
+		"input TrackInput {\n  duration: Int!\n  isrc: String\n  musicbrainzId: String\n  number: Int!\n  title: String!\n}",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("schema doesn't contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestJSONFieldName(t *testing.T) {
+	for name, want := range map[string]string{"id": "id", "createdAt": "created_at", "catalogNumber": "catalog_number"} {
+		if got := jsonFieldName(name); got != want {
+			t.Errorf("jsonFieldName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
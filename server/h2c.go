@@ -0,0 +1,14 @@
+// HTTP/2 without TLS (h2c), for proxies and meshes that speak it
+//
+// With -h2c, the listener accepts HTTP/2 connections with "prior
+// knowledge" (the client starts speaking HTTP/2 straight away, as gRPC
+// clients and proxies like Envoy do) as well as HTTP/1. Only use it behind
+// a proxy or inside a mesh that handles TLS, as there's no encryption. The
+// h2c upgrade from HTTP/1.1 (the Upgrade: h2c header) isn't supported, nor
+// are WebSockets over HTTP/2, so WebSocket clients must use HTTP/1.1.
+//
+// This uses net/http's own support for unencrypted HTTP/2, rather than
+// golang.org/x/net/http2/h2c, to keep the server free of dependencies. That
+// was added in Go 1.24, so a server built with an older Go refuses -h2c.
+
+package server
@@ -0,0 +1,16 @@
+//go:build go1.24
+
+// HTTP/2 without TLS, with net/http's support for it
+
+package server
+
+import "net/http"
+
+// enableH2C makes server accept unencrypted HTTP/2 as well as HTTP/1.
+func enableH2C(server *http.Server) error {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server.Protocols = &protocols
+	return nil
+}
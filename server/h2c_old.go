@@ -0,0 +1,15 @@
+//go:build !go1.24
+
+// HTTP/2 without TLS isn't supported by net/http before Go 1.24
+
+package server
+
+import (
+	"errors"
+	"net/http"
+)
+
+// enableH2C returns an error, as net/http can't serve unencrypted HTTP/2.
+func enableH2C(server *http.Server) error {
+	return errors.New("h2c needs the server to be built with Go 1.24 or later")
+}
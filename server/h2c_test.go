@@ -0,0 +1,46 @@
+//go:build go1.24
+
+// Tests for HTTP/2 without TLS
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestH2C(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	err := enableH2C(server.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	get := func(protocols *http.Protocols) string {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+		response, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.Header.Get("X-Proto")
+	}
+
+	// Clients with prior knowledge get HTTP/2, and others still get HTTP/1
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	if got := get(&h2c); got != "HTTP/2.0" {
+		t.Fatalf("got %s with h2c client, want HTTP/2.0", got)
+	}
+	var http1 http.Protocols
+	http1.SetHTTP1(true)
+	if got := get(&http1); got != "HTTP/1.1" {
+		t.Fatalf("got %s with HTTP/1 client, want HTTP/1.1", got)
+	}
+}
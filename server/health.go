@@ -0,0 +1,94 @@
+// Database availability checks and readiness endpoint
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// AvailabilityChecker is an optional interface a Database can implement to
+// report whether it can currently serve reads and writes. For example, a
+// database whose replica was promoted or whose disk is full may still
+// serve reads, but not writes.
+type AvailabilityChecker interface {
+	// CheckAvailability returns a nil readErr if reads are available and a
+	// nil writeErr if writes are available, otherwise errors describing
+	// why they're not.
+	CheckAvailability() (readErr, writeErr error)
+}
+
+// availabilityHandler rejects requests with 503 Service Unavailable when the
+// database can't serve them: reads (GET, HEAD, and OPTIONS) when reads are
+// down, and all other methods when writes are down. The readiness endpoint
+// is always passed through so it can report the details.
+func (s *Server) availabilityHandler(h http.Handler, checker AvailabilityChecker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/readyz" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		readErr, writeErr := checker.CheckAvailability()
+		var err error
+		if isSafeMethod(r.Method) {
+			err = readErr
+		} else {
+			err = writeErr
+		}
+		if err != nil {
+			data := map[string]interface{}{"message": err.Error()}
+			s.writeError(w, r, apierr.Unavailable(err).WithData(data))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type readyzResponse struct {
+	Status string `json:"status"` // "ready", "degraded", or "unavailable"
+	Read   string `json:"read"`   // "ok" or error message
+	Write  string `json:"write"`  // "ok" or error message
+}
+
+// getReadyz reports whether the server is ready for traffic. If reads are
+// available but writes aren't, it reports "degraded" with a 200 status
+// (so load balancers keep sending us reads); if reads aren't available,
+// it reports "unavailable" with a 503. Read-only and maintenance modes
+// are reported the same way.
+func (s *Server) getReadyz(w http.ResponseWriter, r *http.Request) {
+	var readErr, writeErr error
+	if checker, ok := s.db.(AvailabilityChecker); ok {
+		readErr, writeErr = checker.CheckAvailability()
+	}
+	switch s.mode.get().Mode {
+	case ModeMaintenance:
+		readErr = errMaintenanceMode
+		writeErr = errMaintenanceMode
+	case ModeReadOnly:
+		if writeErr == nil {
+			writeErr = errReadOnlyMode
+		}
+	}
+	response := readyzResponse{
+		Status: "ready",
+		Read:   availabilityString(readErr),
+		Write:  availabilityString(writeErr),
+	}
+	status := http.StatusOK
+	switch {
+	case readErr != nil:
+		response.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	case writeErr != nil:
+		response.Status = "degraded"
+	}
+	s.writeJSON(w, r, status, response)
+}
+
+func availabilityString(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
@@ -0,0 +1,121 @@
+// Tests for database availability checks and readiness endpoint
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	db := &partialDatabase{MemoryDatabase: NewMemoryDatabase()}
+	server := NewServer(db, log.New(io.Discard, "", 0))
+
+	tests := []struct {
+		readErr  error
+		writeErr error
+		status   int
+		want     readyzResponse
+	}{
+		{nil, nil, http.StatusOK, readyzResponse{"ready", "ok", "ok"}},
+		{nil, errors.New("disk full"), http.StatusOK, readyzResponse{"degraded", "ok", "disk full"}},
+		{errors.New("down"), errors.New("down"), http.StatusServiceUnavailable, readyzResponse{"unavailable", "down", "down"}},
+	}
+	for _, test := range tests {
+		t.Run(test.want.Status, func(t *testing.T) {
+			db.set(test.readErr, test.writeErr)
+			result := serve(t, server, newRequest(t, "GET", "/readyz", nil))
+			ensureStatus(t, result, test.status)
+			var got readyzResponse
+			unmarshalResponse(t, result, &got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("bad response: got vs want:\n%#v\n%#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadyzNoChecker(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/readyz", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var got readyzResponse
+	unmarshalResponse(t, result, &got)
+	want := readyzResponse{"ready", "ok", "ok"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad response: got vs want:\n%#v\n%#v", got, want)
+	}
+}
+
+func TestWritesUnavailable(t *testing.T) {
+	db := &partialDatabase{MemoryDatabase: NewMemoryDatabase()}
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	db.set(nil, errors.New("replica is read-only"))
+	server := NewServer(db, log.New(io.Discard, "", 0))
+
+	want := testAlbum{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795}
+	testGetAlbum(t, server, getAlbumTest{"/albums/a1", http.StatusOK, want})
+
+	body := `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel"}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusServiceUnavailable)
+	data := map[string]interface{}{"message": "replica is read-only"}
+	ensureError(t, result, http.StatusServiceUnavailable, "unavailable", data)
+}
+
+func TestReadsUnavailable(t *testing.T) {
+	db := &partialDatabase{MemoryDatabase: NewMemoryDatabase()}
+	db.set(errors.New("down"), errors.New("down"))
+	server := NewServer(db, log.New(io.Discard, "", 0))
+
+	result := serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusServiceUnavailable)
+	ensureError(t, result, http.StatusServiceUnavailable, "unavailable", map[string]interface{}{"message": "down"})
+}
+
+func TestAddAlbumUnavailableError(t *testing.T) {
+	db := &partialDatabase{MemoryDatabase: NewMemoryDatabase(), addErr: fmt.Errorf("writing: %w", ErrUnavailable)}
+	server := NewServer(db, log.New(io.Discard, "", 0))
+
+	body := `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel"}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusServiceUnavailable)
+	ensureError(t, result, http.StatusServiceUnavailable, "unavailable", nil)
+}
+
+// partialDatabase is a MemoryDatabase whose read and write availability can
+// be controlled by the test.
+type partialDatabase struct {
+	*MemoryDatabase
+	addErr error
+
+	mu       sync.Mutex
+	readErr  error
+	writeErr error
+}
+
+func (d *partialDatabase) set(readErr, writeErr error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.readErr, d.writeErr = readErr, writeErr
+}
+
+func (d *partialDatabase) CheckAvailability() (error, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.readErr, d.writeErr
+}
+
+func (d *partialDatabase) AddAlbum(album Album) (Album, error) {
+	if d.addErr != nil {
+		return Album{}, d.addErr
+	}
+	return d.MemoryDatabase.AddAlbum(album)
+}
@@ -0,0 +1,138 @@
+// Album version history and point-in-time reads
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// getAlbumVersions lists the kept versions of an album, oldest first. A
+// client can undo a bad edit by PUTting an earlier version back.
+func (s *Server) getAlbumVersions(w http.ResponseWriter, r *http.Request, id string) {
+	includeDeleted, ok := s.includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	versions, err := s.db.GetAlbumVersions(id)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("fetching versions of album ID %q: %w", id, err)))
+		return
+	}
+	current := versions[len(versions)-1]
+	if !current.published(s.now()) || current.DeletedAt != nil && !includeDeleted {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	s.writeJSONWithETag(w, r, s.redactAlbums(r, versions))
+}
+
+// pointInTime identifies an earlier state of an album, either by time or
+// by revision (album version). The zero value means the current state.
+type pointInTime struct {
+	at      time.Time
+	version int
+}
+
+func (p pointInTime) isZero() bool {
+	return p.at.IsZero() && p.version == 0
+}
+
+// asOfParam parses the optional "as_of" query parameter for point-in-time
+// reads, which is either an RFC 3339 timestamp or a revision number (the
+// album's version). The older "at" parameter is also accepted, but only
+// takes a timestamp. It writes an error response and returns false for ok
+// if the parameters are invalid.
+func (s *Server) asOfParam(w http.ResponseWriter, r *http.Request) (p pointInTime, ok bool) {
+	query := r.URL.Query()
+	issues := make(map[string]interface{})
+	p.at = timeParam(query.Get("at"), "at", issues)
+	if asOf := query.Get("as_of"); asOf != "" {
+		_, err := strconv.Atoi(asOf)
+		switch {
+		case query.Get("at") != "":
+			issues["as_of"] = validationIssue{"conflict", "as_of and at can't both be given"}
+		case err == nil:
+			p.version = intParam(asOf, 0, 1, math.MaxInt32, "as_of", issues)
+		default:
+			p.at, _ = time.Parse(time.RFC3339, asOf)
+			if p.at.IsZero() {
+				issues["as_of"] = validationIssue{"invalid", "as_of must be an RFC 3339 time, like 2021-06-01T12:00:00Z, or a revision number"}
+			}
+		}
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return pointInTime{}, false
+	}
+	return p, true
+}
+
+// albumAsOf fetches the state of an album at the given point in time. It
+// returns ErrDoesNotExist if the album didn't exist then, or if that
+// revision never existed or is too old to have been kept.
+func (s *Server) albumAsOf(id string, p pointInTime) (Album, error) {
+	if p.version == 0 {
+		return s.db.GetAlbumAt(id, p.at)
+	}
+	versions, err := s.db.GetAlbumVersions(id)
+	if err != nil {
+		return Album{}, err
+	}
+	album, ok := findVersion(versions, p.version)
+	if !ok {
+		return Album{}, ErrDoesNotExist
+	}
+	return album, nil
+}
+
+func (d *MemoryDatabase) GetAlbumVersions(id string) ([]Album, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	album, ok := d.albums[id]
+	if !ok {
+		return nil, ErrDoesNotExist
+	}
+	history := d.history[id]
+	versions := make([]Album, len(history), len(history)+1)
+	copy(versions, history)
+	return append(versions, album), nil
+}
+
+func (d *MemoryDatabase) GetAlbumAt(id string, at time.Time) (Album, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	album, ok := d.albums[id]
+	if !ok {
+		return Album{}, ErrDoesNotExist
+	}
+	if !album.UpdatedAt.After(at) {
+		return album, nil
+	}
+	history := d.history[id]
+	for i := len(history) - 1; i >= 0; i-- {
+		if !history[i].UpdatedAt.After(at) {
+			return history[i], nil
+		}
+	}
+	return Album{}, ErrDoesNotExist
+}
+
+// saveVersion records old as a prior version of its album, just before
+// it's replaced by a newer version.
+func (d *MemoryDatabase) saveVersion(old Album) {
+	versions := append(d.history[old.ID], old)
+	if d.MaxVersions > 0 && len(versions) > d.MaxVersions {
+		// As with the audit log, discarded versions are freed when append
+		// next reallocates
+		versions = versions[len(versions)-d.MaxVersions:]
+	}
+	d.history[old.ID] = versions
+}
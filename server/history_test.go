@@ -0,0 +1,223 @@
+// Tests for album version history and point-in-time reads
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHistoryTestServer creates a server with album a1 added at 12:00 on
+// 2021-06-01 and changed at 12:01 (retitled) and 12:02 (track added).
+func newHistoryTestServer(t *testing.T) *Server {
+	db := NewMemoryDatabase()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	db.Now = func() time.Time { return now }
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return now }),
+	)
+	requests := []*http.Request{
+		newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a1", "title": "9th Symphony", "artist": "Beethoven"}`)),
+		newRequest(t, "PUT", "/albums/a1", strings.NewReader(`{"title": "Ninth Symphony", "artist": "Beethoven", "version": 1}`)),
+		newRequest(t, "POST", "/albums/a1/tracks", strings.NewReader(`{"title": "Ode to Joy", "duration": 600}`)),
+	}
+	for _, request := range requests {
+		result := serve(t, server, request)
+		if result.StatusCode >= 300 {
+			t.Fatalf("%s %s: got status %d", request.Method, request.URL, result.StatusCode)
+		}
+		now = now.Add(time.Minute)
+	}
+	return server
+}
+
+// versionedAlbum is the subset of album fields the history tests check.
+type versionedAlbum struct {
+	Title     string      `json:"title"`
+	Tracks    []testTrack `json:"tracks"`
+	Version   int         `json:"version"`
+	UpdatedAt string      `json:"updated_at"`
+}
+
+func TestGetAlbumVersions(t *testing.T) {
+	server := newHistoryTestServer(t)
+
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1/versions", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var versions []versionedAlbum
+	unmarshalResponse(t, result, &versions)
+	if len(versions) != 3 {
+		t.Fatalf("got %d versions, want 3", len(versions))
+	}
+	for i, want := range []struct {
+		version   int
+		title     string
+		tracks    int
+		updatedAt string
+	}{
+		{1, "9th Symphony", 0, "2021-06-01T12:00:00Z"},
+		{2, "Ninth Symphony", 0, "2021-06-01T12:01:00Z"},
+		{3, "Ninth Symphony", 1, "2021-06-01T12:02:00Z"},
+	} {
+		v := versions[i]
+		if v.Version != want.version || v.Title != want.title || len(v.Tracks) != want.tracks || v.UpdatedAt != want.updatedAt {
+			t.Fatalf("bad version %d: %+v", i+1, v)
+		}
+	}
+
+	// Undo the retitle by putting the first version back
+	body := `{"title": "9th Symphony", "artist": "Beethoven", "version": 3}`
+	result = serve(t, server, newRequest(t, "PUT", "/albums/a1", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusOK)
+	testGetAlbum(t, server, getAlbumTest{"/albums/a1", http.StatusOK, testAlbum{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"}})
+
+	// Deleted albums' history is hidden too, except from admins
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/versions", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newAdminRequest(t, "GET", "/albums/a1/versions?include_deleted=true", nil))
+	ensureStatus(t, result, http.StatusOK)
+	unmarshalResponse(t, result, &versions)
+	if len(versions) != 5 {
+		t.Fatalf("got %d versions, want 5", len(versions))
+	}
+
+	result = serve(t, server, newRequest(t, "GET", "/albums/a2/versions", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newRequest(t, "POST", "/albums/a1/versions", nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+}
+
+func TestGetAlbumAt(t *testing.T) {
+	server := newHistoryTestServer(t)
+
+	tests := []struct {
+		at          string
+		wantStatus  int
+		wantVersion int
+	}{
+		{"2021-06-01T11:59:59Z", http.StatusNotFound, 0},
+		{"2021-06-01T12:00:00Z", http.StatusOK, 1},
+		{"2021-06-01T12:00:59Z", http.StatusOK, 1},
+		{"2021-06-01T12:01:00Z", http.StatusOK, 2},
+		{"2021-06-01T22:01:30%2B10:00", http.StatusOK, 2}, // same as 12:01:30 UTC
+		{"2021-06-02T00:00:00Z", http.StatusOK, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.at, func(t *testing.T) {
+			result := serve(t, server, newRequest(t, "GET", "/albums/a1?at="+test.at, nil))
+			ensureStatus(t, result, test.wantStatus)
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+			var album versionedAlbum
+			unmarshalResponse(t, result, &album)
+			if album.Version != test.wantVersion {
+				t.Fatalf("got version %d, want %d", album.Version, test.wantVersion)
+			}
+		})
+	}
+
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1?at=yesterday", nil))
+	data := map[string]interface{}{
+		"at": map[string]interface{}{"error": "invalid", "message": "at must be an RFC 3339 time, like 2021-06-01T12:00:00Z"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+
+	// Old versions of deleted albums are hidden
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1?at=2021-06-01T12:00:00Z", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestGetAlbumAsOf(t *testing.T) {
+	server := newHistoryTestServer(t)
+
+	tests := []struct {
+		asOf        string
+		wantStatus  int
+		wantVersion int
+		wantTitle   string
+	}{
+		{"1", http.StatusOK, 1, "9th Symphony"},
+		{"2", http.StatusOK, 2, "Ninth Symphony"},
+		{"3", http.StatusOK, 3, "Ninth Symphony"},
+		{"4", http.StatusNotFound, 0, ""},
+		{"2021-06-01T12:00:30Z", http.StatusOK, 1, "9th Symphony"},
+		{"2021-06-01T12:01:00Z", http.StatusOK, 2, "Ninth Symphony"},
+		{"2021-06-01T11:00:00Z", http.StatusNotFound, 0, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.asOf, func(t *testing.T) {
+			result := serve(t, server, newRequest(t, "GET", "/albums/a1?as_of="+test.asOf, nil))
+			ensureStatus(t, result, test.wantStatus)
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+			var album versionedAlbum
+			unmarshalResponse(t, result, &album)
+			if album.Version != test.wantVersion || album.Title != test.wantTitle {
+				t.Fatalf("got version %d %q, want %d %q", album.Version, album.Title, test.wantVersion, test.wantTitle)
+			}
+		})
+	}
+
+	for _, test := range []struct {
+		query   string
+		field   string
+		code    string
+		message string
+	}{
+		{"as_of=yesterday", "as_of", "invalid", "as_of must be an RFC 3339 time, like 2021-06-01T12:00:00Z, or a revision number"},
+		{"as_of=0", "as_of", "out-of-range", "as_of must be an integer between 1 and 2147483647"},
+		{"as_of=1&at=2021-06-01T12:00:00Z", "as_of", "conflict", "as_of and at can't both be given"},
+	} {
+		result := serve(t, server, newRequest(t, "GET", "/albums/a1?"+test.query, nil))
+		data := map[string]interface{}{
+			test.field: map[string]interface{}{"error": test.code, "message": test.message},
+		}
+		ensureError(t, result, http.StatusBadRequest, "validation", data)
+	}
+
+	// Revisions that are no longer kept are not found
+	db := NewMemoryDatabase()
+	db.MaxVersions = 1
+	mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+	for version := 1; version <= 2; version++ {
+		_, err := db.PutAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"}, version)
+		if err != nil {
+			t.Fatalf("error putting album: %v", err)
+		}
+	}
+	server = NewServer(db, log.New(io.Discard, "", 0))
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1?as_of=1", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1?as_of=2", nil))
+	ensureStatus(t, result, http.StatusOK)
+}
+
+func TestMemoryDatabaseMaxVersions(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.MaxVersions = 2
+	mustAddAlbum(t, db, Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+	for version := 1; version <= 5; version++ {
+		_, err := db.PutAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"}, version)
+		if err != nil {
+			t.Fatalf("error putting album: %v", err)
+		}
+	}
+	versions, err := db.GetAlbumVersions("a1")
+	if err != nil {
+		t.Fatalf("error getting versions: %v", err)
+	}
+	if len(versions) != 3 || versions[0].Version != 4 || versions[2].Version != 6 {
+		t.Fatalf("got %d versions from %d, want 3 from 4", len(versions), versions[0].Version)
+	}
+}
@@ -0,0 +1,244 @@
+// HTML views of albums for browsers, with metadata for link previews and
+// search engines
+
+package server
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// wantsHTML reports whether the request's Accept header prefers HTML to
+// JSON, as a browser's does. Clients that don't say, or that accept both
+// equally (like curl's "*/*"), get JSON.
+func wantsHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return acceptQuality(accept, "text/html") > acceptQuality(accept, "application/json")
+}
+
+// acceptQuality returns the quality value ("q") that the Accept header
+// gives mediaType, using the most specific matching media range as RFC
+// 7231 specifies. It returns 0 if no range matches.
+func acceptQuality(accept, mediaType string) float64 {
+	anySubtype := mediaType[:strings.IndexByte(mediaType, '/')] + "/*"
+	quality, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		var s int
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case mediaType:
+			s = 2
+		case anySubtype:
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				q, err = strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					q = 0
+				}
+			}
+		}
+		quality, specificity = q, s
+	}
+	return quality
+}
+
+var albumTemplate = template.Must(template.New("album").Funcs(template.FuncMap{
+	"duration": formatDuration,
+}).Parse(`<!DOCTYPE html>
+<html lang="{{.Locale}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Album.Title}} by {{.Album.Artist}}</title>
+<meta name="description" content="{{.Description}}">
+<link rel="canonical" href="{{.URL}}">
+<meta property="og:type" content="music.album">
+<meta property="og:title" content="{{.Album.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.URL}}">
+<script type="application/ld+json">{{.JSONLD}}</script>
+</head>
+<body>
+<h1>{{.Album.Title}}</h1>
+<p>{{.Album.Artist}}</p>
+<p>Released {{.Released}}</p>
+{{- if .Price}}
+<p>{{.Price}}</p>
+{{- end}}
+{{- if .Album.Tracks}}
+<ol>
+{{- range .Album.Tracks}}
+<li value="{{.Number}}">{{.Title}} ({{duration .Duration}})</li>
+{{- end}}
+</ol>
+{{- end}}
+</body>
+</html>
+`))
+
+// formatDuration formats a track duration in seconds like "5:38".
+func formatDuration(seconds int) string {
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// musicAlbum is the schema.org MusicAlbum JSON-LD for an album.
+type musicAlbum struct {
+	Context       string           `json:"@context"`
+	Type          string           `json:"@type"`
+	Name          string           `json:"name"`
+	URL           string           `json:"url"`
+	ByArtist      musicGroup       `json:"byArtist"`
+	DatePublished string           `json:"datePublished,omitempty"`
+	Genre         []string         `json:"genre,omitempty"`
+	NumTracks     int              `json:"numTracks"`
+	Track         []musicRecording `json:"track,omitempty"`
+}
+
+type musicGroup struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+type musicRecording struct {
+	Type     string `json:"@type"`
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+	Duration string `json:"duration"` // ISO 8601, like "PT5M38S"
+}
+
+// writeAlbumHTML writes the album as an HTML page with OpenGraph tags and
+// schema.org JSON-LD, so that shared links unfurl with the album details.
+func (s *Server) writeAlbumHTML(w http.ResponseWriter, r *http.Request, album Album) {
+	link := s.publicAlbumURL(r, album.ID)
+	ld := musicAlbum{
+		Context:       "https://schema.org",
+		Type:          "MusicAlbum",
+		Name:          album.Title,
+		URL:           link,
+		ByArtist:      musicGroup{Type: "MusicGroup", Name: album.Artist},
+		DatePublished: albumPublished(album).Format("2006-01-02"),
+		Genre:         album.Genres,
+		NumTracks:     len(album.Tracks),
+	}
+	for _, track := range album.Tracks {
+		ld.Track = append(ld.Track, musicRecording{
+			Type:     "MusicRecording",
+			Name:     track.Title,
+			Position: track.Number,
+			Duration: fmt.Sprintf("PT%dM%dS", track.Duration/60, track.Duration%60),
+		})
+	}
+	// json.Marshal escapes <, >, and &, so this is safe inside <script>
+	jsonLD, err := json.Marshal(ld)
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(err))
+		return
+	}
+
+	description := "Album by " + album.Artist
+	if len(album.Tracks) == 1 {
+		description += ", 1 track"
+	} else if len(album.Tracks) > 1 {
+		description += fmt.Sprintf(", %d tracks", len(album.Tracks))
+	}
+
+	// Prices and dates are formatted for the client's language
+	locale := matchLocale(r.Header.Get("Accept-Language"))
+	price := ""
+	if album.Price != 0 {
+		price = locale.formatPrice(album.Price)
+	}
+
+	var buf bytes.Buffer
+	err = albumTemplate.Execute(&buf, map[string]interface{}{
+		"Album":       album,
+		"Description": description,
+		"URL":         link,
+		"JSONLD":      template.JS(jsonLD),
+		"Locale":      locale.tag,
+		"Price":       price,
+		"Released":    locale.formatDate(albumPublished(album)),
+	})
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("rendering album HTML: %w", err)))
+		return
+	}
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", locale.tag)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		s.log.Printf("error writing HTML: %v", err)
+	}
+}
+
+//go:embed templates/albums.html
+var albumListHTML string
+
+var albumListTemplate = template.Must(template.New("albums").Parse(albumListHTML))
+
+// albumListRow is an album as listed in the HTML table of albums.
+type albumListRow struct {
+	Title    string
+	Artist   string
+	URL      string
+	Released string
+	Tracks   int
+	Price    string
+}
+
+// writeAlbumsHTML writes the albums as an HTML table, so that visitors
+// with a browser can read the list. Each title links to the album's own
+// HTML page.
+func (s *Server) writeAlbumsHTML(w http.ResponseWriter, r *http.Request, albums []Album) {
+	locale := matchLocale(r.Header.Get("Accept-Language"))
+	rows := make([]albumListRow, len(albums))
+	for i, album := range albums {
+		rows[i] = albumListRow{
+			Title:    album.Title,
+			Artist:   album.Artist,
+			URL:      s.albumURL(r, album.ID),
+			Released: locale.formatDate(albumPublished(album)),
+			Tracks:   len(album.Tracks),
+		}
+		if album.Price != 0 {
+			rows[i].Price = locale.formatPrice(album.Price)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := albumListTemplate.Execute(&buf, map[string]interface{}{
+		"Albums": rows,
+		"Locale": locale.tag,
+	})
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("rendering albums HTML: %w", err)))
+		return
+	}
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", locale.tag)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		s.log.Printf("error writing HTML: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Tests for the HTML view of albums
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+func TestGetAlbumHTML(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.Now = func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }
+	db.AddGenre(Genre{ID: "classical", Name: "Classical"})
+	db.AddAlbum(Album{ID: "a1", Title: "9th </script> Symphony", Artist: "Beethoven & Co", Genres: []string{"classical"}})
+	db.AddTrack("a1", Track{Title: "Ode to Joy", Duration: 338})
+	server := NewServer(db, log.New(io.Discard, "", 0), WithPublicURLTemplate("https://shop.example.com/catalog/{id}"))
+
+	request := newRequest(t, "GET", "/albums/a1", nil)
+	request.Header.Set("Accept", browserAccept)
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Fatalf("bad Content-Type: got %q", got)
+	}
+	if got := result.Header.Get("Vary"); got != "Accept" {
+		t.Fatalf("bad Vary header: got %q, want %q", got, "Accept")
+	}
+	b, err := io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	page := string(b)
+
+	for _, want := range []string{
+		`<title>9th &lt;/script&gt; Symphony by Beethoven &amp; Co</title>`,
+		`<meta property="og:type" content="music.album">`,
+		`<meta property="og:title" content="9th &lt;/script&gt; Symphony">`,
+		`<meta property="og:description" content="Album by Beethoven &amp; Co, 1 track">`,
+		`<meta property="og:url" content="https://shop.example.com/catalog/a1">`,
+		`<html lang="en-US">`,
+		`<p>Released June 1, 2021</p>`,
+		`<li value="1">Ode to Joy (5:38)</li>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Fatalf("page doesn't contain %s:\n%s", want, page)
+		}
+	}
+
+	// The JSON-LD must be parseable, and the title mustn't end the script
+	match := regexp.MustCompile(`(?s)<script type="application/ld\+json">(.*?)</script>`).FindStringSubmatch(page)
+	if match == nil {
+		t.Fatalf("no JSON-LD in page:\n%s", page)
+	}
+	var got map[string]interface{}
+	err = json.Unmarshal([]byte(match[1]), &got)
+	if err != nil {
+		t.Fatalf("error unmarshaling JSON-LD: %v\n%s", err, match[1])
+	}
+	want := map[string]interface{}{
+		"@context":      "https://schema.org",
+		"@type":         "MusicAlbum",
+		"name":          "9th </script> Symphony",
+		"url":           "https://shop.example.com/catalog/a1",
+		"byArtist":      map[string]interface{}{"@type": "MusicGroup", "name": "Beethoven & Co"},
+		"datePublished": "2021-06-01",
+		"genre":         []interface{}{"classical"},
+		"numTracks":     1.0,
+		"track": []interface{}{
+			map[string]interface{}{"@type": "MusicRecording", "name": "Ode to Joy", "position": 1.0, "duration": "PT5M38S"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad JSON-LD: got vs want:\n%#v\n%#v", got, want)
+	}
+
+	// API clients still get JSON
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var album testAlbum
+	unmarshalResponse(t, result, &album)
+
+	// Hidden albums are hidden in HTML too
+	request = newRequest(t, "GET", "/albums/a2", nil)
+	request.Header.Set("Accept", browserAccept)
+	result = serve(t, server, request)
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestGetAlbumsHTML(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.Now = func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }
+	db.AddAlbum(Album{ID: "a1", Title: "9th <Symphony>", Artist: "Beethoven", Price: 795})
+	db.AddTrack("a1", Track{Title: "Ode to Joy", Duration: 338})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000})
+	server := NewServer(db, log.New(io.Discard, "", 0))
+
+	request := newRequest(t, "GET", "/v1/albums", nil)
+	request.Header.Set("Accept", browserAccept)
+	request.Header.Set("Accept-Language", "de")
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Fatalf("bad Content-Type: got %q", got)
+	}
+	if got := result.Header.Values("Vary"); !reflect.DeepEqual(got, []string{"Accept", "Accept-Language"}) {
+		t.Fatalf("bad Vary headers: got %q", got)
+	}
+	b, err := io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	page := string(b)
+	for _, want := range []string{
+		`<html lang="de-DE">`,
+		`<td><a href="/v1/albums/a1">9th &lt;Symphony&gt;</a></td>`,
+		`<td class="number">1</td>`,
+		`<td><a href="/v1/albums/a2">Hey Jude</a></td>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Fatalf("page doesn't contain %s:\n%s", want, page)
+		}
+	}
+
+	// API clients still get JSON
+	result = serve(t, server, newRequest(t, "GET", "/v1/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var albums []testAlbum
+	unmarshalResponse(t, result, &albums)
+	if len(albums) != 2 {
+		t.Fatalf("got %d albums, want 2", len(albums))
+	}
+}
+
+func TestWantsHTML(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", false},
+		{"text/html", true},
+		{browserAccept, true},
+		{"text/*", true},
+		{"text/html;q=0.5, application/json", false},
+		{"application/json;q=0.5, text/html", true},
+		{"text/html;q=0, */*", false},
+		{"TEXT/HTML", true},
+	}
+	for _, test := range tests {
+		t.Run(test.accept, func(t *testing.T) {
+			request := newRequest(t, "GET", "/albums/a1", nil)
+			request.Header.Set("Accept", test.accept)
+			if got := wantsHTML(request); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
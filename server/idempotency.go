@@ -0,0 +1,74 @@
+// Idempotency-Key support for POST requests
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Maximum length of an Idempotency-Key header.
+const maxIdempotencyKeyLen = 255
+
+// WithIdempotencyTTL enables support for the Idempotency-Key header on
+// POST requests. When a client retries a POST with the same key and the
+// same request within ttl, the original response is replayed (with an
+// "Idempotent-Replayed: true" header) rather than performing the action
+// again, so a retried create returns 201 instead of 409 already-exists.
+// Reusing a key for a different request is a 422 error. The default of
+// zero disables support (the header is ignored).
+func WithIdempotencyTTL(ttl time.Duration) Option {
+	return func(s *Server) {
+		s.idempotencyTTL = ttl
+	}
+}
+
+// idempotencyHandler replays the original response to POST requests with
+// an Idempotency-Key header that was used within the TTL. If the original
+// request is still in progress, the retry waits for it to finish.
+func (s *Server) idempotencyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != "POST" || key == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			issues := map[string]interface{}{
+				"Idempotency-Key": validationIssue{"invalid", fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLen)},
+			}
+			s.writeError(w, r, apierr.Validation(issues))
+			return
+		}
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+
+		fingerprint := requestFingerprint(r, body)
+		original, isRetry := s.idempotency.start(s.tenantReplayScope(r)+key, fingerprint, s.now())
+		if isRetry {
+			if original.fingerprint != fingerprint {
+				s.writeError(w, r, apierr.IdempotencyKeyReused())
+				return
+			}
+			s.replay(w, r, original, "Idempotent-Replayed", "true")
+			return
+		}
+		s.serveAndRecord(w, r, h, s.idempotency, key, original)
+	})
+}
+
+// requestFingerprint returns a hash of the request's method, URL, and
+// body, to check that a retry is the same request as the original.
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n", r.Method, r.URL.RequestURI())
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,95 @@
+// Tests for Idempotency-Key support
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithIdempotencyTTL(time.Hour),
+		WithIDGenerator(&SequentialIDGenerator{}),
+		WithClock(func() time.Time { return now }),
+	)
+	defer server.Close()
+	post := func(key, body string) *http.Response {
+		request := newRequest(t, "POST", "/albums", strings.NewReader(body))
+		if key != "" {
+			request.Header.Set("Idempotency-Key", key)
+		}
+		return serve(t, server, request)
+	}
+	body := `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel"}`
+
+	result := post("k1", body)
+	ensureStatus(t, result, http.StatusCreated)
+	ensureReplayed(t, result, false)
+
+	// A retry with the same key gets the original 201, not a 409
+	now = now.Add(59 * time.Minute)
+	result = post("k1", body)
+	ensureStatus(t, result, http.StatusCreated)
+	ensureReplayed(t, result, true)
+	if location := result.Header.Get("Location"); location != "/albums/a9" {
+		t.Fatalf("bad Location header: got %q, want %q", location, "/albums/a9")
+	}
+
+	// Reusing the key for a different request is an error
+	result = post("k1", `{"id": "a8", "title": "Pianoman", "artist": "Billy Joel"}`)
+	ensureStatus(t, result, http.StatusUnprocessableEntity)
+	ensureError(t, result, http.StatusUnprocessableEntity, "idempotency-key-reused", nil)
+
+	// Without a key, or with a new key, the request is handled as usual
+	result = post("", body)
+	ensureStatus(t, result, http.StatusConflict)
+	ensureError(t, result, http.StatusConflict, "already-exists", nil)
+	result = post("k2", body)
+	ensureStatus(t, result, http.StatusConflict)
+	ensureReplayed(t, result, false)
+
+	// Once the TTL has passed, the key is forgotten
+	now = now.Add(2 * time.Minute)
+	result = post("k1", body)
+	ensureStatus(t, result, http.StatusConflict)
+	ensureReplayed(t, result, false)
+	ensureAlbumIDs(t, server, []string{"a9"})
+}
+
+func TestIdempotencyKeyTooLong(t *testing.T) {
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithIdempotencyTTL(time.Hour))
+	defer server.Close()
+	request := newRequest(t, "POST", "/albums", strings.NewReader(`{}`))
+	request.Header.Set("Idempotency-Key", strings.Repeat("x", maxIdempotencyKeyLen+1))
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusBadRequest)
+	data := map[string]interface{}{
+		"Idempotency-Key": map[string]interface{}{"error": "invalid", "message": "Idempotency-Key must be at most 255 characters"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+}
+
+func TestIdempotencyKeyDisabled(t *testing.T) {
+	server := newTestServer()
+	for _, status := range []int{http.StatusCreated, http.StatusConflict} {
+		request := newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a9", "title": "Pianoman", "artist": "Billy Joel"}`))
+		request.Header.Set("Idempotency-Key", "k1")
+		result := serve(t, server, request)
+		ensureStatus(t, result, status)
+		ensureReplayed(t, result, false)
+	}
+}
+
+func ensureReplayed(t *testing.T, result *http.Response, replayed bool) {
+	t.Helper()
+	got := result.Header.Get("Idempotent-Replayed")
+	if replayed && got != "true" || !replayed && got != "" {
+		t.Fatalf("bad Idempotent-Replayed header %q, want replayed %v", got, replayed)
+	}
+}
@@ -0,0 +1,329 @@
+// External identifiers: ISRCs, UPCs, and MusicBrainz IDs
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Albums can have a UPC (the number under the barcode, or a 13-digit EAN)
+// and a MusicBrainz release ID, and tracks can have an ISRC and a
+// MusicBrainz recording ID, so the catalog can be matched up with
+// rights-management and metadata systems. ISRCs are stored in their
+// compact uppercase form, like "USS1Z9900001", but can be given with
+// hyphens ("US-S1Z-99-00001"). UPCs must have a valid check digit, and
+// MusicBrainz IDs are lowercase UUIDs.
+//
+// GET /lookup?isrc=, ?upc=, or ?musicbrainz_id= finds the albums with an
+// identifier, along with the matching track for track identifiers.
+// Identifiers needn't be unique by default: the same recording (and so the
+// same ISRC) can be on several albums, like the original and a
+// compilation. WithUniqueIdentifiers makes the given kinds unique: an
+// album or track is then rejected if another album, including a deleted
+// one (which can be restored), already has one of its identifiers. The
+// check is made when the album is validated, by scanning the catalog, so
+// two concurrent requests can still both succeed.
+const (
+	identifierISRC        = "isrc"
+	identifierUPC         = "upc"
+	identifierMusicBrainz = "musicbrainz_id"
+)
+
+// identifierKinds are the kinds of external identifier, in the order
+// they're reported.
+var identifierKinds = []string{identifierISRC, identifierMusicBrainz, identifierUPC}
+
+// WithUniqueIdentifiers makes the given kinds of identifier ("isrc",
+// "upc", or "musicbrainz_id") unique across the catalog. The default is
+// for none of them to be unique.
+func WithUniqueIdentifiers(kinds ...string) Option {
+	return func(s *Server) {
+		if s.uniqueIdentifiers == nil {
+			s.uniqueIdentifiers = make(map[string]bool)
+		}
+		for _, kind := range kinds {
+			s.uniqueIdentifiers[kind] = true
+		}
+	}
+}
+
+// parseUniqueIdentifiers parses the -unique-ids flag, a comma-separated
+// list of identifier kinds.
+func parseUniqueIdentifiers(s string) ([]string, error) {
+	var kinds []string
+	for _, kind := range strings.Split(s, ",") {
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			continue
+		}
+		if !isIdentifierKind(kind) {
+			return nil, fmt.Errorf("unknown identifier %q (must be one of %s)", kind, strings.Join(identifierKinds, ", "))
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+func isIdentifierKind(kind string) bool {
+	for _, k := range identifierKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeISRC returns the compact uppercase form of an ISRC.
+func normalizeISRC(isrc string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(isrc), "-", ""))
+}
+
+// normalizeIdentifier returns the stored form of an identifier of the
+// given kind.
+func normalizeIdentifier(kind, value string) string {
+	switch kind {
+	case identifierISRC:
+		return normalizeISRC(value)
+	case identifierMusicBrainz:
+		return strings.ToLower(strings.TrimSpace(value))
+	default:
+		return strings.TrimSpace(value)
+	}
+}
+
+// validISRC reports whether isrc (in compact form) is a valid ISRC: a
+// two-letter country code, three letters or digits for the registrant,
+// then two digits for the year and five for the recording.
+func validISRC(isrc string) bool {
+	if len(isrc) != 12 {
+		return false
+	}
+	for i := 0; i < len(isrc); i++ {
+		c := isrc[i]
+		letter := c >= 'A' && c <= 'Z'
+		digit := c >= '0' && c <= '9'
+		switch {
+		case i < 2 && !letter:
+			return false
+		case i >= 2 && i < 5 && !letter && !digit:
+			return false
+		case i >= 5 && !digit:
+			return false
+		}
+	}
+	return true
+}
+
+// validUPC reports whether upc is a valid UPC-A (12 digits) or EAN-13,
+// including its GS1 check digit.
+func validUPC(upc string) bool {
+	if len(upc) != 12 && len(upc) != 13 {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(upc); i++ {
+		c := upc[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		// Digits are weighted 3, 1, 3, ... from the right, excluding the
+		// check digit itself
+		if i < len(upc)-1 {
+			weight := 1
+			if (len(upc)-1-i)%2 == 1 {
+				weight = 3
+			}
+			sum += int(c-'0') * weight
+		}
+	}
+	return (10-sum%10)%10 == int(upc[len(upc)-1]-'0')
+}
+
+// validMusicBrainzID reports whether id is a lowercase UUID, like
+// "b84ee12a-09ef-421b-82de-0441a926375b".
+func validMusicBrainzID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validateAlbumIdentifiers adds issues for the album's identifiers that
+// aren't valid. The track identifiers are validated by validateTrack.
+func validateAlbumIdentifiers(album Album, issues map[string]interface{}) {
+	if album.UPC != "" && !validUPC(album.UPC) {
+		issues["upc"] = validationIssue{"invalid", "upc must be a 12-digit UPC or 13-digit EAN with a valid check digit"}
+	}
+	if album.MusicBrainzID != "" && !validMusicBrainzID(album.MusicBrainzID) {
+		issues["musicbrainz_id"] = validationIssue{"invalid", "musicbrainz_id must be a UUID"}
+	}
+}
+
+// validateTrackIdentifiers adds issues for the track's identifiers that
+// aren't valid, with the field names prefixed by prefix.
+func validateTrackIdentifiers(track Track, prefix string, issues map[string]interface{}) {
+	if track.ISRC != "" && !validISRC(track.ISRC) {
+		issues[prefix+"isrc"] = validationIssue{"invalid", "isrc must be an ISRC, like US-S1Z-99-00001"}
+	}
+	if track.MusicBrainzID != "" && !validMusicBrainzID(track.MusicBrainzID) {
+		issues[prefix+"musicbrainz_id"] = validationIssue{"invalid", "musicbrainz_id must be a UUID"}
+	}
+}
+
+// normalizeAlbumIdentifiers puts the identifiers of album and its tracks
+// into their stored form.
+func normalizeAlbumIdentifiers(album *Album) {
+	album.UPC = normalizeIdentifier(identifierUPC, album.UPC)
+	album.MusicBrainzID = normalizeIdentifier(identifierMusicBrainz, album.MusicBrainzID)
+	for i := range album.Tracks {
+		normalizeTrackIdentifiers(&album.Tracks[i])
+	}
+}
+
+// normalizeTrackIdentifiers puts the track's identifiers into their
+// stored form.
+func normalizeTrackIdentifiers(track *Track) {
+	track.ISRC = normalizeIdentifier(identifierISRC, track.ISRC)
+	track.MusicBrainzID = normalizeIdentifier(identifierMusicBrainz, track.MusicBrainzID)
+}
+
+// checkUniqueIdentifiers adds issues for identifiers of album that are
+// configured to be unique but are already used by another album, or by
+// another of its tracks. Track issues are keyed by trackPrefix(i) plus the
+// field name, for the track at index i.
+func (s *Server) checkUniqueIdentifiers(album Album, trackPrefix func(i int) string, issues map[string]interface{}) error {
+	if len(s.uniqueIdentifiers) == 0 {
+		return nil
+	}
+	albums, err := s.db.GetAlbums()
+	if err != nil {
+		return fmt.Errorf("checking identifiers are unique: %w", err)
+	}
+	used := make(map[string]string) // album ID by kind and identifier
+	for _, other := range albums {
+		if other.ID == album.ID {
+			continue
+		}
+		for _, id := range albumIdentifiers(other) {
+			used[id.kind+" "+id.value] = other.ID
+		}
+	}
+
+	seen := make(map[string]bool) // identifiers earlier in album
+	duplicate := func(kind, value, key string) {
+		if !s.uniqueIdentifiers[kind] || value == "" {
+			return
+		}
+		if otherID, ok := used[kind+" "+value]; ok {
+			issues[key] = validationIssue{"duplicate", fmt.Sprintf("%s %s is already used by album %q", kind, value, otherID)}
+		} else if seen[kind+" "+value] {
+			issues[key] = validationIssue{"duplicate", fmt.Sprintf("duplicate %s %s", kind, value)}
+		}
+		seen[kind+" "+value] = true
+	}
+	duplicate(identifierUPC, album.UPC, "upc")
+	duplicate(identifierMusicBrainz, album.MusicBrainzID, "musicbrainz_id")
+	for i, track := range album.Tracks {
+		duplicate(identifierISRC, track.ISRC, trackPrefix(i)+"isrc")
+		duplicate(identifierMusicBrainz, track.MusicBrainzID, trackPrefix(i)+"musicbrainz_id")
+	}
+	return nil
+}
+
+// albumIdentifier is one of an album's external identifiers.
+type albumIdentifier struct {
+	kind        string
+	value       string
+	trackNumber int // zero for album identifiers
+}
+
+// albumIdentifiers returns the external identifiers of album and its
+// tracks.
+func albumIdentifiers(album Album) []albumIdentifier {
+	var ids []albumIdentifier
+	if album.UPC != "" {
+		ids = append(ids, albumIdentifier{identifierUPC, album.UPC, 0})
+	}
+	if album.MusicBrainzID != "" {
+		ids = append(ids, albumIdentifier{identifierMusicBrainz, album.MusicBrainzID, 0})
+	}
+	for _, track := range album.Tracks {
+		if track.ISRC != "" {
+			ids = append(ids, albumIdentifier{identifierISRC, track.ISRC, track.Number})
+		}
+		if track.MusicBrainzID != "" {
+			ids = append(ids, albumIdentifier{identifierMusicBrainz, track.MusicBrainzID, track.Number})
+		}
+	}
+	return ids
+}
+
+// identifierMatch is an album found by GET /lookup, with the matching
+// track if it was a track identifier.
+type identifierMatch struct {
+	Album Album  `json:"album"`
+	Track *Track `json:"track,omitempty"`
+}
+
+func (s *Server) lookupIdentifier(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var kind, value string
+	for _, k := range identifierKinds {
+		if v := query.Get(k); v != "" {
+			if kind != "" {
+				kind = ""
+				break
+			}
+			kind, value = k, normalizeIdentifier(k, v)
+		}
+	}
+	if kind == "" {
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{
+			"query": validationIssue{"required", "exactly one of " + strings.Join(identifierKinds, ", ") + " is required"},
+		}))
+		return
+	}
+
+	albums, err := s.db.GetAlbums()
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("looking up %s %s: %w", kind, value, err)))
+		return
+	}
+	matches := []identifierMatch{}
+	for _, album := range s.redactAlbums(r, filterVisible(albums, s.now(), false)) {
+		for _, id := range albumIdentifiers(album) {
+			if id.kind != kind || id.value != value {
+				continue
+			}
+			match := identifierMatch{Album: album}
+			for i := range album.Tracks {
+				if id.trackNumber != 0 && album.Tracks[i].Number == id.trackNumber {
+					match.Track = &album.Tracks[i]
+				}
+			}
+			matches = append(matches, match)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Album.ID < matches[j].Album.ID
+	})
+	s.writeJSON(w, r, http.StatusOK, matches)
+}
@@ -0,0 +1,170 @@
+// Tests for external identifiers
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	testUPC  = "036000291452"
+	testMBID = "b84ee12a-09ef-421b-82de-0441a926375b"
+)
+
+func TestIdentifiers(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{
+		"id": "h1", "title": "Help!", "artist": "The Beatles", "price": 1500,
+		"upc": "`+testUPC+`", "musicbrainz_id": "B84EE12A-09EF-421B-82DE-0441A926375B",
+		"tracks": [{"title": "Help!", "duration": 139, "isrc": "gb-aye-65-00001"}]
+	}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	var album Album
+	unmarshalResponse(t, result, &album)
+	if album.UPC != testUPC || album.MusicBrainzID != testMBID || album.Tracks[0].ISRC != "GBAYE6500001" {
+		t.Fatalf("identifiers not normalized: %+v", album)
+	}
+	result = serve(t, server, newRequest(t, "POST", "/albums/h1/tracks", strings.NewReader(`{"title": "Yesterday", "duration": 125, "isrc": "GBAYE6500002"}`)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	// Identifiers aren't unique by default, so a compilation can have the
+	// same recording
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{
+		"id": "h2", "title": "1", "artist": "The Beatles", "price": 2000,
+		"tracks": [{"title": "Help!", "duration": 139, "isrc": "GBAYE6500001"}]
+	}`)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	result = serve(t, server, newRequest(t, "GET", "/lookup?isrc=GB-AYE-65-00001", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var matches []identifierMatch
+	unmarshalResponse(t, result, &matches)
+	if len(matches) != 2 || matches[0].Album.ID != "h1" || matches[1].Album.ID != "h2" ||
+		matches[0].Track == nil || matches[0].Track.Title != "Help!" || matches[0].Track.Number != 1 {
+		t.Fatalf("bad matches: %+v", matches)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/lookup?upc="+testUPC, nil))
+	ensureStatus(t, result, http.StatusOK)
+	matches = nil
+	unmarshalResponse(t, result, &matches)
+	if len(matches) != 1 || matches[0].Album.ID != "h1" || matches[0].Track != nil {
+		t.Fatalf("bad matches: %+v", matches)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/lookup?musicbrainz_id=00000000-0000-0000-0000-000000000000", nil))
+	ensureStatus(t, result, http.StatusOK)
+	matches = nil
+	unmarshalResponse(t, result, &matches)
+	if matches == nil || len(matches) != 0 {
+		t.Fatalf("expected empty list, got %+v", matches)
+	}
+
+	for _, query := range []string{"", "?upc=" + testUPC + "&isrc=GBAYE6500001", "?ean=123"} {
+		result = serve(t, server, newRequest(t, "GET", "/lookup"+query, nil))
+		ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+			"query": map[string]interface{}{"error": "required", "message": "exactly one of isrc, musicbrainz_id, upc is required"},
+		})
+	}
+}
+
+func TestIdentifierValidation(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{
+		"title": "Help!", "artist": "The Beatles", "price": 1500,
+		"upc": "036000291453", "musicbrainz_id": "b84ee12a",
+		"tracks": [{"title": "Help!", "duration": 139, "isrc": "GBAYE65000"}]
+	}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"upc":            map[string]interface{}{"error": "invalid", "message": "upc must be a 12-digit UPC or 13-digit EAN with a valid check digit"},
+		"musicbrainz_id": map[string]interface{}{"error": "invalid", "message": "musicbrainz_id must be a UUID"},
+		"tracks.0.isrc":  map[string]interface{}{"error": "invalid", "message": "isrc must be an ISRC, like US-S1Z-99-00001"},
+	})
+
+	for _, test := range []struct {
+		valid func(string) bool
+		value string
+		want  bool
+	}{
+		{validISRC, "USS1Z9900001", true},
+		{validISRC, "US1Z99000001", true},
+		{validISRC, "1SS1Z9900001", false},
+		{validISRC, "USS1Z99A0001", false},
+		{validUPC, testUPC, true},
+		{validUPC, "4006381333931", true},
+		{validUPC, "4006381333932", false},
+		{validUPC, "03600029145x", false},
+		{validMusicBrainzID, testMBID, true},
+		{validMusicBrainzID, strings.ToUpper(testMBID), false},
+		{validMusicBrainzID, strings.Replace(testMBID, "-", "", 1), false},
+	} {
+		if got := test.valid(test.value); got != test.want {
+			t.Errorf("valid(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestUniqueIdentifiers(t *testing.T) {
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithUniqueIdentifiers(identifierISRC, identifierUPC),
+	)
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{
+		"id": "h1", "title": "Help!", "artist": "The Beatles", "price": 1500, "upc": "`+testUPC+`",
+		"tracks": [{"title": "Help!", "duration": 139, "isrc": "GBAYE6500001"}]
+	}`)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	// Replacing the album with its own identifiers is fine
+	result = serve(t, server, newRequest(t, "PUT", "/albums/h1", strings.NewReader(`{
+		"title": "Help!", "artist": "The Beatles", "price": 1600, "upc": "`+testUPC+`", "version": 1,
+		"tracks": [{"title": "Help!", "duration": 139, "isrc": "GBAYE6500001"}]
+	}`)))
+	ensureStatus(t, result, http.StatusOK)
+
+	// Other albums can't reuse them, even if the album is deleted, and the
+	// tracks of an album can't share an ISRC
+	result = serve(t, server, newAdminRequest(t, "DELETE", "/albums/h1", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{
+		"id": "h2", "title": "1", "artist": "The Beatles", "price": 2000, "upc": "`+testUPC+`",
+		"tracks": [
+			{"number": 2, "title": "Yesterday", "duration": 125, "isrc": "GBAYE6500002"},
+			{"number": 1, "title": "Help!", "duration": 139, "isrc": "GB-AYE-65-00001"},
+			{"number": 3, "title": "Yesterday", "duration": 125, "isrc": "GBAYE6500002"}
+		]
+	}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"upc":           map[string]interface{}{"error": "duplicate", "message": `upc ` + testUPC + ` is already used by album "h1"`},
+		"tracks.1.isrc": map[string]interface{}{"error": "duplicate", "message": `isrc GBAYE6500001 is already used by album "h1"`},
+		"tracks.2.isrc": map[string]interface{}{"error": "duplicate", "message": `duplicate isrc GBAYE6500002`},
+	})
+
+	// MusicBrainz IDs weren't made unique
+	for _, id := range []string{"h2", "h3"} {
+		result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{
+			"id": "`+id+`", "title": "1", "artist": "The Beatles", "price": 2000, "musicbrainz_id": "`+testMBID+`"
+		}`)))
+		ensureStatus(t, result, http.StatusCreated)
+	}
+
+	// Added tracks are checked against the album's own tracks too
+	result = serve(t, server, newRequest(t, "POST", "/albums/h2/tracks", strings.NewReader(`{"title": "Help!", "duration": 139, "isrc": "GBAYE6500003"}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	result = serve(t, server, newRequest(t, "POST", "/albums/h2/tracks", strings.NewReader(`{"title": "Help!", "duration": 139, "isrc": "GBAYE6500003"}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"isrc": map[string]interface{}{"error": "duplicate", "message": `isrc GBAYE6500003 is already used by album "h2"`},
+	})
+}
+
+func TestParseUniqueIdentifiers(t *testing.T) {
+	kinds, err := parseUniqueIdentifiers(" isrc, upc,")
+	if err != nil || strings.Join(kinds, ",") != "isrc,upc" {
+		t.Fatalf("got %q, %v", kinds, err)
+	}
+	if _, err := parseUniqueIdentifiers("isrc,ean"); err == nil {
+		t.Fatal("expected error for unknown identifier")
+	}
+}
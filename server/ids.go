@@ -0,0 +1,141 @@
+// Server-side generation of album IDs, and the syntax of client-chosen ones
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxAlbumIDLen is the longest album ID a client can choose, in bytes.
+const maxAlbumIDLen = 128
+
+// validateAlbumID returns a validation issue if id isn't a valid album ID,
+// or nil if it is. It's used for IDs in request bodies and (once decoded)
+// in URL paths, so an album can always be fetched by the ID it was created
+// with. IDs can contain any UTF-8 text except control characters and "%",
+// which is only ever the sign of a malformed or doubly-encoded escape in a
+// URL, and can't be "." or "..", which clients remove from URLs. Slashes and
+// spaces are allowed, as album URLs escape them.
+func validateAlbumID(id string) *validationIssue {
+	switch {
+	case id == "":
+		return &validationIssue{"required", "id is required"}
+	case len(id) > maxAlbumIDLen:
+		return &validationIssue{"too-long", fmt.Sprintf("id must be at most %d bytes", maxAlbumIDLen)}
+	case !utf8.ValidString(id) || id == "." || id == ".." ||
+		strings.ContainsRune(id, '%') || strings.IndexFunc(id, unicode.IsControl) >= 0:
+		return &validationIssue{"invalid", "id must be text without control characters or %, and not . or .."}
+	}
+	return nil
+}
+
+// IDGenerator generates IDs for new albums when the client doesn't
+// specify one.
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// WithIDGenerator sets the generator used for new album IDs. The default
+// generates random (version 4) UUIDs.
+func WithIDGenerator(generator IDGenerator) Option {
+	return func(s *Server) {
+		s.idGenerator = generator
+	}
+}
+
+// UUIDGenerator generates random (version 4) UUIDs like
+// "f47ac10b-58cc-4372-a567-0e02b2c3d479".
+type UUIDGenerator struct {
+	Rand io.Reader // source of randomness; nil means crypto/rand.Reader
+}
+
+func (g UUIDGenerator) NewID() (string, error) {
+	var b [16]byte
+	_, err := io.ReadFull(randReader(g.Rand), b[:])
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10 (RFC 4122)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// ULIDGenerator generates ULIDs like "01ARZ3NDEKTSV4RRFFQ69G5FAV": a 48-bit
+// millisecond timestamp followed by 80 random bits, encoded in Crockford's
+// base32. Unlike UUIDs, they sort in order of creation.
+type ULIDGenerator struct {
+	Now  func() time.Time // clock; nil means time.Now
+	Rand io.Reader        // source of randomness; nil means crypto/rand.Reader
+}
+
+func (g ULIDGenerator) NewID() (string, error) {
+	now := time.Now
+	if g.Now != nil {
+		now = g.Now
+	}
+	var b [16]byte
+	ms := uint64(now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint16(b[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+	_, err := io.ReadFull(randReader(g.Rand), b[6:])
+	if err != nil {
+		return "", err
+	}
+	return encodeULID(b), nil
+}
+
+// SequentialIDGenerator generates the IDs "id1", "id2", and so on, so that
+// tests (including integration tests using the testfixtures package, or
+// run against a server started with -id-format sequential) can predict
+// the IDs of the albums they create.
+// It's safe for concurrent use. The zero value starts at "id1".
+type SequentialIDGenerator struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (g *SequentialIDGenerator) NewID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n++
+	return "id" + strconv.Itoa(g.n), nil
+}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// encodeULID encodes the 128 bits of b as 26 base32 characters (130 bits,
+// the first two of which are zero).
+func encodeULID(b [16]byte) string {
+	bit := func(i int) byte {
+		i -= 2 // skip the two leading zero bits
+		if i < 0 {
+			return 0
+		}
+		return b[i/8] >> (7 - i%8) & 1
+	}
+	var out [26]byte
+	for i := range out {
+		var c byte
+		for j := 0; j < 5; j++ {
+			c = c<<1 | bit(i*5+j)
+		}
+		out[i] = crockfordBase32[c]
+	}
+	return string(out[:])
+}
+
+func randReader(r io.Reader) io.Reader {
+	if r == nil {
+		return rand.Reader
+	}
+	return r
+}
@@ -0,0 +1,219 @@
+// Tests for server-side generation and validation of album IDs
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAddAlbumGeneratedID(t *testing.T) {
+	db := NewMemoryDatabase()
+	server := NewServer(db, log.New(io.Discard, "", 0), WithIDGenerator(&SequentialIDGenerator{}))
+
+	for _, wantID := range []string{"id1", "id2"} {
+		body := `{"title": "Pianoman", "artist": "Billy Joel"}`
+		result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+		ensureStatus(t, result, http.StatusCreated)
+		var got testAlbum
+		unmarshalResponse(t, result, &got)
+		want := testAlbum{ID: wantID, Title: "Pianoman", Artist: "Billy Joel"}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("bad response: got vs want:\n%#v\n%#v", got, want)
+		}
+		location := result.Header.Get("Location")
+		if location != "/albums/"+wantID {
+			t.Fatalf("bad Location header: got %q, want %q", location, "/albums/"+wantID)
+		}
+		testGetAlbum(t, server, getAlbumTest{location, http.StatusOK, want})
+	}
+}
+
+func TestAddAlbumDefaultIDGenerator(t *testing.T) {
+	server := newTestServer()
+	body := `{"title": "Pianoman", "artist": "Billy Joel"}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	var got testAlbum
+	unmarshalResponse(t, result, &got)
+	if !reUUID.MatchString(got.ID) {
+		t.Fatalf("bad generated ID: got %q, want a UUID", got.ID)
+	}
+}
+
+var reUUID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestUUIDGenerator(t *testing.T) {
+	generator := UUIDGenerator{Rand: bytes.NewReader(bytes.Repeat([]byte{0xff}, 16))}
+	got, err := generator.NewID()
+	if err != nil {
+		t.Fatalf("error generating ID: %v", err)
+	}
+	want := "ffffffff-ffff-4fff-bfff-ffffffffffff"
+	if got != want {
+		t.Fatalf("bad ID: got %q, want %q", got, want)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := UUIDGenerator{}.NewID()
+		if err != nil {
+			t.Fatalf("error generating ID: %v", err)
+		}
+		if !reUUID.MatchString(id) || seen[id] {
+			t.Fatalf("bad or duplicate ID %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestULIDGenerator(t *testing.T) {
+	// Example from the ULID spec: timestamp 1469918176385 is "01ARYZ6S41"
+	generator := ULIDGenerator{
+		Now:  func() time.Time { return time.Unix(0, 1469918176385*int64(time.Millisecond)) },
+		Rand: bytes.NewReader(make([]byte, 10)),
+	}
+	got, err := generator.NewID()
+	if err != nil {
+		t.Fatalf("error generating ID: %v", err)
+	}
+	want := "01ARYZ6S410000000000000000"
+	if got != want {
+		t.Fatalf("bad ID: got %q, want %q", got, want)
+	}
+
+	// ULIDs generated at later times sort later
+	first, _ := ULIDGenerator{Now: func() time.Time { return time.Unix(1000, 0) }}.NewID()
+	second, _ := ULIDGenerator{Now: func() time.Time { return time.Unix(1001, 0) }}.NewID()
+	if len(first) != 26 || !(first < second) {
+		t.Fatalf("bad ULIDs: %q should sort before %q", first, second)
+	}
+}
+
+func TestSequentialIDGenerator(t *testing.T) {
+	var generator SequentialIDGenerator
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			generator.NewID()
+		}()
+	}
+	wg.Wait()
+	got, err := generator.NewID()
+	if err != nil || got != "id11" {
+		t.Fatalf("got %q, %v; want id11", got, err)
+	}
+}
+
+func TestValidateAlbumID(t *testing.T) {
+	for _, id := range []string{"a1", "a/9", "a 1", "Café", "..a", strings.Repeat("x", maxAlbumIDLen)} {
+		if issue := validateAlbumID(id); issue != nil {
+			t.Errorf("%q: got issue %+v", id, *issue)
+		}
+	}
+	tests := []struct {
+		id, issue string
+	}{
+		{"", "required"},
+		{strings.Repeat("x", maxAlbumIDLen+1), "too-long"},
+		{"%zz", "invalid"},
+		{"a%201", "invalid"},
+		{"a\x001", "invalid"},
+		{"a\n1", "invalid"},
+		{"\xff", "invalid"},
+		{".", "invalid"},
+		{"..", "invalid"},
+	}
+	for _, test := range tests {
+		issue := validateAlbumID(test.id)
+		if issue == nil || issue.Error != test.issue {
+			t.Errorf("%q: got issue %v, want %q", test.id, issue, test.issue)
+		}
+	}
+}
+
+func TestAlbumIDInPath(t *testing.T) {
+	server := newTestServer()
+	body := `{"id": "a/9 é", "title": "Pianoman", "artist": "Billy Joel"}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	location := result.Header.Get("Location")
+	if location != "/albums/a%2F9%20%C3%A9" {
+		t.Fatalf("got Location %q", location)
+	}
+
+	// The ID is decoded from the path, so an escaped slash is part of it
+	for _, path := range []string{location, location + "/tracks"} {
+		result = serve(t, server, newRequest(t, "GET", path, nil))
+		ensureStatus(t, result, http.StatusOK)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/albums/a/9", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	// Junk IDs are an error, before the handler looks them up
+	tests := []struct {
+		method, path, issue string
+	}{
+		{"GET", "/albums/%25zz", "invalid"},
+		{"GET", "/albums/a%001/tracks", "invalid"},
+		{"DELETE", "/albums/..", "invalid"},
+		{"PUT", "/albums/" + strings.Repeat("x", maxAlbumIDLen+1), "too-long"},
+	}
+	for _, test := range tests {
+		result = serve(t, server, newPathRequest(test.method, test.path, nil))
+		ensureStatus(t, result, http.StatusBadRequest)
+		var got struct {
+			Error string `json:"error"`
+			Data  map[string]struct {
+				Error string `json:"error"`
+			} `json:"data"`
+		}
+		unmarshalResponse(t, result, &got)
+		if got.Error != "invalid-id" || got.Data["id"].Error != test.issue {
+			t.Errorf("%s %s: got %+v, want invalid-id with %q", test.method, test.path, got, test.issue)
+		}
+	}
+	result = serve(t, server, newRequest(t, "HEAD", "/albums/%25zz", nil))
+	ensureStatus(t, result, http.StatusBadRequest)
+
+	// A malformed escape is rejected by net/http before the router sees
+	// it, so it gets net/http's plain text 400 rather than "invalid-id"
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	conn, err := net.Dial("tcp", httpServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /albums/%zz HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	ensureStatus(t, response, http.StatusBadRequest)
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Fatalf("got Content-Type %q, want net/http's text/plain", contentType)
+	}
+
+	// Bodies are held to the same rules
+	body = `{"id": "a%zz", "title": "Pianoman", "artist": "Billy Joel"}`
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	data := map[string]interface{}{
+		"id": map[string]interface{}{"error": "invalid", "message": "id must be text without control characters or %, and not . or .."},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+}
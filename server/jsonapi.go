@@ -0,0 +1,284 @@
+// JSON:API responses for clients that ask for them
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/textproto"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+const jsonAPIContentType = "application/vnd.api+json"
+
+// wantsJSONAPI reports whether the client wants a JSON:API response
+// (https://jsonapi.org/), which it asks for with an Accept header that
+// prefers application/vnd.api+json to plain JSON and HTML.
+//
+// Only responses use JSON:API: request bodies are still the plain album
+// JSON, whatever the Accept header.
+func wantsJSONAPI(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	quality := acceptQuality(accept, jsonAPIContentType)
+	return quality > acceptQuality(accept, "application/json") && quality > acceptQuality(accept, "text/html")
+}
+
+// jsonAPIResource is an album as a JSON:API resource object. Attributes
+// are the album's JSON fields other than its ID, so they're the same as
+// in a plain JSON response, and the album's version history is a related
+// resource.
+type jsonAPIResource struct {
+	Type          string                         `json:"type"`
+	ID            string                         `json:"id"`
+	Attributes    map[string]json.RawMessage     `json:"attributes"`
+	Relationships map[string]jsonAPIRelationship `json:"relationships,omitempty"`
+	Links         jsonAPILinks                   `json:"links"`
+}
+
+type jsonAPIRelationship struct {
+	Links jsonAPILinks `json:"links"`
+}
+
+type jsonAPILinks struct {
+	Self    string `json:"self,omitempty"`
+	Related string `json:"related,omitempty"`
+}
+
+// jsonAPIDocument is a top-level JSON:API document. Data is a single
+// resource or a list of them.
+type jsonAPIDocument struct {
+	Data  interface{}  `json:"data"`
+	Links jsonAPILinks `json:"links"`
+}
+
+// jsonAPIAlbumFields is the set of album attribute and relationship names
+// that can be given in a sparse fieldset.
+var jsonAPIAlbumFields = func() map[string]bool {
+	fields := map[string]bool{"versions": true}
+	typ := reflect.TypeOf(Album{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name != "id" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// jsonAPIFields parses the sparse fieldset for albums, given as the
+// ?fields[albums]= query parameter, writing an error response if it names
+// fields that albums don't have. It returns nil (all fields) if the
+// parameter isn't given. The caller should return from the handler early
+// if it returns false.
+func (s *Server) jsonAPIFields(w http.ResponseWriter, r *http.Request) (map[string]bool, bool) {
+	values, ok := r.URL.Query()["fields[albums]"]
+	if !ok {
+		return nil, true
+	}
+	fields := make(map[string]bool)
+	var unknown []string
+	for _, name := range strings.Split(strings.Join(values, ","), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !jsonAPIAlbumFields[name] {
+			unknown = append(unknown, strconv.Quote(name))
+		}
+		fields[name] = true
+	}
+	if len(unknown) > 0 {
+		issues := map[string]interface{}{
+			"fields[albums]": validationIssue{"invalid", "unknown album field(s) " + strings.Join(unknown, ", ")},
+		}
+		s.writeError(w, r, apierr.Validation(issues))
+		return nil, false
+	}
+	return fields, true
+}
+
+// jsonAPIAlbum converts an album to a JSON:API resource with only the
+// given fields (all fields if fields is nil).
+func (s *Server) jsonAPIAlbum(r *http.Request, album Album, fields map[string]bool) jsonAPIResource {
+	attributes := albumFields(album)
+	delete(attributes, "id")
+	if fields != nil {
+		for name := range attributes {
+			if !fields[name] {
+				delete(attributes, name)
+			}
+		}
+	}
+	url := s.albumURL(r, album.ID)
+	resource := jsonAPIResource{
+		Type:       "albums",
+		ID:         album.ID,
+		Attributes: attributes,
+		Links:      jsonAPILinks{Self: url},
+	}
+	if fields == nil || fields["versions"] {
+		resource.Relationships = map[string]jsonAPIRelationship{
+			"versions": {Links: jsonAPILinks{Related: url + "/versions"}},
+		}
+	}
+	return resource
+}
+
+// writeJSONAPIAlbum writes a single album as a JSON:API document.
+func (s *Server) writeJSONAPIAlbum(w http.ResponseWriter, r *http.Request, status int, album Album) {
+	fields, ok := s.jsonAPIFields(w, r)
+	if !ok {
+		return
+	}
+	doc := jsonAPIDocument{
+		Data:  s.jsonAPIAlbum(r, album, fields),
+		Links: jsonAPILinks{Self: s.resourceURL(apiPrefix(r) + r.URL.RequestURI())},
+	}
+	s.writeJSONAPI(w, r, status, doc)
+}
+
+// writeJSONAPIAlbums writes a list of albums as a JSON:API document.
+func (s *Server) writeJSONAPIAlbums(w http.ResponseWriter, r *http.Request, albums []Album) {
+	fields, ok := s.jsonAPIFields(w, r)
+	if !ok {
+		return
+	}
+	resources := make([]jsonAPIResource, len(albums))
+	for i, album := range albums {
+		resources[i] = s.jsonAPIAlbum(r, album, fields)
+	}
+	doc := jsonAPIDocument{
+		Data:  resources,
+		Links: jsonAPILinks{Self: s.resourceURL(apiPrefix(r) + r.URL.RequestURI())},
+	}
+	s.writeJSONAPI(w, r, http.StatusOK, doc)
+}
+
+// writeJSONAPI writes a JSON:API document with the given status. Responses
+// to GET requests get an ETag like the plain JSON responses.
+func (s *Server) writeJSONAPI(w http.ResponseWriter, r *http.Request, status int, doc jsonAPIDocument) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err := s.encodeJSON(buf, r, doc, "")
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(err))
+		return
+	}
+	if (r.Method == "GET" || r.Method == "HEAD") && status == http.StatusOK {
+		s.writeWithETag(w, r, jsonAPIContentType, buf.Bytes())
+		return
+	}
+	w.Header().Set("Content-Type", jsonAPIContentType)
+	w.WriteHeader(status)
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		s.log.Printf("error writing response: %v", err)
+	}
+}
+
+// jsonAPIError is a JSON:API error object. Code is the server's error
+// code, the same as "error" in the regular error envelope.
+type jsonAPIError struct {
+	Status string                 `json:"status"`
+	Code   string                 `json:"code"`
+	Title  string                 `json:"title"`
+	Detail string                 `json:"detail,omitempty"`
+	Source map[string]string      `json:"source,omitempty"`
+	Meta   map[string]interface{} `json:"meta,omitempty"`
+}
+
+// jsonAPIErrors writes the error as a JSON:API errors document. Validation
+// errors have an error object per invalid field, with its source and the
+// issue's error code in "meta", and any other error has a single object
+// with its data (if any) in "meta".
+func (s *Server) jsonAPIErrors(w http.ResponseWriter, r *http.Request, apiErr *apierr.Error) {
+	title := s.errorTitle(r, apiErr)
+	base := jsonAPIError{
+		Status: strconv.Itoa(apiErr.Status),
+		Code:   apiErr.Code,
+		Title:  title,
+	}
+
+	var errs []jsonAPIError
+	var meta map[string]interface{}
+	if apiErr.Code == apierr.CodeValidation && len(apiErr.Data) > 0 {
+		names := make([]string, 0, len(apiErr.Data))
+		for name, value := range apiErr.Data {
+			if strings.HasPrefix(name, "$") {
+				// Dev mode hints (see WithDevMode) apply to the whole request
+				if meta == nil {
+					meta = make(map[string]interface{})
+				}
+				meta[name] = value
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			e := base
+			e.Source = jsonAPISource(r, name)
+			e.Meta = map[string]interface{}{"field": name}
+			if issue, ok := apiErr.Data[name].(validationIssue); ok {
+				e.Detail = issue.Message
+				e.Meta["error"] = issue.Error
+			} else {
+				e.Meta["error"] = apiErr.Data[name]
+			}
+			errs = append(errs, e)
+		}
+	} else {
+		e := base
+		if message, ok := apiErr.Data["message"].(string); ok {
+			e.Detail = message
+		}
+		e.Meta = apiErr.Data
+		errs = append(errs, e)
+	}
+	if apiErr.Retry != nil {
+		// It applies to the whole request, not a particular error
+		if meta == nil {
+			meta = make(map[string]interface{})
+		}
+		meta["retry"] = apiErr.Retry
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err := s.encodeJSON(buf, r, struct {
+		Errors []jsonAPIError         `json:"errors"`
+		Meta   map[string]interface{} `json:"meta,omitempty"`
+	}{errs, meta}, "")
+	if err != nil {
+		s.log.Printf("error marshaling JSON: %v", err)
+		http.Error(w, `{"errors":[{"status":"500","code":"`+apierr.CodeInternal+`"}]}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", jsonAPIContentType)
+	w.WriteHeader(apiErr.Status)
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		s.log.Printf("error writing JSON: %v", err)
+	}
+}
+
+// jsonAPISource returns the JSON:API error source for the validation
+// issue with the given name. Issues are named after header names (in
+// canonical case, like "If-Match"), or after query parameters for requests
+// without a body, or else after fields in the (plain JSON) body, with
+// nested fields separated by dots, like "tracks.0.title".
+func jsonAPISource(r *http.Request, name string) map[string]string {
+	switch {
+	case name != "" && name[0] >= 'A' && name[0] <= 'Z' && textproto.CanonicalMIMEHeaderKey(name) == name:
+		return map[string]string{"header": name}
+	case r.Method == "GET" || r.Method == "HEAD" || r.Method == "DELETE" || strings.Contains(name, "["):
+		return map[string]string{"parameter": name}
+	default:
+		return map[string]string{"pointer": "/" + strings.ReplaceAll(name, ".", "/")}
+	}
+}
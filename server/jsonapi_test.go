@@ -0,0 +1,184 @@
+// Tests for JSON:API responses
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newJSONAPIRequest(t *testing.T, method, url string, body io.Reader) *http.Request {
+	request := newRequest(t, method, url, body)
+	request.Header.Set("Accept", jsonAPIContentType)
+	return request
+}
+
+// readJSONAPI reads a JSON:API response into a generic value.
+func readJSONAPI(t *testing.T, response *http.Response) map[string]interface{} {
+	t.Helper()
+	if got := response.Header.Get("Content-Type"); got != jsonAPIContentType {
+		t.Fatalf("bad Content-Type: got %q, want %q", got, jsonAPIContentType)
+	}
+	var doc map[string]interface{}
+	err := json.NewDecoder(response.Body).Decode(&doc)
+	if err != nil {
+		t.Fatalf("error unmarshaling JSON:API document: %v", err)
+	}
+	return doc
+}
+
+func TestGetAlbumJSONAPI(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newJSONAPIRequest(t, "GET", "/albums/a1?fields[albums]=title,artist,versions", nil))
+	ensureStatus(t, result, http.StatusOK)
+	got := readJSONAPI(t, result)
+	want := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "albums",
+			"id":   "a1",
+			"attributes": map[string]interface{}{
+				"title":  "9th Symphony",
+				"artist": "Beethoven",
+			},
+			"relationships": map[string]interface{}{
+				"versions": map[string]interface{}{
+					"links": map[string]interface{}{"related": "/albums/a1/versions"},
+				},
+			},
+			"links": map[string]interface{}{"self": "/albums/a1"},
+		},
+		"links": map[string]interface{}{"self": "/albums/a1?fields[albums]=title,artist,versions"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got vs want:\n%#v\n%#v", got, want)
+	}
+}
+
+func TestGetAlbumsJSONAPI(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newJSONAPIRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if result.Header.Get("ETag") == "" {
+		t.Fatalf("expected ETag")
+	}
+	got := readJSONAPI(t, result)
+	data := got["data"].([]interface{})
+	if len(data) != 2 {
+		t.Fatalf("got %d albums, want 2", len(data))
+	}
+	resource := data[1].(map[string]interface{})
+	attributes := resource["attributes"].(map[string]interface{})
+	if resource["id"] != "a2" || attributes["title"] != "Hey Jude" || attributes["price"] != 2000.0 {
+		t.Fatalf("bad album resource: %#v", resource)
+	}
+	if _, ok := attributes["id"]; ok {
+		t.Fatalf("id shouldn't be an attribute: %#v", attributes)
+	}
+	if _, ok := resource["relationships"]; !ok {
+		t.Fatalf("expected relationships: %#v", resource)
+	}
+
+	// An empty sparse fieldset means no fields
+	result = serve(t, server, newJSONAPIRequest(t, "GET", "/albums?fields[albums]=", nil))
+	ensureStatus(t, result, http.StatusOK)
+	resource = readJSONAPI(t, result)["data"].([]interface{})[0].(map[string]interface{})
+	if len(resource["attributes"].(map[string]interface{})) != 0 || resource["relationships"] != nil {
+		t.Fatalf("expected no fields: %#v", resource)
+	}
+
+	// Browsers and plain JSON clients are unaffected
+	result = serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var albums []testAlbum
+	unmarshalResponse(t, result, &albums)
+}
+
+func TestCreateAlbumJSONAPI(t *testing.T) {
+	server := newTestServer()
+	body := `{"id": "a3", "title": "Abbey Road", "artist": "The Beatles"}`
+	result := serve(t, server, newJSONAPIRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	if got := result.Header.Get("Location"); got != "/albums/a3" {
+		t.Fatalf("bad Location: %q", got)
+	}
+	data := readJSONAPI(t, result)["data"].(map[string]interface{})
+	if data["id"] != "a3" || data["attributes"].(map[string]interface{})["version"] != 1.0 {
+		t.Fatalf("bad created album: %#v", data)
+	}
+
+	// Updates keep the version ETag for the next update
+	body = `{"title": "Abbey Road (Remastered)", "artist": "The Beatles"}`
+	request := newJSONAPIRequest(t, "PUT", "/albums/a3", strings.NewReader(body))
+	request.Header.Set("If-Match", `"1"`)
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("ETag"); got != `"2"` {
+		t.Fatalf("bad ETag: got %q, want %q", got, `"2"`)
+	}
+	readJSONAPI(t, result)
+}
+
+func TestJSONAPIErrors(t *testing.T) {
+	server := newTestServer()
+	tests := []struct {
+		name    string
+		request *http.Request
+		status  int
+		want    []interface{}
+	}{
+		{"not-found", newJSONAPIRequest(t, "GET", "/albums/a9", nil), http.StatusNotFound, []interface{}{
+			map[string]interface{}{"status": "404", "code": "not-found", "title": "Not found"},
+		}},
+		{"body", newJSONAPIRequest(t, "POST", "/albums", strings.NewReader(`{"tracks": [{"duration": 60}]}`)), http.StatusBadRequest, []interface{}{
+			map[string]interface{}{
+				"status": "400", "code": "validation", "title": "Validation failed",
+				"source": map[string]interface{}{"pointer": "/artist"},
+				"meta":   map[string]interface{}{"field": "artist", "error": "required"},
+			},
+			map[string]interface{}{
+				"status": "400", "code": "validation", "title": "Validation failed",
+				"source": map[string]interface{}{"pointer": "/title"},
+				"meta":   map[string]interface{}{"field": "title", "error": "required"},
+			},
+			map[string]interface{}{
+				"status": "400", "code": "validation", "title": "Validation failed",
+				"source": map[string]interface{}{"pointer": "/tracks/0/title"},
+				"meta":   map[string]interface{}{"field": "tracks.0.title", "error": "required"},
+			},
+		}},
+		{"parameter", newJSONAPIRequest(t, "GET", "/albums?fields[albums]=title,colour", nil), http.StatusBadRequest, []interface{}{
+			map[string]interface{}{
+				"status": "400", "code": "validation", "title": "Validation failed",
+				"detail": `unknown album field(s) "colour"`,
+				"source": map[string]interface{}{"parameter": "fields[albums]"},
+				"meta":   map[string]interface{}{"field": "fields[albums]", "error": "invalid"},
+			},
+		}},
+		{"header", func() *http.Request {
+			request := newJSONAPIRequest(t, "PUT", "/albums/a1", strings.NewReader(`{"title": "x", "artist": "y"}`))
+			request.Header.Set("If-Match", "bad")
+			return request
+		}(), http.StatusBadRequest, []interface{}{
+			map[string]interface{}{
+				"status": "400", "code": "validation", "title": "Validation failed",
+				"detail": `If-Match must be the album's ETag, like "1"`,
+				"source": map[string]interface{}{"header": "If-Match"},
+				"meta":   map[string]interface{}{"field": "If-Match", "error": "invalid"},
+			},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := serve(t, server, test.request)
+			ensureStatus(t, result, test.status)
+			got := readJSONAPI(t, result)["errors"]
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got vs want:\n%#v\n%#v", got, test.want)
+			}
+		})
+	}
+}
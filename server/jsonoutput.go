@@ -0,0 +1,52 @@
+// Compact or pretty-printed JSON responses
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// JSON responses are compact by default, which makes them smaller and
+// quicker to encode, and writeJSON encodes them straight to the response.
+// For reading responses by hand, add ?pretty=1 (or pretty=true) to a
+// request, or start the server with -pretty-json to indent all of them, as
+// it did before.
+//
+// This applies to the API's JSON responses, including errors, problem
+// details, and JSON:API documents. An ETag is a hash of the exact response
+// body, so the same resource has a different ETag when pretty-printed.
+
+// WithPrettyJSON sets whether all JSON responses are indented. The default
+// is false, where only requests with ?pretty=1 get indented responses.
+func WithPrettyJSON(enabled bool) Option {
+	return func(s *Server) {
+		s.indentJSON = enabled
+	}
+}
+
+// prettyJSON reports whether the JSON response to r should be indented.
+func (s *Server) prettyJSON(r *http.Request) bool {
+	if s.indentJSON {
+		return true
+	}
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	return pretty
+}
+
+// statusOnWrite is a ResponseWriter that writes the status in the header
+// when the body is first written, so a handler can still write a
+// different one if encoding the body fails before then.
+type statusOnWrite struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (sw *statusOnWrite) Write(p []byte) (int, error) {
+	if !sw.wrote {
+		sw.wrote = true
+		sw.ResponseWriter.WriteHeader(sw.status)
+	}
+	return sw.ResponseWriter.Write(p)
+}
@@ -0,0 +1,54 @@
+// Tests for compact and pretty-printed JSON responses
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrettyJSON(t *testing.T) {
+	getBody := func(server *Server, url string) string {
+		t.Helper()
+		result := serve(t, server, newRequest(t, "GET", url, nil))
+		b, _ := io.ReadAll(result.Body)
+		return string(b)
+	}
+
+	// Compact by default, with ?pretty=1 to indent
+	server := newTestServer()
+	if got, want := getBody(server, "/albums/a1"), `{"id":"a1","title":"9th Symphony",`; !strings.HasPrefix(got, want) {
+		t.Fatalf("got %q, want compact JSON", got)
+	}
+	if got := getBody(server, "/albums/a1?pretty=1"); !strings.HasPrefix(got, "{\n    \"id\": \"a1\",\n") {
+		t.Fatalf("got %q, want indented JSON", got)
+	}
+	if got := getBody(server, "/albums?pretty=true"); !strings.HasPrefix(got, "[\n    {\n        \"id\": \"a1\",") {
+		t.Fatalf("got %q for list, want indented JSON", got)
+	}
+	if got := getBody(server, "/albums/x?pretty=1"); !strings.Contains(got, "\n    \"status\": 404") {
+		t.Fatalf("got %q for error, want indented JSON", got)
+	}
+	if got := getBody(server, "/albums/x"); !strings.Contains(got, `{"status":404,"error":"not-found"}`) {
+		t.Fatalf("got %q for error, want compact JSON", got)
+	}
+
+	// Or indent every response
+	server = NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithPrettyJSON(true))
+	if got := getBody(server, "/albums/x"); !strings.Contains(got, "\n    \"status\": 404") {
+		t.Fatalf("got %q with WithPrettyJSON, want indented JSON", got)
+	}
+}
+
+func TestCompactJSONError(t *testing.T) {
+	// The status can still change if the value can't be marshaled
+	server := newTestServer()
+	recorder := httptest.NewRecorder()
+	server.writeJSON(recorder, newRequest(t, "GET", "/", nil), http.StatusCreated, map[string]interface{}{"bad": func() {}})
+	result := recorder.Result()
+	ensureStatus(t, result, http.StatusInternalServerError)
+}
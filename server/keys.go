@@ -0,0 +1,165 @@
+// Signing key rotation
+
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Everything the server signs can have its key rotated without breaking
+// what was signed with the old one:
+//
+//   - Responses (see signing.go) are signed with the current Ed25519 key,
+//     and earlier keys added with WithPreviousSigningKeys are still
+//     published, with the current one, in the JWK set at GET
+//     /signing-keys. Verifiers pick the key by the keyid in each response's
+//     Signature-Input, so responses cached before the rotation still
+//     verify. With -signing-key, the current key's file comes first,
+//     followed by the previous ones.
+//   - Webhooks (see webhook.go) get a new secret with POST
+//     /webhooks/:id/rotate-secret. For webhookSecretOverlap after that,
+//     events are signed with both the new and the old secret, so receivers
+//     can switch over to the new one in their own time.
+//
+// Admins can list every key with GET /keys, with its ID, whether it's the
+// current one, and how old it is, to see which are due to be rotated.
+// Keys in this API are identified by the first 8 bytes of the SHA-256
+// hash of their public key (or of the secret, for webhooks), in hex, which
+// identifies a key without revealing it.
+
+// WithPreviousSigningKeys adds public keys that responses used to be
+// signed with, so they're still published at GET /signing-keys.
+func WithPreviousSigningKeys(keys ...ed25519.PublicKey) Option {
+	return func(s *Server) {
+		s.previousSigningKeys = append(s.previousSigningKeys, keys...)
+	}
+}
+
+// WithKeysCreated records when keys were created, by key ID, so GET /keys
+// can show their ages. Webhook secrets don't need this, as the server
+// creates them.
+func WithKeysCreated(created map[string]time.Time) Option {
+	return func(s *Server) {
+		if s.keysCreated == nil {
+			s.keysCreated = make(map[string]time.Time)
+		}
+		for id, t := range created {
+			s.keysCreated[id] = t
+		}
+	}
+}
+
+// readSigningKeys reads the -signing-key flag, a comma-separated list of
+// PEM files with the current signing key first, followed by previous ones.
+// It also returns when each key was created, by key ID, taken from its
+// file's modification time.
+func readSigningKeys(paths string) (ed25519.PrivateKey, []ed25519.PublicKey, map[string]time.Time, error) {
+	var current ed25519.PrivateKey
+	var previous []ed25519.PublicKey
+	created := make(map[string]time.Time)
+	for i, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		key, err := readSigningKey(path)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if i == 0 {
+			current = key
+		} else {
+			previous = append(previous, key.Public().(ed25519.PublicKey))
+		}
+		created[signingKeyID(key)] = info.ModTime()
+	}
+	return current, previous, created, nil
+}
+
+// secretKeyID returns the key ID for a shared secret.
+func secretKeyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// signingJWKSet is a JSON Web Key Set of public signing keys.
+type signingJWKSet struct {
+	Keys []signingJWK `json:"keys"` // current first
+}
+
+func (s *Server) getSigningKeys(w http.ResponseWriter, r *http.Request) {
+	set := signingJWKSet{Keys: []signingJWK{}}
+	if s.signingKey != nil {
+		set.Keys = append(set.Keys, newSigningJWK(s.signingKey.Public().(ed25519.PublicKey)))
+	}
+	for _, public := range s.previousSigningKeys {
+		set.Keys = append(set.Keys, newSigningJWK(public))
+	}
+	s.writeJSON(w, r, http.StatusOK, set)
+}
+
+// KeyInfo describes a key the server signs with, for GET /keys.
+type KeyInfo struct {
+	ID string `json:"id"`
+
+	// Use is "response-signing" or "webhook", and WebhookID is the
+	// webhook a webhook secret belongs to.
+	Use       string `json:"use"`
+	WebhookID string `json:"webhook_id,omitempty"`
+
+	// Current is whether new signatures are made with the key.
+	Current bool `json:"current"`
+
+	// CreatedAt and Age are omitted if the key's creation time isn't
+	// known. ExpiresAt is when a rotated-out webhook secret stops being
+	// used.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	Age       string     `json:"age,omitempty"` // like "720h0m0s"
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (s *Server) getKeys(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	now := s.now()
+	keys := []KeyInfo{}
+	add := func(key KeyInfo, created time.Time) {
+		if !created.IsZero() {
+			key.CreatedAt = &created
+			key.Age = now.Sub(created).Round(time.Second).String()
+		}
+		keys = append(keys, key)
+	}
+	if s.signingKey != nil {
+		id := signingKeyID(s.signingKey)
+		add(KeyInfo{ID: id, Use: "response-signing", Current: true}, s.keysCreated[id])
+	}
+	for _, public := range s.previousSigningKeys {
+		id := publicKeyID(public)
+		add(KeyInfo{ID: id, Use: "response-signing"}, s.keysCreated[id])
+	}
+
+	for _, hook := range s.webhooks.list() {
+		hook.signingSecrets(now) // forget expired secrets
+		hook.mu.Lock()
+		for i, secret := range hook.secrets {
+			key := KeyInfo{ID: secretKeyID(secret.secret), Use: "webhook", WebhookID: hook.ID, Current: i == 0}
+			if !secret.expiresAt.IsZero() {
+				expires := secret.expiresAt
+				key.ExpiresAt = &expires
+			}
+			add(key, secret.createdAt)
+		}
+		hook.mu.Unlock()
+	}
+	s.writeJSON(w, r, http.StatusOK, keys)
+}
@@ -0,0 +1,154 @@
+// Tests for signing key rotation
+
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigningKeyRotation(t *testing.T) {
+	_, current, _ := ed25519.GenerateKey(rand.Reader)
+	previous, _, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return now }),
+		WithSigningKey(current),
+		WithPreviousSigningKeys(previous),
+		WithKeysCreated(map[string]time.Time{signingKeyID(current): now.Add(-48 * time.Hour)}),
+	)
+
+	// Responses are signed with the current key, and verifiers can find
+	// both keys in the set
+	result := serve(t, server, newRequest(t, "GET", "/signing-keys", nil))
+	ensureStatus(t, result, http.StatusOK)
+	body, _ := io.ReadAll(result.Body)
+	keyID, ok := verifySignature(t, result, body, current.Public().(ed25519.PublicKey))
+	if !ok || keyID != signingKeyID(current) {
+		t.Fatalf("signature didn't verify with current key (key ID %q)", keyID)
+	}
+	var set signingJWKSet
+	if err := json.Unmarshal(body, &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 || set.Keys[0].KeyID != keyID || set.Keys[1].KeyID != publicKeyID(previous) {
+		t.Fatalf("bad JWK set: %+v", set)
+	}
+
+	result = serve(t, server, newRequest(t, "GET", "/keys", nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	result = serve(t, server, newAdminRequest(t, "GET", "/keys", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var keys []KeyInfo
+	unmarshalResponse(t, result, &keys)
+	if len(keys) != 2 ||
+		keys[0].ID != keyID || !keys[0].Current || keys[0].Use != "response-signing" || keys[0].Age != "48h0m0s" ||
+		keys[1].ID != publicKeyID(previous) || keys[1].Current || keys[1].CreatedAt != nil {
+		t.Fatalf("bad keys: %+v", keys)
+	}
+
+	// Without any keys the set is empty
+	server = newTestServer()
+	result = serve(t, server, newRequest(t, "GET", "/signing-keys", nil))
+	ensureStatus(t, result, http.StatusOK)
+	unmarshalResponse(t, result, &set)
+	if len(set.Keys) != 0 {
+		t.Fatalf("expected no keys, got %+v", set)
+	}
+}
+
+func TestWebhookSecretRotation(t *testing.T) {
+	receiver := &webhookReceiver{}
+	endpoint := httptest.NewServer(receiver)
+	defer endpoint.Close()
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	server := newWebhookTestServer(t, WithClock(func() time.Time { return now }))
+	hook := addTestWebhook(t, server, endpoint.URL, "old-secret")
+
+	result := serve(t, server, newRequest(t, "POST", "/webhooks/"+hook.ID+"/rotate-secret", nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	result = serve(t, server, newAdminRequest(t, "POST", "/webhooks/"+hook.ID+"/rotate-secret", strings.NewReader(`{"secret": "new-secret"}`)))
+	ensureStatus(t, result, http.StatusOK)
+	var rotated Webhook
+	unmarshalResponse(t, result, &rotated)
+	if rotated.ID != hook.ID || rotated.Secret != "new-secret" {
+		t.Fatalf("bad webhook: %+v", rotated)
+	}
+
+	// Events are signed with both secrets, the new one first
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a2", "title": "Hey Jude", "artist": "The Beatles", "price": 2000}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	waitForDeliveries(t, server, hook.ID, 1)
+	received := receiver.received()
+	want := signWebhook([]string{"new-secret", "old-secret"}, now, received[0].body)
+	if got := received[0].header.Get("X-Webhook-Signature"); got != want || strings.Count(got, "v1=") != 2 {
+		t.Fatalf("got signature %q, want %q", got, want)
+	}
+
+	result = serve(t, server, newAdminRequest(t, "GET", "/keys", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var keys []KeyInfo
+	unmarshalResponse(t, result, &keys)
+	if len(keys) != 2 ||
+		keys[0].ID != secretKeyID("new-secret") || !keys[0].Current || keys[0].WebhookID != hook.ID || keys[0].ExpiresAt != nil ||
+		keys[1].ID != secretKeyID("old-secret") || keys[1].Current || !keys[1].ExpiresAt.Equal(now.Add(webhookSecretOverlap)) {
+		t.Fatalf("bad keys: %+v", keys)
+	}
+
+	// Once the overlap is over, only the new secret is used; without a
+	// body, a random secret is generated
+	registered := server.webhooks.list()[0]
+	if got := registered.signingSecrets(now.Add(webhookSecretOverlap)); len(got) != 1 || got[0] != "new-secret" {
+		t.Fatalf("got secrets %q, want just new-secret", got)
+	}
+	result = serve(t, server, newAdminRequest(t, "POST", "/webhooks/"+hook.ID+"/rotate-secret", nil))
+	ensureStatus(t, result, http.StatusOK)
+	unmarshalResponse(t, result, &rotated)
+	if len(rotated.Secret) != 64 {
+		t.Fatalf("got secret %q, want 64 hex digits", rotated.Secret)
+	}
+	result = serve(t, server, newAdminRequest(t, "POST", "/webhooks/nope/rotate-secret", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestReadSigningKeys(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	var keys []ed25519.PrivateKey
+	for _, name := range []string{"current.pem", "previous.pem"} {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		der, _ := x509.MarshalPKCS8PrivateKey(key)
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+		paths = append(paths, path)
+		keys = append(keys, key)
+	}
+	modTime := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	os.Chtimes(paths[1], modTime, modTime)
+
+	current, previous, created, err := readSigningKeys(strings.Join(paths, ", "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !current.Equal(keys[0]) || len(previous) != 1 || !previous[0].Equal(keys[1].Public()) ||
+		len(created) != 2 || !created[signingKeyID(keys[1])].Equal(modTime) {
+		t.Fatalf("got %v, %v, %v", current, previous, created)
+	}
+
+	if _, _, _, err := readSigningKeys(paths[0] + "," + filepath.Join(dir, "missing.pem")); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
@@ -0,0 +1,229 @@
+// Priority lanes: per-class concurrency limits and queueing
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// RequestClass is a class of request for priority lanes. Classes are in
+// priority order, highest first.
+type RequestClass int
+
+const (
+	ClassHealth RequestClass = iota // health checks, version, stats, diagnostics, and mode changes
+	ClassRead                       // reads of albums and genres
+	ClassWrite                      // creates, updates, and deletes
+	ClassBulk                       // streams, feeds, audit log, imports, migration, and uploads
+	numClasses
+)
+
+var classNames = [numClasses]string{"health", "read", "write", "bulk"}
+
+func (c RequestClass) String() string {
+	if c < 0 || c >= numClasses {
+		return "RequestClass(" + strconv.Itoa(int(c)) + ")"
+	}
+	return classNames[c]
+}
+
+// classifyRequest returns the class of the request.
+func classifyRequest(r *http.Request) RequestClass {
+	switch {
+	case r.URL.Path == "/readyz" || r.URL.Path == "/version" || r.URL.Path == "/stats" || r.URL.Path == "/diagnostics" || r.URL.Path == "/mode":
+		return ClassHealth
+	case isStreaming(r) || r.URL.Path == "/sitemap.xml" || r.URL.Path == "/feed.atom" ||
+		r.URL.Path == "/audit" || r.URL.Path == "/export" || r.URL.Path == "/albums/import" || strings.HasPrefix(r.URL.Path, "/migration/") ||
+		strings.HasPrefix(r.URL.Path, "/uploads/"):
+		return ClassBulk
+	case isSafeMethod(r.Method) || r.URL.Path == "/albums/lookup":
+		return ClassRead
+	default:
+		return ClassWrite
+	}
+}
+
+// WithLanes gives each class of request its own concurrency limit (zero
+// or missing means the class is only bounded by WithMaxInFlight), so that,
+// for example, a flood of exports can't use up all the capacity needed for
+// health checks and interactive reads. It replaces the plain (or
+// adaptive) limit with one that also queues: a request that can't run
+// straight away waits up to queueTimeout for a free slot, and when a slot
+// frees up the highest class waiting gets it. Requests still waiting
+// after queueTimeout are rejected with 503 Service Unavailable.
+func WithLanes(limits map[RequestClass]int, queueTimeout time.Duration) Option {
+	return func(s *Server) {
+		s.laneLimits = limits
+		s.laneQueueTimeout = queueTimeout
+	}
+}
+
+// parseLanes parses per-class limits given as comma-separated class=limit
+// pairs, like "health=10,bulk=20" (as given to the -lanes flag).
+func parseLanes(s string) (map[RequestClass]int, error) {
+	limits := make(map[RequestClass]int)
+	for _, lane := range strings.Split(s, ",") {
+		lane = strings.TrimSpace(lane)
+		if lane == "" {
+			continue
+		}
+		equals := strings.IndexByte(lane, '=')
+		if equals < 0 {
+			return nil, fmt.Errorf("lane %q must be class=limit", lane)
+		}
+		name, value := lane[:equals], lane[equals+1:]
+		class := RequestClass(-1)
+		for c, className := range classNames {
+			if name == className {
+				class = RequestClass(c)
+			}
+		}
+		if class < 0 {
+			return nil, fmt.Errorf("unknown request class %q (must be one of %s)", name, strings.Join(classNames[:], ", "))
+		}
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("limit for %s must be a non-negative integer", name)
+		}
+		limits[class] = limit
+	}
+	return limits, nil
+}
+
+// laneLimiter limits the number of requests in flight overall and in each
+// class, queueing requests that can't run in priority order.
+type laneLimiter struct {
+	total   int // zero means no overall limit
+	limits  [numClasses]int
+	timeout time.Duration
+
+	mu       sync.Mutex
+	running  int
+	inFlight [numClasses]int
+	queues   [numClasses][]chan struct{}
+}
+
+func newLaneLimiter(total int, limits map[RequestClass]int, timeout time.Duration) *laneLimiter {
+	l := &laneLimiter{total: total, timeout: timeout}
+	for class, limit := range limits {
+		if class >= 0 && class < numClasses {
+			l.limits[class] = limit
+		}
+	}
+	return l
+}
+
+// canRun reports whether a request of the given class can start now. The
+// caller must hold l.mu.
+func (l *laneLimiter) canRun(class RequestClass) bool {
+	return (l.total == 0 || l.running < l.total) &&
+		(l.limits[class] == 0 || l.inFlight[class] < l.limits[class])
+}
+
+// start records a request of the given class as running. The caller must
+// hold l.mu.
+func (l *laneLimiter) start(class RequestClass) {
+	l.running++
+	l.inFlight[class]++
+}
+
+// acquire reserves a slot for a request of the given class, waiting up to
+// the queue timeout for one to free up. It returns false if none did.
+//
+// Requests only queue when they can't run, and every release starts any
+// queued requests that now can, so it's never necessary to check whether
+// a new request would jump ahead of a queued one of higher priority.
+func (l *laneLimiter) acquire(class RequestClass) bool {
+	l.mu.Lock()
+	if l.canRun(class) {
+		l.start(class)
+		l.mu.Unlock()
+		return true
+	}
+	if l.timeout <= 0 {
+		l.mu.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	l.queues[class] = append(l.queues[class], ready)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	}
+
+	// Timed out, but a slot may have been handed over in the meantime
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	queue := l.queues[class]
+	for i, waiting := range queue {
+		if waiting == ready {
+			l.queues[class] = append(queue[:i:i], queue[i+1:]...)
+			return false
+		}
+	}
+	return true
+}
+
+// release frees a slot of the given class and starts as many queued
+// requests as can now run, highest class first.
+func (l *laneLimiter) release(class RequestClass) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	l.inFlight[class]--
+	for c := ClassHealth; c < numClasses; c++ {
+		for len(l.queues[c]) > 0 && l.canRun(c) {
+			l.start(c)
+			close(l.queues[c][0])
+			l.queues[c] = l.queues[c][1:]
+		}
+	}
+}
+
+// laneStats is the state of a single lane, as reported by /stats.
+type laneStats struct {
+	Limit    int `json:"limit,omitempty"`
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+}
+
+// stats returns the limiter's overall state, with the state of each lane.
+func (l *laneLimiter) stats() limiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := limiterStats{Limit: l.total, InFlight: l.running, Lanes: make(map[string]laneStats)}
+	for c := ClassHealth; c < numClasses; c++ {
+		stats.Lanes[c.String()] = laneStats{
+			Limit:    l.limits[c],
+			InFlight: l.inFlight[c],
+			Queued:   len(l.queues[c]),
+		}
+	}
+	return stats
+}
+
+// laneHandler is like limitHandler, but with per-class limits and queueing.
+func (s *Server) laneHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := classifyRequest(r)
+		if !s.lanes.acquire(class) {
+			w.Header().Set("Retry-After", overloadedRetryAfter)
+			s.writeError(w, r, apierr.Overloaded())
+			return
+		}
+		defer s.lanes.release(class)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,183 @@
+// Tests for priority lanes
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyRequest(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		accept string
+		want   RequestClass
+	}{
+		{"GET", "/readyz", "", ClassHealth},
+		{"GET", "/stats", "", ClassHealth},
+		{"GET", "/albums", "", ClassRead},
+		{"GET", "/albums/a1", "", ClassRead},
+		{"POST", "/albums/lookup", "", ClassRead},
+		{"POST", "/albums", "", ClassWrite},
+		{"PUT", "/albums/a1", "", ClassWrite},
+		{"DELETE", "/albums/a1", "", ClassWrite},
+		{"GET", "/albums", ndjsonContentType, ClassBulk},
+		{"GET", "/sitemap.xml", "", ClassBulk},
+		{"GET", "/feed.atom", "", ClassBulk},
+		{"GET", "/audit", "", ClassBulk},
+		{"GET", "/export", "", ClassBulk},
+		{"POST", "/migration/backfill", "", ClassBulk},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.url, func(t *testing.T) {
+			request := newRequest(t, test.method, test.url, nil)
+			request.Header.Set("Accept", test.accept)
+			if got := classifyRequest(request); got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseLanes(t *testing.T) {
+	tests := []struct {
+		lanes string
+		want  map[RequestClass]int
+		err   string
+	}{
+		{"", map[RequestClass]int{}, ""},
+		{"health=10, bulk=0,", map[RequestClass]int{ClassHealth: 10, ClassBulk: 0}, ""},
+		{"read=5,write=2", map[RequestClass]int{ClassRead: 5, ClassWrite: 2}, ""},
+		{"read", nil, `lane "read" must be class=limit`},
+		{"export=1", nil, `unknown request class "export" (must be one of health, read, write, bulk)`},
+		{"bulk=-1", nil, "limit for bulk must be a non-negative integer"},
+	}
+	for _, test := range tests {
+		t.Run(test.lanes, func(t *testing.T) {
+			got, err := parseLanes(test.lanes)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// waitQueued waits until the lane for class has n requests queued.
+func waitQueued(t *testing.T, l *laneLimiter, class RequestClass, n int) {
+	t.Helper()
+	for l.stats().Lanes[class.String()].Queued < n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLaneLimiterPriority(t *testing.T) {
+	l := newLaneLimiter(1, nil, time.Minute)
+	if !l.acquire(ClassRead) {
+		t.Fatalf("acquire failed")
+	}
+
+	// Queue a bulk request, then a health check
+	started := make(chan RequestClass, 2)
+	go func() {
+		if l.acquire(ClassBulk) {
+			started <- ClassBulk
+		}
+	}()
+	waitQueued(t, l, ClassBulk, 1)
+	go func() {
+		if l.acquire(ClassHealth) {
+			started <- ClassHealth
+		}
+	}()
+	waitQueued(t, l, ClassHealth, 1)
+
+	// The health check goes first, even though it queued last
+	l.release(ClassRead)
+	if got := <-started; got != ClassHealth {
+		t.Fatalf("got %s first, want health", got)
+	}
+	l.release(ClassHealth)
+	if got := <-started; got != ClassBulk {
+		t.Fatalf("got %s second, want bulk", got)
+	}
+	l.release(ClassBulk)
+
+	stats := l.stats()
+	if stats.InFlight != 0 || stats.Lanes["bulk"].Queued != 0 {
+		t.Fatalf("bad stats at end: %#v", stats)
+	}
+}
+
+func TestLaneLimiterTimeout(t *testing.T) {
+	l := newLaneLimiter(0, map[RequestClass]int{ClassBulk: 1}, 10*time.Millisecond)
+	if !l.acquire(ClassBulk) {
+		t.Fatalf("acquire failed")
+	}
+
+	// The bulk lane is full, so another export times out in the queue, but
+	// other classes aren't held up
+	if l.acquire(ClassBulk) {
+		t.Fatalf("expected acquire to time out")
+	}
+	if !l.acquire(ClassRead) {
+		t.Fatalf("read acquire failed")
+	}
+	want := laneStats{Limit: 1, InFlight: 1}
+	if got := l.stats().Lanes["bulk"]; got != want {
+		t.Fatalf("bad bulk stats: got %#v, want %#v", got, want)
+	}
+}
+
+func TestLaneHandler(t *testing.T) {
+	db := newSlowDatabase()
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithMaxInFlight(2),
+		WithLanes(map[RequestClass]int{ClassRead: 1}, 0),
+	)
+
+	// Start a read that blocks in the database, and wait till it's in flight
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(t, server, newRequest(t, "GET", "/albums", nil))
+	}()
+	for server.lanes.stats().Lanes["read"].InFlight < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Other reads are rejected, but health checks still get through
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1", nil))
+	ensureError(t, result, http.StatusServiceUnavailable, "overloaded", nil)
+	if got := result.Header.Get("Retry-After"); got != "1" {
+		t.Fatalf("bad Retry-After header: got %q, want %q", got, "1")
+	}
+	result = serve(t, server, newRequest(t, "GET", "/stats", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var got struct {
+		Limiter limiterStats `json:"limiter"`
+	}
+	unmarshalResponse(t, result, &got)
+	if got.Limiter.Limit != 2 || got.Limiter.InFlight != 2 || got.Limiter.Lanes["read"].InFlight != 1 {
+		t.Fatalf("bad limiter stats: %#v", got.Limiter)
+	}
+
+	close(db.release)
+	<-done
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{"title": "x", "artist": "y"}`)))
+	ensureStatus(t, result, http.StatusCreated)
+}
@@ -0,0 +1,102 @@
+// Lifecycle management of the server's background goroutines
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// lifecycle tracks the server's background components (such as cache
+// janitors), so that Shutdown can stop them all and verify they've exited.
+// Every goroutine that outlives a request must be started with Go.
+type lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]int // component name -> number running
+	stopped bool
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel, running: make(map[string]int)}
+}
+
+// Go runs the named component in a new goroutine. The component must
+// return soon after ctx is cancelled. If the lifecycle has already been
+// stopped, the component isn't started and Go returns false.
+func (l *lifecycle) Go(name string, run func(ctx context.Context)) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return false
+	}
+	l.running[name]++
+	l.wg.Add(1)
+	go func() {
+		defer func() {
+			l.mu.Lock()
+			l.running[name]--
+			if l.running[name] == 0 {
+				delete(l.running, name)
+			}
+			l.mu.Unlock()
+			l.wg.Done()
+		}()
+		run(l.ctx)
+	}()
+	return true
+}
+
+// Stop cancels all components and waits for them to exit. If ctx is done
+// first, it returns an error listing the components still running.
+func (l *lifecycle) Stop(ctx context.Context) error {
+	l.mu.Lock()
+	l.stopped = true
+	l.mu.Unlock()
+	l.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stopping background components (%s still running): %w",
+			strings.Join(l.runningNames(), ", "), ctx.Err())
+	}
+}
+
+// runningNames returns the names of the components still running, sorted.
+func (l *lifecycle) runningNames() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	names := make([]string, 0, len(l.running))
+	for name := range l.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Shutdown stops the server's background components and waits for them to
+// exit, or for ctx to be done. Call it after http.Server.Shutdown has
+// finished serving requests. The server must not be used after Shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.events.stop()
+	return s.background.Stop(ctx)
+}
+
+// Close is like Shutdown, but waits indefinitely.
+func (s *Server) Close() error {
+	return s.Shutdown(context.Background())
+}
@@ -0,0 +1,61 @@
+// Tests for lifecycle management of background goroutines
+
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerCloseStopsBackground(t *testing.T) {
+	before := runtime.NumGoroutine()
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithDuplicateWindow(time.Millisecond))
+	if names := server.background.runningNames(); len(names) == 0 {
+		t.Fatalf("expected background components to be running")
+	}
+
+	err := server.Close()
+	if err != nil {
+		t.Fatalf("error closing server: %v", err)
+	}
+	if names := server.background.runningNames(); len(names) != 0 {
+		t.Fatalf("components still running after Close: %q", names)
+	}
+	ensureNoGoroutineLeak(t, before)
+}
+
+func TestLifecycleStopTimeout(t *testing.T) {
+	l := newLifecycle()
+	release := make(chan struct{})
+	l.Go("stuck", func(ctx context.Context) {
+		<-release // ignores ctx
+	})
+	l.Go("polite", func(ctx context.Context) {
+		<-ctx.Done()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := l.Stop(ctx)
+	if err == nil || !strings.Contains(err.Error(), "(stuck still running)") {
+		t.Fatalf("got error %v, want stuck component reported", err)
+	}
+	close(release)
+	err = l.Stop(context.Background())
+	if err != nil {
+		t.Fatalf("error stopping: %v", err)
+	}
+
+	// Components can't be started after Stop
+	started := make(chan struct{}, 1)
+	l.Go("late", func(ctx context.Context) { started <- struct{}{} })
+	time.Sleep(10 * time.Millisecond)
+	if len(started) != 0 {
+		t.Fatalf("component started after Stop")
+	}
+}
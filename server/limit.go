@@ -0,0 +1,158 @@
+// Concurrency limiter (load shedding) middleware
+
+package server
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// How long clients are asked to wait before retrying an overloaded server.
+const overloadedRetryAfter = "1"
+
+// limitHandler allows at most s.maxInFlight requests through to h at once.
+// Rather than queueing excess requests (which would let goroutines and
+// memory grow without bound under a load spike), it rejects them straight
+// away with a 503 and a Retry-After header.
+func (s *Server) limitHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case s.inFlight <- struct{}{}:
+			defer func() { <-s.inFlight }()
+			h.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", overloadedRetryAfter)
+			s.writeError(w, r, apierr.Overloaded())
+		}
+	})
+}
+
+// Bounds and backoff factor for the adaptive concurrency limit.
+const (
+	adaptiveMinLimit = 10  // or -max-in-flight, if that's lower
+	adaptiveBackoff  = 0.9 // multiplier applied to the limit when slow
+)
+
+// adaptiveLimiter is a concurrency limit that adapts to latency using
+// AIMD (additive increase, multiplicative decrease), like TCP congestion
+// control. It starts at the maximum; each request that takes longer than
+// the target latency shrinks the limit by adaptiveBackoff (at most once
+// per target latency, so one burst of slow requests doesn't collapse it),
+// and each fast request grows it by 1/limit, or about one per limit's
+// worth of requests. So when the database slows down, fewer requests pile
+// up waiting on it, and when it recovers the limit climbs back.
+type adaptiveLimiter struct {
+	target   time.Duration
+	min, max float64
+
+	mu           sync.Mutex
+	limit        float64
+	inFlight     int
+	lastDecrease time.Time
+}
+
+func newAdaptiveLimiter(max int, target time.Duration) *adaptiveLimiter {
+	min := adaptiveMinLimit
+	if max < min {
+		min = max
+	}
+	return &adaptiveLimiter{
+		target: target,
+		min:    float64(min),
+		max:    float64(max),
+		limit:  float64(max),
+	}
+}
+
+// acquire reserves a slot for a request, returning false if the server is
+// at its current limit.
+func (l *adaptiveLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight >= int(l.limit) {
+		return false
+	}
+	l.inFlight++
+	return true
+}
+
+// release frees a request's slot and adjusts the limit using the request's
+// latency, which is negative if it shouldn't be used (for example, a
+// streamed response that takes as long as the client reads).
+func (l *adaptiveLimiter) release(latency time.Duration, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inFlight := l.inFlight
+	l.inFlight--
+	switch {
+	case latency < 0:
+	case latency > l.target:
+		if now.Sub(l.lastDecrease) >= l.target {
+			l.limit = math.Max(l.min, l.limit*adaptiveBackoff)
+			l.lastDecrease = now
+		}
+	case 2*inFlight >= int(l.limit):
+		// Only grow the limit when it's being used, otherwise it would
+		// creep up to the maximum whenever the server is quiet
+		l.limit = math.Min(l.max, l.limit+1/l.limit)
+	}
+}
+
+// stats returns the limiter's current limit and in-flight requests.
+func (l *adaptiveLimiter) stats() limiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return limiterStats{Limit: int(l.limit), InFlight: l.inFlight, Adaptive: true}
+}
+
+// adaptiveLimitHandler is like limitHandler, but with the adaptive limit.
+func (s *Server) adaptiveLimitHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.adaptive.acquire() {
+			w.Header().Set("Retry-After", overloadedRetryAfter)
+			s.writeError(w, r, apierr.Overloaded())
+			return
+		}
+		start := s.now()
+		defer func() {
+			now := s.now()
+			latency := now.Sub(start)
+			if isStreaming(r) {
+				latency = -1
+			}
+			s.adaptive.release(latency, now)
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// limiterStats is the concurrency limiter's state, as reported by /stats.
+type limiterStats struct {
+	Limit    int  `json:"limit"`
+	InFlight int  `json:"in_flight"`
+	Adaptive bool `json:"adaptive"`
+
+	// Lanes is the state of each request class with priority lanes.
+	Lanes map[string]laneStats `json:"lanes,omitempty"`
+}
+
+// limiterStats returns the state of the concurrency limiter, or nil if
+// there's no limit.
+func (s *Server) limiterStats() *limiterStats {
+	switch {
+	case s.lanes != nil:
+		stats := s.lanes.stats()
+		return &stats
+	case s.adaptive != nil:
+		stats := s.adaptive.stats()
+		return &stats
+	case s.inFlight != nil:
+		return &limiterStats{Limit: cap(s.inFlight), InFlight: len(s.inFlight)}
+	default:
+		return nil
+	}
+}
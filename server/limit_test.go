@@ -0,0 +1,148 @@
+// Tests for the concurrency limiter middleware
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMaxInFlight(t *testing.T) {
+	db := newSlowDatabase()
+	server := NewServer(db, log.New(io.Discard, "", 0), WithMaxInFlight(1))
+
+	// Start a request that blocks in the database, and wait till it's in flight
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(t, server, newRequest(t, "GET", "/albums", nil))
+	}()
+	for len(server.inFlight) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Next request should be rejected straight away
+	result := serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusServiceUnavailable)
+	ensureError(t, result, http.StatusServiceUnavailable, "overloaded", nil)
+	retryAfter := result.Header.Get("Retry-After")
+	if retryAfter != "1" {
+		t.Fatalf("bad Retry-After header: got %q, want %q", retryAfter, "1")
+	}
+
+	// Once the first request finishes, requests are allowed through again
+	close(db.release)
+	<-done
+	result = serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := newAdaptiveLimiter(20, 100*time.Millisecond)
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	if got := l.stats().Limit; got != 20 {
+		t.Fatalf("bad initial limit: got %d, want 20", got)
+	}
+
+	// A burst of slow requests only backs off once per target latency
+	for i := 0; i < 5; i++ {
+		if !l.acquire() {
+			t.Fatalf("acquire %d failed", i)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		l.release(time.Second, now)
+	}
+	if got := l.stats().Limit; got != 18 {
+		t.Fatalf("bad limit after slow burst: got %d, want 18", got)
+	}
+
+	// It keeps backing off while requests are slow, but not below the minimum
+	for i := 0; i < 50; i++ {
+		now = now.Add(100 * time.Millisecond)
+		l.acquire()
+		l.release(time.Second, now)
+	}
+	if got := l.stats().Limit; got != adaptiveMinLimit {
+		t.Fatalf("bad limit after slowness: got %d, want %d", got, adaptiveMinLimit)
+	}
+
+	// Requests that exceed the limit are rejected
+	for i := 0; i < adaptiveMinLimit; i++ {
+		if !l.acquire() {
+			t.Fatalf("acquire %d failed", i)
+		}
+	}
+	if l.acquire() {
+		t.Fatalf("expected acquire to fail at the limit")
+	}
+
+	// Fast requests while the limit is in use raise it again, up to the max
+	for i := 0; i < 1000; i++ {
+		l.release(time.Millisecond, now)
+		l.acquire()
+	}
+	if got := l.stats(); got.Limit != 20 || got.InFlight != adaptiveMinLimit {
+		t.Fatalf("bad stats after recovery: %#v", got)
+	}
+
+	// Fast requests on a quiet server don't raise the limit
+	l = newAdaptiveLimiter(20, 100*time.Millisecond)
+	l.acquire()
+	l.release(time.Second, now)
+	for i := 0; i < 1000; i++ {
+		l.acquire()
+		l.release(time.Millisecond, now)
+	}
+	if got := l.stats().Limit; got != 18 {
+		t.Fatalf("bad limit on quiet server: got %d, want 18", got)
+	}
+
+	// Samples with negative latency are ignored
+	l.acquire()
+	l.release(-1, now.Add(time.Hour))
+	if got := l.stats(); got.Limit != 18 || got.InFlight != 0 {
+		t.Fatalf("bad stats after ignored sample: %#v", got)
+	}
+}
+
+func TestAdaptiveLimitHandler(t *testing.T) {
+	db := newSlowDatabase()
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithMaxInFlight(1),
+		WithAdaptiveLimit(time.Second),
+	)
+
+	// Start a request that blocks in the database, and wait till it's in flight
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(t, server, newRequest(t, "GET", "/albums", nil))
+	}()
+	for server.adaptive.stats().InFlight < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	result := serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureError(t, result, http.StatusServiceUnavailable, "overloaded", nil)
+	if got := result.Header.Get("Retry-After"); got != "1" {
+		t.Fatalf("bad Retry-After header: got %q, want %q", got, "1")
+	}
+
+	close(db.release)
+	<-done
+	result = serve(t, server, newRequest(t, "GET", "/stats", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var got struct {
+		Limiter limiterStats `json:"limiter"`
+	}
+	unmarshalResponse(t, result, &got)
+	want := limiterStats{Limit: 1, InFlight: 1, Adaptive: true} // the /stats request itself
+	if !reflect.DeepEqual(got.Limiter, want) {
+		t.Fatalf("bad limiter stats: got %#v, want %#v", got.Limiter, want)
+	}
+}
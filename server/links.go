@@ -0,0 +1,122 @@
+// Links to resources, such as the Location header on create
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// WithBaseURL sets the external base URL of the API, like
+// "https://example.com/api", used to make resource links absolute. This is
+// needed when the server runs behind a reverse proxy that changes the host
+// or path prefix. The default of nil means links are relative paths like
+// "/albums/a1".
+func WithBaseURL(base *url.URL) Option {
+	return func(s *Server) {
+		s.baseURL = base
+	}
+}
+
+// WithPublicURLTemplate sets the URL of an album's public web page, with
+// "{id}" replaced by the (escaped) album ID, for example
+// "https://shop.example.com/catalog/{id}". It's used in album QR codes and
+// in the sitemap and feed. The default is the album's API URL (see
+// WithBaseURL).
+func WithPublicURLTemplate(template string) Option {
+	return func(s *Server) {
+		s.publicURLTemplate = template
+	}
+}
+
+// WithSelfLinks enables a "links" object with a "self" link to the new
+// resource in create responses.
+func WithSelfLinks(enabled bool) Option {
+	return func(s *Server) {
+		s.selfLinks = enabled
+	}
+}
+
+// parseBaseURL parses and checks a base URL given on the command line. It
+// must be absolute, and can't include a query or fragment.
+func parseBaseURL(raw string) (*url.URL, error) {
+	base, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("base URL %q must be an absolute http or https URL", raw)
+	}
+	if base.RawQuery != "" || base.Fragment != "" {
+		return nil, fmt.Errorf("base URL %q must not have a query or fragment", raw)
+	}
+	return base, nil
+}
+
+// checkPublicURLTemplate returns an error if template isn't an absolute
+// http or https URL containing "{id}".
+func checkPublicURLTemplate(template string) error {
+	if !strings.Contains(template, "{id}") {
+		return fmt.Errorf("public URL template %q must contain {id}", template)
+	}
+	u, err := url.Parse(strings.ReplaceAll(template, "{id}", "id"))
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("public URL template %q must be an absolute http or https URL", template)
+	}
+	return nil
+}
+
+// resourceURL returns the link to the resource at path (which must already
+// be escaped), relative to the base URL if one is set.
+func (s *Server) resourceURL(path string) string {
+	if s.baseURL == nil {
+		return path
+	}
+	return strings.TrimSuffix(s.baseURL.String(), "/") + path
+}
+
+// albumURL returns the link to the album with the given ID, under /v1 if
+// the request was made to a /v1 route.
+func (s *Server) albumURL(r *http.Request, id string) string {
+	return s.resourceURL(apiPrefix(r) + "/albums/" + url.PathEscape(id))
+}
+
+// absoluteURL returns the absolute URL of the resource at path. With a
+// base URL that's the same as resourceURL, otherwise it uses the host the
+// request was made to.
+func (s *Server) absoluteURL(r *http.Request, path string) string {
+	if s.baseURL != nil {
+		return s.resourceURL(path)
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
+
+// publicAlbumURL returns the absolute URL of the album's public web page,
+// for links that leave the API, like QR codes and the sitemap.
+func (s *Server) publicAlbumURL(r *http.Request, id string) string {
+	if s.publicURLTemplate != "" {
+		return strings.ReplaceAll(s.publicURLTemplate, "{id}", url.PathEscape(id))
+	}
+	return s.absoluteURL(r, "/albums/"+url.PathEscape(id))
+}
+
+// resourceLinks is the "links" object in a response.
+type resourceLinks struct {
+	Self string `json:"self"`
+}
+
+// createdAlbum is the response to creating an album: the album itself, plus
+// a self link if enabled.
+type createdAlbum struct {
+	Album
+	Links *resourceLinks `json:"links,omitempty"`
+}
@@ -0,0 +1,108 @@
+// Tests for resource links
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAddAlbumLinks(t *testing.T) {
+	tests := []struct {
+		name         string
+		baseURL      string
+		selfLinks    bool
+		wantLocation string
+		wantSelf     string
+	}{
+		{"relative", "", false, "/albums/a%2F9", ""},
+		{"self", "", true, "/albums/a%2F9", "/albums/a%2F9"},
+		{"base", "https://example.com/api", false, "https://example.com/api/albums/a%2F9", ""},
+		{"base-slash", "https://example.com/api/", true, "https://example.com/api/albums/a%2F9", "https://example.com/api/albums/a%2F9"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := []Option{WithSelfLinks(test.selfLinks)}
+			if test.baseURL != "" {
+				base, err := parseBaseURL(test.baseURL)
+				if err != nil {
+					t.Fatalf("error parsing base URL: %v", err)
+				}
+				options = append(options, WithBaseURL(base))
+			}
+			server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), options...)
+
+			body := `{"id": "a/9", "title": "Pianoman", "artist": "Billy Joel"}`
+			result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+			ensureStatus(t, result, http.StatusCreated)
+			location := result.Header.Get("Location")
+			if location != test.wantLocation {
+				t.Fatalf("bad Location header: got %q, want %q", location, test.wantLocation)
+			}
+
+			var got struct {
+				ID    string            `json:"id"`
+				Links map[string]string `json:"links"`
+			}
+			unmarshalResponse(t, result, &got)
+			if got.ID != "a/9" {
+				t.Fatalf("bad ID: got %q, want %q", got.ID, "a/9")
+			}
+			if got.Links["self"] != test.wantSelf {
+				t.Fatalf("bad self link: got %q, want %q", got.Links["self"], test.wantSelf)
+			}
+			if test.wantSelf == "" && got.Links != nil {
+				t.Fatalf("got unexpected links: %v", got.Links)
+			}
+		})
+	}
+}
+
+func TestParseBaseURL(t *testing.T) {
+	tests := []struct {
+		raw string
+		ok  bool
+	}{
+		{"https://example.com", true},
+		{"http://localhost:8080/api/", true},
+		{"/api", false},
+		{"example.com", false},
+		{"ftp://example.com", false},
+		{"https://example.com/api?x=1", false},
+		{"https://example.com/api#top", false},
+		{"https://%zz", false},
+	}
+	for _, test := range tests {
+		t.Run(test.raw, func(t *testing.T) {
+			_, err := parseBaseURL(test.raw)
+			if (err == nil) != test.ok {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestCheckPublicURLTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		ok       bool
+	}{
+		{"https://shop.example.com/catalog/{id}", true},
+		{"http://localhost:8080/a?id={id}", true},
+		{"https://shop.example.com/catalog/", false},
+		{"/catalog/{id}", false},
+		{"ftp://shop.example.com/{id}", false},
+		{"https://%zz/{id}", false},
+	}
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			err := checkPublicURLTemplate(test.template)
+			if (err == nil) != test.ok {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
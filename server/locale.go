@@ -0,0 +1,140 @@
+// Locale-aware formatting of prices and dates for human-readable output
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// locale holds the formatting conventions for one language and region.
+// It doesn't depend on HTTP, so other human-readable output (like a CLI
+// listing) can format values the same way as the HTML views.
+type locale struct {
+	tag      string // BCP 47 language tag, like "en-US"
+	decimal  string // decimal separator
+	group    string // thousands separator
+	currency string // price format, with %s replaced by the number
+	date     string // date format: %[1]d is the day, %[2]s the month, %[3]d the year
+	months   [12]string
+}
+
+// locales are the supported locales. The first locale for each language is
+// used when only the language matches, and the first of all is the default.
+var locales = []*locale{
+	{
+		tag: "en-US", decimal: ".", group: ",", currency: "$%s", date: "%[2]s %[1]d, %[3]d",
+		months: [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+	},
+	{
+		tag: "en-GB", decimal: ".", group: ",", currency: "US$%s", date: "%[1]d %[2]s %[3]d",
+		months: [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+	},
+	{
+		tag: "de-DE", decimal: ",", group: ".", currency: "%s\u00a0$", date: "%[1]d. %[2]s %[3]d",
+		months: [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+	},
+	{
+		tag: "fr-FR", decimal: ",", group: "\u202f", currency: "%s\u00a0$US", date: "%[1]d %[2]s %[3]d",
+		months: [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+	},
+	{
+		tag: "es-ES", decimal: ",", group: ".", currency: "%s\u00a0US$", date: "%[1]d de %[2]s de %[3]d",
+		months: [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+	},
+}
+
+// matchLocale returns the supported locale that best matches an
+// Accept-Language header value, trying the client's preferences in order
+// of quality. Each language tag matches a locale exactly, or failing that
+// by language alone. It returns the default locale if nothing matches.
+func matchLocale(acceptLanguage string) *locale {
+	for _, tag := range parseAcceptLanguage(acceptLanguage) {
+		for _, l := range locales {
+			if strings.ToLower(l.tag) == tag {
+				return l
+			}
+		}
+		language := strings.SplitN(tag, "-", 2)[0]
+		for _, l := range locales {
+			if strings.HasPrefix(strings.ToLower(l.tag), language+"-") {
+				return l
+			}
+		}
+	}
+	return locales[0]
+}
+
+// parseAcceptLanguage returns the language tags in an Accept-Language
+// header value, lowercased and sorted by quality (highest first), without
+// those with zero quality. A "*" and any tags after it are left out, as
+// they mean the client will take whatever the server's default is.
+func parseAcceptLanguage(acceptLanguage string) []string {
+	type preference struct {
+		tag     string
+		quality float64
+	}
+	var preferences []preference
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		if tag == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					q = 0
+				}
+				quality = q
+			}
+		}
+		if quality > 0 {
+			preferences = append(preferences, preference{tag, quality})
+		}
+	}
+	sort.SliceStable(preferences, func(i, j int) bool {
+		return preferences[i].quality > preferences[j].quality
+	})
+
+	var tags []string
+	for _, p := range preferences {
+		if p.tag == "*" {
+			break
+		}
+		tags = append(tags, p.tag)
+	}
+	return tags
+}
+
+// formatPrice formats a price in cents, like "$1,234.50" in en-US or
+// "1.234,50 $" in de-DE (with a no-break space before the symbol).
+func (l *locale) formatPrice(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	whole := strconv.Itoa(cents / 100)
+	var grouped strings.Builder
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped.WriteString(l.group)
+		}
+		grouped.WriteRune(digit)
+	}
+	number := fmt.Sprintf("%s%s%02d", grouped.String(), l.decimal, cents%100)
+	return sign + fmt.Sprintf(l.currency, number)
+}
+
+// formatDate formats the date part of t, like "June 1, 2021" in en-US or
+// "1. Juni 2021" in de-DE.
+func (l *locale) formatDate(t time.Time) string {
+	return fmt.Sprintf(l.date, t.Day(), l.months[t.Month()-1], t.Year())
+}
@@ -0,0 +1,110 @@
+// Tests for locale-aware formatting
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchLocale(t *testing.T) {
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "en-US"},
+		{"*", "en-US"},
+		{"en-GB", "en-GB"},
+		{"EN-gb", "en-GB"},
+		{"en", "en-US"},
+		{"en-AU", "en-US"},
+		{"de-AT, en;q=0.5", "de-DE"},
+		{"ja, fr;q=0.8, de;q=0.9", "de-DE"},
+		{"fr-CA;q=0.1, es;q=0.2", "es-ES"},
+		{"de;q=0, fr", "fr-FR"},
+		{"ja, zh", "en-US"},
+		{"nl, *;q=0.5, de;q=0.1", "en-US"},
+	}
+	for _, test := range tests {
+		t.Run(test.acceptLanguage, func(t *testing.T) {
+			got := matchLocale(test.acceptLanguage).tag
+			if got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatPrice(t *testing.T) {
+	tests := []struct {
+		tag   string
+		cents int
+		want  string
+	}{
+		{"en-US", 795, "$7.95"},
+		{"en-US", 5, "$0.05"},
+		{"en-US", 123456789, "$1,234,567.89"},
+		{"en-US", -2000, "-$20.00"},
+		{"en-GB", 100000, "US$1,000.00"},
+		{"de-DE", 123450, "1.234,50\u00a0$"},
+		{"fr-FR", 123450, "1\u202f234,50\u00a0$US"},
+		{"es-ES", 795, "7,95\u00a0US$"},
+	}
+	for _, test := range tests {
+		t.Run(test.tag+"/"+test.want, func(t *testing.T) {
+			got := matchLocale(test.tag).formatPrice(test.cents)
+			if got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	date := time.Date(2021, 3, 7, 23, 0, 0, 0, time.UTC)
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"en-US", "March 7, 2021"},
+		{"en-GB", "7 March 2021"},
+		{"de-DE", "7. März 2021"},
+		{"fr-FR", "7 mars 2021"},
+		{"es-ES", "7 de marzo de 2021"},
+	}
+	for _, test := range tests {
+		t.Run(test.tag, func(t *testing.T) {
+			got := matchLocale(test.tag).formatDate(date)
+			if got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetAlbumHTMLLocale(t *testing.T) {
+	server := newTestServer()
+	request := newRequest(t, "GET", "/albums/a2", nil)
+	request.Header.Set("Accept", browserAccept)
+	request.Header.Set("Accept-Language", "de-CH, de;q=0.9, en;q=0.8")
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Content-Language"); got != "de-DE" {
+		t.Fatalf("bad Content-Language: got %q, want %q", got, "de-DE")
+	}
+	if got := result.Header.Values("Vary"); strings.Join(got, ", ") != "Accept, Accept-Language" {
+		t.Fatalf("bad Vary headers: %q", got)
+	}
+	b, err := io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	for _, want := range []string{`<html lang="de-DE">`, "<p>20,00\u00a0$</p>"} {
+		if !strings.Contains(string(b), want) {
+			t.Fatalf("page doesn't contain %s:\n%s", want, b)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+// Optimistic locking: album versions as ETags
+
+package server
+
+import (
+	"strconv"
+	"strings"
+)
+
+// albumETag returns the ETag for the given version of an album.
+func albumETag(album Album) string {
+	return `"` + strconv.Itoa(album.Version) + `"`
+}
+
+// parseVersionETag parses an If-Match header containing a single album
+// ETag, returning the version and true, or false if it's not valid.
+func parseVersionETag(ifMatch string) (int, bool) {
+	etag := strings.TrimSpace(ifMatch)
+	if len(etag) < 3 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.Atoi(etag[1 : len(etag)-1])
+	if err != nil || version < 1 {
+		return 0, false
+	}
+	return version, true
+}
@@ -0,0 +1,98 @@
+// Tests for optimistic locking with album versions
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAlbumVersions(t *testing.T) {
+	server := newTestServer()
+	ensureVersion(t, server, "a1", 1)
+
+	// Adding a track is a change to the album
+	body := `{"title": "Ode to Joy", "duration": 600}`
+	result := serve(t, server, newRequest(t, "POST", "/albums/a1/tracks", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	ensureVersion(t, server, "a1", 2)
+
+	// Replacing at the current version (from the ETag) increments it
+	request := newRequest(t, "PUT", "/albums/a1", strings.NewReader(`{"title": "5th Symphony", "artist": "Beethoven"}`))
+	request.Header.Set("If-Match", `"2"`)
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	if etag := result.Header.Get("ETag"); etag != `"3"` {
+		t.Fatalf("bad ETag: got %q, want %q", etag, `"3"`)
+	}
+	ensureVersion(t, server, "a1", 3)
+}
+
+func TestPutAlbumStale(t *testing.T) {
+	server := newTestServer()
+	tests := []struct {
+		name    string
+		ifMatch string
+		version string
+		status  int
+		code    string
+	}{
+		{"stale-if-match", `"2"`, "", http.StatusConflict, "conflict"},
+		{"stale-body", "", "2", http.StatusConflict, "conflict"},
+		{"if-match-wins", `"2"`, "1", http.StatusConflict, "conflict"},
+		{"missing", "", "", http.StatusPreconditionRequired, "precondition-required"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := `{"title": "Let It Be", "artist": "The Beatles"`
+			if test.version != "" {
+				body += `, "version": ` + test.version
+			}
+			request := newRequest(t, "PUT", "/albums/a2", strings.NewReader(body+"}"))
+			if test.ifMatch != "" {
+				request.Header.Set("If-Match", test.ifMatch)
+			}
+			result := serve(t, server, request)
+			ensureStatus(t, result, test.status)
+			ensureError(t, result, test.status, test.code, nil)
+		})
+	}
+
+	// Album wasn't changed
+	want := testAlbum{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000}
+	testGetAlbum(t, server, getAlbumTest{"/albums/a2", http.StatusOK, want})
+	ensureVersion(t, server, "a2", 1)
+}
+
+func TestPutAlbumBadIfMatch(t *testing.T) {
+	server := newTestServer()
+	for _, ifMatch := range []string{"1", `"x"`, `"0"`, `W/"1"`, `"1", "2"`} {
+		request := newRequest(t, "PUT", "/albums/a2", strings.NewReader(`{"title": "Let It Be", "artist": "The Beatles"}`))
+		request.Header.Set("If-Match", ifMatch)
+		result := serve(t, server, request)
+		ensureStatus(t, result, http.StatusBadRequest)
+		data := map[string]interface{}{
+			"If-Match": map[string]interface{}{"error": "invalid", "message": `If-Match must be the album's ETag, like "1"`},
+		}
+		ensureError(t, result, http.StatusBadRequest, "validation", data)
+	}
+}
+
+// ensureVersion checks the version of an album and its ETag.
+func ensureVersion(t *testing.T, server *Server, id string, want int) {
+	t.Helper()
+	result := serve(t, server, newRequest(t, "GET", "/albums/"+id, nil))
+	ensureStatus(t, result, http.StatusOK)
+	var got struct {
+		Version int `json:"version"`
+	}
+	unmarshalResponse(t, result, &got)
+	if got.Version != want {
+		t.Fatalf("bad version: got %d, want %d", got.Version, want)
+	}
+	wantETag := albumETag(Album{Version: want})
+	if etag := result.Header.Get("ETag"); etag != wantETag {
+		t.Fatalf("bad ETag: got %q, want %q", etag, wantETag)
+	}
+}
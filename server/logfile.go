@@ -0,0 +1,101 @@
+// Log file with rotation
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// By default the server logs to stderr, leaving rotation to whatever
+// collects it (systemd, Docker, and so on). With -log-file it appends to
+// a file instead, and the rotate-logs job (-schedule rotate-logs=24h)
+// renames the current file to one with a timestamp suffix, like
+// server.log.20240102-150405, and starts a new one. Only the most recent
+// maxRotatedLogs rotated files are kept.
+const maxRotatedLogs = 7
+
+// logFile is an io.Writer that appends to a log file that can be rotated.
+// It's safe for concurrent use.
+type logFile struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openLogFile opens (or creates) the log file at path for appending.
+func openLogFile(path string) (*logFile, error) {
+	f := &logFile{path: path}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	return nil
+}
+
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Write(p)
+}
+
+// Rotate renames the current log file with a suffix for time now, starts
+// a new one, and removes the oldest rotated files.
+func (f *logFile) Rotate(now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rotated := f.path + "." + now.UTC().Format("20060102-150405")
+	err := os.Rename(f.path, rotated)
+	if err != nil {
+		return err
+	}
+	// Open the new file before closing the old one, so if that fails the
+	// log still goes somewhere
+	old := f.file
+	err = f.open()
+	if err != nil {
+		f.file = old
+		return fmt.Errorf("opening new log file: %w", err)
+	}
+	old.Close()
+
+	matches, err := filepath.Glob(f.path + ".????????-??????")
+	if err != nil {
+		return err
+	}
+	sort.Strings(matches) // the timestamps sort by time
+	for len(matches) > maxRotatedLogs {
+		os.Remove(matches[0])
+		matches = matches[1:]
+	}
+	return nil
+}
+
+// Close closes the log file.
+func (f *logFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// rotateLogsJob returns a job that rotates f every interval.
+func rotateLogsJob(f *logFile, interval time.Duration, now func() time.Time) Job {
+	return Job{Name: "rotate-logs", Interval: interval, Run: func(ctx context.Context) error {
+		return f.Rotate(now())
+	}}
+}
@@ -0,0 +1,52 @@
+// Tests for the log file with rotation
+
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogFileRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.log")
+	f, err := openLogFile(path)
+	if err != nil {
+		t.Fatalf("error opening log file: %v", err)
+	}
+	defer f.Close()
+	logger := log.New(f, "", 0)
+	os.WriteFile(filepath.Join(dir, "server.log.bak"), nil, 0o644) // not a rotated file
+
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < maxRotatedLogs+2; i++ {
+		logger.Printf("line %d", i)
+		job := rotateLogsJob(f, time.Hour, func() time.Time { return start.Add(time.Duration(i) * time.Hour) })
+		err := job.Run(context.Background())
+		if err != nil {
+			t.Fatalf("error rotating: %v", err)
+		}
+	}
+	logger.Print("current")
+
+	b, _ := os.ReadFile(path)
+	if string(b) != "current\n" {
+		t.Fatalf("got current log %q", b)
+	}
+	matches, _ := filepath.Glob(path + ".2024*")
+	if len(matches) != maxRotatedLogs {
+		t.Fatalf("got %d rotated files, want %d", len(matches), maxRotatedLogs)
+	}
+	// The oldest two were removed
+	b, _ = os.ReadFile(path + ".20240102-020000")
+	if string(b) != "line 2\n" {
+		t.Fatalf("got oldest rotated log %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "server.log.bak")); err != nil {
+		t.Fatalf("other file was removed: %v", err)
+	}
+}
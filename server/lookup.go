@@ -0,0 +1,92 @@
+// Batch lookup of albums by ID
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Maximum number of IDs in a single lookup request.
+const maxLookupIDs = 100
+
+// lookupRequest is the body of a POST /albums/lookup request.
+type lookupRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// lookupResponse is the response to a lookup: the albums found, and the
+// requested IDs that weren't found (both sorted by ID).
+type lookupResponse struct {
+	Albums  []Album  `json:"albums"`
+	Missing []string `json:"missing"`
+}
+
+func (s *Server) lookupAlbums(w http.ResponseWriter, r *http.Request) {
+	var request lookupRequest
+	if !s.readJSON(w, r, &request) {
+		return
+	}
+
+	issues := make(map[string]interface{})
+	switch {
+	case len(request.IDs) == 0:
+		issues["ids"] = validationIssue{"required", ""}
+	case len(request.IDs) > maxLookupIDs:
+		issues["ids"] = validationIssue{"too-many", fmt.Sprintf("at most %d ids can be looked up at once", maxLookupIDs)}
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+
+	// Remove duplicate IDs before asking the database
+	seen := make(map[string]bool, len(request.IDs))
+	var ids []string
+	for _, id := range request.IDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	albums, err := s.db.GetAlbumsByIDs(ids)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("looking up %d albums: %w", len(ids), err)))
+		return
+	}
+
+	// Unpublished and deleted albums are reported as missing, as if they
+	// don't exist
+	albums = filterVisible(albums, s.now(), false)
+	for _, album := range albums {
+		delete(seen, album.ID)
+	}
+	missing := make([]string, 0, len(seen))
+	for id := range seen {
+		missing = append(missing, id)
+	}
+	sort.Strings(missing)
+
+	s.writeJSON(w, r, http.StatusOK, lookupResponse{Albums: s.redactAlbums(r, albums), Missing: missing})
+}
+
+func (d *MemoryDatabase) GetAlbumsByIDs(ids []string) ([]Album, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	albums := make([]Album, 0, len(ids))
+	added := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		album, ok := d.albums[id]
+		if ok && !added[id] {
+			albums = append(albums, album)
+			added[id] = true
+		}
+	}
+	sortAlbums(albums)
+	return albums, nil
+}
@@ -0,0 +1,94 @@
+// Tests for the batch album lookup endpoint
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookupAlbums(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000})
+	db.AddAlbum(Album{ID: "a3", Title: "Pianoman", Artist: "Billy Joel", PublishAt: &later})
+	server := NewServer(db, log.New(io.Discard, "", 0), WithClock(func() time.Time { return now }))
+
+	body := `{"ids": ["a2", "a9", "a1", "a3", "a2"]}`
+	result := serve(t, server, newRequest(t, "POST", "/albums/lookup", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusOK)
+	var got struct {
+		Albums  []testAlbum `json:"albums"`
+		Missing []string    `json:"missing"`
+	}
+	unmarshalResponse(t, result, &got)
+	wantAlbums := []testAlbum{
+		{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795},
+		{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000},
+	}
+	if !reflect.DeepEqual(got.Albums, wantAlbums) {
+		t.Fatalf("bad albums: got vs want:\n%#v\n%#v", got.Albums, wantAlbums)
+	}
+	// Unpublished albums are reported as missing too
+	wantMissing := []string{"a3", "a9"}
+	if !reflect.DeepEqual(got.Missing, wantMissing) {
+		t.Fatalf("bad missing IDs: got %q, want %q", got.Missing, wantMissing)
+	}
+}
+
+func TestLookupAlbumsNoneFound(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "POST", "/albums/lookup", strings.NewReader(`{"ids": ["x"]}`)))
+	ensureStatus(t, result, http.StatusOK)
+	var got map[string]interface{}
+	unmarshalResponse(t, result, &got)
+	want := map[string]interface{}{
+		"albums":  []interface{}{},
+		"missing": []interface{}{"x"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad response: got vs want:\n%#v\n%#v", got, want)
+	}
+}
+
+func TestLookupAlbumsValidation(t *testing.T) {
+	server := newTestServer()
+
+	result := serve(t, server, newRequest(t, "POST", "/albums/lookup", strings.NewReader(`{}`)))
+	ensureStatus(t, result, http.StatusBadRequest)
+	data := map[string]interface{}{
+		"ids": map[string]interface{}{"error": "required"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+
+	ids := make([]string, maxLookupIDs+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%q", fmt.Sprint(i))
+	}
+	body := `{"ids": [` + strings.Join(ids, ",") + `]}`
+	result = serve(t, server, newRequest(t, "POST", "/albums/lookup", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusBadRequest)
+	data = map[string]interface{}{
+		"ids": map[string]interface{}{"error": "too-many", "message": "at most 100 ids can be looked up at once"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+
+	result = serve(t, server, newRequest(t, "GET", "/albums/lookup", nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+	ensureError(t, result, http.StatusMethodNotAllowed, "method-not-allowed", nil)
+}
+
+func TestLookupAlbumsDatabaseError(t *testing.T) {
+	server := NewServer(errorDatabase{}, log.New(io.Discard, "", 0))
+	result := serve(t, server, newRequest(t, "POST", "/albums/lookup", strings.NewReader(`{"ids": ["a1"]}`)))
+	ensureStatus(t, result, http.StatusInternalServerError)
+	ensureError(t, result, http.StatusInternalServerError, "database", nil)
+}
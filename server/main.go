@@ -0,0 +1,1957 @@
+// Package server is the album API server: the Server handler, its
+// options, and the in-memory database. The web-service-stdlib command
+// runs it with Main, and the testfixtures package runs it in-process
+// for integration tests.
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Main runs the server as configured by the command line flags.
+func Main() {
+	// Allow user to specify listen port on command line
+	var port int
+	flag.IntVar(&port, "port", 8080, "port to listen on")
+
+	// Allow user to serve the runtime debug endpoints (pprof profiles and
+	// expvar memory stats) on a separate address that isn't public
+	var debugAddr string
+	flag.StringVar(&debugAddr, "debug-addr", "", "`address` to serve /debug/pprof/ and /debug/vars on, like localhost:6060 (default is not to serve them)")
+
+	// Allow user to accept HTTP/2 without TLS (h2c), for use behind proxies
+	// or inside meshes that speak it to the server
+	var h2c bool
+	flag.BoolVar(&h2c, "h2c", false, "accept unencrypted HTTP/2 connections with prior knowledge, as well as HTTP/1")
+
+	// Allow user to tune the HTTP server's timeouts and limits. The defaults
+	// are much stricter than net/http's (which has no timeouts at all), to
+	// protect against slowloris-style clients that hold connections open.
+	var (
+		readTimeout       time.Duration
+		readHeaderTimeout time.Duration
+		writeTimeout      time.Duration
+		idleTimeout       time.Duration
+		maxHeaderBytes    int
+	)
+	flag.DurationVar(&readTimeout, "read-timeout", 10*time.Second, "max time to read entire request, including body")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 5*time.Second, "max time to read request headers")
+	flag.DurationVar(&writeTimeout, "write-timeout", 10*time.Second, "max time to write response")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 60*time.Second, "max time to wait for next request on keep-alive connection")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "max size of request headers in bytes")
+
+	// Allow user to limit how long each request's handler can take (this
+	// should be less than the write timeout for the timeout response to
+	// make it through)
+	var handlerTimeout time.Duration
+	flag.DurationVar(&handlerTimeout, "handler-timeout", 5*time.Second, "max time for handler to produce response (0 to disable)")
+
+	// Allow user to limit how long a graceful shutdown can take
+	var shutdownTimeout time.Duration
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "max time to wait for requests and background tasks on shutdown")
+
+	// Allow user to cap the number of requests handled at once, to shed
+	// load rather than use unbounded goroutines and memory
+	var maxInFlight int
+	flag.IntVar(&maxInFlight, "max-in-flight", 1000, "max number of requests handled concurrently (0 for no limit)")
+
+	// Allow user to adapt the concurrency limit to latency, so it tightens
+	// when the backend slows down, instead of always allowing the maximum
+	var targetLatency time.Duration
+	flag.DurationVar(&targetLatency, "target-latency", 0, "lower the concurrency limit while requests take longer than this (0 for a fixed -max-in-flight)")
+
+	// Allow user to give each class of request its own concurrency limit,
+	// so that (say) exports can't starve health checks and reads
+	var lanes string
+	flag.StringVar(&lanes, "lanes", "", "comma-separated per-class concurrency `limits` like health=10,bulk=20 (classes: health, read, write, bulk)")
+	var laneQueueTimeout time.Duration
+	flag.DurationVar(&laneQueueTimeout, "lane-queue-timeout", 100*time.Millisecond, "max time a request waits in its lane for a free slot")
+
+	// Allow user to limit the size of the in-memory database, so that a
+	// constrained container gets explicit errors rather than running out
+	// of memory
+	var maxAlbums int
+	var maxDBBytes int64
+	flag.IntVar(&maxAlbums, "max-albums", 0, "max number of albums in database (0 for no limit)")
+	flag.Int64Var(&maxDBBytes, "max-db-bytes", 0, "max approximate size of database in bytes (0 for no limit)")
+
+	// Limit how much album history is kept for GET /albums/:id/versions
+	var maxVersions int
+	flag.IntVar(&maxVersions, "max-versions", 100, "max number of prior versions kept per album (0 for no limit)")
+
+	// Allow user to load the database from a fixture file instead of the
+	// sample albums
+	var seedFile string
+	flag.StringVar(&seedFile, "seed", "", "JSON or CSV fixture `file` of albums (and genres) to load on startup, or \"none\" to start empty (default is a couple of sample albums)")
+
+	// Allow user to choose how strictly album prices are parsed
+	var priceInput string
+	flag.StringVar(&priceInput, "price-input", "strict", "price input mode: strict (integer cents only) or tolerant")
+
+	// Allow user to choose the format of IDs generated for new albums
+	var idFormat string
+	flag.StringVar(&idFormat, "id-format", "uuid", "format of generated album IDs: uuid, ulid, or sequential (id1, id2, ..., for integration tests)")
+
+	// Allow user to detect accidental duplicate submissions (like a
+	// double-click) and return the original response instead
+	var duplicateWindow time.Duration
+	flag.DurationVar(&duplicateWindow, "duplicate-window", 0, "return original response to identical POSTs from same client within this window (0 to disable)")
+
+	// Allow user to set how long Idempotency-Key headers are remembered
+	var idempotencyTTL time.Duration
+	flag.DurationVar(&idempotencyTTL, "idempotency-ttl", 24*time.Hour, "how long to remember Idempotency-Key requests for retries (0 to ignore the header)")
+
+	// Allow user to cache album responses in memory (and let clients and
+	// CDNs cache them) for a short time
+	var responseCacheTTL time.Duration
+	flag.DurationVar(&responseCacheTTL, "response-cache-ttl", 0, "how long to cache GET /albums and GET /albums/{id} responses, cleared on writes (0 to disable)")
+
+	// Allow user to set the proxies (like a load balancer) whose forwarding
+	// header gives the real client IP, for logging and duplicate detection
+	var trustedProxies string
+	var proxyHeader string
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "comma-separated proxy IP addresses or CIDR ranges, like 10.0.0.0/8, whose -proxy-header gives the client IP (default is to use the connection's address)")
+	flag.StringVar(&proxyHeader, "proxy-header", "X-Forwarded-For", "forwarding header the trusted proxies set: X-Forwarded-For or Forwarded")
+
+	// Allow user to redirect or rewrite paths with a trailing slash or
+	// duplicate slashes, like /albums/, rather than returning 404
+	var pathPolicyName string
+	flag.StringVar(&pathPolicyName, "path-policy", "strict", "`policy` for paths with a trailing slash or duplicate slashes: strict (404), redirect (308 to the cleaned path), or rewrite (serve the cleaned path)")
+
+	// Allow user to set the external base URL (when behind a reverse proxy)
+	// so links to resources are correct, and to include self links
+	var baseURL string
+	var selfLinks bool
+	flag.StringVar(&baseURL, "base-url", "", "external base `URL` of the API for absolute links, like https://example.com/api")
+	flag.BoolVar(&selfLinks, "self-links", false, "include a self link in create responses")
+
+	// Allow user to set the public URL that album QR codes link to
+	var publicURLTemplate string
+	flag.StringVar(&publicURLTemplate, "public-url", "", "`template` for album web page URLs in QR codes, the sitemap, and the feed, with {id} replaced by the album ID (default is the album's API URL)")
+
+	// Allow user to set the admin token (needed to see and restore deleted
+	// albums), and how long deleted albums are kept
+	var adminToken string
+	var deletedRetention time.Duration
+	flag.StringVar(&adminToken, "admin-token", "", "bearer `token` for admin requests (default is no admin access)")
+	flag.DurationVar(&deletedRetention, "deleted-retention", 30*24*time.Hour, "how long to keep deleted albums so they can be restored (0 to keep forever)")
+
+	// Allow user to set how often stored blobs (cover art) are checked for
+	// corruption
+	var blobScrubInterval time.Duration
+	flag.DurationVar(&blobScrubInterval, "blob-scrub-interval", 24*time.Hour, "how often to check stored blobs for corruption (0 to disable)")
+
+	// Allow user to store blobs in S3 (or an S3-compatible store like
+	// MinIO) instead of in memory; credentials come from the standard AWS
+	// environment variables
+	var blobStore string
+	flag.StringVar(&blobStore, "blob-store", "", "`URL` of an S3 bucket to store blobs in, like s3://bucket/prefix?region=us-east-1&endpoint=http://localhost:9000 (default is memory)")
+
+	// Allow user to run maintenance jobs, like snapshotting the database
+	// to a file and rotating the log file
+	var schedule string
+	var snapshotFile string
+	var logFilePath string
+	flag.StringVar(&schedule, "schedule", "", "comma-separated maintenance `jobs` and intervals like snapshot=1h,rotate-logs=24h (jobs: snapshot, rotate-logs)")
+	flag.StringVar(&snapshotFile, "snapshot-file", "", "`path` of the JSON file the snapshot job writes the database to")
+	flag.StringVar(&logFilePath, "log-file", "", "`path` of the file to log to instead of stderr (rotated by the rotate-logs job)")
+
+	// Allow user to log every change as an event
+	var logEvents bool
+	flag.BoolVar(&logEvents, "log-events", false, "log every change made through the API")
+
+	// Allow user to register webhooks that are sent every change
+	var webhookURLs string
+	var webhookSecret string
+	flag.StringVar(&webhookURLs, "webhooks", "", "comma-separated webhook `URLs` to POST every change to")
+	flag.StringVar(&webhookSecret, "webhook-secret", "", "`secret` to sign webhook requests with (default is a random one per webhook)")
+
+	// Allow user to publish album changes to NATS or Kafka
+	var eventBroker string
+	flag.StringVar(&eventBroker, "event-broker", "", "`URL` of a message broker to publish album changes to, like nats://host/subject or kafka+http://rest-proxy/topic")
+
+	// Allow user to opt in to sending an anonymous daily usage report
+	var usagePing string
+	flag.StringVar(&usagePing, "usage-ping", "", "`URL` to send an anonymous daily usage report (version, backend types, features, rough album count) to (default is not to)")
+
+	// Allow user to take payments for orders
+	var fakePayments bool
+	var stripeWebhookSecret string
+	flag.BoolVar(&fakePayments, "fake-payments", false, "take order payments with an in-memory fake provider that accepts them all (for development)")
+	flag.StringVar(&stripeWebhookSecret, "stripe-webhook-secret", "", "signing `secret` of the Stripe webhook endpoint, to mark orders paid from Stripe events (default is not to accept them)")
+
+	// Allow user to set the sizes of cover art thumbnails
+	var thumbnailSizes string
+	flag.StringVar(&thumbnailSizes, "thumbnail-sizes", "small=150,medium=600", "comma-separated cover thumbnail `sizes` as name=pixels (max width and height)")
+
+	// Allow user to sign responses, so consumers can verify them
+	var signingKeyFile string
+	flag.StringVar(&signingKeyFile, "signing-key", "", "comma-separated PEM `files` with Ed25519 private keys: the current one to sign responses with, then previous ones still published for verifiers (default is not to sign them)")
+
+	// Allow user to set when the deprecated unversioned album routes stop
+	// being served (in favour of /v1)
+	var legacySunset string
+	flag.StringVar(&legacySunset, "legacy-sunset", "", "`date` (like 2027-01-31) from which unversioned /albums routes return 410 Gone (default is to keep serving them)")
+
+	// Allow user to set how often WebSocket clients are pinged, in case a
+	// proxy in front of the server drops idle connections sooner
+	var wsPingInterval time.Duration
+	flag.DurationVar(&wsPingInterval, "ws-ping-interval", defaultWSPingInterval, "how often to ping WebSocket clients to keep connections alive")
+
+	// Allow user to hide album fields (like internal catalog numbers) from
+	// public clients, so only back-office (admin) clients see them
+	var adminFields string
+	flag.StringVar(&adminFields, "admin-fields", "", "comma-separated album `fields` only admins can see, like catalog_number")
+
+	// Allow user to throttle bulk imports and backfills, so they don't
+	// starve interactive requests of database time
+	var importRate float64
+	flag.Float64Var(&importRate, "import-rate", 0, "max `rows` per second written by bulk imports and migration backfills, which also give way to interactive requests (0 for no limit)")
+
+	// Allow user to tune timeouts, roles, rate limits, and caching per route
+	var routeConfigFile string
+	flag.StringVar(&routeConfigFile, "route-config", "", "JSON `file` with per-route timeouts, roles, rate limits, and cache TTLs (see routeconfig.go)")
+
+	// Allow user to choose where diagnostics bundles are written
+	var diagnosticsDir string
+	flag.StringVar(&diagnosticsDir, "diagnostics-dir", os.TempDir(), "`directory` to write diagnostics bundles to on SIGQUIT or POST /diagnostics")
+
+	// Allow user to require that external identifiers (like ISRCs) are
+	// unique across albums
+	var uniqueIDs string
+	flag.StringVar(&uniqueIDs, "unique-ids", "", "comma-separated external `identifiers` that must be unique: isrc, upc, or musicbrainz_id (default is none)")
+
+	// Allow user to start in read-only or maintenance mode (an admin can
+	// switch modes at runtime with PUT /mode)
+	var modeName string
+	var modeRetryAfter time.Duration
+	flag.StringVar(&modeName, "mode", "normal", "`mode` to start in: normal, read-only (writes get 503), or maintenance (everything gets 503)")
+	flag.DurationVar(&modeRetryAfter, "mode-retry-after", defaultModeRetryAfter, "Retry-After to send for requests rejected in read-only or maintenance mode")
+
+	// Allow user to serve a frontend (like a single-page app) from the
+	// same binary as the API
+	var staticDir string
+	var staticMaxAge time.Duration
+	flag.StringVar(&staticDir, "static-dir", "", "`directory` of static files to serve under /static/ (default is none)")
+	flag.DurationVar(&staticMaxAge, "static-max-age", time.Hour, "how long clients can cache static files without revalidating")
+
+	// Allow user to host several stores (tenants) with separate data
+	var tenants, tenantDomain string
+	var crossTenantAdmin bool
+	flag.StringVar(&tenants, "tenants", "", "comma-separated tenant `IDs` to host separate stores for, chosen by subdomain or X-Tenant header (default is a single store)")
+	flag.StringVar(&tenantDomain, "tenant-domain", "", "`domain` whose subdomains are tenant IDs, like albums.example.com (default is the X-Tenant header only)")
+	flag.BoolVar(&crossTenantAdmin, "cross-tenant-admin", false, "let the admin token access every tenant's data")
+
+	// Allow user to turn on development mode, with example payloads and
+	// schema links in validation errors
+	var devMode bool
+	flag.BoolVar(&devMode, "dev", false, "development mode: add example payloads and schema links to validation errors")
+
+	// Allow user to indent all JSON responses, for reading them by hand
+	// (otherwise only requests with ?pretty=1 get indented responses)
+	var prettyJSON bool
+	flag.BoolVar(&prettyJSON, "pretty-json", false, "indent all JSON responses (default is compact JSON, unless a request has ?pretty=1)")
+
+	// Allow user to switch error responses to RFC 7807 problem details
+	var problemJSON bool
+	flag.BoolVar(&problemJSON, "problem-json", false, "write errors as application/problem+json (clients can also ask with Accept)")
+
+	// Allow user to limit the size of the (in-memory) audit log
+	var maxAuditEntries int
+	flag.IntVar(&maxAuditEntries, "max-audit-entries", 10000, "maximum number of audit log entries to keep (0 for no limit)")
+
+	// Allow user to print the OpenAPI spec, or check it for breaking
+	// changes against a committed baseline (before a release), instead of
+	// running the server
+	var printOpenAPI bool
+	var contractBaseline string
+	flag.BoolVar(&printOpenAPI, "print-openapi", false, "print OpenAPI spec and exit")
+	flag.StringVar(&contractBaseline, "check-contract", "", "report breaking changes to OpenAPI spec since baseline `file` and exit")
+
+	// Allow user to diff the album catalogs of two deployments (or a
+	// deployment and a snapshot file) instead of running the server, to
+	// validate a migration or replication
+	var diffFrom, diffTo string
+	flag.StringVar(&diffFrom, "diff-from", "", "server base `URL` or snapshot file to diff the catalog of against -diff-to, then exit")
+	flag.StringVar(&diffTo, "diff-to", "", "server base `URL` or snapshot file to diff the catalog of against -diff-from, then exit")
+	flag.Parse()
+
+	if printOpenAPI {
+		b, err := json.MarshalIndent(openAPISpec(), "", "    ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	if contractBaseline != "" {
+		os.Exit(checkContract(contractBaseline, os.Stdout))
+	}
+	if diffFrom != "" || diffTo != "" {
+		if diffFrom == "" || diffTo == "" {
+			log.Fatalf("-diff-from and -diff-to must be given together")
+		}
+		os.Exit(diffCatalogCommand(diffFrom, diffTo, adminToken, os.Stdout))
+	}
+
+	var priceMode PriceMode
+	switch priceInput {
+	case "strict":
+		priceMode = PriceStrict
+	case "tolerant":
+		priceMode = PriceTolerant
+	default:
+		log.Fatalf("invalid -price-input %q: must be strict or tolerant", priceInput)
+	}
+
+	seed := defaultSeed
+	switch seedFile {
+	case "":
+	case "none":
+		seed = DatabaseSnapshot{}
+	default:
+		var err error
+		seed, err = readSeedFile(seedFile, priceMode)
+		if err != nil {
+			log.Fatalf("invalid -seed: %v", err)
+		}
+	}
+
+	var idGenerator IDGenerator
+	switch idFormat {
+	case "uuid":
+		idGenerator = UUIDGenerator{}
+	case "ulid":
+		idGenerator = ULIDGenerator{}
+	case "sequential":
+		idGenerator = &SequentialIDGenerator{}
+	default:
+		log.Fatalf("invalid -id-format %q: must be uuid, ulid, or sequential", idFormat)
+	}
+
+	var base *url.URL
+	if baseURL != "" {
+		var err error
+		base, err = parseBaseURL(baseURL)
+		if err != nil {
+			log.Fatalf("invalid -base-url: %v", err)
+		}
+	}
+	if publicURLTemplate != "" {
+		err := checkPublicURLTemplate(publicURLTemplate)
+		if err != nil {
+			log.Fatalf("invalid -public-url: %v", err)
+		}
+	}
+	laneLimits, err := parseLanes(lanes)
+	if err != nil {
+		log.Fatalf("invalid -lanes: %v", err)
+	}
+	proxies, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		log.Fatalf("invalid -trusted-proxies: %v", err)
+	}
+	err = checkProxyHeader(proxyHeader)
+	if err != nil {
+		log.Fatalf("invalid -proxy-header: %v", err)
+	}
+	pathPolicy, err := parsePathPolicy(pathPolicyName)
+	if err != nil {
+		log.Fatalf("invalid -path-policy: %v", err)
+	}
+	fieldPolicy, err := parseAdminFields(adminFields)
+	if err != nil {
+		log.Fatalf("invalid -admin-fields: %v", err)
+	}
+	var routeConfigs map[string]RouteConfig
+	if routeConfigFile != "" {
+		routeConfigs, err = readRouteConfig(routeConfigFile)
+		if err != nil {
+			log.Fatalf("invalid -route-config: %v", err)
+		}
+	}
+	var tenantIDs []string
+	if tenants != "" {
+		tenantIDs, err = parseTenants(tenants)
+		if err != nil {
+			log.Fatalf("invalid -tenants: %v", err)
+		}
+	}
+	uniqueIDKinds, err := parseUniqueIdentifiers(uniqueIDs)
+	if err != nil {
+		log.Fatalf("invalid -unique-ids: %v", err)
+	}
+	mode, err := parseMode(modeName)
+	if err != nil {
+		log.Fatalf("invalid -mode: %v", err)
+	}
+	if modeRetryAfter < time.Second {
+		log.Fatalf("invalid -mode-retry-after: must be at least 1s")
+	}
+	var staticFiles fs.FS
+	if staticDir != "" {
+		info, err := os.Stat(staticDir)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s is not a directory", staticDir)
+		}
+		if err != nil {
+			log.Fatalf("invalid -static-dir: %v", err)
+		}
+		staticFiles = os.DirFS(staticDir)
+	}
+	webhookList, err := parseWebhookURLs(webhookURLs)
+	if err != nil {
+		log.Fatalf("invalid -webhooks: %v", err)
+	}
+	if eventBroker != "" {
+		_, err := parseEventBroker(eventBroker)
+		if err != nil {
+			log.Fatalf("invalid -event-broker: %v", err)
+		}
+	}
+	var s3Config S3Config
+	if blobStore != "" {
+		s3Config, err = parseS3URL(blobStore)
+		if err != nil {
+			log.Fatalf("invalid -blob-store: %v", err)
+		}
+		s3Config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s3Config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s3Config.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		if s3Config.AccessKey == "" || s3Config.SecretKey == "" {
+			log.Fatalf("-blob-store needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+	}
+	thumbnailSizeMap, err := parseThumbnailSizes(thumbnailSizes)
+	if err != nil {
+		log.Fatalf("invalid -thumbnail-sizes: %v", err)
+	}
+	var signingKey ed25519.PrivateKey
+	var previousSigningKeys []ed25519.PublicKey
+	var keysCreated map[string]time.Time
+	if signingKeyFile != "" {
+		signingKey, previousSigningKeys, keysCreated, err = readSigningKeys(signingKeyFile)
+		if err != nil {
+			log.Fatalf("invalid -signing-key: %v", err)
+		}
+	}
+	var legacySunsetTime time.Time
+	if legacySunset != "" {
+		legacySunsetTime, err = time.Parse("2006-01-02", legacySunset)
+		if err != nil {
+			log.Fatalf("invalid -legacy-sunset: %v", err)
+		}
+	}
+	jobIntervals, err := parseSchedule(schedule)
+	if err != nil {
+		log.Fatalf("invalid -schedule: %v", err)
+	}
+	if jobIntervals["snapshot"] > 0 && snapshotFile == "" {
+		log.Fatalf("-schedule snapshot needs -snapshot-file")
+	}
+	if jobIntervals["snapshot"] > 0 && len(tenantIDs) > 0 {
+		log.Fatalf("-schedule snapshot can't be used with -tenants (it only snapshots a single database)")
+	}
+	if jobIntervals["rotate-logs"] > 0 && logFilePath == "" {
+		log.Fatalf("-schedule rotate-logs needs -log-file")
+	}
+	var logOutput *logFile
+	if logFilePath != "" {
+		logOutput, err = openLogFile(logFilePath)
+		if err != nil {
+			log.Fatalf("error opening log file: %v", err)
+		}
+		defer logOutput.Close()
+		log.SetOutput(logOutput)
+	}
+
+	// Create in-memory database and add the seed albums and genres (and the
+	// same for each tenant, if there are any)
+	var blobs BlobStore
+	if blobStore != "" {
+		blobs = NewS3BlobStore(s3Config)
+	}
+	newDatabase := func() *MemoryDatabase {
+		db := NewMemoryDatabase()
+		db.MaxAlbums = maxAlbums
+		db.MaxBytes = maxDBBytes
+		db.MaxVersions = maxVersions
+		if blobs != nil {
+			db.Blobs = blobs
+		}
+		err := LoadSeed(db, seed)
+		if err != nil {
+			log.Fatalf("error loading seed: %v", err)
+		}
+		return db
+	}
+	db := newDatabase()
+	var tenantStore TenantStore
+	if len(tenantIDs) > 0 {
+		memoryTenants := NewMemoryTenantStore()
+		for _, id := range tenantIDs {
+			err := memoryTenants.AddTenant(id, newDatabase())
+			if err != nil {
+				log.Fatalf("error adding tenant: %v", err)
+			}
+		}
+		tenantStore = memoryTenants
+	}
+
+	auditStore := NewMemoryAuditStore()
+	auditStore.MaxEntries = maxAuditEntries
+	var eventLogger EventPublisher
+	if logEvents {
+		eventLogger = LogPublisher{Log: log.Default()}
+	}
+
+	var paymentProvider PaymentProvider
+	if fakePayments {
+		paymentProvider = NewFakePaymentProvider()
+	}
+
+	// Create server and wire up database
+	server := NewServer(db, log.Default(),
+		WithHandlerTimeout(handlerTimeout),
+		WithMaxInFlight(maxInFlight),
+		WithAdaptiveLimit(targetLatency),
+		WithLanes(laneLimits, laneQueueTimeout),
+		WithIDGenerator(idGenerator),
+		WithPriceMode(priceMode),
+		WithBaseURL(base),
+		WithSelfLinks(selfLinks),
+		WithPublicURLTemplate(publicURLTemplate),
+		WithAdminToken(adminToken),
+		WithDeletedRetention(deletedRetention),
+		WithBlobScrubInterval(blobScrubInterval),
+		WithWebSocketPingInterval(wsPingInterval),
+		WithWebhooks(webhookSecret, webhookList...),
+		WithEventBroker(eventBroker),
+		WithUsagePing(usagePing),
+		WithSigningKey(signingKey),
+		WithPreviousSigningKeys(previousSigningKeys...),
+		WithKeysCreated(keysCreated),
+		WithLegacySunset(legacySunsetTime),
+		WithThumbnailSizes(thumbnailSizeMap),
+		WithAuditStore(auditStore),
+		WithOrderStore(NewMemoryOrderStore()),
+		WithUserStore(NewMemoryUserStore()),
+		WithFavoriteStore(NewMemoryFavoriteStore()),
+		WithPaymentProvider(paymentProvider),
+		WithStripeWebhookSecret(stripeWebhookSecret),
+		WithTrustedProxies(proxyHeader, proxies),
+		WithPathPolicy(pathPolicy),
+		WithDuplicateWindow(duplicateWindow),
+		WithResponseCache(responseCacheTTL),
+		WithIdempotencyTTL(idempotencyTTL),
+		WithProblemDetails(problemJSON),
+		WithFieldPolicy(fieldPolicy),
+		WithUniqueIdentifiers(uniqueIDKinds...),
+		WithRouteConfig(routeConfigs),
+		WithImportRate(importRate),
+		WithDiagnostics(diagnosticsDir, redactFlags(flag.CommandLine)),
+		WithStaticFiles(staticFiles, staticMaxAge),
+		WithMode(mode, modeRetryAfter),
+		WithSeed(seed),
+		WithTenants(tenantStore),
+		WithTenantDomain(tenantDomain),
+		WithCrossTenantAdmin(crossTenantAdmin),
+		WithDevMode(devMode),
+		WithPrettyJSON(prettyJSON),
+		WithEventPublisher(eventLogger),
+		WithJob(snapshotJob(db, snapshotFile, jobIntervals["snapshot"], time.Now)),
+		WithJob(rotateLogsJob(logOutput, jobIntervals["rotate-logs"], time.Now)),
+	)
+
+	httpServer := &http.Server{
+		Addr:              ":" + strconv.Itoa(port),
+		Handler:           server,
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+	// Event streams last until the client goes away, so end them when
+	// shutting down rather than waiting for them
+	httpServer.RegisterOnShutdown(server.events.stop)
+	if h2c {
+		err := enableH2C(httpServer)
+		if err != nil {
+			log.Fatalf("invalid -h2c: %v", err)
+		}
+	}
+
+	// If this is a restart, serve on the listeners the old process handed
+	// over rather than listening again
+	listeners, err := inheritedListeners()
+	if err != nil {
+		log.Fatalf("error inheriting listeners: %v", err)
+	}
+
+	// Start the server's components in order, then on SIGINT or SIGTERM
+	// stop them in reverse: stop accepting connections and wait for
+	// in-flight requests to finish, then stop the background components.
+	// On SIGUSR2, hand the listeners over to a new process and do the same
+	// once it's ready.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("web-service-stdlib %s", readBuildInfo())
+	app := NewApp(log.Default())
+	restarts := newRestarter(log.Default(), stop)
+	app.Add("server", server)
+	httpComponent := newHTTPComponent(httpServer, log.Default())
+	httpComponent.inherited = listeners["http"]
+	app.Add("http", httpComponent)
+	restarts.Add("http", httpComponent)
+	if debugAddr != "" {
+		debugComponent := newHTTPComponent(newDebugServer(debugAddr), log.Default())
+		debugComponent.inherited = listeners["debug"]
+		app.Add("debug", debugComponent)
+		restarts.Add("debug", debugComponent)
+	} else if listeners["debug"] != nil {
+		listeners["debug"].Close()
+	}
+	app.Add("restarts", restarts)
+
+	// On SIGQUIT, write a diagnostics bundle and keep running, rather than
+	// Go's default of printing the goroutines and exiting
+	stopDiagnostics := server.dumpDiagnosticsOn(syscall.SIGQUIT)
+	defer stopDiagnostics()
+	err = app.Run(ctx, shutdownTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Server is the album HTTP server.
+type Server struct {
+	db           Database
+	log          *log.Logger
+	handler      http.Handler
+	serverHeader string
+	background   *lifecycle
+
+	references          []referenceSource
+	encoders            []responseEncoder
+	idGenerator         IDGenerator
+	baseURL             *url.URL
+	selfLinks           bool
+	publicURLTemplate   string
+	adminToken          string
+	problemDetails      bool
+	fieldPolicy         FieldPolicy
+	devMode             bool
+	indentJSON          bool
+	codec               Codec
+	translators         map[string]languageTranslator // by lowercase tag
+	languageFallbacks   map[string][]string
+	authenticators      []Authenticator
+	authChain           []Authenticator // admin token first, then sessions, then authenticators
+	auditStore          AuditStore
+	orderStore          OrderStore
+	userStore           UserStore
+	favoriteStore       FavoriteStore
+	paymentProvider     PaymentProvider
+	stripeWebhookSecret string
+	priceMode           PriceMode
+	deletedRetention    time.Duration
+	blobScrubInterval   time.Duration
+	jobConfig           []Job
+	jobs                []*scheduledJob
+	changes             *changeHub
+	wsPingInterval      time.Duration
+	webhooks            *webhooks
+	webhookConfig       []Webhook
+	webhookClient       *http.Client
+	webhookAttempts     int
+	webhookBackoff      time.Duration
+	eventBrokerURL      string
+	usagePingURL        string
+	signingKey          ed25519.PrivateKey
+	previousSigningKeys []ed25519.PublicKey
+	keysCreated         map[string]time.Time // by key ID
+	uniqueIdentifiers   map[string]bool      // by identifier kind
+
+	routeConfigOverrides map[string]RouteConfig
+	routeConfigs         map[string]RouteConfig  // by route name, merged with the defaults
+	routeLimiters        map[string]*rateLimiter // by route name
+
+	tenants          TenantStore
+	tenantDomain     string
+	crossTenantAdmin bool
+	tenant           string  // the tenant this copy of the server is for (see forTenant)
+	importRate       float64 // rows per second
+	importThrottle   *writeThrottle
+	diagnosticsDir   string
+	diagnosticsFlags map[string]string // by name, redacted
+	staticFiles      *staticFiles
+	initialMode      modeState
+	mode             *serverMode
+	seed             *DatabaseSnapshot
+	resetConfirms    *resetConfirmations
+	requestLog       *requestLog
+	legacySunset     time.Time
+	legacyCalls      *legacyCalls
+	uploads          *uploads
+	thumbnailSizes   map[string]int
+	events           *eventStreams
+	publishers       []EventPublisher
+	responseCacheTTL time.Duration
+	responseCache    *responseCache
+	trustedProxies   []*net.IPNet
+	proxyHeader      string
+	pathPolicy       PathPolicy
+	duplicateWindow  time.Duration
+	duplicates       *replayStore
+	idempotencyTTL   time.Duration
+	idempotency      *replayStore
+	handlerTimeout   time.Duration
+	maxInFlight      int
+	inFlight         chan struct{}
+	targetLatency    time.Duration
+	adaptive         *adaptiveLimiter
+	laneLimits       map[RequestClass]int
+	laneQueueTimeout time.Duration
+	lanes            *laneLimiter
+	now              func() time.Time
+}
+
+// Database is the interface used by the server to load and store albums.
+//
+// All implementations must return albums in the same order, so clients see
+// identical results regardless of backend: sorted by ID, comparing IDs
+// byte-wise as UTF-8 (Go's string < operator). This is a binary collation,
+// not a locale-aware one, so "B" < "a" < "b" and "10" < "9"; SQL backends
+// need an ORDER BY with a binary collation (for example COLLATE "C" in
+// Postgres or BINARY in SQLite). IDs are unique, so there are no ties. Any
+// future pagination must be keyed on this same order. Tracks are always
+// returned sorted by track number. The conformance tests in
+// conformance_test.go check these rules for each backend.
+//
+// Like the version, an album's CreatedAt and UpdatedAt timestamps are set
+// by the database (in UTC) whenever the album is stored or changed, so SQL
+// backends can use column defaults or triggers for them.
+type Database interface {
+	// GetAlbums returns a copy of all albums, sorted by ID.
+	GetAlbums() ([]Album, error)
+
+	// GetAlbumsByID returns a single album by ID, or ErrDoesNotExist if
+	// an album with that ID does not exist.
+	GetAlbumByID(id string) (Album, error)
+
+	// GetAlbumsByIDs returns the albums with the given IDs, sorted by ID.
+	// IDs that don't exist are skipped rather than being an error. SQL
+	// backends can implement this with a single "WHERE id IN (...)" query.
+	GetAlbumsByIDs(ids []string) ([]Album, error)
+
+	// AddAlbum adds a single album, or ErrAlreadyExists if an album with
+	// the given ID already exists. The album is stored with version 1, and
+	// CreatedAt and UpdatedAt set to the current time. It returns the
+	// stored album.
+	AddAlbum(album Album) (Album, error)
+
+	// PutAlbum adds or replaces an album, using compare-and-swap on the
+	// album's version. If version is zero, the album is added, or
+	// ErrVersionConflict is returned if it already exists. Otherwise the
+	// existing album is replaced only if its current version equals
+	// version, or ErrVersionConflict is returned. Replacing keeps the
+	// existing CreatedAt. It returns the stored album, with its new version
+	// and timestamps.
+	PutAlbum(album Album, version int) (Album, error)
+
+	// DeleteAlbum permanently deletes a single album by ID, or returns
+	// ErrDoesNotExist if an album with that ID does not exist. The API
+	// soft deletes albums with SoftDeleteAlbum instead.
+	DeleteAlbum(id string) error
+
+	// SoftDeleteAlbum marks the album with the given ID as deleted at time
+	// deletedAt, incrementing its version. It returns ErrDoesNotExist if
+	// the album doesn't exist or is already deleted. Deleted albums are
+	// still returned by the Get and Search methods (with DeletedAt set),
+	// and their IDs can't be reused, but they can't be changed: PutAlbum
+	// and AddTrack treat them as not existing.
+	SoftDeleteAlbum(id string, deletedAt time.Time) error
+
+	// RestoreAlbum undoes the soft deletion of the album with the given ID,
+	// incrementing its version, and returns the restored album. Restoring
+	// an album that isn't deleted does nothing. It returns ErrDoesNotExist
+	// if the album doesn't exist (or has been purged).
+	RestoreAlbum(id string) (Album, error)
+
+	// PurgeDeletedAlbums permanently deletes albums that were soft deleted
+	// before the given time, returning the number deleted.
+	PurgeDeletedAlbums(before time.Time) (int, error)
+
+	// GetAlbumVersions returns the kept versions of the album with the
+	// given ID, oldest first, ending with the current version. Backends
+	// may discard old versions. It returns ErrDoesNotExist if the album
+	// doesn't exist.
+	GetAlbumVersions(id string) ([]Album, error)
+
+	// GetAlbumAt returns the version of the album with the given ID that
+	// was current at time at: the latest version with UpdatedAt not after
+	// at. It returns ErrDoesNotExist if the album doesn't exist, didn't
+	// exist yet at that time, or that version has been discarded.
+	GetAlbumAt(id string, at time.Time) (Album, error)
+
+	// AddTrack adds a track to the album with the given ID and returns the
+	// added track, incrementing the album's version. If track.Number is
+	// zero, the track is numbered after the album's last track. It returns
+	// ErrDoesNotExist if the album doesn't exist, or ErrAlreadyExists if it
+	// already has a track with that number.
+	AddTrack(albumID string, track Track) (Track, error)
+
+	// GetGenres returns all genres, sorted by ID.
+	GetGenres() ([]Genre, error)
+
+	// AddGenre adds a single genre, or ErrAlreadyExists if a genre with the
+	// given ID already exists.
+	AddGenre(genre Genre) error
+
+	// SearchAlbums returns albums whose title or artist matches query,
+	// sorted by ID. Matching is case-insensitive, and each word in query
+	// must match the start of a word in the title or artist.
+	SearchAlbums(query string) ([]Album, error)
+}
+
+var (
+	ErrDoesNotExist  = errors.New("does not exist")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrUnavailable   = errors.New("unavailable")
+	ErrFull          = errors.New("database full")
+
+	ErrVersionConflict = errors.New("version conflict")
+)
+
+// errorMapping maps the database's domain errors to the API errors they're
+// reported to clients as.
+var errorMapping = apierr.Mapping{
+	{Err: ErrDoesNotExist, API: apierr.NotFound()},
+	{Err: ErrAlreadyExists, API: apierr.AlreadyExists()},
+	{Err: ErrUnavailable, API: apierr.Unavailable(nil)},
+	{Err: ErrFull, API: apierr.DatabaseFull(nil)},
+	{Err: ErrVersionConflict, API: apierr.Conflict()},
+}
+
+// Album represents data about a single album.
+type Album struct {
+	ID     string `json:"id" xml:"id"`
+	Title  string `json:"title" xml:"title"`
+	Artist string `json:"artist" xml:"artist"`
+	Price  int    `json:"price,omitempty" xml:"price,omitempty"` // use int cents instead of float64 for currency
+
+	// PublishAt is the time at which the album becomes publicly visible.
+	// If nil, the album is visible as soon as it is added.
+	PublishAt *time.Time `json:"publish_at,omitempty" xml:"publish_at,omitempty"`
+
+	// Tracks is the album's track listing, sorted by track number.
+	Tracks []Track `json:"tracks,omitempty" xml:"tracks>track,omitempty"`
+
+	// Genres are the IDs of the album's genres, which must exist.
+	Genres []string `json:"genres,omitempty" xml:"genres>genre,omitempty"`
+
+	// Version is incremented on every change to the album, starting at 1,
+	// and must be given when replacing an album (see putAlbum).
+	Version int `json:"version" xml:"version"`
+
+	// CreatedAt is when the album was added, and UpdatedAt when it was
+	// last changed. Like Version, these are set by the database.
+	CreatedAt time.Time `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+
+	// CatalogNumber is the label's catalog number, which can be printed
+	// as a barcode.
+	CatalogNumber string `json:"catalog_number,omitempty" xml:"catalog_number,omitempty"`
+
+	// UPC is the album's Universal Product Code (or EAN), and
+	// MusicBrainzID its MusicBrainz release ID (see identifiers.go).
+	UPC           string `json:"upc,omitempty" xml:"upc,omitempty"`
+	MusicBrainzID string `json:"musicbrainz_id,omitempty" xml:"musicbrainz_id,omitempty"`
+
+	// Favorites is the number of users who've favorited the album. It's
+	// not stored with the album, but added when it's fetched (see
+	// favorites.go).
+	Favorites int `json:"favorites,omitempty" xml:"favorites,omitempty"`
+
+	// DeletedAt is the time the album was deleted, or nil if it hasn't
+	// been. Deleted albums are hidden, but can be restored by an admin.
+	DeletedAt *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty"`
+
+	// Stock is the number of copies left to sell (see purchaseAlbum).
+	Stock int `json:"stock,omitempty" xml:"stock,omitempty"`
+}
+
+// published reports whether the album is publicly visible at time now.
+func (a Album) published(now time.Time) bool {
+	return a.PublishAt == nil || !a.PublishAt.After(now)
+}
+
+// visible reports whether the album is publicly visible at time now: it's
+// been published and hasn't been deleted.
+func (a Album) visible(now time.Time) bool {
+	return a.DeletedAt == nil && a.published(now)
+}
+
+// filterVisible returns only the albums that are publicly visible at time
+// now, also keeping deleted albums if includeDeleted is true. It filters in
+// place, overwriting the albums slice.
+func filterVisible(albums []Album, now time.Time, includeDeleted bool) []Album {
+	visible := albums[:0]
+	for _, album := range albums {
+		if album.published(now) && (album.DeletedAt == nil || includeDeleted) {
+			visible = append(visible, album)
+		}
+	}
+	return visible
+}
+
+// NewServer creates a new server using the given database implementation
+// and options.
+func NewServer(db Database, log *log.Logger, options ...Option) *Server {
+	s := &Server{
+		db:              db,
+		log:             log,
+		background:      newLifecycle(),
+		serverHeader:    serverHeader(buildVersion()),
+		now:             time.Now,
+		idGenerator:     UUIDGenerator{},
+		encoders:        defaultEncoders(),
+		changes:         newChangeHub(),
+		wsPingInterval:  defaultWSPingInterval,
+		webhooks:        &webhooks{hooks: make(map[string]*webhook)},
+		webhookClient:   newWebhookClient(),
+		webhookAttempts: defaultWebhookAttempts,
+		webhookBackoff:  defaultWebhookBackoff,
+		uploads:         &uploads{pending: make(map[string]*pendingUpload)},
+		events:          newEventStreams(),
+		thumbnailSizes:  defaultThumbnailSizes,
+		legacyCalls:     newLegacyCalls(),
+		requestLog:      newRequestLog(maxLoggedRequests),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	if s.codec == nil {
+		s.codec = JSONCodec{}
+	}
+	thumbnailSizes := make(map[string]int)
+	for name, side := range s.thumbnailSizes {
+		err := checkThumbnailSize(name, side)
+		if err != nil {
+			s.log.Printf("error configuring thumbnails: %v", err)
+			continue
+		}
+		thumbnailSizes[name] = side
+	}
+	s.thumbnailSizes = thumbnailSizes
+	builtin := []EventPublisher{s.webhooks, EventPublisherFunc(s.notifyWebSockets), s.events}
+	s.publishers = append(builtin, s.publishers...)
+	if s.eventBrokerURL != "" {
+		s.startEventBroker()
+	}
+	for _, hook := range s.webhookConfig {
+		_, err := s.addWebhook(hook)
+		if err != nil {
+			s.log.Printf("error adding webhook for %s: %v", hook.URL, err)
+		}
+	}
+
+	s.authChain = []Authenticator{adminTokenAuthenticator{s.adminToken}}
+	if s.userStore != nil {
+		s.authChain = append(s.authChain, userSessionAuthenticator{s.userStore, s.now})
+	}
+	s.authChain = append(s.authChain, s.authenticators...)
+	s.routeConfigs = mergeRouteConfigs(defaultRouteConfigs, s.routeConfigOverrides)
+	if s.importRate > 0 {
+		s.importThrottle = newWriteThrottle(s.importRate)
+	}
+	s.routeLimiters = make(map[string]*rateLimiter)
+	for name, config := range s.routeConfigs {
+		if config.RateLimit > 0 {
+			s.routeLimiters[name] = newRateLimiter(config.RateLimit)
+		}
+	}
+
+	// Build the handler chain: the middleware listed last runs first
+	if s.responseCacheTTL > 0 {
+		s.responseCache = newResponseCache(s.responseCacheTTL)
+	}
+	var handler http.Handler = http.HandlerFunc(s.cachedRoute)
+	if s.tenants != nil {
+		handler = http.HandlerFunc(s.routeTenant)
+	}
+	handler = s.routeConfigHandler(handler)
+	handler = s.authHandler(handler)
+	if checker, ok := db.(AvailabilityChecker); ok {
+		handler = s.availabilityHandler(handler, checker)
+	}
+	if s.duplicateWindow > 0 {
+		s.duplicates = newReplayStore(s.duplicateWindow)
+		s.background.Go("duplicate-janitor", func(ctx context.Context) {
+			s.duplicates.runJanitor(ctx, s.now)
+		})
+		handler = s.duplicateHandler(handler)
+	}
+	if s.idempotencyTTL > 0 {
+		s.idempotency = newReplayStore(s.idempotencyTTL)
+		s.background.Go("idempotency-janitor", func(ctx context.Context) {
+			s.idempotency.runJanitor(ctx, s.now)
+		})
+		handler = s.idempotencyHandler(handler)
+	}
+	var builtinJobs []Job
+	if s.deletedRetention > 0 {
+		builtinJobs = append(builtinJobs, s.purgeJob())
+	}
+	if scrubber, ok := db.(BlobScrubber); ok {
+		builtinJobs = append(builtinJobs, s.scrubJob(scrubber))
+	}
+	if pruner, ok := s.userStore.(SessionPruner); ok {
+		builtinJobs = append(builtinJobs, s.pruneSessionsJob(pruner))
+	}
+	if job, ok := s.usagePingJob(); ok {
+		builtinJobs = append(builtinJobs, job)
+	}
+	s.startJobs(builtinJobs)
+	if s.handlerTimeout > 0 || s.hasRouteTimeouts() {
+		handler = s.timeoutHandler(handler, s.handlerTimeout)
+	}
+	switch {
+	case len(s.laneLimits) > 0:
+		s.lanes = newLaneLimiter(s.maxInFlight, s.laneLimits, s.laneQueueTimeout)
+		handler = s.laneHandler(handler)
+	case s.maxInFlight > 0 && s.targetLatency > 0:
+		s.adaptive = newAdaptiveLimiter(s.maxInFlight, s.targetLatency)
+		handler = s.adaptiveLimitHandler(handler)
+	case s.maxInFlight > 0:
+		s.inFlight = make(chan struct{}, s.maxInFlight)
+		handler = s.limitHandler(handler)
+	}
+	if s.importThrottle != nil {
+		handler = s.throttleHandler(handler)
+	}
+	if s.signingKey != nil {
+		handler = s.signingHandler(handler)
+	}
+	s.resetConfirms = &resetConfirmations{tokens: make(map[string]resetConfirmation)}
+	s.mode = &serverMode{}
+	initialMode := s.initialMode
+	if initialMode.Mode == "" {
+		initialMode = modeState{Mode: ModeNormal, RetryAfter: int(defaultModeRetryAfter / time.Second)}
+	}
+	initialMode.Since = s.now().UTC()
+	s.mode.set(initialMode)
+	handler = s.modeHandler(handler)
+	handler = s.versionHandler(handler)
+	if s.pathPolicy == PathRedirect || s.pathPolicy == PathRewrite {
+		handler = s.pathHandler(handler)
+	}
+	handler = s.requestLogHandler(handler)
+	if len(s.trustedProxies) > 0 {
+		handler = s.clientIPHandler(handler)
+	}
+	s.handler = handler
+
+	return s
+}
+
+// Option is a configuration option for NewServer.
+type Option func(s *Server)
+
+// WithMaxInFlight sets the maximum number of requests the server will
+// handle concurrently. Requests beyond that are rejected immediately with
+// 503 Service Unavailable and an "overloaded" error. The default of zero
+// means no limit.
+func WithMaxInFlight(n int) Option {
+	return func(s *Server) {
+		s.maxInFlight = n
+	}
+}
+
+// WithAdaptiveLimit makes the concurrency limit set by WithMaxInFlight
+// adaptive: it's lowered while requests take longer than target, and
+// raised back towards the maximum while they're faster (see
+// adaptiveLimiter). The current limit is reported by /stats. The default
+// of zero means a fixed limit.
+func WithAdaptiveLimit(target time.Duration) Option {
+	return func(s *Server) {
+		s.targetLatency = target
+	}
+}
+
+// WithClock sets the function used to get the current time, for example to
+// decide whether an album has been published yet. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) {
+		s.now = now
+	}
+}
+
+// WithHandlerTimeout sets the maximum time a handler may take to produce a
+// response. If it takes longer, the request's context is cancelled and a
+// 503 Service Unavailable "timeout" error is returned. The default of zero
+// means no timeout.
+func WithHandlerTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.handlerTimeout = timeout
+	}
+}
+
+// apiRoutes is the table of the API's routes, compiled once at startup
+// (see router.go). Handlers for "/albums/{id:album}" and its sub-resources
+// are passed the decoded album ID as a parameter, once it's been checked
+// with validateAlbumID. It's set in init, as handlers look their route up
+// in it (to name it in errors, for example), which Go would otherwise
+// reject as an initialization cycle.
+var apiRoutes *router
+
+func init() {
+	apiRoutes = newAPIRoutes()
+}
+
+func newAPIRoutes() *router {
+	rt := newRouter()
+	rt.handle("GET", "/albums", (*Server).getAlbums)
+	rt.handle("POST", "/albums", (*Server).addAlbum)
+	rt.handle("GET", "/albums/search", (*Server).searchAlbums)
+	rt.handle("POST", "/albums/import", (*Server).importAlbums)
+	rt.handle("POST", "/albums/lookup", (*Server).lookupAlbums)
+	rt.handle("GET", "/albums/{id:album}", (*Server).getAlbumByID)
+	rt.handle("PUT", "/albums/{id:album}", (*Server).putAlbum)
+	rt.handle("DELETE", "/albums/{id:album}", (*Server).deleteAlbum)
+	rt.handle("GET", "/albums/{id:album}/tracks", (*Server).getTracks)
+	rt.handle("POST", "/albums/{id:album}/tracks", (*Server).addTrack)
+	rt.handle("GET", "/albums/{id:album}/cover", (*Server).getCover)
+	rt.handle("PUT", "/albums/{id:album}/cover", (*Server).putCover)
+	rt.handle("DELETE", "/albums/{id:album}/cover", (*Server).deleteCover)
+	rt.handle("GET", "/albums/{id:album}/attachments", (*Server).getAttachments)
+	rt.handle("POST", "/albums/{id:album}/attachments", (*Server).addAttachment)
+	rt.handle("GET", "/albums/{id:album}/attachments/{attachment_id}", (*Server).getAttachment)
+	rt.handle("DELETE", "/albums/{id:album}/attachments/{attachment_id}", (*Server).deleteAttachment)
+	rt.handle("POST", "/albums/{id:album}/cover/upload-url", (*Server).createCoverUpload)
+	rt.handle("POST", "/albums/{id:album}/cover/confirm", (*Server).confirmCoverUpload)
+	rt.handle("GET", "/albums/{id:album}/cover/download-url", (*Server).getCoverDownloadURL)
+	rt.handle("PUT", "/albums/{id:album}/favorite", (*Server).putFavorite)
+	rt.handle("DELETE", "/albums/{id:album}/favorite", (*Server).deleteFavorite)
+	rt.handle("GET", "/albums/{id:album}/barcode.png", (*Server).getBarcode)
+	rt.handle("GET", "/albums/{id:album}/qr.png", (*Server).getQRCode)
+	rt.handle("POST", "/albums/{id:album}/restore", (*Server).restoreAlbum)
+	rt.handle("POST", "/albums/{id:album}/purchase", (*Server).purchaseAlbum)
+	rt.handle("GET", "/albums/{id:album}/versions", (*Server).getAlbumVersions)
+	rt.handle("GET", "/albums/{id:album}/diff", (*Server).getAlbumDiff)
+	rt.handle("PUT", "/uploads/{token}", (*Server).putUpload)
+	rt.handle("GET", "/lookup", (*Server).lookupIdentifier)
+
+	rt.handle("GET", "/graphql", (*Server).graphQL)
+	rt.handle("POST", "/graphql", (*Server).graphQL)
+	rt.handle("GET", "/graphql/schema", (*Server).getGraphQLSchema)
+
+	rt.handle("GET", "/ws", (*Server).getWebSocket)
+
+	rt.handle("GET", "/genres", (*Server).getGenres)
+	rt.handle("POST", "/genres", (*Server).addGenre)
+
+	rt.handle("GET", "/docs/examples", (*Server).getExamples)
+
+	rt.handle("GET", "/problems/{code:slug}", (*Server).getProblem)
+
+	rt.handle("GET", "/readyz", (*Server).getReadyz)
+	rt.handle("GET", "/version", (*Server).getVersion)
+	rt.handle("GET", "/deprecations", (*Server).getDeprecations)
+	rt.handle("GET", "/stats", (*Server).getStats)
+
+	rt.handle("GET", "/mode", (*Server).getMode)
+	rt.handle("PUT", "/mode", (*Server).putMode)
+
+	rt.handle("POST", "/diagnostics", (*Server).postDiagnostics)
+
+	rt.handle("GET", "/admin", (*Server).getAdmin)
+	rt.handle("POST", "/admin/login", (*Server).postAdminLogin)
+	rt.handle("POST", "/admin/logout", (*Server).postAdminLogout)
+	rt.handle("POST", "/admin/albums", (*Server).postAdminAlbum)
+	rt.handle("POST", "/admin/albums/{id:album}/delete", (*Server).postAdminDeleteAlbum)
+	rt.handle("POST", "/admin/reset", (*Server).postAdminReset)
+
+	rt.handle("GET", "/static/{name...}", (*Server).getStaticFile)
+	rt.handle("HEAD", "/static/{name...}", (*Server).getStaticFile)
+
+	rt.handle("GET", "/sitemap.xml", (*Server).getSitemap)
+
+	rt.handle("GET", "/feed.atom", (*Server).getFeed)
+
+	rt.handle("GET", "/events", (*Server).getEvents)
+
+	rt.handle("GET", "/webhooks", (*Server).getWebhooks)
+	rt.handle("POST", "/webhooks", (*Server).addWebhookHandler)
+	rt.handle("GET", "/webhooks/{id}", (*Server).getWebhook)
+	rt.handle("DELETE", "/webhooks/{id}", (*Server).deleteWebhook)
+	rt.handle("GET", "/webhooks/{id}/deliveries", (*Server).getWebhookDeliveries)
+	rt.handle("POST", "/webhooks/{id}/rotate-secret", (*Server).rotateWebhookSecret)
+
+	rt.handle("GET", "/audit", (*Server).getAudit)
+
+	rt.handle("POST", "/users", (*Server).createUser)
+	rt.handle("POST", "/users/login", (*Server).login)
+	rt.handle("POST", "/users/logout", (*Server).logout)
+	rt.handle("GET", "/users/me", (*Server).getCurrentUser)
+
+	rt.handle("GET", "/me/favorites", (*Server).getFavorites)
+
+	rt.handle("GET", "/orders", (*Server).getOrders)
+	rt.handle("POST", "/orders", (*Server).createOrder)
+	rt.handle("GET", "/orders/{id}", (*Server).getOrder)
+	rt.handle("POST", "/orders/{id}/status", (*Server).updateOrderStatus)
+	rt.handle("POST", "/orders/{id}/pay", (*Server).payOrder)
+
+	rt.handle("POST", "/payments/stripe", (*Server).receiveStripeWebhook)
+
+	rt.handle("GET", "/export", (*Server).getExport)
+
+	rt.handle("POST", "/blobs/scrub", (*Server).scrubBlobs)
+
+	rt.handle("POST", "/migration/backfill", (*Server).postMigrationBackfill)
+	rt.handle("GET", "/migration/report", (*Server).getMigrationReport)
+
+	rt.handle("GET", "/signing-key", (*Server).getSigningKey)
+
+	rt.handle("GET", "/signing-keys", (*Server).getSigningKeys)
+
+	rt.handle("GET", "/keys", (*Server).getKeys)
+
+	rt.handle("GET", "/openapi.json", (*Server).getOpenAPI)
+	return rt
+}
+
+// ServeHTTP logs the request and passes it through the middleware chain
+// to the router.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.log.Printf("%s %s", r.Method, r.URL.Path)
+	w.Header().Set("Server", s.serverHeader)
+	s.handler.ServeHTTP(w, r)
+}
+
+// route routes the request and calls the correct handler based on the URL
+// and HTTP method. It writes a 404 Not Found if the request URL is unknown,
+// or 405 Method Not Allowed if the request method is invalid.
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	if !s.checkQueryParams(w, r) {
+		return
+	}
+	apiRoutes.serve(s, w, r)
+}
+
+func (s *Server) getAlbums(w http.ResponseWriter, r *http.Request) {
+	includeDeleted, ok := s.includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	filter, ok := s.filterParam(w, r)
+	if !ok {
+		return
+	}
+	genres := paramValues(r, "genre")
+	artists := paramValues(r, "artist")
+	w.Header().Add("Vary", "Accept")
+	if wantsNDJSON(r) {
+		s.streamAlbumsNDJSON(w, r, includeDeleted, genres, artists, filter)
+		return
+	}
+	var albums []Album
+	var err error
+	if filter != nil {
+		albums, err = filterAlbums(s.db, filter)
+	} else {
+		albums, err = s.db.GetAlbums()
+	}
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+
+	// Only list albums that have been published and not deleted (and are
+	// in one of the given genres, by one of the given artists, and match
+	// the filter)
+	albums = filterVisible(albums, s.now(), includeDeleted)
+	if genres != nil {
+		albums = filterGenre(albums, genres...)
+	}
+	if artists != nil {
+		filtered := albums[:0]
+		for _, album := range albums {
+			if matchArtist(album, artists) {
+				filtered = append(filtered, album)
+			}
+		}
+		albums = filtered
+	}
+	err = s.addFavoriteCounts(albums)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	albums = s.redactAlbums(r, albums)
+	if wantsXML(r) {
+		s.writeXML(w, r, xmlContentType, xmlAlbumList{Albums: albums})
+		return
+	}
+	if wantsJSONAPI(r) {
+		s.writeJSONAPIAlbums(w, r, albums)
+		return
+	}
+	if mediaType, encoder := s.negotiateEncoder(r); encoder != nil {
+		s.writeEncoded(w, r, mediaType, func(buf *bytes.Buffer) error {
+			return encoder.EncodeAlbums(buf, albums)
+		})
+		return
+	}
+	if wantsHTML(r) {
+		s.writeAlbumsHTML(w, r, albums)
+		return
+	}
+	if len(albums) > streamListThreshold {
+		// Too many to buffer the whole list just for an ETag
+		s.streamJSONArray(w, r, http.StatusOK, len(albums), func(i int) interface{} { return albums[i] })
+		return
+	}
+	s.writeJSONWithETag(w, r, albums)
+}
+
+func (s *Server) addAlbum(w http.ResponseWriter, r *http.Request) {
+	album, ok := s.readAlbum(w, r, "")
+	if !ok {
+		return
+	}
+	stored, err := s.createAlbum(r, album)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.writeCreatedAlbum(w, r, stored)
+}
+
+// createAlbum adds a validated album to the database, generating its ID if
+// the client didn't give one, and audits it. It returns the stored album,
+// or an *apierr.Error.
+func (s *Server) createAlbum(r *http.Request, album Album) (Album, error) {
+	if album.ID == "" {
+		// Client didn't specify an ID, so generate one
+		id, err := s.idGenerator.NewID()
+		if err != nil {
+			return Album{}, apierr.Internal(fmt.Errorf("generating album ID: %w", err))
+		}
+		album.ID = id
+	}
+
+	stored, err := s.db.AddAlbum(album)
+	if err != nil {
+		return Album{}, apierr.Database(fmt.Errorf("adding album ID %q: %w", album.ID, err))
+	}
+	s.audit(r, "create", "album", stored.ID, nil, snapshot(stored))
+	return stored, nil
+}
+
+// writeCreatedAlbum writes a 201 Created response for a new album, with
+// its Location (and self link, if enabled).
+func (s *Server) writeCreatedAlbum(w http.ResponseWriter, r *http.Request, album Album) {
+	response := createdAlbum{Album: s.redactAlbum(r, album)}
+	location := s.albumURL(r, album.ID)
+	if s.selfLinks {
+		response.Links = &resourceLinks{Self: location}
+	}
+	w.Header().Set("Location", location)
+	w.Header().Set("ETag", albumETag(album))
+	if wantsJSONAPI(r) {
+		s.writeJSONAPIAlbum(w, r, http.StatusCreated, response.Album)
+		return
+	}
+	s.writeJSON(w, r, http.StatusCreated, response)
+}
+
+// readAlbum reads an album from the request body and validates it,
+// writing an error response if it's not valid. If id is not empty, it's
+// the album ID from the URL, which the body's ID (if given) must match. It
+// returns true on success; the caller should return from the handler early
+// if it returns false.
+func (s *Server) readAlbum(w http.ResponseWriter, r *http.Request, id string) (Album, bool) {
+	var input albumInput
+	if !s.readJSON(w, r, &input) {
+		return Album{}, false
+	}
+	album, issues, err := s.validateAlbum(input, id)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return Album{}, false
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return Album{}, false
+	}
+	return album, true
+}
+
+// albumInput is an album as given by a client. The price is decoded
+// separately, so we can apply the price input rules.
+type albumInput struct {
+	Album
+	Price json.RawMessage `json:"price"`
+}
+
+// validateAlbum validates an album from a client, returning the album to
+// store and a map of validation issues (empty if it's valid). If id is not
+// empty, it's the album ID from the URL, which the input's ID (if given)
+// must match. It only returns an error if checking the genres or the
+// uniqueness of the identifiers fails.
+func (s *Server) validateAlbum(input albumInput, id string) (Album, map[string]interface{}, error) {
+	album := input.Album
+
+	// Validate the input and build a map of validation issues
+	issues := make(map[string]interface{})
+	if id != "" {
+		if album.ID != "" && album.ID != id {
+			issues["id"] = validationIssue{"mismatch", "id must match the album ID in the URL"}
+		}
+		album.ID = id // already checked by the router
+	} else if album.ID != "" {
+		if issue := validateAlbumID(album.ID); issue != nil {
+			issues["id"] = *issue
+		}
+	}
+	price, issue := parsePrice(input.Price, s.priceMode)
+	if issue != nil {
+		issues["price"] = *issue
+	}
+	album.Price = price
+	album.DeletedAt = nil // only set by deleting the album
+	album.Favorites = 0   // only counted when fetching the album
+	if album.Title == "" {
+		issues["title"] = validationIssue{"required", ""}
+	}
+	if album.Artist == "" {
+		issues["artist"] = validationIssue{"required", ""}
+	}
+	if issue == nil && (album.Price < 0 || album.Price >= 100000) {
+		issues["price"] = validationIssue{"out-of-range", "price must be between 0 and $1000"}
+	}
+	if album.PublishAt != nil {
+		// Store in UTC so comparisons and output don't depend on the
+		// client's (or server's) time zone
+		publishAt := album.PublishAt.UTC()
+		album.PublishAt = &publishAt
+	}
+	validateCatalogNumber(album.CatalogNumber, issues)
+	validateStock(album.Stock, issues)
+	normalizeAlbumIdentifiers(&album)
+	validateAlbumIdentifiers(album, issues)
+	// Check before the tracks are sorted, so issues have the input's indexes
+	trackPrefix := func(i int) string { return fmt.Sprintf("tracks.%d.", i) }
+	if err := s.checkUniqueIdentifiers(album, trackPrefix, issues); err != nil {
+		return Album{}, nil, err
+	}
+	album.Tracks = validateAlbumTracks(album.Tracks, issues)
+	genres, err := s.validateAlbumGenres(album.Genres, issues)
+	if err != nil {
+		return Album{}, nil, err
+	}
+	album.Genres = genres
+	return album, issues, nil
+}
+
+func (s *Server) putAlbum(w http.ResponseWriter, r *http.Request, id string) {
+	album, ok := s.readAlbum(w, r, id)
+	if !ok {
+		return
+	}
+
+	// The expected version can be given in an If-Match header (the ETag
+	// from fetching the album) or in the body
+	version := album.Version
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		var ok bool
+		version, ok = parseVersionETag(ifMatch)
+		if !ok {
+			issues := map[string]interface{}{
+				"If-Match": validationIssue{"invalid", "If-Match must be the album's ETag, like \"1\""},
+			}
+			s.writeError(w, r, apierr.Validation(issues))
+			return
+		}
+	}
+
+	before := s.albumSnapshot(album.ID)
+	stored, err := s.db.PutAlbum(album, version)
+	if errors.Is(err, ErrVersionConflict) && version == 0 {
+		// Album exists, but client didn't say which version it's replacing
+		s.writeError(w, r, apierr.PreconditionRequired())
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("putting album ID %q: %w", album.ID, err)))
+		return
+	}
+	if version == 0 {
+		s.audit(r, "create", "album", stored.ID, nil, snapshot(stored))
+		s.writeCreatedAlbum(w, r, stored)
+		return
+	}
+	s.audit(r, "update", "album", stored.ID, before, snapshot(stored))
+	w.Header().Set("ETag", albumETag(stored))
+	if wantsJSONAPI(r) {
+		s.writeJSONAPIAlbum(w, r, http.StatusOK, s.redactAlbum(r, stored))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, s.redactAlbum(r, stored))
+}
+
+// validationIssue is a single validation error in the "data" field of a
+// validation error response, keyed by field name.
+type validationIssue struct {
+	Error   string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
+func (s *Server) getAlbumByID(w http.ResponseWriter, r *http.Request, id string) {
+	includeDeleted, ok := s.includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	asOf, ok := s.asOfParam(w, r)
+	if !ok {
+		return
+	}
+	album, err := s.db.GetAlbumByID(id)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	// Pretend unpublished (and deleted) albums don't exist
+	hidden := func(album Album) bool {
+		return !album.published(s.now()) || album.DeletedAt != nil && !includeDeleted
+	}
+	if hidden(album) {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if !asOf.isZero() {
+		// Fetch the version current at the given time (or the given
+		// revision), which must have been visible too
+		album, err = s.albumAsOf(id, asOf)
+		if err != nil {
+			s.writeError(w, r, apierr.Database(err))
+			return
+		}
+		if hidden(album) {
+			s.writeError(w, r, apierr.NotFound())
+			return
+		}
+	}
+	albums := []Album{album}
+	err = s.addFavoriteCounts(albums)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	album = s.redactAlbum(r, albums[0])
+	w.Header().Add("Vary", "Accept")
+	if wantsXML(r) {
+		s.writeXML(w, r, xmlContentType, xmlAlbum{Album: album})
+		return
+	}
+	if wantsJSONAPI(r) {
+		s.writeJSONAPIAlbum(w, r, http.StatusOK, album)
+		return
+	}
+	if mediaType, encoder := s.negotiateEncoder(r); encoder != nil {
+		s.writeEncoded(w, r, mediaType, func(buf *bytes.Buffer) error {
+			return encoder.EncodeAlbum(buf, album)
+		})
+		return
+	}
+	if wantsHTML(r) {
+		s.writeAlbumHTML(w, r, album)
+		return
+	}
+	w.Header().Set("ETag", albumETag(album))
+	s.writeJSON(w, r, http.StatusOK, album)
+}
+
+// writeJSON marshals v to JSON and writes it to the response, handling
+// errors as appropriate. It also sets the Content-Type header to
+// "application/json". The JSON is compact unless pretty-printing is on
+// (see prettyJSON).
+func (s *Server) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// The encoder only writes once it has marshaled all of v, so if that
+	// fails the status hasn't been sent yet
+	sw := &statusOnWrite{ResponseWriter: w, status: status}
+	err := s.encodeJSON(sw, r, v, "")
+	switch {
+	case err != nil && !sw.wrote:
+		s.log.Printf("error marshaling JSON: %v", err)
+		http.Error(w, `{"error":"`+apierr.CodeInternal+`"}`, http.StatusInternalServerError)
+	case err != nil:
+		// Very unlikely to happen, but log any error (not much more we can do)
+		s.log.Printf("error writing JSON: %v", err)
+	}
+}
+
+// writeError writes err to the response as a structured JSON error. Domain
+// errors are mapped to API errors using errorMapping, and any other errors
+// that aren't already an *apierr.Error are reported as internal errors.
+// Server errors (5xx) are logged along with their underlying cause.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := errorMapping.Lookup(err)
+	if apiErr.Status >= 500 {
+		s.log.Printf("error handling %s %s: %v", r.Method, r.URL.Path, apiErr)
+	}
+	if s.devMode && apiErr.Code == apierr.CodeValidation {
+		apiErr = s.addErrorHints(r, apiErr)
+	}
+	apiErr = s.translateError(w, r, apiErr)
+	if apiErr.Retry != nil && apiErr.Retry.AfterSeconds > 0 && w.Header().Get("Retry-After") == "" {
+		w.Header().Set("Retry-After", strconv.Itoa(apiErr.Retry.AfterSeconds))
+	}
+	if wantsXML(r) {
+		s.xmlError(w, apiErr.Status, apiErr.Code, apiErr.Data, apiErr.Retry)
+		return
+	}
+	if wantsJSONAPI(r) {
+		s.jsonAPIErrors(w, r, apiErr)
+		return
+	}
+	if s.problemDetails || wantsProblem(r) {
+		s.problemError(w, r, apiErr)
+		return
+	}
+	s.jsonError(w, r, apiErr.Status, apiErr.Code, apiErr.Data, apiErr.Retry)
+}
+
+// methodNotAllowed writes a 405 Method Not Allowed error, setting the Allow
+// header to the given allowed methods.
+func (s *Server) methodNotAllowed(w http.ResponseWriter, r *http.Request, allow string) {
+	w.Header().Set("Allow", allow)
+	s.writeError(w, r, apierr.MethodNotAllowed())
+}
+
+// jsonError writes a structured error as JSON to the response, with
+// optional structured data in the "data" field and retry advice in the
+// "retry" field. Handlers should use writeError instead of calling this
+// directly.
+func (s *Server) jsonError(w http.ResponseWriter, r *http.Request, status int, error string, data map[string]interface{}, retry *apierr.Retry) {
+	response := struct {
+		Status int                    `json:"status"`
+		Error  string                 `json:"error"`
+		Data   map[string]interface{} `json:"data,omitempty"`
+		Retry  *apierr.Retry          `json:"retry,omitempty"`
+	}{
+		Status: status,
+		Error:  error,
+		Data:   data,
+		Retry:  retry,
+	}
+	s.writeJSON(w, r, status, response)
+}
+
+// readJSON reads the request body and unmarshals it from JSON, handling
+// errors as appropriate. It returns true on success; the caller should
+// return from the handler early if it returns false.
+func (s *Server) readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("reading JSON body: %w", err)))
+		return false
+	}
+	err = s.codec.Decode(b, v)
+	if err != nil {
+		s.writeError(w, r, apierr.MalformedJSON(err))
+		return false
+	}
+	return true
+}
+
+// MemoryDatabase is a Database implementation that uses a simple
+// in-memory map to store the albums.
+type MemoryDatabase struct {
+	// MaxAlbums and MaxBytes limit the number of albums and approximate
+	// memory used by the database. Zero means no limit. When a limit would
+	// be exceeded, adds return ErrFull. These must be set before use.
+	MaxAlbums int
+	MaxBytes  int64
+
+	// MaxVersions limits the number of prior versions kept for each album
+	// (see GetAlbumVersions), discarding the oldest. Zero means no limit.
+	// Prior versions don't count towards MaxBytes. This must be set before
+	// use.
+	MaxVersions int
+
+	// Now is the clock used for album timestamps. The default (nil) is
+	// time.Now. This must be set before use.
+	Now func() time.Time
+
+	// Blobs stores the content of cover art and attachments.
+	// NewMemoryDatabase sets it to a new MemoryBlobStore. This must be set
+	// before use.
+	Blobs BlobStore
+
+	lock        sync.RWMutex
+	albums      map[string]Album
+	genres      map[string]Genre
+	words       map[string]map[string]struct{} // inverted index: word -> album IDs
+	bytes       int64                          // approximate memory used by albums
+	history     map[string][]Album             // prior versions of each album, oldest first
+	covers      map[string]Cover               // by album ID, without their data, which is in Blobs
+	attachments map[string][]Attachment        // by album ID, oldest first, without their data
+	thumbnails  map[string]map[string]Cover    // by album ID and size name, without their data
+}
+
+// NewMemoryDatabase creates a new in-memory database.
+func NewMemoryDatabase() *MemoryDatabase {
+	return &MemoryDatabase{
+		albums:      make(map[string]Album),
+		genres:      make(map[string]Genre),
+		words:       make(map[string]map[string]struct{}),
+		history:     make(map[string][]Album),
+		covers:      make(map[string]Cover),
+		attachments: make(map[string][]Attachment),
+		thumbnails:  make(map[string]map[string]Cover),
+		Blobs:       NewMemoryBlobStore(),
+	}
+}
+
+// now returns the current time for album timestamps.
+func (d *MemoryDatabase) now() time.Time {
+	if d.Now == nil {
+		return time.Now().UTC()
+	}
+	return d.Now().UTC()
+}
+
+func (d *MemoryDatabase) GetAlbums() ([]Album, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	// Make a copy of the albums map (as a slice)
+	albums := make([]Album, 0, len(d.albums))
+	for _, album := range d.albums {
+		albums = append(albums, album)
+	}
+
+	sortAlbums(albums)
+	return albums, nil
+}
+
+// sortAlbums sorts albums by ID so we return them in a defined order (see
+// the Database interface for the ordering rules).
+func sortAlbums(albums []Album) {
+	sort.Slice(albums, func(i, j int) bool {
+		return albums[i].ID < albums[j].ID
+	})
+}
+
+func (d *MemoryDatabase) GetAlbumByID(id string) (Album, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	album, ok := d.albums[id]
+	if !ok {
+		return Album{}, ErrDoesNotExist
+	}
+	return album, nil
+}
+
+func (d *MemoryDatabase) AddAlbum(album Album) (Album, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.albums[album.ID]; ok {
+		return Album{}, ErrAlreadyExists
+	}
+	size := albumSize(album)
+	if d.MaxAlbums > 0 && len(d.albums) >= d.MaxAlbums {
+		return Album{}, fmt.Errorf("%w: max albums %d reached", ErrFull, d.MaxAlbums)
+	}
+	if d.MaxBytes > 0 && d.bytes+size > d.MaxBytes {
+		return Album{}, fmt.Errorf("%w: max bytes %d reached", ErrFull, d.MaxBytes)
+	}
+	album.Version = 1
+	album.CreatedAt = d.now()
+	album.UpdatedAt = album.CreatedAt
+	d.albums[album.ID] = album
+	d.bytes += size
+	d.indexAlbum(album)
+	return album, nil
+}
+
+func (d *MemoryDatabase) PutAlbum(album Album, version int) (Album, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	old, exists := d.albums[album.ID]
+	switch {
+	case exists && old.DeletedAt != nil && version == 0:
+		return Album{}, fmt.Errorf("%w: album is deleted", ErrAlreadyExists)
+	case exists && old.DeletedAt != nil:
+		return Album{}, ErrDoesNotExist
+	case version == 0 && exists:
+		return Album{}, fmt.Errorf("%w: album exists with version %d", ErrVersionConflict, old.Version)
+	case version != 0 && !exists:
+		return Album{}, fmt.Errorf("%w: album doesn't exist", ErrVersionConflict)
+	case version != 0 && old.Version != version:
+		return Album{}, fmt.Errorf("%w: album has version %d, not %d", ErrVersionConflict, old.Version, version)
+	}
+
+	size := albumSize(album)
+	if exists {
+		size -= albumSize(old)
+	} else if d.MaxAlbums > 0 && len(d.albums) >= d.MaxAlbums {
+		return Album{}, fmt.Errorf("%w: max albums %d reached", ErrFull, d.MaxAlbums)
+	}
+	if d.MaxBytes > 0 && size > 0 && d.bytes+size > d.MaxBytes {
+		return Album{}, fmt.Errorf("%w: max bytes %d reached", ErrFull, d.MaxBytes)
+	}
+	album.CreatedAt = d.now()
+	album.UpdatedAt = album.CreatedAt
+	if exists {
+		d.unindexAlbum(old)
+		d.saveVersion(old)
+		album.CreatedAt = old.CreatedAt
+	}
+	album.Version = version + 1
+	d.albums[album.ID] = album
+	d.bytes += size
+	d.indexAlbum(album)
+	return album, nil
+}
+
+// indexAlbum adds album's title and artist words to the search index.
+func (d *MemoryDatabase) indexAlbum(album Album) {
+	for _, word := range searchWords(album.Title + " " + album.Artist) {
+		if d.words[word] == nil {
+			d.words[word] = make(map[string]struct{})
+		}
+		d.words[word][album.ID] = struct{}{}
+	}
+}
+
+// unindexAlbum removes album's words from the search index.
+func (d *MemoryDatabase) unindexAlbum(album Album) {
+	for _, word := range searchWords(album.Title + " " + album.Artist) {
+		delete(d.words[word], album.ID)
+		if len(d.words[word]) == 0 {
+			delete(d.words, word)
+		}
+	}
+}
+
+func (d *MemoryDatabase) DeleteAlbum(id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	album, ok := d.albums[id]
+	if !ok {
+		return ErrDoesNotExist
+	}
+	delete(d.albums, id)
+	delete(d.history, id)
+	d.bytes -= albumSize(album)
+	d.releaseCover(id)
+	d.releaseAttachments(id)
+	d.unindexAlbum(album)
+	return nil
+}
+
+func (d *MemoryDatabase) AddTrack(albumID string, track Track) (Track, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	album, ok := d.albums[albumID]
+	if !ok || album.DeletedAt != nil {
+		return Track{}, ErrDoesNotExist
+	}
+	if track.Number == 0 {
+		track.Number = 1
+		if len(album.Tracks) > 0 {
+			track.Number = album.Tracks[len(album.Tracks)-1].Number + 1
+		}
+	}
+	for _, t := range album.Tracks {
+		if t.Number == track.Number {
+			return Track{}, ErrAlreadyExists
+		}
+	}
+	size := trackSize(track)
+	if d.MaxBytes > 0 && d.bytes+size > d.MaxBytes {
+		return Track{}, fmt.Errorf("%w: max bytes %d reached", ErrFull, d.MaxBytes)
+	}
+	d.bytes += size
+	d.saveVersion(album)
+
+	// Copy rather than append in place, as GetAlbums and friends return
+	// albums that share the old Tracks slice
+	tracks := make([]Track, len(album.Tracks), len(album.Tracks)+1)
+	copy(tracks, album.Tracks)
+	album.Tracks = append(tracks, track)
+	sortTracks(album.Tracks)
+	album.Version++
+	album.UpdatedAt = d.now()
+	d.albums[albumID] = album
+	return track, nil
+}
+
+func (d *MemoryDatabase) SearchAlbums(query string) ([]Album, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	// Find the IDs matching each query word (as a prefix of an indexed
+	// word), and only keep the albums that match all of them
+	var matches map[string]struct{}
+	for _, queryWord := range searchWords(query) {
+		wordMatches := make(map[string]struct{})
+		for word, ids := range d.words {
+			if strings.HasPrefix(word, queryWord) {
+				for id := range ids {
+					wordMatches[id] = struct{}{}
+				}
+			}
+		}
+		if matches == nil {
+			matches = wordMatches
+			continue
+		}
+		for id := range matches {
+			if _, ok := wordMatches[id]; !ok {
+				delete(matches, id)
+			}
+		}
+	}
+
+	albums := make([]Album, 0, len(matches))
+	for id := range matches {
+		albums = append(albums, d.albums[id])
+	}
+	sortAlbums(albums)
+	return albums, nil
+}
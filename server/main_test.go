@@ -1,6 +1,6 @@
 // Tests for the server functions
 
-package main
+package server
 
 import (
 	"encoding/json"
@@ -14,6 +14,9 @@ import (
 	"strings"
 	"testing"
 	"testing/iotest"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
 )
 
 // Duplicate this struct in tests so tests catch breaking changes.
@@ -22,6 +25,18 @@ type testAlbum struct {
 	Title  string `json:"title"`
 	Artist string `json:"artist"`
 	Price  int    `json:"price"`
+
+	PublishAt string      `json:"publish_at"`
+	Tracks    []testTrack `json:"tracks"`
+	Genres    []string    `json:"genres"`
+
+	CatalogNumber string `json:"catalog_number"`
+}
+
+type testTrack struct {
+	Number   int    `json:"number"`
+	Title    string `json:"title"`
+	Duration int    `json:"duration"`
 }
 
 func TestGetAlbums(t *testing.T) {
@@ -91,6 +106,10 @@ func TestAddAlbumCreated(t *testing.T) {
 	if !reflect.DeepEqual(got, want) {
 		t.Fatalf("bad response: got vs want:\n%#v\n%#v", got, want)
 	}
+	location := result.Header.Get("Location")
+	if location != "/albums/a9" {
+		t.Fatalf("bad Location header: got %q, want %q", location, "/albums/a9")
+	}
 
 	// Ensure we can fetch the album after it's been created
 	testGetAlbum(t, server, getAlbumTest{"/albums/a9", http.StatusOK, want})
@@ -123,6 +142,58 @@ func TestAddAlbumAlreadyExists(t *testing.T) {
 	testGetAlbum(t, server, getAlbumTest{"/albums/a2", http.StatusOK, want})
 }
 
+func TestPutAlbum(t *testing.T) {
+	server := newTestServer()
+
+	// Replacing an existing album (at its current version) returns 200
+	body := `{"title": "Let It Be", "artist": "The Beatles", "price": 1500, "version": 1}`
+	result := serve(t, server, newRequest(t, "PUT", "/albums/a2", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusOK)
+	var got testAlbum
+	unmarshalResponse(t, result, &got)
+	want := testAlbum{ID: "a2", Title: "Let It Be", Artist: "The Beatles", Price: 1500}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad response: got vs want:\n%#v\n%#v", got, want)
+	}
+	testGetAlbum(t, server, getAlbumTest{"/albums/a2", http.StatusOK, want})
+
+	// Putting a new album returns 201, and doing it again with the
+	// album's ETag returns 200
+	body = `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel"}`
+	want = testAlbum{ID: "a9", Title: "Pianoman", Artist: "Billy Joel"}
+	ifMatch := ""
+	for _, status := range []int{http.StatusCreated, http.StatusOK} {
+		request := newRequest(t, "PUT", "/albums/a9", strings.NewReader(body))
+		if ifMatch != "" {
+			request.Header.Set("If-Match", ifMatch)
+		}
+		result = serve(t, server, request)
+		ensureStatus(t, result, status)
+		got = testAlbum{}
+		unmarshalResponse(t, result, &got)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("bad response: got vs want:\n%#v\n%#v", got, want)
+		}
+		ifMatch = result.Header.Get("ETag")
+	}
+	if location := result.Header.Get("Location"); location != "" {
+		t.Fatalf("got Location %q on replace, want none", location)
+	}
+	ensureAlbumIDs(t, server, []string{"a1", "a2", "a9"})
+}
+
+func TestPutAlbumValidation(t *testing.T) {
+	server := newTestServer()
+	body := `{"id": "a1", "title": "", "artist": "The Beatles"}`
+	result := serve(t, server, newRequest(t, "PUT", "/albums/a2", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusBadRequest)
+	data := map[string]interface{}{
+		"id":    map[string]interface{}{"error": "mismatch", "message": "id must match the album ID in the URL"},
+		"title": map[string]interface{}{"error": "required"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+}
+
 func TestAddAlbumBadJSON(t *testing.T) {
 	server := newTestServer()
 	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader("@")))
@@ -138,7 +209,6 @@ func TestAddAlbumMissingFields(t *testing.T) {
 	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{"price": -1}`)))
 	ensureStatus(t, result, http.StatusBadRequest)
 	data := map[string]interface{}{
-		"id":     map[string]interface{}{"error": "required"},
 		"title":  map[string]interface{}{"error": "required"},
 		"artist": map[string]interface{}{"error": "required"},
 		"price":  map[string]interface{}{"error": "out-of-range", "message": "price must be between 0 and $1000"},
@@ -146,6 +216,65 @@ func TestAddAlbumMissingFields(t *testing.T) {
 	ensureError(t, result, http.StatusBadRequest, "validation", data)
 }
 
+func TestScheduledPublishing(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	server := NewServer(db, log.New(io.Discard, "", 0), WithClock(func() time.Time { return now }))
+
+	// Publish time is in a different time zone, 1 hour from now (UTC)
+	body := `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel", "publish_at": "2021-06-01T14:00:00+01:00"}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	var got testAlbum
+	unmarshalResponse(t, result, &got)
+	want := testAlbum{ID: "a9", Title: "Pianoman", Artist: "Billy Joel", PublishAt: "2021-06-01T13:00:00Z"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad response: got vs want:\n%#v\n%#v", got, want)
+	}
+
+	// Not published yet, so not listed and not fetchable
+	ensureAlbumIDs(t, server, []string{"a1"})
+	testGetAlbum(t, server, getAlbumTest{"/albums/a9", http.StatusNotFound, testAlbum{}})
+
+	// Exactly at the publish time, it's visible
+	now = now.Add(time.Hour)
+	ensureAlbumIDs(t, server, []string{"a1", "a9"})
+	testGetAlbum(t, server, getAlbumTest{"/albums/a9", http.StatusOK, want})
+}
+
+func TestScheduledPublishingBadTime(t *testing.T) {
+	server := newTestServer()
+	body := `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel", "publish_at": "2021-06-01 14:00"}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusBadRequest)
+
+	// Exact time parsing error message varies between Go versions
+	var got struct {
+		Error string `json:"error"`
+	}
+	unmarshalResponse(t, result, &got)
+	if got.Error != "malformed-json" {
+		t.Fatalf("bad error: got %q, want %q", got.Error, "malformed-json")
+	}
+}
+
+// ensureAlbumIDs checks that GET /albums lists exactly the given album IDs.
+func ensureAlbumIDs(t *testing.T, server *Server, want []string) {
+	t.Helper()
+	result := serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var albums []testAlbum
+	unmarshalResponse(t, result, &albums)
+	got := []string{}
+	for _, album := range albums {
+		got = append(got, album.ID)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad album IDs: got %q, want %q", got, want)
+	}
+}
+
 func TestConcurrentRequests(t *testing.T) {
 	server := newTestServer()
 	for i := 0; i < 100; i++ {
@@ -180,6 +309,56 @@ func TestDatabaseErrors(t *testing.T) {
 	result = serve(t, server, newRequest(t, "GET", "/albums/a1", nil))
 	ensureStatus(t, result, http.StatusInternalServerError)
 	ensureError(t, result, http.StatusInternalServerError, "database", nil)
+
+	result = serve(t, server, newRequest(t, "GET", "/albums/search?q=foo", nil))
+	ensureStatus(t, result, http.StatusInternalServerError)
+	ensureError(t, result, http.StatusInternalServerError, "database", nil)
+
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusInternalServerError)
+	ensureError(t, result, http.StatusInternalServerError, "database", nil)
+}
+
+func TestErrorRetryAdvice(t *testing.T) {
+	server := NewServer(errorDatabase{}, log.New(io.Discard, "", 0))
+
+	result := serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusInternalServerError)
+	if got := result.Header.Get("Retry-After"); got != "1" {
+		t.Fatalf("got Retry-After %q, want 1", got)
+	}
+	var envelope struct {
+		Retry *apierr.Retry `json:"retry"`
+	}
+	unmarshalResponse(t, result, &envelope)
+	if envelope.Retry == nil || *envelope.Retry != (apierr.Retry{Retryable: true, AfterSeconds: 1}) {
+		t.Fatalf("got retry %+v", envelope.Retry)
+	}
+
+	// The other error formats include it too
+	for _, test := range []struct {
+		accept string
+		want   string
+	}{
+		{problemContentType, `"retry":{`},
+		{jsonAPIContentType, `"retry":{`},
+		{"application/xml", "<retryable>true</retryable>"},
+	} {
+		request := newRequest(t, "GET", "/albums", nil)
+		request.Header.Set("Accept", test.accept)
+		result := serve(t, server, request)
+		body, _ := io.ReadAll(result.Body)
+		if !strings.Contains(string(body), test.want) {
+			t.Errorf("%s: retry advice not found in %s", test.accept, body)
+		}
+	}
+
+	// Errors with nothing to advise don't include it
+	result = serve(t, server, newRequest(t, "GET", "/nope", nil))
+	body, _ := io.ReadAll(result.Body)
+	if strings.Contains(string(body), "retry") || result.Header.Get("Retry-After") != "" {
+		t.Fatalf("unexpected retry advice: %s", body)
+	}
 }
 
 type errorDatabase struct{}
@@ -192,8 +371,56 @@ func (errorDatabase) GetAlbumByID(id string) (Album, error) {
 	return Album{}, errors.New("GetAlbumByID error")
 }
 
-func (errorDatabase) AddAlbum(album Album) error {
-	return errors.New("AddAlbum error")
+func (errorDatabase) GetAlbumsByIDs(ids []string) ([]Album, error) {
+	return nil, errors.New("GetAlbumsByIDs error")
+}
+
+func (errorDatabase) AddAlbum(album Album) (Album, error) {
+	return Album{}, errors.New("AddAlbum error")
+}
+
+func (errorDatabase) PutAlbum(album Album, version int) (Album, error) {
+	return Album{}, errors.New("PutAlbum error")
+}
+
+func (errorDatabase) DeleteAlbum(id string) error {
+	return errors.New("DeleteAlbum error")
+}
+
+func (errorDatabase) SoftDeleteAlbum(id string, deletedAt time.Time) error {
+	return errors.New("SoftDeleteAlbum error")
+}
+
+func (errorDatabase) RestoreAlbum(id string) (Album, error) {
+	return Album{}, errors.New("RestoreAlbum error")
+}
+
+func (errorDatabase) PurgeDeletedAlbums(before time.Time) (int, error) {
+	return 0, errors.New("PurgeDeletedAlbums error")
+}
+
+func (errorDatabase) GetAlbumVersions(id string) ([]Album, error) {
+	return nil, errors.New("GetAlbumVersions error")
+}
+
+func (errorDatabase) GetAlbumAt(id string, at time.Time) (Album, error) {
+	return Album{}, errors.New("GetAlbumAt error")
+}
+
+func (errorDatabase) AddTrack(albumID string, track Track) (Track, error) {
+	return Track{}, errors.New("AddTrack error")
+}
+
+func (errorDatabase) GetGenres() ([]Genre, error) {
+	return nil, errors.New("GetGenres error")
+}
+
+func (errorDatabase) AddGenre(genre Genre) error {
+	return errors.New("AddGenre error")
+}
+
+func (errorDatabase) SearchAlbums(query string) ([]Album, error) {
+	return nil, errors.New("SearchAlbums error")
 }
 
 func TestMethodNotAllowed(t *testing.T) {
@@ -202,16 +429,16 @@ func TestMethodNotAllowed(t *testing.T) {
 	ensureStatus(t, result, http.StatusMethodNotAllowed)
 	ensureError(t, result, http.StatusMethodNotAllowed, "method-not-allowed", nil)
 	allow := result.Header.Get("Allow")
-	if allow != "GET, POST" {
-		t.Fatalf("bad Allow header: got %q, want %q", allow, "GET, POST")
+	if allow != "GET, HEAD, POST, OPTIONS" {
+		t.Fatalf("bad Allow header: got %q, want %q", allow, "GET, HEAD, POST, OPTIONS")
 	}
 
-	result = serve(t, server, newRequest(t, "PUT", "/albums/a1", nil))
+	result = serve(t, server, newRequest(t, "PATCH", "/albums/a1", nil))
 	ensureStatus(t, result, http.StatusMethodNotAllowed)
 	ensureError(t, result, http.StatusMethodNotAllowed, "method-not-allowed", nil)
 	allow = result.Header.Get("Allow")
-	if allow != "GET" {
-		t.Fatalf("bad Allow header: got %q, want %q", allow, "GET")
+	if allow != "GET, HEAD, PUT, DELETE, OPTIONS" {
+		t.Fatalf("bad Allow header: got %q, want %q", allow, "GET, HEAD, PUT, DELETE, OPTIONS")
 	}
 }
 
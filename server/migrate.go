@@ -0,0 +1,711 @@
+// Dual-write migration between Database backends
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// MigratingDatabase is a Database for migrating between two backends with
+// no downtime. Reads are served by the primary backend (Old, or New if
+// ReadFromNew is set), and every write is applied to the primary and then
+// mirrored to the other backend. A failed mirror write is logged but
+// doesn't fail the request; run Backfill to copy existing data (and fix
+// any drift), and Verify to check the backends agree before switching
+// over.
+//
+// Versions and timestamps are managed by each backend, so they're not
+// copied, and clients see the primary's. To switch reads to the new
+// backend, restart with ReadFromNew set, which also makes it the primary
+// for writes.
+type MigratingDatabase struct {
+	Old         Database
+	New         Database
+	ReadFromNew bool
+	Log         *log.Logger
+
+	mirrorErrors int64 // accessed atomically
+}
+
+// NewMigratingDatabase creates a database that migrates from oldDB to
+// newDB, logging mirror errors to log.
+func NewMigratingDatabase(oldDB, newDB Database, log *log.Logger) *MigratingDatabase {
+	return &MigratingDatabase{Old: oldDB, New: newDB, Log: log}
+}
+
+// Migrator is an optional interface a Database can implement to support
+// the admin migration endpoints.
+type Migrator interface {
+	// Backfill makes the secondary backend's data match the primary's.
+	Backfill() (BackfillResult, error)
+
+	// Verify compares the backends and reports any differences.
+	Verify() (MigrationReport, error)
+}
+
+// BackfillResult is the outcome of a backfill.
+type BackfillResult struct {
+	Albums int `json:"albums"` // number of albums changed in the secondary
+	Genres int `json:"genres"` // number of genres added to the secondary
+
+	// Attachments is the number of attachments copied to the secondary
+	Attachments int `json:"attachments"`
+}
+
+// MigrationReport lists the differences between the primary and secondary
+// backends, by album ID or genre ID.
+type MigrationReport struct {
+	Consistent    bool     `json:"consistent"`
+	Missing       []string `json:"missing"`   // albums only in the primary
+	Extra         []string `json:"extra"`     // albums only in the secondary
+	Different     []string `json:"different"` // albums that differ
+	MissingGenres []string `json:"missing_genres"`
+
+	// MirrorErrors is the number of writes that failed to mirror since the
+	// server started.
+	MirrorErrors int64 `json:"mirror_errors"`
+}
+
+func (m *MigratingDatabase) primary() Database {
+	if m.ReadFromNew {
+		return m.New
+	}
+	return m.Old
+}
+
+func (m *MigratingDatabase) secondary() Database {
+	if m.ReadFromNew {
+		return m.Old
+	}
+	return m.New
+}
+
+// mirrorError records a failure to mirror a write to the secondary.
+func (m *MigratingDatabase) mirrorError(what string, err error) {
+	atomic.AddInt64(&m.mirrorErrors, 1)
+	m.Log.Printf("error mirroring %s to secondary database: %v", what, err)
+}
+
+// mirrorAlbum makes the secondary's copy of the album match the primary's,
+// logging any error.
+func (m *MigratingDatabase) mirrorAlbum(id string) {
+	_, err := m.syncAlbum(id)
+	if err != nil {
+		m.mirrorError(fmt.Sprintf("album ID %q", id), err)
+	}
+}
+
+// syncAlbum makes the secondary's copy of the album with the given ID
+// match the primary's, adding, replacing, soft deleting, or deleting it
+// as needed. It reports whether anything was changed.
+func (m *MigratingDatabase) syncAlbum(id string) (changed bool, err error) {
+	primary, secondary := m.primary(), m.secondary()
+	want, err := primary.GetAlbumByID(id)
+	if errors.Is(err, ErrDoesNotExist) {
+		err = secondary.DeleteAlbum(id)
+		if errors.Is(err, ErrDoesNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	fields := want
+	fields.DeletedAt = nil
+
+	got, err := secondary.GetAlbumByID(id)
+	if errors.Is(err, ErrDoesNotExist) {
+		got, err = secondary.AddAlbum(fields)
+		changed = true
+	}
+	if err != nil {
+		return changed, err
+	}
+	if got.DeletedAt != nil && (want.DeletedAt == nil || !sameAlbum(got, want)) {
+		// Deleted albums can't be changed, so restore it first
+		got, err = secondary.RestoreAlbum(id)
+		if err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	if !sameAlbum(got, fields) && got.DeletedAt == nil {
+		got, err = secondary.PutAlbum(fields, got.Version)
+		if err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	if want.DeletedAt != nil && got.DeletedAt == nil {
+		err = secondary.SoftDeleteAlbum(id, *want.DeletedAt)
+		if err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// sameAlbum reports whether a and b have the same data, ignoring the
+// fields each backend manages itself (the version and timestamps).
+func sameAlbum(a, b Album) bool {
+	return reflect.DeepEqual(comparableAlbum(a), comparableAlbum(b))
+}
+
+func comparableAlbum(album Album) Album {
+	album.Version = 0
+	album.CreatedAt = time.Time{}
+	album.UpdatedAt = time.Time{}
+	if len(album.Tracks) == 0 {
+		album.Tracks = nil
+	}
+	if len(album.Genres) == 0 {
+		album.Genres = nil
+	}
+	if album.PublishAt != nil {
+		publishAt := album.PublishAt.UTC()
+		album.PublishAt = &publishAt
+	}
+	if album.DeletedAt != nil {
+		deletedAt := album.DeletedAt.UTC()
+		album.DeletedAt = &deletedAt
+	}
+	return album
+}
+
+func (m *MigratingDatabase) Backfill() (BackfillResult, error) {
+	return m.backfill(nil)
+}
+
+// backfill is like Backfill, but if wait isn't nil, it's called before
+// each album is synced, to throttle the backfill (see WithImportRate).
+func (m *MigratingDatabase) backfill(wait func() error) (BackfillResult, error) {
+	var result BackfillResult
+	ids, err := m.albumIDs()
+	if err != nil {
+		return result, err
+	}
+	for _, id := range ids {
+		if wait != nil {
+			err := wait()
+			if err != nil {
+				return result, err
+			}
+		}
+		changed, err := m.syncAlbum(id)
+		if err != nil {
+			return result, fmt.Errorf("backfilling album ID %q: %w", id, err)
+		}
+		if changed {
+			result.Albums++
+		}
+	}
+
+	missing, err := m.missingGenres()
+	if err != nil {
+		return result, err
+	}
+	for _, genre := range missing {
+		err := m.secondary().AddGenre(genre)
+		if err != nil && !errors.Is(err, ErrAlreadyExists) {
+			return result, fmt.Errorf("backfilling genre ID %q: %w", genre.ID, err)
+		}
+		result.Genres++
+	}
+
+	attachments, err := m.backfillAttachments(ids)
+	result.Attachments = attachments
+	return result, err
+}
+
+// backfillAttachments copies the attachments of the given albums that the
+// secondary doesn't have from the primary, if they both store attachments,
+// returning the number copied. Attachments can't be changed, so only their
+// IDs matter. Soft deleted albums can't have attachments added, so theirs
+// are copied by the first backfill after they're restored.
+func (m *MigratingDatabase) backfillAttachments(albumIDs []string) (int, error) {
+	primary, ok := m.primary().(AttachmentStore)
+	if !ok {
+		return 0, nil
+	}
+	secondary, ok := m.secondary().(AttachmentStore)
+	if !ok {
+		return 0, nil
+	}
+	n := 0
+	for _, albumID := range albumIDs {
+		album, err := m.primary().GetAlbumByID(albumID)
+		if errors.Is(err, ErrDoesNotExist) || (err == nil && album.DeletedAt != nil) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		want, err := primary.GetAttachments(albumID)
+		if err != nil {
+			return n, err
+		}
+		have, err := secondary.GetAttachments(albumID)
+		if err != nil {
+			return n, err
+		}
+		haveIDs := make(map[string]bool, len(have))
+		for _, attachment := range have {
+			haveIDs[attachment.ID] = true
+		}
+		for _, attachment := range want {
+			if haveIDs[attachment.ID] {
+				continue
+			}
+			attachment, err := primary.GetAttachment(albumID, attachment.ID)
+			if errors.Is(err, ErrDoesNotExist) {
+				continue // deleted since it was listed
+			}
+			if err != nil {
+				return n, err
+			}
+			_, err = secondary.AddAttachment(albumID, attachment)
+			if err != nil && !errors.Is(err, ErrAlreadyExists) {
+				return n, fmt.Errorf("backfilling attachment ID %q: %w", attachment.ID, err)
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// albumIDs returns the IDs of the albums in either backend, sorted.
+func (m *MigratingDatabase) albumIDs() ([]string, error) {
+	seen := make(map[string]bool)
+	for _, db := range []Database{m.primary(), m.secondary()} {
+		albums, err := db.GetAlbums()
+		if err != nil {
+			return nil, err
+		}
+		for _, album := range albums {
+			seen[album.ID] = true
+		}
+	}
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// missingGenres returns the primary's genres that the secondary doesn't
+// have, sorted by ID. Genres can't be changed, so only their IDs matter.
+func (m *MigratingDatabase) missingGenres() ([]Genre, error) {
+	have, err := m.secondary().GetGenres()
+	if err != nil {
+		return nil, err
+	}
+	haveIDs := make(map[string]bool, len(have))
+	for _, genre := range have {
+		haveIDs[genre.ID] = true
+	}
+	want, err := m.primary().GetGenres()
+	if err != nil {
+		return nil, err
+	}
+	var missing []Genre
+	for _, genre := range want {
+		if !haveIDs[genre.ID] {
+			missing = append(missing, genre)
+		}
+	}
+	return missing, nil
+}
+
+func (m *MigratingDatabase) Verify() (MigrationReport, error) {
+	report := MigrationReport{
+		Missing:       []string{},
+		Extra:         []string{},
+		Different:     []string{},
+		MissingGenres: []string{},
+		MirrorErrors:  atomic.LoadInt64(&m.mirrorErrors),
+	}
+	primary, err := m.primary().GetAlbums()
+	if err != nil {
+		return report, err
+	}
+	secondary, err := m.secondary().GetAlbums()
+	if err != nil {
+		return report, err
+	}
+
+	// Both lists are sorted by ID, so merge them
+	i, j := 0, 0
+	for i < len(primary) || j < len(secondary) {
+		switch {
+		case j == len(secondary) || i < len(primary) && primary[i].ID < secondary[j].ID:
+			report.Missing = append(report.Missing, primary[i].ID)
+			i++
+		case i == len(primary) || secondary[j].ID < primary[i].ID:
+			report.Extra = append(report.Extra, secondary[j].ID)
+			j++
+		default:
+			if !sameAlbum(primary[i], secondary[j]) {
+				report.Different = append(report.Different, primary[i].ID)
+			}
+			i++
+			j++
+		}
+	}
+
+	missing, err := m.missingGenres()
+	if err != nil {
+		return report, err
+	}
+	for _, genre := range missing {
+		report.MissingGenres = append(report.MissingGenres, genre.ID)
+	}
+	report.Consistent = len(report.Missing) == 0 && len(report.Extra) == 0 &&
+		len(report.Different) == 0 && len(report.MissingGenres) == 0
+	return report, nil
+}
+
+func (m *MigratingDatabase) GetAlbums() ([]Album, error) {
+	return m.primary().GetAlbums()
+}
+
+// StreamAlbums implements AlbumStreamer by streaming from the primary.
+func (m *MigratingDatabase) StreamAlbums(fn func(album Album) error) error {
+	return streamAlbums(m.primary(), fn)
+}
+
+// FilterAlbums implements AlbumFilterer by filtering on the primary.
+func (m *MigratingDatabase) FilterAlbums(filter Filter) ([]Album, error) {
+	return filterAlbums(m.primary(), filter)
+}
+
+func (m *MigratingDatabase) GetAlbumByID(id string) (Album, error) {
+	return m.primary().GetAlbumByID(id)
+}
+
+func (m *MigratingDatabase) GetAlbumsByIDs(ids []string) ([]Album, error) {
+	return m.primary().GetAlbumsByIDs(ids)
+}
+
+func (m *MigratingDatabase) AddAlbum(album Album) (Album, error) {
+	stored, err := m.primary().AddAlbum(album)
+	if err != nil {
+		return Album{}, err
+	}
+	m.mirrorAlbum(stored.ID)
+	return stored, nil
+}
+
+func (m *MigratingDatabase) PutAlbum(album Album, version int) (Album, error) {
+	stored, err := m.primary().PutAlbum(album, version)
+	if err != nil {
+		return Album{}, err
+	}
+	m.mirrorAlbum(stored.ID)
+	return stored, nil
+}
+
+func (m *MigratingDatabase) DeleteAlbum(id string) error {
+	err := m.primary().DeleteAlbum(id)
+	if err != nil {
+		return err
+	}
+	m.mirrorAlbum(id)
+	return nil
+}
+
+func (m *MigratingDatabase) SoftDeleteAlbum(id string, deletedAt time.Time) error {
+	err := m.primary().SoftDeleteAlbum(id, deletedAt)
+	if err != nil {
+		return err
+	}
+	m.mirrorAlbum(id)
+	return nil
+}
+
+func (m *MigratingDatabase) RestoreAlbum(id string) (Album, error) {
+	album, err := m.primary().RestoreAlbum(id)
+	if err != nil {
+		return Album{}, err
+	}
+	m.mirrorAlbum(id)
+	return album, nil
+}
+
+func (m *MigratingDatabase) PurgeDeletedAlbums(before time.Time) (int, error) {
+	n, err := m.primary().PurgeDeletedAlbums(before)
+	if err != nil {
+		return 0, err
+	}
+	_, err = m.secondary().PurgeDeletedAlbums(before)
+	if err != nil {
+		m.mirrorError("purge", err)
+	}
+	return n, nil
+}
+
+func (m *MigratingDatabase) GetAlbumVersions(id string) ([]Album, error) {
+	return m.primary().GetAlbumVersions(id)
+}
+
+func (m *MigratingDatabase) GetAlbumAt(id string, at time.Time) (Album, error) {
+	return m.primary().GetAlbumAt(id, at)
+}
+
+func (m *MigratingDatabase) AddTrack(albumID string, track Track) (Track, error) {
+	added, err := m.primary().AddTrack(albumID, track)
+	if err != nil {
+		return Track{}, err
+	}
+	m.mirrorAlbum(albumID)
+	return added, nil
+}
+
+// GetCover implements CoverStore by reading from the primary. If the
+// primary doesn't store covers, no album has one.
+func (m *MigratingDatabase) GetCover(albumID string) (Cover, error) {
+	store, ok := m.primary().(CoverStore)
+	if !ok {
+		return Cover{}, ErrDoesNotExist
+	}
+	return store.GetCover(albumID)
+}
+
+// PutCover implements CoverStore, mirroring the cover to the secondary if
+// it stores covers too.
+func (m *MigratingDatabase) PutCover(albumID string, cover Cover) error {
+	store, ok := m.primary().(CoverStore)
+	if !ok {
+		return fmt.Errorf("%w: primary database doesn't store covers", ErrDoesNotExist)
+	}
+	err := store.PutCover(albumID, cover)
+	if err != nil {
+		return err
+	}
+	if secondary, ok := m.secondary().(CoverStore); ok {
+		err = secondary.PutCover(albumID, cover)
+		if err != nil {
+			m.mirrorError(fmt.Sprintf("cover for album ID %q", albumID), err)
+		}
+	}
+	return nil
+}
+
+// DeleteCover implements CoverStore, mirroring the delete to the
+// secondary if it stores covers too.
+func (m *MigratingDatabase) DeleteCover(albumID string) error {
+	store, ok := m.primary().(CoverStore)
+	if !ok {
+		return ErrDoesNotExist
+	}
+	err := store.DeleteCover(albumID)
+	if err != nil {
+		return err
+	}
+	if secondary, ok := m.secondary().(CoverStore); ok {
+		err = secondary.DeleteCover(albumID)
+		if err != nil && !errors.Is(err, ErrDoesNotExist) {
+			m.mirrorError(fmt.Sprintf("cover for album ID %q", albumID), err)
+		}
+	}
+	return nil
+}
+
+// CoverPresigner implements DirectCoverStore with the primary's presigner,
+// if it has one. Uploads staged while one database was the primary can't
+// be confirmed after the other becomes the primary, so clients need to
+// upload them again.
+func (m *MigratingDatabase) CoverPresigner() BlobPresigner {
+	store, ok := m.primary().(DirectCoverStore)
+	if !ok {
+		return nil
+	}
+	return store.CoverPresigner()
+}
+
+// GetCoverMetadata implements DirectCoverStore by reading from the
+// primary.
+func (m *MigratingDatabase) GetCoverMetadata(albumID string) (Cover, error) {
+	store, ok := m.primary().(DirectCoverStore)
+	if !ok {
+		return Cover{}, ErrDoesNotExist
+	}
+	return store.GetCoverMetadata(albumID)
+}
+
+// GetThumbnail implements ThumbnailStore by reading from the primary.
+// Thumbnails aren't mirrored to the secondary, as it generates its own
+// when it's promoted.
+func (m *MigratingDatabase) GetThumbnail(albumID, size string) (Cover, error) {
+	store, ok := m.primary().(ThumbnailStore)
+	if !ok {
+		return Cover{}, ErrDoesNotExist
+	}
+	return store.GetThumbnail(albumID, size)
+}
+
+// PutThumbnail implements ThumbnailStore by storing the thumbnail in the
+// primary, if it stores thumbnails.
+func (m *MigratingDatabase) PutThumbnail(albumID, size, coverHash string, thumbnail Cover) error {
+	store, ok := m.primary().(ThumbnailStore)
+	if !ok {
+		return ErrDoesNotExist
+	}
+	return store.PutThumbnail(albumID, size, coverHash, thumbnail)
+}
+
+// GetAttachments implements AttachmentStore by reading from the primary.
+// If the primary doesn't store attachments, no album has any.
+func (m *MigratingDatabase) GetAttachments(albumID string) ([]Attachment, error) {
+	store, ok := m.primary().(AttachmentStore)
+	if !ok {
+		_, err := m.primary().GetAlbumByID(albumID)
+		return nil, err
+	}
+	return store.GetAttachments(albumID)
+}
+
+// GetAttachment implements AttachmentStore by reading from the primary.
+func (m *MigratingDatabase) GetAttachment(albumID, id string) (Attachment, error) {
+	store, ok := m.primary().(AttachmentStore)
+	if !ok {
+		return Attachment{}, ErrDoesNotExist
+	}
+	return store.GetAttachment(albumID, id)
+}
+
+// AddAttachment implements AttachmentStore, mirroring the attachment to
+// the secondary if it stores attachments too.
+func (m *MigratingDatabase) AddAttachment(albumID string, attachment Attachment) (Attachment, error) {
+	store, ok := m.primary().(AttachmentStore)
+	if !ok {
+		return Attachment{}, fmt.Errorf("%w: primary database doesn't store attachments", ErrDoesNotExist)
+	}
+	added, err := store.AddAttachment(albumID, attachment)
+	if err != nil {
+		return Attachment{}, err
+	}
+	if secondary, ok := m.secondary().(AttachmentStore); ok {
+		_, err = secondary.AddAttachment(albumID, attachment)
+		if err != nil {
+			m.mirrorError(fmt.Sprintf("attachment ID %q", attachment.ID), err)
+		}
+	}
+	return added, nil
+}
+
+// DeleteAttachment implements AttachmentStore, mirroring the delete to the
+// secondary if it stores attachments too.
+func (m *MigratingDatabase) DeleteAttachment(albumID, id string) error {
+	store, ok := m.primary().(AttachmentStore)
+	if !ok {
+		return ErrDoesNotExist
+	}
+	err := store.DeleteAttachment(albumID, id)
+	if err != nil {
+		return err
+	}
+	if secondary, ok := m.secondary().(AttachmentStore); ok {
+		err = secondary.DeleteAttachment(albumID, id)
+		if err != nil && !errors.Is(err, ErrDoesNotExist) {
+			m.mirrorError(fmt.Sprintf("attachment ID %q", id), err)
+		}
+	}
+	return nil
+}
+
+// ScrubBlobs implements BlobScrubber by scrubbing the primary's blobs (the
+// secondary's are checked when it becomes the primary). If the primary
+// doesn't store blobs, there's nothing to scrub.
+func (m *MigratingDatabase) ScrubBlobs() (BlobScrubReport, error) {
+	scrubber, ok := m.primary().(BlobScrubber)
+	if !ok {
+		return BlobScrubReport{Corrupt: []string{}}, nil
+	}
+	return scrubber.ScrubBlobs()
+}
+
+func (m *MigratingDatabase) GetGenres() ([]Genre, error) {
+	return m.primary().GetGenres()
+}
+
+func (m *MigratingDatabase) AddGenre(genre Genre) error {
+	err := m.primary().AddGenre(genre)
+	if err != nil {
+		return err
+	}
+	err = m.secondary().AddGenre(genre)
+	if err != nil && !errors.Is(err, ErrAlreadyExists) {
+		m.mirrorError(fmt.Sprintf("genre ID %q", genre.ID), err)
+	}
+	return nil
+}
+
+func (m *MigratingDatabase) SearchAlbums(query string) ([]Album, error) {
+	return m.primary().SearchAlbums(query)
+}
+
+// CheckAvailability reports the primary's availability, if it can. Mirror
+// writes to an unavailable secondary fail without failing the request.
+func (m *MigratingDatabase) CheckAvailability() (readErr, writeErr error) {
+	if checker, ok := m.primary().(AvailabilityChecker); ok {
+		return checker.CheckAvailability()
+	}
+	return nil, nil
+}
+
+// throttledBackfiller is a Migrator whose backfill can be throttled.
+type throttledBackfiller interface {
+	backfill(wait func() error) (BackfillResult, error)
+}
+
+func (s *Server) postMigrationBackfill(w http.ResponseWriter, r *http.Request) {
+	migrator, ok := s.db.(Migrator)
+	if !ok {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	var result BackfillResult
+	var err error
+	if backfiller, ok := migrator.(throttledBackfiller); ok && s.importThrottle != nil {
+		result, err = backfiller.backfill(func() error { return s.waitToWrite(r) })
+	} else {
+		result, err = migrator.Backfill()
+	}
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("backfilling: %w", err)))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, result)
+}
+
+func (s *Server) getMigrationReport(w http.ResponseWriter, r *http.Request) {
+	migrator, ok := s.db.(Migrator)
+	if !ok {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	report, err := migrator.Verify()
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("verifying migration: %w", err)))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, report)
+}
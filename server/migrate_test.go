@@ -0,0 +1,172 @@
+// Tests for dual-write migration between databases
+
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigratingDatabaseConformance(t *testing.T) {
+	for _, readFromNew := range []bool{false, true} {
+		testDatabaseConformance(t, func() Database {
+			db := NewMigratingDatabase(NewMemoryDatabase(), NewMemoryDatabase(), log.New(io.Discard, "", 0))
+			db.ReadFromNew = readFromNew
+			return db
+		})
+	}
+}
+
+func newMigrationTestServer(db *MigratingDatabase) *Server {
+	return NewServer(db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }),
+	)
+}
+
+func ensureConsistent(t *testing.T, db *MigratingDatabase) {
+	t.Helper()
+	report, err := db.Verify()
+	if err != nil {
+		t.Fatalf("error verifying: %v", err)
+	}
+	if !report.Consistent {
+		t.Fatalf("databases aren't consistent: %+v", report)
+	}
+}
+
+func TestMigratingDatabaseMirrorsWrites(t *testing.T) {
+	oldDB, newDB := NewMemoryDatabase(), NewMemoryDatabase()
+	db := NewMigratingDatabase(oldDB, newDB, log.New(io.Discard, "", 0))
+	server := newMigrationTestServer(db)
+
+	requests := []*http.Request{
+		newRequest(t, "POST", "/genres", strings.NewReader(`{"id": "rock", "name": "Rock"}`)),
+		newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a1", "title": "Hey Jude", "artist": "The Beatles"}`)),
+		newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a2", "title": "Pianoman", "artist": "Billy Joel"}`)),
+		newRequest(t, "PUT", "/albums/a1", strings.NewReader(`{"title": "Hey Jude", "artist": "The Beatles", "genres": ["rock"], "version": 1}`)),
+		newRequest(t, "POST", "/albums/a1/tracks", strings.NewReader(`{"title": "Hey Jude", "duration": 431}`)),
+		newRequest(t, "DELETE", "/albums/a2", nil),
+	}
+	for _, request := range requests {
+		result := serve(t, server, request)
+		if result.StatusCode >= 300 {
+			t.Fatalf("%s %s: got status %d", request.Method, request.URL, result.StatusCode)
+		}
+	}
+	ensureConsistent(t, db)
+
+	album, err := newDB.GetAlbumByID("a1")
+	if err != nil {
+		t.Fatalf("error getting album from new database: %v", err)
+	}
+	if len(album.Tracks) != 1 || !reflect.DeepEqual(album.Genres, []string{"rock"}) {
+		t.Fatalf("bad album in new database: %+v", album)
+	}
+	album, err = newDB.GetAlbumByID("a2")
+	if err != nil || album.DeletedAt == nil {
+		t.Fatalf("album not soft deleted in new database: %+v, %v", album, err)
+	}
+
+	// Restores are mirrored too
+	result := serve(t, server, newAdminRequest(t, "POST", "/albums/a2/restore", nil))
+	ensureStatus(t, result, http.StatusOK)
+	ensureConsistent(t, db)
+}
+
+func TestMigratingDatabaseBackfill(t *testing.T) {
+	oldDB, newDB := NewMemoryDatabase(), NewMemoryDatabase()
+	oldDB.AddGenre(Genre{ID: "rock", Name: "Rock"})
+	oldDB.AddAlbum(Album{ID: "a1", Title: "Hey Jude", Artist: "The Beatles", Genres: []string{"rock"}})
+	oldDB.AddTrack("a1", Track{Title: "Hey Jude", Duration: 431})
+	oldDB.AddAttachment("a1", Attachment{ID: "n1", Filename: "notes.txt", ContentType: "text/plain; charset=utf-8", Data: []byte("notes")})
+	oldDB.AddAlbum(Album{ID: "a2", Title: "Pianoman", Artist: "Billy Joel"})
+	oldDB.AddAttachment("a2", Attachment{ID: "n2", Filename: "notes.txt", ContentType: "text/plain; charset=utf-8", Data: []byte("notes")})
+	oldDB.SoftDeleteAlbum("a2", time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC))
+	oldDB.AddAlbum(Album{ID: "a3", Title: "9th Symphony", Artist: "Beethoven"})
+	newDB.AddAlbum(Album{ID: "a3", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	newDB.AddAlbum(Album{ID: "a4", Title: "Thriller", Artist: "Michael Jackson"})
+	db := NewMigratingDatabase(oldDB, newDB, log.New(io.Discard, "", 0))
+	server := newMigrationTestServer(db)
+
+	result := serve(t, server, newAdminRequest(t, "GET", "/migration/report", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var report MigrationReport
+	unmarshalResponse(t, result, &report)
+	want := MigrationReport{
+		Missing:       []string{"a1", "a2"},
+		Extra:         []string{"a4"},
+		Different:     []string{"a3"},
+		MissingGenres: []string{"rock"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("bad report: got vs want:\n%+v\n%+v", report, want)
+	}
+
+	result = serve(t, server, newAdminRequest(t, "POST", "/migration/backfill", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var backfill BackfillResult
+	unmarshalResponse(t, result, &backfill)
+	if backfill != (BackfillResult{Albums: 4, Genres: 1, Attachments: 1}) {
+		t.Fatalf("bad backfill result: %+v", backfill)
+	}
+	ensureConsistent(t, db)
+	attachment, err := newDB.GetAttachment("a1", "n1")
+	if err != nil || string(attachment.Data) != "notes" {
+		t.Fatalf("got attachment %+v, error %v", attachment, err)
+	}
+
+	// Backfilling again has nothing to do
+	backfill, err = db.Backfill()
+	if err != nil || backfill != (BackfillResult{}) {
+		t.Fatalf("got %+v, error %v backfilling again", backfill, err)
+	}
+}
+
+func TestMigratingDatabaseMirrorErrors(t *testing.T) {
+	newDB := &partialDatabase{MemoryDatabase: NewMemoryDatabase(), addErr: errors.New("disk full")}
+	db := NewMigratingDatabase(NewMemoryDatabase(), newDB, log.New(io.Discard, "", 0))
+	server := newMigrationTestServer(db)
+
+	// The write succeeds, but isn't mirrored
+	body := `{"id": "a1", "title": "Hey Jude", "artist": "The Beatles"}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	report, err := db.Verify()
+	if err != nil {
+		t.Fatalf("error verifying: %v", err)
+	}
+	if report.Consistent || report.MirrorErrors != 1 || !reflect.DeepEqual(report.Missing, []string{"a1"}) {
+		t.Fatalf("bad report: %+v", report)
+	}
+
+	// Once the new database is fixed, a backfill catches it up
+	newDB.addErr = nil
+	_, err = db.Backfill()
+	if err != nil {
+		t.Fatalf("error backfilling: %v", err)
+	}
+	ensureConsistent(t, db)
+}
+
+func TestMigrationEndpointErrors(t *testing.T) {
+	db := NewMigratingDatabase(NewMemoryDatabase(), NewMemoryDatabase(), log.New(io.Discard, "", 0))
+	server := newMigrationTestServer(db)
+	result := serve(t, server, newRequest(t, "GET", "/migration/report", nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	result = serve(t, server, newRequest(t, "POST", "/migration/backfill", nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	result = serve(t, server, newAdminRequest(t, "GET", "/migration/backfill", nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+
+	// Only available when migrating
+	server = NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithAdminToken(testAdminToken))
+	result = serve(t, server, newAdminRequest(t, "GET", "/migration/report", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
@@ -0,0 +1,162 @@
+// Read-only and maintenance modes, for backend migrations
+//
+// In read-only mode, reads are served as usual but writes are rejected
+// with 503 Service Unavailable and a "read-only" error, so the database
+// can be copied or migrated without changes being lost. In maintenance
+// mode every request gets a 503 "maintenance" error. Both set Retry-After,
+// so well-behaved clients back off and try again later.
+//
+// The mode can be set at startup, and switched at runtime by an admin
+// with PUT /mode, which (like /readyz) is served in every mode.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Mode is the server's operating mode.
+type Mode string
+
+const (
+	ModeNormal      Mode = "normal"
+	ModeReadOnly    Mode = "read-only"
+	ModeMaintenance Mode = "maintenance"
+)
+
+// defaultModeRetryAfter is how long clients are told to wait before
+// retrying in read-only or maintenance mode, if not given.
+const defaultModeRetryAfter = time.Minute
+
+// Errors reported by /readyz for the modes.
+var (
+	errReadOnlyMode    = errors.New("server is in read-only mode")
+	errMaintenanceMode = errors.New("server is down for maintenance")
+)
+
+// parseMode parses the name of a mode.
+func parseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case ModeNormal, ModeReadOnly, ModeMaintenance:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("mode must be %s, %s, or %s, not %q", ModeNormal, ModeReadOnly, ModeMaintenance, s)
+	}
+}
+
+// WithMode sets the mode the server starts in, and how long clients are
+// told to wait before retrying requests it rejects (zero means the
+// default of a minute). The default is ModeNormal.
+func WithMode(mode Mode, retryAfter time.Duration) Option {
+	return func(s *Server) {
+		if retryAfter <= 0 {
+			retryAfter = defaultModeRetryAfter
+		}
+		s.initialMode = modeState{Mode: mode, RetryAfter: int(retryAfter / time.Second)}
+	}
+}
+
+// modeState is the server's current mode, as returned by GET /mode.
+type modeState struct {
+	Mode       Mode      `json:"mode"`
+	RetryAfter int       `json:"retry_after"` // in seconds
+	Message    string    `json:"message,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// serverMode holds the current mode, which is read by every request.
+type serverMode struct {
+	state atomic.Value // modeState
+}
+
+func (m *serverMode) get() modeState {
+	return m.state.Load().(modeState)
+}
+
+func (m *serverMode) set(state modeState) {
+	m.state.Store(state)
+}
+
+// modeHandler rejects requests the current mode doesn't allow: writes
+// (methods other than GET, HEAD, and OPTIONS) in read-only mode, and everything in
+// maintenance mode. The mode and readiness endpoints are always passed
+// through.
+func (s *Server) modeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/mode" || r.URL.Path == "/readyz" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		state := s.mode.get()
+		var apiErr *apierr.Error
+		switch {
+		case state.Mode == ModeMaintenance:
+			apiErr = apierr.Maintenance(state.RetryAfter)
+		case state.Mode == ModeReadOnly && !isSafeMethod(r.Method):
+			apiErr = apierr.ReadOnly(state.RetryAfter)
+		default:
+			h.ServeHTTP(w, r)
+			return
+		}
+		if state.Message != "" {
+			apiErr = apiErr.WithData(map[string]interface{}{"message": state.Message})
+		}
+		s.writeError(w, r, apiErr)
+	})
+}
+
+func (s *Server) getMode(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, s.mode.get())
+}
+
+// modeInput is the new mode given to PUT /mode. RetryAfter is optional
+// (it defaults to the current value), as is Message, which is included in
+// the errors for rejected requests.
+type modeInput struct {
+	Mode       Mode   `json:"mode"`
+	RetryAfter *int   `json:"retry_after,omitempty"` // in seconds
+	Message    string `json:"message,omitempty"`
+}
+
+func (s *Server) putMode(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	var input modeInput
+	if !s.readJSON(w, r, &input) {
+		return
+	}
+	old := s.mode.get()
+	issues := make(map[string]interface{})
+	mode, err := parseMode(string(input.Mode))
+	if input.Mode == "" {
+		issues["mode"] = validationIssue{"required", ""}
+	} else if err != nil {
+		issues["mode"] = validationIssue{"invalid", err.Error()}
+	}
+	retryAfter := old.RetryAfter
+	if input.RetryAfter != nil {
+		retryAfter = *input.RetryAfter
+		if retryAfter < 1 {
+			issues["retry_after"] = validationIssue{"out-of-range", "retry_after must be at least 1 second"}
+		}
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+
+	state := modeState{Mode: mode, RetryAfter: retryAfter, Message: input.Message, Since: s.now().UTC()}
+	s.mode.set(state)
+	s.log.Printf("mode changed from %s to %s by %s", old.Mode, state.Mode, s.principal(r).ID)
+	s.writeJSON(w, r, http.StatusOK, state)
+}
@@ -0,0 +1,96 @@
+// Tests for read-only and maintenance modes
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModes(t *testing.T) {
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithAdminToken(testAdminToken))
+	album := `{"id": "m1", "title": "Help!", "artist": "The Beatles"}`
+
+	// Only admins can see or change the mode
+	result := serve(t, server, newRequest(t, "PUT", "/mode", strings.NewReader(`{"mode": "maintenance"}`)))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	result = serve(t, server, newAdminRequest(t, "GET", "/mode", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var state modeState
+	unmarshalResponse(t, result, &state)
+	if state.Mode != ModeNormal {
+		t.Fatalf("got mode %q, want normal", state.Mode)
+	}
+
+	// Read-only mode rejects writes, but not reads
+	input := `{"mode": "read-only", "retry_after": 120, "message": "migrating the database"}`
+	result = serve(t, server, newAdminRequest(t, "PUT", "/mode", strings.NewReader(input)))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(album)))
+	ensureError(t, result, http.StatusServiceUnavailable, "read-only", map[string]interface{}{"message": "migrating the database"})
+	if got := result.Header.Get("Retry-After"); got != "120" {
+		t.Fatalf("got Retry-After %q, want 120", got)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newRequest(t, "GET", "/readyz", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var ready readyzResponse
+	unmarshalResponse(t, result, &ready)
+	if ready != (readyzResponse{"degraded", "ok", "server is in read-only mode"}) {
+		t.Fatalf("bad readyz response in read-only mode: %+v", ready)
+	}
+
+	// Maintenance mode rejects everything but /mode and /readyz, and keeps
+	// the Retry-After if not given
+	result = serve(t, server, newAdminRequest(t, "PUT", "/mode", strings.NewReader(`{"mode": "maintenance"}`)))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newRequest(t, "GET", "/v1/albums", nil))
+	ensureError(t, result, http.StatusServiceUnavailable, "maintenance", nil)
+	if got := result.Header.Get("Retry-After"); got != "120" {
+		t.Fatalf("got Retry-After %q, want 120", got)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/readyz", nil))
+	ensureStatus(t, result, http.StatusServiceUnavailable)
+	result = serve(t, server, newAdminRequest(t, "PUT", "/mode", strings.NewReader(`{"mode": "normal"}`)))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(album)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	// Modes are validated
+	result = serve(t, server, newAdminRequest(t, "PUT", "/mode", strings.NewReader(`{"mode": "off", "retry_after": 0}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"mode":        map[string]interface{}{"error": "invalid", "message": `mode must be normal, read-only, or maintenance, not "off"`},
+		"retry_after": map[string]interface{}{"error": "out-of-range", "message": "retry_after must be at least 1 second"},
+	})
+	result = serve(t, server, newAdminRequest(t, "PUT", "/mode", strings.NewReader(`{}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"mode": map[string]interface{}{"error": "required"},
+	})
+}
+
+func TestWithMode(t *testing.T) {
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithMode(ModeMaintenance, 5*time.Minute),
+	)
+	result := serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureError(t, result, http.StatusServiceUnavailable, "maintenance", nil)
+	if got := result.Header.Get("Retry-After"); got != "300" {
+		t.Fatalf("got Retry-After %q, want 300", got)
+	}
+
+	for _, name := range []string{"normal", "read-only", "maintenance"} {
+		mode, err := parseMode(name)
+		if err != nil || string(mode) != name {
+			t.Errorf("%s: got %q, %v", name, mode, err)
+		}
+	}
+	if _, err := parseMode("readonly"); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
@@ -0,0 +1,159 @@
+// MessagePack encoding of album responses
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const msgpackContentType = "application/msgpack"
+
+// msgpackEncoder encodes albums as MessagePack (https://msgpack.org/).
+// Albums are encoded with the same structure and field names as in JSON
+// (they're converted via JSON, so the two can't drift apart), with map
+// keys sorted so the encoding, and hence the ETag, is stable. Timestamps
+// are RFC 3339 strings, as in JSON.
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) EncodeAlbum(buf *bytes.Buffer, album Album) error {
+	return encodeMsgpackJSON(buf, album)
+}
+
+func (msgpackEncoder) EncodeAlbums(buf *bytes.Buffer, albums []Album) error {
+	return encodeMsgpackJSON(buf, albums)
+}
+
+// encodeMsgpackJSON encodes v as MessagePack by way of its JSON encoding.
+func encodeMsgpackJSON(buf *bytes.Buffer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var value interface{}
+	err = decoder.Decode(&value)
+	if err != nil {
+		return err
+	}
+	return encodeMsgpack(buf, value)
+}
+
+// encodeMsgpack appends the MessagePack encoding of a value decoded from
+// JSON (with UseNumber) to buf, using the smallest encoding for each value.
+func encodeMsgpack(buf *bytes.Buffer, value interface{}) error {
+	switch value := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if value {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			encodeMsgpackInt(buf, n)
+			return nil
+		}
+		f, err := value.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		writeBigEndian(buf, math.Float64bits(f), 8)
+	case string:
+		encodeMsgpackHeader(buf, len(value), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(value)
+	case []interface{}:
+		encodeMsgpackHeader(buf, len(value), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range value {
+			err := encodeMsgpack(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		encodeMsgpackHeader(buf, len(value), 0x80, 16, 0, 0xde, 0xdf)
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encodeMsgpack(buf, key)
+			err := encodeMsgpack(buf, value[key])
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("can't encode %T as MessagePack", value)
+	}
+	return nil
+}
+
+func encodeMsgpackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= math.MaxInt8:
+		buf.WriteByte(byte(n)) // positive fixint
+	case n < 0 && n >= -32:
+		buf.WriteByte(byte(n)) // negative fixint
+	case n > 0 && n <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(n))
+	case n > 0 && n <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		writeBigEndian(buf, uint64(n), 2)
+	case n > 0 && n <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		writeBigEndian(buf, uint64(n), 4)
+	case n > 0:
+		buf.WriteByte(0xcf)
+		writeBigEndian(buf, uint64(n), 8)
+	case n >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		writeBigEndian(buf, uint64(n), 2)
+	case n >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		writeBigEndian(buf, uint64(n), 4)
+	default:
+		buf.WriteByte(0xd3)
+		writeBigEndian(buf, uint64(n), 8)
+	}
+}
+
+// encodeMsgpackHeader writes the header for a string, array, or map of
+// length n: a "fix" type (fix|n) if n < fixMax, otherwise the 8, 16, or
+// 32-bit length type (arrays and maps have no 8-bit type, so code8 is 0).
+func encodeMsgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, code8, code16, code32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(code8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		writeBigEndian(buf, uint64(n), 2)
+	default:
+		buf.WriteByte(code32)
+		writeBigEndian(buf, uint64(n), 4)
+	}
+}
+
+// writeBigEndian writes the low size bytes of n to buf, most significant
+// first.
+func writeBigEndian(buf *bytes.Buffer, n uint64, size int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	buf.Write(b[8-size:])
+}
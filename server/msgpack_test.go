@@ -0,0 +1,199 @@
+// Tests for MessagePack encoding
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeMsgpack(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string // hex
+	}{
+		{nil, "c0"},
+		{true, "c3"},
+		{false, "c2"},
+		{json.Number("0"), "00"},
+		{json.Number("127"), "7f"},
+		{json.Number("-1"), "ff"},
+		{json.Number("-32"), "e0"},
+		{json.Number("-33"), "d0df"},
+		{json.Number("128"), "cc80"},
+		{json.Number("256"), "cd0100"},
+		{json.Number("65536"), "ce00010000"},
+		{json.Number("4294967296"), "cf0000000100000000"},
+		{json.Number("-129"), "d1ff7f"},
+		{json.Number("-32769"), "d2ffff7fff"},
+		{json.Number("-2147483649"), "d3ffffffff7fffffff"},
+		{json.Number("1.5"), "cb3ff8000000000000"},
+		{"", "a0"},
+		{"abc", "a3616263"},
+		{strings.Repeat("x", 32), "d920" + strings.Repeat("78", 32)},
+		{strings.Repeat("x", 256), "da0100" + strings.Repeat("78", 256)},
+		{[]interface{}{}, "90"},
+		{[]interface{}{json.Number("1"), "a"}, "9201a161"},
+		{map[string]interface{}{"b": json.Number("2"), "a": json.Number("1")}, "82a16101a16202"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.value), func(t *testing.T) {
+			var buf bytes.Buffer
+			err := encodeMsgpack(&buf, test.value)
+			if err != nil {
+				t.Fatalf("error encoding: %v", err)
+			}
+			got := fmt.Sprintf("%x", buf.Bytes())
+			if got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	// Long arrays and maps use the 16-bit length types
+	var buf bytes.Buffer
+	encodeMsgpack(&buf, make([]interface{}, 16))
+	if got := fmt.Sprintf("%x", buf.Bytes()[:3]); got != "dc0010" {
+		t.Fatalf("got array header %s, want dc0010", got)
+	}
+}
+
+// decodeMsgpack is a minimal MessagePack decoder for the types that
+// encodeMsgpack produces, returning values like encoding/json does.
+func decodeMsgpack(r *bytes.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	readN := func(size int) uint64 {
+		var buf [8]byte
+		io.ReadFull(r, buf[8-size:])
+		return binary.BigEndian.Uint64(buf[:])
+	}
+	readString := func(n int) string {
+		s := make([]byte, n)
+		io.ReadFull(r, s)
+		return string(s)
+	}
+	readArray := func(n int) (interface{}, error) {
+		array := make([]interface{}, n)
+		for i := range array {
+			array[i], err = decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	readMap := func(n int) (interface{}, error) {
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			key, err := decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			m[key.(string)], err = decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	switch {
+	case b <= 0x7f:
+		return float64(b), nil
+	case b >= 0xe0:
+		return float64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		return readString(int(b & 0x1f)), nil
+	case b&0xf0 == 0x90:
+		return readArray(int(b & 0x0f))
+	case b&0xf0 == 0x80:
+		return readMap(int(b & 0x0f))
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc:
+		return float64(readN(1)), nil
+	case 0xcd:
+		return float64(readN(2)), nil
+	case 0xce:
+		return float64(readN(4)), nil
+	case 0xcf:
+		return float64(readN(8)), nil
+	case 0xd0:
+		return float64(int8(readN(1))), nil
+	case 0xd1:
+		return float64(int16(readN(2))), nil
+	case 0xd2:
+		return float64(int32(readN(4))), nil
+	case 0xd3:
+		return float64(int64(readN(8))), nil
+	case 0xcb:
+		return math.Float64frombits(readN(8)), nil
+	case 0xd9:
+		return readString(int(readN(1))), nil
+	case 0xda:
+		return readString(int(readN(2))), nil
+	case 0xdb:
+		return readString(int(readN(4))), nil
+	case 0xdc:
+		return readArray(int(readN(2)))
+	case 0xdd:
+		return readArray(int(readN(4)))
+	case 0xde:
+		return readMap(int(readN(2)))
+	case 0xdf:
+		return readMap(int(readN(4)))
+	}
+	return nil, fmt.Errorf("unexpected MessagePack type 0x%02x", b)
+}
+
+func TestGetAlbumsMsgpack(t *testing.T) {
+	server := newTestServer()
+	for _, path := range []string{"/albums", "/albums/a1"} {
+		t.Run(path, func(t *testing.T) {
+			// The MessagePack response has the same structure as the JSON
+			result := serve(t, server, newRequest(t, "GET", path, nil))
+			ensureStatus(t, result, http.StatusOK)
+			var want interface{}
+			unmarshalResponse(t, result, &want)
+
+			request := newRequest(t, "GET", path, nil)
+			request.Header.Set("Accept", msgpackContentType)
+			result = serve(t, server, request)
+			ensureStatus(t, result, http.StatusOK)
+			if got := result.Header.Get("Content-Type"); got != msgpackContentType {
+				t.Fatalf("bad Content-Type: got %q", got)
+			}
+			b, err := io.ReadAll(result.Body)
+			if err != nil {
+				t.Fatalf("error reading response: %v", err)
+			}
+			reader := bytes.NewReader(b)
+			got, err := decodeMsgpack(reader)
+			if err != nil {
+				t.Fatalf("error decoding MessagePack: %v", err)
+			}
+			if reader.Len() != 0 {
+				t.Fatalf("%d bytes left over after decoding", reader.Len())
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got vs want:\n%#v\n%#v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+// Streaming album listings as newline-delimited JSON
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// AlbumStreamer is an optional interface a Database can implement to list
+// albums one at a time, so that large listings don't need the whole result
+// set in memory. Databases that don't implement it are streamed from
+// GetAlbums.
+type AlbumStreamer interface {
+	// StreamAlbums calls fn for each album, in the same order as
+	// GetAlbums. If fn returns an error, it stops and returns that error.
+	StreamAlbums(fn func(album Album) error) error
+}
+
+// streamAlbums calls fn for each album in db, using StreamAlbums if db
+// implements AlbumStreamer.
+func streamAlbums(db Database, fn func(album Album) error) error {
+	if streamer, ok := db.(AlbumStreamer); ok {
+		return streamer.StreamAlbums(fn)
+	}
+	albums, err := db.GetAlbums()
+	if err != nil {
+		return err
+	}
+	for _, album := range albums {
+		err := fn(album)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StreamAlbums implements AlbumStreamer. It only holds the lock while
+// copying each album, so a slow client doesn't block writers; albums
+// deleted part way through are skipped.
+func (d *MemoryDatabase) StreamAlbums(fn func(album Album) error) error {
+	d.lock.RLock()
+	ids := make([]string, 0, len(d.albums))
+	for id := range d.albums {
+		ids = append(ids, id)
+	}
+	d.lock.RUnlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		d.lock.RLock()
+		album, ok := d.albums[id]
+		d.lock.RUnlock()
+		if !ok {
+			continue
+		}
+		err := fn(album)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wantsNDJSON reports whether the request's Accept header prefers
+// newline-delimited JSON to a regular JSON array.
+func wantsNDJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return acceptQuality(accept, ndjsonContentType) > acceptQuality(accept, "application/json")
+}
+
+// isStreaming reports whether the request is for a streamed response,
+// which mustn't be buffered (for example by timeoutHandler): albums as
+// NDJSON, or the /events stream.
+func isStreaming(r *http.Request) bool {
+	return (r.Method == "GET" || r.Method == "HEAD") && (r.URL.Path == "/albums" && wantsNDJSON(r) || r.URL.Path == "/events")
+}
+
+// errStopStream is returned by the streaming callback to stop early when
+// the client has gone away.
+var errStopStream = errors.New("stop stream")
+
+// streamAlbumsNDJSON writes the visible albums (in genres, by artists, and
+// matching filter, if they're given) one per line as they're read from the
+// database. Once the first album has been written the status code can't
+// change, so a database error part way through is logged and the
+// connection aborted, rather than ending the response cleanly, so clients
+// can't mistake a partial list for the whole one.
+func (s *Server) streamAlbumsNDJSON(w http.ResponseWriter, r *http.Request, includeDeleted bool, genres, artists []string, filter Filter) {
+	now := s.now()
+	match := func(Album) bool { return true }
+	if filter != nil {
+		match = compileFilter(filter)
+	}
+	started := false
+	err := streamAlbums(s.db, func(album Album) error {
+		if !album.published(now) || album.DeletedAt != nil && !includeDeleted {
+			return nil
+		}
+		if genres != nil && !inGenre(album, genres) || !matchArtist(album, artists) || !match(album) {
+			return nil
+		}
+		if r.Context().Err() != nil {
+			return errStopStream
+		}
+		if !started {
+			w.Header().Set("Content-Type", ndjsonContentType)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		// Encode writes a trailing newline after each value
+		return s.codec.Encode(w, s.redactAlbum(r, album), "", "")
+	})
+	switch {
+	case err == errStopStream:
+		return
+	case err != nil && !started:
+		s.writeError(w, r, apierr.Database(err))
+		return
+	case err != nil:
+		s.log.Printf("error streaming albums: %v", err)
+		panic(http.ErrAbortHandler) // net/http closes the connection without logging
+	}
+	if !started {
+		// No albums, so an empty body
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,193 @@
+// Tests for streaming album listings as NDJSON
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readNDJSON reads an NDJSON response body, failing if any line isn't a
+// valid album.
+func readNDJSON(t *testing.T, response *http.Response) []testAlbum {
+	t.Helper()
+	if got := response.Header.Get("Content-Type"); got != ndjsonContentType {
+		t.Fatalf("bad Content-Type: got %q, want %q", got, ndjsonContentType)
+	}
+	var albums []testAlbum
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		var album testAlbum
+		err := json.Unmarshal(scanner.Bytes(), &album)
+		if err != nil {
+			t.Fatalf("error unmarshaling line %q: %v", scanner.Text(), err)
+		}
+		albums = append(albums, album)
+	}
+	if scanner.Err() != nil {
+		t.Fatalf("error reading response: %v", scanner.Err())
+	}
+	return albums
+}
+
+func newNDJSONRequest(t *testing.T, url string) *http.Request {
+	request := newRequest(t, "GET", url, nil)
+	request.Header.Set("Accept", ndjsonContentType)
+	return request
+}
+
+func TestGetAlbumsNDJSON(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddGenre(Genre{ID: "rock", Name: "Rock"})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000, Genres: []string{"rock"}})
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	future := time.Now().Add(time.Hour)
+	db.AddAlbum(Album{ID: "a3", Title: "Unreleased", Artist: "Nobody", PublishAt: &future})
+	server := NewServer(db, log.New(io.Discard, "", 0), WithAdminToken(testAdminToken))
+
+	result := serve(t, server, newNDJSONRequest(t, "/albums"))
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Vary"); got != "Accept" {
+		t.Fatalf("bad Vary header: got %q, want %q", got, "Accept")
+	}
+	albums := readNDJSON(t, result)
+	want := []testAlbum{
+		{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795},
+		{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000, Genres: []string{"rock"}},
+	}
+	ensureAlbums(t, albums, want)
+
+	// Filtering applies as for the JSON listing
+	result = serve(t, server, newNDJSONRequest(t, "/albums?genre=rock"))
+	ensureStatus(t, result, http.StatusOK)
+	ensureAlbums(t, readNDJSON(t, result), want[1:])
+
+	result = serve(t, server, newNDJSONRequest(t, "/albums?genre=jazz"))
+	ensureStatus(t, result, http.StatusOK)
+	ensureAlbums(t, readNDJSON(t, result), nil)
+
+	result = serve(t, server, newNDJSONRequest(t, "/albums?include_deleted=true"))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+
+	// Clients that prefer JSON still get an array
+	request := newRequest(t, "GET", "/albums", nil)
+	request.Header.Set("Accept", "application/json, application/x-ndjson;q=0.5")
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	var got []testAlbum
+	unmarshalResponse(t, result, &got)
+	ensureAlbums(t, got, want)
+}
+
+func ensureAlbums(t *testing.T, got, want []testAlbum) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d albums, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range got {
+		if got[i].ID != want[i].ID || got[i].Title != want[i].Title || got[i].Price != want[i].Price {
+			t.Fatalf("album %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// failingStreamer is a database whose StreamAlbums fails after the given
+// number of albums.
+type failingStreamer struct {
+	*MemoryDatabase
+	after int
+}
+
+func (d failingStreamer) StreamAlbums(fn func(album Album) error) error {
+	n := 0
+	return d.MemoryDatabase.StreamAlbums(func(album Album) error {
+		if n == d.after {
+			return errors.New("connection lost")
+		}
+		n++
+		return fn(album)
+	})
+}
+
+func TestGetAlbumsNDJSONError(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles"})
+
+	// Before anything is written, it's a regular error response
+	server := NewServer(failingStreamer{db, 0}, log.New(io.Discard, "", 0))
+	result := serve(t, server, newNDJSONRequest(t, "/albums"))
+	ensureError(t, result, http.StatusInternalServerError, "database", nil)
+
+	// After that, the connection is aborted, so the client can't mistake
+	// what it got for the whole list (enough albums that some are sent)
+	for i := 3; i <= 100; i++ {
+		db.AddAlbum(Album{ID: fmt.Sprintf("a%d", i), Title: strings.Repeat("x", 100), Artist: "Various"})
+	}
+	server = NewServer(failingStreamer{db, 99}, log.New(io.Discard, "", 0))
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	response, err := http.DefaultClient.Do(newNDJSONRequest(t, httpServer.URL+"/albums"))
+	if err != nil {
+		t.Fatalf("error making request: %v", err)
+	}
+	defer response.Body.Close()
+	ensureStatus(t, response, http.StatusOK)
+	b, err := io.ReadAll(response.Body)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got error %v after %d bytes, want unexpected EOF", err, len(b))
+	}
+}
+
+func TestGetAlbumsNDJSONNotBuffered(t *testing.T) {
+	// Streamed responses aren't subject to the handler timeout, because
+	// they can't be buffered
+	db := newSlowDatabase()
+	server := NewServer(db, log.New(io.Discard, "", 0), WithHandlerTimeout(10*time.Millisecond))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(db.release)
+	}()
+	result := serve(t, server, newNDJSONRequest(t, "/albums"))
+	ensureStatus(t, result, http.StatusOK)
+	b, err := io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	if strings.TrimSpace(string(b)) != "" {
+		t.Fatalf("got body %q, want empty", b)
+	}
+}
+
+func TestWantsNDJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", false},
+		{"application/x-ndjson", true},
+		{"application/*", false},
+		{"application/x-ndjson, application/json;q=0.9", true},
+		{"application/x-ndjson;q=0.5, application/json", false},
+	}
+	for _, test := range tests {
+		t.Run(test.accept, func(t *testing.T) {
+			request := newRequest(t, "GET", "/albums", nil)
+			request.Header.Set("Accept", test.accept)
+			if got := wantsNDJSON(request); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
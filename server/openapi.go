@@ -0,0 +1,1206 @@
+// OpenAPI specification for the API
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// openAPIDoc is the subset of an OpenAPI 3 document that we generate.
+// Schemas are inlined rather than using "$ref", which keeps the spec (and
+// diffing it) simple.
+type openAPIDoc struct {
+	OpenAPI string                                  `json:"openapi"`
+	Info    openAPIInfo                             `json:"info"`
+	Paths   map[string]map[string]*openAPIOperation `json:"paths"` // path -> lowercase method -> operation
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"` // status code -> response
+	Deprecated  bool                        `json:"deprecated,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"` // "path" or "query"
+	Required bool           `json:"required,omitempty"`
+	Schema   *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required,omitempty"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Type       string                    `json:"type,omitempty"`
+	Format     string                    `json:"format,omitempty"`
+	Properties map[string]*openAPISchema `json:"properties,omitempty"`
+	Required   []string                  `json:"required,omitempty"`
+	Items      *openAPISchema            `json:"items,omitempty"`
+}
+
+// openAPISpec generates the OpenAPI spec for the current API. The Album
+// schema is derived from the Album struct, so adding or changing fields
+// is reflected in the spec automatically.
+func openAPISpec() *openAPIDoc {
+	doc := buildOpenAPISpec(true)
+
+	// The album routes are documented under /v1 too. The /v1 operations
+	// are generated separately, so they don't share anything with the
+	// deprecated ones.
+	for path, operations := range buildOpenAPISpec(false).Paths {
+		if isLegacyRoute(path) {
+			doc.Paths[apiVersionPrefix+path] = operations
+		}
+	}
+	return doc
+}
+
+// buildOpenAPISpec generates the OpenAPI spec for the unversioned paths.
+// If deprecateLegacy is true, the album routes are marked deprecated (see
+// versionHandler).
+func buildOpenAPISpec(deprecateLegacy bool) *openAPIDoc {
+	album := schemaFor(reflect.TypeOf(Album{}))
+	albums := &openAPISchema{Type: "array", Items: album}
+
+	// New albums don't need an ID (the server generates one if not given)
+	// or a version (only needed when replacing an album), and can't be
+	// created already deleted. The timestamps are set by the database.
+	readOnly := map[string]bool{"deleted_at": true, "created_at": true, "updated_at": true}
+	newAlbum := *album
+	newAlbum.Properties = make(map[string]*openAPISchema, len(album.Properties))
+	for name, prop := range album.Properties {
+		if !readOnly[name] {
+			newAlbum.Properties[name] = prop
+		}
+	}
+	newAlbum.Required = nil
+	for _, name := range album.Required {
+		if name != "id" && name != "version" && !readOnly[name] {
+			newAlbum.Required = append(newAlbum.Required, name)
+		}
+	}
+	// Created albums may also include a self link
+	created := *album
+	created.Properties = make(map[string]*openAPISchema, len(album.Properties)+1)
+	for name, prop := range album.Properties {
+		created.Properties[name] = prop
+	}
+	created.Properties["links"] = schemaFor(reflect.TypeOf(resourceLinks{}))
+
+	errorSchema := &openAPISchema{
+		Type: "object",
+		Properties: map[string]*openAPISchema{
+			"status": {Type: "integer"},
+			"error":  {Type: "string"},
+			"data":   {Type: "object"},
+			"retry":  schemaFor(reflect.TypeOf(apierr.Retry{})),
+		},
+		Required: []string{"error", "status"},
+	}
+	object := &openAPISchema{Type: "object"}
+	binary := &openAPISchema{Type: "string", Format: "binary"}
+	track := schemaFor(reflect.TypeOf(Track{}))
+	genre := schemaFor(reflect.TypeOf(Genre{}))
+	order := schemaFor(reflect.TypeOf(Order{}))
+	user := schemaFor(reflect.TypeOf(User{}))
+	idParam := openAPIParameter{Name: "id", In: "path", Required: true, Schema: &openAPISchema{Type: "string"}}
+	includeDeletedParam := openAPIParameter{Name: "include_deleted", In: "query", Schema: &openAPISchema{Type: "boolean"}}
+	formatParam := openAPIParameter{Name: "format", In: "query", Schema: &openAPISchema{Type: "string"}} // "json" or "xml"
+	repeatableParam := &openAPISchema{Type: "array", Items: &openAPISchema{Type: "string"}}              // filters that match any value
+	readyzSchema := schemaFor(reflect.TypeOf(readyzResponse{}))
+	jsonAPIDoc := schemaFor(reflect.TypeOf(jsonAPIDocument{}))
+	jsonAPIErrorsSchema := &openAPISchema{
+		Type:       "object",
+		Properties: map[string]*openAPISchema{"errors": {Type: "array", Items: schemaFor(reflect.TypeOf(jsonAPIError{}))}},
+		Required:   []string{"errors"},
+	}
+	fieldsParam := openAPIParameter{Name: "fields[albums]", In: "query", Schema: &openAPISchema{Type: "string"}} // JSON:API sparse fieldset
+
+	ok := func(schema *openAPISchema) *openAPIResponse {
+		return jsonResponse(http.StatusOK, schema)
+	}
+	problemSchema := schemaFor(reflect.TypeOf(problem{}))
+	errorResponse := func(status int) *openAPIResponse {
+		response := jsonResponse(status, errorSchema)
+		response.Content[problemContentType] = openAPIMediaType{Schema: problemSchema}
+		response.Content[jsonAPIContentType] = openAPIMediaType{Schema: jsonAPIErrorsSchema}
+		return response
+	}
+	notModified := &openAPIResponse{Description: http.StatusText(http.StatusNotModified)}
+	coverContent := make(map[string]openAPIMediaType)
+	for _, typ := range coverTypes {
+		coverContent[typ] = openAPIMediaType{Schema: binary}
+	}
+	attachmentContent := make(map[string]openAPIMediaType)
+	for _, typ := range attachmentTypes {
+		attachmentContent[typ] = openAPIMediaType{Schema: binary}
+	}
+	attachmentIDParam := openAPIParameter{Name: "attachment_id", In: "path", Required: true, Schema: &openAPISchema{Type: "string"}}
+
+	doc := &openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "Albums API", Version: "1.0"},
+		Paths: map[string]map[string]*openAPIOperation{
+			"/albums": {
+				"get": {
+					Summary: "List all published albums, sorted by ID",
+					Parameters: []openAPIParameter{
+						{Name: "genre", In: "query", Schema: repeatableParam},
+						{Name: "artist", In: "query", Schema: repeatableParam},
+						{Name: "q", In: "query", Schema: &openAPISchema{Type: "string"}}, // filter expression, like artist ~ "beatles"
+						includeDeletedParam,
+						formatParam,
+						fieldsParam,
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": {
+							Description: http.StatusText(http.StatusOK),
+							Content: map[string]openAPIMediaType{
+								"application/json":  {Schema: albums},
+								"application/xml":   {Schema: albums},
+								ndjsonContentType:   {Schema: album},
+								msgpackContentType:  {Schema: albums},
+								jsonAPIContentType:  {Schema: jsonAPIDoc},
+								protobufContentType: {Schema: binary},
+							},
+						},
+						"304": notModified,
+						"400": errorResponse(http.StatusBadRequest),
+						"403": errorResponse(http.StatusForbidden),
+					},
+				},
+				"post": {
+					Summary: "Add a new album",
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: &newAlbum}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"201": jsonResponse(http.StatusCreated, &created),
+						"400": errorResponse(http.StatusBadRequest),
+						"409": errorResponse(http.StatusConflict),
+						"422": errorResponse(http.StatusUnprocessableEntity),
+						"507": errorResponse(http.StatusInsufficientStorage),
+					},
+				},
+			},
+			"/albums/{id}": {
+				"get": {
+					Summary: "Fetch a single album by ID, or the version that was current at a given time or revision",
+					Parameters: []openAPIParameter{
+						idParam,
+						includeDeletedParam,
+						{Name: "at", In: "query", Schema: &openAPISchema{Type: "string", Format: "date-time"}},
+						{Name: "as_of", In: "query", Schema: &openAPISchema{Type: "string"}}, // timestamp or revision
+						formatParam,
+						fieldsParam,
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": {
+							Description: http.StatusText(http.StatusOK),
+							Content: map[string]openAPIMediaType{
+								"application/json":  {Schema: album},
+								"application/xml":   {Schema: album},
+								"text/html":         {Schema: &openAPISchema{Type: "string"}},
+								msgpackContentType:  {Schema: album},
+								jsonAPIContentType:  {Schema: jsonAPIDoc},
+								protobufContentType: {Schema: binary},
+							},
+						},
+						"400": errorResponse(http.StatusBadRequest),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+				"put": {
+					Summary:    "Add an album with the given ID, or replace it if it exists",
+					Parameters: []openAPIParameter{idParam},
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: &newAlbum}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(album),
+						"201": jsonResponse(http.StatusCreated, &created),
+						"400": errorResponse(http.StatusBadRequest),
+						"409": errorResponse(http.StatusConflict),
+						"428": errorResponse(http.StatusPreconditionRequired),
+						"507": errorResponse(http.StatusInsufficientStorage),
+					},
+				},
+				"delete": {
+					Summary: "Soft delete an album, if nothing refers to it",
+					Parameters: []openAPIParameter{
+						idParam,
+						{Name: "force", In: "query", Schema: &openAPISchema{Type: "boolean"}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"204": {Description: http.StatusText(http.StatusNoContent)},
+						"400": errorResponse(http.StatusBadRequest),
+						"404": errorResponse(http.StatusNotFound),
+						"409": errorResponse(http.StatusConflict),
+					},
+				},
+			},
+			"/albums/{id}/favorite": {
+				"put": {
+					Summary:    "Add the album to the logged-in user's favorites",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"204": {Description: http.StatusText(http.StatusNoContent)},
+						"401": errorResponse(http.StatusUnauthorized),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+				"delete": {
+					Summary:    "Remove the album from the logged-in user's favorites",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"204": {Description: http.StatusText(http.StatusNoContent)},
+						"401": errorResponse(http.StatusUnauthorized),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/albums/{id}/tracks": {
+				"get": {
+					Summary:    "List an album's tracks, sorted by track number",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(&openAPISchema{Type: "array", Items: track}),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+				"post": {
+					Summary:    "Add a track to an album",
+					Parameters: []openAPIParameter{idParam},
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: track}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"201": jsonResponse(http.StatusCreated, track),
+						"400": errorResponse(http.StatusBadRequest),
+						"404": errorResponse(http.StatusNotFound),
+						"409": errorResponse(http.StatusConflict),
+					},
+				},
+			},
+			"/albums/{id}/cover": {
+				"get": {
+					Summary: "Fetch an album's cover art, or a thumbnail of it",
+					Parameters: []openAPIParameter{
+						idParam,
+						{Name: "size", In: "query", Schema: &openAPISchema{Type: "string"}}, // thumbnail size, like "small"
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": {
+							Description: http.StatusText(http.StatusOK),
+							Content:     map[string]openAPIMediaType{"image/png": {Schema: binary}, "image/jpeg": {Schema: binary}},
+						},
+						"304": notModified,
+						"400": errorResponse(http.StatusBadRequest),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+				"put": {
+					Summary:     "Upload an album's cover art (PNG, JPEG, or GIF), which is re-encoded",
+					Parameters:  []openAPIParameter{idParam},
+					RequestBody: &openAPIRequestBody{Required: true, Content: coverContent},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(coverInfo{}))),
+						"400": errorResponse(http.StatusBadRequest),
+						"404": errorResponse(http.StatusNotFound),
+						"413": errorResponse(http.StatusRequestEntityTooLarge),
+						"415": errorResponse(http.StatusUnsupportedMediaType),
+					},
+				},
+				"delete": {
+					Summary:    "Delete an album's cover art",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"204": {Description: http.StatusText(http.StatusNoContent)},
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/albums/{id}/cover/upload-url": {
+				"post": {
+					Summary:    "Get a one-time URL to upload a large cover to, before confirming it",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"201": ok(schemaFor(reflect.TypeOf(uploadTarget{}))),
+						"404": errorResponse(http.StatusNotFound),
+						"503": errorResponse(http.StatusServiceUnavailable),
+					},
+				},
+			},
+			"/albums/{id}/cover/download-url": {
+				"get": {
+					Summary:    "Get a pre-signed URL to download an album's cover art from directly, if blobs are in an object store",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(downloadTarget{}))),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/albums/{id}/cover/confirm": {
+				"post": {
+					Summary:    "Make an uploaded file the album's cover art, which is checked and re-encoded as for PUT",
+					Parameters: []openAPIParameter{idParam},
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content: map[string]openAPIMediaType{"application/json": {Schema: &openAPISchema{
+							Type:       "object",
+							Properties: map[string]*openAPISchema{"token": {Type: "string"}},
+							Required:   []string{"token"},
+						}}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(coverInfo{}))),
+						"400": errorResponse(http.StatusBadRequest),
+						"404": errorResponse(http.StatusNotFound),
+						"413": errorResponse(http.StatusRequestEntityTooLarge),
+						"415": errorResponse(http.StatusUnsupportedMediaType),
+					},
+				},
+			},
+			"/albums/{id}/attachments": {
+				"get": {
+					Summary:    "List the files attached to an album, oldest first",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(&openAPISchema{Type: "array", Items: schemaFor(reflect.TypeOf(Attachment{}))}),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+				"post": {
+					Summary: "Attach a PDF or text file to an album",
+					Parameters: []openAPIParameter{
+						idParam,
+						{Name: "filename", In: "query", Required: true, Schema: &openAPISchema{Type: "string"}},
+					},
+					RequestBody: &openAPIRequestBody{Required: true, Content: attachmentContent},
+					Responses: map[string]*openAPIResponse{
+						"201": jsonResponse(http.StatusCreated, schemaFor(reflect.TypeOf(Attachment{}))),
+						"400": errorResponse(http.StatusBadRequest),
+						"404": errorResponse(http.StatusNotFound),
+						"413": errorResponse(http.StatusRequestEntityTooLarge),
+						"415": errorResponse(http.StatusUnsupportedMediaType),
+					},
+				},
+			},
+			"/albums/{id}/attachments/{attachment_id}": {
+				"get": {
+					Summary:    "Download an album's attachment",
+					Parameters: []openAPIParameter{idParam, attachmentIDParam},
+					Responses: map[string]*openAPIResponse{
+						"200": {Description: http.StatusText(http.StatusOK), Content: attachmentContent},
+						"304": notModified,
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+				"delete": {
+					Summary:    "Delete an album's attachment",
+					Parameters: []openAPIParameter{idParam, attachmentIDParam},
+					Responses: map[string]*openAPIResponse{
+						"204": {Description: http.StatusText(http.StatusNoContent)},
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/uploads/{token}": {
+				"put": {
+					Summary: "Upload a file to a one-time upload URL",
+					Parameters: []openAPIParameter{
+						{Name: "token", In: "path", Required: true, Schema: &openAPISchema{Type: "string"}},
+					},
+					RequestBody: &openAPIRequestBody{Required: true, Content: coverContent},
+					Responses: map[string]*openAPIResponse{
+						"204": {Description: http.StatusText(http.StatusNoContent)},
+						"404": errorResponse(http.StatusNotFound),
+						"413": errorResponse(http.StatusRequestEntityTooLarge),
+					},
+				},
+			},
+			"/albums/import": {
+				"post": {
+					Summary: "Add albums from newline-delimited JSON, one per line (admin only)",
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/x-ndjson": {Schema: &newAlbum}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(importResult{}))),
+						"403": errorResponse(http.StatusForbidden),
+					},
+				},
+			},
+			"/albums/lookup": {
+				"post": {
+					Summary: "Fetch several albums by ID, and list the IDs not found",
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: schemaFor(reflect.TypeOf(lookupRequest{}))}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(lookupResponse{}))),
+						"400": errorResponse(http.StatusBadRequest),
+					},
+				},
+			},
+			"/lookup": {
+				"get": {
+					Summary: "Find albums by an external identifier, like an ISRC or UPC",
+					Parameters: []openAPIParameter{
+						{Name: "isrc", In: "query", Schema: &openAPISchema{Type: "string"}},
+						{Name: "upc", In: "query", Schema: &openAPISchema{Type: "string"}},
+						{Name: "musicbrainz_id", In: "query", Schema: &openAPISchema{Type: "string"}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(&openAPISchema{Type: "array", Items: schemaFor(reflect.TypeOf(identifierMatch{}))}),
+						"400": errorResponse(http.StatusBadRequest),
+					},
+				},
+			},
+			"/albums/search": {
+				"get": {
+					Summary: "Search albums by title and artist",
+					Parameters: []openAPIParameter{
+						{Name: "q", In: "query", Required: true, Schema: &openAPISchema{Type: "string"}},
+						includeDeletedParam,
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(albums),
+						"304": notModified,
+						"400": errorResponse(http.StatusBadRequest),
+						"403": errorResponse(http.StatusForbidden),
+					},
+				},
+			},
+			"/albums/{id}/barcode.png": {
+				"get": {
+					Summary: "Render an album's catalog number as a Code 128 barcode",
+					Parameters: []openAPIParameter{
+						idParam,
+						{Name: "scale", In: "query", Schema: &openAPISchema{Type: "integer"}},
+						{Name: "height", In: "query", Schema: &openAPISchema{Type: "integer"}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": {
+							Description: http.StatusText(http.StatusOK),
+							Content:     map[string]openAPIMediaType{"image/png": {Schema: &openAPISchema{Type: "string", Format: "binary"}}},
+						},
+						"304": notModified,
+						"400": errorResponse(http.StatusBadRequest),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/albums/{id}/qr.png": {
+				"get": {
+					Summary: "Render a QR code linking to an album's public page",
+					Parameters: []openAPIParameter{
+						idParam,
+						{Name: "scale", In: "query", Schema: &openAPISchema{Type: "integer"}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": {
+							Description: http.StatusText(http.StatusOK),
+							Content:     map[string]openAPIMediaType{"image/png": {Schema: &openAPISchema{Type: "string", Format: "binary"}}},
+						},
+						"304": notModified,
+						"400": errorResponse(http.StatusBadRequest),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/albums/{id}/versions": {
+				"get": {
+					Summary:    "List the kept versions of an album, oldest first",
+					Parameters: []openAPIParameter{idParam, includeDeletedParam},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(albums),
+						"304": notModified,
+						"400": errorResponse(http.StatusBadRequest),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/albums/{id}/diff": {
+				"get": {
+					Summary: "List the fields that changed between two revisions of an album",
+					Parameters: []openAPIParameter{
+						idParam,
+						{Name: "from", In: "query", Required: true, Schema: &openAPISchema{Type: "integer"}},
+						{Name: "to", In: "query", Schema: &openAPISchema{Type: "integer"}},
+						includeDeletedParam,
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": {
+							Description: http.StatusText(http.StatusOK),
+							Content: map[string]openAPIMediaType{
+								"application/json": {Schema: schemaFor(reflect.TypeOf(albumDiff{}))},
+								"text/html":        {Schema: &openAPISchema{Type: "string"}},
+							},
+						},
+						"304": notModified,
+						"400": errorResponse(http.StatusBadRequest),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/albums/{id}/restore": {
+				"post": {
+					Summary:    "Restore a deleted album (admin only)",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(album),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/albums/{id}/purchase": {
+				"post": {
+					Summary:    "Buy a copy of an album, decrementing its stock",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(album),
+						"404": errorResponse(http.StatusNotFound),
+						"409": errorResponse(http.StatusConflict),
+					},
+				},
+			},
+			"/genres": {
+				"get": {
+					Summary:   "List all genres, sorted by ID",
+					Responses: map[string]*openAPIResponse{"200": ok(&openAPISchema{Type: "array", Items: genre})},
+				},
+				"post": {
+					Summary: "Add a new genre",
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: genre}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"201": jsonResponse(http.StatusCreated, genre),
+						"400": errorResponse(http.StatusBadRequest),
+						"409": errorResponse(http.StatusConflict),
+					},
+				},
+			},
+			"/graphql": {
+				"get": {
+					Summary: "Run a GraphQL query (see /graphql/schema)",
+					Parameters: []openAPIParameter{
+						{Name: "query", In: "query", Required: true, Schema: &openAPISchema{Type: "string"}},
+						{Name: "operationName", In: "query", Schema: &openAPISchema{Type: "string"}},
+						{Name: "variables", In: "query", Schema: &openAPISchema{Type: "string"}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(object),
+						"400": jsonResponse(http.StatusBadRequest, object),
+						"405": jsonResponse(http.StatusMethodNotAllowed, object),
+					},
+				},
+				"post": {
+					Summary: "Run a GraphQL query or mutation (see /graphql/schema)",
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: schemaFor(reflect.TypeOf(graphQLRequest{}))}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(object),
+						"400": jsonResponse(http.StatusBadRequest, object),
+					},
+				},
+			},
+			"/graphql/schema": {
+				"get": {
+					Summary: "Describe the GraphQL schema in SDL",
+					Responses: map[string]*openAPIResponse{
+						"200": {
+							Description: http.StatusText(http.StatusOK),
+							Content:     map[string]openAPIMediaType{"text/plain": {Schema: &openAPISchema{Type: "string"}}},
+						},
+					},
+				},
+			},
+			"/ws": {
+				"get": {
+					Summary: "Subscribe to album changes over a WebSocket, which are sent as JSON text messages",
+					Parameters: []openAPIParameter{
+						{Name: "artist", In: "query", Schema: repeatableParam},
+					},
+					Responses: map[string]*openAPIResponse{
+						"101": {Description: http.StatusText(http.StatusSwitchingProtocols)},
+						"400": errorResponse(http.StatusBadRequest),
+						"503": errorResponse(http.StatusServiceUnavailable),
+					},
+				},
+			},
+			"/docs/examples": {
+				"get": {
+					Summary:   "List example requests and responses",
+					Responses: map[string]*openAPIResponse{"200": ok(&openAPISchema{Type: "array", Items: object})},
+				},
+			},
+			"/problems/{code}": {
+				"get": {
+					Summary: "Document the problem type for an error code",
+					Parameters: []openAPIParameter{
+						{Name: "code", In: "path", Required: true, Schema: &openAPISchema{Type: "string"}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": {
+							Description: http.StatusText(http.StatusOK),
+							Content:     map[string]openAPIMediaType{"text/html": {Schema: &openAPISchema{Type: "string"}}},
+						},
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/readyz": {
+				"get": {
+					Summary: "Report whether the server can serve reads and writes",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(readyzSchema),
+						"503": jsonResponse(http.StatusServiceUnavailable, readyzSchema),
+					},
+				},
+			},
+			"/version": {
+				"get": {
+					Summary: "Report the server's version, git commit, build date, and Go version",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(buildInfo{}))),
+					},
+				},
+			},
+			"/stats": {
+				"get": {
+					Summary: "Report database size and concurrency limiter statistics",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(statsResponse{}))),
+					},
+				},
+			},
+			"/mode": {
+				"get": {
+					Summary: "Report whether the server is in normal, read-only, or maintenance mode (admin only)",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(modeState{}))),
+						"403": errorResponse(http.StatusForbidden),
+					},
+				},
+				"put": {
+					Summary: "Switch the server to normal, read-only (writes get 503), or maintenance (everything gets 503) mode (admin only)",
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: schemaFor(reflect.TypeOf(modeInput{}))}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(modeState{}))),
+						"400": errorResponse(http.StatusBadRequest),
+						"403": errorResponse(http.StatusForbidden),
+					},
+				},
+			},
+			"/admin/reset": {
+				"post": {
+					Summary: "Delete all albums and genres, optionally loading a seed fixture; without a confirm token, returns 428 with one to repeat the request with (admin only)",
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: schemaFor(reflect.TypeOf(resetInput{}))}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(resetResponse{}))),
+						"400": errorResponse(http.StatusBadRequest),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+						"428": errorResponse(http.StatusPreconditionRequired),
+					},
+				},
+			},
+			"/diagnostics": {
+				"post": {
+					Summary: "Write a diagnostics bundle of goroutine stacks, recent requests, config, metrics, and database stats to a file on the server (admin only)",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(diagnosticsResponse{}))),
+						"403": errorResponse(http.StatusForbidden),
+					},
+				},
+			},
+			"/sitemap.xml": {
+				"get": {
+					Summary:    "Fetch a sitemap of public album pages, or a sitemap index if there are too many for one",
+					Parameters: []openAPIParameter{{Name: "page", In: "query", Schema: &openAPISchema{Type: "integer"}}},
+					Responses: map[string]*openAPIResponse{
+						"200": {
+							Description: http.StatusText(http.StatusOK),
+							Content:     map[string]openAPIMediaType{"application/xml": {Schema: &openAPISchema{Type: "string"}}},
+						},
+						"304": notModified,
+						"400": errorResponse(http.StatusBadRequest),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/feed.atom": {
+				"get": {
+					Summary:    "Fetch an Atom feed of public albums, most recently added or updated first",
+					Parameters: []openAPIParameter{{Name: "page", In: "query", Schema: &openAPISchema{Type: "integer"}}},
+					Responses: map[string]*openAPIResponse{
+						"200": {
+							Description: http.StatusText(http.StatusOK),
+							Content:     map[string]openAPIMediaType{"application/atom+xml": {Schema: &openAPISchema{Type: "string"}}},
+						},
+						"304": notModified,
+						"400": errorResponse(http.StatusBadRequest),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/audit": {
+				"get": {
+					Summary: "List audit log entries for changes, oldest first (admin only)",
+					Parameters: []openAPIParameter{
+						{Name: "album_id", In: "query", Schema: &openAPISchema{Type: "string"}},
+						{Name: "since", In: "query", Schema: &openAPISchema{Type: "string", Format: "date-time"}},
+						{Name: "until", In: "query", Schema: &openAPISchema{Type: "string", Format: "date-time"}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(&openAPISchema{Type: "array", Items: schemaFor(reflect.TypeOf(AuditEntry{}))}),
+						"400": errorResponse(http.StatusBadRequest),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/users": {
+				"post": {
+					Summary: "Sign up for a user account",
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: schemaFor(reflect.TypeOf(userInput{}))}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"201": jsonResponse(http.StatusCreated, user),
+						"400": errorResponse(http.StatusBadRequest),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/users/login": {
+				"post": {
+					Summary: "Log in with an email address and password, returning a session token to send as a bearer token",
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: schemaFor(reflect.TypeOf(userInput{}))}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(loginResponse{}))),
+						"401": errorResponse(http.StatusUnauthorized),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/users/logout": {
+				"post": {
+					Summary: "End the session of the request's session token",
+					Responses: map[string]*openAPIResponse{
+						"204": {Description: http.StatusText(http.StatusNoContent)},
+						"401": errorResponse(http.StatusUnauthorized),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/users/me": {
+				"get": {
+					Summary: "Fetch the logged-in user",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(user),
+						"401": errorResponse(http.StatusUnauthorized),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/me/favorites": {
+				"get": {
+					Summary: "List the logged-in user's favorite albums, most recent first",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(albums),
+						"401": errorResponse(http.StatusUnauthorized),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/orders": {
+				"get": {
+					Summary: "List a customer's orders, oldest first (admin or the customer's user only)",
+					Parameters: []openAPIParameter{
+						{Name: "customer_id", In: "query", Required: true, Schema: &openAPISchema{Type: "string"}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(&openAPISchema{Type: "array", Items: order}),
+						"400": errorResponse(http.StatusBadRequest),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+				"post": {
+					Summary: "Place an order for one or more albums, at their current prices (admin or the customer's user only)",
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: schemaFor(reflect.TypeOf(orderInput{}))}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"201": jsonResponse(http.StatusCreated, order),
+						"400": errorResponse(http.StatusBadRequest),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/orders/{id}": {
+				"get": {
+					Summary:    "Fetch an order (admin or the customer's user only)",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(order),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/orders/{id}/status": {
+				"post": {
+					Summary:    "Move an order on to its next status: pending to paid, paid to shipped, or paid or shipped to refunded (admin only)",
+					Parameters: []openAPIParameter{idParam},
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content: map[string]openAPIMediaType{"application/json": {Schema: &openAPISchema{
+							Type:       "object",
+							Properties: map[string]*openAPISchema{"status": {Type: "string"}},
+							Required:   []string{"status"},
+						}}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(order),
+						"400": errorResponse(http.StatusBadRequest),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+						"409": errorResponse(http.StatusConflict),
+					},
+				},
+			},
+			"/orders/{id}/pay": {
+				"post": {
+					Summary:    "Pay for a pending order through the payment provider (admin or the customer's user only; 202 if the provider confirms the payment later)",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(order),
+						"202": jsonResponse(http.StatusAccepted, order),
+						"400": errorResponse(http.StatusBadRequest),
+						"402": errorResponse(http.StatusPaymentRequired),
+						"404": errorResponse(http.StatusNotFound),
+						"409": errorResponse(http.StatusConflict),
+						"503": errorResponse(http.StatusServiceUnavailable),
+					},
+				},
+			},
+			"/payments/stripe": {
+				"post": {
+					Summary: "Receive a Stripe webhook event, marking the order paid on payment_intent.succeeded",
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: &openAPISchema{Type: "object"}}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"204": {Description: http.StatusText(http.StatusNoContent)},
+						"400": errorResponse(http.StatusBadRequest),
+						"404": errorResponse(http.StatusNotFound),
+						"409": errorResponse(http.StatusConflict),
+					},
+				},
+			},
+			"/export": {
+				"get": {
+					Summary: "Export the whole catalog, including deleted albums, in the snapshot file format (admin only)",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(DatabaseSnapshot{}))),
+						"403": errorResponse(http.StatusForbidden),
+					},
+				},
+			},
+			"/events": {
+				"get": {
+					Summary: "Stream every change as server-sent events, optionally only the given comma-separated types or resources (admin only)",
+					Parameters: []openAPIParameter{
+						{Name: "type", In: "query", Schema: repeatableParam},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": {
+							Description: http.StatusText(http.StatusOK),
+							Content:     map[string]openAPIMediaType{"text/event-stream": {Schema: &openAPISchema{Type: "string"}}},
+						},
+						"403": errorResponse(http.StatusForbidden),
+					},
+				},
+			},
+			"/blobs/scrub": {
+				"post": {
+					Summary: "Check stored blobs, like cover art, for corruption (admin only)",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(BlobScrubReport{}))),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/webhooks": {
+				"get": {
+					Summary: "List webhooks (admin only)",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(&openAPISchema{Type: "array", Items: schemaFor(reflect.TypeOf(Webhook{}))}),
+						"403": errorResponse(http.StatusForbidden),
+					},
+				},
+				"post": {
+					Summary: "Register a webhook that's sent every change, returning its signing secret (admin only)",
+					RequestBody: &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]openAPIMediaType{"application/json": {Schema: schemaFor(reflect.TypeOf(Webhook{}))}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"201": ok(schemaFor(reflect.TypeOf(Webhook{}))),
+						"400": errorResponse(http.StatusBadRequest),
+						"403": errorResponse(http.StatusForbidden),
+					},
+				},
+			},
+			"/webhooks/{id}": {
+				"get": {
+					Summary:    "Fetch a webhook (admin only)",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(Webhook{}))),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+				"delete": {
+					Summary:    "Delete a webhook (admin only)",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"204": {Description: http.StatusText(http.StatusNoContent)},
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/webhooks/{id}/deliveries": {
+				"get": {
+					Summary:    "List a webhook's recent deliveries, most recent first (admin only)",
+					Parameters: []openAPIParameter{idParam},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(&openAPISchema{Type: "array", Items: schemaFor(reflect.TypeOf(WebhookDelivery{}))}),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/webhooks/{id}/rotate-secret": {
+				"post": {
+					Summary:    "Give a webhook a new secret, signing with the old one too for the next 24 hours (admin only)",
+					Parameters: []openAPIParameter{idParam},
+					RequestBody: &openAPIRequestBody{
+						Content: map[string]openAPIMediaType{"application/json": {Schema: &openAPISchema{
+							Type:       "object",
+							Properties: map[string]*openAPISchema{"secret": {Type: "string"}},
+						}}},
+					},
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(Webhook{}))),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/keys": {
+				"get": {
+					Summary: "List the keys the server signs with and their ages (admin only)",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(&openAPISchema{Type: "array", Items: schemaFor(reflect.TypeOf(KeyInfo{}))}),
+						"403": errorResponse(http.StatusForbidden),
+					},
+				},
+			},
+			"/migration/backfill": {
+				"post": {
+					Summary: "Copy data from the primary to the secondary database during a migration (admin only)",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(BackfillResult{}))),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/migration/report": {
+				"get": {
+					Summary: "Compare the primary and secondary databases during a migration (admin only)",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(MigrationReport{}))),
+						"403": errorResponse(http.StatusForbidden),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/deprecations": {
+				"get": {
+					Summary: "Report which clients are still calling the deprecated unversioned album routes (admin only)",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(deprecationReport{}))),
+						"403": errorResponse(http.StatusForbidden),
+					},
+				},
+			},
+			"/signing-key": {
+				"get": {
+					Summary: "Fetch the public key that responses are signed with, as a JWK",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(signingJWK{}))),
+						"404": errorResponse(http.StatusNotFound),
+					},
+				},
+			},
+			"/signing-keys": {
+				"get": {
+					Summary: "Fetch the current and previous public keys responses are signed with, as a JWK set",
+					Responses: map[string]*openAPIResponse{
+						"200": ok(schemaFor(reflect.TypeOf(signingJWKSet{}))),
+					},
+				},
+			},
+			"/openapi.json": {
+				"get": {
+					Summary:   "Fetch this OpenAPI spec",
+					Responses: map[string]*openAPIResponse{"200": ok(object)},
+				},
+			},
+		},
+	}
+
+	if deprecateLegacy {
+		for path, operations := range doc.Paths {
+			if !isLegacyRoute(path) {
+				continue
+			}
+			for _, operation := range operations {
+				operation.Deprecated = true
+				operation.Responses["410"] = errorResponse(http.StatusGone)
+			}
+		}
+	}
+	return doc
+}
+
+func jsonResponse(status int, schema *openAPISchema) *openAPIResponse {
+	return &openAPIResponse{
+		Description: http.StatusText(status),
+		Content:     map[string]openAPIMediaType{"application/json": {Schema: schema}},
+	}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// schemaFor returns the JSON schema for values of type typ, as marshaled by
+// encoding/json. Struct fields without "omitempty" are marked required.
+func schemaFor(typ reflect.Type) *openAPISchema {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == timeType {
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	}
+	if typ == rawMessageType {
+		return &openAPISchema{Type: "object"}
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &openAPISchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &openAPISchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &openAPISchema{Type: "array", Items: schemaFor(typ.Elem())}
+	case reflect.Struct:
+		schema := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.PkgPath != "" {
+				continue // unexported
+			}
+			name, options := field.Name, ""
+			if tag, ok := field.Tag.Lookup("json"); ok {
+				if tag == "-" {
+					continue
+				}
+				if i := strings.Index(tag, ","); i >= 0 {
+					name, options = tag[:i], tag[i:]
+				} else {
+					name = tag
+				}
+				if name == "" {
+					name = field.Name
+				}
+			}
+			schema.Properties[name] = schemaFor(field.Type)
+			if !strings.Contains(options, ",omitempty") {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+		return schema
+	default:
+		return &openAPISchema{Type: "object"}
+	}
+}
+
+func (s *Server) getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, r, http.StatusOK, openAPISpec())
+}
@@ -0,0 +1,63 @@
+// Tests for the OpenAPI spec generation
+
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetOpenAPI(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/openapi.json", nil))
+	ensureStatus(t, result, http.StatusOK)
+
+	var got openAPIDoc
+	unmarshalResponse(t, result, &got)
+	if got.OpenAPI != "3.0.3" {
+		t.Fatalf("bad openapi version: got %q, want %q", got.OpenAPI, "3.0.3")
+	}
+	album := got.Paths["/albums/{id}"]["get"].Responses["200"].Content["application/json"].Schema
+	want := []string{"id", "title", "artist", "version", "created_at", "updated_at"}
+	if !reflect.DeepEqual(album.Required, want) {
+		t.Fatalf("bad required fields: got %q, want %q", album.Required, want)
+	}
+}
+
+func TestSchemaFor(t *testing.T) {
+	type inner struct {
+		When time.Time `json:"when"`
+	}
+	type value struct {
+		Name    string   `json:"name"`
+		Count   int      `json:"count,omitempty"`
+		Ratio   float64  `json:"ratio"`
+		Tags    []string `json:"tags,omitempty"`
+		Inner   *inner   `json:"inner,omitempty"`
+		Ignored string   `json:"-"`
+		NoTag   bool
+		private int
+	}
+	got := schemaFor(reflect.TypeOf(value{}))
+	want := &openAPISchema{
+		Type: "object",
+		Properties: map[string]*openAPISchema{
+			"name":  {Type: "string"},
+			"count": {Type: "integer"},
+			"ratio": {Type: "number"},
+			"tags":  {Type: "array", Items: &openAPISchema{Type: "string"}},
+			"inner": {
+				Type:       "object",
+				Properties: map[string]*openAPISchema{"when": {Type: "string", Format: "date-time"}},
+				Required:   []string{"when"},
+			},
+			"NoTag": {Type: "boolean"},
+		},
+		Required: []string{"name", "ratio", "NoTag"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad schema: got vs want:\n%#v\n%#v", got, want)
+	}
+}
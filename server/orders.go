@@ -0,0 +1,447 @@
+// Orders and checkout
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Customers buy albums by placing an order: POST /orders with a customer
+// ID and the albums (and quantities) to buy. The order's prices are
+// copied from the albums when it's placed, so later price changes don't
+// affect it, and its total is the sum of its line items. Orders start out
+// "pending", move on to "paid" and then "shipped", and a paid or shipped
+// order can be "refunded"; no other transitions are allowed. Customers
+// pay with POST /orders/:id/pay if there's a PaymentProvider (see
+// payments.go), and admins can change the status with POST
+// /orders/:id/status, for example to mark orders paid offline. GET
+// /orders/:id fetches an order, and GET /orders?customer_id= lists a
+// customer's orders, oldest first. Only admins and the user the order is
+// for (the user whose ID is its customer ID, see users.go) can place,
+// pay for, or fetch it.
+//
+// Refunding an order with a payment first moves it to "refunding", so
+// only one request can refund it, and only then calls the
+// PaymentProvider. The order is "refunded" once that succeeds, or back to
+// its previous status if it fails.
+//
+// Orders are kept in their own OrderStore rather than the Database, as
+// they're a separate resource with their own lifecycle.
+const (
+	maxOrderItems    = 100
+	maxOrderQuantity = 100
+)
+
+// Order statuses, in the order an order moves through them.
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderShipped   = "shipped"
+	OrderRefunding = "refunding" // while the payment is being refunded
+	OrderRefunded  = "refunded"
+)
+
+// orderTransitions maps each order status to the statuses it can be moved
+// to with POST /orders/:id/status. It doesn't include OrderRefunding, as
+// only refunds move an order to and from that.
+var orderTransitions = map[string][]string{
+	OrderPending: {OrderPaid},
+	OrderPaid:    {OrderShipped, OrderRefunded},
+	OrderShipped: {OrderRefunded},
+}
+
+// canTransition reports whether an order can move from status "from" to
+// status "to".
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Order is a customer's order for one or more albums.
+type Order struct {
+	ID         string      `json:"id"`
+	CustomerID string      `json:"customer_id"`
+	Items      []OrderItem `json:"items"`
+	Total      int         `json:"total"` // in cents, like Album.Price
+	Status     string      `json:"status"`
+	PaymentID  string      `json:"payment_id,omitempty"` // from the PaymentProvider
+	CreatedAt  time.Time   `json:"created_at"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+
+	// Tenant is the ID of the tenant the order was placed with, if there
+	// are tenants (see tenants.go).
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// OrderItem is a line item in an order: an album, how many copies, and
+// the album's price when the order was placed.
+type OrderItem struct {
+	AlbumID   string `json:"album_id"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int    `json:"unit_price"`
+}
+
+// OrderStore is the interface used by the server to store orders.
+type OrderStore interface {
+	// AddOrder adds an order, or returns ErrAlreadyExists if an order
+	// with its ID already exists.
+	AddOrder(order Order) error
+
+	// GetOrder returns the order with the given ID, or ErrDoesNotExist.
+	GetOrder(id string) (Order, error)
+
+	// GetCustomerOrders returns the customer's orders, oldest first.
+	GetCustomerOrders(customerID string) ([]Order, error)
+
+	// UpdateOrderStatus changes the order's status from "from" to "to",
+	// setting its UpdatedAt to now, and returns the updated order. It's a
+	// compare-and-swap: it returns ErrVersionConflict if the order's
+	// status isn't "from", or ErrDoesNotExist if there's no such order.
+	UpdateOrderStatus(id, from, to string, now time.Time) (Order, error)
+
+	// SetOrderPaymentID sets the ID of the order's payment if it doesn't
+	// have one yet. It returns ErrVersionConflict if it already has one,
+	// or ErrDoesNotExist if there's no such order.
+	SetOrderPaymentID(id, paymentID string) error
+}
+
+// WithOrderStore sets the store for orders. The default is none, in which
+// case the /orders routes aren't available.
+func WithOrderStore(store OrderStore) Option {
+	return func(s *Server) {
+		s.orderStore = store
+	}
+}
+
+// orderURL returns the URL of the order with the given ID.
+func (s *Server) orderURL(r *http.Request, id string) string {
+	return s.resourceURL(apiPrefix(r) + "/orders/" + id)
+}
+
+// orderInput is an order as given by a client.
+type orderInput struct {
+	CustomerID string `json:"customer_id"`
+	Items      []struct {
+		AlbumID  string `json:"album_id"`
+		Quantity int    `json:"quantity"`
+	} `json:"items"`
+}
+
+func (s *Server) createOrder(w http.ResponseWriter, r *http.Request) {
+	if s.orderStore == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	var input orderInput
+	if !s.readJSON(w, r, &input) {
+		return
+	}
+
+	issues := make(map[string]interface{})
+	if input.CustomerID == "" {
+		issues["customer_id"] = validationIssue{"required", ""}
+	}
+	switch {
+	case len(input.Items) == 0:
+		issues["items"] = validationIssue{"required", "an order must have at least one item"}
+	case len(input.Items) > maxOrderItems:
+		issues["items"] = validationIssue{"too-many", fmt.Sprintf("an order can have at most %d items", maxOrderItems)}
+	}
+	ids := make([]string, 0, len(input.Items))
+	seen := make(map[string]bool)
+	for i, item := range input.Items {
+		prefix := fmt.Sprintf("items.%d.", i)
+		switch {
+		case item.AlbumID == "":
+			issues[prefix+"album_id"] = validationIssue{"required", ""}
+		case seen[item.AlbumID]:
+			issues[prefix+"album_id"] = validationIssue{"duplicate", "each album can only be in one item"}
+		}
+		seen[item.AlbumID] = true
+		if item.Quantity < 1 || item.Quantity > maxOrderQuantity {
+			issues[prefix+"quantity"] = validationIssue{"out-of-range", fmt.Sprintf("quantity must be between 1 and %d", maxOrderQuantity)}
+		}
+		ids = append(ids, item.AlbumID)
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+	if !s.canSeeOrders(r, input.CustomerID) {
+		s.writeError(w, r, apierr.Forbidden())
+		return
+	}
+
+	albums, err := s.db.GetAlbumsByIDs(ids)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("fetching order albums: %w", err)))
+		return
+	}
+	prices := make(map[string]int, len(albums))
+	for _, album := range filterVisible(albums, s.now(), false) {
+		prices[album.ID] = album.Price
+	}
+	order := Order{CustomerID: input.CustomerID, Items: []OrderItem{}, Status: OrderPending}
+	for i, item := range input.Items {
+		price, ok := prices[item.AlbumID]
+		if !ok {
+			issues[fmt.Sprintf("items.%d.album_id", i)] = validationIssue{"not-found", fmt.Sprintf("album %q doesn't exist", item.AlbumID)}
+			continue
+		}
+		order.Items = append(order.Items, OrderItem{AlbumID: item.AlbumID, Quantity: item.Quantity, UnitPrice: price})
+		order.Total += item.Quantity * price
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+
+	order.ID, err = s.idGenerator.NewID()
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("generating order ID: %w", err)))
+		return
+	}
+	order.CreatedAt = s.now().UTC()
+	order.UpdatedAt = order.CreatedAt
+	err = s.orderStore.AddOrder(order)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("adding order ID %q: %w", order.ID, err)))
+		return
+	}
+	s.audit(r, "create", "order", order.ID, nil, snapshot(order))
+	w.Header().Set("Location", s.orderURL(r, order.ID))
+	s.writeJSON(w, r, http.StatusCreated, order)
+}
+
+// canSeeOrders reports whether the request is allowed to fetch, place, or
+// pay for the orders of the customer with the given ID: it must be from an
+// admin, or from the user with that ID.
+func (s *Server) canSeeOrders(r *http.Request, customerID string) bool {
+	userID := s.principal(r).UserID
+	return s.isAdmin(r) || userID != "" && userID == customerID
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request, id string) {
+	if s.orderStore == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	order, err := s.orderStore.GetOrder(id)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	if !s.canSeeOrders(r, order.CustomerID) {
+		// Not found rather than forbidden, so order IDs can't be probed
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, order)
+}
+
+func (s *Server) getOrders(w http.ResponseWriter, r *http.Request) {
+	if s.orderStore == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	customerID := r.URL.Query().Get("customer_id")
+	if customerID == "" {
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{
+			"customer_id": validationIssue{"required", ""},
+		}))
+		return
+	}
+	if !s.canSeeOrders(r, customerID) {
+		s.writeError(w, r, apierr.Forbidden())
+		return
+	}
+	orders, err := s.orderStore.GetCustomerOrders(customerID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("fetching orders: %w", err)))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, orders)
+}
+
+// updateOrderStatus moves an order on to its next status.
+func (s *Server) updateOrderStatus(w http.ResponseWriter, r *http.Request, id string) {
+	if s.orderStore == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	var input struct {
+		Status string `json:"status"`
+	}
+	if !s.readJSON(w, r, &input) {
+		return
+	}
+	order, err := s.orderStore.GetOrder(id)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	if !canTransition(order.Status, input.Status) {
+		message := "order is " + order.Status + " and can't be changed"
+		if next := orderTransitions[order.Status]; len(next) > 0 {
+			message = "order is " + order.Status + ", so status can only be changed to " + strings.Join(next, " or ")
+		}
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{
+			"status": validationIssue{"invalid-transition", message},
+		}))
+		return
+	}
+	if input.Status == OrderRefunded && order.PaymentID != "" {
+		s.refundOrder(w, r, order)
+		return
+	}
+	updated, err := s.changeOrderStatus(r, order, input.Status)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, updated)
+}
+
+// refundOrder refunds the order's payment and marks it refunded. The order
+// is moved to OrderRefunding first, so if two requests try to refund it at
+// once, the second gets a conflict rather than refunding it twice.
+func (s *Server) refundOrder(w http.ResponseWriter, r *http.Request, order Order) {
+	if s.paymentProvider == nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("refunding order ID %q: no payment provider", order.ID)))
+		return
+	}
+	_, err := s.orderStore.UpdateOrderStatus(order.ID, order.Status, OrderRefunding, s.now())
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("updating order ID %q: %w", order.ID, err)))
+		return
+	}
+	err = s.paymentProvider.Refund(order.PaymentID, order.Total)
+	if err != nil {
+		_, undoErr := s.orderStore.UpdateOrderStatus(order.ID, OrderRefunding, order.Status, s.now())
+		if undoErr != nil {
+			s.log.Printf("error restoring status of order ID %q after failed refund: %v", order.ID, undoErr)
+		}
+		s.writePaymentError(w, r, fmt.Errorf("refunding order ID %q: %w", order.ID, err))
+		return
+	}
+	updated, err := s.orderStore.UpdateOrderStatus(order.ID, OrderRefunding, OrderRefunded, s.now())
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("updating order ID %q: %w", order.ID, err)))
+		return
+	}
+	s.audit(r, "update", "order", order.ID, snapshot(order), snapshot(updated))
+	s.writeJSON(w, r, http.StatusOK, updated)
+}
+
+// changeOrderStatus moves order on to status "to" and audits the change.
+// It returns the updated order, or an *apierr.Error (a conflict if the
+// order was changed since it was fetched).
+func (s *Server) changeOrderStatus(r *http.Request, order Order, to string) (Order, error) {
+	updated, err := s.orderStore.UpdateOrderStatus(order.ID, order.Status, to, s.now())
+	if err != nil {
+		return Order{}, apierr.Database(fmt.Errorf("updating order ID %q: %w", order.ID, err))
+	}
+	s.audit(r, "update", "order", order.ID, snapshot(order), snapshot(updated))
+	return updated, nil
+}
+
+// MemoryOrderStore is an OrderStore that keeps orders in memory.
+type MemoryOrderStore struct {
+	lock   sync.RWMutex
+	orders map[string]Order
+}
+
+// NewMemoryOrderStore creates a new in-memory order store.
+func NewMemoryOrderStore() *MemoryOrderStore {
+	return &MemoryOrderStore{orders: make(map[string]Order)}
+}
+
+func (m *MemoryOrderStore) AddOrder(order Order) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.orders[order.ID]; ok {
+		return ErrAlreadyExists
+	}
+	order.Items = append([]OrderItem(nil), order.Items...)
+	m.orders[order.ID] = order
+	return nil
+}
+
+func (m *MemoryOrderStore) GetOrder(id string) (Order, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	order, ok := m.orders[id]
+	if !ok {
+		return Order{}, ErrDoesNotExist
+	}
+	return copyOrder(order), nil
+}
+
+func (m *MemoryOrderStore) GetCustomerOrders(customerID string) ([]Order, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	orders := []Order{}
+	for _, order := range m.orders {
+		if order.CustomerID == customerID {
+			orders = append(orders, copyOrder(order))
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].CreatedAt.Equal(orders[j].CreatedAt) {
+			return orders[i].CreatedAt.Before(orders[j].CreatedAt)
+		}
+		return orders[i].ID < orders[j].ID
+	})
+	return orders, nil
+}
+
+func (m *MemoryOrderStore) UpdateOrderStatus(id, from, to string, now time.Time) (Order, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	order, ok := m.orders[id]
+	if !ok {
+		return Order{}, ErrDoesNotExist
+	}
+	if order.Status != from {
+		return Order{}, ErrVersionConflict
+	}
+	order.Status = to
+	order.UpdatedAt = now.UTC()
+	m.orders[id] = order
+	return copyOrder(order), nil
+}
+
+func (m *MemoryOrderStore) SetOrderPaymentID(id, paymentID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	order, ok := m.orders[id]
+	if !ok {
+		return ErrDoesNotExist
+	}
+	if order.PaymentID != "" {
+		return ErrVersionConflict
+	}
+	order.PaymentID = paymentID
+	m.orders[id] = order
+	return nil
+}
+
+// copyOrder returns a copy of order that doesn't share its items.
+func copyOrder(order Order) Order {
+	order.Items = append([]OrderItem{}, order.Items...)
+	return order
+}
@@ -0,0 +1,243 @@
+// Tests for orders and checkout
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newOrderTestServer() *Server {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000})
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	return NewServer(db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return now }),
+		WithIDGenerator(&SequentialIDGenerator{}),
+		WithOrderStore(NewMemoryOrderStore()),
+	)
+}
+
+func TestOrders(t *testing.T) {
+	server := newOrderTestServer()
+	result := serve(t, server, newAdminRequest(t, "POST", "/orders", strings.NewReader(`{
+		"customer_id": "c1",
+		"items": [{"album_id": "a2", "quantity": 1}, {"album_id": "a1", "quantity": 3}]
+	}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	if got := result.Header.Get("Location"); got != "/orders/id1" {
+		t.Fatalf("got Location %q, want /orders/id1", got)
+	}
+	var order Order
+	unmarshalResponse(t, result, &order)
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	if order.ID != "id1" || order.CustomerID != "c1" || order.Status != OrderPending || order.Total != 2000+3*795 ||
+		len(order.Items) != 2 || order.Items[1] != (OrderItem{AlbumID: "a1", Quantity: 3, UnitPrice: 795}) ||
+		!order.CreatedAt.Equal(now) {
+		t.Fatalf("bad order: %+v", order)
+	}
+
+	// Later price changes don't affect the order
+	result = serve(t, server, newRequest(t, "PUT", "/albums/a1", strings.NewReader(`{"title": "9th Symphony", "artist": "Beethoven", "price": 995, "version": 1}`)))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newAdminRequest(t, "GET", "/v1/orders/id1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var fetched Order
+	unmarshalResponse(t, result, &fetched)
+	if fetched.Total != order.Total {
+		t.Fatalf("got total %d, want %d", fetched.Total, order.Total)
+	}
+	result = serve(t, server, newAdminRequest(t, "GET", "/orders/id9", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	// Listing by customer
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders", strings.NewReader(`{"customer_id": "c2", "items": [{"album_id": "a1", "quantity": 1}]}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders", strings.NewReader(`{"customer_id": "c1", "items": [{"album_id": "a1", "quantity": 1}]}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	result = serve(t, server, newAdminRequest(t, "GET", "/orders?customer_id=c1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var orders []Order
+	unmarshalResponse(t, result, &orders)
+	if len(orders) != 2 || orders[0].ID != "id1" || orders[1].ID != "id3" || orders[1].Total != 995 {
+		t.Fatalf("bad orders: %+v", orders)
+	}
+	result = serve(t, server, newAdminRequest(t, "GET", "/orders?customer_id=c9", nil))
+	ensureStatus(t, result, http.StatusOK)
+	unmarshalResponse(t, result, &orders)
+	if len(orders) != 0 {
+		t.Fatalf("expected no orders, got %+v", orders)
+	}
+	result = serve(t, server, newAdminRequest(t, "GET", "/orders", nil))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"customer_id": map[string]interface{}{"error": "required"},
+	})
+}
+
+func TestOrderValidation(t *testing.T) {
+	server := newOrderTestServer()
+	result := serve(t, server, newAdminRequest(t, "POST", "/orders", strings.NewReader(`{"items": []}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"customer_id": map[string]interface{}{"error": "required"},
+		"items":       map[string]interface{}{"error": "required", "message": "an order must have at least one item"},
+	})
+
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders", strings.NewReader(`{
+		"customer_id": "c1",
+		"items": [{"album_id": "a1", "quantity": 0}, {"album_id": "a1", "quantity": 1}, {"quantity": 1}]
+	}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"items.0.quantity": map[string]interface{}{"error": "out-of-range", "message": "quantity must be between 1 and 100"},
+		"items.1.album_id": map[string]interface{}{"error": "duplicate", "message": "each album can only be in one item"},
+		"items.2.album_id": map[string]interface{}{"error": "required"},
+	})
+
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders", strings.NewReader(`{"customer_id": "c1", "items": [{"album_id": "a1", "quantity": 1}, {"album_id": "a3", "quantity": 1}]}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"items.1.album_id": map[string]interface{}{"error": "not-found", "message": `album "a3" doesn't exist`},
+	})
+}
+
+func TestOrderStatus(t *testing.T) {
+	server := newOrderTestServer()
+	result := serve(t, server, newAdminRequest(t, "POST", "/orders", strings.NewReader(`{"customer_id": "c1", "items": [{"album_id": "a1", "quantity": 1}]}`)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	result = serve(t, server, newRequest(t, "POST", "/orders/id1/status", strings.NewReader(`{"status": "paid"}`)))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders/id1/status", strings.NewReader(`{"status": "shipped"}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"status": map[string]interface{}{"error": "invalid-transition", "message": "order is pending, so status can only be changed to paid"},
+	})
+
+	for _, status := range []string{OrderPaid, OrderShipped, OrderRefunded} {
+		result = serve(t, server, newAdminRequest(t, "POST", "/orders/id1/status", strings.NewReader(`{"status": "`+status+`"}`)))
+		ensureStatus(t, result, http.StatusOK)
+		var order Order
+		unmarshalResponse(t, result, &order)
+		if order.Status != status {
+			t.Fatalf("got status %q, want %q", order.Status, status)
+		}
+	}
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders/id1/status", strings.NewReader(`{"status": "pending"}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"status": map[string]interface{}{"error": "invalid-transition", "message": "order is refunded and can't be changed"},
+	})
+
+	// Paid orders can be shipped or refunded
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders", strings.NewReader(`{"customer_id": "c1", "items": [{"album_id": "a1", "quantity": 1}]}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders/id2/status", strings.NewReader(`{"status": "paid"}`)))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders/id2/status", strings.NewReader(`{"status": "pending"}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"status": map[string]interface{}{"error": "invalid-transition", "message": "order is paid, so status can only be changed to shipped or refunded"},
+	})
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders/id9/status", strings.NewReader(`{"status": "paid"}`)))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestOrdersAccess(t *testing.T) {
+	// Only admins and the customer's own user can place or see their orders
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithIDGenerator(&SequentialIDGenerator{}),
+		WithOrderStore(NewMemoryOrderStore()),
+		WithAuthenticators(AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+			userID := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer user-")
+			if userID == r.Header.Get("Authorization") {
+				return Principal{}, ErrNoCredentials
+			}
+			return Principal{ID: userID, Role: RolePublic, UserID: userID}, nil
+		})),
+	)
+	asUser := func(method, path, userID string, body io.Reader) *http.Request {
+		request := newRequest(t, method, path, body)
+		if userID != "" {
+			request.Header.Set("Authorization", "Bearer user-"+userID)
+		}
+		return request
+	}
+
+	// Users can only place orders for themselves
+	input := `{"customer_id": "c1", "items": [{"album_id": "a1", "quantity": 1}]}`
+	for _, userID := range []string{"", "c2"} {
+		result := serve(t, server, asUser("POST", "/orders", userID, strings.NewReader(input)))
+		ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	}
+	result := serve(t, server, asUser("POST", "/orders", "c1", strings.NewReader(input)))
+	ensureStatus(t, result, http.StatusCreated)
+	if got := result.Header.Get("Location"); got != "/orders/id1" {
+		t.Fatalf("got Location %q, want /orders/id1", got)
+	}
+
+	ensureStatus(t, serve(t, server, asUser("GET", "/orders/id1", "c1", nil)), http.StatusOK)
+	ensureStatus(t, serve(t, server, asUser("GET", "/orders?customer_id=c1", "c1", nil)), http.StatusOK)
+	for _, userID := range []string{"", "c2"} {
+		result = serve(t, server, asUser("GET", "/orders/id1", userID, nil))
+		ensureError(t, result, http.StatusNotFound, "not-found", nil)
+		result = serve(t, server, asUser("GET", "/orders?customer_id=c1", userID, nil))
+		ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	}
+}
+
+func TestOrdersUnavailable(t *testing.T) {
+	server := newTestServer()
+	for _, path := range []string{"/orders?customer_id=c1", "/orders/o1"} {
+		result := serve(t, server, newRequest(t, "GET", path, nil))
+		ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	}
+}
+
+func TestMemoryOrderStore(t *testing.T) {
+	store := NewMemoryOrderStore()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	order := Order{ID: "o1", CustomerID: "c1", Items: []OrderItem{{AlbumID: "a1", Quantity: 1, UnitPrice: 795}}, Status: OrderPending, CreatedAt: now}
+	if err := store.AddOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddOrder(order); err != ErrAlreadyExists {
+		t.Fatalf("got %v, want ErrAlreadyExists", err)
+	}
+
+	// Returned orders don't share their items with the store
+	got, _ := store.GetOrder("o1")
+	got.Items[0].Quantity = 99
+	got, _ = store.GetOrder("o1")
+	if got.Items[0].Quantity != 1 {
+		t.Fatalf("store's order was modified: %+v", got)
+	}
+
+	updated, err := store.UpdateOrderStatus("o1", OrderPending, OrderPaid, now.Add(time.Hour))
+	if err != nil || updated.Status != OrderPaid || !updated.UpdatedAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("got %+v, %v", updated, err)
+	}
+	if _, err := store.UpdateOrderStatus("o1", OrderPending, OrderPaid, now); err != ErrVersionConflict {
+		t.Fatalf("got %v, want ErrVersionConflict", err)
+	}
+	if _, err := store.UpdateOrderStatus("o2", OrderPending, OrderPaid, now); err != ErrDoesNotExist {
+		t.Fatalf("got %v, want ErrDoesNotExist", err)
+	}
+
+	// The payment ID can only be set once
+	if err := store.SetOrderPaymentID("o1", "p1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetOrderPaymentID("o1", "p2"); err != ErrVersionConflict {
+		t.Fatalf("got %v, want ErrVersionConflict", err)
+	}
+	if got, _ := store.GetOrder("o1"); got.PaymentID != "p1" {
+		t.Fatalf("got payment ID %q, want p1", got.PaymentID)
+	}
+	if err := store.SetOrderPaymentID("o2", "p1"); err != ErrDoesNotExist {
+		t.Fatalf("got %v, want ErrDoesNotExist", err)
+	}
+}
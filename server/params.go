@@ -0,0 +1,79 @@
+// Repeated query parameters
+
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Query parameters have explicit semantics when they're repeated, rather
+// than whatever url.Values.Get returns (the first value). The filters in
+// repeatableParams match any of their values, so ?artist=A&artist=B lists
+// albums by either artist; different filters are combined, so adding
+// &genre=rock as well lists only the rock albums by A or B. Any other
+// parameter, like page or include_deleted, can only be given once: a
+// request that repeats one is rejected with a validation error, because
+// there's no way to tell which value the client meant.
+var repeatableParams = map[string]bool{
+	"artist":         true, // GET /albums and /ws
+	"genre":          true, // GET /albums
+	"type":           true, // GET /events
+	"fields[albums]": true, // JSON:API sparse fieldsets
+}
+
+// checkQueryParams writes a validation error and returns false if the
+// request repeats a query parameter that can only be given once.
+func (s *Server) checkQueryParams(w http.ResponseWriter, r *http.Request) bool {
+	issues := make(map[string]interface{})
+	for name, values := range r.URL.Query() {
+		if len(values) > 1 && !repeatableParams[name] {
+			issues[name] = validationIssue{"duplicate", name + " must only be given once"}
+		}
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return false
+	}
+	return true
+}
+
+// paramValues returns the non-empty values of a repeatable query
+// parameter, sorted and de-duplicated, or nil if there aren't any (so the
+// filter isn't applied).
+func paramValues(r *http.Request, name string) []string {
+	var values []string
+	for _, value := range r.URL.Query()[name] {
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Strings(values)
+	unique := values[:1]
+	for _, value := range values[1:] {
+		if value != unique[len(unique)-1] {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// matchArtist reports whether the album is by one of the given artists
+// (case-insensitively), or true if there are none.
+func matchArtist(album Album, artists []string) bool {
+	if len(artists) == 0 {
+		return true
+	}
+	for _, artist := range artists {
+		if strings.EqualFold(artist, album.Artist) {
+			return true
+		}
+	}
+	return false
+}
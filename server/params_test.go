@@ -0,0 +1,101 @@
+// Tests for repeated query parameters
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRepeatedFilters(t *testing.T) {
+	db := NewMemoryDatabase()
+	for _, id := range []string{"rock", "jazz", "pop"} {
+		db.AddGenre(Genre{ID: id, Name: id})
+	}
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Genres: []string{"rock"}})
+	db.AddAlbum(Album{ID: "a3", Title: "Kind of Blue", Artist: "Miles Davis", Genres: []string{"jazz"}})
+	db.AddAlbum(Album{ID: "a4", Title: "Help!", Artist: "The Beatles", Genres: []string{"pop", "rock"}})
+	server := NewServer(db, log.New(io.Discard, "", 0))
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"a1", "a2", "a3", "a4"}},
+		{"?genre=rock", []string{"a2", "a4"}},
+		{"?genre=rock&genre=jazz", []string{"a2", "a3", "a4"}},
+		{"?genre=rock&genre=rock", []string{"a2", "a4"}},
+		{"?genre=polka", []string{}},
+		{"?artist=beethoven&artist=Miles+Davis", []string{"a1", "a3"}},
+		{"?artist=The+Beatles&genre=jazz&genre=pop", []string{"a4"}},
+		{"?artist=&genre=", []string{"a1", "a2", "a3", "a4"}},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			result := serve(t, server, newRequest(t, "GET", "/albums"+test.query, nil))
+			ensureStatus(t, result, http.StatusOK)
+			var albums []testAlbum
+			unmarshalResponse(t, result, &albums)
+			ids := []string{}
+			for _, album := range albums {
+				ids = append(ids, album.ID)
+			}
+			if !reflect.DeepEqual(ids, test.want) {
+				t.Fatalf("got IDs %q, want %q", ids, test.want)
+			}
+
+			// Streaming filters the same way
+			result = serve(t, server, newNDJSONRequest(t, "/albums"+test.query))
+			ensureStatus(t, result, http.StatusOK)
+			ids = []string{}
+			for _, album := range readNDJSON(t, result) {
+				ids = append(ids, album.ID)
+			}
+			if !reflect.DeepEqual(ids, test.want) {
+				t.Fatalf("got streamed IDs %q, want %q", ids, test.want)
+			}
+		})
+	}
+}
+
+func TestDuplicateQueryParams(t *testing.T) {
+	server := newTestServer()
+	tests := []struct {
+		url  string
+		data map[string]interface{}
+	}{
+		{"/albums?include_deleted=false&include_deleted=true", map[string]interface{}{
+			"include_deleted": map[string]interface{}{"error": "duplicate", "message": "include_deleted must only be given once"},
+		}},
+		{"/albums?q=x&genre=rock&q=y", map[string]interface{}{
+			"q": map[string]interface{}{"error": "duplicate", "message": "q must only be given once"},
+		}},
+		{"/albums/a1/barcode?scale=2&scale=3&format=png&format=svg", map[string]interface{}{
+			"scale":  map[string]interface{}{"error": "duplicate", "message": "scale must only be given once"},
+			"format": map[string]interface{}{"error": "duplicate", "message": "format must only be given once"},
+		}},
+		{"/feed?page=1&page=1", map[string]interface{}{
+			"page": map[string]interface{}{"error": "duplicate", "message": "page must only be given once"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			result := serve(t, server, newRequest(t, "GET", test.url, nil))
+			ensureError(t, result, http.StatusBadRequest, "validation", test.data)
+		})
+	}
+}
+
+func TestParamValues(t *testing.T) {
+	request := newRequest(t, "GET", "/albums?genre=rock&genre=&genre=jazz&genre=rock&artist=", nil)
+	if got, want := paramValues(request, "genre"), []string{"jazz", "rock"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got := paramValues(request, "artist"); got != nil {
+		t.Fatalf("got %q, want nil", got)
+	}
+}
@@ -0,0 +1,117 @@
+// Trailing-slash and duplicate-slash path policy
+//
+// Routes are matched exactly, so by default "/albums/" and "//albums" are
+// 404 Not Found, even though they're only a typo away from "/albums". The
+// path policy says what to do instead when a path doesn't match a route
+// but its cleaned form (with runs of slashes collapsed and any trailing
+// slash removed) does:
+//
+//   - PathStrict (the default) leaves it, so the request is a 404.
+//   - PathRedirect redirects to the cleaned path with 308 Permanent
+//     Redirect, which (unlike 301) tells clients to repeat the request
+//     with the same method and body.
+//   - PathRewrite serves the cleaned path as if it had been requested.
+//
+// The policy is applied before the rest of the middleware chain, so route
+// configuration, roles, and rate limits apply to the cleaned path, and a
+// rewritten "/albums/a1/" can't be used to get around the rules for
+// "/albums/{id}". Paths that match a route as they are, like those of
+// static files (where a trailing slash means a directory index), are never
+// changed.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// PathPolicy says how to handle request paths with a trailing slash or
+// duplicate slashes.
+type PathPolicy string
+
+const (
+	PathStrict   PathPolicy = "strict"
+	PathRedirect PathPolicy = "redirect"
+	PathRewrite  PathPolicy = "rewrite"
+)
+
+// parsePathPolicy parses the name of a path policy.
+func parsePathPolicy(s string) (PathPolicy, error) {
+	switch policy := PathPolicy(s); policy {
+	case PathStrict, PathRedirect, PathRewrite:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("path policy must be %s, %s, or %s, not %q", PathStrict, PathRedirect, PathRewrite, s)
+	}
+}
+
+// WithPathPolicy sets how paths with a trailing slash or duplicate slashes
+// are handled. The default is PathStrict.
+func WithPathPolicy(policy PathPolicy) Option {
+	return func(s *Server) {
+		s.pathPolicy = policy
+	}
+}
+
+// cleanPath returns path with runs of slashes collapsed to one slash, and
+// without a trailing slash (unless it's just "/").
+func cleanPath(path string) string {
+	var b strings.Builder
+	b.Grow(len(path))
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && (i+1 == len(path) || path[i+1] == '/') {
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	if b.Len() == 0 {
+		return "/"
+	}
+	return b.String()
+}
+
+// isRoute reports whether the escaped path, which may have the /v1 prefix,
+// matches a route.
+func isRoute(path string) bool {
+	if path == apiVersionPrefix || strings.HasPrefix(path, apiVersionPrefix+"/") {
+		path = strings.TrimPrefix(path, apiVersionPrefix)
+		if path == "" {
+			path = "/"
+		}
+	}
+	rte, _ := apiRoutes.lookup(path)
+	return rte != nil
+}
+
+// pathHandler applies the path policy to requests for paths that don't
+// match a route.
+func (s *Server) pathHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.EscapedPath()
+		if isRoute(path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		clean := cleanPath(path)
+		if clean == path || !isRoute(clean) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Like http.StripPrefix, copy the URL rather than changing it
+		u := *r.URL
+		u.Path, _ = url.PathUnescape(clean) // already unescaped once, so can't fail
+		u.RawPath = clean
+		if s.pathPolicy == PathRedirect {
+			w.Header().Set("Location", s.resourceURL(u.RequestURI()))
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		r2 := *r
+		r2.URL = &u
+		h.ServeHTTP(w, &r2)
+	})
+}
@@ -0,0 +1,137 @@
+// Tests for the trailing-slash and duplicate-slash path policy
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"/", "/"},
+		{"//", "/"},
+		{"", "/"},
+		{"/albums", "/albums"},
+		{"/albums/", "/albums"},
+		{"/albums//", "/albums"},
+		{"//albums", "/albums"},
+		{"/albums//a1///tracks/", "/albums/a1/tracks"},
+	}
+	for _, test := range tests {
+		if got := cleanPath(test.path); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestParsePathPolicy(t *testing.T) {
+	for _, s := range []string{"strict", "redirect", "rewrite"} {
+		policy, err := parsePathPolicy(s)
+		if err != nil || string(policy) != s {
+			t.Fatalf("%q: got %q, %v", s, policy, err)
+		}
+	}
+	if _, err := parsePathPolicy("lenient"); err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
+
+// newPathRequest is like newRequest, but parses the path like the server
+// does, so "//albums" is a path rather than a host.
+func newPathRequest(method, path string, body io.Reader) *http.Request {
+	return httptest.NewRequest(method, path, body)
+}
+
+func newPathPolicyTestServer(policy PathPolicy) *Server {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	return NewServer(db, log.New(io.Discard, "", 0), WithPathPolicy(policy))
+}
+
+func TestPathPolicyStrict(t *testing.T) {
+	for _, server := range []*Server{newTestServer(), newPathPolicyTestServer(PathStrict)} {
+		for _, path := range []string{"/albums/", "//albums", "/albums//a1", "/v1/albums/a1/"} {
+			result := serve(t, server, newPathRequest("GET", path, nil))
+			ensureError(t, result, http.StatusNotFound, "not-found", nil)
+		}
+	}
+}
+
+func TestPathPolicyRedirect(t *testing.T) {
+	server := newPathPolicyTestServer(PathRedirect)
+	tests := []struct {
+		method, path, location string
+	}{
+		{"GET", "/albums/", "/albums"},
+		{"GET", "//albums?genre=rock", "/albums?genre=rock"},
+		{"GET", "/albums//a1/", "/albums/a1"},
+		{"GET", "/v1/albums/a1/", "/v1/albums/a1"},
+		{"POST", "/albums/", "/albums"},
+		{"DELETE", "/albums/a1/", "/albums/a1"},
+	}
+	for _, test := range tests {
+		result := serve(t, server, newPathRequest(test.method, test.path, nil))
+		ensureStatus(t, result, http.StatusPermanentRedirect)
+		if location := result.Header.Get("Location"); location != test.location {
+			t.Errorf("%s %s: got Location %q, want %q", test.method, test.path, location, test.location)
+		}
+	}
+
+	// Including the base URL
+	server = NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithPathPolicy(PathRedirect),
+		WithBaseURL(mustParseBaseURL(t, "https://example.com/api")))
+	result := serve(t, server, newPathRequest("GET", "/albums/", nil))
+	ensureStatus(t, result, http.StatusPermanentRedirect)
+	if location := result.Header.Get("Location"); location != "https://example.com/api/albums" {
+		t.Fatalf("got Location %q", location)
+	}
+}
+
+func TestPathPolicyRewrite(t *testing.T) {
+	server := newPathPolicyTestServer(PathRewrite)
+	for _, path := range []string{"/albums/a1/", "//albums//a1", "/v1/albums/a1/"} {
+		var album testAlbum
+		result := serve(t, server, newPathRequest("GET", path, nil))
+		ensureStatus(t, result, http.StatusOK)
+		unmarshalResponse(t, result, &album)
+		if album.ID != "a1" {
+			t.Fatalf("%s: got album %+v", path, album)
+		}
+	}
+
+	result := serve(t, server, newPathRequest("GET", "/albums/a1/", nil))
+	request := newPathRequest("PUT", "/albums/a1/", strings.NewReader(`{"title": "Pianoman", "artist": "Billy Joel", "price": 1099}`))
+	request.Header.Set("If-Match", result.Header.Get("ETag"))
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newPathRequest("GET", "/albums/a1", nil))
+	var album testAlbum
+	unmarshalResponse(t, result, &album)
+	if album.Title != "Pianoman" {
+		t.Fatalf("got album %+v", album)
+	}
+}
+
+func TestPathPolicyUnknownPaths(t *testing.T) {
+	// Paths that don't match a route even when cleaned, or that already
+	// match one, aren't changed
+	for _, policy := range []PathPolicy{PathRedirect, PathRewrite} {
+		server := newPathPolicyTestServer(policy)
+		for _, path := range []string{"/nope/", "//nope", "/albums/a1/nope/"} {
+			result := serve(t, server, newPathRequest("GET", path, nil))
+			ensureError(t, result, http.StatusNotFound, "not-found", nil)
+		}
+		result := serve(t, server, newPathRequest("GET", "/static/", nil))
+		ensureError(t, result, http.StatusNotFound, "not-found", nil) // no static files
+		if result.Header.Get("Location") != "" {
+			t.Fatalf("%s: got Location %q for static directory", policy, result.Header.Get("Location"))
+		}
+	}
+}
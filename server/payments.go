@@ -0,0 +1,334 @@
+// Payments for orders
+
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Orders are paid for through a PaymentProvider (see WithPaymentProvider):
+// POST /orders/:id/pay authorizes a payment for the order's total and
+// then captures it, after which the order is paid. The payment's ID is
+// kept on the order, so a retried request captures the same payment
+// rather than charging the customer twice, and so refunding the order
+// (moving it to "refunded" with POST /orders/:id/status) refunds it.
+//
+// Some providers, like Stripe, confirm payments asynchronously: their
+// Capture returns ErrPaymentPending, the order stays pending (and the pay
+// request returns 202 Accepted), and the provider later calls a webhook.
+// POST /payments/stripe receives Stripe's webhook events: it checks the
+// Stripe-Signature header against the secret set with
+// WithStripeWebhookSecret, and marks the order paid when a
+// payment_intent.succeeded event arrives for it. The PaymentIntent must
+// have the order's ID in its metadata, as "order_id". Other event types
+// are acknowledged and ignored, as are events for orders that don't match
+// (they're logged), since Stripe would otherwise keep retrying them.
+const (
+	maxStripeEventBytes = 256 * 1024
+	stripeTolerance     = 5 * time.Minute // maximum age of a webhook's signature
+)
+
+// PaymentProvider is the interface used by the server to take payments.
+// Amounts are in cents, like Album.Price.
+type PaymentProvider interface {
+	// Authorize reserves amount for the order, returning the payment's ID.
+	// It returns ErrPaymentDeclined if the payment was refused.
+	Authorize(orderID string, amount int) (paymentID string, err error)
+
+	// Capture takes an authorized payment. It returns ErrPaymentPending if
+	// the provider will confirm the payment later, with a webhook.
+	Capture(paymentID string) error
+
+	// Refund returns amount of a captured payment to the customer.
+	Refund(paymentID string, amount int) error
+}
+
+var (
+	// ErrPaymentDeclined means the payment provider refused a payment.
+	ErrPaymentDeclined = errors.New("payment declined")
+
+	// ErrPaymentPending means the payment provider will confirm a payment
+	// later.
+	ErrPaymentPending = errors.New("payment pending")
+)
+
+// WithPaymentProvider sets the provider orders are paid through. The
+// default is none, in which case POST /orders/:id/pay isn't available.
+func WithPaymentProvider(provider PaymentProvider) Option {
+	return func(s *Server) {
+		s.paymentProvider = provider
+	}
+}
+
+// WithStripeWebhookSecret sets the signing secret of the Stripe webhook
+// endpoint (starting with "whsec_"). The default is none, in which case
+// POST /payments/stripe isn't available.
+func WithStripeWebhookSecret(secret string) Option {
+	return func(s *Server) {
+		s.stripeWebhookSecret = secret
+	}
+}
+
+// writePaymentError writes the error response for a payment provider
+// failure.
+func (s *Server) writePaymentError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrPaymentDeclined) {
+		s.writeError(w, r, apierr.PaymentDeclined())
+		return
+	}
+	s.writeError(w, r, apierr.Unavailable(err))
+}
+
+func (s *Server) payOrder(w http.ResponseWriter, r *http.Request, id string) {
+	if s.orderStore == nil || s.paymentProvider == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	order, err := s.orderStore.GetOrder(id)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	if !s.canSeeOrders(r, order.CustomerID) {
+		// Not found, as for getOrder, so others' orders can't be probed
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if order.Status != OrderPending {
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{
+			"status": validationIssue{"invalid-transition", "order is " + order.Status + ", and only pending orders can be paid"},
+		}))
+		return
+	}
+
+	if order.PaymentID == "" {
+		paymentID, err := s.paymentProvider.Authorize(order.ID, order.Total)
+		if err != nil {
+			s.writePaymentError(w, r, fmt.Errorf("authorizing payment for order ID %q: %w", id, err))
+			return
+		}
+		// If a concurrent request got in first, this authorization is left
+		// to expire, uncaptured
+		err = s.orderStore.SetOrderPaymentID(id, paymentID)
+		if err != nil {
+			s.writeError(w, r, apierr.Database(fmt.Errorf("setting payment of order ID %q: %w", id, err)))
+			return
+		}
+		order.PaymentID = paymentID
+	}
+	err = s.paymentProvider.Capture(order.PaymentID)
+	if errors.Is(err, ErrPaymentPending) {
+		s.writeJSON(w, r, http.StatusAccepted, order)
+		return
+	}
+	if err != nil {
+		s.writePaymentError(w, r, fmt.Errorf("capturing payment for order ID %q: %w", id, err))
+		return
+	}
+	updated, err := s.changeOrderStatus(r, order, OrderPaid)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, updated)
+}
+
+// stripeEvent is the part of a Stripe webhook event we use.
+type stripeEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object struct {
+			ID             string            `json:"id"`
+			AmountReceived int               `json:"amount_received"`
+			Metadata       map[string]string `json:"metadata"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+func (s *Server) receiveStripeWebhook(w http.ResponseWriter, r *http.Request) {
+	if s.orderStore == nil || s.stripeWebhookSecret == "" {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	body, ok := s.readUpload(w, r, maxStripeEventBytes, "Stripe event")
+	if !ok {
+		return
+	}
+	if !verifyStripeSignature(s.stripeWebhookSecret, r.Header.Get("Stripe-Signature"), body, s.now()) {
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{
+			"Stripe-Signature": validationIssue{"invalid", "Stripe-Signature must be a valid, recent signature of the body"},
+		}))
+		return
+	}
+	var event stripeEvent
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		s.writeError(w, r, apierr.MalformedJSON(err))
+		return
+	}
+	if event.Type != "payment_intent.succeeded" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Changes are audited as made by Stripe
+	r = r.WithContext(context.WithValue(r.Context(), principalKey{}, Principal{ID: "stripe", Role: RolePublic}))
+	intent := event.Data.Object
+	orderID := intent.Metadata["order_id"]
+	order, err := s.orderStore.GetOrder(orderID)
+	switch {
+	case errors.Is(err, ErrDoesNotExist):
+		s.log.Printf("ignoring Stripe event %s: no order ID %q", event.ID, orderID)
+	case err != nil:
+		s.writeError(w, r, apierr.Database(err)) // Stripe retries
+		return
+	case order.PaymentID != "" && order.PaymentID != intent.ID:
+		s.log.Printf("ignoring Stripe event %s: order ID %q has payment %q, not %q", event.ID, orderID, order.PaymentID, intent.ID)
+	case intent.AmountReceived != order.Total:
+		s.log.Printf("ignoring Stripe event %s: received %d for order ID %q, but its total is %d", event.ID, intent.AmountReceived, orderID, order.Total)
+	case order.Status != OrderPending:
+		// Already paid (this is a repeat delivery, or the pay request
+		// captured it synchronously)
+	default:
+		if order.PaymentID == "" {
+			err = s.orderStore.SetOrderPaymentID(orderID, intent.ID)
+			if err != nil && !errors.Is(err, ErrVersionConflict) {
+				s.writeError(w, r, apierr.Database(err))
+				return
+			}
+		}
+		_, err = s.changeOrderStatus(r, order, OrderPaid)
+		if err != nil {
+			s.writeError(w, r, err) // a conflict if it changed since; Stripe retries
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyStripeSignature reports whether header is a valid Stripe-Signature
+// header for body: "t=<unix time>,v1=<signature>", with one or more v1
+// signatures (Stripe sends several while a secret is being rolled), no
+// older than stripeTolerance. The scheme is the same one our own
+// webhooks use (see signWebhook).
+func verifyStripeSignature(secret, header string, body []byte, now time.Time) bool {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		equals := strings.IndexByte(part, '=')
+		if equals < 0 {
+			continue
+		}
+		switch key, value := strings.TrimSpace(part[:equals]), part[equals+1:]; key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	signedAt := time.Unix(unix, 0)
+	if now.Sub(signedAt) > stripeTolerance || signedAt.Sub(now) > stripeTolerance {
+		return false
+	}
+	want := strings.TrimPrefix(signWebhook([]string{secret}, signedAt, body), "t="+timestamp+",v1=")
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(want)) {
+			return true
+		}
+	}
+	return false
+}
+
+// FakePaymentProvider is a PaymentProvider that keeps payments in memory,
+// for development and tests. It accepts every payment unless Decline
+// says otherwise.
+type FakePaymentProvider struct {
+	// Decline, if set, is called to decide whether to refuse a payment.
+	// This must be set before use.
+	Decline func(orderID string, amount int) bool
+
+	lock     sync.Mutex
+	payments map[string]*FakePayment
+	nextID   int
+}
+
+// FakePayment is a payment taken by a FakePaymentProvider.
+type FakePayment struct {
+	ID       string
+	OrderID  string
+	Amount   int
+	Status   string // "authorized", "captured", or "refunded"
+	Refunded int
+}
+
+// NewFakePaymentProvider creates a new fake payment provider.
+func NewFakePaymentProvider() *FakePaymentProvider {
+	return &FakePaymentProvider{payments: make(map[string]*FakePayment), nextID: 1}
+}
+
+func (p *FakePaymentProvider) Authorize(orderID string, amount int) (string, error) {
+	if p.Decline != nil && p.Decline(orderID, amount) {
+		return "", ErrPaymentDeclined
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	id := "fake_" + strconv.Itoa(p.nextID)
+	p.nextID++
+	p.payments[id] = &FakePayment{ID: id, OrderID: orderID, Amount: amount, Status: "authorized"}
+	return id, nil
+}
+
+func (p *FakePaymentProvider) Capture(paymentID string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	payment, ok := p.payments[paymentID]
+	if !ok {
+		return ErrDoesNotExist
+	}
+	if payment.Status == "authorized" {
+		payment.Status = "captured"
+	}
+	return nil
+}
+
+func (p *FakePaymentProvider) Refund(paymentID string, amount int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	payment, ok := p.payments[paymentID]
+	if !ok {
+		return ErrDoesNotExist
+	}
+	if payment.Status == "authorized" || payment.Refunded+amount > payment.Amount {
+		return fmt.Errorf("can't refund %d of %s payment of %d (%d already refunded)", amount, payment.Status, payment.Amount, payment.Refunded)
+	}
+	payment.Refunded += amount
+	payment.Status = "refunded"
+	return nil
+}
+
+// Payment returns the payment with the given ID.
+func (p *FakePaymentProvider) Payment(paymentID string) (FakePayment, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	payment, ok := p.payments[paymentID]
+	if !ok {
+		return FakePayment{}, false
+	}
+	return *payment, true
+}
@@ -0,0 +1,275 @@
+// Tests for payments for orders
+
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testStripeSecret = "whsec_test"
+
+func newPaymentTestServer(provider PaymentProvider) *Server {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	return NewServer(db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return now }),
+		WithIDGenerator(&SequentialIDGenerator{}),
+		WithAuditStore(NewMemoryAuditStore()),
+		WithOrderStore(NewMemoryOrderStore()),
+		WithPaymentProvider(provider),
+		WithStripeWebhookSecret(testStripeSecret),
+	)
+}
+
+func createTestOrder(t *testing.T, server *Server, quantity string) {
+	t.Helper()
+	result := serve(t, server, newAdminRequest(t, "POST", "/orders", strings.NewReader(`{"customer_id": "c1", "items": [{"album_id": "a1", "quantity": `+quantity+`}]}`)))
+	ensureStatus(t, result, http.StatusCreated)
+}
+
+func TestPayOrder(t *testing.T) {
+	provider := NewFakePaymentProvider()
+	provider.Decline = func(orderID string, amount int) bool { return amount > 10000 }
+	server := newPaymentTestServer(provider)
+	createTestOrder(t, server, "2")
+
+	// Only admins and the customer's own user can pay for an order
+	result := serve(t, server, newRequest(t, "POST", "/orders/id1/pay", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	if _, ok := provider.Payment("fake_1"); ok {
+		t.Fatalf("order was paid anonymously")
+	}
+
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders/id1/pay", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var order Order
+	unmarshalResponse(t, result, &order)
+	if order.Status != OrderPaid || order.PaymentID != "fake_1" {
+		t.Fatalf("bad order: %+v", order)
+	}
+	payment, _ := provider.Payment("fake_1")
+	if payment != (FakePayment{ID: "fake_1", OrderID: "id1", Amount: 2 * 795, Status: "captured"}) {
+		t.Fatalf("bad payment: %+v", payment)
+	}
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders/id1/pay", nil))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"status": map[string]interface{}{"error": "invalid-transition", "message": "order is paid, and only pending orders can be paid"},
+	})
+
+	// Refunding the order refunds its payment
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders/id1/status", strings.NewReader(`{"status": "refunded"}`)))
+	ensureStatus(t, result, http.StatusOK)
+	payment, _ = provider.Payment("fake_1")
+	if payment.Status != "refunded" || payment.Refunded != 2*795 {
+		t.Fatalf("bad payment: %+v", payment)
+	}
+
+	// Declined payments leave the order pending
+	createTestOrder(t, server, "20")
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders/id2/pay", nil))
+	ensureError(t, result, http.StatusPaymentRequired, "payment-declined", nil)
+	result = serve(t, server, newAdminRequest(t, "GET", "/orders/id2", nil))
+	var declined Order
+	unmarshalResponse(t, result, &declined)
+	if declined.Status != OrderPending || declined.PaymentID != "" {
+		t.Fatalf("bad order: %+v", declined)
+	}
+
+	result = serve(t, server, newAdminRequest(t, "POST", "/orders/id9/pay", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+// blockingRefundProvider is a PaymentProvider whose refunds wait until
+// release is closed, and fail if fail is set.
+type blockingRefundProvider struct {
+	*FakePaymentProvider
+	refunds chan string
+	release chan struct{}
+	fail    bool
+}
+
+func (p blockingRefundProvider) Refund(paymentID string, amount int) error {
+	p.refunds <- paymentID
+	<-p.release
+	if p.fail {
+		return errors.New("card network unavailable")
+	}
+	return p.FakePaymentProvider.Refund(paymentID, amount)
+}
+
+func TestRefundOrderConcurrently(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		provider := blockingRefundProvider{NewFakePaymentProvider(), make(chan string, 2), make(chan struct{}), fail}
+		server := newPaymentTestServer(provider)
+		createTestOrder(t, server, "1")
+		ensureStatus(t, serve(t, server, newAdminRequest(t, "POST", "/orders/id1/pay", nil)), http.StatusOK)
+
+		// While the first refund is in progress, the order is "refunding",
+		// so a second one is a conflict and doesn't reach the provider
+		done := make(chan *http.Response)
+		go func() {
+			done <- serve(t, server, newAdminRequest(t, "POST", "/orders/id1/status", strings.NewReader(`{"status": "refunded"}`)))
+		}()
+		<-provider.refunds
+		result := serve(t, server, newAdminRequest(t, "POST", "/orders/id1/status", strings.NewReader(`{"status": "refunded"}`)))
+		ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+			"status": map[string]interface{}{"error": "invalid-transition", "message": "order is refunding and can't be changed"},
+		})
+		close(provider.release)
+		result = <-done
+		if len(provider.refunds) != 0 {
+			t.Fatalf("fail %v: refund made twice", fail)
+		}
+
+		// If the refund fails, the order goes back to paid
+		want := OrderRefunded
+		if fail {
+			ensureError(t, result, http.StatusServiceUnavailable, "unavailable", nil)
+			want = OrderPaid
+		} else {
+			ensureStatus(t, result, http.StatusOK)
+		}
+		result = serve(t, server, newAdminRequest(t, "GET", "/orders/id1", nil))
+		var order Order
+		unmarshalResponse(t, result, &order)
+		if order.Status != want {
+			t.Fatalf("fail %v: got status %q, want %q", fail, order.Status, want)
+		}
+	}
+}
+
+// pendingPaymentProvider is a PaymentProvider that confirms payments later,
+// like Stripe.
+type pendingPaymentProvider struct {
+	*FakePaymentProvider
+}
+
+func (p pendingPaymentProvider) Capture(paymentID string) error {
+	return ErrPaymentPending
+}
+
+func TestStripeWebhook(t *testing.T) {
+	server := newPaymentTestServer(pendingPaymentProvider{NewFakePaymentProvider()})
+	createTestOrder(t, server, "1")
+	result := serve(t, server, newAdminRequest(t, "POST", "/orders/id1/pay", nil))
+	ensureStatus(t, result, http.StatusAccepted)
+	var order Order
+	unmarshalResponse(t, result, &order)
+	if order.Status != OrderPending || order.PaymentID != "fake_1" {
+		t.Fatalf("bad order: %+v", order)
+	}
+
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	send := func(body, signature string) *http.Response {
+		request := newRequest(t, "POST", "/payments/stripe", strings.NewReader(body))
+		request.Header.Set("Stripe-Signature", signature)
+		return serve(t, server, request)
+	}
+	event := func(paymentID string, amount string) string {
+		return `{"id": "evt_1", "type": "payment_intent.succeeded", "data": {"object": {
+			"id": "` + paymentID + `", "amount_received": ` + amount + `, "metadata": {"order_id": "id1"}}}}`
+	}
+
+	// Events that don't match the order are ignored
+	for _, body := range []string{event("pi_other", "795"), event("fake_1", "100"), `{"id": "evt_2", "type": "charge.refunded"}`} {
+		result = send(body, signWebhook([]string{testStripeSecret}, now, []byte(body)))
+		ensureStatus(t, result, http.StatusNoContent)
+	}
+	result = serve(t, server, newAdminRequest(t, "GET", "/orders/id1", nil))
+	unmarshalResponse(t, result, &order)
+	if order.Status != OrderPending {
+		t.Fatalf("got status %q, want pending", order.Status)
+	}
+
+	body := event("fake_1", "795")
+	result = send(body, signWebhook([]string{testStripeSecret}, now, []byte(body)))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newAdminRequest(t, "GET", "/orders/id1", nil))
+	unmarshalResponse(t, result, &order)
+	if order.Status != OrderPaid {
+		t.Fatalf("got status %q, want paid", order.Status)
+	}
+	entries, _ := server.auditStore.GetAuditEntries(AuditFilter{})
+	if got := entries[len(entries)-1]; got.Actor != "stripe" || got.Resource != "order" {
+		t.Fatalf("bad audit entry: %+v", got)
+	}
+
+	// Repeat deliveries are acknowledged
+	result = send(body, signWebhook([]string{testStripeSecret}, now, []byte(body)))
+	ensureStatus(t, result, http.StatusNoContent)
+}
+
+func TestStripeWebhookSignature(t *testing.T) {
+	server := newPaymentTestServer(NewFakePaymentProvider())
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	body := `{"id": "evt_1", "type": "charge.refunded"}`
+	valid := signWebhook([]string{testStripeSecret}, now, []byte(body))
+
+	tests := []struct {
+		name      string
+		signature string
+		status    int
+	}{
+		{"valid", valid, http.StatusNoContent},
+		{"rolled-secret", valid + ",v1=" + strings.Repeat("0", 64), http.StatusNoContent},
+		{"missing", "", http.StatusBadRequest},
+		{"wrong-secret", signWebhook([]string{"whsec_other"}, now, []byte(body)), http.StatusBadRequest},
+		{"other-body", signWebhook([]string{testStripeSecret}, now, []byte(`{}`)), http.StatusBadRequest},
+		{"too-old", signWebhook([]string{testStripeSecret}, now.Add(-10*time.Minute), []byte(body)), http.StatusBadRequest},
+		{"no-timestamp", strings.SplitN(valid, ",", 2)[1], http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := newRequest(t, "POST", "/payments/stripe", strings.NewReader(body))
+			request.Header.Set("Stripe-Signature", test.signature)
+			result := serve(t, server, request)
+			if test.status == http.StatusBadRequest {
+				ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+					"Stripe-Signature": map[string]interface{}{"error": "invalid", "message": "Stripe-Signature must be a valid, recent signature of the body"},
+				})
+				return
+			}
+			ensureStatus(t, result, test.status)
+		})
+	}
+}
+
+func TestPaymentsUnavailable(t *testing.T) {
+	server := newOrderTestServer()
+	createTestOrder(t, server, "1")
+	result := serve(t, server, newAdminRequest(t, "POST", "/orders/id1/pay", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newRequest(t, "POST", "/payments/stripe", strings.NewReader(`{}`)))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestFakePaymentProvider(t *testing.T) {
+	provider := NewFakePaymentProvider()
+	id, err := provider.Authorize("o1", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.Refund(id, 1000); err == nil {
+		t.Fatal("expected error refunding an uncaptured payment")
+	}
+	if err := provider.Capture(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.Refund(id, 600); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.Refund(id, 600); err == nil {
+		t.Fatal("expected error refunding more than the payment")
+	}
+	if err := provider.Capture("fake_9"); err != ErrDoesNotExist {
+		t.Fatalf("got %v, want ErrDoesNotExist", err)
+	}
+}
@@ -0,0 +1,102 @@
+// Parsing of album price input
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PriceMode controls which forms of price input are accepted.
+type PriceMode int
+
+const (
+	// PriceStrict only accepts prices as a JSON integer number of cents,
+	// like 1999.
+	PriceStrict PriceMode = iota
+
+	// PriceTolerant also accepts prices as a string of cents, like "1999",
+	// or as a decimal number of dollars with at most two decimal places,
+	// either as a number or a string, like 19.99 or "19.99". A decimal
+	// point always means dollars, so 20.0 is 2000 cents. Exponents (like
+	// 2e3) and more than two decimal places are rejected as ambiguous.
+	PriceTolerant
+)
+
+// WithPriceMode sets how strictly album prices are parsed. The default is
+// PriceStrict.
+func WithPriceMode(mode PriceMode) Option {
+	return func(s *Server) {
+		s.priceMode = mode
+	}
+}
+
+var (
+	reCents   = regexp.MustCompile(`^-?[0-9]+$`)
+	reDollars = regexp.MustCompile(`^(-?)([0-9]+)\.([0-9]{1,2})$`)
+	reFloat   = regexp.MustCompile(`^-?[0-9]+\.[0-9]+$`)
+)
+
+// parsePrice parses raw JSON price input according to mode and returns the
+// price in cents. A missing or null price is zero. If the price isn't
+// valid, it returns a validation issue describing why.
+func parsePrice(raw json.RawMessage, mode PriceMode) (int, *validationIssue) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, nil
+	}
+
+	var text string
+	switch {
+	case raw[0] == '"':
+		if mode == PriceStrict {
+			return 0, &validationIssue{"invalid-type", "price must be an integer number of cents, not a string"}
+		}
+		err := json.Unmarshal(raw, &text)
+		if err != nil {
+			return 0, &validationIssue{"invalid", "price must be a number of cents or dollars"}
+		}
+	case raw[0] == '-' || raw[0] >= '0' && raw[0] <= '9':
+		text = string(raw)
+	default:
+		return 0, &validationIssue{"invalid-type", "price must be a number"}
+	}
+
+	if reCents.MatchString(text) {
+		cents, err := strconv.Atoi(text)
+		if err != nil {
+			return 0, &validationIssue{"out-of-range", "price must be between 0 and $1000"}
+		}
+		return cents, nil
+	}
+	if mode == PriceStrict {
+		return 0, &validationIssue{"invalid", "price must be an integer number of cents"}
+	}
+	if strings.ContainsAny(text, "eE") {
+		return 0, &validationIssue{"ambiguous", "price must not use exponent notation"}
+	}
+	matches := reDollars.FindStringSubmatch(text)
+	if matches == nil {
+		if reFloat.MatchString(text) {
+			return 0, &validationIssue{"ambiguous", "price in dollars must have at most two decimal places"}
+		}
+		return 0, &validationIssue{"invalid", "price must be a number of cents or dollars"}
+	}
+	dollars, err := strconv.Atoi(matches[2])
+	if err != nil || dollars > 1000000 {
+		return 0, &validationIssue{"out-of-range", "price must be between 0 and $1000"}
+	}
+	fraction := matches[3]
+	if len(fraction) == 1 {
+		fraction += "0"
+	}
+	cents, _ := strconv.Atoi(fraction)
+	cents += dollars * 100
+	if matches[1] == "-" {
+		cents = -cents
+	}
+	return cents, nil
+}
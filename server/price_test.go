@@ -0,0 +1,87 @@
+// Tests for parsing of album price input
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		input    string
+		strict   int    // expected cents in strict mode
+		strictEr string // expected issue error in strict mode
+		tolerant int
+		tolerEr  string
+	}{
+		{``, 0, "", 0, ""},
+		{`null`, 0, "", 0, ""},
+		{`1999`, 1999, "", 1999, ""},
+		{`-5`, -5, "", -5, ""},
+		{`"1999"`, 0, "invalid-type", 1999, ""},
+		{`19.99`, 0, "invalid", 1999, ""},
+		{`"19.99"`, 0, "invalid-type", 1999, ""},
+		{`20.0`, 0, "invalid", 2000, ""},
+		{`19.9`, 0, "invalid", 1990, ""},
+		{`-1.5`, 0, "invalid", -150, ""},
+		{`19.999`, 0, "invalid", 0, "ambiguous"},
+		{`2e3`, 0, "invalid", 0, "ambiguous"},
+		{`"abc"`, 0, "invalid-type", 0, "invalid"},
+		{`"19."`, 0, "invalid-type", 0, "invalid"},
+		{`"1,999"`, 0, "invalid-type", 0, "invalid"},
+		{`true`, 0, "invalid-type", 0, "invalid-type"},
+		{`{}`, 0, "invalid-type", 0, "invalid-type"},
+		{`99999999999999999999`, 0, "out-of-range", 0, "out-of-range"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			check := func(mode string, got int, issue *validationIssue, want int, wantErr string) {
+				t.Helper()
+				gotErr := ""
+				if issue != nil {
+					gotErr = issue.Error
+				}
+				if got != want || gotErr != wantErr {
+					t.Fatalf("%s: got %d %q, want %d %q", mode, got, gotErr, want, wantErr)
+				}
+			}
+			got, issue := parsePrice(json.RawMessage(test.input), PriceStrict)
+			check("strict", got, issue, test.strict, test.strictEr)
+			got, issue = parsePrice(json.RawMessage(test.input), PriceTolerant)
+			check("tolerant", got, issue, test.tolerant, test.tolerEr)
+		})
+	}
+}
+
+func TestAddAlbumPriceModes(t *testing.T) {
+	body := `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel", "price": "12.34"}`
+
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusBadRequest)
+	data := map[string]interface{}{
+		"price": map[string]interface{}{"error": "invalid-type", "message": "price must be an integer number of cents, not a string"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+
+	db := NewMemoryDatabase()
+	server = NewServer(db, log.New(io.Discard, "", 0), WithPriceMode(PriceTolerant))
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	want := testAlbum{ID: "a9", Title: "Pianoman", Artist: "Billy Joel", Price: 1234}
+	testGetAlbum(t, server, getAlbumTest{"/albums/a9", http.StatusOK, want})
+
+	// Range is still checked after conversion
+	body = `{"id": "a8", "title": "Pianoman", "artist": "Billy Joel", "price": 1000.00}`
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusBadRequest)
+	data = map[string]interface{}{
+		"price": map[string]interface{}{"error": "out-of-range", "message": "price must be between 0 and $1000"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+}
@@ -0,0 +1,112 @@
+// RFC 7807 problem details error responses
+
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+const problemContentType = "application/problem+json"
+
+// WithProblemDetails sets whether error responses are always written as
+// RFC 7807 problem details (application/problem+json) rather than the
+// server's own error envelope. Clients can also ask for problem details
+// per request with their Accept header. The default is false.
+func WithProblemDetails(enabled bool) Option {
+	return func(s *Server) {
+		s.problemDetails = enabled
+	}
+}
+
+// wantsProblem reports whether the request's Accept header prefers
+// problem details to plain JSON.
+func wantsProblem(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return acceptQuality(accept, problemContentType) > acceptQuality(accept, "application/json")
+}
+
+// problem is an RFC 7807 problem details object. Code and Data are
+// extension members with the same values as "error" and "data" in the
+// regular error envelope, so clients can switch formats without losing
+// information.
+type problem struct {
+	Type     string                 `json:"type"`
+	Title    string                 `json:"title"`
+	Status   int                    `json:"status"`
+	Detail   string                 `json:"detail,omitempty"`
+	Instance string                 `json:"instance"`
+	Code     string                 `json:"code"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+	Retry    *apierr.Retry          `json:"retry,omitempty"`
+}
+
+// problemError writes the error as problem details. Each error code has
+// its own problem type URI, /problems/:code on this server, which
+// documents it.
+func (s *Server) problemError(w http.ResponseWriter, r *http.Request, apiErr *apierr.Error) {
+	title := s.errorTitle(r, apiErr)
+	p := problem{
+		Type:     s.problemType(r, apiErr.Code),
+		Title:    title,
+		Status:   apiErr.Status,
+		Instance: r.URL.RequestURI(),
+		Code:     apiErr.Code,
+		Data:     apiErr.Data,
+		Retry:    apiErr.Retry,
+	}
+	if message, ok := apiErr.Data["message"].(string); ok {
+		// Errors like malformed-json have a message for humans
+		p.Detail = message
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err := s.encodeJSON(buf, r, p, "")
+	if err != nil {
+		s.log.Printf("error marshaling JSON: %v", err)
+		http.Error(w, `{"error":"`+apierr.CodeInternal+`"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(apiErr.Status)
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		s.log.Printf("error writing JSON: %v", err)
+	}
+}
+
+// problemType returns the problem type URI for the error code.
+func (s *Server) problemType(r *http.Request, code string) string {
+	return s.absoluteURL(r, "/problems/"+url.PathEscape(code))
+}
+
+var problemTemplate = template.Must(template.New("problem").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Error responses with this problem type have the error code <code>{{.Code}}</code>.</p>
+</body>
+</html>
+`))
+
+// getProblem serves the documentation for a problem type.
+func (s *Server) getProblem(w http.ResponseWriter, r *http.Request, code string) {
+	title, ok := apierr.Title(code)
+	if !ok {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := problemTemplate.Execute(w, struct{ Title, Code string }{title, code})
+	if err != nil {
+		s.log.Printf("error writing response: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+// Tests for RFC 7807 problem details errors
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readProblem reads a problem details response.
+func readProblem(t *testing.T, response *http.Response) map[string]interface{} {
+	t.Helper()
+	if got := response.Header.Get("Content-Type"); got != problemContentType {
+		t.Fatalf("bad Content-Type: got %q, want %q", got, problemContentType)
+	}
+	var p map[string]interface{}
+	err := json.NewDecoder(response.Body).Decode(&p)
+	if err != nil {
+		t.Fatalf("error unmarshaling problem: %v", err)
+	}
+	return p
+}
+
+func TestProblemDetailsAccept(t *testing.T) {
+	server := newTestServer()
+	request := newRequest(t, "GET", "/albums/a3?include_deleted=false", nil)
+	request.Host = "api.example.com"
+	request.Header.Set("Accept", "application/problem+json, application/json;q=0.9")
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusNotFound)
+	got := readProblem(t, result)
+	want := map[string]interface{}{
+		"type":     "http://api.example.com/problems/not-found",
+		"title":    "Not found",
+		"status":   404.0,
+		"instance": "/albums/a3?include_deleted=false",
+		"code":     "not-found",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got vs want:\n%#v\n%#v", got, want)
+	}
+
+	// Clients that don't ask get the regular envelope
+	result = serve(t, server, newRequest(t, "GET", "/albums/a3", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestProblemDetailsOption(t *testing.T) {
+	db := NewMemoryDatabase()
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithProblemDetails(true),
+		WithBaseURL(mustParseBaseURL(t, "https://example.com/api")),
+	)
+
+	body := `{"id": "a1", "artist": "Beethoven"}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusBadRequest)
+	got := readProblem(t, result)
+	want := map[string]interface{}{
+		"type":     "https://example.com/api/problems/validation",
+		"title":    "Validation failed",
+		"status":   400.0,
+		"instance": "/albums",
+		"code":     "validation",
+		"data": map[string]interface{}{
+			"title": map[string]interface{}{"error": "required"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got vs want:\n%#v\n%#v", got, want)
+	}
+
+	// Messages for humans are the detail
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader("{")))
+	ensureStatus(t, result, http.StatusBadRequest)
+	got = readProblem(t, result)
+	if got["code"] != "malformed-json" || got["detail"] != "unexpected end of JSON input" {
+		t.Fatalf("bad malformed JSON problem: %#v", got)
+	}
+}
+
+func TestGetProblem(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/problems/not-found", nil))
+	ensureStatus(t, result, http.StatusOK)
+	b, err := io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	if !strings.Contains(string(b), "<h1>Not found</h1>") || !strings.Contains(string(b), "<code>not-found</code>") {
+		t.Fatalf("bad problem page:\n%s", b)
+	}
+
+	result = serve(t, server, newRequest(t, "GET", "/problems/no-such-code", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
@@ -0,0 +1,160 @@
+// Protocol Buffers encoding of album responses
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+const protobufContentType = "application/x-protobuf"
+
+// protobufEncoder encodes albums as Protocol Buffers, using the schema
+// below. A single album is an Album message and a list is an AlbumList.
+// Timestamps use the same wire format as google.protobuf.Timestamp.
+//
+//	syntax = "proto3";
+//
+//	message Album {
+//	  string id = 1;
+//	  string title = 2;
+//	  string artist = 3;
+//	  int64 price = 4; // in cents
+//	  Timestamp publish_at = 5;
+//	  repeated Track tracks = 6;
+//	  repeated string genres = 7;
+//	  int64 version = 8;
+//	  Timestamp created_at = 9;
+//	  Timestamp updated_at = 10;
+//	  string catalog_number = 11;
+//	  Timestamp deleted_at = 12;
+//	  int64 stock = 13;
+//	  string upc = 14;
+//	  string musicbrainz_id = 15;
+//	  int64 favorites = 16;
+//	}
+//
+//	message Track {
+//	  int64 number = 1;
+//	  string title = 2;
+//	  int64 duration = 3; // in seconds
+//	  string isrc = 4;
+//	  string musicbrainz_id = 5;
+//	}
+//
+//	message AlbumList {
+//	  repeated Album albums = 1;
+//	}
+//
+//	message Timestamp {
+//	  int64 seconds = 1;
+//	  int32 nanos = 2;
+//	}
+//
+// Add new Album fields with new field numbers, and never reuse the number
+// of a removed field, so older clients can still decode responses.
+type protobufEncoder struct{}
+
+func (protobufEncoder) EncodeAlbum(buf *bytes.Buffer, album Album) error {
+	buf.Write(protobufAlbum(album))
+	return nil
+}
+
+func (protobufEncoder) EncodeAlbums(buf *bytes.Buffer, albums []Album) error {
+	var w protobufWriter
+	for _, album := range albums {
+		w.message(1, protobufAlbum(album))
+	}
+	buf.Write(w.buf)
+	return nil
+}
+
+func protobufAlbum(album Album) []byte {
+	var w protobufWriter
+	w.string(1, album.ID)
+	w.string(2, album.Title)
+	w.string(3, album.Artist)
+	w.int(4, int64(album.Price))
+	w.timestamp(5, album.PublishAt)
+	for _, track := range album.Tracks {
+		var t protobufWriter
+		t.int(1, int64(track.Number))
+		t.string(2, track.Title)
+		t.int(3, int64(track.Duration))
+		t.string(4, track.ISRC)
+		t.string(5, track.MusicBrainzID)
+		w.message(6, t.buf)
+	}
+	for _, genre := range album.Genres {
+		w.repeatedString(7, genre)
+	}
+	w.int(8, int64(album.Version))
+	w.timestamp(9, &album.CreatedAt)
+	w.timestamp(10, &album.UpdatedAt)
+	w.string(11, album.CatalogNumber)
+	w.timestamp(12, album.DeletedAt)
+	w.int(13, int64(album.Stock))
+	w.string(14, album.UPC)
+	w.string(15, album.MusicBrainzID)
+	w.int(16, int64(album.Favorites))
+	return w.buf
+}
+
+// protobufWriter builds a protobuf message. As in proto3, fields with zero
+// values are omitted (except elements of repeated fields).
+type protobufWriter struct {
+	buf []byte
+}
+
+// Wire types
+const (
+	protobufVarint = 0
+	protobufBytes  = 2
+)
+
+func (w *protobufWriter) tag(field, wireType int) {
+	w.varint(uint64(field<<3 | wireType))
+}
+
+func (w *protobufWriter) varint(n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutUvarint(b[:], n)]...)
+}
+
+func (w *protobufWriter) int(field int, n int64) {
+	if n == 0 {
+		return
+	}
+	w.tag(field, protobufVarint)
+	w.varint(uint64(n)) // negative int64s are encoded as 10-byte varints
+}
+
+func (w *protobufWriter) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	w.repeatedString(field, s)
+}
+
+func (w *protobufWriter) repeatedString(field int, s string) {
+	w.tag(field, protobufBytes)
+	w.varint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *protobufWriter) message(field int, b []byte) {
+	w.tag(field, protobufBytes)
+	w.varint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *protobufWriter) timestamp(field int, t *time.Time) {
+	if t == nil || t.IsZero() {
+		return
+	}
+	var ts protobufWriter
+	ts.int(1, t.Unix())
+	ts.int(2, int64(t.Nanosecond()))
+	w.message(field, ts.buf)
+}
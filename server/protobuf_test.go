@@ -0,0 +1,156 @@
+// Tests for Protocol Buffers encoding
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// protobufField is a decoded field: either a varint or a length-delimited
+// value.
+type protobufField struct {
+	number int
+	varint uint64
+	bytes  []byte
+}
+
+// decodeProtobuf decodes the top-level fields of a protobuf message.
+func decodeProtobuf(t *testing.T, b []byte) []protobufField {
+	t.Helper()
+	var fields []protobufField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad tag varint")
+		}
+		b = b[n:]
+		field := protobufField{number: int(tag >> 3)}
+		switch tag & 7 {
+		case protobufVarint:
+			field.varint, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("bad field varint")
+			}
+			b = b[n:]
+		case protobufBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				t.Fatalf("bad length")
+			}
+			field.bytes = b[n : n+int(length)]
+			b = b[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// protobufFieldMap summarizes fields as number -> list of values (ints or
+// strings) for easier comparison.
+func protobufFieldMap(t *testing.T, b []byte) map[int][]interface{} {
+	t.Helper()
+	m := make(map[int][]interface{})
+	for _, field := range decodeProtobuf(t, b) {
+		if field.bytes != nil {
+			m[field.number] = append(m[field.number], string(field.bytes))
+		} else {
+			m[field.number] = append(m[field.number], int64(field.varint))
+		}
+	}
+	return m
+}
+
+func protobufTimestampBytes(t *testing.T, ts time.Time) string {
+	var w protobufWriter
+	w.timestamp(1, &ts)
+	fields := decodeProtobuf(t, w.buf)
+	return string(fields[0].bytes)
+}
+
+func TestProtobufAlbum(t *testing.T) {
+	created := time.Date(2021, 6, 1, 12, 0, 0, 500, time.UTC)
+	album := Album{
+		ID:        "a1",
+		Title:     "9th Symphony",
+		Artist:    "Beethoven",
+		Price:     795,
+		Tracks:    []Track{{Number: 1, Title: "Ode to Joy", Duration: 338}},
+		Genres:    []string{"classical", "romantic"},
+		Version:   2,
+		CreatedAt: created,
+		UpdatedAt: created,
+	}
+	got := protobufFieldMap(t, protobufAlbum(album))
+	var track protobufWriter
+	track.int(1, 1)
+	track.string(2, "Ode to Joy")
+	track.int(3, 338)
+	timestamp := protobufTimestampBytes(t, created)
+	want := map[int][]interface{}{
+		1:  {"a1"},
+		2:  {"9th Symphony"},
+		3:  {"Beethoven"},
+		4:  {int64(795)},
+		6:  {string(track.buf)},
+		7:  {"classical", "romantic"},
+		8:  {int64(2)},
+		9:  {timestamp},
+		10: {timestamp},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got vs want:\n%v\n%v", got, want)
+	}
+
+	// The timestamp is seconds and nanos
+	ts := protobufFieldMap(t, []byte(timestamp))
+	if !reflect.DeepEqual(ts, map[int][]interface{}{1: {created.Unix()}, 2: {int64(500)}}) {
+		t.Fatalf("bad timestamp: %v", ts)
+	}
+}
+
+func TestGetAlbumsProtobuf(t *testing.T) {
+	server := newTestServer()
+	request := newRequest(t, "GET", "/albums", nil)
+	request.Header.Set("Accept", protobufContentType)
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Content-Type"); got != protobufContentType {
+		t.Fatalf("bad Content-Type: got %q", got)
+	}
+	b, err := io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	var ids []string
+	for _, field := range decodeProtobuf(t, b) {
+		if field.number != 1 {
+			t.Fatalf("unexpected AlbumList field %d", field.number)
+		}
+		album := protobufFieldMap(t, field.bytes)
+		ids = append(ids, fmt.Sprint(album[1][0]))
+	}
+	if !reflect.DeepEqual(ids, []string{"a1", "a2"}) {
+		t.Fatalf("got album IDs %q, want a1, a2", ids)
+	}
+
+	request = newRequest(t, "GET", "/albums/a2", nil)
+	request.Header.Set("Accept", protobufContentType)
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	b, err = io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	album := protobufFieldMap(t, b)
+	if album[2][0] != "Hey Jude" || album[4][0] != int64(2000) {
+		t.Fatalf("bad album: %v", album)
+	}
+}
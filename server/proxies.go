@@ -0,0 +1,189 @@
+// Client IP addresses from trusted proxies' forwarding headers
+//
+// Behind a load balancer or reverse proxy, a request's RemoteAddr is the
+// proxy's address, not the client's, so the audit log, request log,
+// duplicate detection, and legacy client tracking would all see one client.
+// Proxies record the address they received each request from in a header,
+// either X-Forwarded-For (a comma-separated list of addresses) or the
+// standard Forwarded (RFC 7239, like "for=192.0.2.1, for=198.51.100.7").
+// Each proxy appends to the list, so the rightmost entries were added by
+// the proxies nearest the server, and the leftmost by the client itself.
+//
+// But any client can send these headers, so they can only be believed as
+// far as they were written by proxies the server trusts. With
+// WithTrustedProxies, the client IP is found by walking the list from the
+// right, starting with RemoteAddr: the first address that isn't a trusted
+// proxy is the client. Entries to the left of it may be forged, so they're
+// ignored. Requests straight from untrusted addresses use RemoteAddr, and
+// their forwarding headers are ignored entirely.
+//
+// Only one header is read (X-Forwarded-For by default), and the trusted
+// proxies must overwrite or append to it. If they set one header but pass
+// through the other unchanged, reading the other would let clients forge
+// their address.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// WithTrustedProxies sets the proxies whose forwarding headers give the
+// real client IP, and the header they use: "X-Forwarded-For" or
+// "Forwarded". The default of no proxies uses each request's RemoteAddr.
+func WithTrustedProxies(header string, proxies []*net.IPNet) Option {
+	return func(s *Server) {
+		s.proxyHeader = http.CanonicalHeaderKey(header)
+		s.trustedProxies = proxies
+	}
+}
+
+// parseTrustedProxies parses a comma-separated list of proxy addresses or
+// CIDR ranges, like "10.0.0.0/8, 192.0.2.1".
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", field)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// checkProxyHeader returns an error if header isn't a forwarding header
+// that WithTrustedProxies can read.
+func checkProxyHeader(header string) error {
+	switch http.CanonicalHeaderKey(header) {
+	case "X-Forwarded-For", "Forwarded":
+		return nil
+	default:
+		return fmt.Errorf("unknown header %q (must be X-Forwarded-For or Forwarded)", header)
+	}
+}
+
+type clientIPKey struct{}
+
+// clientIPHandler finds each request's client IP from the trusted proxies'
+// forwarding header, for clientIP to return.
+func (s *Server) clientIPHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := s.forwardedClientIP(r)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// clientIP returns the IP address of the client that made the request:
+// the one found by clientIPHandler if there are trusted proxies, otherwise
+// the address the request came from.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns the IP address the request came from.
+func remoteIP(r *http.Request) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return client
+}
+
+// forwardedClientIP returns the rightmost address in the request's
+// forwarding header (after RemoteAddr) that isn't a trusted proxy. If an
+// entry isn't an IP address (like Forwarded's "unknown" or an obfuscated
+// "_hidden"), the client can't be known, so it returns the proxy that
+// added it. If every address is a trusted proxy, it returns the leftmost.
+func (s *Server) forwardedClientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !s.isTrustedProxy(net.ParseIP(ip)) {
+		return ip
+	}
+	var forwarded []string
+	for _, value := range r.Header.Values(s.proxyHeader) {
+		if s.proxyHeader == "Forwarded" {
+			forwarded = append(forwarded, parseForwardedFor(value)...)
+		} else {
+			for _, addr := range strings.Split(value, ",") {
+				forwarded = append(forwarded, strings.TrimSpace(addr))
+			}
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		next := parseForwardedIP(forwarded[i])
+		if next == nil {
+			return ip
+		}
+		ip = next.String()
+		if !s.isTrustedProxy(next) {
+			return ip
+		}
+	}
+	return ip
+}
+
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedFor returns the "for" parameter of each element of a
+// Forwarded header value, with quotes removed. An element without one
+// gives "", as the address that proxy received the request from is
+// unknown.
+func parseForwardedFor(value string) []string {
+	var addrs []string
+	for _, element := range strings.Split(value, ",") {
+		addr := ""
+		for _, pair := range strings.Split(element, ";") {
+			eq := strings.Index(pair, "=")
+			if eq < 0 || !strings.EqualFold(strings.TrimSpace(pair[:eq]), "for") {
+				continue
+			}
+			addr = strings.Trim(strings.TrimSpace(pair[eq+1:]), `"`)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// parseForwardedIP parses an address from a forwarding header, which may
+// have a port, as in "192.0.2.1:4711" or "[2001:db8::1]:4711". It returns
+// nil if it isn't an IP address.
+func parseForwardedIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
@@ -0,0 +1,108 @@
+// Tests for client IPs from trusted proxies
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		values     []string
+		want       string
+	}{
+		{"no header", "X-Forwarded-For", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"untrusted peer", "X-Forwarded-For", "198.51.100.1:1234", []string{"203.0.113.9"}, "198.51.100.1"},
+		{"one proxy", "X-Forwarded-For", "10.0.0.1:1234", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"forged entries ignored", "X-Forwarded-For", "10.0.0.1:1234", []string{"1.1.1.1, 203.0.113.9, 10.1.2.3"}, "203.0.113.9"},
+		{"multiple headers", "X-Forwarded-For", "192.0.2.1:1234", []string{"1.1.1.1, 203.0.113.9", "10.1.2.3"}, "203.0.113.9"},
+		{"all trusted", "X-Forwarded-For", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"invalid entry", "X-Forwarded-For", "10.0.0.1:1234", []string{"203.0.113.9, garbage"}, "10.0.0.1"},
+		{"IPv6", "X-Forwarded-For", "[2001:db8::1]:1234", []string{"2001:db9::7"}, "2001:db9::7"},
+		{"forwarded", "Forwarded", "10.0.0.1:1234", []string{`for=203.0.113.9;proto=https, For="10.1.2.3:4711"`}, "203.0.113.9"},
+		{"forwarded IPv6", "Forwarded", "10.0.0.1:1234", []string{`for="[2001:db9::7]:4711";by=10.0.0.1`}, "2001:db9::7"},
+		{"forwarded unknown", "Forwarded", "10.0.0.1:1234", []string{`for=unknown, for=10.1.2.3`}, "10.1.2.3"},
+		{"forwarded hidden", "Forwarded", "10.0.0.1:1234", []string{`for=_hidden`}, "10.0.0.1"},
+		{"forwarded without for", "Forwarded", "10.0.0.1:1234", []string{`proto=https`}, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithTrustedProxies(test.header, proxies))
+			request := newRequest(t, "GET", "/albums", nil)
+			request.RemoteAddr = test.remoteAddr
+			for _, value := range test.values {
+				request.Header.Add(test.header, value)
+			}
+			// The header that isn't configured is never read
+			if test.header == "X-Forwarded-For" {
+				request.Header.Set("Forwarded", "for=1.1.1.1")
+			} else {
+				request.Header.Set("X-Forwarded-For", "1.1.1.1")
+			}
+			if got := server.forwardedClientIP(request); got != test.want {
+				t.Fatalf("got client IP %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	// Without trusted proxies, the header is ignored
+	request := newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a3", "title": "Pianoman", "artist": "Billy Joel"}`))
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if got := clientIP(request); got != "10.0.0.1" {
+		t.Fatalf("got client IP %q without trusted proxies", got)
+	}
+
+	// With them, handlers (like the audit log) see the client's address
+	proxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditStore := NewMemoryAuditStore()
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithTrustedProxies("x-forwarded-for", proxies), WithAuditStore(auditStore))
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusCreated)
+	entries, err := auditStore.GetAuditEntries(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ClientIP != "203.0.113.9" {
+		t.Fatalf("bad audit entries: %+v", entries)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("")
+	if err != nil || proxies != nil {
+		t.Fatalf("got %v, %v for no proxies", proxies, err)
+	}
+	for _, s := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0.1:80"} {
+		_, err := parseTrustedProxies(s)
+		if err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+	for _, header := range []string{"X-Forwarded-For", "forwarded"} {
+		if err := checkProxyHeader(header); err != nil {
+			t.Fatalf("unexpected error for %q: %v", header, err)
+		}
+	}
+	if err := checkProxyHeader("X-Real-IP"); err == nil {
+		t.Fatal("expected error for X-Real-IP")
+	}
+}
@@ -0,0 +1,549 @@
+// Album deep-link QR codes as PNG images
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Limits on the QR code image's scale (pixels per module).
+const (
+	defaultQRScale = 8
+	maxQRScale     = 20
+)
+
+func (s *Server) getQRCode(w http.ResponseWriter, r *http.Request, albumID string) {
+	issues := make(map[string]interface{})
+	scale := intParam(r.URL.Query().Get("scale"), defaultQRScale, 1, maxQRScale, "scale", issues)
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+
+	album, err := s.db.GetAlbumByID(albumID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	if !album.visible(s.now()) {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+
+	// As with barcodes, the image only depends on the URL and scale
+	link := s.publicAlbumURL(r, album.ID)
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d", link, scale)))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	code, err := encodeQR([]byte(link))
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("encoding QR code for %q: %w", link, err)))
+		return
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, code.image(scale))
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("encoding QR code PNG: %w", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		s.log.Printf("error writing QR code: %v", err)
+	}
+}
+
+// qrCode is a QR code symbol: a square grid of modules, true for dark.
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // modules that are part of a function pattern
+}
+
+// Number of blank modules required around a QR code.
+const qrQuietZone = 4
+
+// image renders the QR code with each module scale pixels square,
+// including the quiet zone.
+func (q *qrCode) image(scale int) *image.Paletted {
+	n := (q.size + 2*qrQuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, n, n), color.Palette{color.White, color.Black})
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetColorIndex((x+qrQuietZone)*scale+px, (y+qrQuietZone)*scale+py, 1)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// qrVersion describes the error correction blocks of a QR code version at
+// error correction level M: each block has ecLen error correction
+// codewords, and the given number of data codewords.
+type qrVersion struct {
+	ecLen  int
+	blocks []int // data codewords in each block
+}
+
+// QR code versions 1 to 10 at error correction level M, which can hold up
+// to 213 bytes; that's plenty for a URL.
+var qrVersions = []qrVersion{
+	1:  {10, []int{16}},
+	2:  {16, []int{28}},
+	3:  {26, []int{44}},
+	4:  {18, []int{32, 32}},
+	5:  {24, []int{43, 43}},
+	6:  {16, []int{27, 27, 27, 27}},
+	7:  {18, []int{31, 31, 31, 31}},
+	8:  {22, []int{38, 38, 39, 39}},
+	9:  {22, []int{36, 36, 36, 37, 37}},
+	10: {26, []int{43, 43, 43, 43, 44}},
+}
+
+// Centre coordinates of alignment patterns for each version.
+var qrAlignments = [][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+func (v qrVersion) dataLen() int {
+	n := 0
+	for _, blockLen := range v.blocks {
+		n += blockLen
+	}
+	return n
+}
+
+// encodeQR encodes data as a QR code in byte mode, using the smallest
+// version that fits at error correction level M.
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v < len(qrVersions); v++ {
+		if 4+qrCountBits(v)+8*len(data) <= 8*qrVersions[v].dataLen() {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%d bytes is too long for a QR code", len(data))
+	}
+	q := newQRCode(version)
+	q.drawCodewords(qrCodewords(data, version))
+
+	// Choose the mask with the lowest penalty, as the spec requires
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		penalty := q.penalty()
+		if bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask) // masks are XOR, so this undoes it
+	}
+	q.applyMask(bestMask)
+	q.drawFormat(bestMask)
+	return q, nil
+}
+
+// qrCountBits returns the number of bits in the byte mode character count.
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// qrCodewords returns the final sequence of codewords for data: the data
+// codewords split into blocks with error correction codewords added, all
+// interleaved.
+func qrCodewords(data []byte, version int) []byte {
+	v := qrVersions[version]
+
+	// Mode indicator (byte mode), character count, data, terminator, then
+	// padding to fill the capacity
+	var bits qrBits
+	bits.append(0x4, 4)
+	bits.append(len(data), qrCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := 8 * v.dataLen()
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	codewords := bits.bytes()
+
+	// Split into blocks and compute error correction for each
+	divisor := reedSolomonDivisor(v.ecLen)
+	var dataBlocks, ecBlocks [][]byte
+	for _, blockLen := range v.blocks {
+		block := codewords[:blockLen]
+		codewords = codewords[blockLen:]
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, reedSolomonRemainder(block, divisor))
+	}
+
+	// Interleave the blocks: first codeword of each block, then second,
+	// and so on
+	var result []byte
+	for i := 0; i < v.blocks[len(v.blocks)-1]; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecLen; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// qrBits is a sequence of bits, most significant first.
+type qrBits []bool
+
+func (b *qrBits) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 == 1)
+	}
+}
+
+func (b qrBits) bytes() []byte {
+	result := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			result[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return result
+}
+
+// newQRCode returns an empty QR code of the given version with its
+// function patterns drawn (and the format area reserved).
+func newQRCode(version int) *qrCode {
+	size := 17 + 4*version
+	q := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for y := range q.modules {
+		q.modules[y] = make([]bool, size)
+		q.function[y] = make([]bool, size)
+	}
+
+	// Timing patterns
+	for i := 0; i < size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns (with separators) in three corners
+	for _, centre := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := centre[0]+dx, centre[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					dist := maxAbs(dx, dy)
+					q.setFunction(x, y, dist != 2 && dist != 4)
+				}
+			}
+		}
+	}
+
+	// Alignment patterns, except where they'd overlap the finders
+	positions := qrAlignments[version]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(x+dx, y+dy, maxAbs(dx, dy) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas, and draw the version information
+	q.drawFormat(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			bit := bits>>i&1 == 1
+			a, b := size-11+i%3, i/3
+			q.setFunction(a, b, bit)
+			q.setFunction(b, a, bit)
+		}
+	}
+	return q
+}
+
+func (q *qrCode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func maxAbs(a, b int) int {
+	if a < 0 {
+		a = -a
+	}
+	if b < 0 {
+		b = -b
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// drawFormat draws both copies of the format information (error
+// correction level M and the given mask), as well as the dark module.
+func (q *qrCode) drawFormat(mask int) {
+	data := 0<<3 | mask // level M is 0b00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	// First copy, around the top-left finder
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	// Second copy, split between the other two finders
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true)
+}
+
+// drawCodewords places the codewords' bits in the non-function modules,
+// in the zigzag order the spec requires: up and down pairs of columns,
+// starting from the bottom right.
+func (q *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert // going up
+				}
+				if !q.function[y][x] && i < len(codewords)*8 {
+					q.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask XORs the non-function modules with the given mask pattern.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the QR code using the spec's rules for how hard it'll be
+// to scan: long runs of one color, 2x2 blocks, patterns that look like
+// finders, and an imbalance of dark and light.
+func (q *qrCode) penalty() int {
+	penalty := 0
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finderLike := []bool{true, false, true, true, true, false, true}
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 0
+			for x := 0; x < q.size; x++ {
+				if x > 0 && at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					penalty += 3
+				} else if run > 5 {
+					penalty++
+				}
+
+				// Finder-like 1:1:3:1:1 pattern with 4 light modules on
+				// either side
+				if x+7 > q.size {
+					continue
+				}
+				match := true
+				for i, dark := range finderLike {
+					if at(x+i, y, vertical) != dark {
+						match = false
+						break
+					}
+				}
+				if match && (q.lightRun(x-4, x, y, vertical, at) || q.lightRun(x+7, x+11, y, vertical, at)) {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := q.modules[y][x]
+				if c == q.modules[y-1][x] && c == q.modules[y][x-1] && c == q.modules[y-1][x-1] {
+					penalty += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	deviation := dark*20 - total*10
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	penalty += deviation / total * 10
+	return penalty
+}
+
+// lightRun reports whether modules from start to end (exclusive) along
+// line y are all light. Modules outside the symbol count as light.
+func (q *qrCode) lightRun(start, end, y int, vertical bool, at func(x, y int, vertical bool) bool) bool {
+	for x := start; x < end; x++ {
+		if x >= 0 && x < q.size && at(x, y, vertical) {
+			return false
+		}
+	}
+	return true
+}
+
+// reedSolomonDivisor returns the Reed-Solomon generator polynomial of the
+// given degree, without its leading coefficient of 1.
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// reedSolomonRemainder returns the error correction codewords for data.
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= gfMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies x and y in GF(2^8) modulo the QR code polynomial
+// x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
@@ -0,0 +1,336 @@
+// Tests for album QR codes
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// "HELLO WORLD" as a version 1-M QR code in alphanumeric mode, from
+	// the worked example at https://www.thonky.com/qr-code-tutorial/
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	got := reedSolomonRemainder(data, reedSolomonDivisor(10))
+	if !bytes.Equal(got, want) {
+		t.Fatalf("bad error correction codewords: got %v, want %v", got, want)
+	}
+}
+
+func TestQRFormatAndVersionBits(t *testing.T) {
+	// Format strings for level M with masks 0 and 5, and version 7's
+	// version string, from the spec's tables
+	for _, test := range []struct {
+		mask int
+		want string
+	}{
+		{0, "101010000010010"},
+		{5, "100000011001110"},
+	} {
+		q := newQRCode(1)
+		q.drawFormat(test.mask)
+		var got strings.Builder
+		for i := 14; i >= 0; i-- {
+			got.WriteString(qrBit(qrFormatBits(q, 0), i))
+		}
+		if got.String() != test.want {
+			t.Fatalf("bad format bits for mask %d: got %s, want %s", test.mask, got.String(), test.want)
+		}
+	}
+
+	q := newQRCode(7)
+	var got strings.Builder
+	for i := 17; i >= 0; i-- {
+		got.WriteString(qrBit(qrVersionBits(q), i))
+	}
+	if want := "000111110010010100"; got.String() != want {
+		t.Fatalf("bad version bits: got %s, want %s", got.String(), want)
+	}
+}
+
+func TestEncodeQR(t *testing.T) {
+	for _, n := range []int{0, 1, 14, 15, 26, 42, 62, 84, 106, 122, 152, 180, 213} {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		q, err := encodeQR(data)
+		if err != nil {
+			t.Fatalf("error encoding %d bytes: %v", n, err)
+		}
+		got, err := decodeQR(q.modules)
+		if err != nil {
+			t.Fatalf("error decoding %d bytes (size %d): %v", n, q.size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("bad round trip of %d bytes: got %v", n, got)
+		}
+	}
+
+	_, err := encodeQR(make([]byte, 214))
+	if err == nil {
+		t.Fatalf("expected error encoding 214 bytes")
+	}
+}
+
+func TestGetQRCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []Option
+		album    string
+		wantLink string
+	}{
+		{"Default", nil, "a1", "http://shop.test/albums/a1"},
+		{"BaseURL", []Option{WithBaseURL(mustParseBaseURL(t, "https://example.com/api"))}, "a1", "https://example.com/api/albums/a1"},
+		{"Template", []Option{WithPublicURLTemplate("https://shop.example.com/catalog/{id}?src=qr")}, "a 9", "https://shop.example.com/catalog/a%209?src=qr"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := NewMemoryDatabase()
+			db.AddAlbum(Album{ID: test.album, Title: "Pianoman", Artist: "Billy Joel"})
+			server := NewServer(db, log.New(io.Discard, "", 0), test.options...)
+
+			request := newRequest(t, "GET", "/albums/"+url.PathEscape(test.album)+"/qr.png?scale=3", nil)
+			request.Host = "shop.test"
+			result := serve(t, server, request)
+			ensureStatus(t, result, http.StatusOK)
+			if got := result.Header.Get("Content-Type"); got != "image/png" {
+				t.Fatalf("bad Content-Type: got %q, want %q", got, "image/png")
+			}
+			if got := result.Header.Get("Cache-Control"); got != "public, max-age=300" {
+				t.Fatalf("bad Cache-Control: got %q", got)
+			}
+			img, err := png.Decode(result.Body)
+			if err != nil {
+				t.Fatalf("error decoding PNG: %v", err)
+			}
+
+			// Sample the centre of each module, skipping the quiet zone
+			bounds := img.Bounds()
+			if bounds.Dx() != bounds.Dy() || bounds.Dx()%3 != 0 {
+				t.Fatalf("bad image size: %dx%d", bounds.Dx(), bounds.Dy())
+			}
+			size := bounds.Dx()/3 - 2*qrQuietZone
+			modules := make([][]bool, size)
+			for y := range modules {
+				modules[y] = make([]bool, size)
+				for x := range modules[y] {
+					modules[y][x] = isDark(img, (x+qrQuietZone)*3+1, (y+qrQuietZone)*3+1)
+				}
+			}
+			for i := 0; i < bounds.Dx(); i++ {
+				if isDark(img, i, 0) || isDark(img, 0, i) || isDark(img, i, bounds.Dy()-1) || isDark(img, bounds.Dx()-1, i) {
+					t.Fatalf("missing quiet zone")
+				}
+			}
+			got, err := decodeQR(modules)
+			if err != nil {
+				t.Fatalf("error decoding QR code: %v", err)
+			}
+			if string(got) != test.wantLink {
+				t.Fatalf("bad QR code link: got %q, want %q", got, test.wantLink)
+			}
+
+			// Conditional GET (the default link depends on the Host header)
+			etag := result.Header.Get("ETag")
+			request.Header.Set("If-None-Match", etag)
+			result = serve(t, server, request)
+			ensureStatus(t, result, http.StatusNotModified)
+		})
+	}
+}
+
+func TestGetQRCodeErrors(t *testing.T) {
+	server := newTestServer()
+
+	result := serve(t, server, newRequest(t, "GET", "/albums/a3/qr.png", nil))
+	ensureStatus(t, result, http.StatusNotFound)
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/qr.png?scale=21", nil))
+	ensureStatus(t, result, http.StatusBadRequest)
+	data := map[string]interface{}{
+		"scale": map[string]interface{}{"error": "out-of-range", "message": "scale must be an integer between 1 and 20"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+
+	result = serve(t, server, newRequest(t, "POST", "/albums/a1/qr.png", nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+}
+
+func mustParseBaseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	base, err := parseBaseURL(raw)
+	if err != nil {
+		t.Fatalf("error parsing base URL: %v", err)
+	}
+	return base
+}
+
+func isDark(img image.Image, x, y int) bool {
+	r, _, _, _ := img.At(x, y).RGBA()
+	return r == 0
+}
+
+func qrBit(bits, i int) string {
+	return fmt.Sprint(bits >> i & 1)
+}
+
+// qrFormatBits reads the 15 format bits from the given copy (0 or 1) of
+// the format information.
+func qrFormatBits(q *qrCode, copy int) int {
+	var positions [][2]int // x, y of bit 0 to bit 14
+	if copy == 0 {
+		for i := 0; i <= 5; i++ {
+			positions = append(positions, [2]int{8, i})
+		}
+		positions = append(positions, [2]int{8, 7}, [2]int{8, 8}, [2]int{7, 8})
+		for i := 5; i >= 0; i-- {
+			positions = append(positions, [2]int{i, 8})
+		}
+	} else {
+		for i := 0; i < 8; i++ {
+			positions = append(positions, [2]int{q.size - 1 - i, 8})
+		}
+		for i := 7; i >= 1; i-- {
+			positions = append(positions, [2]int{8, q.size - i})
+		}
+	}
+	bits := 0
+	for i, p := range positions {
+		if q.modules[p[1]][p[0]] {
+			bits |= 1 << i
+		}
+	}
+	return bits
+}
+
+// qrVersionBits reads the 18 version bits from the bottom-left copy of the
+// version information.
+func qrVersionBits(q *qrCode) int {
+	bits := 0
+	for i := 0; i < 18; i++ {
+		if q.modules[q.size-11+i%3][i/3] {
+			bits |= 1 << i
+		}
+	}
+	return bits
+}
+
+// decodeQR decodes a byte mode QR code at error correction level M from
+// its modules, checking the format information and error correction
+// codewords (but not correcting errors).
+func decodeQR(modules [][]bool) ([]byte, error) {
+	size := len(modules)
+	version := (size - 17) / 4
+	if size != 17+4*version || version < 1 || version >= len(qrVersions) {
+		return nil, fmt.Errorf("unsupported size %d", size)
+	}
+	q := newQRCode(version)
+	for y := range modules {
+		copy(q.modules[y], modules[y])
+	}
+
+	// Both copies of the format information must match and be for level M
+	format := qrFormatBits(q, 0)
+	if other := qrFormatBits(q, 1); other != format {
+		return nil, fmt.Errorf("format copies differ: %015b and %015b", format, other)
+	}
+	format ^= 0x5412
+	if format>>13 != 0 {
+		return nil, fmt.Errorf("unexpected error correction level %02b", format>>13)
+	}
+	rem := format
+	for i := 14; i >= 10; i-- {
+		if rem>>i&1 == 1 {
+			rem ^= 0x537 << (i - 10)
+		}
+	}
+	if rem != 0 {
+		return nil, fmt.Errorf("bad format BCH code: %015b", format)
+	}
+	if !modules[size-8][8] {
+		return nil, fmt.Errorf("missing dark module")
+	}
+	q.applyMask(format >> 10 & 7)
+
+	// Read codewords right to left in pairs of columns, alternately up
+	// and down
+	v := qrVersions[version]
+	total := v.dataLen() + len(v.blocks)*v.ecLen
+	var bits qrBits
+	upward := true
+	for right := size - 1; right > 0; right -= 2 {
+		if right == 6 {
+			right--
+		}
+		for i := 0; i < size; i++ {
+			y := i
+			if upward {
+				y = size - 1 - i
+			}
+			for _, x := range []int{right, right - 1} {
+				if !q.function[y][x] {
+					bits = append(bits, q.modules[y][x])
+				}
+			}
+		}
+		upward = !upward
+	}
+	codewords := bits[:8*total].bytes()
+
+	// De-interleave and check each block's error correction codewords
+	blocks := make([][]byte, len(v.blocks))
+	i := 0
+	for n := 0; n < v.blocks[len(v.blocks)-1]; n++ {
+		for b, blockLen := range v.blocks {
+			if n < blockLen {
+				blocks[b] = append(blocks[b], codewords[i])
+				i++
+			}
+		}
+	}
+	divisor := reedSolomonDivisor(v.ecLen)
+	var data []byte
+	for b := range blocks {
+		var blockEC []byte
+		for j := 0; j < v.ecLen; j++ {
+			blockEC = append(blockEC, codewords[i+j*len(blocks)+b])
+		}
+		if !bytes.Equal(reedSolomonRemainder(blocks[b], divisor), blockEC) {
+			return nil, fmt.Errorf("bad error correction codewords in block %d", b)
+		}
+		data = append(data, blocks[b]...)
+	}
+
+	// Byte mode indicator, count, then the data itself
+	if data[0]>>4 != 0x4 {
+		return nil, fmt.Errorf("unexpected mode %04b", data[0]>>4)
+	}
+	var stream qrBits
+	for _, b := range data {
+		stream.append(int(b), 8)
+	}
+	stream = stream[4:]
+	count := 0
+	for _, bit := range stream[:qrCountBits(version)] {
+		count <<= 1
+		if bit {
+			count |= 1
+		}
+	}
+	stream = stream[qrCountBits(version):]
+	if 8*count > len(stream) {
+		return nil, fmt.Errorf("count %d too large", count)
+	}
+	return stream[:8*count].bytes(), nil
+}
@@ -0,0 +1,620 @@
+// Filter expressions for album listings (?q=)
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Filter is a parsed filter expression, like:
+//
+//	artist ~ "beatles" AND price < 1500
+//
+// It's one of AndFilter, OrFilter, NotFilter, or Comparison. Databases
+// that implement AlbumFilterer compile it to their own query language;
+// MemoryDatabase compiles it to a Go function.
+type Filter interface {
+	isFilter()
+}
+
+// AndFilter matches albums that match both Left and Right.
+type AndFilter struct {
+	Left, Right Filter
+}
+
+// OrFilter matches albums that match Left, Right, or both.
+type OrFilter struct {
+	Left, Right Filter
+}
+
+// NotFilter matches albums that don't match Filter.
+type NotFilter struct {
+	Filter Filter
+}
+
+// Comparison compares an album field with a value. Op is one of "=",
+// "!=", "<", "<=", ">", ">=", or "~" (contains, ignoring case). Value is a
+// string, int, or time.Time, depending on the type of the field (see
+// filterFields).
+//
+// The "genre" field is special: "=" matches albums that have the genre,
+// "!=" albums that don't, and "~" albums with a genre that contains the
+// value.
+type Comparison struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+func (AndFilter) isFilter()  {}
+func (OrFilter) isFilter()   {}
+func (NotFilter) isFilter()  {}
+func (Comparison) isFilter() {}
+
+// AlbumFilterer is an optional interface a Database can implement to
+// filter albums itself, for example by compiling the filter to SQL.
+// Databases that don't implement it are filtered from GetAlbums.
+type AlbumFilterer interface {
+	// FilterAlbums returns the albums that match filter, in the same
+	// order as GetAlbums.
+	FilterAlbums(filter Filter) ([]Album, error)
+}
+
+// filterAlbums returns the albums in db that match filter, using
+// FilterAlbums if db implements AlbumFilterer.
+func filterAlbums(db Database, filter Filter) ([]Album, error) {
+	if filterer, ok := db.(AlbumFilterer); ok {
+		return filterer.FilterAlbums(filter)
+	}
+	albums, err := db.GetAlbums()
+	if err != nil {
+		return nil, err
+	}
+	return filterMatching(albums, compileFilter(filter)), nil
+}
+
+// FilterAlbums implements AlbumFilterer.
+func (d *MemoryDatabase) FilterAlbums(filter Filter) ([]Album, error) {
+	albums, err := d.GetAlbums()
+	if err != nil {
+		return nil, err
+	}
+	return filterMatching(albums, compileFilter(filter)), nil
+}
+
+// filterMatching returns the albums that match, reusing the slice.
+func filterMatching(albums []Album, match func(Album) bool) []Album {
+	matching := albums[:0]
+	for _, album := range albums {
+		if match(album) {
+			matching = append(matching, album)
+		}
+	}
+	return matching
+}
+
+// Types of filter fields.
+const (
+	stringField = "string"
+	intField    = "integer"
+	timeField   = "timestamp"
+)
+
+// filterFields maps the fields that can be used in a filter to their
+// types. Most are album JSON fields; "tracks" is the number of tracks.
+var filterFields = map[string]string{
+	"id":             stringField,
+	"title":          stringField,
+	"artist":         stringField,
+	"catalog_number": stringField,
+	"upc":            stringField,
+	"musicbrainz_id": stringField,
+	"genre":          stringField,
+	"price":          intField,
+	"stock":          intField,
+	"version":        intField,
+	"tracks":         intField,
+	"created_at":     timeField,
+	"updated_at":     timeField,
+}
+
+// compileFilter compiles filter to a function that reports whether an
+// album matches it.
+func compileFilter(filter Filter) func(Album) bool {
+	switch f := filter.(type) {
+	case AndFilter:
+		left, right := compileFilter(f.Left), compileFilter(f.Right)
+		return func(album Album) bool { return left(album) && right(album) }
+	case OrFilter:
+		left, right := compileFilter(f.Left), compileFilter(f.Right)
+		return func(album Album) bool { return left(album) || right(album) }
+	case NotFilter:
+		inner := compileFilter(f.Filter)
+		return func(album Album) bool { return !inner(album) }
+	case Comparison:
+		return compileComparison(f)
+	default:
+		panic(fmt.Sprintf("unexpected filter type %T", filter))
+	}
+}
+
+func compileComparison(c Comparison) func(Album) bool {
+	switch value := c.Value.(type) {
+	case string:
+		if c.Field == "genre" {
+			return compileGenreComparison(c.Op, value)
+		}
+		get := map[string]func(Album) string{
+			"id":             func(a Album) string { return a.ID },
+			"title":          func(a Album) string { return a.Title },
+			"artist":         func(a Album) string { return a.Artist },
+			"catalog_number": func(a Album) string { return a.CatalogNumber },
+			"upc":            func(a Album) string { return a.UPC },
+			"musicbrainz_id": func(a Album) string { return a.MusicBrainzID },
+		}[c.Field]
+		return func(album Album) bool { return compareStrings(get(album), c.Op, value) }
+	case int:
+		get := map[string]func(Album) int{
+			"price":   func(a Album) int { return a.Price },
+			"stock":   func(a Album) int { return a.Stock },
+			"version": func(a Album) int { return a.Version },
+			"tracks":  func(a Album) int { return len(a.Tracks) },
+		}[c.Field]
+		return func(album Album) bool { return compareOrdered(compareInts(get(album), value), c.Op) }
+	case time.Time:
+		get := map[string]func(Album) time.Time{
+			"created_at": func(a Album) time.Time { return a.CreatedAt },
+			"updated_at": func(a Album) time.Time { return a.UpdatedAt },
+		}[c.Field]
+		return func(album Album) bool { return compareOrdered(compareTimes(get(album), value), c.Op) }
+	default:
+		panic(fmt.Sprintf("unexpected comparison value type %T", c.Value))
+	}
+}
+
+func compileGenreComparison(op, value string) func(Album) bool {
+	return func(album Album) bool {
+		has := false
+		for _, genre := range album.Genres {
+			if op == "~" && containsFold(genre, value) || op != "~" && genre == value {
+				has = true
+				break
+			}
+		}
+		return has == (op != "!=")
+	}
+}
+
+func compareStrings(s, op, value string) bool {
+	switch op {
+	case "=":
+		return s == value
+	case "!=":
+		return s != value
+	default: // "~"
+		return containsFold(s, value)
+	}
+}
+
+// containsFold reports whether substr is in s, ignoring case.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareOrdered reports whether the result of a three-way comparison
+// (-1, 0, or 1) satisfies op.
+func compareOrdered(cmp int, op string) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default: // ">="
+		return cmp >= 0
+	}
+}
+
+// Limits on filter expressions, so a malicious one can't use much CPU or
+// stack. Real queries are nowhere near these.
+const (
+	maxFilterLength = 1000
+	maxFilterDepth  = 20
+)
+
+// parseFilter parses a filter expression. The grammar is:
+//
+//	expr       = and ("OR" and)*
+//	and        = not ("AND" not)*
+//	not        = "NOT" not | "(" expr ")" | comparison
+//	comparison = field op value
+//	op         = "=" | "!=" | "<" | "<=" | ">" | ">=" | "~"
+//	value      = string | integer
+//
+// Keywords are case-insensitive. Strings are double-quoted, with
+// backslash escapes as in Go. Timestamp fields are compared with strings
+// in RFC 3339 format, or dates like "2021-06-01" (midnight UTC).
+func parseFilter(s string) (Filter, error) {
+	if len(s) > maxFilterLength {
+		return nil, fmt.Errorf("filter must be at most %d characters", maxFilterLength)
+	}
+	p := &filterParser{lexer: filterLexer{input: s}}
+	err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	filter, err := p.expr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.token.kind != tokenEOF {
+		return nil, p.errorf("unexpected %s", p.token)
+	}
+	return filter, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenInt
+	tokenOp
+	tokenLParen
+	tokenRParen
+)
+
+type filterToken struct {
+	kind  tokenKind
+	text  string // identifier, operator, or unquoted string
+	value int    // integer value
+	pos   int    // byte offset in input, from 0
+}
+
+func (t filterToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of filter"
+	case tokenString:
+		return strconv.Quote(t.text)
+	case tokenInt:
+		return strconv.Itoa(t.value)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// isKeyword reports whether t is the given keyword, ignoring case.
+func (t filterToken) isKeyword(keyword string) bool {
+	return t.kind == tokenIdent && strings.EqualFold(t.text, keyword)
+}
+
+type filterLexer struct {
+	input string
+	pos   int
+}
+
+func (l *filterLexer) next() (filterToken, error) {
+	for l.pos < len(l.input) && (l.input[l.pos] == ' ' || l.input[l.pos] == '\t') {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return filterToken{kind: tokenEOF, pos: start}, nil
+	}
+	c := l.input[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return filterToken{kind: tokenLParen, text: "(", pos: start}, nil
+	case c == ')':
+		l.pos++
+		return filterToken{kind: tokenRParen, text: ")", pos: start}, nil
+	case c == '=' || c == '~':
+		l.pos++
+		return filterToken{kind: tokenOp, text: string(c), pos: start}, nil
+	case c == '!' || c == '<' || c == '>':
+		l.pos++
+		if l.pos < len(l.input) && l.input[l.pos] == '=' {
+			l.pos++
+		} else if c == '!' {
+			return filterToken{}, filterErrorf(start, `expected "!="`)
+		}
+		return filterToken{kind: tokenOp, text: l.input[start:l.pos], pos: start}, nil
+	case c == '"':
+		l.pos++
+		for l.pos < len(l.input) && l.input[l.pos] != '"' {
+			if l.input[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.input) {
+			return filterToken{}, filterErrorf(start, "unterminated string")
+		}
+		l.pos++
+		text, err := strconv.Unquote(l.input[start:l.pos])
+		if err != nil {
+			return filterToken{}, filterErrorf(start, "invalid string")
+		}
+		return filterToken{kind: tokenString, text: text, pos: start}, nil
+	case c == '-' || c >= '0' && c <= '9':
+		l.pos++
+		for l.pos < len(l.input) && l.input[l.pos] >= '0' && l.input[l.pos] <= '9' {
+			l.pos++
+		}
+		n, err := strconv.Atoi(l.input[start:l.pos])
+		if err != nil {
+			return filterToken{}, filterErrorf(start, "invalid integer")
+		}
+		return filterToken{kind: tokenInt, value: n, pos: start}, nil
+	case isIdentByte(c) && (c < '0' || c > '9'):
+		for l.pos < len(l.input) && isIdentByte(l.input[l.pos]) {
+			l.pos++
+		}
+		return filterToken{kind: tokenIdent, text: l.input[start:l.pos], pos: start}, nil
+	default:
+		return filterToken{}, filterErrorf(start, "unexpected character %q", c)
+	}
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// filterError is an error parsing a filter, at a byte offset in the input.
+type filterError struct {
+	pos     int
+	message string
+}
+
+func (e *filterError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.message, e.pos+1)
+}
+
+func filterErrorf(pos int, format string, args ...interface{}) error {
+	return &filterError{pos, fmt.Sprintf(format, args...)}
+}
+
+type filterParser struct {
+	lexer filterLexer
+	token filterToken
+}
+
+func (p *filterParser) next() error {
+	token, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.token = token
+	return nil
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return filterErrorf(p.token.pos, format, args...)
+}
+
+func (p *filterParser) expr(depth int) (Filter, error) {
+	if depth > maxFilterDepth {
+		return nil, p.errorf("filter nested too deeply")
+	}
+	left, err := p.and(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.token.isKeyword("OR") {
+		err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		right, err := p.and(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = OrFilter{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) and(depth int) (Filter, error) {
+	left, err := p.not(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.token.isKeyword("AND") {
+		err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		right, err := p.not(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = AndFilter{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) not(depth int) (Filter, error) {
+	switch {
+	case p.token.isKeyword("NOT"):
+		if depth >= maxFilterDepth {
+			return nil, p.errorf("filter nested too deeply")
+		}
+		err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		inner, err := p.not(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return NotFilter{inner}, nil
+	case p.token.kind == tokenLParen:
+		err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		inner, err := p.expr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if p.token.kind != tokenRParen {
+			return nil, p.errorf(`expected ")", got %s`, p.token)
+		}
+		return inner, p.next()
+	default:
+		return p.comparison()
+	}
+}
+
+func (p *filterParser) comparison() (Filter, error) {
+	if p.token.kind != tokenIdent || p.token.isKeyword("AND") || p.token.isKeyword("OR") {
+		return nil, p.errorf("expected field name, got %s", p.token)
+	}
+	field := p.token.text
+	fieldType, ok := filterFields[field]
+	if !ok {
+		return nil, p.errorf("unknown field %q", field)
+	}
+	err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if p.token.kind != tokenOp {
+		return nil, p.errorf("expected operator, got %s", p.token)
+	}
+	op := p.token.text
+	if fieldType == stringField && op != "=" && op != "!=" && op != "~" {
+		return nil, p.errorf("operator %q can't be used with %s", op, field)
+	}
+	if fieldType != stringField && op == "~" {
+		return nil, p.errorf(`operator "~" can't be used with %s`, field)
+	}
+	err = p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	comparison := Comparison{Field: field, Op: op}
+	switch {
+	case fieldType == intField && p.token.kind == tokenInt:
+		comparison.Value = p.token.value
+	case fieldType == stringField && p.token.kind == tokenString:
+		comparison.Value = p.token.text
+	case fieldType == timeField && p.token.kind == tokenString:
+		t, err := parseFilterTime(p.token.text)
+		if err != nil {
+			return nil, p.errorf("%s must be compared with a timestamp like \"2021-06-01T12:00:00Z\" or a date", field)
+		}
+		comparison.Value = t
+	default:
+		return nil, p.errorf("%s must be compared with %s %s, got %s", field, article(fieldType), fieldType, p.token)
+	}
+	return comparison, p.next()
+}
+
+// parseFilterTime parses an RFC 3339 timestamp or a date.
+func parseFilterTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", s)
+	}
+	return t.UTC(), err
+}
+
+func article(noun string) string {
+	if strings.IndexByte("aeiou", noun[0]) >= 0 {
+		return "an"
+	}
+	return "a"
+}
+
+// comparisonFields returns the names of the fields used by filter.
+func comparisonFields(filter Filter) []string {
+	switch f := filter.(type) {
+	case AndFilter:
+		return append(comparisonFields(f.Left), comparisonFields(f.Right)...)
+	case OrFilter:
+		return append(comparisonFields(f.Left), comparisonFields(f.Right)...)
+	case NotFilter:
+		return comparisonFields(f.Filter)
+	case Comparison:
+		return []string{f.Field}
+	default:
+		return nil
+	}
+}
+
+// filterParam parses the ?q= filter for the album listing, writing an
+// error response if it's invalid. It returns nil if there's no filter.
+// Callers can't filter on fields they can't see (see FieldPolicy), or they
+// could work out the hidden values. The caller should return from the
+// handler early if it returns false.
+func (s *Server) filterParam(w http.ResponseWriter, r *http.Request) (Filter, bool) {
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		return nil, true
+	}
+	filter, err := s.parseCallerFilter(r, q)
+	if err != nil {
+		issues := map[string]interface{}{"q": validationIssue{"invalid", err.Error()}}
+		s.writeError(w, r, apierr.Validation(issues))
+		return nil, false
+	}
+	return filter, true
+}
+
+// parseCallerFilter parses a filter expression like parseFilter, but also
+// treats fields the caller can't see (see WithFieldPolicy) as unknown.
+func (s *Server) parseCallerFilter(r *http.Request, q string) (Filter, error) {
+	filter, err := parseFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	role := s.role(r)
+	for _, field := range comparisonFields(filter) {
+		name := field
+		if field == "genre" {
+			name = "genres"
+		}
+		if minRole, ok := s.fieldPolicy[name]; ok && role < minRole {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+	}
+	return filter, nil
+}
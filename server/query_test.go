@@ -0,0 +1,187 @@
+// Tests for filter expressions
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		q    string
+		want Filter
+	}{
+		{`artist~"beatles" AND price<1500`, AndFilter{
+			Comparison{"artist", "~", "beatles"},
+			Comparison{"price", "<", 1500},
+		}},
+		{`id = "a1" OR id = "a2" AND NOT genre = "rock"`, OrFilter{
+			Comparison{"id", "=", "a1"},
+			AndFilter{Comparison{"id", "=", "a2"}, NotFilter{Comparison{"genre", "=", "rock"}}},
+		}},
+		{`(id = "a1" or id = "a2") and tracks >= -1`, AndFilter{
+			OrFilter{Comparison{"id", "=", "a1"}, Comparison{"id", "=", "a2"}},
+			Comparison{"tracks", ">=", -1},
+		}},
+		{`title != "say \"hi\""`, Comparison{"title", "!=", `say "hi"`}},
+		{`created_at > "2021-06-01"`, Comparison{"created_at", ">", time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}},
+		{`updated_at <= "2021-06-01T14:00:00+02:00"`, Comparison{"updated_at", "<=", time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}},
+	}
+	for _, test := range tests {
+		t.Run(test.q, func(t *testing.T) {
+			got, err := parseFilter(test.q)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got vs want:\n%#v\n%#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{`colour = "red"`, `unknown field "colour" at position 1`},
+		{`title`, `expected operator, got end of filter at position 6`},
+		{`title = `, `title must be compared with a string, got end of filter at position 9`},
+		{`price = "10"`, `price must be compared with an integer, got "10" at position 9`},
+		{`title < "b"`, `operator "<" can't be used with title at position 7`},
+		{`price ~ 1`, `operator "~" can't be used with price at position 7`},
+		{`created_at > "yesterday"`, `created_at must be compared with a timestamp like "2021-06-01T12:00:00Z" or a date at position 14`},
+		{`title = "x`, `unterminated string at position 9`},
+		{`title ! "x"`, `expected "!=" at position 7`},
+		{`title = "x" price = 1`, `unexpected "price" at position 13`},
+		{`(title = "x"`, `expected ")", got end of filter at position 13`},
+		{`AND title = "x"`, `expected field name, got "AND" at position 1`},
+		{`title = "x" & price = 1`, `unexpected character '&' at position 13`},
+		{strings.Repeat("(", 30) + `title = "x"` + strings.Repeat(")", 30), `filter nested too deeply at position 22`},
+		{strings.Repeat("NOT ", 30) + `title = "x"`, `filter nested too deeply at position 81`},
+		{strings.Repeat(" ", 1001), `filter must be at most 1000 characters`},
+	}
+	for _, test := range tests {
+		t.Run(test.q, func(t *testing.T) {
+			_, err := parseFilter(test.q)
+			if err == nil || err.Error() != test.want {
+				t.Fatalf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	created := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	album := Album{
+		ID: "a1", Title: "Abbey Road", Artist: "The Beatles", Price: 1500,
+		Tracks:    []Track{{Number: 1, Title: "Come Together", Duration: 259}, {Number: 2, Title: "Something", Duration: 182}},
+		Genres:    []string{"pop", "rock"},
+		Version:   2,
+		CreatedAt: created,
+		UpdatedAt: created.Add(time.Hour),
+	}
+	tests := []struct {
+		q    string
+		want bool
+	}{
+		{`artist ~ "BEATLES"`, true},
+		{`artist = "Beatles"`, false},
+		{`artist != "Beatles"`, true},
+		{`price = 1500 AND version = 2`, true},
+		{`price < 1500`, false},
+		{`price <= 1500`, true},
+		{`price > 1499 AND price >= 1500`, true},
+		{`price != 1500 OR tracks = 2`, true},
+		{`NOT tracks = 2`, false},
+		{`genre = "rock"`, true},
+		{`genre = "roc"`, false},
+		{`genre ~ "ROC"`, true},
+		{`genre != "rock"`, false},
+		{`genre != "jazz"`, true},
+		{`created_at = "2021-06-01T12:00:00Z"`, true},
+		{`created_at < "2021-06-02" AND updated_at > "2021-06-01T12:30:00Z"`, true},
+		{`(title ~ "road" OR title ~ "abbey") AND NOT (price > 2000 OR id = "a2")`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.q, func(t *testing.T) {
+			filter, err := parseFilter(test.q)
+			if err != nil {
+				t.Fatalf("error parsing filter: %v", err)
+			}
+			if got := compileFilter(filter)(album); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetAlbumsFilter(t *testing.T) {
+	server := newTestServer()
+	server.db.AddAlbum(Album{ID: "a3", Title: "Abbey Road", Artist: "The Beatles", Price: 1500})
+
+	get := func(request *http.Request) []string {
+		t.Helper()
+		result := serve(t, server, request)
+		ensureStatus(t, result, http.StatusOK)
+		var albums []testAlbum
+		if result.Header.Get("Content-Type") == ndjsonContentType {
+			albums = readNDJSON(t, result)
+		} else {
+			unmarshalResponse(t, result, &albums)
+		}
+		ids := []string{}
+		for _, album := range albums {
+			ids = append(ids, album.ID)
+		}
+		return ids
+	}
+	query := "/albums?q=" + url.QueryEscape(`artist ~ "beatles" AND price < 1800`)
+	if got := get(newRequest(t, "GET", query, nil)); !reflect.DeepEqual(got, []string{"a3"}) {
+		t.Fatalf("bad album IDs: got %q", got)
+	}
+	if got := get(newNDJSONRequest(t, query)); !reflect.DeepEqual(got, []string{"a3"}) {
+		t.Fatalf("bad streamed album IDs: got %q", got)
+	}
+	query = "/albums?q=" + url.QueryEscape(`price >= 0`)
+	if got := get(newRequest(t, "GET", query, nil)); !reflect.DeepEqual(got, []string{"a1", "a2", "a3"}) {
+		t.Fatalf("bad album IDs: got %q", got)
+	}
+
+	result := serve(t, server, newRequest(t, "GET", "/albums?q="+url.QueryEscape(`price <`), nil))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"q": map[string]interface{}{"error": "invalid", "message": "price must be compared with an integer, got end of filter at position 8"},
+	})
+}
+
+func TestGetAlbumsFilterHiddenField(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithFieldPolicy(FieldPolicy{"price": RoleAdmin}),
+	)
+
+	// Public callers can't filter on a hidden field to work out its value
+	query := "/albums?q=" + url.QueryEscape(`price > 700`)
+	result := serve(t, server, newRequest(t, "GET", query, nil))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"q": map[string]interface{}{"error": "invalid", "message": `unknown field "price"`},
+	})
+
+	result = serve(t, server, newAdminRequest(t, "GET", query, nil))
+	ensureStatus(t, result, http.StatusOK)
+	var albums []testAlbum
+	unmarshalResponse(t, result, &albums)
+	if len(albums) != 1 {
+		t.Fatalf("got %d albums, want 1", len(albums))
+	}
+}
@@ -0,0 +1,122 @@
+// Hiding album fields from callers based on their role
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Role is a caller's role, which decides which album fields they see.
+type Role int
+
+const (
+	// RolePublic is any caller without admin credentials, including
+	// anonymous ones.
+	RolePublic Role = iota
+
+	// RoleAdmin is a caller with the admin token, or given the role by
+	// another Authenticator (back-office clients).
+	RoleAdmin
+)
+
+// role returns the role of the caller making the request.
+func (s *Server) role(r *http.Request) Role {
+	return s.principal(r).Role
+}
+
+// FieldPolicy maps album fields, by their JSON name, to the minimum role
+// that can see them. Fields that aren't in the policy are visible to all
+// callers. Only optional fields (those omitted from JSON when empty) can
+// be hidden, so responses are still valid albums without them.
+//
+// Hidden fields are left out of responses in every format, but not
+// protected from writes: a client that replaces an album without a field
+// it can't see clears it, as with any field left out of a PUT.
+type FieldPolicy map[string]Role
+
+// WithFieldPolicy sets the policy for which album fields each role can
+// see. The default is to show every field to everyone. Fields that can't
+// be hidden are ignored (see checkFieldPolicy).
+func WithFieldPolicy(policy FieldPolicy) Option {
+	return func(s *Server) {
+		s.fieldPolicy = policy
+	}
+}
+
+// optionalAlbumFields maps the JSON names of Album's optional fields to
+// their struct field indexes.
+var optionalAlbumFields = func() map[string]int {
+	fields := make(map[string]int)
+	typ := reflect.TypeOf(Album{})
+	for i := 0; i < typ.NumField(); i++ {
+		tag := typ.Field(i).Tag.Get("json")
+		if strings.HasSuffix(tag, ",omitempty") {
+			fields[strings.TrimSuffix(tag, ",omitempty")] = i
+		}
+	}
+	return fields
+}()
+
+// checkFieldPolicy checks that every field in the policy can be hidden.
+func checkFieldPolicy(policy FieldPolicy) error {
+	var bad []string
+	for field := range policy {
+		if _, ok := optionalAlbumFields[field]; !ok {
+			bad = append(bad, field)
+		}
+	}
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return fmt.Errorf("can't hide album field(s) %s (only optional fields can be hidden)", strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// parseAdminFields parses a comma-separated list of album fields that only
+// admins can see (as given to the -admin-fields flag) into a policy.
+func parseAdminFields(s string) (FieldPolicy, error) {
+	policy := make(FieldPolicy)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			policy[field] = RoleAdmin
+		}
+	}
+	return policy, checkFieldPolicy(policy)
+}
+
+// redactAlbum returns a copy of album without the fields the caller's role
+// can't see. Handlers call it (or redactAlbums) just before rendering an
+// album in any format.
+func (s *Server) redactAlbum(r *http.Request, album Album) Album {
+	if len(s.fieldPolicy) == 0 {
+		return album
+	}
+	role := s.role(r)
+	v := reflect.ValueOf(&album).Elem()
+	for field, minRole := range s.fieldPolicy {
+		index, ok := optionalAlbumFields[field]
+		if ok && role < minRole {
+			f := v.Field(index)
+			f.Set(reflect.Zero(f.Type()))
+		}
+	}
+	return album
+}
+
+// redactAlbums is like redactAlbum for a list of albums. It returns a new
+// slice if any fields are hidden.
+func (s *Server) redactAlbums(r *http.Request, albums []Album) []Album {
+	if len(s.fieldPolicy) == 0 {
+		return albums
+	}
+	redacted := make([]Album, len(albums))
+	for i, album := range albums {
+		redacted[i] = s.redactAlbum(r, album)
+	}
+	return redacted
+}
@@ -0,0 +1,193 @@
+// Tests for hiding album fields by role
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newRedactTestServer(t *testing.T) *Server {
+	t.Helper()
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795, CatalogNumber: "DG-1234"})
+	policy, err := parseAdminFields("price, catalog_number")
+	if err != nil {
+		t.Fatalf("error parsing fields: %v", err)
+	}
+	return NewServer(db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithFieldPolicy(policy),
+	)
+}
+
+func TestRedactGetAlbum(t *testing.T) {
+	server := newRedactTestServer(t)
+
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var got testAlbum
+	unmarshalResponse(t, result, &got)
+	want := testAlbum{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad public album: got vs want:\n%#v\n%#v", got, want)
+	}
+
+	result = serve(t, server, newAdminRequest(t, "GET", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	got = testAlbum{}
+	unmarshalResponse(t, result, &got)
+	want = testAlbum{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795, CatalogNumber: "DG-1234"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad admin album: got vs want:\n%#v\n%#v", got, want)
+	}
+}
+
+func TestRedactAlbumLists(t *testing.T) {
+	server := newRedactTestServer(t)
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		read    func(*http.Response) []testAlbum
+	}{
+		{"list", newRequest(t, "GET", "/albums", nil), func(result *http.Response) []testAlbum {
+			var albums []testAlbum
+			unmarshalResponse(t, result, &albums)
+			return albums
+		}},
+		{"ndjson", newNDJSONRequest(t, "/albums"), func(result *http.Response) []testAlbum {
+			return readNDJSON(t, result)
+		}},
+		{"search", newRequest(t, "GET", "/albums/search?q=beethoven", nil), func(result *http.Response) []testAlbum {
+			var albums []testAlbum
+			unmarshalResponse(t, result, &albums)
+			return albums
+		}},
+		{"lookup", newRequest(t, "POST", "/albums/lookup", strings.NewReader(`{"ids": ["a1"]}`)), func(result *http.Response) []testAlbum {
+			var got struct {
+				Albums []testAlbum `json:"albums"`
+			}
+			unmarshalResponse(t, result, &got)
+			return got.Albums
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := serve(t, server, test.request)
+			ensureStatus(t, result, http.StatusOK)
+			got := test.read(result)
+			want := []testAlbum{{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"}}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got vs want:\n%#v\n%#v", got, want)
+			}
+		})
+	}
+}
+
+func TestRedactCreateAlbum(t *testing.T) {
+	server := newRedactTestServer(t)
+
+	// The album is stored in full, but the response hides fields from the
+	// public caller who created it
+	body := `{"id": "a2", "title": "Hey Jude", "artist": "The Beatles", "price": 2000, "catalog_number": "PM-7"}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	var got testAlbum
+	unmarshalResponse(t, result, &got)
+	want := testAlbum{ID: "a2", Title: "Hey Jude", Artist: "The Beatles"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad created album: got vs want:\n%#v\n%#v", got, want)
+	}
+
+	album, err := server.db.GetAlbumByID("a2")
+	if err != nil {
+		t.Fatalf("error fetching album: %v", err)
+	}
+	if album.Price != 2000 || album.CatalogNumber != "PM-7" {
+		t.Fatalf("album not stored in full: %#v", album)
+	}
+}
+
+func TestRedactXML(t *testing.T) {
+	server := newRedactTestServer(t)
+	result := serve(t, server, newXMLRequest(t, "GET", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	b, err := io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	if strings.Contains(string(b), "<price>") || strings.Contains(string(b), "DG-1234") {
+		t.Fatalf("hidden fields in XML:\n%s", b)
+	}
+}
+
+func TestRedactDiff(t *testing.T) {
+	server := newRedactTestServer(t)
+	body := `{"id": "a1", "title": "9th Symphony", "artist": "Beethoven", "price": 995, "catalog_number": "DG-1234"}`
+	request := newRequest(t, "PUT", "/albums/a1", strings.NewReader(body))
+	request.Header.Set("If-Match", `"1"`)
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+
+	// Only the price changed (apart from the version and update time),
+	// which public callers can't see
+	changed := func(request *http.Request) []string {
+		result := serve(t, server, request)
+		ensureStatus(t, result, http.StatusOK)
+		var diff struct {
+			Changes []fieldChange `json:"changes"`
+		}
+		unmarshalResponse(t, result, &diff)
+		fields := []string{}
+		for _, change := range diff.Changes {
+			fields = append(fields, change.Field)
+		}
+		return fields
+	}
+	got := changed(newRequest(t, "GET", "/albums/a1/diff?from=1", nil))
+	want := []string{"updated_at", "version"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad public diff: got %q, want %q", got, want)
+	}
+	got = changed(newAdminRequest(t, "GET", "/albums/a1/diff?from=1", nil))
+	want = []string{"price", "updated_at", "version"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad admin diff: got %q, want %q", got, want)
+	}
+}
+
+func TestParseAdminFields(t *testing.T) {
+	tests := []struct {
+		fields string
+		want   FieldPolicy
+		err    string
+	}{
+		{"", FieldPolicy{}, ""},
+		{"price", FieldPolicy{"price": RoleAdmin}, ""},
+		{" price , catalog_number,", FieldPolicy{"price": RoleAdmin, "catalog_number": RoleAdmin}, ""},
+		{"title,id", nil, "can't hide album field(s) id, title (only optional fields can be hidden)"},
+		{"cost_price", nil, "can't hide album field(s) cost_price (only optional fields can be hidden)"},
+	}
+	for _, test := range tests {
+		t.Run(test.fields, func(t *testing.T) {
+			got, err := parseAdminFields(test.fields)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Album deletion protection based on references from other resources
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// ReferenceSource is implemented by stores of other resources that refer to
+// albums (for example playlists, orders, or favorites), so that albums
+// can't be deleted out from under them.
+type ReferenceSource interface {
+	// AlbumReferences returns the IDs of the items that refer to the album
+	// with the given ID.
+	AlbumReferences(albumID string) ([]string, error)
+
+	// RemoveAlbumReferences removes all references to the album with the
+	// given ID. It's called when a deletion cascades.
+	RemoveAlbumReferences(albumID string) error
+}
+
+// ReferenceRule says what happens to references when an album is deleted.
+type ReferenceRule int
+
+const (
+	// ReferenceRestrict refuses to delete a referenced album unless the
+	// request has ?force=true, in which case the references are removed.
+	ReferenceRestrict ReferenceRule = iota
+
+	// ReferenceCascade always deletes the album and removes the references.
+	ReferenceCascade
+
+	// ReferenceProtect never deletes a referenced album, even when forced.
+	ReferenceProtect
+)
+
+type referenceSource struct {
+	typ    string
+	source ReferenceSource
+	rule   ReferenceRule
+}
+
+// WithReferenceSource registers a source of references to albums, with the
+// given type name (used in error responses) and deletion rule.
+func WithReferenceSource(typ string, source ReferenceSource, rule ReferenceRule) Option {
+	return func(s *Server) {
+		s.references = append(s.references, referenceSource{typ, source, rule})
+	}
+}
+
+// referrer is an item that refers to an album.
+type referrer struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+func (s *Server) deleteAlbum(w http.ResponseWriter, r *http.Request, id string) {
+	issues := make(map[string]interface{})
+	force := boolParam(r.URL.Query().Get("force"), "force", issues)
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+	err := s.removeAlbum(r, id, force)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeAlbum soft-deletes the album, unless references to it block the
+// deletion (restricted ones only do without force), then removes the
+// references that cascade. It returns an *apierr.Error on failure.
+func (s *Server) removeAlbum(r *http.Request, id string, force bool) error {
+	album, err := s.db.GetAlbumByID(id)
+	if err != nil {
+		return apierr.Database(err)
+	}
+	if album.DeletedAt != nil {
+		return apierr.NotFound()
+	}
+
+	// Find all referrers, and which of them block the deletion
+	var blocking []referrer
+	var cascade []referenceSource
+	forceAllowed := true
+	for _, ref := range s.references {
+		ids, err := ref.source.AlbumReferences(id)
+		if err != nil {
+			return apierr.Database(fmt.Errorf("fetching %s references: %w", ref.typ, err))
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		if ref.rule == ReferenceProtect || ref.rule == ReferenceRestrict && !force {
+			for _, refID := range ids {
+				blocking = append(blocking, referrer{Type: ref.typ, ID: refID})
+			}
+			if ref.rule == ReferenceProtect {
+				forceAllowed = false
+			}
+			continue
+		}
+		cascade = append(cascade, ref)
+	}
+	if len(blocking) > 0 {
+		data := map[string]interface{}{
+			"referrers":     blocking,
+			"force_allowed": forceAllowed,
+		}
+		return apierr.Referenced().WithData(data)
+	}
+
+	// Delete the album first, so that if that fails the references are
+	// left untouched. It's only a soft delete, so an admin can restore the
+	// album, but the references aren't restored with it.
+	err = s.db.SoftDeleteAlbum(id, s.now())
+	if err != nil {
+		return apierr.Database(err)
+	}
+	s.audit(r, "delete", "album", id, snapshot(album), s.albumSnapshot(id))
+	for _, ref := range cascade {
+		err := ref.source.RemoveAlbumReferences(id)
+		if err != nil {
+			// Album is already gone, so just log (not much more we can do)
+			s.log.Printf("error removing %s references to deleted album ID %q: %v", ref.typ, id, err)
+		}
+	}
+	return nil
+}
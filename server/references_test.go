@@ -0,0 +1,129 @@
+// Tests for album deletion and reference protection
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestDeleteAlbum(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	ensureAlbumIDs(t, server, []string{"a2"})
+	testGetAlbum(t, server, getAlbumTest{"/albums/a1", http.StatusNotFound, testAlbum{}})
+
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNotFound)
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	// Deleted album shouldn't be found by search either
+	result = serve(t, server, newRequest(t, "GET", "/albums/search?q=beethoven", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var albums []testAlbum
+	unmarshalResponse(t, result, &albums)
+	if len(albums) != 0 {
+		t.Fatalf("got search results %#v, want none", albums)
+	}
+}
+
+func TestDeleteAlbumReferences(t *testing.T) {
+	playlists := newTestReferences(map[string][]string{"a1": {"p2", "p1"}})
+	favorites := newTestReferences(map[string][]string{"a1": {"u1"}, "a2": {"u1"}})
+	orders := newTestReferences(map[string][]string{"a2": {"o1"}})
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles"})
+	db.AddAlbum(Album{ID: "a3", Title: "Abbey Road", Artist: "The Beatles"})
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithReferenceSource("playlist", playlists, ReferenceRestrict),
+		WithReferenceSource("favorite", favorites, ReferenceCascade),
+		WithReferenceSource("order", orders, ReferenceProtect),
+	)
+
+	// Restricted references block deletion unless forced
+	result := serve(t, server, newRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusConflict)
+	data := map[string]interface{}{
+		"referrers": []interface{}{
+			map[string]interface{}{"type": "playlist", "id": "p1"},
+			map[string]interface{}{"type": "playlist", "id": "p2"},
+		},
+		"force_allowed": true,
+	}
+	ensureError(t, result, http.StatusConflict, "referenced", data)
+	ensureAlbumIDs(t, server, []string{"a1", "a2", "a3"})
+
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a1?force=true", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	ensureAlbumIDs(t, server, []string{"a2", "a3"})
+	ensureReferences(t, playlists, "a1", nil)
+	ensureReferences(t, favorites, "a1", nil)
+
+	// Protected references block deletion even when forced
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a2?force=true", nil))
+	ensureStatus(t, result, http.StatusConflict)
+	data = map[string]interface{}{
+		"referrers": []interface{}{
+			map[string]interface{}{"type": "order", "id": "o1"},
+		},
+		"force_allowed": false,
+	}
+	ensureError(t, result, http.StatusConflict, "referenced", data)
+	ensureReferences(t, favorites, "a2", []string{"u1"})
+
+	// Unreferenced albums delete fine
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a3", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	ensureAlbumIDs(t, server, []string{"a2"})
+
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a2?force=maybe", nil))
+	ensureStatus(t, result, http.StatusBadRequest)
+	data = map[string]interface{}{
+		"force": map[string]interface{}{"error": "invalid", "message": "force must be true or false"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+}
+
+// testReferences is a ReferenceSource backed by a map of album ID to
+// referrer IDs.
+type testReferences struct {
+	mu   sync.Mutex
+	refs map[string][]string
+}
+
+func newTestReferences(refs map[string][]string) *testReferences {
+	return &testReferences{refs: refs}
+}
+
+func (r *testReferences) AlbumReferences(albumID string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := append([]string(nil), r.refs[albumID]...)
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (r *testReferences) RemoveAlbumReferences(albumID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.refs, albumID)
+	return nil
+}
+
+func ensureReferences(t *testing.T, r *testReferences, albumID string, want []string) {
+	t.Helper()
+	got, _ := r.AlbumReferences(albumID)
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad references to %q: got %q, want %q", albumID, got, want)
+	}
+}
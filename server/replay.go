@@ -0,0 +1,187 @@
+// Recording and replaying responses, for duplicate and idempotent requests
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// replayStore records recent requests and their responses, so that the
+// response can be replayed for a repeat of the request within ttl.
+type replayStore struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	requests map[string]*recentRequest
+}
+
+// recentRequest is a request recorded in a replayStore. Once done is
+// closed, the response fields are set and must not be modified.
+type recentRequest struct {
+	fingerprint string
+	done        chan struct{}
+	expires     time.Time
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newReplayStore(ttl time.Duration) *replayStore {
+	return &replayStore{
+		ttl:      ttl,
+		requests: make(map[string]*recentRequest),
+	}
+}
+
+// start records the start of a request with the given key. If a request
+// with the same key was seen within the TTL (or is still in progress), it
+// returns that request and true. Otherwise it returns a new in-progress
+// request with the given fingerprint, and false.
+func (d *replayStore) start(key, fingerprint string, now time.Time) (*recentRequest, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	request, ok := d.requests[key]
+	if ok && (!isClosed(request.done) || now.Before(request.expires)) {
+		return request, true
+	}
+	request = &recentRequest{fingerprint: fingerprint, done: make(chan struct{})}
+	d.requests[key] = request
+	return request, false
+}
+
+// runJanitor prunes expired requests every TTL, so the map doesn't grow
+// forever, until ctx is cancelled.
+func (d *replayStore) runJanitor(ctx context.Context, now func() time.Time) {
+	ticker := time.NewTicker(d.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.prune(now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// prune removes requests that finished and expired before now.
+func (d *replayStore) prune(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, request := range d.requests {
+		if isClosed(request.done) && !now.Before(request.expires) {
+			delete(d.requests, key)
+		}
+	}
+}
+
+// finish records the response to an in-progress request. The TTL starts
+// when the response is sent. Server errors aren't remembered, so that a
+// retry after a failure is handled afresh (though requests that were
+// already waiting are given the error response).
+func (d *replayStore) finish(key string, request *recentRequest, now time.Time, status int, header http.Header, body []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	request.status = status
+	request.header = header.Clone()
+	request.body = body
+	request.expires = now.Add(d.ttl)
+	close(request.done)
+	if status >= 500 && d.requests[key] == request {
+		delete(d.requests, key)
+	}
+}
+
+// isClosed reports whether the channel ch has been closed.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// readBody reads the request body and puts it back so the handler can read
+// it too. It returns false (after writing an error response) if the body
+// can't be read.
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("reading request body: %w", err)))
+		return nil, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// serveAndRecord calls h and records its response as the response to the
+// in-progress request in store.
+func (s *Server) serveAndRecord(w http.ResponseWriter, r *http.Request, h http.Handler, store *replayStore, key string, request *recentRequest) {
+	rw := &recordingWriter{ResponseWriter: w}
+	defer func() {
+		// Even if the handler panics, don't leave repeat requests waiting
+		if !rw.wroteHeader {
+			rw.status = http.StatusInternalServerError
+		}
+		store.finish(key, request, s.now(), rw.status, w.Header(), rw.buf.Bytes())
+	}()
+	h.ServeHTTP(rw, r)
+}
+
+// replay waits for original to finish (if it's still in progress) and
+// writes its response, with the extra header set.
+func (s *Server) replay(w http.ResponseWriter, r *http.Request, original *recentRequest, header, value string) {
+	select {
+	case <-original.done:
+	case <-r.Context().Done():
+		return // client went away (or timed out) while waiting
+	}
+	dst := w.Header()
+	for k, vv := range original.header {
+		dst[k] = vv
+	}
+	dst.Set(header, value)
+	w.WriteHeader(original.status)
+	_, err := w.Write(original.body)
+	if err != nil {
+		s.log.Printf("error writing response: %v", err)
+	}
+}
+
+// recordingWriter is a ResponseWriter that records the status and body
+// written to it, as well as passing them through.
+type recordingWriter struct {
+	http.ResponseWriter
+	buf         bytes.Buffer
+	status      int
+	wroteHeader bool
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.buf.Write(p)
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
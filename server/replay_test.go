@@ -0,0 +1,27 @@
+// Tests for recording and replaying responses
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReplayStorePrune(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	d := newReplayStore(time.Second)
+	done, _ := d.start("done", "", now)
+	d.finish("done", done, now, http.StatusOK, http.Header{}, nil)
+	d.start("in-progress", "", now)
+
+	d.prune(now.Add(500 * time.Millisecond))
+	if len(d.requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(d.requests))
+	}
+	// In-progress requests are never pruned, however old
+	d.prune(now.Add(time.Hour))
+	if _, ok := d.requests["in-progress"]; !ok || len(d.requests) != 1 {
+		t.Fatalf("got requests %v, want only in-progress", d.requests)
+	}
+}
@@ -0,0 +1,190 @@
+// Resetting the database, for demo environments and integration tests
+//
+// POST /admin/reset deletes all the albums and genres, and optionally
+// loads a seed fixture: the server's own (see WithSeed) or one given in
+// the request. Because it can't be undone, it takes two requests: the
+// first gets a 428 Precondition Required error with a confirmation token,
+// and the second gives that token back, within five minutes. Tokens can
+// only be used once, and only for the tenant they were issued for.
+//
+// Only the database is reset. Users, orders, favorites, and the audit log
+// are kept, as are blobs (covers and attachments) that other databases may
+// share.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// resetConfirmTTL is how long a reset confirmation token is valid for.
+const resetConfirmTTL = 5 * time.Minute
+
+// Resetter is an optional interface a Database can implement to support
+// POST /admin/reset.
+type Resetter interface {
+	// Reset permanently deletes all albums (with their tracks, versions,
+	// covers, and attachments) and genres.
+	Reset() error
+}
+
+// WithSeed sets the seed fixture POST /admin/reset loads when asked to.
+// Albums are added with version 1, as if they were new; deleted ones are
+// deleted again (at their DeletedAt time) once added.
+func WithSeed(seed DatabaseSnapshot) Option {
+	return func(s *Server) {
+		s.seed = &seed
+	}
+}
+
+// resetConfirmations are the outstanding reset confirmation tokens.
+type resetConfirmations struct {
+	mu     sync.Mutex
+	tokens map[string]resetConfirmation // by token
+}
+
+type resetConfirmation struct {
+	tenant    string
+	expiresAt time.Time
+}
+
+// issue returns a new token for resetting the tenant's database.
+func (c *resetConfirmations) issue(tenant string, now time.Time) (string, time.Time, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(b[:])
+	expiresAt := now.Add(resetConfirmTTL)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for t, confirmation := range c.tokens {
+		if !now.Before(confirmation.expiresAt) {
+			delete(c.tokens, t)
+		}
+	}
+	c.tokens[token] = resetConfirmation{tenant: tenant, expiresAt: expiresAt}
+	return token, expiresAt, nil
+}
+
+// use reports whether token is valid for the tenant, and if so uses it
+// up.
+func (c *resetConfirmations) use(token, tenant string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	confirmation, ok := c.tokens[token]
+	if !ok || confirmation.tenant != tenant || !now.Before(confirmation.expiresAt) {
+		return false
+	}
+	delete(c.tokens, token)
+	return true
+}
+
+// resetInput is the body of POST /admin/reset. Seed loads the server's
+// seed fixture, and Fixture is one to load instead.
+type resetInput struct {
+	Confirm string            `json:"confirm,omitempty"`
+	Seed    bool              `json:"seed,omitempty"`
+	Fixture *DatabaseSnapshot `json:"fixture,omitempty"`
+}
+
+type resetResponse struct {
+	Albums int `json:"albums"` // number of albums loaded
+	Genres int `json:"genres"` // number of genres loaded
+}
+
+func (s *Server) postAdminReset(w http.ResponseWriter, r *http.Request) {
+	resetter, ok := s.db.(Resetter)
+	if !ok {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	var input resetInput
+	if !s.readJSON(w, r, &input) {
+		return
+	}
+	if input.Seed && input.Fixture != nil {
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{
+			"fixture": validationIssue{"conflict", "give seed or fixture, not both"},
+		}))
+		return
+	}
+	if input.Seed && s.seed == nil {
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{
+			"seed": validationIssue{"unavailable", "the server doesn't have a seed fixture"},
+		}))
+		return
+	}
+
+	now := s.now()
+	if input.Confirm == "" {
+		token, expiresAt, err := s.resetConfirms.issue(s.tenant, now)
+		if err != nil {
+			s.writeError(w, r, apierr.Internal(fmt.Errorf("generating reset confirmation token: %w", err)))
+			return
+		}
+		s.writeError(w, r, apierr.PreconditionRequired().WithData(map[string]interface{}{
+			"message":    "this deletes all albums and genres: repeat the request with this confirm token to go ahead",
+			"confirm":    token,
+			"expires_at": expiresAt.UTC(),
+		}))
+		return
+	}
+	if !s.resetConfirms.use(input.Confirm, s.tenant, now) {
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{
+			"confirm": validationIssue{"invalid", "confirm token is invalid, expired, or already used"},
+		}))
+		return
+	}
+
+	err := resetter.Reset()
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("resetting database: %w", err)))
+		return
+	}
+	var seed DatabaseSnapshot
+	switch {
+	case input.Seed:
+		seed = *s.seed
+	case input.Fixture != nil:
+		seed = *input.Fixture
+	}
+	err = LoadSeed(s.db, seed)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("loading seed fixture: %w", err)))
+		return
+	}
+	s.log.Printf("database reset by %s, loaded %d albums and %d genres", s.principal(r).ID, len(seed.Albums), len(seed.Genres))
+	s.writeJSON(w, r, http.StatusOK, resetResponse{Albums: len(seed.Albums), Genres: len(seed.Genres)})
+}
+
+func (d *MemoryDatabase) Reset() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for id := range d.albums {
+		d.releaseCover(id)
+		d.releaseAttachments(id)
+	}
+	d.albums = make(map[string]Album)
+	d.genres = make(map[string]Genre)
+	d.words = make(map[string]map[string]struct{})
+	d.bytes = 0
+	d.history = make(map[string][]Album)
+	d.covers = make(map[string]Cover)
+	d.attachments = make(map[string][]Attachment)
+	d.thumbnails = make(map[string]map[string]Cover)
+	return nil
+}
@@ -0,0 +1,139 @@
+// Tests for resetting the database
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetConfirmToken asks for a reset of the tenant's database (none for
+// the default database) and returns the confirm token from the 428 error.
+func resetConfirmToken(t *testing.T, server *Server, request *http.Request) string {
+	t.Helper()
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusPreconditionRequired)
+	var response struct {
+		Error string `json:"error"`
+		Data  struct {
+			Confirm   string    `json:"confirm"`
+			ExpiresAt time.Time `json:"expires_at"`
+		} `json:"data"`
+	}
+	unmarshalResponse(t, result, &response)
+	if response.Error != "precondition-required" || response.Data.Confirm == "" || response.Data.ExpiresAt.IsZero() {
+		t.Fatalf("bad confirmation response: %+v", response)
+	}
+	return response.Data.Confirm
+}
+
+func TestReset(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	db.AddGenre(Genre{ID: "classical", Name: "Classical"})
+	seed := DatabaseSnapshot{
+		Albums: []Album{
+			{ID: "s1", Title: "Help!", Artist: "The Beatles", Price: 1500},
+			{ID: "s2", Title: "Revolver", Artist: "The Beatles", Price: 1800, DeletedAt: &time.Time{}},
+		},
+		Genres: []Genre{{ID: "rock", Name: "Rock"}},
+	}
+	server := NewServer(db, log.New(io.Discard, "", 0), WithAdminToken(testAdminToken), WithSeed(seed))
+
+	// Only admins can reset
+	result := serve(t, server, newRequest(t, "POST", "/admin/reset", strings.NewReader(`{}`)))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+
+	// Without a confirm token, nothing is deleted
+	token := resetConfirmToken(t, server, newAdminRequest(t, "POST", "/admin/reset", strings.NewReader(`{"seed": true}`)))
+	if _, err := db.GetAlbumByID("a1"); err != nil {
+		t.Fatalf("album deleted before confirmation: %v", err)
+	}
+
+	// With one, the database is reset and the seed loaded
+	result = serve(t, server, newAdminRequest(t, "POST", "/admin/reset", strings.NewReader(`{"seed": true, "confirm": "`+token+`"}`)))
+	ensureStatus(t, result, http.StatusOK)
+	var response resetResponse
+	unmarshalResponse(t, result, &response)
+	if response != (resetResponse{Albums: 2, Genres: 1}) {
+		t.Fatalf("bad reset response: %+v", response)
+	}
+	if _, err := db.GetAlbumByID("a1"); err != ErrDoesNotExist {
+		t.Fatalf("got %v for old album, want ErrDoesNotExist", err)
+	}
+	album, err := db.GetAlbumByID("s1")
+	if err != nil || album.Version != 1 {
+		t.Fatalf("bad seed album: %+v, %v", album, err)
+	}
+	album, err = db.GetAlbumByID("s2")
+	if err != nil || album.DeletedAt == nil {
+		t.Fatalf("seed album should be deleted: %+v, %v", album, err)
+	}
+	genres, err := db.GetGenres()
+	if err != nil || len(genres) != 1 || genres[0].ID != "rock" {
+		t.Fatalf("bad genres after reset: %+v, %v", genres, err)
+	}
+
+	// Tokens can only be used once
+	result = serve(t, server, newAdminRequest(t, "POST", "/admin/reset", strings.NewReader(`{"confirm": "`+token+`"}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"confirm": map[string]interface{}{"error": "invalid", "message": "confirm token is invalid, expired, or already used"},
+	})
+
+	// An inline fixture can be loaded instead, or nothing at all
+	token = resetConfirmToken(t, server, newAdminRequest(t, "POST", "/admin/reset", strings.NewReader(`{}`)))
+	fixture := `{"albums": [{"id": "f1", "title": "Abbey Road", "artist": "The Beatles", "price": 1900}]}`
+	result = serve(t, server, newAdminRequest(t, "POST", "/admin/reset", strings.NewReader(`{"confirm": "`+token+`", "fixture": `+fixture+`}`)))
+	ensureStatus(t, result, http.StatusOK)
+	if _, err := db.GetAlbumByID("f1"); err != nil {
+		t.Fatalf("fixture album not loaded: %v", err)
+	}
+	token = resetConfirmToken(t, server, newAdminRequest(t, "POST", "/admin/reset", strings.NewReader(`{}`)))
+	result = serve(t, server, newAdminRequest(t, "POST", "/admin/reset", strings.NewReader(`{"confirm": "`+token+`"}`)))
+	ensureStatus(t, result, http.StatusOK)
+	albums, err := db.GetAlbums()
+	if err != nil || len(albums) != 0 {
+		t.Fatalf("got albums %+v, %v after empty reset", albums, err)
+	}
+
+	result = serve(t, server, newAdminRequest(t, "POST", "/admin/reset", strings.NewReader(`{"seed": true, "fixture": {}}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"fixture": map[string]interface{}{"error": "conflict", "message": "give seed or fixture, not both"},
+	})
+	server = NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithAdminToken(testAdminToken))
+	result = serve(t, server, newAdminRequest(t, "POST", "/admin/reset", strings.NewReader(`{"seed": true}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"seed": map[string]interface{}{"error": "unavailable", "message": "the server doesn't have a seed fixture"},
+	})
+}
+
+func TestResetTenants(t *testing.T) {
+	server := newTenantTestServer(t, WithCrossTenantAdmin(true))
+
+	// A token issued for one tenant can't reset another's database
+	token := resetConfirmToken(t, server, newTenantRequest(t, "POST", "/admin/reset", "acme", "acme-admin", strings.NewReader(`{}`)))
+	result := serve(t, server, newTenantRequest(t, "POST", "/admin/reset", "globex", testAdminToken, strings.NewReader(`{"confirm": "`+token+`"}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"confirm": map[string]interface{}{"error": "invalid", "message": "confirm token is invalid, expired, or already used"},
+	})
+	result = serve(t, server, newTenantRequest(t, "GET", "/albums/t1", "globex", testAdminToken, nil))
+	ensureStatus(t, result, http.StatusOK)
+
+	result = serve(t, server, newTenantRequest(t, "POST", "/admin/reset", "acme", "acme-admin", strings.NewReader(`{"confirm": "`+token+`"}`)))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newTenantRequest(t, "GET", "/albums/t1", "acme", "acme-admin", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestResetReadOnly(t *testing.T) {
+	server := NewServer(newTestServer().db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithMode(ModeReadOnly, 0),
+	)
+	result := serve(t, server, newAdminRequest(t, "POST", "/admin/reset", strings.NewReader(`{}`)))
+	ensureError(t, result, http.StatusServiceUnavailable, "read-only", nil)
+}
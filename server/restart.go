@@ -0,0 +1,289 @@
+// Zero-downtime restarts, by handing the listening sockets to a new process
+//
+// On SIGUSR2, the server starts a new copy of its binary, with the same
+// arguments and environment, and passes it the listening sockets as
+// inherited file descriptors, so there's never a moment when connections
+// are refused. The new process serves on them as soon as it's started, and
+// then tells the old one it's ready over a pipe. The old one then shuts
+// down gracefully as on SIGTERM (see App.Run): it stops accepting
+// connections and finishes its in-flight requests, while the new one takes
+// all the new connections. If the new process fails to start, or isn't
+// ready within restartReadyTimeout, the old one logs why and keeps
+// running, so a bad deploy doesn't take the service down.
+//
+// To deploy, replace the binary on disk and send the running server
+// SIGUSR2. Only the sockets are handed over, not the in-memory database:
+// the new process loads its -seed fixture, which can be a snapshot
+// written just before (see the snapshot job). And a supervisor that tracks
+// the main process (like systemd with Type=simple) will see it exit, so
+// run the server under one that doesn't, or with socket activation.
+//
+// The sockets are passed as systemd socket activation passes them
+// (LISTEN_FDS and LISTEN_FDNAMES, from file descriptor 3), so the server
+// can also be started by systemd with sockets named "http" and "debug".
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// listenFDsStart is the first inherited listener's file descriptor.
+	listenFDsStart = 3
+
+	// restartReadyEnv names the environment variable with the file
+	// descriptor of the pipe a new process says it's ready on.
+	restartReadyEnv = "RESTART_READY_FD"
+
+	// restartReadyTimeout is how long the old process waits for the new
+	// one to be ready.
+	restartReadyTimeout = 30 * time.Second
+)
+
+// restartReadyMessage is what a new process writes to the ready pipe once
+// it's serving. If it exits before then, the old process reads EOF.
+const restartReadyMessage = "ready\n"
+
+// inheritedListeners returns the listeners passed to this process by the
+// one that started it, by name. It unsets the environment variables that
+// passed them, so they're not passed on to other processes.
+func inheritedListeners() (map[string]net.Listener, error) {
+	fds := os.Getenv("LISTEN_FDS")
+	pid := os.Getenv("LISTEN_PID")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" || pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// Nothing passed, or (with systemd) passed to another process
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	listeners := make(map[string]net.Listener, n)
+	for i := 0; i < n; i++ {
+		name := "unknown" // systemd's name for unnamed sockets
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		if name == "unknown" && i == 0 {
+			name = "http"
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		listener, err := net.FileListener(f)
+		f.Close() // FileListener has its own copy
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inheriting listener %q: %w", name, err)
+		}
+		listeners[name] = listener
+	}
+	return listeners, nil
+}
+
+// restarter is a Component that restarts the server on restartSignals by
+// handing its HTTP components' listeners to a new process, and calls
+// shutdown once the new process is ready. It's added after the HTTP
+// components, so they're listening by the time it starts. If this process
+// was itself started by a restart, starting the restarter tells the old
+// process it's ready.
+type restarter struct {
+	log        *log.Logger
+	shutdown   func()
+	components []namedHTTPComponent
+
+	// command is the command line of the new process. The default (nil)
+	// is this process's executable and arguments.
+	command      []string
+	readyTimeout time.Duration
+
+	signals chan os.Signal
+	done    chan struct{}
+}
+
+type namedHTTPComponent struct {
+	name string
+	*httpComponent
+}
+
+func newRestarter(log *log.Logger, shutdown func()) *restarter {
+	return &restarter{log: log, shutdown: shutdown, readyTimeout: restartReadyTimeout}
+}
+
+// Add adds an HTTP component whose listener is handed over, passed to the
+// new process with the given name.
+func (r *restarter) Add(name string, component *httpComponent) {
+	r.components = append(r.components, namedHTTPComponent{name, component})
+}
+
+func (r *restarter) Start(ctx context.Context) error {
+	err := notifyReady()
+	if err != nil {
+		return err
+	}
+	if len(restartSignals) == 0 {
+		return nil // not supported on this platform
+	}
+	r.signals = make(chan os.Signal, 1)
+	r.done = make(chan struct{})
+	signal.Notify(r.signals, restartSignals...)
+	go func() {
+		for {
+			select {
+			case sig := <-r.signals:
+				r.log.Printf("restarting on %v", sig)
+				process, err := r.restart()
+				if err != nil {
+					r.log.Printf("error restarting, still running: %v", err)
+					continue
+				}
+				r.log.Printf("new process %d is ready", process.Pid)
+				r.shutdown()
+				return
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *restarter) Stop(ctx context.Context) error {
+	if r.signals != nil {
+		signal.Stop(r.signals)
+		close(r.done)
+		r.signals = nil
+	}
+	return nil
+}
+
+// restart starts a new process with the listeners, and waits for it to be
+// ready. If it isn't, it kills the new process and returns an error.
+func (r *restarter) restart() (*os.Process, error) {
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, c := range r.components {
+		l, ok := c.listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("can't hand over %s listener of type %T", c.name, c.listener)
+		}
+		f, err := l.File()
+		if err != nil {
+			return nil, fmt.Errorf("getting %s listener's file: %w", c.name, err)
+		}
+		files = append(files, f)
+		names = append(names, c.name)
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+
+	command := r.command
+	if command == nil {
+		executable, err := os.Executable()
+		if err != nil {
+			readyWriter.Close()
+			return nil, err
+		}
+		command = append([]string{executable}, os.Args[1:]...)
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = restartEnv(os.Environ(), names)
+	err = cmd.Start()
+	readyWriter.Close() // the new process has its own copy
+
+	// Passing the sockets put them in blocking mode (see os.File.Fd), and
+	// they're shared with this process's listeners, so undo that: a
+	// blocking accept could take a connection after the listener is
+	// closed, which would then be dropped
+	for _, c := range r.components {
+		if conn, ok := c.listener.(syscall.Conn); ok {
+			err := setNonblock(conn)
+			if err != nil {
+				r.log.Printf("error setting %s listener to non-blocking: %v", c.name, err)
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("starting new process: %w", err)
+	}
+	// Reap the new process if it exits while this one is still running
+	go cmd.Wait()
+
+	ready.SetReadDeadline(time.Now().Add(r.readyTimeout))
+	b, err := io.ReadAll(io.LimitReader(ready, int64(len(restartReadyMessage))))
+	if string(b) != restartReadyMessage {
+		cmd.Process.Kill()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("new process %d wasn't ready after %v", cmd.Process.Pid, r.readyTimeout)
+		}
+		return nil, fmt.Errorf("new process %d exited before it was ready", cmd.Process.Pid)
+	}
+	return cmd.Process, nil
+}
+
+// restartEnv returns the environment for a new process that's passed the
+// named listeners and then the ready pipe.
+func restartEnv(environ, names []string) []string {
+	var env []string
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, "LISTEN_") || strings.HasPrefix(kv, restartReadyEnv+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		restartReadyEnv+"="+strconv.Itoa(listenFDsStart+len(names)),
+	)
+}
+
+// notifyReady tells the process that started this one, if it's a restart,
+// that it's ready.
+func notifyReady() error {
+	fd := os.Getenv(restartReadyEnv)
+	if fd == "" {
+		return nil
+	}
+	os.Unsetenv(restartReadyEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", restartReadyEnv, fd)
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	defer f.Close()
+	_, err = io.WriteString(f, restartReadyMessage)
+	if err != nil {
+		return fmt.Errorf("notifying old process: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+
+// Restart signals on other systems, which don't support restarts
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals is empty, as restarts need SIGUSR2 and inherited file
+// descriptors, which other platforms (like Windows) don't have.
+var restartSignals []os.Signal
+
+// setNonblock does nothing, as restarts aren't supported.
+func setNonblock(conn syscall.Conn) error {
+	return nil
+}
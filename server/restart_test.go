@@ -0,0 +1,154 @@
+// Tests for zero-downtime restarts
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// restartHelperEnv is set when the test binary is run as the new process
+// of a restart, to say what the helper should do.
+const restartHelperEnv = "TEST_RESTART_HELPER"
+
+// TestRestartHelper isn't a real test: it's the new process started by
+// TestRestart, which serves on the inherited listener.
+func TestRestartHelper(t *testing.T) {
+	switch os.Getenv(restartHelperEnv) {
+	case "":
+		t.Skip("only run by TestRestart")
+	case "exit":
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+		os.Exit(1)
+	}
+	listeners, err := inheritedListeners()
+	if err != nil || listeners["http"] == nil {
+		fmt.Fprintf(os.Stderr, "bad inherited listeners: %v %v\n", listeners, err)
+		os.Exit(1)
+	}
+	component := newHTTPComponent(&http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "new process %d", os.Getpid())
+	})}, log.New(io.Discard, "", 0))
+	component.inherited = listeners["http"]
+	app := NewApp(log.New(io.Discard, "", 0))
+	app.Add("http", component)
+	app.Add("restarts", newRestarter(log.New(io.Discard, "", 0), func() {}))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	app.Run(ctx, time.Second)
+	os.Exit(0)
+}
+
+func TestRestart(t *testing.T) {
+	if len(restartSignals) == 0 {
+		t.Skip("restarts aren't supported on " + runtime.GOOS)
+	}
+	component := newHTTPComponent(&http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "old process")
+	})}, log.New(io.Discard, "", 0))
+	component.server.Addr = "127.0.0.1:0"
+	err := component.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := component.listener.Addr().String()
+	get := func() string {
+		t.Helper()
+		response, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		b, _ := io.ReadAll(response.Body)
+		return string(b)
+	}
+	if got := get(); got != "old process" {
+		t.Fatalf("got %q before restart", got)
+	}
+
+	restarts := newRestarter(log.New(io.Discard, "", 0), nil)
+	restarts.Add("http", component)
+	restart := func(helper string) (*os.Process, error) {
+		t.Setenv(restartHelperEnv, helper)
+		restarts.command = []string{os.Args[0], "-test.run=^TestRestartHelper$"}
+		return restarts.restart()
+	}
+
+	// If the new process fails, the old one keeps serving
+	_, err = restart("exit")
+	if err == nil {
+		t.Fatal("expected error when new process exits")
+	}
+	restarts.readyTimeout = 100 * time.Millisecond
+	_, err = restart("hang")
+	if err == nil {
+		t.Fatal("expected error when new process isn't ready")
+	}
+	if got := get(); got != "old process" {
+		t.Fatalf("got %q after failed restarts", got)
+	}
+
+	// Once the new one is ready, the old one can shut down without the
+	// listener closing
+	restarts.readyTimeout = 10 * time.Second
+	process, err := restart("serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer process.Kill()
+	err = component.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(), fmt.Sprintf("new process %d", process.Pid); got != want {
+		t.Fatalf("got %q after restart, want %q", got, want)
+	}
+}
+
+func TestRestartEnv(t *testing.T) {
+	environ := []string{"HOME=/root", "LISTEN_FDS=1", "LISTEN_PID=42", restartReadyEnv + "=9", "LISTEN_FDNAMES=x"}
+	got := restartEnv(environ, []string{"http", "debug"})
+	want := []string{"HOME=/root", "LISTEN_FDS=2", "LISTEN_FDNAMES=http:debug", restartReadyEnv + "=5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// Listeners for another process (with systemd) are ignored
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", "1")
+	listeners, err := inheritedListeners()
+	if err != nil || listeners != nil {
+		t.Fatalf("got %v, %v for another process's listeners", listeners, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("LISTEN_FDS wasn't unset")
+	}
+	t.Setenv("LISTEN_FDS", "none")
+	_, err = inheritedListeners()
+	if err == nil {
+		t.Fatal("expected error for invalid LISTEN_FDS")
+	}
+}
+
+func TestRestartListenerFile(t *testing.T) {
+	// Only listeners backed by a file (like TCP ones) can be handed over
+	restarts := newRestarter(log.New(io.Discard, "", 0), nil)
+	restarts.Add("http", &httpComponent{listener: fakeListener{}})
+	if _, err := restarts.restart(); err == nil {
+		t.Fatal("expected error for listener without a file")
+	}
+}
+
+// fakeListener is a net.Listener that isn't backed by a file.
+type fakeListener struct{ net.Listener }
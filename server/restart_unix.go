@@ -0,0 +1,29 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+// Restart signals on Unix-like systems
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals are the signals that restart the server (see restarter).
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+// setNonblock puts the socket conn is for into non-blocking mode.
+func setNonblock(conn syscall.Conn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var nonblockErr error
+	err = raw.Control(func(fd uintptr) {
+		nonblockErr = syscall.SetNonblock(int(fd), true)
+	})
+	if err != nil {
+		return err
+	}
+	return nonblockErr
+}
@@ -0,0 +1,325 @@
+// Per-route configuration: timeouts, roles, rate limits, and caching
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Operators can override how individual routes are handled without a code
+// change, using a JSON file given to -route-config. Routes are named by
+// method and OpenAPI path, as in the spec at /openapi.json, and each can
+// set any of these (fields left out keep their defaults):
+//
+//	{
+//	  "GET /albums":        {"timeout": "10s", "cache_ttl": "30s"},
+//	  "POST /albums":       {"role": "admin"},
+//	  "POST /users/login":  {"rate_limit": 5}
+//	}
+//
+//   - timeout replaces -handler-timeout for the route. Streamed responses
+//     still aren't timed out (see timeoutHandler).
+//   - role is the minimum role ("public" or "admin") that can call the
+//     route, which is rejected with 403 Forbidden otherwise. It can only
+//     add a requirement: routes that check for an admin in their handler
+//     still do.
+//   - rate_limit is the number of requests per second the route allows,
+//     across all clients, with bursts of up to the same number. Requests
+//     over the limit get 429 Too Many Requests.
+//   - cache_ttl lets clients and proxies cache successful responses of GET
+//     routes for that long, with "Cache-Control: public, max-age=...".
+//
+// The file is merged over defaultRouteConfigs, and checked against the
+// routes in the OpenAPI spec at startup, so a typo in a route name stops
+// the server rather than being silently ignored. The /v1 routes are
+// configured by their unversioned names.
+
+// RouteConfig is the configuration of a single route. Zero values mean
+// the server-wide default.
+type RouteConfig struct {
+	Timeout   time.Duration
+	Role      Role
+	RateLimit float64 // requests per second
+	CacheTTL  time.Duration
+}
+
+// defaultRouteConfigs are the per-route defaults that -route-config is
+// merged over.
+var defaultRouteConfigs = map[string]RouteConfig{
+	// These only change when the server is upgraded
+	"GET /openapi.json":   {CacheTTL: 5 * time.Minute},
+	"GET /graphql/schema": {CacheTTL: 5 * time.Minute},
+}
+
+// roleNames are the names of roles in route configuration.
+var roleNames = map[string]Role{"public": RolePublic, "admin": RoleAdmin}
+
+// WithRouteConfig sets per-route configuration, by route name (like "GET
+// /albums/{id}"), merged over defaultRouteConfigs. Routes that don't exist
+// are ignored (see readRouteConfig).
+func WithRouteConfig(configs map[string]RouteConfig) Option {
+	return func(s *Server) {
+		s.routeConfigOverrides = configs
+	}
+}
+
+// mergeRouteConfigs returns the defaults with the fields set in overrides
+// replacing theirs.
+func mergeRouteConfigs(defaults, overrides map[string]RouteConfig) map[string]RouteConfig {
+	merged := make(map[string]RouteConfig, len(defaults)+len(overrides))
+	for name, config := range defaults {
+		merged[name] = config
+	}
+	for name, override := range overrides {
+		config := merged[name]
+		if override.Timeout > 0 {
+			config.Timeout = override.Timeout
+		}
+		if override.Role != RolePublic {
+			config.Role = override.Role
+		}
+		if override.RateLimit > 0 {
+			config.RateLimit = override.RateLimit
+		}
+		if override.CacheTTL > 0 {
+			config.CacheTTL = override.CacheTTL
+		}
+		merged[name] = config
+	}
+	return merged
+}
+
+// routeConfigInput is a route's configuration as given in the file.
+type routeConfigInput struct {
+	Timeout   string  `json:"timeout"`
+	Role      string  `json:"role"`
+	RateLimit float64 `json:"rate_limit"`
+	CacheTTL  string  `json:"cache_ttl"`
+}
+
+// readRouteConfig reads the route configuration file given to
+// -route-config, checking that every route exists and every value is
+// valid.
+func readRouteConfig(path string) (map[string]RouteConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var inputs map[string]routeConfigInput
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&inputs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	routes := routeNames()
+	configs := make(map[string]RouteConfig, len(inputs))
+	var problems []string
+	for name, input := range inputs {
+		config, problem := parseRouteConfig(name, input, routes)
+		if problem != "" {
+			problems = append(problems, name+": "+problem)
+			continue
+		}
+		configs[name] = config
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("%s: %s", path, strings.Join(problems, "; "))
+	}
+	return configs, nil
+}
+
+// parseRouteConfig parses the configuration of the named route, returning
+// a description of the problem if it's not valid.
+func parseRouteConfig(name string, input routeConfigInput, routes map[string]bool) (RouteConfig, string) {
+	var config RouteConfig
+	if !routes[name] {
+		return config, "unknown route (must be a method and path in /openapi.json, like \"GET /albums/{id}\")"
+	}
+	var err error
+	if input.Timeout != "" {
+		config.Timeout, err = time.ParseDuration(input.Timeout)
+		if err != nil || config.Timeout <= 0 {
+			return config, fmt.Sprintf("timeout %q must be a positive duration, like 10s", input.Timeout)
+		}
+	}
+	if input.Role != "" {
+		role, ok := roleNames[input.Role]
+		if !ok {
+			return config, fmt.Sprintf("role %q must be public or admin", input.Role)
+		}
+		config.Role = role
+	}
+	if input.RateLimit < 0 {
+		return config, "rate_limit must be a positive number of requests per second"
+	}
+	config.RateLimit = input.RateLimit
+	if input.CacheTTL != "" {
+		if !strings.HasPrefix(name, "GET ") {
+			return config, "cache_ttl can only be set for GET routes"
+		}
+		config.CacheTTL, err = time.ParseDuration(input.CacheTTL)
+		if err != nil || config.CacheTTL < time.Second {
+			return config, fmt.Sprintf("cache_ttl %q must be a duration of at least 1s", input.CacheTTL)
+		}
+	}
+	return config, ""
+}
+
+// routeNames returns the names of the routes in the OpenAPI spec, like
+// "GET /albums/{id}", not including the /v1 ones.
+func routeNames() map[string]bool {
+	names := make(map[string]bool)
+	for path, operations := range buildOpenAPISpec(false).Paths {
+		for method := range operations {
+			names[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+	return names
+}
+
+// routeName returns the name of the route that matches the request, like
+// "GET /albums/{id}", or "" if there's none. HEAD requests are handled by
+// the GET route.
+func routeName(r *http.Request) string {
+	if m := requestRouteMatch(apiRoutes, r); m != nil {
+		return m.name
+	}
+	rte, _ := apiRoutes.match(r)
+	if rte == nil {
+		return ""
+	}
+	return rte.name(r.Method)
+}
+
+// routeConfig returns the name and configuration of the route that matches
+// the request, and whether it has any. It's found when the route is looked
+// up (see withRouteMatch), so it's only a context lookup here.
+func (s *Server) routeConfig(r *http.Request) (string, RouteConfig, bool) {
+	if m := requestRouteMatch(apiRoutes, r); m != nil {
+		return m.name, m.config, m.configured
+	}
+	name := routeName(r)
+	config, ok := s.routeConfigs[name]
+	return name, config, ok
+}
+
+// routeTimeout returns the handler timeout for the request: the route's,
+// or defaultTimeout if it doesn't set one.
+func (s *Server) routeTimeout(r *http.Request, defaultTimeout time.Duration) time.Duration {
+	if _, config, ok := s.routeConfig(r); ok && config.Timeout > 0 {
+		return config.Timeout
+	}
+	return defaultTimeout
+}
+
+// hasRouteTimeouts reports whether any route sets its own timeout.
+func (s *Server) hasRouteTimeouts() bool {
+	for _, config := range s.routeConfigs {
+		if config.Timeout > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// routeConfigHandler applies each route's role, rate limit, and cache TTL.
+// It must be inside authHandler, so the caller's role is known.
+func (s *Server) routeConfigHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, config, ok := s.routeConfig(r)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if s.role(r) < config.Role {
+			s.writeError(w, r, apierr.Forbidden())
+			return
+		}
+		if limiter := s.routeLimiters[name]; limiter != nil {
+			if ok, wait := limiter.allow(s.now()); !ok {
+				s.writeError(w, r, apierr.RateLimited(int(math.Ceil(wait.Seconds()))))
+				return
+			}
+		}
+		if config.CacheTTL > 0 && !isStreaming(r) && r.URL.Path != "/ws" {
+			// WebSocket connections need the real ResponseWriter to take
+			// over the connection, and streams need to flush
+			w = &cacheControlWriter{
+				ResponseWriter: w,
+				value:          fmt.Sprintf("public, max-age=%d", int(config.CacheTTL.Seconds())),
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// cacheControlWriter sets the Cache-Control header of successful
+// responses, replacing any the handler set.
+type cacheControlWriter struct {
+	http.ResponseWriter
+	value       string
+	wroteHeader bool
+}
+
+func (cw *cacheControlWriter) WriteHeader(status int) {
+	if !cw.wroteHeader && status == http.StatusOK {
+		cw.Header().Set("Cache-Control", cw.value)
+	}
+	cw.wroteHeader = true
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheControlWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// rateLimiter is a token bucket that allows rate requests per second on
+// average, in bursts of up to rate requests (or 1, if rate is less).
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := math.Max(1, rate)
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst}
+}
+
+// allow reports whether a request at time now is within the limit. If it
+// isn't, it also returns how long until the next request would be.
+func (l *rateLimiter) allow(now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() && now.After(l.last) {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	if l.last.IsZero() || now.After(l.last) {
+		l.last = now
+	}
+	if l.tokens < 1 {
+		return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+	l.tokens--
+	return true, 0
+}
@@ -0,0 +1,214 @@
+// Tests for per-route configuration
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteConfig(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return now }),
+		WithRouteConfig(map[string]RouteConfig{
+			"POST /albums":        {Role: RoleAdmin},
+			"GET /albums/{id}":    {RateLimit: 2, CacheTTL: time.Minute},
+			"GET /openapi.json":   {RateLimit: 100},
+			"GET /graphql/schema": {CacheTTL: time.Hour},
+		}),
+	)
+	server.db.AddAlbum(Album{ID: "a1", Title: "Help!", Artist: "The Beatles", Price: 1500})
+
+	// Roles are checked on top of the handler's own checks
+	input := `{"title": "Abbey Road", "artist": "The Beatles", "price": 1600}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(input)))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	result = serve(t, server, newRequest(t, "POST", "/v1/albums", strings.NewReader(input)))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	result = serve(t, server, newAdminRequest(t, "POST", "/albums", strings.NewReader(input)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	// Successful responses can be cached, and the rate limit applies to
+	// the route as a whole
+	for _, path := range []string{"/albums/a1", "/v1/albums/a1"} {
+		result = serve(t, server, newRequest(t, "GET", path, nil))
+		ensureStatus(t, result, http.StatusOK)
+		if got := result.Header.Get("Cache-Control"); got != "public, max-age=60" {
+			t.Fatalf("got Cache-Control %q, want public, max-age=60", got)
+		}
+	}
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1", nil))
+	ensureError(t, result, http.StatusTooManyRequests, "rate-limited", nil)
+	if got := result.Header.Get("Retry-After"); got != "1" {
+		t.Fatalf("got Retry-After %q, want 1", got)
+	}
+	now = now.Add(500 * time.Millisecond)
+	result = serve(t, server, newRequest(t, "GET", "/albums/nope", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	if got := result.Header.Get("Cache-Control"); got != "" {
+		t.Fatalf("got Cache-Control %q for error, want none", got)
+	}
+
+	// Other routes with the same path aren't affected, and literal paths
+	// take precedence over templates, as in the router
+	result = serve(t, server, newRequest(t, "GET", "/albums/search?q=help", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Cache-Control"); got != "no-cache" {
+		t.Fatalf("got Cache-Control %q, want no-cache", got)
+	}
+
+	// Overrides are merged with the defaults
+	result = serve(t, server, newRequest(t, "GET", "/openapi.json", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Cache-Control"); got != "public, max-age=300" {
+		t.Fatalf("got Cache-Control %q, want the default", got)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/graphql/schema", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Cache-Control"); got != "public, max-age=3600" {
+		t.Fatalf("got Cache-Control %q, want public, max-age=3600", got)
+	}
+}
+
+func TestRouteTimeout(t *testing.T) {
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithRouteConfig(map[string]RouteConfig{"GET /albums": {Timeout: time.Nanosecond}}),
+	)
+	if !server.hasRouteTimeouts() {
+		t.Fatal("expected route timeouts")
+	}
+	if got := server.routeTimeout(newRequest(t, "GET", "/albums", nil), time.Second); got != time.Nanosecond {
+		t.Fatalf("got timeout %s for GET /albums, want 1ns", got)
+	}
+	if got := server.routeTimeout(newRequest(t, "POST", "/albums", nil), time.Second); got != time.Second {
+		t.Fatalf("got timeout %s for POST /albums, want the default", got)
+	}
+	if got := newTestServer().routeTimeout(newRequest(t, "GET", "/albums", nil), 0); got != 0 {
+		t.Fatalf("got timeout %s without config, want none", got)
+	}
+}
+
+func TestReadRouteConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "routes.json")
+		err := os.WriteFile(path, []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	configs, err := readRouteConfig(write(`{
+		"GET /albums": {"timeout": "10s", "cache_ttl": "30s"},
+		"POST /albums": {"role": "admin", "rate_limit": 0.5}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]RouteConfig{
+		"GET /albums":  {Timeout: 10 * time.Second, CacheTTL: 30 * time.Second},
+		"POST /albums": {Role: RoleAdmin, RateLimit: 0.5},
+	}
+	if len(configs) != len(want) || configs["GET /albums"] != want["GET /albums"] || configs["POST /albums"] != want["POST /albums"] {
+		t.Fatalf("got %+v, want %+v", configs, want)
+	}
+
+	for _, test := range []struct {
+		content string
+		want    string
+	}{
+		{`{"GET /nope": {}}`, "GET /nope: unknown route"},
+		{`{"GET /v1/albums": {}}`, "GET /v1/albums: unknown route"},
+		{`{"PATCH /albums": {}}`, "PATCH /albums: unknown route"},
+		{`{"GET /albums": {"timeout": "soon"}}`, `timeout "soon" must be a positive duration`},
+		{`{"GET /albums": {"role": "root"}}`, `role "root" must be public or admin`},
+		{`{"GET /albums": {"rate_limit": -1}}`, "rate_limit must be a positive number"},
+		{`{"POST /albums": {"cache_ttl": "1m"}}`, "cache_ttl can only be set for GET routes"},
+		{`{"GET /albums": {"cache_ttl": "1ms"}}`, "must be a duration of at least 1s"},
+		{`{"GET /albums": {"ttl": "1m"}}`, `unknown field "ttl"`},
+	} {
+		_, err := readRouteConfig(write(test.content))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want %q", test.content, err, test.want)
+		}
+	}
+
+	// The defaults must be valid routes too
+	routes := routeNames()
+	for name := range defaultRouteConfigs {
+		if !routes[name] {
+			t.Errorf("default route config for unknown route %q", name)
+		}
+	}
+}
+
+func TestRouteName(t *testing.T) {
+	tests := []struct {
+		method, path, name string
+	}{
+		{"GET", "/albums", "GET /albums"},
+		{"GET", "/albums/a%2F1", "GET /albums/{id}"},
+		{"HEAD", "/albums/a1", "GET /albums/{id}"},
+		{"GET", "/albums/lookup", ""}, // no GET handler
+		{"POST", "/albums/lookup", "POST /albums/lookup"},
+		{"GET", "/problems/not-found", "GET /problems/{code}"},
+		{"GET", "/nope", ""},
+	}
+	for _, test := range tests {
+		request := newRequest(t, test.method, test.path, nil)
+		if name := routeName(request); name != test.name {
+			t.Errorf("%s %s: got %q, want %q", test.method, test.path, name, test.name)
+		}
+		// The same when it's looked up once for the whole chain
+		if name := routeName(newTestServer().withRouteMatch(request)); name != test.name {
+			t.Errorf("%s %s: got %q from match, want %q", test.method, test.path, name, test.name)
+		}
+	}
+
+	// A match for another path isn't used
+	request := newTestServer().withRouteMatch(newRequest(t, "GET", "/albums", nil))
+	request.URL.Path = "/genres"
+	if name := routeName(request); name != "GET /genres" {
+		t.Fatalf("got %q for changed path", name)
+	}
+}
+
+func BenchmarkRouteConfig(b *testing.B) {
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithRouteConfig(map[string]RouteConfig{
+		"GET /albums/{id}": {CacheTTL: time.Minute},
+	}))
+	request, err := http.NewRequest("GET", "/albums/a1", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := server.withRouteMatch(request)
+		server.routeTimeout(r, 0)
+		server.routeConfig(r)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(0.5)
+	if ok, _ := limiter.allow(now); !ok {
+		t.Fatal("first request should be allowed")
+	}
+	ok, wait := limiter.allow(now.Add(time.Second))
+	if ok || wait != time.Second {
+		t.Fatalf("got %v, %s, want false, 1s", ok, wait)
+	}
+	if ok, _ := limiter.allow(now.Add(2 * time.Second)); !ok {
+		t.Fatal("request after 2s should be allowed")
+	}
+}
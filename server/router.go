@@ -0,0 +1,549 @@
+// Compiled route table
+//
+// Requests used to be routed by a big switch that tried a regex for each
+// "/albums/:id"-style path in turn, so an unlucky request ran two dozen
+// regexes (and allocated a slice of matches for the one that matched)
+// before it found its handler. Now the routes are registered once, in
+// apiRoutes, and compiled into a tree of path segments. Looking a path up
+// walks the tree one segment at a time: static segments are a map lookup,
+// and parameters are checked by their type's plain Go function, so no
+// regexes run at request time and a lookup doesn't allocate.
+//
+// Patterns use the same syntax as the OpenAPI document's paths:
+//
+//	/albums                    static segments only
+//	/albums/{id:album}         {id:album} matches an album ID (see below)
+//	/orders/{id}               {id} matches any one non-empty segment
+//	/problems/{code:slug}      {code:slug} only matches segments of the type
+//	/static/{name...}          {name...} matches the rest of the path
+//
+// Paths are matched while they're still percent-encoded, and parameters
+// are decoded before they're passed to the handler, so "/albums/a%2F9" is
+// the album "a/9" rather than a 404. Album IDs in paths must be valid (see
+// validateAlbumID), the same as in request bodies, or the request gets a
+// 400 "invalid-id" error.
+//
+// Static segments take precedence over parameters, so "/albums/search"
+// goes to the search handler rather than to "/albums/{id}" with an ID of
+// "search". If the rest of the path doesn't match after a static segment,
+// the lookup backtracks and tries the parameter instead, so "/albums/search/
+// tracks" is still the tracks of the album "search".
+//
+// Each route knows which methods it has handlers for, so a request with any
+// other method gets a 405 Method Not Allowed with an Allow header listing
+// them in the order they were registered, without each route having to
+// spell it out. Every route with a GET handler also answers HEAD, and every
+// route answers OPTIONS, unless it registers its own handlers for them.
+//
+// Each request's route is looked up once, when its path is final (see
+// versionHandler), and kept in the request's context, so middleware that
+// needs to know the route, like per-route configuration (see
+// routeconfig.go), gets it without looking it up again. Routes are named
+// like the OpenAPI operations, by method and path: "GET /albums/{id}".
+//
+// The handlers are method expressions like (*Server).getAlbumByID, called
+// with the server serving the request. That way the table is shared by the
+// per-tenant copies of the server (see tenants.go) rather than built for
+// each one.
+//
+// The benchmarks in router_test.go compare lookups with the old regexes:
+//
+//	go test -run=^$ -bench=RouteLookup
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// maxRouteParams is the most parameters a route pattern may have.
+const maxRouteParams = 2
+
+// routeParams are the values of a route's parameters, in the order they
+// appear in its pattern. It's an array rather than a slice so that looking
+// a route up doesn't allocate.
+type routeParams [maxRouteParams]string
+
+// routeHandler handles a request for a route, given the server and the
+// route's parameters.
+type routeHandler func(s *Server, w http.ResponseWriter, r *http.Request, params routeParams)
+
+// routeParamType is a type of route parameter, given as "{name:type}" in a
+// route pattern.
+type routeParamType struct {
+	// match reports whether a path segment (still percent-encoded) can be
+	// the parameter. If not, the lookup tries other routes, so if none
+	// match the request is a 404 Not Found.
+	match func(segment string) bool
+
+	// check, if not nil, returns the issue with the parameter's decoded
+	// value if it's not valid. It's only called once the route's been
+	// found, so the request is a 400 "invalid-id" error rather than a 404.
+	check func(value string) *validationIssue
+}
+
+// routeParamTypes are the types of parameter that may be given in route
+// patterns. Parameters without a type match any non-empty segment.
+var routeParamTypes = map[string]routeParamType{
+	"":      {match: isSegment},
+	"slug":  {match: isSlug},
+	"album": {match: isSegment, check: validateAlbumID},
+}
+
+// isSegment reports whether s is a non-empty path segment.
+func isSegment(s string) bool {
+	return s != ""
+}
+
+// isSlug reports whether s is one or more lowercase words of letters and
+// digits separated by hyphens, like "not-found".
+func isSlug(s string) bool {
+	if s == "" || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-' && s[i-1] != '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// router is a compiled table of routes. Add routes with handle before
+// using it to look paths up; it's not safe to add routes concurrently
+// with lookups.
+type router struct {
+	root   routeNode
+	routes []*route // in the order they were added
+}
+
+// route is one pattern's handlers.
+type route struct {
+	pattern  string
+	path     string // the OpenAPI path: the pattern without parameter types
+	params   []routeParam
+	handlers []methodHandler
+	allow    string // value of the Allow header for a 405
+}
+
+// routeParam is one of a route's parameters.
+type routeParam struct {
+	name  string
+	check func(value string) *validationIssue
+}
+
+type methodHandler struct {
+	method  string
+	name    string // the route name, like "GET /albums/{id}"
+	handler routeHandler
+}
+
+// routeNode is a node in the tree of path segments. A path matches a node's
+// route if the path has no more segments when the node is reached.
+type routeNode struct {
+	static        map[string]*routeNode
+	param         *routeNode
+	paramType     routeParamType
+	paramTypeName string
+	rest          *route // route for a "{name...}" parameter at this point
+	route         *route
+}
+
+// newRouter returns an empty router.
+func newRouter() *router {
+	return &router{}
+}
+
+// handle adds a handler for requests with the given method and a path
+// matching pattern. The handler is a method expression on *Server taking
+// the request and then one string for each of the pattern's parameters,
+// like (*Server).getAlbumByID. It panics if the pattern is invalid or the
+// handler takes the wrong number of parameters, as routes are only
+// registered at startup.
+func (rt *router) handle(method, pattern string, handler interface{}) {
+	rte := rt.add(pattern)
+	h, nParams := toRouteHandler(handler)
+	if h == nil || nParams != len(rte.params) {
+		panic(fmt.Sprintf("route %s %s: handler %T doesn't take %d parameters", method, pattern, handler, len(rte.params)))
+	}
+	for _, mh := range rte.handlers {
+		if mh.method == method {
+			panic(fmt.Sprintf("route %s %s registered twice", method, pattern))
+		}
+	}
+	rte.handlers = append(rte.handlers, methodHandler{method, method + " " + rte.path, h})
+	rte.allow = rte.allowHeader()
+}
+
+// allowHeader returns the value of the Allow header for the route: its
+// methods in the order they were registered, with HEAD after GET and
+// OPTIONS last if they're handled automatically.
+func (rte *route) allowHeader() string {
+	var methods []string
+	for _, mh := range rte.handlers {
+		methods = append(methods, mh.method)
+		if mh.method == "GET" && rte.handler("HEAD") == nil {
+			methods = append(methods, "HEAD")
+		}
+	}
+	if rte.handler("OPTIONS") == nil {
+		methods = append(methods, "OPTIONS")
+	}
+	return strings.Join(methods, ", ")
+}
+
+// toRouteHandler converts a method expression to a routeHandler, returning
+// the number of parameters it takes, or nil if it's not a handler.
+func toRouteHandler(handler interface{}) (routeHandler, int) {
+	switch h := handler.(type) {
+	case func(*Server, http.ResponseWriter, *http.Request):
+		return func(s *Server, w http.ResponseWriter, r *http.Request, params routeParams) {
+			h(s, w, r)
+		}, 0
+	case func(*Server, http.ResponseWriter, *http.Request, string):
+		return func(s *Server, w http.ResponseWriter, r *http.Request, params routeParams) {
+			h(s, w, r, params[0])
+		}, 1
+	case func(*Server, http.ResponseWriter, *http.Request, string, string):
+		return func(s *Server, w http.ResponseWriter, r *http.Request, params routeParams) {
+			h(s, w, r, params[0], params[1])
+		}, 2
+	default:
+		return nil, -1
+	}
+}
+
+// add returns the route for pattern, adding it to the tree if it's new.
+func (rt *router) add(pattern string) *route {
+	if !strings.HasPrefix(pattern, "/") {
+		panic(fmt.Sprintf("route pattern %q must start with /", pattern))
+	}
+	node := &rt.root
+	var params []routeParam
+	segments := strings.Split(pattern[1:], "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			if strings.ContainsAny(segment, "{}") {
+				panic(fmt.Sprintf("route pattern %q: invalid segment %q", pattern, segment))
+			}
+			if node.static == nil {
+				node.static = make(map[string]*routeNode)
+			}
+			child := node.static[segment]
+			if child == nil {
+				child = &routeNode{}
+				node.static[segment] = child
+			}
+			node = child
+			continue
+		}
+
+		if len(params) == maxRouteParams {
+			panic(fmt.Sprintf("route pattern %q has more than %d parameters", pattern, maxRouteParams))
+		}
+		name := segment[1 : len(segment)-1]
+		if strings.HasSuffix(name, "...") {
+			if i != len(segments)-1 {
+				panic(fmt.Sprintf("route pattern %q: %s must be the last segment", pattern, segment))
+			}
+			params = append(params, routeParam{name: strings.TrimSuffix(name, "...")})
+			if node.rest == nil {
+				node.rest = &route{pattern: pattern, path: openAPIPath(pattern), params: params}
+				rt.routes = append(rt.routes, node.rest)
+			}
+			return node.rest
+		}
+		typeName := ""
+		if colon := strings.IndexByte(name, ':'); colon >= 0 {
+			name, typeName = name[:colon], name[colon+1:]
+		}
+		paramType, ok := routeParamTypes[typeName]
+		if !ok {
+			panic(fmt.Sprintf("route pattern %q: unknown parameter type %q", pattern, typeName))
+		}
+		if node.param == nil {
+			node.param = &routeNode{paramType: paramType, paramTypeName: typeName}
+		} else if node.param.paramTypeName != typeName {
+			panic(fmt.Sprintf("route pattern %q: parameter %s conflicts with the type of an earlier route's", pattern, segment))
+		}
+		params = append(params, routeParam{name: name, check: paramType.check})
+		node = node.param
+	}
+	if node.route == nil {
+		node.route = &route{pattern: pattern, path: openAPIPath(pattern), params: params}
+		rt.routes = append(rt.routes, node.route)
+	}
+	return node.route
+}
+
+// openAPIPath returns the OpenAPI path for a route pattern, which is the
+// pattern without the parameters' types: "/albums/{id:album}" is
+// "/albums/{id}".
+func openAPIPath(pattern string) string {
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if colon := strings.IndexByte(segment, ':'); colon >= 0 && strings.HasPrefix(segment, "{") {
+			segments[i] = segment[:colon] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// lookup returns the route matching path and the values of its
+// parameters, or nil if no route matches. The path should be percent-
+// encoded (as returned by URL.EscapedPath), so that an encoded slash in a
+// parameter doesn't split it in two, and the parameters are returned
+// still encoded.
+func (rt *router) lookup(path string) (*route, routeParams) {
+	var params routeParams
+	if !strings.HasPrefix(path, "/") {
+		return nil, params
+	}
+	rte := rt.root.lookup(path[1:], &params, 0)
+	return rte, params
+}
+
+// lookup matches the rest of a path (without its leading slash) against
+// the node's children, setting params[n:] to the parameters matched.
+func (node *routeNode) lookup(path string, params *routeParams, n int) *route {
+	segment, rest, more := path, "", false
+	if slash := strings.IndexByte(path, '/'); slash >= 0 {
+		segment, rest, more = path[:slash], path[slash+1:], true
+	}
+
+	if child := node.static[segment]; child != nil {
+		if rte := child.next(rest, more, params, n); rte != nil {
+			return rte
+		}
+	}
+	if node.param != nil && node.param.paramType.match(segment) {
+		if rte := node.param.next(rest, more, params, n+1); rte != nil {
+			params[n] = segment
+			return rte
+		}
+	}
+	if node.rest != nil {
+		params[n] = path
+		return node.rest
+	}
+	return nil
+}
+
+// next returns the node's route if the path has no more segments, or
+// otherwise looks the rest of the path up in the node's children.
+func (node *routeNode) next(rest string, more bool, params *routeParams, n int) *route {
+	if !more {
+		return node.route
+	}
+	return node.lookup(rest, params, n)
+}
+
+// handler returns the route's handler for method, or nil if it has none.
+func (rte *route) handler(method string) routeHandler {
+	for _, mh := range rte.handlers {
+		if mh.method == method {
+			return mh.handler
+		}
+	}
+	return nil
+}
+
+// name returns the name of the route's operation for method, like "GET
+// /albums/{id}", or "" if it has no handler for method. HEAD requests are
+// handled by the GET operation, unless the route has its own.
+func (rte *route) name(method string) string {
+	if method == "HEAD" && rte.handler("HEAD") == nil {
+		method = "GET"
+	}
+	for _, mh := range rte.handlers {
+		if mh.method == method {
+			return mh.name
+		}
+	}
+	return ""
+}
+
+// routeMatch is the route found for a request's path (nil if there's
+// none), as kept in its context.
+type routeMatch struct {
+	router *router
+	path   string // escaped path the route was looked up for
+	route  *route
+	params routeParams
+
+	// The name of the route's operation for the request method, and its
+	// configuration, if any (see routeconfig.go)
+	name       string
+	config     RouteConfig
+	configured bool
+}
+
+// routeMatchKey is the context key for the request's *routeMatch.
+type routeMatchKey struct{}
+
+// withRouteMatch looks up the route for the request in the API routes, and
+// returns the request with the match (and the route's configuration) in
+// its context.
+func (s *Server) withRouteMatch(r *http.Request) *http.Request {
+	m := &routeMatch{router: apiRoutes, path: r.URL.EscapedPath()}
+	m.route, m.params = apiRoutes.lookup(m.path)
+	if m.route != nil {
+		m.name = m.route.name(r.Method)
+		m.config, m.configured = s.routeConfigs[m.name]
+	}
+	return r.WithContext(context.WithValue(r.Context(), routeMatchKey{}, m))
+}
+
+// requestRouteMatch returns the route match in the request's context, or
+// nil if there isn't one for rt and the request's current path (as for
+// requests handled without the whole middleware chain).
+func requestRouteMatch(rt *router, r *http.Request) *routeMatch {
+	m, _ := r.Context().Value(routeMatchKey{}).(*routeMatch)
+	if m == nil || m.router != rt || m.path != r.URL.EscapedPath() {
+		return nil
+	}
+	return m
+}
+
+// match returns the route matching the request's path and the values of
+// its parameters (still encoded), using the match in the request's
+// context if there is one.
+func (rt *router) match(r *http.Request) (*route, routeParams) {
+	if m := requestRouteMatch(rt, r); m != nil {
+		return m.route, m.params
+	}
+	return rt.lookup(r.URL.EscapedPath())
+}
+
+// serve looks up the route for the request and calls its handler for the
+// request method. It writes a 404 Not Found if no route matches the path,
+// or a 405 Method Not Allowed if the route has no handler for the method.
+//
+// Routes that don't have their own HEAD or OPTIONS handlers get them
+// automatically: HEAD calls the GET handler without sending the body, and
+// OPTIONS is a 204 No Content listing the allowed methods.
+func (rt *router) serve(s *Server, w http.ResponseWriter, r *http.Request) {
+	rte, params := rt.match(r)
+	if rte == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	handler := rte.handler(r.Method)
+	switch {
+	case handler != nil:
+		if rte.decodeParams(s, w, r, &params) {
+			handler(s, w, r, params)
+		}
+	case r.Method == "HEAD" && rte.handler("GET") != nil:
+		hw := &headWriter{ResponseWriter: w}
+		if rte.decodeParams(s, hw, r, &params) {
+			rte.handler("GET")(s, hw, r, params)
+		}
+		hw.finish()
+	case r.Method == "OPTIONS":
+		w.Header().Set("Allow", rte.allow)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.methodNotAllowed(w, r, rte.allow)
+	}
+}
+
+// decodeParams percent-decodes the route's parameters and checks them
+// against their types. If one isn't valid, it writes a 400 "invalid-id"
+// error with the issue keyed by the parameter's name, and returns false.
+//
+// Requests with malformed escapes like "/albums/%zz" never get here:
+// net/http rejects them with a plain text 400 Bad Request before calling
+// any handler, so they can't get the structured "invalid-id" error. An
+// encoded escape like "%25zz" does get here, and decodes to "%zz", which
+// album ID checks reject.
+func (rte *route) decodeParams(s *Server, w http.ResponseWriter, r *http.Request, params *routeParams) bool {
+	for i, param := range rte.params {
+		value, err := url.PathUnescape(params[i])
+		if err != nil {
+			issue := validationIssue{"invalid", param.name + " must be correctly percent-encoded"}
+			s.writeError(w, r, apierr.InvalidID(map[string]interface{}{param.name: issue}))
+			return false
+		}
+		if param.check != nil {
+			if issue := param.check(value); issue != nil {
+				s.writeError(w, r, apierr.InvalidID(map[string]interface{}{param.name: *issue}))
+				return false
+			}
+		}
+		params[i] = value
+	}
+	return true
+}
+
+// headWriter is a ResponseWriter for a GET handler serving a HEAD request.
+// It discards the body, but holds the headers back until the handler
+// returns so it can set Content-Length to the length of the body the GET
+// response would have had. If the handler flushes, as event streams do,
+// the headers are sent then instead.
+type headWriter struct {
+	http.ResponseWriter
+	status int
+	length int64
+	sent   bool
+}
+
+func (hw *headWriter) WriteHeader(status int) {
+	if status < 200 {
+		hw.ResponseWriter.WriteHeader(status) // informational, like 103 Early Hints
+		return
+	}
+	if hw.status == 0 {
+		hw.status = status
+	}
+}
+
+func (hw *headWriter) Write(p []byte) (int, error) {
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	hw.length += int64(len(p))
+	return len(p), nil
+}
+
+func (hw *headWriter) Flush() {
+	hw.sendHeader()
+	if flusher, ok := hw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish sends the headers if the handler hasn't flushed them, with the
+// body's Content-Length if the handler didn't set one.
+func (hw *headWriter) finish() {
+	if hw.sent {
+		return
+	}
+	header := hw.Header()
+	if hw.length > 0 && header.Get("Content-Length") == "" && header.Get("Transfer-Encoding") == "" {
+		header.Set("Content-Length", strconv.FormatInt(hw.length, 10))
+	}
+	hw.sendHeader()
+}
+
+func (hw *headWriter) sendHeader() {
+	if hw.sent {
+		return
+	}
+	hw.sent = true
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	hw.ResponseWriter.WriteHeader(hw.status)
+}
@@ -0,0 +1,322 @@
+// Tests and benchmarks for the compiled route table
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRouterLookup(t *testing.T) {
+	tests := []struct {
+		path    string
+		pattern string // "" for no match
+		params  routeParams
+	}{
+		{"/albums", "/albums", routeParams{}},
+		{"/albums/a1", "/albums/{id:album}", routeParams{"a1"}},
+		{"/albums/search", "/albums/search", routeParams{}},
+		{"/albums/search/tracks", "/albums/{id:album}/tracks", routeParams{"search"}}, // backtracks
+		{"/albums/a1/attachments/x2", "/albums/{id:album}/attachments/{attachment_id}", routeParams{"a1", "x2"}},
+		{"/albums/a1/barcode.png", "/albums/{id:album}/barcode.png", routeParams{"a1"}},
+		{"/problems/not-found", "/problems/{code:slug}", routeParams{"not-found"}},
+		{"/static/", "/static/{name...}", routeParams{""}},
+		{"/static/css/site.css", "/static/{name...}", routeParams{"css/site.css"}},
+		{"/admin/albums/a1/delete", "/admin/albums/{id:album}/delete", routeParams{"a1"}},
+
+		{"", "", routeParams{}},
+		{"/", "", routeParams{}},
+		{"/albums/", "", routeParams{}},
+		{"//albums", "", routeParams{}},
+		{"/albums//tracks", "", routeParams{}},
+		{"/albums/a1/", "", routeParams{}},
+		{"/albums/a1/nope", "", routeParams{}},
+		{"/problems/Not-Found", "", routeParams{}},
+		{"/problems/not--found", "", routeParams{}},
+		{"/static", "", routeParams{}},
+		{"/nope", "", routeParams{}},
+	}
+	for _, test := range tests {
+		rte, params := apiRoutes.lookup(test.path)
+		pattern := ""
+		if rte != nil {
+			pattern = rte.pattern
+		}
+		if pattern != test.pattern {
+			t.Errorf("%q: got pattern %q, want %q", test.path, pattern, test.pattern)
+			continue
+		}
+		if rte != nil && params != test.params {
+			t.Errorf("%q: got params %q, want %q", test.path, params, test.params)
+		}
+	}
+}
+
+func TestIsSlug(t *testing.T) {
+	for _, s := range []string{"a", "not-found", "v2", "a-b-c"} {
+		if !isSlug(s) {
+			t.Errorf("%q: expected slug", s)
+		}
+	}
+	for _, s := range []string{"", "-", "-a", "a-", "a--b", "A", "a_b", "a.b"} {
+		if isSlug(s) {
+			t.Errorf("%q: expected not slug", s)
+		}
+	}
+}
+
+func TestRouterAllow(t *testing.T) {
+	server := newTestServer()
+	tests := []struct {
+		method, path, allow string
+	}{
+		{"PATCH", "/albums/a1/cover", "GET, HEAD, PUT, DELETE, OPTIONS"},
+		{"POST", "/albums/search", "GET, HEAD, OPTIONS"},
+		{"GET", "/albums/a1/favorite", "PUT, DELETE, OPTIONS"},
+		{"DELETE", "/graphql", "GET, HEAD, POST, OPTIONS"},
+		{"POST", "/static/site.css", "GET, HEAD, OPTIONS"},
+	}
+	for _, test := range tests {
+		result := serve(t, server, newRequest(t, test.method, test.path, nil))
+		ensureError(t, result, http.StatusMethodNotAllowed, "method-not-allowed", nil)
+		if allow := result.Header.Get("Allow"); allow != test.allow {
+			t.Errorf("%s %s: got Allow %q, want %q", test.method, test.path, allow, test.allow)
+		}
+	}
+}
+
+func TestRouterHead(t *testing.T) {
+	// HEAD gets the same headers as GET, with the GET body's length, but
+	// no body
+	server := newTestServer()
+	for _, path := range []string{"/albums", "/albums/a1", "/albums/nope", "/genres"} {
+		get := serve(t, server, newRequest(t, "GET", path, nil))
+		body, _ := io.ReadAll(get.Body)
+		head := serve(t, server, newRequest(t, "HEAD", path, nil))
+		ensureStatus(t, head, get.StatusCode)
+		if got, _ := io.ReadAll(head.Body); len(got) != 0 {
+			t.Fatalf("HEAD %s: got body %q", path, got)
+		}
+		if got, want := head.Header.Get("Content-Length"), strconv.Itoa(len(body)); got != want {
+			t.Fatalf("HEAD %s: got Content-Length %q, want %q", path, got, want)
+		}
+		head.Header.Del("Content-Length")
+		if !reflect.DeepEqual(head.Header, get.Header) {
+			t.Fatalf("HEAD %s: got headers %v, want %v", path, head.Header, get.Header)
+		}
+	}
+
+	// Conditional HEAD requests work like GETs
+	get := serve(t, server, newRequest(t, "GET", "/albums", nil))
+	request := newRequest(t, "HEAD", "/albums", nil)
+	request.Header.Set("If-None-Match", get.Header.Get("ETag"))
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusNotModified)
+	if got := result.Header.Get("Content-Length"); got != "" {
+		t.Fatalf("got Content-Length %q for 304", got)
+	}
+
+	// But not for routes without a GET
+	result = serve(t, server, newRequest(t, "HEAD", "/albums/import", nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+	if allow := result.Header.Get("Allow"); allow != "POST, OPTIONS" {
+		t.Fatalf("got Allow %q, want %q", allow, "POST, OPTIONS")
+	}
+}
+
+func TestRouterOptions(t *testing.T) {
+	server := newTestServer()
+	tests := []struct {
+		path, allow string
+	}{
+		{"/albums", "GET, HEAD, POST, OPTIONS"},
+		{"/albums/a1/attachments/x1", "GET, HEAD, DELETE, OPTIONS"},
+		{"/albums/import", "POST, OPTIONS"},
+		{"/static/site.css", "GET, HEAD, OPTIONS"},
+	}
+	for _, test := range tests {
+		result := serve(t, server, newRequest(t, "OPTIONS", test.path, nil))
+		ensureStatus(t, result, http.StatusNoContent)
+		if allow := result.Header.Get("Allow"); allow != test.allow {
+			t.Errorf("OPTIONS %s: got Allow %q, want %q", test.path, allow, test.allow)
+		}
+		if body, _ := io.ReadAll(result.Body); len(body) != 0 {
+			t.Errorf("OPTIONS %s: got body %q", test.path, body)
+		}
+	}
+
+	result := serve(t, server, newRequest(t, "OPTIONS", "/nope", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestHeadWriterFlush(t *testing.T) {
+	// Streamed responses send their headers when they flush
+	recorder := httptest.NewRecorder()
+	hw := &headWriter{ResponseWriter: recorder}
+	hw.Header().Set("Content-Type", "text/event-stream")
+	hw.WriteHeader(http.StatusOK)
+	hw.Write([]byte(": subscribed\n\n"))
+	hw.Flush()
+	if !recorder.Flushed || recorder.Code != http.StatusOK {
+		t.Fatalf("got flushed %v and status %d", recorder.Flushed, recorder.Code)
+	}
+	hw.Write([]byte(": heartbeat\n\n"))
+	hw.finish()
+	if recorder.Body.Len() != 0 || recorder.Header().Get("Content-Length") != "" {
+		t.Fatalf("got body %q and Content-Length %q", recorder.Body.String(), recorder.Header().Get("Content-Length"))
+	}
+}
+
+func TestRouterHandlePanics(t *testing.T) {
+	handler := (*Server).getAlbumByID
+	tests := []struct {
+		name, method, pattern string
+		handler               interface{}
+	}{
+		{"no slash", "GET", "albums/{id}", handler},
+		{"pattern has no params", "GET", "/albums", handler},
+		{"pattern has two params", "GET", "/albums/{id}/tracks/{n}", handler},
+		{"pattern has three params", "GET", "/{a}/{b}/{c}", handler},
+		{"not a handler", "GET", "/albums/{id}", func(w http.ResponseWriter, r *http.Request, id string) {}},
+		{"unknown type", "GET", "/albums/{id:int}", handler},
+		{"rest not last", "GET", "/static/{name...}/x", handler},
+		{"bad segment", "GET", "/albums/x{id}", handler},
+		{"conflicting type", "GET", "/problems/{code}", handler},
+		{"twice", "GET", "/albums/{id}", handler},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rt := newRouter()
+			rt.handle("GET", "/albums/{id}", handler)
+			rt.handle("GET", "/problems/{code:slug}", (*Server).getProblem)
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected panic for %s %s", test.method, test.pattern)
+				}
+			}()
+			rt.handle(test.method, test.pattern, test.handler)
+		})
+	}
+}
+
+func TestRoutesDocumented(t *testing.T) {
+	// Every API route is in the OpenAPI document, except for the HTML admin
+	// UI and static files
+	spec := openAPISpec()
+	for _, rte := range apiRoutes.routes {
+		if rte.pattern == "/admin" || strings.HasPrefix(rte.pattern, "/admin/") || strings.HasPrefix(rte.pattern, "/static/") {
+			continue
+		}
+		path := routeParamTypeRegexp.ReplaceAllString(rte.pattern, "}")
+		for _, mh := range rte.handlers {
+			if spec.Paths[path][strings.ToLower(mh.method)] == nil {
+				t.Errorf("%s %s isn't in the OpenAPI document", mh.method, path)
+			}
+		}
+	}
+}
+
+// routeParamTypeRegexp matches the ":type}" at the end of typed route
+// parameters, which OpenAPI paths don't have.
+var routeParamTypeRegexp = regexp.MustCompile(`:[a-z]+}`)
+
+// regexpRoute is a route matched the old way, with a regex for each route
+// that has parameters, to compare against in benchmarks.
+type regexpRoute struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// regexpRoutes returns apiRoutes' patterns as regexes, in the order they
+// were registered.
+func regexpRoutes() []regexpRoute {
+	var routes []regexpRoute
+	for _, rte := range apiRoutes.routes {
+		if !strings.Contains(rte.pattern, "{") {
+			routes = append(routes, regexpRoute{pattern: rte.pattern})
+			continue
+		}
+		segments := strings.Split(rte.pattern, "/")
+		for i, segment := range segments {
+			switch {
+			case strings.HasSuffix(segment, "...}"):
+				segments[i] = `(.*)`
+			case strings.HasPrefix(segment, "{"):
+				segments[i] = `([^/]+)`
+			default:
+				segments[i] = regexp.QuoteMeta(segment)
+			}
+		}
+		re := regexp.MustCompile("^" + strings.Join(segments, "/") + "$")
+		routes = append(routes, regexpRoute{pattern: rte.pattern, re: re})
+	}
+	return routes
+}
+
+// lookupRegexp finds the route for path like the old switch in route did,
+// comparing static paths and running regexes in turn.
+func lookupRegexp(routes []regexpRoute, path string) (string, []string) {
+	for _, rte := range routes {
+		if rte.re == nil {
+			if path == rte.pattern {
+				return rte.pattern, nil
+			}
+			continue
+		}
+		matches := rte.re.FindStringSubmatch(path)
+		if len(matches) > 0 {
+			return rte.pattern, matches[1:]
+		}
+	}
+	return "", nil
+}
+
+// benchmarkPaths are request paths from near the start, middle, and end of
+// the route table, and one that doesn't match.
+var benchmarkPaths = []string{
+	"/albums",
+	"/albums/a1",
+	"/albums/a1/versions",
+	"/webhooks/w1/deliveries",
+	"/orders/o1/pay",
+	"/openapi.json",
+	"/nope/nope",
+}
+
+func TestLookupRegexp(t *testing.T) {
+	// Make sure the benchmark compares like with like
+	routes := regexpRoutes()
+	for _, path := range benchmarkPaths {
+		want, _ := apiRoutes.lookup(path)
+		got, _ := lookupRegexp(routes, path)
+		if (want == nil && got != "") || (want != nil && got != want.pattern) {
+			t.Fatalf("%q: regexp lookup got %q, table got %v", path, got, want)
+		}
+	}
+}
+
+func BenchmarkRouteLookup(b *testing.B) {
+	b.Run("regexp", func(b *testing.B) {
+		routes := regexpRoutes()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, path := range benchmarkPaths {
+				lookupRegexp(routes, path)
+			}
+		}
+	})
+	b.Run("table", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, path := range benchmarkPaths {
+				apiRoutes.lookup(path)
+			}
+		}
+	})
+}
@@ -0,0 +1,450 @@
+// Blob storage in an S3-compatible object store
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blobs can be stored in Amazon S3 or any S3-compatible object store (like
+// MinIO) instead of in memory, by setting the database's Blobs to an
+// S3BlobStore. Each blob is an object named by its hash under the
+// "blobs/" prefix; requests are signed with AWS Signature Version 4, and
+// use path-style URLs (https://endpoint/bucket/key), which MinIO and other
+// S3-compatible stores require.
+//
+// S3 has no reference counts, so they're kept in memory, along with the
+// rest of the memory database: the first Put of some content uploads it,
+// and the last Release deletes it. Objects left behind by a restart are
+// harmless, as blobs are immutable and the same content is stored under
+// the same name, so they're simply reused (Scrub still checks them).
+//
+// S3BlobStore also implements BlobPresigner, so large covers can be
+// uploaded and downloaded by clients directly, with pre-signed URLs,
+// rather than through the service (see DirectCoverStore). Uploads are
+// staged under the "uploads/" prefix until they're confirmed; a lifecycle
+// rule on that prefix will clean up ones that never are.
+const (
+	s3Timeout         = 30 * time.Second
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3Config is the location of, and credentials for, an S3 bucket.
+type S3Config struct {
+	Endpoint     string // like https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Region       string
+	Bucket       string
+	Prefix       string // prepended to object names, like "covers/" (optional)
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // for temporary credentials (optional)
+}
+
+// parseS3URL parses an S3 location given as a URL like
+// s3://bucket/prefix?region=us-east-1&endpoint=http://localhost:9000 (as
+// given to the -blob-store flag). The region defaults to us-east-1, and
+// the endpoint to the region's AWS endpoint. Credentials aren't part of
+// the URL, so they don't end up in logs or process listings.
+func parseS3URL(rawURL string) (S3Config, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return S3Config{}, err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return S3Config{}, fmt.Errorf("%q must be like s3://bucket/prefix", rawURL)
+	}
+	query := u.Query()
+	config := S3Config{
+		Endpoint: query.Get("endpoint"),
+		Region:   query.Get("region"),
+		Bucket:   u.Host,
+		Prefix:   strings.TrimPrefix(u.Path, "/"),
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return S3Config{}, fmt.Errorf("endpoint %q must be an http or https URL", config.Endpoint)
+	}
+	if config.Prefix != "" && !strings.HasSuffix(config.Prefix, "/") {
+		config.Prefix += "/"
+	}
+	return config, nil
+}
+
+// S3BlobStore is a BlobStore that keeps blobs in an S3 bucket.
+type S3BlobStore struct {
+	config S3Config
+	client *http.Client
+	now    func() time.Time
+
+	// The first Put and last Release of a blob upload and delete it with
+	// the lock held, so it can't be deleted while it's being added again.
+	lock sync.Mutex
+	refs map[string]int
+}
+
+// NewS3BlobStore creates a blob store that uses the given bucket.
+func NewS3BlobStore(config S3Config) *S3BlobStore {
+	return &S3BlobStore{
+		config: config,
+		client: &http.Client{Timeout: s3Timeout},
+		now:    time.Now,
+		refs:   make(map[string]int),
+	}
+}
+
+func (b *S3BlobStore) Put(data []byte) (string, error) {
+	hash := blobHash(data)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.refs[hash] == 0 {
+		_, err := b.do("PUT", b.blobKey(hash), nil, data)
+		if err != nil {
+			return "", fmt.Errorf("uploading blob %s: %w", hash, err)
+		}
+	}
+	b.refs[hash]++
+	return hash, nil
+}
+
+func (b *S3BlobStore) Get(hash string) ([]byte, error) {
+	data, err := b.do("GET", b.blobKey(hash), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if blobHash(data) != hash {
+		return nil, fmt.Errorf("%w: blob %s", ErrBlobCorrupt, hash)
+	}
+	return data, nil
+}
+
+func (b *S3BlobStore) Release(hash string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	refs := b.refs[hash]
+	if refs == 0 {
+		return ErrDoesNotExist
+	}
+	if refs == 1 {
+		_, err := b.do("DELETE", b.blobKey(hash), nil, nil)
+		if err != nil && !errors.Is(err, ErrDoesNotExist) {
+			return fmt.Errorf("deleting blob %s: %w", hash, err)
+		}
+		delete(b.refs, hash)
+		return nil
+	}
+	b.refs[hash] = refs - 1
+	return nil
+}
+
+// Scrub implements BlobStore by downloading every blob in the bucket
+// (including ones with no references) and checking its hash.
+func (b *S3BlobStore) Scrub() (BlobScrubReport, error) {
+	report := BlobScrubReport{Corrupt: []string{}}
+	prefix := b.blobKey("")
+	continuation := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuation != "" {
+			query.Set("continuation-token", continuation)
+		}
+		body, err := b.do("GET", "", query, nil)
+		if err != nil {
+			return BlobScrubReport{}, fmt.Errorf("listing blobs: %w", err)
+		}
+		var list s3ListResult
+		err = xml.Unmarshal(body, &list)
+		if err != nil {
+			return BlobScrubReport{}, fmt.Errorf("listing blobs: %w", err)
+		}
+		for _, object := range list.Contents {
+			hash := strings.TrimPrefix(object.Key, prefix)
+			data, err := b.do("GET", object.Key, nil, nil)
+			if errors.Is(err, ErrDoesNotExist) {
+				continue // released since it was listed
+			}
+			if err != nil {
+				return BlobScrubReport{}, fmt.Errorf("getting blob %s: %w", hash, err)
+			}
+			report.Blobs++
+			report.Bytes += int64(len(data))
+			if blobHash(data) != hash {
+				report.Corrupt = append(report.Corrupt, hash)
+			}
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			break
+		}
+		continuation = list.NextContinuationToken
+	}
+	sort.Strings(report.Corrupt)
+	return report, nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response that's used.
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key string
+	}
+}
+
+// s3Error is an S3 error response.
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+func (b *S3BlobStore) PresignGet(hash, contentType string, expiry time.Duration) (string, error) {
+	query := url.Values{"response-content-type": {contentType}}
+	return b.config.presign("GET", b.objectURL(b.blobKey(hash), nil), query, expiry, b.now()), nil
+}
+
+func (b *S3BlobStore) PresignUpload(token string, expiry time.Duration) (string, error) {
+	return b.config.presign("PUT", b.objectURL(b.uploadKey(token), nil), nil, expiry, b.now()), nil
+}
+
+func (b *S3BlobStore) TakeUpload(token string, maxBytes int) ([]byte, error) {
+	key := b.uploadKey(token)
+	response, err := b.request("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Don't read more than needed to tell it's too large
+	data, err := io.ReadAll(io.LimitReader(response.Body, int64(maxBytes)+1))
+	response.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("getting upload: %w", err)
+	}
+	// Delete it even if it's too large, as it's no use
+	_, err = b.do("DELETE", key, nil, nil)
+	if err != nil && !errors.Is(err, ErrDoesNotExist) {
+		return nil, fmt.Errorf("deleting upload: %w", err)
+	}
+	if len(data) > maxBytes {
+		return nil, errUploadTooLarge
+	}
+	return data, nil
+}
+
+func (b *S3BlobStore) blobKey(hash string) string {
+	return b.config.Prefix + "blobs/" + hash
+}
+
+func (b *S3BlobStore) uploadKey(token string) string {
+	return b.config.Prefix + "uploads/" + token
+}
+
+// objectURL returns the path-style URL of the object with the given key,
+// or of the bucket if key is "".
+func (b *S3BlobStore) objectURL(key string, query url.Values) *url.URL {
+	u, _ := url.Parse(b.config.Endpoint) // checked by parseS3URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.config.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	// Send the path and query exactly as they're signed
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+	return u
+}
+
+// do makes a signed request to S3 and returns the response body. A 404
+// Not Found response returns ErrDoesNotExist.
+func (b *S3BlobStore) do(method, key string, query url.Values, body []byte) ([]byte, error) {
+	response, err := b.request(method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return io.ReadAll(response.Body)
+}
+
+// request makes a signed request to S3 and returns the response if it's
+// successful, in which case the caller must close its body. A 404 Not
+// Found response returns ErrDoesNotExist.
+func (b *S3BlobStore) request(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, b.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	b.config.sign(request, hex.EncodeToString(sum[:]), b.now())
+	response, err := b.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		return response, nil
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, ErrDoesNotExist
+	}
+	var s3Err s3Error
+	data, _ := io.ReadAll(io.LimitReader(response.Body, 64<<10))
+	_ = xml.Unmarshal(data, &s3Err)
+	if s3Err.Code != "" {
+		return nil, fmt.Errorf("S3 %s %s: %s: %s: %s", method, key, response.Status, s3Err.Code, s3Err.Message)
+	}
+	return nil, fmt.Errorf("S3 %s %s: %s", method, key, response.Status)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the
+// request, signing all its headers and the given hash of its body.
+func (c S3Config) sign(request *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		request.Method,
+		s3Escape(request.URL.Path, false),
+		s3CanonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope, signature := c.signature(amzDate, canonical)
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, signedHeaders, signature))
+}
+
+// presign returns a pre-signed URL for a request with the given method to
+// u, with the given extra query parameters, that's valid for expiry (at
+// most 7 days). Only the host header is signed, so the client can send
+// any others, and the body isn't.
+func (c S3Config) presign(method string, u *url.URL, extra url.Values, expiry time.Duration, now time.Time) string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	query := url.Values{}
+	for name, values := range extra {
+		query[name] = values
+	}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", c.AccessKey+"/"+c.scope(amzDate))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expiry/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if c.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	canonical := strings.Join([]string{
+		method,
+		s3Escape(u.Path, false),
+		s3CanonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+	_, signature := c.signature(amzDate, canonical)
+
+	signed := *u
+	signed.RawPath = s3Escape(u.Path, false)
+	signed.RawQuery = s3CanonicalQuery(query) + "&X-Amz-Signature=" + signature
+	return signed.String()
+}
+
+func (c S3Config) scope(amzDate string) string {
+	return amzDate[:8] + "/" + c.Region + "/s3/aws4_request"
+}
+
+// signature returns the credential scope and the signature of the
+// canonical request made at amzDate.
+func (c S3Config) signature(amzDate, canonical string) (scope, signature string) {
+	scope = c.scope(amzDate)
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + c.SecretKey)
+	for _, part := range []string{amzDate[:8], c.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything in s except unreserved characters
+// (and slashes, unless encodeSlash is true), as Signature Version 4
+// requires. That's not quite what url.PathEscape or url.QueryEscape do.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery returns the query string in Signature Version 4
+// canonical form: sorted by name, then value, and escaped with s3Escape.
+func s3CanonicalQuery(query url.Values) string {
+	escaped := make(map[string][]string, len(query))
+	names := make([]string, 0, len(query))
+	for name, values := range query {
+		name = s3Escape(name, true)
+		names = append(names, name)
+		for _, value := range values {
+			escaped[name] = append(escaped[name], s3Escape(value, true))
+		}
+		sort.Strings(escaped[name])
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range escaped[name] {
+			pairs = append(pairs, name+"="+value)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
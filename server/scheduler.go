@@ -0,0 +1,186 @@
+// Scheduled maintenance jobs
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server runs maintenance jobs periodically: purging albums deleted
+// longer ago than the retention period (see WithDeletedRetention),
+// checking stored blobs for corruption (see WithBlobScrubInterval), and
+// any jobs added with WithJob, like the database snapshots and log
+// rotation configured by the -schedule flag. Each job runs in its own
+// background goroutine, first one interval after the server starts and
+// then every interval after that. A run that takes longer than the
+// interval delays the next one rather than overlapping it, and a run that
+// fails is logged and simply tried again next time.
+//
+// GET /stats reports each job's runs, failures, and last error, so a
+// monitoring system can alert when a job keeps failing or has stopped
+// running.
+
+// Job is a maintenance task the server runs every Interval. Run should
+// return soon after ctx is cancelled.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+}
+
+// WithJob adds a maintenance job to run in the background. A job with a
+// zero interval isn't run, so a configuration can list a job but disable
+// it. If a job with the same name has already been added, an error is
+// logged and the new one isn't run.
+func WithJob(job Job) Option {
+	return func(s *Server) {
+		s.jobConfig = append(s.jobConfig, job)
+	}
+}
+
+// JobStats reports how a scheduled job is doing, for GET /stats.
+type JobStats struct {
+	Name         string     `json:"name"`
+	Interval     string     `json:"interval"` // like "1h0m0s"
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"`
+	Running      bool       `json:"running"`
+	LastRun      *time.Time `json:"last_run,omitempty"` // when it started
+	LastDuration float64    `json:"last_duration_seconds"`
+	LastError    string     `json:"last_error,omitempty"` // cleared by a successful run
+	NextRun      *time.Time `json:"next_run,omitempty"`
+}
+
+// scheduledJob is a job that's been started, with its stats.
+type scheduledJob struct {
+	Job
+	mu    sync.Mutex
+	stats JobStats
+}
+
+// startJobs starts the configured jobs (the built-in ones first).
+func (s *Server) startJobs(builtin []Job) {
+	seen := make(map[string]bool)
+	for _, job := range append(builtin, s.jobConfig...) {
+		if job.Interval <= 0 || job.Run == nil {
+			continue
+		}
+		if seen[job.Name] {
+			s.log.Printf("error scheduling job: duplicate job name %q", job.Name)
+			continue
+		}
+		seen[job.Name] = true
+		scheduled := &scheduledJob{Job: job}
+		scheduled.stats = JobStats{Name: job.Name, Interval: job.Interval.String()}
+		// Set the first run time here rather than in runJob, so a job's
+		// goroutine doesn't use the clock until it first runs
+		scheduled.setNextRun(s.now().Add(job.Interval))
+		s.jobs = append(s.jobs, scheduled)
+		s.background.Go(job.Name, func(ctx context.Context) {
+			s.runJob(ctx, scheduled)
+		})
+	}
+}
+
+// runJob runs job every interval until ctx is cancelled.
+func (s *Server) runJob(ctx context.Context, job *scheduledJob) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.runJobOnce(ctx, job)
+			job.setNextRun(s.now().Add(job.Interval))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runJobOnce runs job and records the outcome in its stats.
+func (s *Server) runJobOnce(ctx context.Context, job *scheduledJob) {
+	started := s.now()
+	job.mu.Lock()
+	job.stats.Running = true
+	job.stats.LastRun = &started
+	job.stats.NextRun = nil
+	job.mu.Unlock()
+
+	err := job.Run(ctx)
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.stats.Running = false
+	job.stats.Runs++
+	job.stats.LastDuration = s.now().Sub(started).Seconds()
+	job.stats.LastError = ""
+	if err != nil {
+		job.stats.Failures++
+		job.stats.LastError = err.Error()
+		if ctx.Err() == nil {
+			s.log.Printf("job %s failed: %v", job.Name, err)
+		}
+	}
+}
+
+func (j *scheduledJob) setNextRun(next time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stats.NextRun = &next
+}
+
+// jobStats returns the stats of the scheduled jobs, sorted by name, or nil
+// if there aren't any.
+func (s *Server) jobStats() []JobStats {
+	var stats []JobStats
+	for _, job := range s.jobs {
+		job.mu.Lock()
+		stats = append(stats, job.stats)
+		job.mu.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// scheduleJobNames are the jobs that can be configured with -schedule.
+var scheduleJobNames = []string{"snapshot", "rotate-logs"}
+
+// parseSchedule parses job intervals given as comma-separated job=interval
+// pairs, like "snapshot=1h,rotate-logs=24h" (as given to the -schedule
+// flag).
+func parseSchedule(s string) (map[string]time.Duration, error) {
+	schedule := make(map[string]time.Duration)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		equals := strings.IndexByte(entry, '=')
+		if equals < 0 {
+			return nil, fmt.Errorf("job %q must be job=interval", entry)
+		}
+		name, value := entry[:equals], entry[equals+1:]
+		known := false
+		for _, jobName := range scheduleJobNames {
+			if name == jobName {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown job %q (must be one of %s)", name, strings.Join(scheduleJobNames, ", "))
+		}
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("interval for %s must be a non-negative duration like 1h", name)
+		}
+		schedule[name] = interval
+	}
+	return schedule, nil
+}
@@ -0,0 +1,116 @@
+// Tests for scheduled maintenance jobs
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForJobRuns waits until the named job has run at least n times, and
+// returns its stats.
+func waitForJobRuns(t *testing.T, server *Server, name string, n int) JobStats {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		for _, stats := range server.jobStats() {
+			if stats.Name == name && stats.Runs >= n && !stats.Running {
+				return stats
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s didn't run %d times", name, n)
+	return JobStats{}
+}
+
+func TestScheduledJobs(t *testing.T) {
+	var runs int32
+	var logBuf bytes.Buffer
+	server := NewServer(NewMemoryDatabase(), log.New(&logBuf, "", 0),
+		WithJob(Job{Name: "count", Interval: time.Millisecond, Run: func(ctx context.Context) error {
+			atomic.AddInt32(&runs, 1)
+			return nil
+		}}),
+		WithJob(Job{Name: "fail", Interval: time.Millisecond, Run: func(ctx context.Context) error {
+			return errors.New("disk full")
+		}}),
+		WithJob(Job{Name: "disabled", Run: func(ctx context.Context) error {
+			t.Errorf("disabled job was run")
+			return nil
+		}}),
+		WithJob(Job{Name: "count", Interval: time.Millisecond, Run: func(ctx context.Context) error {
+			t.Errorf("duplicate job was run")
+			return nil
+		}}),
+	)
+
+	count := waitForJobRuns(t, server, "count", 3)
+	if count.Failures != 0 || count.LastError != "" || count.LastRun == nil || count.Interval != "1ms" {
+		t.Fatalf("bad stats for count: %#v", count)
+	}
+	fail := waitForJobRuns(t, server, "fail", 2)
+	if fail.Failures != fail.Runs || fail.LastError != "disk full" {
+		t.Fatalf("bad stats for fail: %#v", fail)
+	}
+	server.Close()
+	if atomic.LoadInt32(&runs) < 3 {
+		t.Fatalf("got %d runs, want at least 3", runs)
+	}
+
+	// Only the enabled jobs are scheduled, and they're in /stats
+	result := serve(t, server, newRequest(t, "GET", "/stats", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var stats statsResponse
+	unmarshalResponse(t, result, &stats)
+	var names []string
+	for _, job := range stats.Jobs {
+		names = append(names, job.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"count", "fail"}) {
+		t.Fatalf("got jobs %q, want count and fail", names)
+	}
+	logged := logBuf.String()
+	if !strings.Contains(logged, "job fail failed: disk full") || !strings.Contains(logged, `duplicate job name "count"`) {
+		t.Fatalf("bad log output:\n%s", logged)
+	}
+}
+
+func TestBuiltinJobs(t *testing.T) {
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithDeletedRetention(24*time.Hour), WithBlobScrubInterval(time.Minute))
+	defer server.Close()
+	got := make(map[string]string)
+	for _, stats := range server.jobStats() {
+		got[stats.Name] = stats.Interval
+	}
+	want := map[string]string{"purge-deleted": "1h0m0s", "scrub-blobs": "1m0s"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got jobs %v, want %v", got, want)
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	schedule, err := parseSchedule(" snapshot=1h , rotate-logs=24h,")
+	if err != nil {
+		t.Fatalf("error parsing schedule: %v", err)
+	}
+	want := map[string]time.Duration{"snapshot": time.Hour, "rotate-logs": 24 * time.Hour}
+	if !reflect.DeepEqual(schedule, want) {
+		t.Fatalf("got %v, want %v", schedule, want)
+	}
+	for _, bad := range []string{"snapshot", "backup=1h", "snapshot=daily", "snapshot=-1h"} {
+		_, err := parseSchedule(bad)
+		if err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
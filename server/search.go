@@ -0,0 +1,42 @@
+// Album search endpoint
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+func (s *Server) searchAlbums(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if len(searchWords(query)) == 0 {
+		issues := map[string]interface{}{
+			"q": validationIssue{"required", ""},
+		}
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+	includeDeleted, ok := s.includeDeleted(w, r)
+	if !ok {
+		return
+	}
+
+	albums, err := s.db.SearchAlbums(query)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("searching albums for %q: %w", query, err)))
+		return
+	}
+	s.writeJSONWithETag(w, r, s.redactAlbums(r, filterVisible(albums, s.now(), includeDeleted)))
+}
+
+// searchWords splits s into lowercase words for searching. Any run of
+// characters that aren't letters or digits is treated as a separator.
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
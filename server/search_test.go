@@ -0,0 +1,57 @@
+// Tests for the album search endpoint
+
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSearchAlbums(t *testing.T) {
+	server := newTestServer()
+	server.db.AddAlbum(Album{ID: "a3", Title: "Abbey Road", Artist: "The Beatles", Price: 1500})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"beatles", []string{"a2", "a3"}},
+		{"BEAT", []string{"a2", "a3"}},
+		{"the beatles jude", []string{"a2"}},
+		{"symphony", []string{"a1"}},
+		{"9th", []string{"a1"}},
+		{"road, beatles!", []string{"a3"}},
+		{"eatles", []string{}},
+		{"mozart", []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			request := newRequest(t, "GET", "/albums/search", nil)
+			request.URL.RawQuery = "q=" + test.query
+			result := serve(t, server, request)
+			ensureStatus(t, result, http.StatusOK)
+			var albums []testAlbum
+			unmarshalResponse(t, result, &albums)
+			got := []string{}
+			for _, album := range albums {
+				got = append(got, album.ID)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("bad album IDs: got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSearchAlbumsNoQuery(t *testing.T) {
+	server := newTestServer()
+	for _, path := range []string{"/albums/search", "/albums/search?q=", "/albums/search?q=+-+"} {
+		result := serve(t, server, newRequest(t, "GET", path, nil))
+		ensureStatus(t, result, http.StatusBadRequest)
+		data := map[string]interface{}{
+			"q": map[string]interface{}{"error": "required"},
+		}
+		ensureError(t, result, http.StatusBadRequest, "validation", data)
+	}
+}
@@ -0,0 +1,333 @@
+// Seed fixtures: the albums and genres the database starts with
+//
+// By default the server starts with a couple of sample albums, but -seed
+// gives a fixture file to load instead, so a demo or test environment can
+// start with the catalog it needs (and POST /admin/reset can put it back).
+// The format is chosen by the file's extension:
+//
+//   - .json: a database snapshot, as written by the snapshot job or GET
+//     /export, with "albums" and "genres" arrays, or just an array of
+//     albums. Albums are given as for POST /albums.
+//   - .csv: albums only, one per record after a header row naming the
+//     columns. The id, title, and artist columns are required, and price
+//     and genres (separated by semicolons) are optional.
+//
+// Each record is validated as POST /albums (or POST /genres) would, against
+// the fixture's own genres, and must have an ID no earlier record has. All
+// the invalid records are reported together, so a broken fixture can be
+// fixed in one go.
+
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultSeed is the seed fixture the server starts with (and that POST
+// /admin/reset loads if asked to), unless -seed gives another.
+var defaultSeed = DatabaseSnapshot{
+	Albums: []Album{
+		{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795},
+		{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000},
+	},
+	Genres: []Genre{
+		{ID: "classical", Name: "Classical"},
+		{ID: "rock", Name: "Rock"},
+	},
+}
+
+// LoadSeed adds the seed's genres and then its albums to db, as the server
+// does on startup. Deleted albums are added and then deleted again.
+func LoadSeed(db Database, seed DatabaseSnapshot) error {
+	for _, genre := range seed.Genres {
+		err := db.AddGenre(genre)
+		if err != nil {
+			return fmt.Errorf("adding genre %q: %w", genre.ID, err)
+		}
+	}
+	for _, album := range seed.Albums {
+		deletedAt := album.DeletedAt
+		album.DeletedAt = nil
+		_, err := db.AddAlbum(album)
+		if err != nil {
+			return fmt.Errorf("adding album %q: %w", album.ID, err)
+		}
+		if deletedAt != nil {
+			err = db.SoftDeleteAlbum(album.ID, *deletedAt)
+			if err != nil {
+				return fmt.Errorf("deleting album %q: %w", album.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// seedRecord is an album from a seed fixture, before it's validated.
+type seedRecord struct {
+	where string // like "album 3" or "line 4"
+	input albumInput
+	err   error // if the record couldn't be parsed
+}
+
+// seedRecordError is an invalid record in a seed fixture, with the
+// validation issues by field, or a message if it couldn't be parsed.
+type seedRecordError struct {
+	Where   string
+	ID      string
+	Issues  map[string]interface{}
+	Message string
+}
+
+// seedError is the error for a seed fixture with invalid records.
+type seedError struct {
+	Path    string
+	Records []seedRecordError
+}
+
+func (e *seedError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d invalid record(s)", e.Path, len(e.Records))
+	for _, record := range e.Records {
+		fmt.Fprintf(&b, "\n  %s", record.Where)
+		if record.ID != "" {
+			fmt.Fprintf(&b, " (id %q)", record.ID)
+		}
+		b.WriteString(":")
+		if record.Message != "" {
+			b.WriteString(" " + record.Message)
+		}
+		fields := make([]string, 0, len(record.Issues))
+		for field := range record.Issues {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for i, field := range fields {
+			if i > 0 {
+				b.WriteString(";")
+			}
+			issue, ok := record.Issues[field].(validationIssue)
+			switch {
+			case !ok:
+				fmt.Fprintf(&b, " %s: %v", field, record.Issues[field])
+			case issue.Message != "":
+				fmt.Fprintf(&b, " %s: %s (%s)", field, issue.Error, issue.Message)
+			default:
+				fmt.Fprintf(&b, " %s: %s", field, issue.Error)
+			}
+		}
+	}
+	return b.String()
+}
+
+// readSeedFile reads and validates the seed fixture at path, parsing
+// prices with priceMode. If any records are invalid, the error is a
+// *seedError listing them.
+func readSeedFile(path string, priceMode PriceMode) (DatabaseSnapshot, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return DatabaseSnapshot{}, err
+	}
+	var genres []Genre
+	var records []seedRecord
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		genres, records, err = parseSeedJSON(b)
+	case ".csv":
+		records, err = parseSeedCSV(b)
+	default:
+		return DatabaseSnapshot{}, fmt.Errorf("%s: seed file must be .json or .csv, not %q", path, ext)
+	}
+	if err != nil {
+		return DatabaseSnapshot{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return validateSeed(path, genres, records, priceMode)
+}
+
+// parseSeedJSON parses a JSON fixture: a snapshot or an array of albums.
+// Albums that can't be unmarshaled are returned with an error, to be
+// reported with the invalid ones.
+func parseSeedJSON(b []byte) ([]Genre, []seedRecord, error) {
+	var fixture struct {
+		Albums []json.RawMessage `json:"albums"`
+		Genres []Genre           `json:"genres"`
+	}
+	b = bytes.TrimSpace(b)
+	var err error
+	if len(b) > 0 && b[0] == '[' {
+		err = json.Unmarshal(b, &fixture.Albums)
+	} else {
+		err = json.Unmarshal(b, &fixture)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	records := make([]seedRecord, len(fixture.Albums))
+	for i, raw := range fixture.Albums {
+		records[i].where = fmt.Sprintf("album %d", i+1)
+		records[i].err = json.Unmarshal(raw, &records[i].input)
+	}
+	return fixture.Genres, records, nil
+}
+
+// seedCSVColumns are the columns a CSV fixture can have, and whether each
+// is required.
+var seedCSVColumns = map[string]bool{
+	"id":     true,
+	"title":  true,
+	"artist": true,
+	"price":  false,
+	"genres": false,
+}
+
+// parseSeedCSV parses a CSV fixture of albums. Records with the wrong
+// number of fields are returned with an error, to be reported with the
+// invalid ones.
+func parseSeedCSV(b []byte) ([]seedRecord, error) {
+	reader := csv.NewReader(bytes.NewReader(b))
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int) // column index by name
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := seedCSVColumns[name]; !ok {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		if _, ok := columns[name]; ok {
+			return nil, fmt.Errorf("duplicate column %q", name)
+		}
+		columns[name] = i
+	}
+	for name, required := range seedCSVColumns {
+		if _, ok := columns[name]; required && !ok {
+			return nil, fmt.Errorf("missing %q column", name)
+		}
+	}
+
+	var records []seedRecord
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if errors.Is(err, csv.ErrFieldCount) {
+			records = append(records, seedRecord{
+				where: fmt.Sprintf("line %d", line),
+				err:   fmt.Errorf("got %d fields, want %d", len(row), len(header)),
+			})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		cell := func(name string) string {
+			i, ok := columns[name]
+			if !ok {
+				return ""
+			}
+			return strings.TrimSpace(row[i])
+		}
+		input := albumInput{Album: Album{ID: cell("id"), Title: cell("title"), Artist: cell("artist")}}
+		if price := cell("price"); price != "" {
+			input.Price = csvPrice(price)
+		}
+		for _, genre := range strings.Split(cell("genres"), ";") {
+			if genre = strings.TrimSpace(genre); genre != "" {
+				input.Genres = append(input.Genres, genre)
+			}
+		}
+		records = append(records, seedRecord{where: fmt.Sprintf("line %d", line), input: input})
+	}
+	return records, nil
+}
+
+// csvPrice returns a CSV price cell as the JSON parsePrice expects: a
+// number if it looks like one, or else a string (which parsePrice reports
+// the problem with).
+func csvPrice(cell string) json.RawMessage {
+	if cell[0] == '-' || cell[0] >= '0' && cell[0] <= '9' {
+		return json.RawMessage(cell)
+	}
+	b, _ := json.Marshal(cell)
+	return b
+}
+
+// validateSeed validates a fixture's genres and albums, returning them as
+// a snapshot to load with LoadSeed.
+func validateSeed(path string, genres []Genre, records []seedRecord, priceMode PriceMode) (DatabaseSnapshot, error) {
+	// Load the fixture into a scratch database as it's validated, so that
+	// albums' genres are checked against the fixture's, and IDs against
+	// the earlier records'. Validating an album only needs the database
+	// and the price mode.
+	db := NewMemoryDatabase()
+	validator := &Server{db: db, priceMode: priceMode}
+	seed := DatabaseSnapshot{Albums: []Album{}, Genres: []Genre{}}
+	seedErr := &seedError{Path: path}
+
+	for i, genre := range genres {
+		issues := make(map[string]interface{})
+		if genre.ID == "" {
+			issues["id"] = validationIssue{"required", ""}
+		} else if !reGenreID.MatchString(genre.ID) {
+			issues["id"] = validationIssue{"invalid", "id must be lowercase letters and digits separated by hyphens"}
+		}
+		if genre.Name == "" {
+			issues["name"] = validationIssue{"required", ""}
+		}
+		if len(issues) == 0 && errors.Is(db.AddGenre(genre), ErrAlreadyExists) {
+			issues["id"] = validationIssue{"duplicate", "id is used by an earlier genre"}
+		}
+		if len(issues) > 0 {
+			seedErr.Records = append(seedErr.Records, seedRecordError{Where: fmt.Sprintf("genre %d", i+1), ID: genre.ID, Issues: issues})
+			continue
+		}
+		seed.Genres = append(seed.Genres, genre)
+	}
+
+	for _, record := range records {
+		if record.err != nil {
+			seedErr.Records = append(seedErr.Records, seedRecordError{Where: record.where, Message: record.err.Error()})
+			continue
+		}
+		album, issues, err := validator.validateAlbum(record.input, "")
+		if err != nil {
+			return DatabaseSnapshot{}, err
+		}
+		if album.ID == "" {
+			issues["id"] = validationIssue{"required", ""}
+		}
+		if len(issues) == 0 {
+			_, err = db.AddAlbum(album)
+			if errors.Is(err, ErrAlreadyExists) {
+				issues["id"] = validationIssue{"duplicate", "id is used by an earlier album"}
+			} else if err != nil {
+				return DatabaseSnapshot{}, err
+			}
+		}
+		if len(issues) > 0 {
+			seedErr.Records = append(seedErr.Records, seedRecordError{Where: record.where, ID: record.input.ID, Issues: issues})
+			continue
+		}
+		album.DeletedAt = record.input.DeletedAt // validateAlbum clears it
+		seed.Albums = append(seed.Albums, album)
+	}
+
+	if len(seedErr.Records) > 0 {
+		return DatabaseSnapshot{}, seedErr
+	}
+	return seed, nil
+}
@@ -0,0 +1,170 @@
+// Tests for seed fixtures
+
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeSeedFile writes a fixture file with the given name to a temporary
+// directory and returns its path.
+func writeSeedFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadSeedFile(t *testing.T) {
+	want := []Album{
+		{ID: "s1", Title: "Help!", Artist: "The Beatles", Price: 1500, Genres: []string{"rock"}},
+		{ID: "s2", Title: "Kind of Blue", Artist: "Miles Davis", Price: 0},
+	}
+	tests := []struct {
+		name    string
+		content string
+		genres  int
+	}{
+		{"snapshot.json", `{
+			"taken_at": "2026-01-02T03:04:05Z",
+			"genres": [{"id": "rock", "name": "Rock"}],
+			"albums": [
+				{"id": "s1", "title": "Help!", "artist": "The Beatles", "price": 1500, "genres": ["rock"]},
+				{"id": "s2", "title": "Kind of Blue", "artist": "Miles Davis"}
+			]
+		}`, 1},
+		{"albums.json", `[
+			{"id": "s1", "title": "Help!", "artist": "The Beatles", "price": 1500},
+			{"id": "s2", "title": "Kind of Blue", "artist": "Miles Davis"}
+		]`, 0},
+		{"albums.CSV", "ID,Title,Artist,Price\n" +
+			"s1,Help!,The Beatles,1500\n" +
+			"s2,Kind of Blue,Miles Davis,\n", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seed, err := readSeedFile(writeSeedFile(t, test.name, test.content), PriceStrict)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(seed.Genres) != test.genres {
+				t.Fatalf("got %d genres, want %d", len(seed.Genres), test.genres)
+			}
+			wantAlbums := want
+			if test.genres == 0 {
+				wantAlbums = []Album{want[0], want[1]}
+				wantAlbums[0].Genres = nil
+			}
+			if !reflect.DeepEqual(seed.Albums, wantAlbums) {
+				t.Fatalf("got albums %+v, want %+v", seed.Albums, wantAlbums)
+			}
+		})
+	}
+
+	// CSV genres are separated by semicolons, and prices are parsed with
+	// the price mode
+	path := writeSeedFile(t, "albums.csv", "id,title,artist,price,genres\ns1,Help!,The Beatles,15.00,rock; pop\n")
+	_, err := readSeedFile(path, PriceTolerant)
+	var seedErr *seedError
+	if !errors.As(err, &seedErr) || seedErr.Records[0].Issues["genres"] == nil || seedErr.Records[0].Issues["price"] != nil {
+		t.Fatalf("got %v, want unknown genres error only", err)
+	}
+
+	// A snapshot's deleted albums stay deleted
+	path = writeSeedFile(t, "snapshot.json", `{"albums": [{"id": "d1", "title": "Gone", "artist": "X", "deleted_at": "2026-01-02T03:04:05Z"}]}`)
+	seed, err := readSeedFile(path, PriceStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewMemoryDatabase()
+	err = LoadSeed(db, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	album, err := db.GetAlbumByID("d1")
+	if err != nil || album.DeletedAt == nil {
+		t.Fatalf("got %+v, %v, want deleted album", album, err)
+	}
+}
+
+func TestReadSeedFileErrors(t *testing.T) {
+	// Every invalid record is reported
+	path := writeSeedFile(t, "albums.json", `{
+		"genres": [{"id": "rock", "name": "Rock"}, {"id": "Rock!"}, {"id": "rock", "name": "Rock again"}],
+		"albums": [
+			{"id": "ok", "title": "Help!", "artist": "The Beatles"},
+			{"title": "No ID", "artist": "X"},
+			{"id": "ok", "title": "Duplicate", "artist": "X"},
+			{"id": "b1", "price": "12", "genres": ["jazz"]},
+			{"id": 42}
+		]
+	}`)
+	_, err := readSeedFile(path, PriceStrict)
+	var seedErr *seedError
+	if !errors.As(err, &seedErr) {
+		t.Fatalf("got %v, want *seedError", err)
+	}
+	var where []string
+	for _, record := range seedErr.Records {
+		where = append(where, record.Where)
+	}
+	wantWhere := []string{"genre 2", "genre 3", "album 2", "album 3", "album 4", "album 5"}
+	if !reflect.DeepEqual(where, wantWhere) {
+		t.Fatalf("got invalid records %v, want %v", where, wantWhere)
+	}
+	wantLines := []string{
+		path + ": 6 invalid record(s)",
+		`  genre 2 (id "Rock!"): id: invalid (id must be lowercase letters and digits separated by hyphens); name: required`,
+		`  genre 3 (id "rock"): id: duplicate (id is used by an earlier genre)`,
+		`  album 2: id: required`,
+		`  album 3 (id "ok"): id: duplicate (id is used by an earlier album)`,
+		`  album 4 (id "b1"): artist: required; genres: unknown (unknown genre(s) "jazz"); price: invalid-type (price must be an integer number of cents, not a string); title: required`,
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 7 || !reflect.DeepEqual(lines[:6], wantLines) || !strings.HasPrefix(lines[6], "  album 5: json: cannot unmarshal number") {
+		t.Fatalf("bad error message:\n%s", err)
+	}
+
+	// CSV records are reported by line
+	path = writeSeedFile(t, "albums.csv", "id,title,artist\ns1,Help!,The Beatles\ns2,Oops\ns3,,X\n")
+	_, err = readSeedFile(path, PriceStrict)
+	if !errors.As(err, &seedErr) {
+		t.Fatalf("got %v, want *seedError", err)
+	}
+	want := path + ": 2 invalid record(s)\n" +
+		"  line 3: got 2 fields, want 3\n" +
+		`  line 4 (id "s3"): title: required`
+	if err.Error() != want {
+		t.Fatalf("got error:\n%s\nwant:\n%s", err, want)
+	}
+
+	// Problems with the file as a whole
+	for _, test := range []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"albums.txt", "", `seed file must be .json or .csv, not ".txt"`},
+		{"albums.json", `{"albums": 1}`, "parsing"},
+		{"albums.csv", "id,title,year\n", `unknown column "year"`},
+		{"albums.csv", "id,title,title\n", `duplicate column "title"`},
+		{"albums.csv", "id,title\n", `missing "artist" column`},
+	} {
+		_, err := readSeedFile(writeSeedFile(t, test.name, test.content), PriceStrict)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s %q: got %v, want error containing %q", test.name, test.content, err, test.want)
+		}
+	}
+	_, err = readSeedFile(filepath.Join(t.TempDir(), "missing.json"), PriceStrict)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want ErrNotExist", err)
+	}
+}
@@ -0,0 +1,188 @@
+// Signed responses (HTTP Message Signatures)
+
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// The server can sign its responses, so consumers that cache catalog data
+// or receive it through intermediaries (CDNs, proxies) can verify that it
+// came from the API unmodified. Signatures follow RFC 9421 (HTTP Message
+// Signatures) using Ed25519: each response gets a Content-Digest of its
+// body (RFC 9530, as for uploads) and a Date, and the Signature header
+// signs those along with the status code and Content-Type, described by
+// the Signature-Input header:
+//
+//	Content-Digest: sha-256=:<base64>:
+//	Signature-Input: sig1=("@status" "content-type" "content-digest" "date");created=1700000000;keyid="<key ID>";alg="ed25519"
+//	Signature: sig1=:<base64 Ed25519 signature>:
+//
+// Verifiers rebuild the RFC 9421 signature base from those fields, check
+// the signature with the public key, which is served as a JWK (RFC 8037)
+// at GET /signing-key, and check the digest against the body. Including
+// the date lets them reject old responses replayed by an intermediary.
+// To verify responses signed before the key was rotated (see keys.go),
+// verifiers look up the keyid in the set at GET /signing-keys.
+//
+// Streamed responses (NDJSON and server-sent events) and WebSockets aren't
+// signed, as the whole body has to be buffered to sign it.
+
+// WithSigningKey signs responses with the given Ed25519 private key. The
+// default is not to sign them.
+func WithSigningKey(key ed25519.PrivateKey) Option {
+	return func(s *Server) {
+		s.signingKey = key
+	}
+}
+
+// readSigningKey reads an Ed25519 private key from a PEM file in PKCS #8
+// format, as written by "openssl genpkey -algorithm ed25519".
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("signing key must be a PEM \"PRIVATE KEY\" block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ed25519Key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key is a %T, not an Ed25519 key", key)
+	}
+	return ed25519Key, nil
+}
+
+// signingKeyID returns the key ID for the signing key: the first 8 bytes
+// of the SHA-256 hash of its public key, in hex, so it changes when the
+// key does.
+func signingKeyID(key ed25519.PrivateKey) string {
+	return publicKeyID(key.Public().(ed25519.PublicKey))
+}
+
+// publicKeyID returns the key ID for a public key (see signingKeyID).
+func publicKeyID(public ed25519.PublicKey) string {
+	sum := sha256.Sum256(public)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signingHandler buffers each response and signs it before it's written.
+func (s *Server) signingHandler(h http.Handler) http.Handler {
+	keyID := signingKeyID(s.signingKey)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStreaming(r) || r.URL.Path == "/ws" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sw := &signingWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+
+		header := w.Header()
+		digest := sha256.Sum256(sw.buf.Bytes())
+		header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(digest[:])+":")
+		now := s.now()
+		if header.Get("Date") == "" {
+			header.Set("Date", now.UTC().Format(http.TimeFormat))
+		}
+		params, base := signatureBase(sw.status, header, now.Unix(), keyID)
+		signature := ed25519.Sign(s.signingKey, []byte(base))
+		header.Set("Signature-Input", "sig1="+params)
+		header.Set("Signature", "sig1=:"+base64.StdEncoding.EncodeToString(signature)+":")
+
+		w.WriteHeader(sw.status)
+		_, err := w.Write(sw.buf.Bytes())
+		if err != nil {
+			s.log.Printf("error writing response: %v", err)
+		}
+	})
+}
+
+// signatureBase returns the signature parameters and the RFC 9421
+// signature base for a response with the given status and headers. The
+// Content-Type is only covered if the response has one.
+func signatureBase(status int, header http.Header, created int64, keyID string) (params, base string) {
+	fields := []string{"content-type", "content-digest", "date"}
+	components := []string{`"@status"`}
+	lines := []string{`"@status": ` + strconv.Itoa(status)}
+	for _, field := range fields {
+		value := header.Get(field)
+		if value == "" {
+			continue
+		}
+		components = append(components, `"`+field+`"`)
+		lines = append(lines, `"`+field+`": `+strings.TrimSpace(value))
+	}
+	params = fmt.Sprintf(`(%s);created=%d;keyid="%s";alg="ed25519"`, strings.Join(components, " "), created, keyID)
+	lines = append(lines, `"@signature-params": `+params)
+	return params, strings.Join(lines, "\n")
+}
+
+// signingWriter buffers a response so it can be signed.
+type signingWriter struct {
+	http.ResponseWriter
+	buf         bytes.Buffer
+	status      int
+	wroteHeader bool
+}
+
+func (sw *signingWriter) WriteHeader(status int) {
+	if sw.wroteHeader {
+		return
+	}
+	sw.wroteHeader = true
+	sw.status = status
+}
+
+func (sw *signingWriter) Write(p []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.buf.Write(p)
+}
+
+// signingJWK is the public signing key as a JSON Web Key.
+type signingJWK struct {
+	KeyType   string `json:"kty"` // "OKP"
+	Curve     string `json:"crv"` // "Ed25519"
+	X         string `json:"x"`   // public key, base64url-encoded
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"` // "EdDSA"
+	Use       string `json:"use"` // "sig"
+}
+
+func (s *Server) getSigningKey(w http.ResponseWriter, r *http.Request) {
+	if s.signingKey == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, newSigningJWK(s.signingKey.Public().(ed25519.PublicKey)))
+}
+
+// newSigningJWK returns the JSON Web Key for a public signing key.
+func newSigningJWK(public ed25519.PublicKey) signingJWK {
+	return signingJWK{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(public),
+		KeyID:     publicKeyID(public),
+		Algorithm: "EdDSA",
+		Use:       "sig",
+	}
+}
@@ -0,0 +1,156 @@
+// Tests for signed responses (HTTP Message Signatures)
+
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSigningTestServer(t *testing.T) (*Server, ed25519.PrivateKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	server := NewServer(db, log.New(io.Discard, "", 0), WithSigningKey(key), WithClock(func() time.Time { return now }))
+	return server, key
+}
+
+var reSignatureInput = regexp.MustCompile(`^sig1=\(([^)]*)\);created=(\d+);keyid="([0-9a-f]+)";alg="ed25519"$`)
+
+// verifySignature checks a response's signature the way a consumer would,
+// by rebuilding the signature base from the response, and returns its
+// key ID.
+func verifySignature(t *testing.T, response *http.Response, body []byte, public ed25519.PublicKey) (keyID string, ok bool) {
+	t.Helper()
+	input := response.Header.Get("Signature-Input")
+	matches := reSignatureInput.FindStringSubmatch(input)
+	if matches == nil {
+		t.Fatalf("bad Signature-Input: %q", input)
+	}
+	var lines []string
+	for _, component := range strings.Fields(matches[1]) {
+		name := strings.Trim(component, `"`)
+		if name == "@status" {
+			lines = append(lines, component+": "+strconv.Itoa(response.StatusCode))
+		} else {
+			lines = append(lines, component+": "+response.Header.Get(name))
+		}
+	}
+	lines = append(lines, `"@signature-params": `+strings.TrimPrefix(input, "sig1="))
+	signature, err := base64.StdEncoding.DecodeString(strings.Trim(strings.TrimPrefix(response.Header.Get("Signature"), "sig1="), ":"))
+	if err != nil {
+		t.Fatalf("bad Signature: %v", err)
+	}
+	sum := sha256.Sum256(body)
+	digestOK := response.Header.Get("Content-Digest") == "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":"
+	return matches[3], digestOK && ed25519.Verify(public, []byte(strings.Join(lines, "\n")), signature)
+}
+
+func TestSignedResponses(t *testing.T) {
+	server, key := newSigningTestServer(t)
+	public := key.Public().(ed25519.PublicKey)
+
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	body, _ := io.ReadAll(result.Body)
+	keyID, ok := verifySignature(t, result, body, public)
+	if !ok {
+		t.Fatalf("signature didn't verify")
+	}
+	if got, want := result.Header.Get("Signature-Input"), `sig1=("@status" "content-type" "content-digest" "date");created=1704207845;keyid="`+keyID+`";alg="ed25519"`; got != want {
+		t.Fatalf("got Signature-Input %q, want %q", got, want)
+	}
+	if got := result.Header.Get("Date"); got != "Tue, 02 Jan 2024 15:04:05 GMT" {
+		t.Fatalf("got Date %q", got)
+	}
+
+	// A tampered body or status doesn't verify
+	if _, ok := verifySignature(t, result, []byte(strings.Replace(string(body), "795", "1", 1)), public); ok {
+		t.Fatalf("tampered body verified")
+	}
+	result.StatusCode = http.StatusNotFound
+	if _, ok := verifySignature(t, result, body, public); ok {
+		t.Fatalf("tampered status verified")
+	}
+
+	// Errors and empty responses are signed too
+	result = serve(t, server, newRequest(t, "GET", "/albums/x", nil))
+	ensureStatus(t, result, http.StatusNotFound)
+	body, _ = io.ReadAll(result.Body)
+	if _, ok := verifySignature(t, result, body, public); !ok {
+		t.Fatalf("error response signature didn't verify")
+	}
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	if _, ok := verifySignature(t, result, nil, public); !ok {
+		t.Fatalf("empty response signature didn't verify")
+	}
+
+	// Streamed responses aren't signed
+	result = serve(t, server, newNDJSONRequest(t, "/albums"))
+	ensureStatus(t, result, http.StatusOK)
+	if result.Header.Get("Signature") != "" {
+		t.Fatalf("streamed response was signed")
+	}
+
+	// The public key is available as a JWK
+	result = serve(t, server, newRequest(t, "GET", "/signing-key", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var jwk signingJWK
+	unmarshalResponse(t, result, &jwk)
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	if jwk.KeyType != "OKP" || jwk.Curve != "Ed25519" || jwk.KeyID != keyID || !public.Equal(ed25519.PublicKey(x)) {
+		t.Fatalf("bad JWK: %#v", jwk)
+	}
+}
+
+func TestUnsignedResponses(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	for _, header := range []string{"Signature", "Signature-Input", "Content-Digest"} {
+		if got := result.Header.Get(header); got != "" {
+			t.Errorf("got %s %q, want none", header, got)
+		}
+	}
+	result = serve(t, server, newRequest(t, "GET", "/signing-key", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestReadSigningKey(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("error marshaling key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	got, err := readSigningKey(path)
+	if err != nil || !got.Equal(key) {
+		t.Fatalf("got key %v, error %v", got, err)
+	}
+
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+	if _, err := readSigningKey(path); err == nil {
+		t.Fatalf("expected error for wrong PEM type")
+	}
+}
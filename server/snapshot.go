@@ -0,0 +1,80 @@
+// Database snapshots
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The snapshot job (-schedule snapshot=1h -snapshot-file albums.json)
+// writes the database's albums and genres to a JSON file, so the data
+// in the in-memory database isn't all lost if the server dies. The file
+// is replaced atomically: the snapshot is written to a temporary file in
+// the same directory, which is then renamed over the old one, so a crash
+// part way through leaves the previous snapshot intact. Covers and
+// attachments aren't included, as they can be large; they're kept in the
+// BlobStore, which should be backed up separately.
+
+// DatabaseSnapshot is a point-in-time copy of the albums (including
+// deleted ones, sorted by ID) and genres in a database.
+type DatabaseSnapshot struct {
+	TakenAt time.Time `json:"taken_at"`
+	Albums  []Album   `json:"albums"`
+	Genres  []Genre   `json:"genres"`
+}
+
+// takeDatabaseSnapshot returns a snapshot of db. Albums and genres are
+// fetched separately, so a change made between the two may be only
+// partly reflected.
+func takeDatabaseSnapshot(db Database, now time.Time) (DatabaseSnapshot, error) {
+	albums, err := db.GetAlbums()
+	if err != nil {
+		return DatabaseSnapshot{}, fmt.Errorf("getting albums: %w", err)
+	}
+	genres, err := db.GetGenres()
+	if err != nil {
+		return DatabaseSnapshot{}, fmt.Errorf("getting genres: %w", err)
+	}
+	return DatabaseSnapshot{TakenAt: now.UTC(), Albums: albums, Genres: genres}, nil
+}
+
+// writeSnapshotFile atomically replaces the file at path with snapshot.
+func writeSnapshotFile(path string, snapshot DatabaseSnapshot) error {
+	b, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once it's been renamed
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// snapshotJob returns a job that writes a snapshot of db to the file at
+// path every interval.
+func snapshotJob(db Database, path string, interval time.Duration, now func() time.Time) Job {
+	return Job{Name: "snapshot", Interval: interval, Run: func(ctx context.Context) error {
+		snapshot, err := takeDatabaseSnapshot(db, now())
+		if err != nil {
+			return err
+		}
+		return writeSnapshotFile(path, snapshot)
+	}}
+}
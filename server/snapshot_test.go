@@ -0,0 +1,65 @@
+// Tests for database snapshots
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotJob(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000})
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	db.AddGenre(Genre{ID: "rock", Name: "Rock"})
+	db.SoftDeleteAlbum("a2", db.now())
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "albums.json")
+	err := os.WriteFile(path, []byte("old snapshot"), 0o644)
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	job := snapshotJob(db, path, time.Hour, func() time.Time { return now })
+	err = job.Run(context.Background())
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading snapshot: %v", err)
+	}
+	var snapshot DatabaseSnapshot
+	err = json.Unmarshal(b, &snapshot)
+	if err != nil {
+		t.Fatalf("error unmarshaling snapshot: %v", err)
+	}
+	if !snapshot.TakenAt.Equal(now) || len(snapshot.Albums) != 2 || snapshot.Albums[0].ID != "a1" ||
+		snapshot.Albums[1].DeletedAt == nil || len(snapshot.Genres) != 1 {
+		t.Fatalf("bad snapshot: %#v", snapshot)
+	}
+
+	// The temporary file has been renamed, so it's the only file
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("got %d files, want 1", len(entries))
+	}
+}
+
+func TestSnapshotJobError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "albums.json")
+	job := snapshotJob(NewMemoryDatabase(), path, time.Hour, time.Now)
+	if err := job.Run(context.Background()); err == nil {
+		t.Fatalf("expected error writing to missing directory")
+	}
+	job = snapshotJob(errorDatabase{}, filepath.Join(t.TempDir(), "albums.json"), time.Hour, time.Now)
+	if err := job.Run(context.Background()); err == nil {
+		t.Fatalf("expected database error")
+	}
+}
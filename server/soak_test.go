@@ -0,0 +1,200 @@
+// Soak test: drive mixed traffic against the server and check for leaks
+
+package server
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// By default the soak test only runs briefly, to keep the harness itself
+// working. Use "go test -run Soak -soak 5m" for a real soak.
+var soakDuration = flag.Duration("soak", 0, "run the soak test for this long (default is a short smoke run)")
+
+func TestSoak(t *testing.T) {
+	duration := *soakDuration
+	if duration == 0 {
+		if testing.Short() {
+			t.Skip("skipping soak test in short mode")
+		}
+		duration = 300 * time.Millisecond
+	}
+
+	goroutinesBefore := runtime.NumGoroutine()
+	heapBefore := heapAlloc()
+
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000})
+	db.AddGenre(Genre{ID: "rock", Name: "Rock"})
+	server := NewServer(db, log.New(io.Discard, "", 0),
+		WithHandlerTimeout(time.Second),
+		WithMaxInFlight(100),
+		WithDuplicateWindow(100*time.Millisecond),
+		WithDeletedRetention(10*time.Millisecond),
+	)
+	httpServer := httptest.NewServer(server)
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	// Each worker runs the mix of requests in a loop until the deadline,
+	// recording the latency of each request in order
+	const workers = 8
+	deadline := time.Now().Add(duration)
+	latencies := make([][]time.Duration, workers)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for n := 0; time.Now().Before(deadline); n++ {
+				for _, step := range soakSteps(worker, n) {
+					start := time.Now()
+					err := soakRequest(client, httpServer.URL, step)
+					if err != nil {
+						errs <- fmt.Errorf("worker %d: %v", worker, err)
+						return
+					}
+					latencies[worker] = append(latencies[worker], time.Since(start))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	httpServer.Close()
+	client.CloseIdleConnections()
+	err := server.Close()
+	if err != nil {
+		t.Errorf("error closing server: %v", err)
+	}
+
+	// Latency shouldn't degrade over the run: compare the slowest requests
+	// in the first and last tenth of each worker's requests
+	var first, last []time.Duration
+	for _, l := range latencies {
+		tenth := len(l) / 10
+		first = append(first, l[:tenth]...)
+		last = append(last, l[len(l)-tenth:]...)
+	}
+	firstP99, lastP99 := percentile(first, 99), percentile(last, 99)
+	t.Logf("%d requests, p99 latency first %s, last %s", countLatencies(latencies), firstP99, lastP99)
+	if lastP99 > 5*firstP99 && lastP99 > 50*time.Millisecond {
+		t.Errorf("latency degraded: p99 went from %s to %s", firstP99, lastP99)
+	}
+
+	// All goroutines started by the server should exit
+	ensureNoGoroutineLeak(t, goroutinesBefore)
+
+	// The traffic deletes what it adds (and deleted albums are purged soon
+	// after), so memory shouldn't grow much
+	heapAfter := heapAlloc()
+	t.Logf("heap before %d bytes, after %d bytes", heapBefore, heapAfter)
+	if heapAfter > 2*heapBefore+16<<20 {
+		t.Errorf("heap grew from %d to %d bytes", heapBefore, heapAfter)
+	}
+}
+
+// soakStep is a single request and its expected response status.
+type soakStep struct {
+	method string
+	path   string
+	body   string
+	status int
+}
+
+// soakSteps returns the mix of requests made on worker's nth iteration.
+func soakSteps(worker, n int) []soakStep {
+	id := fmt.Sprintf("soak-%d-%d", worker, n)
+	album := fmt.Sprintf(`{"id": %q, "title": "Soak %d", "artist": "Worker %d", "genres": ["rock"]}`, id, n, worker)
+	return []soakStep{
+		{"GET", "/albums", "", http.StatusOK},
+		{"GET", "/albums/a1", "", http.StatusOK},
+		{"GET", "/albums/search?q=jude", "", http.StatusOK},
+		{"GET", "/albums?genre=rock", "", http.StatusOK},
+		{"POST", "/albums", album, http.StatusCreated},
+		{"POST", "/albums/" + id + "/tracks", `{"title": "Track", "duration": 60}`, http.StatusCreated},
+		{"POST", "/albums/lookup", `{"ids": ["a1", "` + id + `", "nope"]}`, http.StatusOK},
+		{"POST", "/albums", `{"title": ""}`, http.StatusBadRequest},
+		{"DELETE", "/albums/" + id, "", http.StatusNoContent},
+		{"GET", "/albums/" + id, "", http.StatusNotFound},
+		{"GET", "/stats", "", http.StatusOK},
+	}
+}
+
+func soakRequest(client *http.Client, baseURL string, step soakStep) error {
+	request, err := http.NewRequest(step.method, baseURL+step.path, strings.NewReader(step.body))
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(io.Discard, response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != step.status {
+		return fmt.Errorf("%s %s: got status %d, want %d", step.method, step.path, response.StatusCode, step.status)
+	}
+	return nil
+}
+
+// ensureNoGoroutineLeak waits for the number of goroutines to drop back to
+// before, failing with a dump of the goroutines if it doesn't.
+func ensureNoGoroutineLeak(t *testing.T, before int) {
+	t.Helper()
+	var after int
+	for i := 0; i < 100; i++ {
+		after = runtime.NumGoroutine()
+		if after <= before {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	t.Errorf("goroutine leak: %d before, %d after:\n%s", before, after, buf)
+}
+
+// heapAlloc returns the bytes allocated on the heap after a GC.
+func heapAlloc() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// percentile returns the pth percentile of durations.
+func percentile(durations []time.Duration, p int) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func countLatencies(latencies [][]time.Duration) int {
+	n := 0
+	for _, l := range latencies {
+		n += len(l)
+	}
+	return n
+}
@@ -0,0 +1,157 @@
+// Soft deletion of albums, with restore and eventual purging
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// WithDeletedRetention sets how long deleted albums are kept (and can be
+// restored) before they're purged for good. The default of zero keeps
+// them forever.
+func WithDeletedRetention(retention time.Duration) Option {
+	return func(s *Server) {
+		s.deletedRetention = retention
+	}
+}
+
+// Maximum time between purges of deleted albums.
+const maxPurgeInterval = time.Hour
+
+// purgeJob returns the scheduled job that purges albums deleted more than
+// the retention period ago, from every tenant's database too.
+func (s *Server) purgeJob() Job {
+	interval := s.deletedRetention
+	if interval > maxPurgeInterval {
+		interval = maxPurgeInterval
+	}
+	return Job{Name: "purge-deleted", Interval: interval, Run: func(ctx context.Context) error {
+		dbs, err := s.databases()
+		if err != nil {
+			return err
+		}
+		n := 0
+		for _, db := range dbs {
+			purged, err := db.PurgeDeletedAlbums(s.now().Add(-s.deletedRetention))
+			if err != nil {
+				return fmt.Errorf("purging deleted albums: %w", err)
+			}
+			n += purged
+		}
+		if n > 0 {
+			s.log.Printf("purged %d deleted albums", n)
+		}
+		return nil
+	}}
+}
+
+// includeDeleted parses the optional "include_deleted" query parameter,
+// which only admins may set to true. It writes an error response and
+// returns false for ok if the parameter is invalid or not allowed.
+func (s *Server) includeDeleted(w http.ResponseWriter, r *http.Request) (include, ok bool) {
+	issues := make(map[string]interface{})
+	include = boolParam(r.URL.Query().Get("include_deleted"), "include_deleted", issues)
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return false, false
+	}
+	if include && !s.requireAdmin(w, r) {
+		return false, false
+	}
+	return include, true
+}
+
+// boolParam parses an optional boolean query parameter, returning false if
+// it's empty. If it's not a valid boolean, it adds an issue to issues for
+// the given parameter name.
+func boolParam(value string, name string, issues map[string]interface{}) bool {
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		issues[name] = validationIssue{"invalid", name + " must be true or false"}
+		return false
+	}
+	return b
+}
+
+func (s *Server) restoreAlbum(w http.ResponseWriter, r *http.Request, id string) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	before := s.albumSnapshot(id)
+	album, err := s.db.RestoreAlbum(id)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("restoring album ID %q: %w", id, err)))
+		return
+	}
+	s.audit(r, "restore", "album", id, before, snapshot(album))
+	w.Header().Set("ETag", albumETag(album))
+	s.writeJSON(w, r, http.StatusOK, album)
+}
+
+func (d *MemoryDatabase) SoftDeleteAlbum(id string, deletedAt time.Time) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	album, ok := d.albums[id]
+	if !ok || album.DeletedAt != nil {
+		return ErrDoesNotExist
+	}
+	d.bytes -= albumSize(album)
+	d.saveVersion(album)
+	deletedAt = deletedAt.UTC()
+	album.DeletedAt = &deletedAt
+	album.Version++
+	album.UpdatedAt = deletedAt
+	d.albums[id] = album
+	d.bytes += albumSize(album)
+	return nil
+}
+
+func (d *MemoryDatabase) RestoreAlbum(id string) (Album, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	album, ok := d.albums[id]
+	if !ok {
+		return Album{}, ErrDoesNotExist
+	}
+	if album.DeletedAt == nil {
+		return album, nil
+	}
+	d.bytes -= albumSize(album)
+	d.saveVersion(album)
+	album.DeletedAt = nil
+	album.Version++
+	album.UpdatedAt = d.now()
+	d.albums[id] = album
+	d.bytes += albumSize(album)
+	return album, nil
+}
+
+func (d *MemoryDatabase) PurgeDeletedAlbums(before time.Time) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	n := 0
+	for id, album := range d.albums {
+		if album.DeletedAt != nil && album.DeletedAt.Before(before) {
+			delete(d.albums, id)
+			delete(d.history, id)
+			d.bytes -= albumSize(album)
+			d.unindexAlbum(album)
+			d.releaseCover(id)
+			d.releaseAttachments(id)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,164 @@
+// Tests for soft deletion and restoring of albums
+
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "s3cret"
+
+func newSoftDeleteTestServer() *Server {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000})
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	return NewServer(db, log.New(io.Discard, "", 0),
+		WithAdminToken(testAdminToken),
+		WithClock(func() time.Time { return now }),
+	)
+}
+
+func newAdminRequest(t *testing.T, method, url string, body io.Reader) *http.Request {
+	t.Helper()
+	request := newRequest(t, method, url, body)
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return request
+}
+
+func TestSoftDeleteAlbum(t *testing.T) {
+	server := newSoftDeleteTestServer()
+	result := serve(t, server, newRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+
+	// Deleted albums are hidden everywhere by default
+	ensureAlbumIDs(t, server, []string{"a2"})
+	for _, path := range []string{"/albums/a1", "/albums/a1/tracks", "/albums/a1/qr.png"} {
+		result = serve(t, server, newRequest(t, "GET", path, nil))
+		ensureStatus(t, result, http.StatusNotFound)
+	}
+	result = serve(t, server, newRequest(t, "POST", "/albums/lookup", strings.NewReader(`{"ids": ["a1"]}`)))
+	ensureStatus(t, result, http.StatusOK)
+	var lookup struct{ Missing []string }
+	unmarshalResponse(t, result, &lookup)
+	if len(lookup.Missing) != 1 || lookup.Missing[0] != "a1" {
+		t.Fatalf("got missing %q, want [a1]", lookup.Missing)
+	}
+
+	// They can't be changed, and their IDs can't be reused
+	body := `{"title": "Ode to Joy", "duration": 600}`
+	result = serve(t, server, newRequest(t, "POST", "/albums/a1/tracks", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusNotFound)
+	body = `{"id": "a1", "title": "5th Symphony", "artist": "Beethoven"}`
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureError(t, result, http.StatusConflict, "already-exists", nil)
+	request := newRequest(t, "PUT", "/albums/a1", strings.NewReader(body))
+	request.Header.Set("If-Match", `"2"`)
+	result = serve(t, server, request)
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	// Clients can't create deleted albums either
+	body = `{"id": "a3", "title": "Pianoman", "artist": "Billy Joel", "deleted_at": "2021-01-01T00:00:00Z"}`
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	ensureAlbumIDs(t, server, []string{"a2", "a3"})
+}
+
+func TestIncludeDeleted(t *testing.T) {
+	server := newSoftDeleteTestServer()
+	result := serve(t, server, newRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+
+	paths := []string{
+		"/albums?include_deleted=true",
+		"/albums/a1?include_deleted=true",
+		"/albums/search?q=beethoven&include_deleted=true",
+	}
+	for _, path := range paths {
+		// Only admins can see deleted albums
+		result = serve(t, server, newRequest(t, "GET", path, nil))
+		ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+
+		result = serve(t, server, newAdminRequest(t, "GET", path, nil))
+		ensureStatus(t, result, http.StatusOK)
+		var got struct {
+			ID        string `json:"id"`
+			DeletedAt string `json:"deleted_at"`
+		}
+		if path == "/albums/a1?include_deleted=true" {
+			unmarshalResponse(t, result, &got)
+		} else {
+			var albums []struct {
+				ID        string `json:"id"`
+				DeletedAt string `json:"deleted_at"`
+			}
+			unmarshalResponse(t, result, &albums)
+			got = albums[0]
+		}
+		if got.ID != "a1" || got.DeletedAt != "2021-06-01T12:00:00Z" {
+			t.Fatalf("%s: got album %q deleted at %q", path, got.ID, got.DeletedAt)
+		}
+	}
+
+	result = serve(t, server, newAdminRequest(t, "GET", "/albums?include_deleted=yes", nil))
+	data := map[string]interface{}{
+		"include_deleted": map[string]interface{}{"error": "invalid", "message": "include_deleted must be true or false"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+
+	// Admins don't see deleted albums unless they ask
+	result = serve(t, server, newAdminRequest(t, "GET", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNotFound)
+}
+
+func TestRestoreAlbum(t *testing.T) {
+	server := newSoftDeleteTestServer()
+	result := serve(t, server, newRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+
+	result = serve(t, server, newRequest(t, "POST", "/albums/a1/restore", nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+
+	result = serve(t, server, newAdminRequest(t, "POST", "/albums/a1/restore", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if etag := result.Header.Get("ETag"); etag != `"3"` {
+		t.Fatalf("bad ETag: got %q, want %q", etag, `"3"`)
+	}
+	testGetAlbum(t, server, getAlbumTest{"/albums/a1", http.StatusOK, testAlbum{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795}})
+	ensureAlbumIDs(t, server, []string{"a1", "a2"})
+
+	result = serve(t, server, newAdminRequest(t, "POST", "/albums/a3/restore", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	result = serve(t, server, newAdminRequest(t, "GET", "/albums/a1/restore", nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+}
+
+func TestPurgeDeletedAlbums(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles"})
+	server := NewServer(db, log.New(io.Discard, "", 0), WithDeletedRetention(5*time.Millisecond))
+	defer server.Close()
+
+	result := serve(t, server, newRequest(t, "DELETE", "/albums/a1", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	for i := 0; i < 100; i++ {
+		_, err := db.GetAlbumByID("a1")
+		if errors.Is(err, ErrDoesNotExist) {
+			_, err = db.GetAlbumByID("a2")
+			if err != nil {
+				t.Fatalf("a2 should not have been purged: %v", err)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("deleted album wasn't purged")
+}
@@ -0,0 +1,171 @@
+// Static file serving, so one binary can ship the API and a frontend
+//
+// Files are served from any fs.FS under /static/: a directory on disk with
+// os.DirFS, or files compiled into the binary with an embed.FS (use
+// fs.Sub to strip the embedded directory's name). Each file gets a strong
+// ETag from a hash of its content, so clients can revalidate cheaply, and
+// a Cache-Control max-age. A request with a "v" query parameter (like
+// /static/app.js?v=3f2a) is taken to be for a versioned URL that changes
+// when the file does, so it's cached for a year.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// staticImmutableMaxAge is how long files requested with a version are
+// cached for.
+const staticImmutableMaxAge = 365 * 24 * time.Hour
+
+// WithStaticFiles serves the files in fsys under /static/, with a
+// Cache-Control max-age of maxAge (zero means clients must always
+// revalidate). A URL ending in a slash is served as the directory's
+// index.html; there are no directory listings, and dot files (like .git)
+// aren't served. The default
+// (nil fsys) is to not serve static files.
+func WithStaticFiles(fsys fs.FS, maxAge time.Duration) Option {
+	return func(s *Server) {
+		if fsys == nil {
+			return
+		}
+		s.staticFiles = &staticFiles{fsys: fsys, maxAge: maxAge, etags: make(map[string]staticETag)}
+	}
+}
+
+// staticFiles serves files from an fs.FS.
+type staticFiles struct {
+	fsys   fs.FS
+	maxAge time.Duration
+
+	mu    sync.Mutex
+	etags map[string]staticETag // by file name
+}
+
+// staticETag is a file's cached ETag, which is recomputed if the file's
+// size or modification time changes.
+type staticETag struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func (s *Server) getStaticFile(w http.ResponseWriter, r *http.Request, name string) {
+	if s.staticFiles == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	if !fs.ValidPath(name) || strings.HasPrefix(name, ".") || strings.Contains(name, "/.") {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	err := s.staticFiles.serve(w, r, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("serving static file %q: %w", name, err)))
+	}
+}
+
+// serve writes the named file, letting http.ServeContent handle the
+// conditional and range requests, and the Content-Type from the file's
+// extension. It returns an error wrapping fs.ErrNotExist if there's no
+// such file (or it's a directory), so the caller can write a 404.
+func (sf *staticFiles) serve(w http.ResponseWriter, r *http.Request, name string) error {
+	f, info, err := sf.open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Files on disk can be seeked, but other file systems' files may not
+	// be, so read those into memory
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(b)
+	}
+	etag, err := sf.etag(name, info, content)
+	if err != nil {
+		return err
+	}
+
+	maxAge := sf.maxAge
+	if r.URL.Query().Get("v") != "" {
+		maxAge = staticImmutableMaxAge
+	}
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge/time.Second)))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache") // cache, but always revalidate
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+	return nil
+}
+
+// open opens the named file, which must not be a directory, returning
+// the file and its info.
+func (sf *staticFiles) open(name string) (fs.File, fs.FileInfo, error) {
+	f, err := sf.fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// etag returns the file's ETag, hashing its content (and seeking back to
+// the start) if it's not cached or the file has changed.
+func (sf *staticFiles) etag(name string, info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	sf.mu.Lock()
+	cached, ok := sf.etags[name]
+	sf.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.etag, nil
+	}
+
+	hash := sha256.New()
+	_, err := io.Copy(hash, content)
+	if err != nil {
+		return "", err
+	}
+	_, err = content.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+
+	sf.mu.Lock()
+	sf.etags[name] = staticETag{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	sf.mu.Unlock()
+	return etag, nil
+}
@@ -0,0 +1,133 @@
+// Tests for static file serving
+
+package server
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestStaticFiles(t *testing.T) {
+	files := fstest.MapFS{
+		"app.js":          {Data: []byte("console.log('hi');\n")},
+		"index.html":      {Data: []byte("<!DOCTYPE html>\n<title>App</title>\n")},
+		"docs/index.html": {Data: []byte("<!DOCTYPE html>\n<title>Docs</title>\n")},
+		".env":            {Data: []byte("SECRET=1\n")},
+		"css/.hidden":     {Data: []byte("x")},
+	}
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithStaticFiles(files, time.Hour))
+
+	result := serve(t, server, newRequest(t, "GET", "/static/app.js", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Content-Type"); got != "text/javascript; charset=utf-8" && got != "application/javascript" {
+		t.Fatalf("bad Content-Type: got %q", got)
+	}
+	if got := result.Header.Get("Cache-Control"); got != "public, max-age=3600" {
+		t.Fatalf("bad Cache-Control: got %q", got)
+	}
+	b, _ := io.ReadAll(result.Body)
+	if string(b) != "console.log('hi');\n" {
+		t.Fatalf("bad body: %q", b)
+	}
+
+	// Clients can revalidate with the ETag
+	etag := result.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("bad ETag: %q", etag)
+	}
+	request := newRequest(t, "GET", "/static/app.js", nil)
+	request.Header.Set("If-None-Match", etag)
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusNotModified)
+
+	// Versioned URLs are cached for a long time
+	result = serve(t, server, newRequest(t, "GET", "/static/app.js?v=abc123", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Cache-Control"); got != "public, max-age=31536000" {
+		t.Fatalf("bad Cache-Control for versioned URL: got %q", got)
+	}
+
+	// Directories are served as their index.html
+	for path, want := range map[string]string{"/static/": "App", "/static/docs/": "Docs"} {
+		result = serve(t, server, newRequest(t, "GET", path, nil))
+		ensureStatus(t, result, http.StatusOK)
+		b, _ := io.ReadAll(result.Body)
+		if !strings.Contains(string(b), "<title>"+want+"</title>") {
+			t.Errorf("%s: got %q, want %s page", path, b, want)
+		}
+		if got := result.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+			t.Errorf("%s: bad Content-Type: got %q", path, got)
+		}
+	}
+
+	for _, path := range []string{"/static/missing.js", "/static/docs", "/static/.env", "/static/css/.hidden", "/static/../main.go", "/static//app.js"} {
+		result = serve(t, server, newRequest(t, "GET", path, nil))
+		if result.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want 404", path, result.StatusCode)
+		}
+	}
+	result = serve(t, server, newRequest(t, "POST", "/static/app.js", nil))
+	ensureError(t, result, http.StatusMethodNotAllowed, "method-not-allowed", nil)
+
+	// Without static files, there's nothing under /static/
+	server = NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0))
+	result = serve(t, server, newRequest(t, "GET", "/static/app.js", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestStaticFilesDir(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "app.css")
+	err := os.WriteFile(name, []byte("body { color: red; }\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithStaticFiles(os.DirFS(dir), 0))
+
+	result := serve(t, server, newRequest(t, "GET", "/static/app.css", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Cache-Control"); got != "no-cache" {
+		t.Fatalf("bad Cache-Control: got %q", got)
+	}
+	if result.Header.Get("Last-Modified") == "" {
+		t.Fatal("no Last-Modified header")
+	}
+	etag := result.Header.Get("ETag")
+
+	// Changing the file changes its ETag
+	err = os.WriteFile(name, []byte("body { color: blue; }\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(name, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/static/app.css", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if result.Header.Get("ETag") == etag {
+		t.Fatalf("ETag %s didn't change", etag)
+	}
+}
+
+func TestStaticFilesEmbed(t *testing.T) {
+	templates, err := fs.Sub(adminTemplateFiles, "templates/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithStaticFiles(templates, time.Hour))
+	result := serve(t, server, newRequest(t, "GET", "/static/login.html", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if result.Header.Get("ETag") == "" {
+		t.Fatal("no ETag for embedded file")
+	}
+}
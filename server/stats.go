@@ -0,0 +1,81 @@
+// Database memory accounting and stats endpoint
+
+package server
+
+import (
+	"net/http"
+	"reflect"
+)
+
+// DatabaseStats holds size statistics for a database.
+type DatabaseStats struct {
+	Albums    int   `json:"albums"`
+	Bytes     int64 `json:"approx_bytes"`
+	MaxAlbums int   `json:"max_albums,omitempty"`
+	MaxBytes  int64 `json:"max_bytes,omitempty"`
+}
+
+// StatsReporter is an optional interface a Database can implement to report
+// its size statistics.
+type StatsReporter interface {
+	Stats() DatabaseStats
+}
+
+func (d *MemoryDatabase) Stats() DatabaseStats {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return DatabaseStats{
+		Albums:    len(d.albums),
+		Bytes:     d.bytes,
+		MaxAlbums: d.MaxAlbums,
+		MaxBytes:  d.MaxBytes,
+	}
+}
+
+// Rough per-item overheads used for memory accounting. These don't need to
+// be exact, just in the right ballpark for enforcing limits.
+var (
+	albumOverhead = int64(reflect.TypeOf(Album{}).Size()) + 64 // map entry and ID key
+	trackOverhead = int64(reflect.TypeOf(Track{}).Size())
+	wordOverhead  = int64(48) // inverted index map entries
+)
+
+// albumSize returns the approximate memory used by storing album, including
+// its tracks and search index entries.
+func albumSize(album Album) int64 {
+	size := albumOverhead + int64(2*len(album.ID)+len(album.Title)+len(album.Artist)+len(album.CatalogNumber)+len(album.UPC)+len(album.MusicBrainzID))
+	if album.PublishAt != nil {
+		size += int64(reflect.TypeOf(*album.PublishAt).Size())
+	}
+	if album.DeletedAt != nil {
+		size += int64(reflect.TypeOf(*album.DeletedAt).Size())
+	}
+	for _, track := range album.Tracks {
+		size += trackSize(track)
+	}
+	for _, word := range searchWords(album.Title + " " + album.Artist) {
+		size += wordOverhead + int64(len(word)+len(album.ID))
+	}
+	return size
+}
+
+// trackSize returns the approximate memory used by storing track.
+func trackSize(track Track) int64 {
+	return trackOverhead + int64(len(track.Title)+len(track.ISRC)+len(track.MusicBrainzID))
+}
+
+// statsResponse is the response of GET /stats.
+type statsResponse struct {
+	Database *DatabaseStats `json:"database,omitempty"`
+	Limiter  *limiterStats  `json:"limiter,omitempty"`
+	Jobs     []JobStats     `json:"jobs,omitempty"`
+}
+
+func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
+	response := statsResponse{Limiter: s.limiterStats(), Jobs: s.jobStats()}
+	if reporter, ok := s.db.(StatsReporter); ok {
+		stats := reporter.Stats()
+		response.Database = &stats
+	}
+	s.writeJSON(w, r, http.StatusOK, response)
+}
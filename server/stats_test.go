@@ -0,0 +1,99 @@
+// Tests for database memory accounting and stats endpoint
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.MaxAlbums = 10
+	server := NewServer(db, log.New(io.Discard, "", 0))
+	got := getStats(t, server)
+	if got.Albums != 0 || got.Bytes != 0 || got.MaxAlbums != 10 || got.MaxBytes != 0 {
+		t.Fatalf("bad stats for empty database: %#v", got)
+	}
+
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	got = getStats(t, server)
+	if got.Albums != 1 || got.Bytes <= 0 {
+		t.Fatalf("bad stats after adding album: %#v", got)
+	}
+	bytes := got.Bytes
+
+	db.AddTrack("a1", Track{Title: "Allegro ma non troppo", Duration: 960})
+	got = getStats(t, server)
+	if got.Albums != 1 || got.Bytes <= bytes {
+		t.Fatalf("bad stats after adding track: %#v", got)
+	}
+}
+
+func TestStatsNoReporter(t *testing.T) {
+	server := NewServer(errorDatabase{}, log.New(io.Discard, "", 0))
+	result := serve(t, server, newRequest(t, "GET", "/stats", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var got map[string]interface{}
+	unmarshalResponse(t, result, &got)
+	if len(got) != 0 {
+		t.Fatalf("bad stats: got %#v, want empty", got)
+	}
+}
+
+func TestMaxAlbums(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.MaxAlbums = 1
+	server := NewServer(db, log.New(io.Discard, "", 0))
+
+	body := `{"id": "a1", "title": "9th Symphony", "artist": "Beethoven"}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	body = `{"id": "a2", "title": "Hey Jude", "artist": "The Beatles"}`
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusInsufficientStorage)
+	ensureError(t, result, http.StatusInsufficientStorage, "database-full", nil)
+	ensureAlbumIDs(t, server, []string{"a1"})
+}
+
+func TestMaxBytes(t *testing.T) {
+	album := Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"}
+	db := NewMemoryDatabase()
+	db.MaxBytes = albumSize(album)
+	server := NewServer(db, log.New(io.Discard, "", 0))
+
+	_, err := db.AddAlbum(album)
+	if err != nil {
+		t.Fatalf("error adding album that exactly fits: %v", err)
+	}
+
+	body := `{"title": "Allegro ma non troppo", "duration": 960}`
+	result := serve(t, server, newRequest(t, "POST", "/albums/a1/tracks", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusInsufficientStorage)
+	ensureError(t, result, http.StatusInsufficientStorage, "database-full", nil)
+
+	body = `{"id": "a2", "title": "Hey Jude", "artist": "The Beatles"}`
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusInsufficientStorage)
+	ensureError(t, result, http.StatusInsufficientStorage, "database-full", nil)
+
+	got := getStats(t, server)
+	if got.Albums != 1 || got.Bytes != db.MaxBytes {
+		t.Fatalf("bad stats after full: %#v", got)
+	}
+}
+
+func getStats(t *testing.T, server *Server) DatabaseStats {
+	t.Helper()
+	result := serve(t, server, newRequest(t, "GET", "/stats", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var got struct {
+		Database DatabaseStats `json:"database"`
+	}
+	unmarshalResponse(t, result, &got)
+	return got.Database
+}
@@ -0,0 +1,67 @@
+// Album stock and purchases
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// An album's Stock is how many copies are left to sell. It's set like any
+// other field, and POST /albums/:id/purchase takes one copy, returning the
+// updated album, or an "out-of-stock" error once there are none left.
+//
+// Concurrent purchases must never sell the same copy twice, so the
+// decrement relies on the compare-and-swap in Database.PutAlbum: read the
+// album, then store it with one less copy only if its version hasn't
+// changed in between. If another change got in first, it re-reads the
+// album and tries again, up to maxPurchaseAttempts times, after which it
+// gives up with a (retryable) conflict error.
+const (
+	maxStock            = 1000000000
+	maxPurchaseAttempts = 10
+)
+
+// validateStock adds an issue to issues if stock is out of range.
+func validateStock(stock int, issues map[string]interface{}) {
+	if stock < 0 || stock > maxStock {
+		issues["stock"] = validationIssue{"out-of-range", fmt.Sprintf("stock must be between 0 and %d", maxStock)}
+	}
+}
+
+func (s *Server) purchaseAlbum(w http.ResponseWriter, r *http.Request, id string) {
+	for attempt := 0; attempt < maxPurchaseAttempts; attempt++ {
+		album, err := s.db.GetAlbumByID(id)
+		if err != nil {
+			s.writeError(w, r, apierr.Database(err))
+			return
+		}
+		if !album.visible(s.now()) {
+			s.writeError(w, r, apierr.NotFound())
+			return
+		}
+		if album.Stock <= 0 {
+			s.writeError(w, r, apierr.OutOfStock())
+			return
+		}
+
+		before := snapshot(album)
+		album.Stock--
+		stored, err := s.db.PutAlbum(album, album.Version)
+		if errors.Is(err, ErrVersionConflict) {
+			continue // changed since we read it
+		}
+		if err != nil {
+			s.writeError(w, r, apierr.Database(fmt.Errorf("purchasing album ID %q: %w", id, err)))
+			return
+		}
+		s.audit(r, "purchase", "album", id, before, snapshot(stored))
+		w.Header().Set("ETag", albumETag(stored))
+		s.writeJSON(w, r, http.StatusOK, s.redactAlbum(r, stored))
+		return
+	}
+	s.writeError(w, r, apierr.Conflict().WithRetry(true, 0))
+}
@@ -0,0 +1,73 @@
+// Tests for album stock and purchases
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPurchaseAlbum(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "PUT", "/albums/a1", strings.NewReader(`{"title": "9th Symphony", "artist": "Beethoven", "price": 795, "stock": 2, "version": 1}`)))
+	ensureStatus(t, result, http.StatusOK)
+
+	for _, want := range []int{1, 0} {
+		result = serve(t, server, newRequest(t, "POST", "/albums/a1/purchase", nil))
+		ensureStatus(t, result, http.StatusOK)
+		var album Album
+		unmarshalResponse(t, result, &album)
+		if album.Stock != want || result.Header.Get("ETag") != albumETag(album) {
+			t.Fatalf("got stock %d (ETag %s), want %d", album.Stock, result.Header.Get("ETag"), want)
+		}
+	}
+	result = serve(t, server, newRequest(t, "POST", "/albums/a1/purchase", nil))
+	ensureError(t, result, http.StatusConflict, "out-of-stock", nil)
+
+	// Albums without stock can't be bought, and hidden ones don't exist
+	result = serve(t, server, newRequest(t, "POST", "/albums/a2/purchase", nil))
+	ensureError(t, result, http.StatusConflict, "out-of-stock", nil)
+	result = serve(t, server, newRequest(t, "POST", "/albums/a3/purchase", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/purchase", nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+
+	result = serve(t, server, newRequest(t, "PUT", "/albums/a2", strings.NewReader(`{"title": "Hey Jude", "artist": "The Beatles", "stock": -1, "version": 1}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"stock": map[string]interface{}{"error": "out-of-range", "message": "stock must be between 0 and 1000000000"},
+	})
+}
+
+func TestPurchaseAlbumConcurrent(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Stock: 5})
+	server := NewServer(db, log.New(io.Discard, "", 0))
+
+	// However the purchases interleave, exactly five succeed (or ask the
+	// client to retry), and the stock never goes negative
+	var mu sync.Mutex
+	statuses := make(map[int]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := serve(t, server, newRequest(t, "POST", "/albums/a1/purchase", nil))
+			mu.Lock()
+			statuses[result.StatusCode]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	album, err := db.GetAlbumByID("a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[http.StatusOK] != 5-album.Stock || album.Stock < 0 || statuses[http.StatusOK]+statuses[http.StatusConflict] != 20 {
+		t.Fatalf("got statuses %v and stock %d", statuses, album.Stock)
+	}
+}
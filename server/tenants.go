@@ -0,0 +1,450 @@
+// Multi-tenancy: separate album data for each tenant
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// With a TenantStore (see WithTenants), one server can host several
+// stores, or tenants, each with its own albums, genres, and everything
+// else in its database. Each request is for a single tenant, given by
+// (checked in this order):
+//
+//   - the caller's credentials: an Authenticator can issue API keys (or
+//     other credentials) for a tenant by setting Principal.Tenant
+//   - the subdomain of the request's host, if WithTenantDomain is set, so
+//     requests to acme.albums.example.com are for the tenant "acme"
+//   - the X-Tenant header
+//
+// A caller with credentials for one tenant can't access another: a request
+// whose subdomain or X-Tenant header disagrees with its credentials (or
+// with each other) is rejected with 403 Forbidden. That includes admins,
+// whose admin role only applies to their own tenant's data. Admin
+// credentials that aren't for any tenant, like the admin token, can't
+// access any tenant's data unless WithCrossTenantAdmin allows it.
+//
+// Tenants are isolated by giving each its own Database: the server routes
+// each request to a copy of itself using the tenant's database (see
+// forTenant). Other stores are shared, so they're scoped by tenant too:
+// favorites are stored under album keys namespaced by tenant, orders and
+// audit entries record their tenant and are only visible to it, and /events
+// and /ws only send a tenant's clients its own changes. Webhooks are set up
+// by the operator, so they get every tenant's events, with the tenant in
+// each one.
+//
+// Routes that don't involve album data, like /readyz, /openapi.json, user
+// accounts, and webhooks (see isGlobalRoute), aren't for any tenant, and
+// use the database given to NewServer. A tenant's admins aren't admins of
+// these routes, as they affect every tenant.
+
+// TenantStore is the interface used by the server to find each tenant's
+// database.
+type TenantStore interface {
+	// TenantDatabase returns the database of the tenant with the given ID,
+	// or ErrDoesNotExist if there's no such tenant.
+	TenantDatabase(id string) (Database, error)
+
+	// TenantIDs returns the IDs of all tenants, sorted.
+	TenantIDs() ([]string, error)
+}
+
+// WithTenants enables multi-tenancy, with the given tenants. The default
+// is none, in which case there's a single store, using the database given
+// to NewServer, and the X-Tenant header is ignored.
+func WithTenants(tenants TenantStore) Option {
+	return func(s *Server) {
+		s.tenants = tenants
+	}
+}
+
+// WithTenantDomain sets the domain whose subdomains are tenant IDs, like
+// "albums.example.com". The default is not to take tenants from the host.
+func WithTenantDomain(domain string) Option {
+	return func(s *Server) {
+		s.tenantDomain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	}
+}
+
+// WithCrossTenantAdmin sets whether admin credentials that aren't for a
+// tenant, like the admin token, can access every tenant's data, giving the
+// tenant with the X-Tenant header or a subdomain. The default is false.
+func WithCrossTenantAdmin(allowed bool) Option {
+	return func(s *Server) {
+		s.crossTenantAdmin = allowed
+	}
+}
+
+// reTenantID matches valid tenant IDs, which can be used as subdomains.
+var reTenantID = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// checkTenantID returns an error if id isn't a valid tenant ID.
+func checkTenantID(id string) error {
+	if !reTenantID.MatchString(id) {
+		return fmt.Errorf("tenant ID %q must be 1 to 63 lowercase letters, digits, and hyphens, not starting or ending with a hyphen", id)
+	}
+	return nil
+}
+
+// parseTenants parses a comma-separated list of tenant IDs, like the
+// -tenants flag.
+func parseTenants(s string) ([]string, error) {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(s, ",") {
+		id = strings.TrimSpace(id)
+		err := checkTenantID(id)
+		if err != nil {
+			return nil, err
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate tenant ID %q", id)
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// globalPaths are the paths of routes that aren't for any tenant.
+var globalPaths = map[string]bool{
+	"/readyz":             true,
+	"/version":            true,
+	"/stats":              true,
+	"/diagnostics":        true,
+	"/mode":               true,
+	"/openapi.json":       true,
+	"/graphql/schema":     true,
+	"/docs/examples":      true,
+	"/deprecations":       true,
+	"/users":              true,
+	"/users/login":        true,
+	"/users/logout":       true,
+	"/users/me":           true,
+	"/webhooks":           true,
+	"/payments/stripe":    true,
+	"/blobs/scrub":        true,
+	"/migration/backfill": true,
+	"/migration/report":   true,
+	"/signing-key":        true,
+	"/signing-keys":       true,
+	"/keys":               true,
+}
+
+// isGlobalRoute reports whether the request's route isn't for any tenant.
+// Uploads are global because their token is their only authorization;
+// the upload is confirmed by a request for the album's tenant. Static
+// files are the same for every tenant.
+func isGlobalRoute(path string) bool {
+	return globalPaths[path] || strings.HasPrefix(path, "/webhooks/") || strings.HasPrefix(path, "/uploads/") ||
+		strings.HasPrefix(path, "/static/")
+}
+
+// routeTenant routes requests when there are tenants: global routes as
+// usual, and others with the copy of the server for the request's tenant.
+func (s *Server) routeTenant(w http.ResponseWriter, r *http.Request) {
+	// Responses for different tenants can have the same URL
+	w.Header().Add("Vary", "X-Tenant")
+	if isGlobalRoute(r.URL.Path) {
+		principal := s.principal(r)
+		if principal.Tenant != "" && principal.Role > RolePublic {
+			principal.Role = RolePublic
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+		}
+		s.cachedRoute(w, r)
+		return
+	}
+	tenant, apiErr := s.requestTenant(r)
+	if apiErr != nil {
+		s.writeError(w, r, apiErr)
+		return
+	}
+	db, err := s.tenants.TenantDatabase(tenant)
+	if errors.Is(err, ErrDoesNotExist) {
+		s.writeError(w, r, apierr.NotFound().WithData(map[string]interface{}{
+			"message": fmt.Sprintf("tenant %q doesn't exist", tenant),
+		}))
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("getting database for tenant %q: %w", tenant, err)))
+		return
+	}
+	s.forTenant(tenant, db).cachedRoute(w, r)
+}
+
+// requestTenant returns the ID of the tenant the request is for, or an
+// *apierr.Error if there isn't one or the caller can't access it.
+func (s *Server) requestTenant(r *http.Request) (string, *apierr.Error) {
+	header := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Tenant")))
+	subdomain := s.tenantSubdomain(r)
+	if header != "" && subdomain != "" && header != subdomain {
+		return "", forbiddenTenant("X-Tenant header doesn't match the subdomain")
+	}
+	requested := subdomain
+	if requested == "" {
+		requested = header
+	}
+
+	principal := s.principal(r)
+	switch {
+	case principal.Tenant != "":
+		if requested != "" && requested != principal.Tenant {
+			return "", forbiddenTenant(fmt.Sprintf("credentials are for tenant %q", principal.Tenant))
+		}
+		return principal.Tenant, nil
+	case principal.Role >= RoleAdmin && !s.crossTenantAdmin:
+		return "", forbiddenTenant("admin credentials that aren't for a tenant can't access tenants' data")
+	case requested == "":
+		return "", apierr.Validation(map[string]interface{}{
+			"X-Tenant": validationIssue{"required", "give the tenant with the X-Tenant header or a subdomain"},
+		})
+	}
+	err := checkTenantID(requested)
+	if err != nil {
+		return "", apierr.Validation(map[string]interface{}{
+			"X-Tenant": validationIssue{"invalid", err.Error()},
+		})
+	}
+	return requested, nil
+}
+
+// forbiddenTenant returns the error for a request for a tenant the caller
+// can't access.
+func forbiddenTenant(message string) *apierr.Error {
+	return apierr.Forbidden().WithData(map[string]interface{}{"message": message})
+}
+
+// tenantSubdomain returns the subdomain of the request's host under the
+// tenant domain, or "" if it isn't under it.
+func (s *Server) tenantSubdomain(r *http.Request) string {
+	if s.tenantDomain == "" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !strings.HasSuffix(host, "."+s.tenantDomain) {
+		return ""
+	}
+	return strings.TrimSuffix(host, "."+s.tenantDomain)
+}
+
+// forTenant returns a copy of the server for the given tenant, using its
+// database, and with the shared stores scoped to it.
+func (s *Server) forTenant(tenant string, db Database) *Server {
+	ts := *s
+	ts.tenant = tenant
+	ts.db = db
+	if s.favoriteStore != nil {
+		ts.favoriteStore = tenantFavoriteStore{s.favoriteStore, tenant}
+	}
+	if s.orderStore != nil {
+		ts.orderStore = tenantOrderStore{s.orderStore, tenant}
+	}
+	return &ts
+}
+
+// tenantReplayScope returns what distinguishes tenants' requests for
+// duplicate detection and idempotency keys, which are checked before
+// requests are authenticated: the host, the X-Tenant header, and a hash of
+// the credentials. It's "" if there are no tenants.
+func (s *Server) tenantReplayScope(r *http.Request) string {
+	if s.tenants == nil {
+		return ""
+	}
+	credentials := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return r.Host + "\n" + r.Header.Get("X-Tenant") + "\n" + hex.EncodeToString(credentials[:]) + "\n"
+}
+
+// databases returns the server's database followed by each tenant's, for
+// maintenance jobs that apply to all of them.
+func (s *Server) databases() ([]Database, error) {
+	dbs := []Database{s.db}
+	if s.tenants == nil {
+		return dbs, nil
+	}
+	ids, err := s.tenants.TenantIDs()
+	if err != nil {
+		return nil, fmt.Errorf("getting tenants: %w", err)
+	}
+	for _, id := range ids {
+		db, err := s.tenants.TenantDatabase(id)
+		if err != nil {
+			return nil, fmt.Errorf("getting database for tenant %q: %w", id, err)
+		}
+		dbs = append(dbs, db)
+	}
+	return dbs, nil
+}
+
+// tenantFavoriteStore is a FavoriteStore for one tenant, which namespaces
+// album IDs with the tenant's ID, as different tenants' albums can have
+// the same ID.
+type tenantFavoriteStore struct {
+	store  FavoriteStore
+	tenant string
+}
+
+func (t tenantFavoriteStore) key(albumID string) string {
+	return t.tenant + "/" + albumID
+}
+
+func (t tenantFavoriteStore) AddFavorite(favorite Favorite) error {
+	favorite.AlbumID = t.key(favorite.AlbumID)
+	return t.store.AddFavorite(favorite)
+}
+
+func (t tenantFavoriteStore) DeleteFavorite(userID, albumID string) error {
+	return t.store.DeleteFavorite(userID, t.key(albumID))
+}
+
+func (t tenantFavoriteStore) GetFavorites(userID string) ([]Favorite, error) {
+	all, err := t.store.GetFavorites(userID)
+	if err != nil {
+		return nil, err
+	}
+	favorites := []Favorite{}
+	for _, favorite := range all {
+		if strings.HasPrefix(favorite.AlbumID, t.key("")) {
+			favorite.AlbumID = strings.TrimPrefix(favorite.AlbumID, t.key(""))
+			favorites = append(favorites, favorite)
+		}
+	}
+	return favorites, nil
+}
+
+func (t tenantFavoriteStore) CountFavorites(albumIDs []string) (map[string]int, error) {
+	keys := make([]string, len(albumIDs))
+	for i, id := range albumIDs {
+		keys[i] = t.key(id)
+	}
+	counts, err := t.store.CountFavorites(keys)
+	if err != nil {
+		return nil, err
+	}
+	tenantCounts := make(map[string]int, len(counts))
+	for key, count := range counts {
+		tenantCounts[strings.TrimPrefix(key, t.key(""))] = count
+	}
+	return tenantCounts, nil
+}
+
+// tenantOrderStore is an OrderStore for one tenant, which records the
+// tenant in each order it adds and treats other tenants' orders as not
+// existing.
+type tenantOrderStore struct {
+	store  OrderStore
+	tenant string
+}
+
+func (t tenantOrderStore) AddOrder(order Order) error {
+	order.Tenant = t.tenant
+	return t.store.AddOrder(order)
+}
+
+func (t tenantOrderStore) GetOrder(id string) (Order, error) {
+	order, err := t.store.GetOrder(id)
+	if err != nil {
+		return Order{}, err
+	}
+	if order.Tenant != t.tenant {
+		return Order{}, ErrDoesNotExist
+	}
+	return order, nil
+}
+
+func (t tenantOrderStore) GetCustomerOrders(customerID string) ([]Order, error) {
+	all, err := t.store.GetCustomerOrders(customerID)
+	if err != nil {
+		return nil, err
+	}
+	orders := []Order{}
+	for _, order := range all {
+		if order.Tenant == t.tenant {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+func (t tenantOrderStore) UpdateOrderStatus(id, from, to string, now time.Time) (Order, error) {
+	_, err := t.GetOrder(id)
+	if err != nil {
+		return Order{}, err
+	}
+	return t.store.UpdateOrderStatus(id, from, to, now)
+}
+
+func (t tenantOrderStore) SetOrderPaymentID(id, paymentID string) error {
+	_, err := t.GetOrder(id)
+	if err != nil {
+		return err
+	}
+	return t.store.SetOrderPaymentID(id, paymentID)
+}
+
+// MemoryTenantStore is a TenantStore with a fixed set of tenants, added
+// when the server starts.
+type MemoryTenantStore struct {
+	lock    sync.RWMutex
+	tenants map[string]Database
+}
+
+// NewMemoryTenantStore creates a new tenant store with no tenants.
+func NewMemoryTenantStore() *MemoryTenantStore {
+	return &MemoryTenantStore{tenants: make(map[string]Database)}
+}
+
+// AddTenant adds a tenant with the given ID and database. It returns
+// ErrAlreadyExists if there's already a tenant with that ID, or an error
+// if the ID isn't valid.
+func (m *MemoryTenantStore) AddTenant(id string, db Database) error {
+	err := checkTenantID(id)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.tenants[id]; ok {
+		return ErrAlreadyExists
+	}
+	m.tenants[id] = db
+	return nil
+}
+
+func (m *MemoryTenantStore) TenantDatabase(id string) (Database, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	db, ok := m.tenants[id]
+	if !ok {
+		return nil, ErrDoesNotExist
+	}
+	return db, nil
+}
+
+func (m *MemoryTenantStore) TenantIDs() ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ids := make([]string, 0, len(m.tenants))
+	for id := range m.tenants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,233 @@
+// Tests for multi-tenancy
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTenantTestServer(t *testing.T, options ...Option) *Server {
+	t.Helper()
+	tenants := NewMemoryTenantStore()
+	for _, id := range []string{"acme", "globex"} {
+		db := NewMemoryDatabase()
+		db.AddAlbum(Album{ID: "t1", Title: "Help! (" + id + ")", Artist: "The Beatles", Price: 1500})
+		err := tenants.AddTenant(id, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// API keys for a single tenant
+	apiKeys := AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer acme-admin":
+			return Principal{ID: "acme-admin", Role: RoleAdmin, Tenant: "acme"}, nil
+		case "Bearer acme-client":
+			return Principal{ID: "acme-client", Role: RolePublic, Tenant: "acme"}, nil
+		default:
+			return Principal{}, ErrNoCredentials
+		}
+	})
+	options = append([]Option{
+		WithAdminToken(testAdminToken),
+		WithAuthenticators(apiKeys),
+		WithTenants(tenants),
+		WithTenantDomain("albums.example.com"),
+		WithAuditStore(NewMemoryAuditStore()),
+	}, options...)
+	return NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), options...)
+}
+
+func newTenantRequest(t *testing.T, method, url, tenant, token string, body io.Reader) *http.Request {
+	t.Helper()
+	request := newRequest(t, method, url, body)
+	if tenant != "" {
+		request.Header.Set("X-Tenant", tenant)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return request
+}
+
+func getTenantAlbum(t *testing.T, server *Server, request *http.Request) Album {
+	t.Helper()
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	var album Album
+	unmarshalResponse(t, result, &album)
+	return album
+}
+
+func TestTenantIsolation(t *testing.T) {
+	server := newTenantTestServer(t)
+
+	// Each tenant has its own albums, by header or subdomain
+	album := getTenantAlbum(t, server, newTenantRequest(t, "GET", "/albums/t1", "acme", "", nil))
+	if album.Title != "Help! (acme)" {
+		t.Fatalf("got album %q, want acme's", album.Title)
+	}
+	request := newRequest(t, "GET", "http://globex.albums.example.com:8080/v1/albums/t1", nil)
+	album = getTenantAlbum(t, server, request)
+	if album.Title != "Help! (globex)" {
+		t.Fatalf("got album %q, want globex's", album.Title)
+	}
+	input := `{"id": "t2", "title": "Abbey Road", "artist": "The Beatles", "price": 1600}`
+	result := serve(t, server, newTenantRequest(t, "POST", "/albums", "acme", "", strings.NewReader(input)))
+	ensureStatus(t, result, http.StatusCreated)
+	if vary := result.Header.Values("Vary"); len(vary) == 0 || vary[0] != "X-Tenant" {
+		t.Fatalf("got Vary %v, want X-Tenant", vary)
+	}
+	result = serve(t, server, newTenantRequest(t, "GET", "/albums/t2", "globex", "", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	// The tenant must be given, and exist
+	result = serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"X-Tenant": map[string]interface{}{"error": "required", "message": "give the tenant with the X-Tenant header or a subdomain"},
+	})
+	result = serve(t, server, newTenantRequest(t, "GET", "/albums", "Not_Valid", "", nil))
+	ensureStatus(t, result, http.StatusBadRequest)
+	result = serve(t, server, newTenantRequest(t, "GET", "/albums", "initech", "", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", map[string]interface{}{"message": `tenant "initech" doesn't exist`})
+
+	// Global routes don't need a tenant
+	result = serve(t, server, newRequest(t, "GET", "/readyz", nil))
+	ensureStatus(t, result, http.StatusOK)
+
+	// Audit entries are only visible to their tenant
+	result = serve(t, server, newTenantRequest(t, "GET", "/audit", "", "acme-admin", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var entries []AuditEntry
+	unmarshalResponse(t, result, &entries)
+	if len(entries) != 1 || entries[0].ResourceID != "t2" || entries[0].Tenant != "acme" {
+		t.Fatalf("bad audit entries for acme: %+v", entries)
+	}
+	server = newTenantTestServer(t, WithCrossTenantAdmin(true))
+	result = serve(t, server, newTenantRequest(t, "GET", "/audit", "globex", testAdminToken, nil))
+	ensureStatus(t, result, http.StatusOK)
+	entries = nil
+	unmarshalResponse(t, result, &entries)
+	if len(entries) != 0 {
+		t.Fatalf("got audit entries for globex: %+v", entries)
+	}
+}
+
+func TestTenantAccess(t *testing.T) {
+	server := newTenantTestServer(t)
+
+	// Credentials for a tenant choose it, and can't be used for another
+	getTenantAlbum(t, server, newTenantRequest(t, "GET", "/albums/t1", "", "acme-client", nil))
+	getTenantAlbum(t, server, newTenantRequest(t, "GET", "/albums/t1", "acme", "acme-client", nil))
+	for _, request := range []*http.Request{
+		newTenantRequest(t, "GET", "/albums/t1", "globex", "acme-client", nil),
+		newTenantRequest(t, "GET", "/albums/t1", "globex", "acme-admin", nil),
+		newTenantRequest(t, "GET", "http://globex.albums.example.com/albums/t1", "", "acme-admin", nil),
+		newTenantRequest(t, "GET", "http://globex.albums.example.com/albums/t1", "acme", "", nil),
+	} {
+		result := serve(t, server, request)
+		ensureStatus(t, result, http.StatusForbidden)
+	}
+
+	// A tenant's admins are only admins of its data
+	result := serve(t, server, newTenantRequest(t, "GET", "/albums/t1", "", "acme-admin", nil))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newTenantRequest(t, "GET", "/webhooks", "", "acme-admin", nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	result = serve(t, server, newTenantRequest(t, "GET", "/webhooks", "", testAdminToken, nil))
+	ensureStatus(t, result, http.StatusOK)
+
+	// The admin token can only access tenants' data if allowed
+	result = serve(t, server, newTenantRequest(t, "GET", "/albums/t1", "acme", testAdminToken, nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", map[string]interface{}{
+		"message": "admin credentials that aren't for a tenant can't access tenants' data",
+	})
+	server = newTenantTestServer(t, WithCrossTenantAdmin(true))
+	album := getTenantAlbum(t, server, newTenantRequest(t, "GET", "/albums/t1", "globex", testAdminToken, nil))
+	if album.Title != "Help! (globex)" {
+		t.Fatalf("got album %q, want globex's", album.Title)
+	}
+}
+
+func TestTenantSharedStores(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	server := newTenantTestServer(t,
+		WithClock(func() time.Time { return now }),
+		WithUserStore(NewMemoryUserStore()),
+		WithFavoriteStore(NewMemoryFavoriteStore()),
+		WithOrderStore(NewMemoryOrderStore()),
+		WithIdempotencyTTL(time.Hour),
+		WithCrossTenantAdmin(true), // to fetch orders in each tenant
+	)
+
+	// Favorites of albums with the same ID in different tenants are separate
+	token := newTestUser(t, server, "kim@example.com")
+	request := newSessionRequest(t, "PUT", "/albums/t1/favorite", token)
+	request.Header.Set("X-Tenant", "acme")
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusNoContent)
+	for tenant, want := range map[string]int{"acme": 1, "globex": 0} {
+		album := getTenantAlbum(t, server, newTenantRequest(t, "GET", "/albums/t1", tenant, "", nil))
+		if album.Favorites != want {
+			t.Errorf("%s: got %d favorites, want %d", tenant, album.Favorites, want)
+		}
+		request := newSessionRequest(t, "GET", "/me/favorites", token)
+		request.Header.Set("X-Tenant", tenant)
+		result := serve(t, server, request)
+		ensureStatus(t, result, http.StatusOK)
+		var albums []Album
+		unmarshalResponse(t, result, &albums)
+		if len(albums) != want {
+			t.Errorf("%s: got %d favorite albums, want %d", tenant, len(albums), want)
+		}
+	}
+
+	// Orders are only visible to their tenant
+	input := `{"customer_id": "c1", "items": [{"album_id": "t1", "quantity": 1}]}`
+	result = serve(t, server, newTenantRequest(t, "POST", "/orders", "acme", testAdminToken, strings.NewReader(input)))
+	ensureStatus(t, result, http.StatusCreated)
+	var order Order
+	unmarshalResponse(t, result, &order)
+	result = serve(t, server, newTenantRequest(t, "GET", "/orders/"+order.ID, "acme", testAdminToken, nil))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newTenantRequest(t, "GET", "/orders/"+order.ID, "globex", testAdminToken, nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newTenantRequest(t, "GET", "/orders?customer_id=c1", "globex", testAdminToken, nil))
+	ensureStatus(t, result, http.StatusOK)
+	var orders []Order
+	unmarshalResponse(t, result, &orders)
+	if len(orders) != 0 {
+		t.Fatalf("got globex orders %+v, want none", orders)
+	}
+
+	// The same idempotency key in different tenants is for different requests
+	input = `{"id": "t3", "title": "Abbey Road", "artist": "The Beatles", "price": 1600}`
+	for _, tenant := range []string{"acme", "globex"} {
+		request := newTenantRequest(t, "POST", "/albums", tenant, "", strings.NewReader(input))
+		request.Header.Set("Idempotency-Key", "k1")
+		result := serve(t, server, request)
+		ensureStatus(t, result, http.StatusCreated)
+		if result.Header.Get("Idempotent-Replayed") != "" {
+			t.Fatalf("%s: response was replayed", tenant)
+		}
+		getTenantAlbum(t, server, newTenantRequest(t, "GET", "/albums/t3", tenant, "", nil))
+	}
+}
+
+func TestParseTenants(t *testing.T) {
+	ids, err := parseTenants("acme, globex")
+	if err != nil || strings.Join(ids, ",") != "acme,globex" {
+		t.Fatalf("got %v, %v", ids, err)
+	}
+	for _, input := range []string{"", "acme,", "Acme", "-acme", "acme,acme", strings.Repeat("a", 64)} {
+		_, err := parseTenants(input)
+		if err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
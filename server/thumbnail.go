@@ -0,0 +1,282 @@
+// Cover art thumbnails
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Smaller versions of an album's cover can be fetched with a size
+// parameter, like GET /albums/:id/cover?size=small, for lists and grids
+// that would otherwise download the full-size image. Each size has a name
+// and a maximum width and height in pixels (see WithThumbnailSizes); the
+// thumbnail keeps the cover's aspect ratio, and a cover that already fits
+// is served as is, as covers are never scaled up.
+//
+// Thumbnails are generated lazily, the first time each size is fetched,
+// which spreads the work out and means sizes that nobody asks for cost
+// nothing. If the database implements ThumbnailStore, the thumbnail is
+// then stored (the memory database keeps it in its BlobStore, like the
+// cover), so it's only generated once; replacing or deleting the cover
+// deletes its thumbnails. Scaling uses a box filter (averaging all the
+// cover pixels that make up each thumbnail pixel), which is simple and
+// good quality for downscaling.
+
+// defaultThumbnailSizes are the thumbnail sizes if WithThumbnailSizes
+// isn't used.
+var defaultThumbnailSizes = map[string]int{"small": 150, "medium": 600}
+
+// Thumbnail size names are lowercase slugs, like genre IDs.
+var reThumbnailSize = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// WithThumbnailSizes sets the named thumbnail sizes, each the maximum
+// width and height in pixels. An empty map disables thumbnails. Invalid
+// sizes are logged and ignored.
+func WithThumbnailSizes(sizes map[string]int) Option {
+	return func(s *Server) {
+		s.thumbnailSizes = sizes
+	}
+}
+
+// checkThumbnailSize returns an error if name or side isn't a valid
+// thumbnail size.
+func checkThumbnailSize(name string, side int) error {
+	if !reThumbnailSize.MatchString(name) {
+		return fmt.Errorf("thumbnail size name %q must be a lowercase slug like \"small\"", name)
+	}
+	if side < 1 || side > maxCoverSide {
+		return fmt.Errorf("thumbnail size %s must be between 1 and %d pixels", name, maxCoverSide)
+	}
+	return nil
+}
+
+// parseThumbnailSizes parses thumbnail sizes given as comma-separated
+// name=pixels pairs, like "small=150,medium=600" (as given to the
+// -thumbnail-sizes flag).
+func parseThumbnailSizes(s string) (map[string]int, error) {
+	sizes := make(map[string]int)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		equals := strings.IndexByte(entry, '=')
+		if equals < 0 {
+			return nil, fmt.Errorf("thumbnail size %q must be name=pixels", entry)
+		}
+		name := entry[:equals]
+		side, err := strconv.Atoi(entry[equals+1:])
+		if err != nil {
+			return nil, fmt.Errorf("thumbnail size %s must be an integer number of pixels", name)
+		}
+		err = checkThumbnailSize(name, side)
+		if err != nil {
+			return nil, err
+		}
+		sizes[name] = side
+	}
+	return sizes, nil
+}
+
+// thumbnailSizeNames returns the names of the thumbnail sizes, sorted.
+func (s *Server) thumbnailSizeNames() []string {
+	names := make([]string, 0, len(s.thumbnailSizes))
+	for name := range s.thumbnailSizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ThumbnailStore is an optional interface a Database that implements
+// CoverStore can implement to store generated cover thumbnails. Without
+// it, thumbnails are generated every time they're fetched.
+type ThumbnailStore interface {
+	// GetThumbnail returns the album's cover thumbnail of the named size,
+	// or ErrDoesNotExist if it hasn't been stored (or the album has no
+	// cover).
+	GetThumbnail(albumID, size string) (Cover, error)
+
+	// PutThumbnail stores a thumbnail of the named size made from the
+	// album's cover with the given hash. If that's no longer the album's
+	// cover (it's been replaced or deleted since), it returns
+	// ErrDoesNotExist, so a stale thumbnail is never stored.
+	PutThumbnail(albumID, size, coverHash string, thumbnail Cover) error
+}
+
+// coverThumbnail returns the album's thumbnail of the named size, which is
+// side pixels across at most, generating (and storing) it if needed.
+func (s *Server) coverThumbnail(albumID string, cover Cover, size string, side int) (Cover, error) {
+	if cover.Width <= side && cover.Height <= side {
+		return cover, nil
+	}
+	thumbnails, canStore := s.db.(ThumbnailStore)
+	if canStore {
+		thumbnail, err := thumbnails.GetThumbnail(albumID, size)
+		if err == nil {
+			return thumbnail, nil
+		}
+		if !errors.Is(err, ErrDoesNotExist) {
+			return Cover{}, fmt.Errorf("getting thumbnail: %w", err)
+		}
+	}
+
+	thumbnail, err := makeThumbnail(cover, side)
+	if err != nil {
+		return Cover{}, err
+	}
+	if canStore {
+		err = thumbnails.PutThumbnail(albumID, size, cover.Hash, thumbnail)
+		if err != nil && !errors.Is(err, ErrDoesNotExist) {
+			// It can still be served, it'll just be generated again
+			s.log.Printf("error storing %s thumbnail for album ID %q: %v", size, albumID, err)
+		}
+	}
+	return thumbnail, nil
+}
+
+// makeThumbnail decodes the cover and scales it to fit in a square of side
+// pixels, encoding it in the same format as the cover.
+func makeThumbnail(cover Cover, side int) (Cover, error) {
+	img, _, err := image.Decode(bytes.NewReader(cover.Data))
+	if err != nil {
+		return Cover{}, fmt.Errorf("decoding cover: %w", err)
+	}
+	width, height := side, side
+	if cover.Width > cover.Height {
+		height = max1(cover.Height * side / cover.Width)
+	} else {
+		width = max1(cover.Width * side / cover.Height)
+	}
+	scaled := scaleImage(img, width, height)
+
+	var buf bytes.Buffer
+	if cover.ContentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: coverQuality})
+	} else {
+		err = png.Encode(&buf, scaled)
+	}
+	if err != nil {
+		return Cover{}, fmt.Errorf("encoding thumbnail: %w", err)
+	}
+	return Cover{ContentType: cover.ContentType, Data: buf.Bytes(), Width: width, Height: height}, nil
+}
+
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// scaleImage scales src down to width by height pixels with a box filter.
+// Averaging the alpha-premultiplied RGBA values means transparent pixels
+// don't darken their neighbours.
+func scaleImage(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	srcRGBA := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(srcRGBA, srcRGBA.Bounds(), src, bounds.Min, draw.Src)
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, (y+1)*srcHeight/height
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, (x+1)*srcWidth/width
+			if x1 == x0 {
+				x1++
+			}
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := srcRGBA.Pix[srcRGBA.PixOffset(x0, sy):srcRGBA.PixOffset(x1, sy)]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			offset := dst.PixOffset(x, y)
+			for i := range sum {
+				dst.Pix[offset+i] = uint8((sum[i] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
+
+// GetThumbnail implements ThumbnailStore, reading the thumbnail's content
+// from the blob store.
+func (d *MemoryDatabase) GetThumbnail(albumID, size string) (Cover, error) {
+	d.lock.RLock()
+	thumbnail, ok := d.thumbnails[albumID][size]
+	d.lock.RUnlock()
+	if !ok {
+		return Cover{}, ErrDoesNotExist
+	}
+	data, err := d.Blobs.Get(thumbnail.Hash)
+	if err != nil {
+		return Cover{}, fmt.Errorf("getting thumbnail blob: %w", err)
+	}
+	thumbnail.Data = data
+	return thumbnail, nil
+}
+
+// PutThumbnail implements ThumbnailStore, storing the thumbnail's content
+// in the blob store. Thumbnails count towards MaxBytes, like covers.
+func (d *MemoryDatabase) PutThumbnail(albumID, size, coverHash string, thumbnail Cover) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	cover, ok := d.covers[albumID]
+	if !ok || cover.Hash != coverHash {
+		return ErrDoesNotExist
+	}
+	old, hasOld := d.thumbnails[albumID][size]
+	growth := int64(len(thumbnail.Data)) - int64(old.Size)
+	if d.MaxBytes > 0 && growth > 0 && d.bytes+growth > d.MaxBytes {
+		return fmt.Errorf("%w: max bytes %d reached", ErrFull, d.MaxBytes)
+	}
+	hash, err := d.Blobs.Put(thumbnail.Data)
+	if err != nil {
+		return fmt.Errorf("putting thumbnail blob: %w", err)
+	}
+	if hasOld {
+		d.bytes -= int64(old.Size)
+		_ = d.Blobs.Release(old.Hash)
+	}
+	thumbnail.Hash = hash
+	thumbnail.Size = len(thumbnail.Data)
+	thumbnail.Data = nil
+	if d.thumbnails[albumID] == nil {
+		d.thumbnails[albumID] = make(map[string]Cover)
+	}
+	d.thumbnails[albumID][size] = thumbnail
+	d.bytes += int64(thumbnail.Size)
+	return nil
+}
+
+// releaseThumbnails removes all the album's thumbnails, releasing their
+// blobs. The caller must hold the write lock.
+func (d *MemoryDatabase) releaseThumbnails(albumID string) {
+	for _, thumbnail := range d.thumbnails[albumID] {
+		d.bytes -= int64(thumbnail.Size)
+		// As for covers, the only possible error is that it's already gone
+		_ = d.Blobs.Release(thumbnail.Hash)
+	}
+	delete(d.thumbnails, albumID)
+}
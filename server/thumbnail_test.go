@@ -0,0 +1,132 @@
+// Tests for cover art thumbnails
+
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func getThumbnail(t *testing.T, server *Server, size string) image.Config {
+	t.Helper()
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1/cover?size="+size, nil))
+	ensureStatus(t, result, http.StatusOK)
+	data, _ := io.ReadAll(result.Body)
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || "image/"+format != result.Header.Get("Content-Type") {
+		t.Fatalf("bad %s thumbnail: format %q, Content-Type %q, error %v", size, format, result.Header.Get("Content-Type"), err)
+	}
+	return config
+}
+
+func TestThumbnails(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven"})
+	server := NewServer(db, log.New(io.Discard, "", 0), WithThumbnailSizes(map[string]int{"tiny": 10, "small": 40, "huge": 1000}))
+	result := serve(t, server, putCoverRequest(t, "image/jpeg", encodeImage(t, "jpeg", 200, 100)))
+	ensureStatus(t, result, http.StatusOK)
+
+	// Thumbnails keep the aspect ratio, and aren't bigger than the cover
+	for size, want := range map[string][2]int{"tiny": {10, 5}, "small": {40, 20}, "huge": {200, 100}} {
+		config := getThumbnail(t, server, size)
+		if got := [2]int{config.Width, config.Height}; got != want {
+			t.Errorf("%s: got %v, want %v", size, got, want)
+		}
+	}
+	if got := len(db.thumbnails["a1"]); got != 2 {
+		t.Fatalf("got %d stored thumbnails, want 2", got)
+	}
+	hash := db.thumbnails["a1"]["small"].Hash
+	getThumbnail(t, server, "small")
+	if db.thumbnails["a1"]["small"].Hash != hash {
+		t.Fatalf("thumbnail was regenerated")
+	}
+
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/cover?size=medium", nil))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"size": map[string]interface{}{"error": "invalid", "message": "size must be one of huge, small, tiny"},
+	})
+
+	// Replacing the cover replaces its thumbnails
+	result = serve(t, server, putCoverRequest(t, "image/png", encodeImage(t, "png", 50, 100)))
+	ensureStatus(t, result, http.StatusOK)
+	if got := len(db.thumbnails["a1"]); got != 0 {
+		t.Fatalf("got %d stored thumbnails, want 0", got)
+	}
+	if config := getThumbnail(t, server, "small"); config.Width != 20 || config.Height != 40 {
+		t.Fatalf("got %dx%d thumbnail, want 20x40", config.Width, config.Height)
+	}
+
+	// Deleting the cover deletes them too, and releases their blobs
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a1/cover", nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	if len(db.thumbnails["a1"]) != 0 || len(db.Blobs.(*MemoryBlobStore).blobs) != 0 {
+		t.Fatalf("thumbnails weren't released")
+	}
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/cover?size=small", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestScaleImage(t *testing.T) {
+	// Each 2x2 block averages to one pixel
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 2; y++ {
+			if x < 2 {
+				src.Set(x, y, color.RGBA{200, 0, 0, 255})
+			} else if (x+y)%2 == 0 {
+				src.Set(x, y, color.RGBA{0, 0, 100, 255})
+			} else {
+				src.Set(x, y, color.RGBA{0, 0, 0, 0})
+			}
+		}
+	}
+	got := scaleImage(src, 2, 1)
+	want := []uint8{200, 0, 0, 255, 0, 0, 50, 128}
+	if !reflect.DeepEqual(got.Pix, want) {
+		t.Fatalf("got pixels %v, want %v", got.Pix, want)
+	}
+}
+
+func TestParseThumbnailSizes(t *testing.T) {
+	sizes, err := parseThumbnailSizes("small=150, x-large=2000")
+	if err != nil || !reflect.DeepEqual(sizes, map[string]int{"small": 150, "x-large": 2000}) {
+		t.Fatalf("got %v, error %v", sizes, err)
+	}
+	for _, bad := range []string{"small", "small=big", "small=0", "small=5000", "Small=10"} {
+		if _, err := parseThumbnailSizes(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+
+	// Invalid sizes given to the server are ignored
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0), WithThumbnailSizes(map[string]int{"small": 10, "Big": 100}))
+	if !reflect.DeepEqual(server.thumbnailSizes, map[string]int{"small": 10}) {
+		t.Fatalf("got sizes %v", server.thumbnailSizes)
+	}
+}
+
+func TestThumbnailPNG(t *testing.T) {
+	// Transparency is kept in PNG thumbnails
+	img := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	thumbnail, err := makeThumbnail(Cover{ContentType: "image/png", Data: buf.Bytes(), Width: 20, Height: 20}, 5)
+	if err != nil {
+		t.Fatalf("error making thumbnail: %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(thumbnail.Data))
+	if err != nil {
+		t.Fatalf("error decoding thumbnail: %v", err)
+	}
+	if _, _, _, a := decoded.At(2, 2).RGBA(); a != 0 || thumbnail.Width != 5 || thumbnail.Height != 5 {
+		t.Fatalf("bad thumbnail: %dx%d, alpha %d", thumbnail.Width, thumbnail.Height, a)
+	}
+}
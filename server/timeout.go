@@ -0,0 +1,129 @@
+// Per-request handler timeout middleware
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// timeoutHandler is similar to http.TimeoutHandler, but writes a structured
+// JSON error instead of a plain text response when the timeout is exceeded.
+//
+// The handler is run in its own goroutine with a request context that's
+// cancelled after the timeout. Its response is buffered and only copied to
+// the real ResponseWriter if it finishes in time. Routes can override
+// defaultTimeout (see routeconfig.go); if neither sets one, the request
+// isn't timed out.
+func (s *Server) timeoutHandler(h http.Handler, defaultTimeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := s.routeTimeout(r, defaultTimeout)
+		if timeout <= 0 || isStreaming(r) || r.URL.Path == "/ws" || strings.HasPrefix(r.URL.Path, "/uploads/") || r.URL.Path == "/albums/import" {
+			// Streamed responses can't be buffered, and may legitimately
+			// take longer than the timeout, as can large uploads and
+			// throttled imports; the http.Server's ReadTimeout and
+			// WriteTimeout still apply. WebSocket connections need the
+			// real ResponseWriter to take over the connection.
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan struct{})
+		panicChan := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicChan <- p
+				}
+			}()
+			h.ServeHTTP(tw, r)
+			close(done)
+		}()
+
+		select {
+		case p := <-panicChan:
+			// Re-panic in this goroutine so net/http's recovery and
+			// logging works as usual
+			panic(p)
+
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			dst := w.Header()
+			for k, vv := range tw.header {
+				dst[k] = vv
+			}
+			if !tw.wroteHeader {
+				tw.status = http.StatusOK
+			}
+			w.WriteHeader(tw.status)
+			_, err := w.Write(tw.buf.Bytes())
+			if err != nil {
+				s.log.Printf("error writing response: %v", err)
+			}
+
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			if ctx.Err() == context.DeadlineExceeded {
+				s.writeError(w, r, apierr.Timeout().WithCause(fmt.Errorf("handler timed out after %s", timeout)))
+			}
+			// Otherwise the client went away, so don't bother responding
+		}
+	})
+}
+
+// timeoutWriter is the buffered ResponseWriter passed to handlers wrapped
+// by timeoutHandler. Once the timeout has fired, writes return
+// http.ErrHandlerTimeout.
+type timeoutWriter struct {
+	header http.Header
+
+	mu          sync.Mutex
+	buf         bytes.Buffer
+	status      int
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	return tw.buf.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.writeHeaderLocked(status)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(status int) {
+	tw.wroteHeader = true
+	tw.status = status
+}
@@ -0,0 +1,121 @@
+// Tests for the handler timeout middleware
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHandlerTimeout(t *testing.T) {
+	db := newSlowDatabase()
+	defer close(db.release)
+	server := NewServer(db, log.New(io.Discard, "", 0), WithHandlerTimeout(10*time.Millisecond))
+
+	result := serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusServiceUnavailable)
+	ensureError(t, result, http.StatusServiceUnavailable, "timeout", nil)
+}
+
+func TestHandlerTimeoutNotExceeded(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	server := NewServer(db, log.New(io.Discard, "", 0), WithHandlerTimeout(time.Second))
+
+	want := testAlbum{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795}
+	testGetAlbum(t, server, getAlbumTest{"/albums/a1", http.StatusOK, want})
+
+	result := serve(t, server, newRequest(t, "PUT", "/albums", nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+	allow := result.Header.Get("Allow")
+	if allow != "GET, HEAD, POST, OPTIONS" {
+		t.Fatalf("bad Allow header: got %q, want %q", allow, "GET, HEAD, POST, OPTIONS")
+	}
+}
+
+// slowDatabase is a Database whose methods block until release is closed.
+type slowDatabase struct {
+	release chan struct{}
+}
+
+func newSlowDatabase() slowDatabase {
+	return slowDatabase{release: make(chan struct{})}
+}
+
+func (d slowDatabase) GetAlbums() ([]Album, error) {
+	<-d.release
+	return nil, nil
+}
+
+func (d slowDatabase) GetAlbumByID(id string) (Album, error) {
+	<-d.release
+	return Album{}, ErrDoesNotExist
+}
+
+func (d slowDatabase) GetAlbumsByIDs(ids []string) ([]Album, error) {
+	<-d.release
+	return nil, nil
+}
+
+func (d slowDatabase) AddAlbum(album Album) (Album, error) {
+	<-d.release
+	return album, nil
+}
+
+func (d slowDatabase) PutAlbum(album Album, version int) (Album, error) {
+	<-d.release
+	return album, nil
+}
+
+func (d slowDatabase) DeleteAlbum(id string) error {
+	<-d.release
+	return nil
+}
+
+func (d slowDatabase) SoftDeleteAlbum(id string, deletedAt time.Time) error {
+	<-d.release
+	return nil
+}
+
+func (d slowDatabase) RestoreAlbum(id string) (Album, error) {
+	<-d.release
+	return Album{}, nil
+}
+
+func (d slowDatabase) PurgeDeletedAlbums(before time.Time) (int, error) {
+	<-d.release
+	return 0, nil
+}
+
+func (d slowDatabase) GetAlbumVersions(id string) ([]Album, error) {
+	<-d.release
+	return nil, nil
+}
+
+func (d slowDatabase) GetAlbumAt(id string, at time.Time) (Album, error) {
+	<-d.release
+	return Album{}, nil
+}
+
+func (d slowDatabase) AddTrack(albumID string, track Track) (Track, error) {
+	<-d.release
+	return track, nil
+}
+
+func (d slowDatabase) GetGenres() ([]Genre, error) {
+	<-d.release
+	return nil, nil
+}
+
+func (d slowDatabase) AddGenre(genre Genre) error {
+	<-d.release
+	return nil
+}
+
+func (d slowDatabase) SearchAlbums(query string) ([]Album, error) {
+	<-d.release
+	return nil, nil
+}
@@ -0,0 +1,118 @@
+// Album tracks sub-resource
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Track represents a single track on an album.
+type Track struct {
+	Number   int    `json:"number" xml:"number"`
+	Title    string `json:"title" xml:"title"`
+	Duration int    `json:"duration" xml:"duration"` // in seconds
+
+	// ISRC is the recording's International Standard Recording Code, and
+	// MusicBrainzID its MusicBrainz recording ID (see identifiers.go).
+	ISRC          string `json:"isrc,omitempty" xml:"isrc,omitempty"`
+	MusicBrainzID string `json:"musicbrainz_id,omitempty" xml:"musicbrainz_id,omitempty"`
+}
+
+const (
+	maxTrackNumber   = 999
+	maxTrackDuration = 24 * 60 * 60
+)
+
+// sortTracks sorts tracks by track number.
+func sortTracks(tracks []Track) {
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].Number < tracks[j].Number
+	})
+}
+
+// validateTrack adds any validation issues with track to issues, with the
+// field names prefixed by prefix. A zero track number is allowed (it means
+// "next track").
+func validateTrack(track Track, prefix string, issues map[string]interface{}) {
+	if track.Number < 0 || track.Number > maxTrackNumber {
+		issues[prefix+"number"] = validationIssue{"out-of-range", fmt.Sprintf("number must be between 1 and %d", maxTrackNumber)}
+	}
+	if track.Title == "" {
+		issues[prefix+"title"] = validationIssue{"required", ""}
+	}
+	if track.Duration <= 0 || track.Duration > maxTrackDuration {
+		issues[prefix+"duration"] = validationIssue{"out-of-range", fmt.Sprintf("duration must be between 1 and %d seconds", maxTrackDuration)}
+	}
+	validateTrackIdentifiers(track, prefix, issues)
+}
+
+// validateAlbumTracks validates the tracks posted as part of a new album,
+// adding any issues to issues with field names like "tracks.0.title".
+// Tracks without a number are numbered by their position in the list. It
+// returns the tracks sorted by track number.
+func validateAlbumTracks(tracks []Track, issues map[string]interface{}) []Track {
+	numbers := make(map[int]bool)
+	for i := range tracks {
+		prefix := fmt.Sprintf("tracks.%d.", i)
+		if tracks[i].Number == 0 {
+			tracks[i].Number = i + 1
+		}
+		validateTrack(tracks[i], prefix, issues)
+		if numbers[tracks[i].Number] {
+			issues[prefix+"number"] = validationIssue{"duplicate", fmt.Sprintf("duplicate track number %d", tracks[i].Number)}
+		}
+		numbers[tracks[i].Number] = true
+	}
+	sortTracks(tracks)
+	return tracks
+}
+
+func (s *Server) getTracks(w http.ResponseWriter, r *http.Request, albumID string) {
+	album, err := s.db.GetAlbumByID(albumID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	if !album.visible(s.now()) {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	tracks := s.redactAlbum(r, album).Tracks
+	if tracks == nil {
+		tracks = []Track{}
+	}
+	s.writeJSON(w, r, http.StatusOK, tracks)
+}
+
+func (s *Server) addTrack(w http.ResponseWriter, r *http.Request, albumID string) {
+	var track Track
+	if !s.readJSON(w, r, &track) {
+		return
+	}
+	issues := make(map[string]interface{})
+	normalizeTrackIdentifiers(&track)
+	validateTrack(track, "", issues)
+	// The album has no ID here, so its own tracks count as other uses
+	noPrefix := func(int) string { return "" }
+	if err := s.checkUniqueIdentifiers(Album{Tracks: []Track{track}}, noPrefix, issues); err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+
+	before := s.albumSnapshot(albumID)
+	track, err := s.db.AddTrack(albumID, track)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("adding track: %w", err)))
+		return
+	}
+	s.audit(r, "update", "album", albumID, before, s.albumSnapshot(albumID))
+	s.writeJSON(w, r, http.StatusCreated, track)
+}
@@ -0,0 +1,118 @@
+// Tests for the album tracks sub-resource
+
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTracks(t *testing.T) {
+	server := newTestServer()
+	ensureTracks(t, server, "a1", []testTrack{})
+
+	body := `{"title": "Allegro ma non troppo", "duration": 960}`
+	result := serve(t, server, newRequest(t, "POST", "/albums/a1/tracks", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	var got testTrack
+	unmarshalResponse(t, result, &got)
+	want := testTrack{Number: 1, Title: "Allegro ma non troppo", Duration: 960}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad response: got vs want:\n%#v\n%#v", got, want)
+	}
+
+	body = `{"number": 4, "title": "Presto", "duration": 1500}`
+	result = serve(t, server, newRequest(t, "POST", "/albums/a1/tracks", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	body = `{"title": "Molto vivace", "duration": 700}`
+	result = serve(t, server, newRequest(t, "POST", "/albums/a1/tracks", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	body = `{"number": 2, "title": "Molto vivace", "duration": 700}`
+	result = serve(t, server, newRequest(t, "POST", "/albums/a1/tracks", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+
+	wantTracks := []testTrack{
+		{Number: 1, Title: "Allegro ma non troppo", Duration: 960},
+		{Number: 2, Title: "Molto vivace", Duration: 700},
+		{Number: 4, Title: "Presto", Duration: 1500},
+		{Number: 5, Title: "Molto vivace", Duration: 700},
+	}
+	ensureTracks(t, server, "a1", wantTracks)
+
+	// Tracks are included in the album resource too
+	testGetAlbum(t, server, getAlbumTest{"/albums/a1", http.StatusOK, testAlbum{
+		ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795, Tracks: wantTracks,
+	}})
+
+	// Track number already used
+	result = serve(t, server, newRequest(t, "POST", "/albums/a1/tracks", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusConflict)
+	ensureError(t, result, http.StatusConflict, "already-exists", nil)
+}
+
+func TestTracksErrors(t *testing.T) {
+	server := newTestServer()
+
+	result := serve(t, server, newRequest(t, "GET", "/albums/a9/tracks", nil))
+	ensureStatus(t, result, http.StatusNotFound)
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	body := `{"title": "Pianoman", "duration": 339}`
+	result = serve(t, server, newRequest(t, "POST", "/albums/a9/tracks", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusNotFound)
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	body = `{"number": -1, "duration": 0}`
+	result = serve(t, server, newRequest(t, "POST", "/albums/a1/tracks", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusBadRequest)
+	data := map[string]interface{}{
+		"number":   map[string]interface{}{"error": "out-of-range", "message": "number must be between 1 and 999"},
+		"title":    map[string]interface{}{"error": "required"},
+		"duration": map[string]interface{}{"error": "out-of-range", "message": "duration must be between 1 and 86400 seconds"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+
+	result = serve(t, server, newRequest(t, "DELETE", "/albums/a1/tracks", nil))
+	ensureStatus(t, result, http.StatusMethodNotAllowed)
+	ensureError(t, result, http.StatusMethodNotAllowed, "method-not-allowed", nil)
+}
+
+func TestAddAlbumWithTracks(t *testing.T) {
+	server := newTestServer()
+	body := `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel", "tracks": [
+		{"number": 2, "title": "Ain't No Crime", "duration": 202},
+		{"title": "Travelin' Prayer", "duration": 250}
+	]}`
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusBadRequest)
+	data := map[string]interface{}{
+		"tracks.1.number": map[string]interface{}{"error": "duplicate", "message": "duplicate track number 2"},
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", data)
+
+	body = `{"id": "a9", "title": "Pianoman", "artist": "Billy Joel", "tracks": [
+		{"number": 3, "title": "Piano Man", "duration": 339},
+		{"title": "Travelin' Prayer", "duration": 250}
+	]}`
+	result = serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	ensureTracks(t, server, "a9", []testTrack{
+		{Number: 2, Title: "Travelin' Prayer", Duration: 250},
+		{Number: 3, Title: "Piano Man", Duration: 339},
+	})
+}
+
+func ensureTracks(t *testing.T, server *Server, albumID string, want []testTrack) {
+	t.Helper()
+	result := serve(t, server, newRequest(t, "GET", "/albums/"+albumID+"/tracks", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var got []testTrack
+	unmarshalResponse(t, result, &got)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad tracks: got vs want:\n%#v\n%#v", got, want)
+	}
+}
@@ -0,0 +1,175 @@
+// Translating error messages into the client's language
+
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// sourceLanguage is the language the server's messages are written in.
+const sourceLanguage = "en"
+
+// Translator translates the server's user-facing messages (validation
+// messages and error titles, written in English) into one language.
+type Translator interface {
+	// Translate returns the translation of message, or false if it
+	// doesn't have one, in which case the next language in the fallback
+	// chain is tried.
+	Translate(message string) (string, bool)
+}
+
+// TranslatorFunc is an adapter to allow the use of ordinary functions as
+// translators, for example to translate messages with values in them
+// using patterns.
+type TranslatorFunc func(message string) (string, bool)
+
+func (f TranslatorFunc) Translate(message string) (string, bool) {
+	return f(message)
+}
+
+// Catalog is a static Translator that maps English messages to their
+// translations.
+type Catalog map[string]string
+
+func (c Catalog) Translate(message string) (string, bool) {
+	translation, ok := c[message]
+	return translation, ok
+}
+
+type languageTranslator struct {
+	tag        string // as registered, for Content-Language
+	translator Translator
+}
+
+// WithTranslator registers a translator for a language, given as a BCP 47
+// tag like "pt" or "pt-BR". Error messages are translated into the
+// language the client's Accept-Language header prefers, and the language
+// used is echoed in the Content-Language header.
+func WithTranslator(language string, translator Translator) Option {
+	return func(s *Server) {
+		if s.translators == nil {
+			s.translators = make(map[string]languageTranslator)
+		}
+		s.translators[strings.ToLower(language)] = languageTranslator{language, translator}
+	}
+}
+
+// WithLanguageFallback sets the languages to try, in order, when a client
+// asks for language and a message has no translation in it. The default
+// chain for a tag with a region (like "pt-BR") is the language alone
+// ("pt"). English, the language the messages are written in, is always
+// the last resort.
+func WithLanguageFallback(language string, fallbacks ...string) Option {
+	return func(s *Server) {
+		if s.languageFallbacks == nil {
+			s.languageFallbacks = make(map[string][]string)
+		}
+		lower := make([]string, len(fallbacks))
+		for i, fallback := range fallbacks {
+			lower[i] = strings.ToLower(fallback)
+		}
+		s.languageFallbacks[strings.ToLower(language)] = lower
+	}
+}
+
+// languageChain returns the lowercase language tags to try for a tag the
+// client asked for (itself first), not including the source language.
+func (s *Server) languageChain(tag string) []string {
+	if fallbacks, ok := s.languageFallbacks[tag]; ok {
+		return append([]string{tag}, fallbacks...)
+	}
+	if dash := strings.IndexByte(tag, '-'); dash >= 0 {
+		return []string{tag, tag[:dash]}
+	}
+	return []string{tag}
+}
+
+// translatorChain returns the translators to try for the request, best
+// first, and the language to report in Content-Language: the client's
+// most preferred language that has a translator (after fallbacks), or the
+// source language if none does.
+func (s *Server) translatorChain(r *http.Request) ([]languageTranslator, string) {
+	if len(s.translators) == 0 {
+		return nil, sourceLanguage
+	}
+	for _, tag := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+		var chain []languageTranslator
+		for _, language := range s.languageChain(tag) {
+			if language == sourceLanguage {
+				break
+			}
+			if t, ok := s.translators[language]; ok {
+				chain = append(chain, t)
+			}
+		}
+		if len(chain) > 0 {
+			return chain, chain[0].tag
+		}
+		if tag == sourceLanguage || strings.HasPrefix(tag, sourceLanguage+"-") {
+			break
+		}
+	}
+	return nil, sourceLanguage
+}
+
+// translate returns message in the client's language, trying each
+// translator in the chain in turn, or message itself if none has it.
+func translate(chain []languageTranslator, message string) string {
+	for _, t := range chain {
+		if translation, ok := t.translator.Translate(message); ok {
+			return translation
+		}
+	}
+	return message
+}
+
+// translateError returns a copy of the error with its messages translated
+// into the client's language (see WithTranslator), and sets the
+// Content-Language header. It returns the error unchanged if no
+// translators are registered.
+func (s *Server) translateError(w http.ResponseWriter, r *http.Request, apiErr *apierr.Error) *apierr.Error {
+	if len(s.translators) == 0 {
+		return apiErr
+	}
+	chain, language := s.translatorChain(r)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", language)
+	if len(chain) == 0 || len(apiErr.Data) == 0 {
+		return apiErr
+	}
+	data := make(map[string]interface{}, len(apiErr.Data))
+	for key, value := range apiErr.Data {
+		switch value := value.(type) {
+		case validationIssue:
+			if value.Message != "" {
+				value.Message = translate(chain, value.Message)
+			}
+			data[key] = value
+		case string:
+			if key == "message" {
+				data[key] = translate(chain, value)
+			} else {
+				data[key] = value
+			}
+		default:
+			data[key] = value
+		}
+	}
+	translated := *apiErr
+	translated.Data = data
+	return &translated
+}
+
+// errorTitle returns the title of an error code in the client's language,
+// for error formats that have one.
+func (s *Server) errorTitle(r *http.Request, apiErr *apierr.Error) string {
+	title, ok := apierr.Title(apiErr.Code)
+	if !ok {
+		title = http.StatusText(apiErr.Status)
+	}
+	chain, _ := s.translatorChain(r)
+	return translate(chain, title)
+}
@@ -0,0 +1,130 @@
+// Tests for translating error messages
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var testPortuguese = Catalog{
+	"Validation failed":                     "Falha na validação",
+	"price must be between 0 and $1000":     "o preço deve estar entre 0 e $1000",
+	"id must match the album ID in the URL": "o id deve corresponder ao ID do álbum na URL",
+}
+
+var testBrazilian = Catalog{
+	"price must be between 0 and $1000": "o preço tem que estar entre 0 e $1000",
+}
+
+func newTranslateTestServer(options ...Option) *Server {
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	options = append([]Option{
+		WithTranslator("pt", testPortuguese),
+		WithTranslator("pt-BR", testBrazilian),
+	}, options...)
+	return NewServer(db, log.New(io.Discard, "", 0), options...)
+}
+
+// postInvalidAlbum posts an album with an out-of-range price and
+// mismatched ID, with the given Accept-Language header.
+func postInvalidAlbum(t *testing.T, server *Server, acceptLanguage string) *http.Response {
+	t.Helper()
+	request := newRequest(t, "PUT", "/albums/a9", strings.NewReader(`{"id": "a8", "title": "x", "artist": "y", "price": 100001}`))
+	request.Header.Set("Accept-Language", acceptLanguage)
+	return serve(t, server, request)
+}
+
+func TestTranslateErrors(t *testing.T) {
+	server := newTranslateTestServer()
+	tests := []struct {
+		acceptLanguage string
+		language       string
+		price          string
+		id             string
+	}{
+		// pt-BR has its own price message, and falls back to pt for the ID
+		{"pt-BR", "pt-BR", "o preço tem que estar entre 0 e $1000", "o id deve corresponder ao ID do álbum na URL"},
+		{"pt-PT", "pt", "o preço deve estar entre 0 e $1000", "o id deve corresponder ao ID do álbum na URL"},
+		{"fr, pt;q=0.5", "pt", "o preço deve estar entre 0 e $1000", "o id deve corresponder ao ID do álbum na URL"},
+		{"en-GB, pt;q=0.5", "en", "price must be between 0 and $1000", "id must match the album ID in the URL"},
+		{"", "en", "price must be between 0 and $1000", "id must match the album ID in the URL"},
+	}
+	for _, test := range tests {
+		t.Run(test.acceptLanguage, func(t *testing.T) {
+			result := postInvalidAlbum(t, server, test.acceptLanguage)
+			ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+				"id":    map[string]interface{}{"error": "mismatch", "message": test.id},
+				"price": map[string]interface{}{"error": "out-of-range", "message": test.price},
+			})
+			if got := result.Header.Get("Content-Language"); got != test.language {
+				t.Fatalf("bad Content-Language: got %q, want %q", got, test.language)
+			}
+			if got := result.Header.Get("Vary"); !strings.Contains(got, "Accept-Language") {
+				t.Fatalf("Vary header %q doesn't include Accept-Language", got)
+			}
+		})
+	}
+}
+
+func TestTranslateFallback(t *testing.T) {
+	// Galician speakers would rather read Portuguese than English
+	server := newTranslateTestServer(WithLanguageFallback("gl", "pt"))
+	result := postInvalidAlbum(t, server, "gl")
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"id":    map[string]interface{}{"error": "mismatch", "message": "o id deve corresponder ao ID do álbum na URL"},
+		"price": map[string]interface{}{"error": "out-of-range", "message": "o preço deve estar entre 0 e $1000"},
+	})
+	if got := result.Header.Get("Content-Language"); got != "pt" {
+		t.Fatalf("bad Content-Language: got %q, want %q", got, "pt")
+	}
+
+	// A custom chain replaces the default one, so this skips pt-BR's own
+	// catalog in favour of plain pt
+	server = newTranslateTestServer(WithLanguageFallback("pt-br", "pt"), WithTranslator("pt-BR", Catalog{}))
+	result = postInvalidAlbum(t, server, "pt-BR")
+	if got := result.Header.Get("Content-Language"); got != "pt-BR" {
+		t.Fatalf("bad Content-Language: got %q, want %q", got, "pt-BR")
+	}
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"id":    map[string]interface{}{"error": "mismatch", "message": "o id deve corresponder ao ID do álbum na URL"},
+		"price": map[string]interface{}{"error": "out-of-range", "message": "o preço deve estar entre 0 e $1000"},
+	})
+}
+
+func TestTranslatorFunc(t *testing.T) {
+	shout := TranslatorFunc(func(message string) (string, bool) {
+		if strings.HasPrefix(message, "price") {
+			return strings.ToUpper(message), true
+		}
+		return "", false
+	})
+	server := newTranslateTestServer(WithTranslator("x-shout", shout))
+	result := postInvalidAlbum(t, server, "x-shout")
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"id":    map[string]interface{}{"error": "mismatch", "message": "id must match the album ID in the URL"},
+		"price": map[string]interface{}{"error": "out-of-range", "message": "PRICE MUST BE BETWEEN 0 AND $1000"},
+	})
+}
+
+func TestTranslateProblemTitle(t *testing.T) {
+	server := newTranslateTestServer(WithProblemDetails(true))
+	result := postInvalidAlbum(t, server, "pt")
+	ensureStatus(t, result, http.StatusBadRequest)
+	if got := readProblem(t, result)["title"]; got != "Falha na validação" {
+		t.Fatalf("bad title: got %q", got)
+	}
+}
+
+func TestTranslateNoTranslators(t *testing.T) {
+	server := newTestServer()
+	result := postInvalidAlbum(t, server, "pt")
+	ensureStatus(t, result, http.StatusBadRequest)
+	if got := result.Header.Get("Content-Language"); got != "" {
+		t.Fatalf("unexpected Content-Language header %q", got)
+	}
+}
@@ -0,0 +1,310 @@
+// Two-step direct upload of large cover art
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Large covers can be uploaded in two steps, so the upload itself doesn't
+// tie up the API: POST /albums/:id/cover/upload-url returns a one-time URL
+// (and token) to PUT the file to, which is served in the bulk lane (see
+// WithLanes) with a higher size limit, and then POST
+// /albums/:id/cover/confirm with the token checks the uploaded image and
+// attaches it as the album's cover, just like PUT /albums/:id/cover.
+//
+// If the database's blobs are in an object store that supports pre-signed
+// URLs (see DirectCoverStore), like S3, the URL is a pre-signed one, so
+// the file goes straight to the object store without passing through the
+// service at all; the response is the same shape either way. The same
+// stores let clients download covers directly too: GET
+// /albums/:id/cover/download-url returns a pre-signed URL for the cover.
+// Pending uploads are kept in memory until they're confirmed or expire.
+const (
+	uploadExpiry      = 15 * time.Minute
+	maxUploadBytes    = 50 << 20
+	maxPendingUploads = 100
+)
+
+// uploadTarget tells the client where to upload a file.
+type uploadTarget struct {
+	URL       string    `json:"url"`
+	Method    string    `json:"method"`
+	Token     string    `json:"token"` // give this to the confirm call
+	MaxBytes  int       `json:"max_bytes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// downloadTarget tells the client where to download a file.
+type downloadTarget struct {
+	URL       string    `json:"url"`
+	Method    string    `json:"method"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// BlobPresigner is an optional interface a BlobStore can implement if its
+// clients can upload and download blobs directly, with pre-signed URLs.
+type BlobPresigner interface {
+	// PresignGet returns a URL to GET the blob with the given hash from,
+	// served with the given Content-Type, that's valid for expiry.
+	PresignGet(hash, contentType string, expiry time.Duration) (string, error)
+
+	// PresignUpload returns a URL to PUT an upload with the given token
+	// to, that's valid for expiry. The upload isn't a blob until it's
+	// taken with TakeUpload and stored with Put.
+	PresignUpload(token string, expiry time.Duration) (string, error)
+
+	// TakeUpload returns the content of the upload with the given token
+	// and deletes it. It returns ErrDoesNotExist if nothing has been
+	// uploaded, or errUploadTooLarge if it's more than maxBytes.
+	TakeUpload(token string, maxBytes int) ([]byte, error)
+}
+
+// errUploadTooLarge means a file uploaded directly is too large.
+var errUploadTooLarge = errors.New("upload too large")
+
+// DirectCoverStore is an optional interface a CoverStore can implement to
+// let clients upload and download covers directly.
+type DirectCoverStore interface {
+	// CoverPresigner returns the presigner for the blob store covers are
+	// kept in, or nil if they can't be accessed directly.
+	CoverPresigner() BlobPresigner
+
+	// GetCoverMetadata is like GetCover, but doesn't get the cover's Data
+	// (only its Hash).
+	GetCoverMetadata(albumID string) (Cover, error)
+}
+
+// coverPresigner returns the presigner for covers, or nil if clients can't
+// upload and download them directly.
+func (s *Server) coverPresigner() BlobPresigner {
+	store, ok := s.db.(DirectCoverStore)
+	if !ok {
+		return nil
+	}
+	return store.CoverPresigner()
+}
+
+// pendingUpload is an upload URL that's been handed out but not yet
+// confirmed.
+type pendingUpload struct {
+	albumID     string
+	expires     time.Time
+	direct      bool // uploaded to a pre-signed URL, not to putUpload
+	uploaded    bool
+	contentType string
+	data        []byte
+}
+
+// uploads holds the pending uploads, by token.
+type uploads struct {
+	mu      sync.Mutex
+	pending map[string]*pendingUpload
+}
+
+// removeExpired deletes pending uploads that have expired. The caller must
+// hold the lock.
+func (u *uploads) removeExpired(now time.Time) {
+	for token, upload := range u.pending {
+		if !now.Before(upload.expires) {
+			delete(u.pending, token)
+		}
+	}
+}
+
+// get returns the unexpired pending upload with the given token, or nil.
+// The caller must hold the lock.
+func (u *uploads) get(token string, now time.Time) *pendingUpload {
+	upload, ok := u.pending[token]
+	if !ok || !now.Before(upload.expires) {
+		return nil
+	}
+	return upload
+}
+
+func (s *Server) createCoverUpload(w http.ResponseWriter, r *http.Request, albumID string) {
+	if s.coverStore(w, r, albumID) == nil {
+		return
+	}
+	var b [32]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("generating upload token: %w", err)))
+		return
+	}
+	token := hex.EncodeToString(b[:])
+	now := s.now()
+
+	uploadURL := s.resourceURL("/uploads/" + token)
+	presigner := s.coverPresigner()
+	if presigner != nil {
+		uploadURL, err = presigner.PresignUpload(token, uploadExpiry)
+		if err != nil {
+			s.writeError(w, r, apierr.Internal(fmt.Errorf("presigning upload URL: %w", err)))
+			return
+		}
+	}
+
+	s.uploads.mu.Lock()
+	s.uploads.removeExpired(now)
+	if len(s.uploads.pending) >= maxPendingUploads {
+		s.uploads.mu.Unlock()
+		s.writeError(w, r, apierr.Overloaded())
+		return
+	}
+	upload := &pendingUpload{albumID: albumID, expires: now.Add(uploadExpiry), direct: presigner != nil}
+	s.uploads.pending[token] = upload
+	s.uploads.mu.Unlock()
+
+	s.writeJSON(w, r, http.StatusCreated, uploadTarget{
+		URL:       uploadURL,
+		Method:    "PUT",
+		Token:     token,
+		MaxBytes:  maxUploadBytes,
+		ExpiresAt: upload.expires.UTC(),
+	})
+}
+
+// putUpload receives the file for a pending upload. The token in the URL
+// is the only authorization needed, and it can only be used once.
+func (s *Server) putUpload(w http.ResponseWriter, r *http.Request, token string) {
+	s.uploads.mu.Lock()
+	upload := s.uploads.get(token, s.now())
+	if upload == nil || upload.direct || upload.uploaded {
+		s.uploads.mu.Unlock()
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	// Claim it, so concurrent uploads with the same token fail
+	upload.uploaded = true
+	s.uploads.mu.Unlock()
+
+	data, ok := s.readUpload(w, r, maxUploadBytes, "upload")
+	if !ok {
+		// Let the client try again with the same token
+		s.uploads.mu.Lock()
+		upload.uploaded = false
+		s.uploads.mu.Unlock()
+		return
+	}
+	s.uploads.mu.Lock()
+	upload.data = data
+	upload.contentType = r.Header.Get("Content-Type")
+	s.uploads.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// confirmCoverUpload checks the uploaded file and makes it the album's
+// cover.
+func (s *Server) confirmCoverUpload(w http.ResponseWriter, r *http.Request, albumID string) {
+	store := s.coverStore(w, r, albumID)
+	if store == nil {
+		return
+	}
+	var input struct {
+		Token string `json:"token"`
+	}
+	if !s.readJSON(w, r, &input) {
+		return
+	}
+
+	s.uploads.mu.Lock()
+	upload := s.uploads.get(input.Token, s.now())
+	if upload == nil || upload.albumID != albumID {
+		s.uploads.mu.Unlock()
+		s.writeError(w, r, apierr.Validation(map[string]interface{}{
+			"token": validationIssue{"invalid", "token must be from an unexpired upload URL for this album"},
+		}))
+		return
+	}
+	if upload.data == nil && !upload.direct {
+		s.uploads.mu.Unlock()
+		s.writeNotUploaded(w, r)
+		return
+	}
+	// It's used up whether or not the file's a valid cover
+	delete(s.uploads.pending, input.Token)
+	s.uploads.mu.Unlock()
+
+	data, contentType := upload.data, upload.contentType
+	if upload.direct {
+		var err error
+		data, err = s.coverPresigner().TakeUpload(input.Token, maxUploadBytes)
+		switch {
+		case errors.Is(err, ErrDoesNotExist):
+			// Let the client try again once it's uploaded
+			s.uploads.mu.Lock()
+			s.uploads.pending[input.Token] = upload
+			s.uploads.mu.Unlock()
+			s.writeNotUploaded(w, r)
+			return
+		case errors.Is(err, errUploadTooLarge):
+			s.writeError(w, r, apierr.TooLarge(maxUploadBytes))
+			return
+		case err != nil:
+			s.writeError(w, r, apierr.Database(fmt.Errorf("getting upload: %w", err)))
+			return
+		}
+	}
+	s.storeCover(w, r, store, albumID, data, contentType)
+}
+
+func (s *Server) writeNotUploaded(w http.ResponseWriter, r *http.Request) {
+	s.writeError(w, r, apierr.Validation(map[string]interface{}{
+		"token": validationIssue{"not-uploaded", "file hasn't been uploaded yet"},
+	}))
+}
+
+// getCoverDownloadURL returns a pre-signed URL the album's cover can be
+// downloaded from directly, if the database supports that.
+func (s *Server) getCoverDownloadURL(w http.ResponseWriter, r *http.Request, albumID string) {
+	if s.coverStore(w, r, albumID) == nil {
+		return
+	}
+	presigner := s.coverPresigner()
+	if presigner == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	cover, err := s.db.(DirectCoverStore).GetCoverMetadata(albumID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	downloadURL, err := presigner.PresignGet(cover.Hash, cover.ContentType, uploadExpiry)
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("presigning download URL: %w", err)))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, downloadTarget{
+		URL:       downloadURL,
+		Method:    "GET",
+		ExpiresAt: s.now().Add(uploadExpiry).UTC(),
+	})
+}
+
+// CoverPresigner implements DirectCoverStore, returning the blob store if
+// it supports pre-signed URLs.
+func (d *MemoryDatabase) CoverPresigner() BlobPresigner {
+	presigner, _ := d.Blobs.(BlobPresigner)
+	return presigner
+}
+
+// GetCoverMetadata implements DirectCoverStore.
+func (d *MemoryDatabase) GetCoverMetadata(albumID string) (Cover, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	cover, ok := d.covers[albumID]
+	if !ok {
+		return Cover{}, ErrDoesNotExist
+	}
+	return cover, nil
+}
@@ -0,0 +1,116 @@
+// Tests for two-step direct upload of large cover art
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createTestUpload(t *testing.T, server *Server, albumID string) uploadTarget {
+	t.Helper()
+	result := serve(t, server, newRequest(t, "POST", "/albums/"+albumID+"/cover/upload-url", nil))
+	ensureStatus(t, result, http.StatusCreated)
+	var target uploadTarget
+	unmarshalResponse(t, result, &target)
+	return target
+}
+
+func confirmTestUpload(t *testing.T, server *Server, albumID, token string) *http.Response {
+	t.Helper()
+	body := strings.NewReader(`{"token": "` + token + `"}`)
+	return serve(t, server, newRequest(t, "POST", "/albums/"+albumID+"/cover/confirm", body))
+}
+
+func TestCoverUpload(t *testing.T) {
+	server := newTestServer()
+	target := createTestUpload(t, server, "a1")
+	if target.Method != "PUT" || target.URL != "/uploads/"+target.Token || target.MaxBytes != maxUploadBytes {
+		t.Fatalf("bad upload target: %#v", target)
+	}
+
+	// Confirming before uploading is an error, but doesn't use up the token
+	result := confirmTestUpload(t, server, "a1", target.Token)
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"token": map[string]interface{}{"error": "not-uploaded", "message": "file hasn't been uploaded yet"},
+	})
+
+	request := newRequest(t, "PUT", target.URL, bytes.NewReader(encodeImage(t, "png", 20, 10)))
+	request.Header.Set("Content-Type", "image/png")
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusNoContent)
+
+	// The upload URL can only be used once
+	result = serve(t, server, newRequest(t, "PUT", target.URL, strings.NewReader("again")))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	// The token is for a particular album
+	result = confirmTestUpload(t, server, "a2", target.Token)
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"token": map[string]interface{}{"error": "invalid", "message": "token must be from an unexpired upload URL for this album"},
+	})
+
+	result = confirmTestUpload(t, server, "a1", target.Token)
+	ensureStatus(t, result, http.StatusOK)
+	var info coverInfo
+	unmarshalResponse(t, result, &info)
+	if info.ContentType != "image/png" || info.Width != 20 || info.Height != 10 {
+		t.Fatalf("bad cover info: %#v", info)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/cover", nil))
+	ensureStatus(t, result, http.StatusOK)
+
+	// Once confirmed, the token is used up
+	result = confirmTestUpload(t, server, "a1", target.Token)
+	ensureStatus(t, result, http.StatusBadRequest)
+}
+
+func TestCoverUploadInvalid(t *testing.T) {
+	server := newTestServer()
+	target := createTestUpload(t, server, "a1")
+	request := newRequest(t, "PUT", target.URL, strings.NewReader(`<svg xmlns="http://www.w3.org/2000/svg"/>`))
+	request.Header.Set("Content-Type", "image/svg+xml")
+	ensureStatus(t, serve(t, server, request), http.StatusNoContent)
+
+	// The file is checked just like a direct PUT of the cover
+	result := confirmTestUpload(t, server, "a1", target.Token)
+	ensureError(t, result, http.StatusUnsupportedMediaType, "unsupported-media-type", map[string]interface{}{
+		"supported": []interface{}{"image/png", "image/jpeg", "image/gif"},
+	})
+	result = serve(t, server, newRequest(t, "GET", "/albums/a1/cover", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	result = serve(t, server, newRequest(t, "POST", "/albums/x/cover/upload-url", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newRequest(t, "PUT", "/uploads/nope", strings.NewReader("x")))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestCoverUploadExpiry(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	server := NewServer(db, log.New(io.Discard, "", 0), WithClock(func() time.Time { return now }))
+
+	target := createTestUpload(t, server, "a1")
+	if !target.ExpiresAt.Equal(now.Add(uploadExpiry)) {
+		t.Fatalf("got expiry %s, want %s", target.ExpiresAt, now.Add(uploadExpiry))
+	}
+	now = now.Add(uploadExpiry)
+	result := serve(t, server, newRequest(t, "PUT", target.URL, bytes.NewReader(encodeImage(t, "png", 1, 1))))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	// Expired uploads don't count towards the limit
+	for i := 0; i < maxPendingUploads; i++ {
+		createTestUpload(t, server, "a1")
+	}
+	result = serve(t, server, newRequest(t, "POST", "/albums/a1/cover/upload-url", nil))
+	ensureError(t, result, http.StatusServiceUnavailable, "overloaded", nil)
+	now = now.Add(uploadExpiry)
+	createTestUpload(t, server, "a1")
+}
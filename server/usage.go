@@ -0,0 +1,182 @@
+// Anonymous usage ping
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// If it's turned on with -usage-ping (it's off by default), the server
+// POSTs a small, anonymous usage report to the given URL once a day, so
+// the maintainers can see which backends and features are used and are
+// worth investing in. The report is a usageReport: the build version,
+// the Go version and platform, the type of database and blob store, which
+// optional features are turned on, and the number of albums rounded down
+// to a power of ten. It never includes album data, IDs, URLs, tokens, or
+// anything else from the configuration or the requests served. The
+// server logs a line at startup saying where the report is sent, so it
+// can't be turned on unnoticed.
+const (
+	usagePingInterval = 24 * time.Hour
+	usagePingTimeout  = 10 * time.Second
+)
+
+// usageReport is the body of the usage ping.
+type usageReport struct {
+	Version   string   `json:"version"`
+	GoVersion string   `json:"go_version"`
+	OS        string   `json:"os"`
+	Arch      string   `json:"arch"`
+	Database  string   `json:"database"`             // Go type, like "MemoryDatabase"
+	BlobStore string   `json:"blob_store,omitempty"` // Go type, if known
+	Albums    string   `json:"albums,omitempty"`     // rounded down, like "100+"
+	Features  []string `json:"features"`             // sorted
+}
+
+// WithUsagePing sends an anonymous usage report to the URL endpoint once
+// a day. The default (an empty endpoint) is not to. If the URL isn't a
+// valid http or https URL, an error is logged and no reports are sent.
+func WithUsagePing(endpoint string) Option {
+	return func(s *Server) {
+		s.usagePingURL = endpoint
+	}
+}
+
+// usagePingJob returns the job that sends the usage report, or false if
+// there's no valid ping URL.
+func (s *Server) usagePingJob() (Job, bool) {
+	if s.usagePingURL == "" {
+		return Job{}, false
+	}
+	u, err := url.Parse(s.usagePingURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		s.log.Printf("error configuring usage ping: URL %q must be an absolute http or https URL", s.usagePingURL)
+		return Job{}, false
+	}
+	s.log.Printf("sending anonymous usage reports to %s every %s (turn off by removing -usage-ping)", u.Host, usagePingInterval)
+	client := &http.Client{Timeout: usagePingTimeout}
+	return Job{Name: "usage-ping", Interval: usagePingInterval, Run: func(ctx context.Context) error {
+		return s.sendUsageReport(ctx, client)
+	}}, true
+}
+
+// sendUsageReport POSTs the usage report to the ping URL.
+func (s *Server) sendUsageReport(ctx context.Context, client *http.Client) error {
+	b, err := json.Marshal(s.usageReport())
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", s.usagePingURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("sending usage report: %w", err)
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 4096)) // so the connection can be reused
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("sending usage report: %s", response.Status)
+	}
+	return nil
+}
+
+// usageReport returns the current usage report.
+func (s *Server) usageReport() usageReport {
+	report := usageReport{
+		Version:   buildVersion(),
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Database:  typeName(s.db),
+		Features:  s.enabledFeatures(),
+	}
+	if memory, ok := s.db.(*MemoryDatabase); ok && memory.Blobs != nil {
+		report.BlobStore = typeName(memory.Blobs)
+	}
+	if reporter, ok := s.db.(StatsReporter); ok {
+		report.Albums = roundDownCount(reporter.Stats().Albums)
+	}
+	return report
+}
+
+// enabledFeatures returns the names of the optional features that are
+// turned on, sorted.
+func (s *Server) enabledFeatures() []string {
+	features := []string{}
+	add := func(name string, enabled bool) {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	add("admin", s.adminToken != "")
+	add("adaptive-limit", s.adaptive != nil)
+	add("audit", s.auditStore != nil)
+	add("authenticators", len(s.authenticators) > 0)
+	add("base-url", s.baseURL != nil)
+	add("dev", s.devMode)
+	add("duplicate-window", s.duplicateWindow > 0)
+	add("event-broker", s.eventBrokerURL != "")
+	add("favorites", s.favoriteStore != nil)
+	add("field-policy", len(s.fieldPolicy) > 0)
+	add("handler-timeout", s.handlerTimeout > 0)
+	add("idempotency", s.idempotencyTTL > 0)
+	add("import-rate", s.importThrottle != nil)
+	add("lanes", s.lanes != nil)
+	add("legacy-sunset", !s.legacySunset.IsZero())
+	add("max-in-flight", s.maxInFlight > 0)
+	add("path-policy", s.pathPolicy == PathRedirect || s.pathPolicy == PathRewrite)
+	add("payments", s.paymentProvider != nil)
+	add("problem-json", s.problemDetails)
+	add("response-cache", s.responseCache != nil)
+	add("route-config", len(s.routeConfigOverrides) > 0)
+	add("self-links", s.selfLinks)
+	add("signing", s.signingKey != nil)
+	add("soft-delete-retention", s.deletedRetention > 0)
+	add("static-files", s.staticFiles != nil)
+	add("stripe-webhooks", s.stripeWebhookSecret != "")
+	add("tenants", s.tenants != nil)
+	add("trusted-proxies", len(s.trustedProxies) > 0)
+	add("webhooks", len(s.webhookConfig) > 0)
+	sort.Strings(features)
+	return features
+}
+
+// typeName returns the name of v's type, without the package or pointer,
+// like "MemoryDatabase".
+func typeName(v interface{}) string {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Name() == "" {
+		return t.String()
+	}
+	return t.Name()
+}
+
+// roundDownCount rounds n down to a power of ten, like "0", "1+", "10+",
+// or "100+", so the report doesn't say exactly how big the catalog is.
+func roundDownCount(n int) string {
+	if n <= 0 {
+		return "0"
+	}
+	rounded := 1
+	for rounded <= n/10 {
+		rounded *= 10
+	}
+	return strconv.Itoa(rounded) + "+"
+}
@@ -0,0 +1,112 @@
+// Tests for the anonymous usage ping
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsagePing(t *testing.T) {
+	var reports []usageReport
+	var contentType string
+	status := http.StatusNoContent
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report usageReport
+		json.NewDecoder(r.Body).Decode(&report)
+		reports = append(reports, report)
+		contentType = r.Header.Get("Content-Type")
+		w.WriteHeader(status)
+	}))
+	defer collector.Close()
+
+	db := NewMemoryDatabase()
+	for _, id := range []string{"a1", "a2", "a3", "a4", "a5", "a6", "a7", "a8", "a9", "a10", "a11", "a12"} {
+		db.AddAlbum(Album{ID: id, Title: "Title " + id, Artist: "Artist"})
+	}
+	var logged bytes.Buffer
+	server := NewServer(db, log.New(&logged, "", 0),
+		WithUsagePing(collector.URL+"/ping"),
+		WithAdminToken("s3cret"),
+		WithIdempotencyTTL(time.Hour),
+	)
+	defer server.background.Stop(context.Background())
+	if want := "sending anonymous usage reports to " + strings.TrimPrefix(collector.URL, "http://"); !strings.Contains(logged.String(), want) {
+		t.Fatalf("expected log %q, got %q", want, logged.String())
+	}
+	if stats := server.jobStats(); len(stats) != 1 || stats[0].Name != "usage-ping" || stats[0].Interval != "24h0m0s" {
+		t.Fatalf("bad jobs: %+v", stats)
+	}
+
+	err := server.sendUsageReport(context.Background(), http.DefaultClient)
+	if err != nil {
+		t.Fatalf("error sending report: %v", err)
+	}
+	want := usageReport{
+		Version:   buildVersion(),
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Database:  "MemoryDatabase",
+		BlobStore: "MemoryBlobStore",
+		Albums:    "10+",
+		Features:  []string{"admin", "idempotency"},
+	}
+	if len(reports) != 1 || !reflect.DeepEqual(reports[0], want) || contentType != "application/json" {
+		t.Fatalf("got reports %+v (Content-Type %q), want %+v", reports, contentType, want)
+	}
+
+	status = http.StatusServiceUnavailable
+	err = server.sendUsageReport(context.Background(), http.DefaultClient)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected 503 error, got %v", err)
+	}
+}
+
+func TestUsagePingOff(t *testing.T) {
+	for _, endpoint := range []string{"", "collector.example.com/ping", "ftp://collector.example.com/"} {
+		var logged bytes.Buffer
+		server := NewServer(NewMemoryDatabase(), log.New(&logged, "", 0), WithUsagePing(endpoint))
+		if stats := server.jobStats(); len(stats) != 0 {
+			t.Errorf("%q: expected no jobs, got %+v", endpoint, stats)
+		}
+		if gotError := strings.Contains(logged.String(), "error configuring usage ping"); gotError != (endpoint != "") {
+			t.Errorf("%q: got log %q", endpoint, logged.String())
+		}
+	}
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0))
+	if server.usagePingURL != "" {
+		t.Fatalf("usage ping should be off by default")
+	}
+}
+
+func TestRoundDownCount(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{-1, "0"},
+		{0, "0"},
+		{1, "1+"},
+		{9, "1+"},
+		{10, "10+"},
+		{99, "10+"},
+		{100, "100+"},
+		{12345, "10000+"},
+	}
+	for _, test := range tests {
+		if got := roundDownCount(test.n); got != test.want {
+			t.Errorf("roundDownCount(%d) = %q, want %q", test.n, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+// User accounts and sessions
+
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Users sign up with POST /users, giving an email address and password,
+// and log in with POST /users/login, which returns a session token. The
+// token is sent like the admin token, in an "Authorization: Bearer
+// <token>" header, and identifies the user to per-user features: the
+// request's Principal has the user's ID (see userSessionAuthenticator).
+// GET /users/me returns the logged-in user, and POST /users/logout ends
+// the session. Sessions expire after sessionTTL.
+//
+// Passwords are hashed with PBKDF2-HMAC-SHA256 and a random salt per user
+// (see hashPassword), and session tokens are only stored as a SHA-256
+// hash, so neither can be recovered from the UserStore. Logins with an
+// unknown email address take as long as those with a wrong password, and
+// get the same error, so they don't reveal who has an account. Likewise,
+// signing up with an email address that's taken gets the same response
+// as a new signup, though no account is created.
+//
+// Expired sessions are deleted when they're next used, and stores that
+// implement SessionPruner have the rest deleted every
+// sessionPruneInterval, so sessions that are never used again don't pile
+// up.
+const (
+	minPasswordLength  = 8
+	maxPasswordLength  = 128 // long enough for any passphrase
+	passwordIterations = 310000
+	sessionTTL         = 30 * 24 * time.Hour
+	sessionTokenPrefix = "sess_"
+
+	sessionPruneInterval = time.Hour
+)
+
+// User is a user account.
+type User struct {
+	ID           string    `json:"id"`
+	Email        string    `json:"email"` // lowercase
+	PasswordHash string    `json:"-"`     // see hashPassword
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Session is a logged-in user's session.
+type Session struct {
+	TokenHash string // hex SHA-256 of the session token
+	UserID    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// UserStore is the interface used by the server to store users and their
+// sessions.
+type UserStore interface {
+	// AddUser adds a user. It returns ErrAlreadyExists if the user's ID
+	// or email address is already taken.
+	AddUser(user User) error
+
+	// GetUser returns the user with the given ID, or ErrDoesNotExist.
+	GetUser(id string) (User, error)
+
+	// GetUserByEmail returns the user with the given (lowercase) email
+	// address, or ErrDoesNotExist.
+	GetUserByEmail(email string) (User, error)
+
+	// AddSession adds a session.
+	AddSession(session Session) error
+
+	// GetSession returns the session with the given token hash, or
+	// ErrDoesNotExist. Expired sessions may still be returned.
+	GetSession(tokenHash string) (Session, error)
+
+	// DeleteSession deletes the session with the given token hash. It
+	// returns ErrDoesNotExist if there's no such session.
+	DeleteSession(tokenHash string) error
+}
+
+// SessionPruner is an optional interface a UserStore can implement to have
+// the server delete expired sessions periodically.
+type SessionPruner interface {
+	// DeleteExpiredSessions deletes sessions that expire at or before now.
+	DeleteExpiredSessions(now time.Time) error
+}
+
+// pruneSessionsJob returns the job that deletes expired sessions.
+func (s *Server) pruneSessionsJob(pruner SessionPruner) Job {
+	return Job{Name: "prune-sessions", Interval: sessionPruneInterval, Run: func(ctx context.Context) error {
+		err := pruner.DeleteExpiredSessions(s.now())
+		if err != nil {
+			return fmt.Errorf("deleting expired sessions: %w", err)
+		}
+		return nil
+	}}
+}
+
+// WithUserStore sets the store for users and sessions. The default is
+// none, in which case the /users routes aren't available.
+func WithUserStore(store UserStore) Option {
+	return func(s *Server) {
+		s.userStore = store
+	}
+}
+
+// hashPassword returns the hash of password with a new random salt, as
+// "pbkdf2-sha256$<iterations>$<base64 salt>$<base64 hash>".
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("generating salt: %w", err)
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations)
+	return "pbkdf2-sha256$" + strconv.Itoa(passwordIterations) + "$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key), nil
+}
+
+// checkPassword reports whether password matches hash (from hashPassword).
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iterations)
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// dummyPasswordHash is checked against for logins with an unknown email
+// address, so they take as long as those with a wrong password.
+var dummyPasswordHash = "pbkdf2-sha256$" + strconv.Itoa(passwordIterations) + "$AAAAAAAAAAAAAAAAAAAAAA$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+// pbkdf2SHA256 derives a 32-byte key from password and salt using PBKDF2
+// (RFC 8018) with HMAC-SHA256. The key is a single block, as it's the
+// same length as the hash.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1}) // block index
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// hashSessionToken returns the hash a session token is stored as.
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// userSessionAuthenticator authenticates requests with a user's session
+// token. Other bearer tokens are passed on to the rest of the chain.
+type userSessionAuthenticator struct {
+	store UserStore
+	now   func() time.Time
+}
+
+// errInvalidSession is returned for session tokens that don't exist or
+// have expired.
+var errInvalidSession = errors.New("invalid or expired session token")
+
+func (a userSessionAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !strings.HasPrefix(token, sessionTokenPrefix) {
+		return Principal{}, ErrNoCredentials
+	}
+	tokenHash := hashSessionToken(token)
+	session, err := a.store.GetSession(tokenHash)
+	if errors.Is(err, ErrDoesNotExist) {
+		return Principal{}, errInvalidSession
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	if !a.now().Before(session.ExpiresAt) {
+		err := a.store.DeleteSession(tokenHash)
+		if err != nil && !errors.Is(err, ErrDoesNotExist) {
+			return Principal{}, err
+		}
+		return Principal{}, errInvalidSession
+	}
+	return Principal{ID: session.UserID, Role: RolePublic, UserID: session.UserID}, nil
+}
+
+// userInput is the email address and password given to sign up or log in.
+type userInput struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	if s.userStore == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	var input userInput
+	if !s.readJSON(w, r, &input) {
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(input.Email))
+	issues := make(map[string]interface{})
+	at := strings.LastIndexByte(email, '@')
+	switch {
+	case email == "":
+		issues["email"] = validationIssue{"required", ""}
+	case at < 1 || at == len(email)-1 || strings.ContainsAny(email, " \t\r\n"):
+		issues["email"] = validationIssue{"invalid", "email must be an email address"}
+	}
+	switch {
+	case input.Password == "":
+		issues["password"] = validationIssue{"required", ""}
+	case utf8.RuneCountInString(input.Password) < minPasswordLength || utf8.RuneCountInString(input.Password) > maxPasswordLength:
+		issues["password"] = validationIssue{"out-of-range", fmt.Sprintf("password must be between %d and %d characters", minPasswordLength, maxPasswordLength)}
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+
+	hash, err := hashPassword(input.Password)
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(err))
+		return
+	}
+	id, err := s.idGenerator.NewID()
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("generating user ID: %w", err)))
+		return
+	}
+	user := User{ID: id, Email: email, PasswordHash: hash, CreatedAt: s.now().UTC()}
+	err = s.userStore.AddUser(user)
+	if err != nil && !errors.Is(err, ErrAlreadyExists) {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("adding user: %w", err)))
+		return
+	}
+	if err == nil {
+		s.audit(r, "create", "user", user.ID, nil, snapshot(user))
+	}
+	// The user can fetch their account at /users/me once they log in.
+	// If the email address was taken, the response is the same, so it
+	// doesn't reveal that it has an account (logging in will fail).
+	w.Header().Set("Location", s.resourceURL(apiPrefix(r)+"/users/me"))
+	s.writeJSON(w, r, http.StatusCreated, user)
+}
+
+// loginResponse is the response to a successful login.
+type loginResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	User      User      `json:"user"`
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	if s.userStore == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	var input userInput
+	if !s.readJSON(w, r, &input) {
+		return
+	}
+	user, err := s.userStore.GetUserByEmail(strings.ToLower(strings.TrimSpace(input.Email)))
+	switch {
+	case errors.Is(err, ErrDoesNotExist):
+		checkPassword(dummyPasswordHash, input.Password)
+		s.writeError(w, r, apierr.Unauthorized())
+		return
+	case err != nil:
+		s.writeError(w, r, apierr.Database(err))
+		return
+	case !checkPassword(user.PasswordHash, input.Password):
+		s.writeError(w, r, apierr.Unauthorized())
+		return
+	}
+
+	var b [32]byte
+	_, err = rand.Read(b[:])
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("generating session token: %w", err)))
+		return
+	}
+	token := sessionTokenPrefix + hex.EncodeToString(b[:])
+	now := s.now().UTC()
+	session := Session{TokenHash: hashSessionToken(token), UserID: user.ID, CreatedAt: now, ExpiresAt: now.Add(sessionTTL)}
+	err = s.userStore.AddSession(session)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("adding session: %w", err)))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, loginResponse{Token: token, ExpiresAt: session.ExpiresAt, User: user})
+}
+
+// requireUser writes a 401 Unauthorized error if the request isn't from a
+// logged-in user. It returns the user's ID, or "" if the caller should
+// return from the handler early.
+func (s *Server) requireUser(w http.ResponseWriter, r *http.Request) string {
+	userID := s.principal(r).UserID
+	if s.userStore == nil || userID == "" {
+		s.writeError(w, r, apierr.Unauthorized())
+		return ""
+	}
+	return userID
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	if s.userStore == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	if s.requireUser(w, r) == "" {
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	err := s.userStore.DeleteSession(hashSessionToken(token))
+	if err != nil && !errors.Is(err, ErrDoesNotExist) {
+		s.writeError(w, r, apierr.Database(fmt.Errorf("deleting session: %w", err)))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getCurrentUser(w http.ResponseWriter, r *http.Request) {
+	if s.userStore == nil {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	userID := s.requireUser(w, r)
+	if userID == "" {
+		return
+	}
+	user, err := s.userStore.GetUser(userID)
+	if err != nil {
+		s.writeError(w, r, apierr.Database(err))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, user)
+}
+
+// MemoryUserStore is a UserStore that keeps users and sessions in memory.
+type MemoryUserStore struct {
+	lock     sync.RWMutex
+	users    map[string]User    // by ID
+	byEmail  map[string]string  // user ID by email address
+	sessions map[string]Session // by token hash
+}
+
+// NewMemoryUserStore creates a new, empty in-memory user store.
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:    make(map[string]User),
+		byEmail:  make(map[string]string),
+		sessions: make(map[string]Session),
+	}
+}
+
+func (m *MemoryUserStore) AddUser(user User) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.users[user.ID]; ok {
+		return ErrAlreadyExists
+	}
+	if _, ok := m.byEmail[user.Email]; ok {
+		return ErrAlreadyExists
+	}
+	m.users[user.ID] = user
+	m.byEmail[user.Email] = user.ID
+	return nil
+}
+
+func (m *MemoryUserStore) GetUser(id string) (User, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	user, ok := m.users[id]
+	if !ok {
+		return User{}, ErrDoesNotExist
+	}
+	return user, nil
+}
+
+func (m *MemoryUserStore) GetUserByEmail(email string) (User, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	id, ok := m.byEmail[email]
+	if !ok {
+		return User{}, ErrDoesNotExist
+	}
+	return m.users[id], nil
+}
+
+func (m *MemoryUserStore) AddSession(session Session) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sessions[session.TokenHash] = session
+	return nil
+}
+
+func (m *MemoryUserStore) GetSession(tokenHash string) (Session, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	session, ok := m.sessions[tokenHash]
+	if !ok {
+		return Session{}, ErrDoesNotExist
+	}
+	return session, nil
+}
+
+func (m *MemoryUserStore) DeleteExpiredSessions(now time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for tokenHash, session := range m.sessions {
+		if !now.Before(session.ExpiresAt) {
+			delete(m.sessions, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryUserStore) DeleteSession(tokenHash string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.sessions[tokenHash]; !ok {
+		return ErrDoesNotExist
+	}
+	delete(m.sessions, tokenHash)
+	return nil
+}
@@ -0,0 +1,184 @@
+// Tests for user accounts and sessions
+
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newUserTestServer(now *time.Time) (*Server, *MemoryAuditStore) {
+	auditStore := NewMemoryAuditStore()
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithClock(func() time.Time { return *now }),
+		WithIDGenerator(&SequentialIDGenerator{}),
+		WithAuditStore(auditStore),
+		WithUserStore(NewMemoryUserStore()),
+	)
+	return server, auditStore
+}
+
+func newSessionRequest(t *testing.T, method, path, token string) *http.Request {
+	t.Helper()
+	request := newRequest(t, method, path, nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	return request
+}
+
+func TestUsers(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	server, auditStore := newUserTestServer(&now)
+	result := serve(t, server, newRequest(t, "POST", "/users", strings.NewReader(`{"email": " Kim@Example.com", "password": "correct horse"}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	if got := result.Header.Get("Location"); got != "/users/me" {
+		t.Fatalf("got Location %q, want /users/me", got)
+	}
+	var created map[string]interface{}
+	unmarshalResponse(t, result, &created)
+	if !reflect.DeepEqual(created, map[string]interface{}{"id": "id1", "email": "kim@example.com", "created_at": "2021-06-01T12:00:00Z"}) {
+		t.Fatalf("bad user: %v", created)
+	}
+
+	// Signing up with a taken email address looks the same, so it doesn't
+	// reveal who has an account, but doesn't change the account
+	result = serve(t, server, newRequest(t, "POST", "/users", strings.NewReader(`{"email": "kim@example.com", "password": "battery staple"}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	if got := result.Header.Get("Location"); got != "/users/me" {
+		t.Fatalf("got Location %q, want /users/me", got)
+	}
+	var duplicate map[string]interface{}
+	unmarshalResponse(t, result, &duplicate)
+	if !reflect.DeepEqual(duplicate, map[string]interface{}{"id": "id2", "email": "kim@example.com", "created_at": "2021-06-01T12:00:00Z"}) {
+		t.Fatalf("bad user: %v", duplicate)
+	}
+	result = serve(t, server, newRequest(t, "POST", "/users/login", strings.NewReader(`{"email": "kim@example.com", "password": "battery staple"}`)))
+	ensureError(t, result, http.StatusUnauthorized, "unauthorized", nil)
+
+	// The password isn't in the audit log
+	entries, _ := auditStore.GetAuditEntries(AuditFilter{})
+	if len(entries) != 1 || entries[0].Resource != "user" || strings.Contains(string(entries[0].After), "pbkdf2") {
+		t.Fatalf("bad audit entries: %+v", entries)
+	}
+
+	for _, input := range []string{
+		`{"email": "kim@example.com", "password": "wrong password"}`,
+		`{"email": "lee@example.com", "password": "correct horse"}`,
+	} {
+		result = serve(t, server, newRequest(t, "POST", "/users/login", strings.NewReader(input)))
+		ensureError(t, result, http.StatusUnauthorized, "unauthorized", nil)
+	}
+	result = serve(t, server, newRequest(t, "POST", "/users/login", strings.NewReader(`{"email": "KIM@example.com", "password": "correct horse"}`)))
+	ensureStatus(t, result, http.StatusOK)
+	var login loginResponse
+	unmarshalResponse(t, result, &login)
+	if !strings.HasPrefix(login.Token, sessionTokenPrefix) || login.User.ID != "id1" || !login.ExpiresAt.Equal(now.Add(sessionTTL)) {
+		t.Fatalf("bad login: %+v", login)
+	}
+
+	// The session token identifies the user
+	result = serve(t, server, newSessionRequest(t, "GET", "/users/me", login.Token))
+	ensureStatus(t, result, http.StatusOK)
+	var user User
+	unmarshalResponse(t, result, &user)
+	if user.ID != "id1" || user.Email != "kim@example.com" {
+		t.Fatalf("bad user: %+v", user)
+	}
+	if principal := server.principal(newSessionRequest(t, "GET", "/", login.Token)); principal != (Principal{ID: "id1", Role: RolePublic, UserID: "id1"}) {
+		t.Fatalf("bad principal: %+v", principal)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/users/me", nil))
+	ensureError(t, result, http.StatusUnauthorized, "unauthorized", nil)
+
+	// Logging out ends the session, and unknown sessions are rejected
+	result = serve(t, server, newSessionRequest(t, "POST", "/users/logout", login.Token))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newSessionRequest(t, "GET", "/users/me", login.Token))
+	ensureError(t, result, http.StatusUnauthorized, "unauthorized", nil)
+	result = serve(t, server, newSessionRequest(t, "GET", "/albums", login.Token))
+	ensureError(t, result, http.StatusUnauthorized, "unauthorized", nil)
+
+	// Sessions expire
+	result = serve(t, server, newRequest(t, "POST", "/users/login", strings.NewReader(`{"email": "kim@example.com", "password": "correct horse"}`)))
+	ensureStatus(t, result, http.StatusOK)
+	unmarshalResponse(t, result, &login)
+	now = now.Add(sessionTTL)
+	result = serve(t, server, newSessionRequest(t, "GET", "/users/me", login.Token))
+	ensureError(t, result, http.StatusUnauthorized, "unauthorized", nil)
+	if _, err := server.userStore.GetSession(hashSessionToken(login.Token)); err != ErrDoesNotExist {
+		t.Fatalf("got %v for expired session, want it deleted", err)
+	}
+}
+
+func TestPruneSessions(t *testing.T) {
+	store := NewMemoryUserStore()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	store.AddSession(Session{TokenHash: "old", UserID: "u1", ExpiresAt: now})
+	store.AddSession(Session{TokenHash: "new", UserID: "u1", ExpiresAt: now.Add(time.Second)})
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithClock(func() time.Time { return now }),
+		WithUserStore(store),
+	)
+	defer server.Close()
+	err := server.pruneSessionsJob(store).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetSession("old"); err != ErrDoesNotExist {
+		t.Fatalf("got %v for expired session, want it deleted", err)
+	}
+	if _, err := store.GetSession("new"); err != nil {
+		t.Fatalf("got %v for current session", err)
+	}
+}
+
+func TestUserValidation(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	server, _ := newUserTestServer(&now)
+	result := serve(t, server, newRequest(t, "POST", "/users", strings.NewReader(`{}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"email":    map[string]interface{}{"error": "required"},
+		"password": map[string]interface{}{"error": "required"},
+	})
+	result = serve(t, server, newRequest(t, "POST", "/users", strings.NewReader(`{"email": "kim@", "password": "short"}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"email":    map[string]interface{}{"error": "invalid", "message": "email must be an email address"},
+		"password": map[string]interface{}{"error": "out-of-range", "message": "password must be between 8 and 128 characters"},
+	})
+}
+
+func TestUsersUnavailable(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "POST", "/users", strings.NewReader(`{"email": "kim@example.com", "password": "correct horse"}`)))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+
+	// Without a user store, session tokens aren't recognized
+	result = serve(t, server, newSessionRequest(t, "GET", "/albums", sessionTokenPrefix+"x"))
+	ensureStatus(t, result, http.StatusOK)
+}
+
+func TestPasswordHashing(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := hashPassword("correct horse")
+	if hash == other || !strings.HasPrefix(hash, "pbkdf2-sha256$310000$") {
+		t.Fatalf("got hashes %q and %q, want different salted ones", hash, other)
+	}
+	if !checkPassword(hash, "correct horse") || checkPassword(hash, "correct horsE") || checkPassword("bad", "correct horse") {
+		t.Fatal("checkPassword gave wrong result")
+	}
+
+	// RFC 7914 section 11 test vector for PBKDF2-HMAC-SHA256
+	key := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1)
+	if got := hex.EncodeToString(key); got != "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" {
+		t.Fatalf("got key %s", got)
+	}
+}
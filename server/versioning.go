@@ -0,0 +1,213 @@
+// Versioned routes (/v1), and deprecation of the unversioned album routes
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Every route is also served under /v1, like GET /v1/albums/:id, which is
+// the versioned API that clients should use from now on; links in /v1
+// responses point to /v1 routes too. The original unversioned album
+// routes (/albums and everything under it) are deprecated: they still
+// work, but their responses have a Deprecation header (RFC 9745) and a
+// Link to the /v1 route with rel="successor-version", and once a sunset
+// date is set (see WithLegacySunset), a Sunset header (RFC 8594) too.
+// From that date on they return 410 Gone, with the /v1 route to use in
+// the error data. Other unversioned routes, like /health and /genres,
+// aren't deprecated.
+//
+// To help with the migration, calls to the deprecated routes are counted
+// per client (by IP address and User-Agent), and admins can see who's
+// still calling what with GET /deprecations, so they can chase the
+// stragglers before the sunset date.
+const (
+	apiVersionPrefix   = "/v1"
+	maxLegacyClients   = 1000 // calls from further clients are only counted in the total
+	maxLegacyRoutes    = 100  // calls to further routes are counted as unknownLegacyRoute
+	unknownLegacyRoute = "unknown"
+)
+
+// legacyDeprecatedAt is when the unversioned album routes were deprecated,
+// for the Deprecation header.
+var legacyDeprecatedAt = time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC)
+
+// WithLegacySunset sets the date after which the deprecated, unversioned
+// album routes return 410 Gone. The default (the zero time) is to keep
+// serving them.
+func WithLegacySunset(sunset time.Time) Option {
+	return func(s *Server) {
+		s.legacySunset = sunset
+	}
+}
+
+// versionedKey is the context key for whether the request was made to a
+// /v1 route.
+type versionedKey struct{}
+
+// apiPrefix returns the prefix to give paths in links: "/v1" if the
+// request was made to a /v1 route, otherwise "".
+func apiPrefix(r *http.Request) string {
+	if r.Context().Value(versionedKey{}) != nil {
+		return apiVersionPrefix
+	}
+	return ""
+}
+
+// isLegacyRoute reports whether path is one of the deprecated, unversioned
+// album routes.
+func isLegacyRoute(path string) bool {
+	return path == "/albums" || strings.HasPrefix(path, "/albums/")
+}
+
+// versionHandler serves /v1 routes by stripping the prefix (so the rest of
+// the chain, and the router, see the unversioned path), and deprecates the
+// unversioned album routes. Once the path is final, it looks up the route,
+// for the rest of the chain (see withRouteMatch).
+func (s *Server) versionHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if path == apiVersionPrefix || strings.HasPrefix(path, apiVersionPrefix+"/") {
+			// Like http.StripPrefix, copy the URL rather than changing it
+			r = r.WithContext(context.WithValue(r.Context(), versionedKey{}, true))
+			u := *r.URL
+			u.Path = strings.TrimPrefix(path, apiVersionPrefix)
+			if u.Path == "" {
+				u.Path = "/"
+			}
+			u.RawPath = strings.TrimPrefix(u.RawPath, apiVersionPrefix)
+			r.URL = &u
+			h.ServeHTTP(w, s.withRouteMatch(r))
+			return
+		}
+		r = s.withRouteMatch(r)
+		if !isLegacyRoute(path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		now := s.now()
+		s.legacyCalls.record(r, now)
+		successor := s.resourceURL(apiVersionPrefix + r.URL.RequestURI())
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(legacyDeprecatedAt.Unix(), 10))
+		w.Header().Add("Link", "<"+successor+`>; rel="successor-version"`)
+		if !s.legacySunset.IsZero() {
+			w.Header().Set("Sunset", s.legacySunset.UTC().Format(http.TimeFormat))
+			if !now.Before(s.legacySunset) {
+				s.writeError(w, r, apierr.Gone().WithData(map[string]interface{}{
+					"message":   "unversioned routes were removed on " + s.legacySunset.UTC().Format("2006-01-02") + ", use the /v1 routes instead",
+					"successor": successor,
+				}))
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// legacyCalls counts calls to the deprecated routes, by client.
+type legacyCalls struct {
+	mu      sync.Mutex
+	total   int64
+	clients map[legacyClientKey]*legacyClient
+}
+
+type legacyClientKey struct {
+	ip        string
+	userAgent string
+}
+
+// legacyClient is a client's calls to the deprecated routes.
+type legacyClient struct {
+	IP        string           `json:"ip"`
+	UserAgent string           `json:"user_agent"`
+	Calls     int64            `json:"calls"`
+	Routes    map[string]int64 `json:"routes"` // by route name, like "GET /albums/{id}", or "unknown"
+	FirstSeen time.Time        `json:"first_seen"`
+	LastSeen  time.Time        `json:"last_seen"`
+}
+
+func newLegacyCalls() *legacyCalls {
+	return &legacyCalls{clients: make(map[legacyClientKey]*legacyClient)}
+}
+
+// record counts a call to a deprecated route. Routes are counted by name,
+// so IDs don't make the counts grow without bound, and calls that don't
+// match a route (or past maxLegacyRoutes for the client) are counted as
+// "unknown", so junk paths don't either.
+func (c *legacyCalls) record(r *http.Request, now time.Time) {
+	route := routeName(r)
+	if route == "" {
+		route = unknownLegacyRoute
+	}
+	key := legacyClientKey{clientIP(r), r.UserAgent()}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total++
+	client, ok := c.clients[key]
+	if !ok {
+		if len(c.clients) >= maxLegacyClients {
+			return
+		}
+		client = &legacyClient{IP: key.ip, UserAgent: key.userAgent, Routes: make(map[string]int64), FirstSeen: now.UTC()}
+		c.clients[key] = client
+	}
+	if _, ok := client.Routes[route]; !ok && len(client.Routes) >= maxLegacyRoutes {
+		route = unknownLegacyRoute
+	}
+	client.Calls++
+	client.Routes[route]++
+	client.LastSeen = now.UTC()
+}
+
+// deprecationReport is the response to GET /deprecations.
+type deprecationReport struct {
+	DeprecatedAt time.Time      `json:"deprecated_at"`
+	SunsetAt     *time.Time     `json:"sunset_at,omitempty"`
+	Calls        int64          `json:"calls"`   // since the server started
+	Clients      []legacyClient `json:"clients"` // most calls first
+}
+
+func (s *Server) getDeprecations(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	report := deprecationReport{DeprecatedAt: legacyDeprecatedAt, Clients: []legacyClient{}}
+	if !s.legacySunset.IsZero() {
+		sunset := s.legacySunset.UTC()
+		report.SunsetAt = &sunset
+	}
+
+	s.legacyCalls.mu.Lock()
+	report.Calls = s.legacyCalls.total
+	for _, client := range s.legacyCalls.clients {
+		copied := *client
+		copied.Routes = make(map[string]int64, len(client.Routes))
+		for route, calls := range client.Routes {
+			copied.Routes[route] = calls
+		}
+		report.Clients = append(report.Clients, copied)
+	}
+	s.legacyCalls.mu.Unlock()
+
+	sort.Slice(report.Clients, func(i, j int) bool {
+		a, b := report.Clients[i], report.Clients[j]
+		if a.Calls != b.Calls {
+			return a.Calls > b.Calls
+		}
+		if a.IP != b.IP {
+			return a.IP < b.IP
+		}
+		return a.UserAgent < b.UserAgent
+	})
+	s.writeJSON(w, r, http.StatusOK, report)
+}
@@ -0,0 +1,150 @@
+// Tests for versioned routes and deprecation of the unversioned ones
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersionedRoutes(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/v1/albums/a1", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var album Album
+	unmarshalResponse(t, result, &album)
+	if album.ID != "a1" || result.Header.Get("Deprecation") != "" {
+		t.Fatalf("got album %q, Deprecation %q", album.ID, result.Header.Get("Deprecation"))
+	}
+
+	// Links in /v1 responses are to /v1 routes
+	result = serve(t, server, newRequest(t, "POST", "/v1/albums", strings.NewReader(`{"id": "a3", "title": "Pianoman", "artist": "Billy Joel"}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	if got := result.Header.Get("Location"); got != "/v1/albums/a3" {
+		t.Fatalf("got Location %q, want /v1/albums/a3", got)
+	}
+
+	// Other routes are served under /v1 too, but aren't deprecated
+	for _, path := range []string{"/genres", "/v1/genres"} {
+		result = serve(t, server, newRequest(t, "GET", path, nil))
+		ensureStatus(t, result, http.StatusOK)
+		if got := result.Header.Get("Deprecation"); got != "" {
+			t.Errorf("%s: got Deprecation %q", path, got)
+		}
+	}
+	result = serve(t, server, newRequest(t, "GET", "/v1", nil))
+	ensureStatus(t, result, http.StatusNotFound)
+}
+
+func TestLegacyRoutes(t *testing.T) {
+	server := newSoftDeleteTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/albums/a1?format=json", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got, want := result.Header.Get("Deprecation"), "@1791936000"; got != want {
+		t.Errorf("got Deprecation %q, want %q", got, want)
+	}
+	if got, want := result.Header.Get("Link"), `</v1/albums/a1?format=json>; rel="successor-version"`; got != want {
+		t.Errorf("got Link %q, want %q", got, want)
+	}
+	if got := result.Header.Get("Sunset"); got != "" {
+		t.Errorf("got Sunset %q without a sunset date", got)
+	}
+
+	// Calls are counted per client and route
+	for _, call := range []struct{ ip, userAgent, path string }{
+		{"192.0.2.1", "old-app/1.0", "/albums"},
+		{"192.0.2.1", "old-app/1.0", "/albums/a2"},
+		{"192.0.2.1", "old-app/1.0", "/albums/a2/no/such/route"},
+		{"192.0.2.1", "old-app/1.0", "/albums/a3/another/junk/path"},
+		{"192.0.2.2", "", "/v1/albums"},
+	} {
+		request := newRequest(t, "GET", call.path, nil)
+		request.RemoteAddr = call.ip + ":1234"
+		request.Header.Set("User-Agent", call.userAgent)
+		serve(t, server, request)
+	}
+	result = serve(t, server, newRequest(t, "GET", "/deprecations", nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+	result = serve(t, server, newAdminRequest(t, "GET", "/deprecations", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var report deprecationReport
+	unmarshalResponse(t, result, &report)
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	want := deprecationReport{
+		DeprecatedAt: legacyDeprecatedAt,
+		Calls:        5,
+		Clients: []legacyClient{
+			{IP: "192.0.2.1", UserAgent: "old-app/1.0", Calls: 4, Routes: map[string]int64{"GET /albums": 1, "GET /albums/{id}": 1, "unknown": 2}, FirstSeen: now, LastSeen: now},
+			{IP: "", UserAgent: "", Calls: 1, Routes: map[string]int64{"GET /albums/{id}": 1}, FirstSeen: now, LastSeen: now},
+		},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("got report:\n%+v\nwant:\n%+v", report, want)
+	}
+}
+
+func TestLegacyRoutesCapped(t *testing.T) {
+	calls := newLegacyCalls()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	request := newRequest(t, "GET", "/albums", nil)
+	calls.record(request, now)
+	client := calls.clients[legacyClientKey{clientIP(request), request.UserAgent()}]
+	for i := len(client.Routes); i < maxLegacyRoutes; i++ {
+		client.Routes[fmt.Sprintf("GET /route%d", i)] = 1
+	}
+
+	calls.record(newRequest(t, "GET", "/albums/a1", nil), now)
+	calls.record(newRequest(t, "GET", "/albums", nil), now)
+	if got := len(client.Routes); got != maxLegacyRoutes+1 {
+		t.Errorf("got %d routes, want %d", got, maxLegacyRoutes+1)
+	}
+	if got := client.Routes["unknown"]; got != 1 {
+		t.Errorf("got %d unknown calls, want 1", got)
+	}
+	if got := client.Routes["GET /albums"]; got != 2 {
+		t.Errorf("got %d GET /albums calls, want 2", got)
+	}
+}
+
+func TestLegacySunset(t *testing.T) {
+	sunset := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	now := sunset.Add(-time.Hour)
+	server := NewServer(NewMemoryDatabase(), log.New(io.Discard, "", 0),
+		WithLegacySunset(sunset),
+		WithClock(func() time.Time { return now }),
+	)
+	result := serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if got, want := result.Header.Get("Sunset"), "Thu, 01 Jul 2021 00:00:00 GMT"; got != want {
+		t.Fatalf("got Sunset %q, want %q", got, want)
+	}
+
+	now = sunset
+	result = serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureError(t, result, http.StatusGone, "gone", map[string]interface{}{
+		"message":   "unversioned routes were removed on 2021-07-01, use the /v1 routes instead",
+		"successor": "/v1/albums",
+	})
+	result = serve(t, server, newRequest(t, "GET", "/v1/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+}
+
+func TestOpenAPIVersionedRoutes(t *testing.T) {
+	spec := openAPISpec()
+	if !spec.Paths["/albums/{id}"]["get"].Deprecated || spec.Paths["/albums/{id}"]["get"].Responses["410"] == nil {
+		t.Fatalf("unversioned album route isn't deprecated")
+	}
+	v1 := spec.Paths["/v1/albums/{id}"]["get"]
+	if v1 == nil || v1.Deprecated || v1.Responses["410"] != nil {
+		t.Fatalf("bad /v1 album route: %+v", v1)
+	}
+	if spec.Paths["/genres"]["get"].Deprecated || spec.Paths["/v1/genres"] != nil {
+		t.Fatalf("genre routes shouldn't be deprecated or versioned in the spec")
+	}
+}
@@ -0,0 +1,574 @@
+// Outbound webhooks, signed with HMAC-SHA256
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Every event (see Event) is POSTed as JSON to each registered webhook.
+// Each webhook has its own queue and delivers events in order, retrying
+// failures with exponential backoff (and jitter), so a slow or broken
+// receiver only delays its own events. Webhooks and their
+// delivery history are kept in memory: ones registered through the API are
+// lost on restart, so long-lived ones should be configured with -webhook.
+const (
+	defaultWebhookAttempts = 6
+	defaultWebhookBackoff  = time.Second // before the first retry, doubling after each
+	maxWebhookBackoff      = 10 * time.Minute
+	webhookTimeout         = 10 * time.Second
+	webhookQueueSize       = 1000 // events waiting per webhook
+	maxWebhookDeliveries   = 100  // delivery records kept per webhook
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookSecretOverlap   = 24 * time.Hour // how long a rotated-out secret still signs events
+)
+
+// Webhook is a URL that events are sent to.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+
+	// Secret is the key events are signed with. It's only returned when
+	// the webhook is created.
+	Secret string `json:"secret,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is the status of sending an event to a webhook.
+type WebhookDelivery struct {
+	EventID   string `json:"event_id"`
+	EventType string `json:"event_type"`
+
+	// Status is "pending" while the event is queued or being retried,
+	// then "succeeded" or "failed".
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+
+	// StatusCode and Error describe the last attempt that failed (or the
+	// response code of the one that succeeded).
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+// WithWebhooks registers webhooks that are sent every change, signed with
+// secret (see signWebhook), or with a random secret for each webhook if
+// it's empty.
+func WithWebhooks(secret string, urls ...string) Option {
+	return func(s *Server) {
+		for _, u := range urls {
+			s.webhookConfig = append(s.webhookConfig, Webhook{URL: u, Secret: secret})
+		}
+	}
+}
+
+// parseWebhookURLs parses the -webhooks flag, a comma-separated list of
+// URLs.
+func parseWebhookURLs(s string) ([]string, error) {
+	var urls []string
+	for _, u := range strings.Split(s, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		issues := make(map[string]interface{})
+		validateWebhookURL(u, issues)
+		if len(issues) > 0 {
+			return nil, fmt.Errorf("%q isn't an absolute http or https URL", u)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// WithWebhookRetries sets how many times delivering an event to a webhook
+// is attempted before it's marked as failed, and how long to wait before
+// the first retry (the wait doubles after each one, up to 10 minutes).
+// The defaults are 6 attempts and 1 second.
+func WithWebhookRetries(attempts int, backoff time.Duration) Option {
+	return func(s *Server) {
+		if attempts > 0 {
+			s.webhookAttempts = attempts
+		}
+		if backoff > 0 {
+			s.webhookBackoff = backoff
+		}
+	}
+}
+
+// webhooks is the set of registered webhooks.
+type webhooks struct {
+	mu    sync.Mutex
+	hooks map[string]*webhook // by ID
+	added int                 // number of webhooks ever added
+}
+
+// webhook is a registered webhook, with its queue and delivery history.
+type webhook struct {
+	Webhook
+	seq   int // order added, for listing
+	queue chan *webhookDelivery
+	stop  chan struct{} // closed when the webhook is deleted
+
+	mu         sync.Mutex
+	deliveries []*webhookDelivery // oldest first
+	secrets    []webhookSecret    // current first, then rotated-out ones
+}
+
+// webhookSecret is one of the secrets a webhook's events are signed with.
+type webhookSecret struct {
+	secret    string
+	createdAt time.Time
+	expiresAt time.Time // zero for the current secret
+}
+
+// webhookDelivery is a queued event and the status of its delivery.
+type webhookDelivery struct {
+	body   []byte
+	status WebhookDelivery // protected by webhook.mu
+}
+
+func (h *webhooks) len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.hooks)
+}
+
+// list returns the registered webhooks in the order they were added.
+func (h *webhooks) list() []*webhook {
+	h.mu.Lock()
+	registered := make([]*webhook, 0, len(h.hooks))
+	for _, hook := range h.hooks {
+		registered = append(registered, hook)
+	}
+	h.mu.Unlock()
+	sort.Slice(registered, func(i, j int) bool {
+		return registered[i].seq < registered[j].seq
+	})
+	return registered
+}
+
+// addWebhook registers a webhook and starts delivering events to it. If
+// it has no secret, a random one is generated. The webhook (including its
+// secret) is returned.
+func (s *Server) addWebhook(hook Webhook) (Webhook, error) {
+	id, err := s.idGenerator.NewID()
+	if err != nil {
+		return Webhook{}, fmt.Errorf("generating webhook ID: %w", err)
+	}
+	hook.ID = id
+	if hook.Secret == "" {
+		hook.Secret, err = newWebhookSecret()
+		if err != nil {
+			return Webhook{}, err
+		}
+	}
+	hook.CreatedAt = s.now().UTC()
+	registered := &webhook{
+		Webhook: hook,
+		queue:   make(chan *webhookDelivery, webhookQueueSize),
+		stop:    make(chan struct{}),
+		secrets: []webhookSecret{{secret: hook.Secret, createdAt: hook.CreatedAt}},
+	}
+	registered.Secret = "" // only kept in secrets, which rotation changes
+
+	s.webhooks.mu.Lock()
+	s.webhooks.added++
+	registered.seq = s.webhooks.added
+	s.webhooks.hooks[hook.ID] = registered
+	s.webhooks.mu.Unlock()
+	s.background.Go("webhook", func(ctx context.Context) {
+		s.runWebhook(ctx, registered)
+	})
+	return hook, nil
+}
+
+// newWebhookSecret generates a random webhook secret.
+func newWebhookSecret() (string, error) {
+	var b [32]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", fmt.Errorf("generating webhook secret: %w", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// Publish implements EventPublisher by queueing the event to each
+// webhook. It never blocks: if a webhook's queue is full, the delivery is
+// marked as failed.
+func (h *webhooks) Publish(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.hooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return // can't happen for our types
+	}
+	for _, hook := range h.hooks {
+		delivery := &webhookDelivery{
+			body: body,
+			status: WebhookDelivery{
+				EventID:   event.ID,
+				EventType: event.Type,
+				Status:    "pending",
+				CreatedAt: event.Time,
+				UpdatedAt: event.Time,
+			},
+		}
+		hook.record(delivery)
+		select {
+		case hook.queue <- delivery:
+		default:
+			hook.update(delivery, func(status *WebhookDelivery) {
+				status.Status = "failed"
+				status.Error = "webhook queue full"
+			})
+		}
+	}
+}
+
+// record adds the delivery to the webhook's history, dropping the oldest
+// once there are too many.
+func (h *webhook) record(delivery *webhookDelivery) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deliveries = append(h.deliveries, delivery)
+	if len(h.deliveries) > maxWebhookDeliveries {
+		h.deliveries = append(h.deliveries[:0], h.deliveries[1:]...)
+	}
+}
+
+// update changes the delivery's status under the webhook's lock.
+func (h *webhook) update(delivery *webhookDelivery, change func(status *WebhookDelivery)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	change(&delivery.status)
+}
+
+// statuses returns the status of the webhook's recent deliveries, most
+// recent first.
+func (h *webhook) statuses() []WebhookDelivery {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	statuses := make([]WebhookDelivery, len(h.deliveries))
+	for i, delivery := range h.deliveries {
+		statuses[len(statuses)-1-i] = delivery.status
+	}
+	return statuses
+}
+
+// runWebhook delivers the webhook's events in order until the webhook is
+// deleted or ctx is cancelled.
+func (s *Server) runWebhook(ctx context.Context, hook *webhook) {
+	for {
+		select {
+		case delivery := <-hook.queue:
+			s.deliverWebhook(ctx, hook, delivery)
+		case <-hook.stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliverWebhook sends the event, retrying with exponential backoff until
+// it succeeds or runs out of attempts.
+func (s *Server) deliverWebhook(ctx context.Context, hook *webhook, delivery *webhookDelivery) {
+	for attempt := 1; ; attempt++ {
+		statusCode, err := s.postWebhook(ctx, hook, delivery.body)
+		now := s.now().UTC()
+		if err == nil {
+			hook.update(delivery, func(status *WebhookDelivery) {
+				status.Status = "succeeded"
+				status.Attempts = attempt
+				status.StatusCode = statusCode
+				status.Error = ""
+				status.UpdatedAt = now
+				status.NextAttemptAt = nil
+			})
+			return
+		}
+		if attempt >= s.webhookAttempts {
+			hook.update(delivery, func(status *WebhookDelivery) {
+				status.Status = "failed"
+				status.Attempts = attempt
+				status.StatusCode = statusCode
+				status.Error = err.Error()
+				status.UpdatedAt = now
+				status.NextAttemptAt = nil
+			})
+			s.log.Printf("webhook %s: giving up on an event after %d attempts: %v", hook.ID, attempt, err)
+			return
+		}
+
+		wait := webhookBackoff(s.webhookBackoff, attempt)
+		next := now.Add(wait)
+		hook.update(delivery, func(status *WebhookDelivery) {
+			status.Attempts = attempt
+			status.StatusCode = statusCode
+			status.Error = err.Error()
+			status.UpdatedAt = now
+			status.NextAttemptAt = &next
+		})
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-hook.stop:
+			timer.Stop()
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// webhookBackoff returns how long to wait after the given (failed)
+// attempt: initial doubled for each previous attempt, up to a maximum,
+// with up to half of it randomized so receivers that come back up aren't
+// all hit at once.
+func webhookBackoff(initial time.Duration, attempt int) time.Duration {
+	backoff := float64(initial) * math.Pow(2, float64(attempt-1))
+	if backoff > float64(maxWebhookBackoff) {
+		backoff = float64(maxWebhookBackoff)
+	}
+	half := time.Duration(backoff / 2)
+	return half + time.Duration(mathrand.Int63n(int64(half)+1))
+}
+
+// postWebhook sends a single attempt, returning the response's status
+// code (if there was a response) and an error unless it was a 2xx.
+func (s *Server) postWebhook(ctx context.Context, hook *webhook, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "web-service-stdlib-webhooks")
+	request.Header.Set(webhookSignatureHeader, signWebhook(hook.signingSecrets(s.now()), s.now(), body))
+	response, err := s.webhookClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024)) // so the connection can be reused
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("webhook returned %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// signWebhook returns the signature header for a webhook request body:
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">". Including
+// the time lets receivers reject old requests that are replayed. While a
+// secret is being rotated there's a v1 signature for each secret, the
+// current one first, and receivers accept the request if any of them
+// matches a secret they know.
+func signWebhook(secrets []string, now time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	header := "t=" + timestamp
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		header += ",v1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return header
+}
+
+// signingSecrets returns the secrets to sign the webhook's events with at
+// time now, current first, forgetting rotated-out ones that have expired.
+func (h *webhook) signingSecrets(now time.Time) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	live := h.secrets[:1]
+	for _, secret := range h.secrets[1:] {
+		if now.Before(secret.expiresAt) {
+			live = append(live, secret)
+		}
+	}
+	h.secrets = live
+	secrets := make([]string, len(live))
+	for i, secret := range live {
+		secrets[i] = secret.secret
+	}
+	return secrets
+}
+
+// rotateSecret makes secret the webhook's current secret. The previous
+// one keeps signing events, alongside it, until webhookSecretOverlap
+// after now.
+func (h *webhook) rotateSecret(secret string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.secrets[0].expiresAt = now.Add(webhookSecretOverlap)
+	h.secrets = append([]webhookSecret{{secret: secret, createdAt: now}}, h.secrets...)
+}
+
+// newWebhookClient returns the HTTP client used to deliver webhooks. It
+// doesn't follow redirects, which are treated as failures.
+func newWebhookClient() *http.Client {
+	return &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (s *Server) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	registered := s.webhooks.list()
+	hooks := make([]Webhook, len(registered))
+	for i, hook := range registered {
+		hooks[i] = hook.Webhook
+		hooks[i].Secret = ""
+	}
+	s.writeJSON(w, r, http.StatusOK, hooks)
+}
+
+func (s *Server) addWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	var input struct {
+		URL    string `json:"url"`
+		Secret string `json:"secret"`
+	}
+	if !s.readJSON(w, r, &input) {
+		return
+	}
+	issues := make(map[string]interface{})
+	validateWebhookURL(input.URL, issues)
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+	hook, err := s.addWebhook(Webhook{URL: input.URL, Secret: input.Secret})
+	if err != nil {
+		s.writeError(w, r, apierr.Internal(err))
+		return
+	}
+	w.Header().Set("Location", "/webhooks/"+hook.ID)
+	s.writeJSON(w, r, http.StatusCreated, hook)
+}
+
+func validateWebhookURL(rawURL string, issues map[string]interface{}) {
+	u, err := url.Parse(rawURL)
+	switch {
+	case rawURL == "":
+		issues["url"] = validationIssue{"required", "url is required"}
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		issues["url"] = validationIssue{"invalid", "url must be an absolute http or https URL"}
+	}
+}
+
+// webhook returns the webhook with the given ID, or writes a 404 Not Found
+// error and returns nil.
+func (s *Server) webhook(w http.ResponseWriter, r *http.Request, id string) *webhook {
+	s.webhooks.mu.Lock()
+	hook, ok := s.webhooks.hooks[id]
+	s.webhooks.mu.Unlock()
+	if !ok {
+		s.writeError(w, r, apierr.NotFound())
+		return nil
+	}
+	return hook
+}
+
+func (s *Server) getWebhook(w http.ResponseWriter, r *http.Request, id string) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	hook := s.webhook(w, r, id)
+	if hook == nil {
+		return
+	}
+	public := hook.Webhook
+	public.Secret = ""
+	s.writeJSON(w, r, http.StatusOK, public)
+}
+
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request, id string) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	s.webhooks.mu.Lock()
+	hook, ok := s.webhooks.hooks[id]
+	delete(s.webhooks.hooks, id)
+	s.webhooks.mu.Unlock()
+	if !ok {
+		s.writeError(w, r, apierr.NotFound())
+		return
+	}
+	close(hook.stop)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getWebhookDeliveries(w http.ResponseWriter, r *http.Request, id string) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	hook := s.webhook(w, r, id)
+	if hook == nil {
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, hook.statuses())
+}
+
+func (s *Server) rotateWebhookSecret(w http.ResponseWriter, r *http.Request, id string) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	var input struct {
+		Secret string `json:"secret"`
+	}
+	if r.ContentLength != 0 && !s.readJSON(w, r, &input) {
+		return
+	}
+	hook := s.webhook(w, r, id)
+	if hook == nil {
+		return
+	}
+	if input.Secret == "" {
+		var err error
+		input.Secret, err = newWebhookSecret()
+		if err != nil {
+			s.writeError(w, r, apierr.Internal(err))
+			return
+		}
+	}
+	hook.rotateSecret(input.Secret, s.now().UTC())
+	public := hook.Webhook
+	public.Secret = input.Secret
+	s.writeJSON(w, r, http.StatusOK, public)
+}
@@ -0,0 +1,236 @@
+// Tests for outbound webhooks
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a test webhook endpoint that records the requests it
+// gets, responding with the given status codes in turn (then 200 OK).
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func (rec *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.requests = append(rec.requests, receivedWebhook{r.Header, body})
+	status := http.StatusOK
+	if len(rec.statuses) > 0 {
+		status = rec.statuses[0]
+		rec.statuses = rec.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (rec *webhookReceiver) received() []receivedWebhook {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]receivedWebhook(nil), rec.requests...)
+}
+
+func newWebhookTestServer(t *testing.T, options ...Option) *Server {
+	t.Helper()
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	options = append([]Option{WithAdminToken(testAdminToken), WithWebhookRetries(3, time.Millisecond)}, options...)
+	server := NewServer(db, log.New(io.Discard, "", 0), options...)
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func addTestWebhook(t *testing.T, server *Server, url, secret string) Webhook {
+	t.Helper()
+	body := `{"url": "` + url + `", "secret": "` + secret + `"}`
+	result := serve(t, server, newAdminRequest(t, "POST", "/webhooks", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusCreated)
+	var hook Webhook
+	unmarshalResponse(t, result, &hook)
+	return hook
+}
+
+// waitForDeliveries waits until the webhook has n deliveries that aren't
+// pending, and returns them.
+func waitForDeliveries(t *testing.T, server *Server, id string, n int) []WebhookDelivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		result := serve(t, server, newAdminRequest(t, "GET", "/webhooks/"+id+"/deliveries", nil))
+		ensureStatus(t, result, http.StatusOK)
+		var deliveries []WebhookDelivery
+		unmarshalResponse(t, result, &deliveries)
+		done := 0
+		for _, delivery := range deliveries {
+			if delivery.Status != "pending" {
+				done++
+			}
+		}
+		if done >= n {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d deliveries: %#v", n, deliveries)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	receiver := &webhookReceiver{}
+	endpoint := httptest.NewServer(receiver)
+	defer endpoint.Close()
+	server := newWebhookTestServer(t)
+	hook := addTestWebhook(t, server, endpoint.URL, "s3cret")
+	if hook.Secret != "s3cret" || hook.ID == "" {
+		t.Fatalf("bad webhook: %#v", hook)
+	}
+
+	result := serve(t, server, newRequest(t, "POST", "/albums", strings.NewReader(`{"id": "a2", "title": "Hey Jude", "artist": "The Beatles", "price": 2000}`)))
+	ensureStatus(t, result, http.StatusCreated)
+	deliveries := waitForDeliveries(t, server, hook.ID, 1)
+	if len(deliveries) != 1 || deliveries[0].Status != "succeeded" || deliveries[0].Attempts != 1 ||
+		deliveries[0].EventType != "album.created" || deliveries[0].StatusCode != 200 {
+		t.Fatalf("bad deliveries: %#v", deliveries)
+	}
+
+	received := receiver.received()
+	if len(received) != 1 {
+		t.Fatalf("got %d requests, want 1", len(received))
+	}
+	var event Event
+	err := json.Unmarshal(received[0].body, &event)
+	if err != nil {
+		t.Fatalf("error unmarshaling event: %v", err)
+	}
+	if event.ID != deliveries[0].EventID || event.Type != "album.created" || event.ResourceID != "a2" {
+		t.Fatalf("bad event: %#v", event)
+	}
+	var album Album
+	err = json.Unmarshal(event.Data, &album)
+	if err != nil || album.Title != "Hey Jude" {
+		t.Fatalf("got album %#v, error %v", album, err)
+	}
+
+	// Receivers can check the signature with the shared secret
+	signature := received[0].header.Get("X-Webhook-Signature")
+	parts := strings.Split(signature, ",")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "t=") || !strings.HasPrefix(parts[1], "v1=") {
+		t.Fatalf("bad signature header %q", signature)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(strings.TrimPrefix(parts[0], "t=") + "."))
+	mac.Write(received[0].body)
+	if want := hex.EncodeToString(mac.Sum(nil)); strings.TrimPrefix(parts[1], "v1=") != want {
+		t.Fatalf("got signature %q, want v1=%s", parts[1], want)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{500, 503}}
+	endpoint := httptest.NewServer(receiver)
+	defer endpoint.Close()
+	server := newWebhookTestServer(t)
+	hook := addTestWebhook(t, server, endpoint.URL, "")
+
+	ensureStatus(t, serve(t, server, newAdminRequest(t, "DELETE", "/albums/a1", nil)), http.StatusNoContent)
+	deliveries := waitForDeliveries(t, server, hook.ID, 1)
+	if deliveries[0].Status != "succeeded" || deliveries[0].Attempts != 3 || deliveries[0].EventType != "album.deleted" {
+		t.Fatalf("bad delivery: %#v", deliveries[0])
+	}
+	if n := len(receiver.received()); n != 3 {
+		t.Fatalf("got %d requests, want 3", n)
+	}
+
+	// After the last attempt, the delivery fails
+	receiver.mu.Lock()
+	receiver.statuses = []int{500, 500, 500}
+	receiver.mu.Unlock()
+	ensureStatus(t, serve(t, server, newAdminRequest(t, "POST", "/albums/a1/restore", nil)), http.StatusOK)
+	deliveries = waitForDeliveries(t, server, hook.ID, 2)
+	if deliveries[0].Status != "failed" || deliveries[0].Attempts != 3 || deliveries[0].StatusCode != 500 ||
+		deliveries[0].Error != "webhook returned 500 Internal Server Error" {
+		t.Fatalf("bad delivery: %#v", deliveries[0])
+	}
+}
+
+func TestWebhookAPI(t *testing.T) {
+	server := newWebhookTestServer(t, WithWebhooks("secret", "http://example.com/hook"))
+
+	result := serve(t, server, newRequest(t, "GET", "/webhooks", nil))
+	ensureError(t, result, http.StatusForbidden, "forbidden", nil)
+
+	result = serve(t, server, newAdminRequest(t, "POST", "/webhooks", strings.NewReader(`{"url": "ftp://example.com"}`)))
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"url": map[string]interface{}{"error": "invalid", "message": "url must be an absolute http or https URL"},
+	})
+
+	// A random secret is generated if none is given, and only returned
+	// when the webhook is created
+	hook := addTestWebhook(t, server, "https://example.org/hook", "")
+	if len(hook.Secret) != 64 {
+		t.Fatalf("got secret %q, want 64 hex digits", hook.Secret)
+	}
+	result = serve(t, server, newAdminRequest(t, "GET", "/webhooks", nil))
+	ensureStatus(t, result, http.StatusOK)
+	var hooks []Webhook
+	unmarshalResponse(t, result, &hooks)
+	var urls []string
+	for _, h := range hooks {
+		if h.Secret != "" {
+			t.Fatalf("secret returned in list")
+		}
+		urls = append(urls, h.URL)
+	}
+	if !reflect.DeepEqual(urls, []string{"http://example.com/hook", "https://example.org/hook"}) {
+		t.Fatalf("got webhooks %v", urls)
+	}
+
+	result = serve(t, server, newAdminRequest(t, "GET", "/webhooks/"+hook.ID, nil))
+	ensureStatus(t, result, http.StatusOK)
+	result = serve(t, server, newAdminRequest(t, "DELETE", "/webhooks/"+hook.ID, nil))
+	ensureStatus(t, result, http.StatusNoContent)
+	result = serve(t, server, newAdminRequest(t, "GET", "/webhooks/"+hook.ID, nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+	result = serve(t, server, newAdminRequest(t, "GET", "/webhooks/"+hook.ID+"/deliveries", nil))
+	ensureError(t, result, http.StatusNotFound, "not-found", nil)
+}
+
+func TestParseWebhookURLs(t *testing.T) {
+	urls, err := parseWebhookURLs(" http://a.example/x, ,https://b.example ")
+	if err != nil || !reflect.DeepEqual(urls, []string{"http://a.example/x", "https://b.example"}) {
+		t.Fatalf("got %v, %v", urls, err)
+	}
+	if _, err := parseWebhookURLs("/relative"); err == nil {
+		t.Fatalf("expected error for relative URL")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{1: time.Second, 3: 4 * time.Second, 20: maxWebhookBackoff} {
+		got := webhookBackoff(time.Second, attempt)
+		if got < want/2 || got > want {
+			t.Errorf("attempt %d: got backoff %s, want between %s and %s", attempt, got, want/2, want)
+		}
+	}
+}
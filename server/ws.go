@@ -0,0 +1,444 @@
+// WebSocket push of album changes
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+// Clients connect to /ws with a WebSocket (RFC 6455) and are sent a JSON
+// text message for every album that's created, updated, deleted, or
+// restored after the handshake completes, optionally only for some artists
+// (/ws?artist=Beethoven&artist=Mozart). Messages aren't buffered for clients that
+// reconnect, so clients should re-fetch what they need after connecting.
+//
+// Only the small part of the protocol needed for server push is
+// implemented: no extensions or subprotocols, and data messages sent by
+// the client are ignored. The server pings each client regularly, and a
+// client that sends nothing (not even a pong) for two ping intervals, or
+// can't keep up with the messages, is disconnected.
+const (
+	wsGUID                = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // from RFC 6455, for Sec-WebSocket-Accept
+	defaultWSPingInterval = 30 * time.Second
+	wsWriteWait           = 10 * time.Second // for each frame written
+	wsCloseWait           = time.Second      // for the client's reply to our close
+	wsMaxPayload          = 4096             // for frames sent by the client
+	wsSendBuffer          = 16               // messages queued per client
+	maxWebSockets         = 1000
+)
+
+// WebSocket opcodes and close codes (RFC 6455 sections 5.2 and 7.4.1).
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsCloseNormal        = 1000
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsClosePolicy        = 1008
+	wsCloseTooBig        = 1009
+)
+
+var (
+	errWSProtocol = errors.New("websocket protocol error")
+	errWSTooBig   = errors.New("websocket frame too big")
+)
+
+// WithWebSocketPingInterval sets how often WebSocket clients are pinged
+// to keep their connections alive (some proxies drop idle connections).
+// A client that sends nothing for two intervals is disconnected. The
+// default is 30 seconds.
+func WithWebSocketPingInterval(interval time.Duration) Option {
+	return func(s *Server) {
+		if interval > 0 {
+			s.wsPingInterval = interval
+		}
+	}
+}
+
+// albumChange is the message sent to WebSocket clients when an album
+// changes. Type is "created", "updated", "deleted", or "restored", and
+// Album is the album after the change.
+type albumChange struct {
+	Type  string `json:"type"`
+	Album Album  `json:"album"`
+}
+
+// wsConn is a WebSocket client subscribed to album changes.
+type wsConn struct {
+	conn    net.Conn
+	rw      *bufio.ReadWriter
+	request *http.Request // the handshake request, for the client's role
+	artists []string      // only send changes to these artists' albums, if set
+	tenant  string        // only send changes to this tenant's albums
+
+	send     chan []byte
+	dropped  chan struct{} // closed if the client can't keep up
+	dropOnce sync.Once
+}
+
+// changeHub keeps track of the WebSocket clients to send changes to.
+type changeHub struct {
+	mu    sync.Mutex
+	conns map[*wsConn]struct{}
+}
+
+func newChangeHub() *changeHub {
+	return &changeHub{conns: make(map[*wsConn]struct{})}
+}
+
+// add subscribes ws to changes, returning false if there are already
+// maxWebSockets clients.
+func (h *changeHub) add(ws *wsConn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.conns) >= maxWebSockets {
+		return false
+	}
+	h.conns[ws] = struct{}{}
+	return true
+}
+
+func (h *changeHub) remove(ws *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns, ws)
+}
+
+func (h *changeHub) len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.conns)
+}
+
+// notifyWebSockets is the EventPublisher for WebSocket clients: it sends
+// album events to the clients subscribed to them. Public clients aren't
+// told about unpublished albums, and get the album redacted as they would
+// over the REST API.
+func (s *Server) notifyWebSockets(event Event) {
+	if !strings.HasPrefix(event.Type, "album.") || event.Data == nil || s.changes.len() == 0 {
+		return
+	}
+	var album Album
+	err := json.Unmarshal(event.Data, &album)
+	if err != nil {
+		s.log.Printf("error decoding album ID %q for WebSocket clients: %v", event.ResourceID, err)
+		return
+	}
+	changeType := strings.TrimPrefix(event.Type, "album.")
+	now := s.now()
+
+	s.changes.mu.Lock()
+	defer s.changes.mu.Unlock()
+	for ws := range s.changes.conns {
+		if ws.tenant != event.Tenant {
+			continue
+		}
+		if s.role(ws.request) < RoleAdmin && !album.published(now) {
+			continue
+		}
+		if !matchArtist(album, ws.artists) {
+			continue
+		}
+		b, err := json.Marshal(albumChange{Type: changeType, Album: s.redactAlbum(ws.request, album)})
+		if err != nil {
+			continue // can't happen for our types
+		}
+		select {
+		case ws.send <- b:
+		default:
+			// Don't let one slow client hold up everyone else
+			ws.dropOnce.Do(func() { close(ws.dropped) })
+		}
+	}
+}
+
+// getWebSocket performs the WebSocket handshake and subscribes the client
+// to album changes. The connection is then handed over to a background
+// component, so it's closed cleanly when the server shuts down.
+func (s *Server) getWebSocket(w http.ResponseWriter, r *http.Request) {
+	issues := make(map[string]interface{})
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		issues["Upgrade"] = validationIssue{"required", "Upgrade must be websocket, with Connection: Upgrade"}
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		issues["Sec-WebSocket-Version"] = validationIssue{"unsupported", "Sec-WebSocket-Version must be 13"}
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		issues["Sec-WebSocket-Key"] = validationIssue{"invalid", "Sec-WebSocket-Key must be 16 bytes, base64 encoded"}
+	}
+	if len(issues) > 0 {
+		s.writeError(w, r, apierr.Validation(issues))
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.writeError(w, r, apierr.Internal(errors.New("connection doesn't support WebSockets")))
+		return
+	}
+
+	ws := &wsConn{
+		request: r,
+		artists: paramValues(r, "artist"),
+		tenant:  s.tenant,
+		send:    make(chan []byte, wsSendBuffer),
+		dropped: make(chan struct{}),
+	}
+	// Subscribe before the handshake response, so the client doesn't miss
+	// changes made after it's connected
+	if !s.changes.add(ws) {
+		s.writeError(w, r, apierr.Overloaded())
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		s.changes.remove(ws)
+		s.writeError(w, r, apierr.Internal(fmt.Errorf("hijacking connection: %w", err)))
+		return
+	}
+	ws.conn = conn
+	ws.rw = rw
+
+	// The http.Server's timeouts no longer apply; from here on the
+	// deadlines are set per frame
+	conn.SetDeadline(time.Time{})
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	err = rw.Flush()
+	if err != nil {
+		s.changes.remove(ws)
+		conn.Close()
+		return
+	}
+
+	started := s.background.Go("websocket", func(ctx context.Context) {
+		s.serveWebSocket(ctx, ws)
+	})
+	if !started {
+		// Server is shutting down
+		s.changes.remove(ws)
+		ws.writeClose(wsCloseGoingAway, "server shutting down")
+		conn.Close()
+	}
+}
+
+// headerHasToken reports whether the comma-separated header contains
+// token, ignoring case.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWebSocket writes changes and pings to the client until it closes
+// the connection, can't keep up, or ctx is cancelled. All writes are done
+// here; the client's frames are read in a separate goroutine, which exits
+// before this does.
+func (s *Server) serveWebSocket(ctx context.Context, ws *wsConn) {
+	defer s.changes.remove(ws)
+
+	pings := make(chan []byte, 1)
+	readDone := make(chan int, 1)
+	go func() {
+		readDone <- ws.readFrames(2*s.wsPingInterval, pings)
+	}()
+
+	ticker := time.NewTicker(s.wsPingInterval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case msg := <-ws.send:
+			err = ws.writeFrame(wsOpText, msg)
+		case payload := <-pings:
+			err = ws.writeFrame(wsOpPong, payload)
+		case <-ticker.C:
+			err = ws.writeFrame(wsOpPing, nil)
+		case code := <-readDone:
+			// Client closed the connection (or broke the protocol), so
+			// reply with a close, unless it's already gone
+			if code != 0 {
+				ws.writeClose(code, "")
+			}
+			ws.conn.Close()
+			return
+		case <-ws.dropped:
+			ws.close(readDone, wsClosePolicy, "client too slow")
+			return
+		case <-ctx.Done():
+			ws.close(readDone, wsCloseGoingAway, "server shutting down")
+			return
+		}
+		if err != nil {
+			ws.conn.Close()
+			<-readDone
+			return
+		}
+	}
+}
+
+// close starts the closing handshake, and waits a short while for the
+// client to reply before closing the connection.
+func (ws *wsConn) close(readDone <-chan int, code int, reason string) {
+	err := ws.writeClose(code, reason)
+	if err == nil {
+		timer := time.NewTimer(wsCloseWait)
+		defer timer.Stop()
+		select {
+		case <-readDone:
+			ws.conn.Close()
+			return
+		case <-timer.C:
+		}
+	}
+	ws.conn.Close()
+	<-readDone
+}
+
+// readFrames reads the client's frames until it closes the connection or
+// an error occurs, sending each ping's payload to pings so it's answered
+// with a pong. It returns the close code to reply with, or 0 if the
+// connection is broken and there's no point replying.
+func (ws *wsConn) readFrames(timeout time.Duration, pings chan<- []byte) int {
+	for {
+		ws.conn.SetReadDeadline(time.Now().Add(timeout))
+		opcode, payload, err := readWSFrame(ws.rw.Reader)
+		switch {
+		case errors.Is(err, errWSTooBig):
+			return wsCloseTooBig
+		case errors.Is(err, errWSProtocol):
+			return wsCloseProtocolError
+		case err != nil:
+			return 0
+		}
+		switch opcode {
+		case wsOpPing:
+			select {
+			case pings <- payload:
+			default:
+				// A pong is already due, which is enough (RFC 6455
+				// section 5.5.3)
+			}
+		case wsOpClose:
+			return wsCloseNormal
+		}
+		// Pongs only extend the deadline, and data is ignored
+	}
+}
+
+// readWSFrame reads a single frame sent by a client, returning its
+// opcode and unmasked payload.
+func readWSFrame(r io.Reader) (byte, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		return 0, nil, fmt.Errorf("%w: reserved bits set", errWSProtocol)
+	}
+	switch opcode {
+	case wsOpContinuation, wsOpText, wsOpBinary, wsOpClose, wsOpPing, wsOpPong:
+	default:
+		return 0, nil, fmt.Errorf("%w: unknown opcode %#x", errWSProtocol, opcode)
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("%w: client frames must be masked", errWSProtocol)
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		_, err = io.ReadFull(r, b[:])
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		_, err = io.ReadFull(r, b[:])
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if opcode >= wsOpClose && (!fin || length > 125) {
+		return 0, nil, fmt.Errorf("%w: control frames must be unfragmented and short", errWSProtocol)
+	}
+	if length > wsMaxPayload {
+		return 0, nil, fmt.Errorf("%w: %d bytes", errWSTooBig, length)
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(r, mask[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// writeFrame writes a single unfragmented, unmasked frame (servers never
+// mask).
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	ws.rw.Write(header)
+	ws.rw.Write(payload)
+	return ws.rw.Flush()
+}
+
+func (ws *wsConn) writeClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	return ws.writeFrame(wsOpClose, payload)
+}
@@ -0,0 +1,297 @@
+// Tests for WebSocket push of album changes
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWSClient is a minimal WebSocket client for testing: just enough to
+// complete the handshake, read the server's frames, and send masked ones.
+type testWSClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, server *httptest.Server, path string, header http.Header) *testWSClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request, err := http.NewRequest("GET", server.URL+path, nil)
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+	for k, v := range header {
+		request.Header[k] = v
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==") // from RFC 6455
+	err = request.Write(conn)
+	if err != nil {
+		t.Fatalf("error writing handshake: %v", err)
+	}
+	r := bufio.NewReader(conn)
+	response, err := http.ReadResponse(r, request)
+	if err != nil {
+		t.Fatalf("error reading handshake response: %v", err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want 101", response.StatusCode)
+	}
+	if got := response.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got Sec-WebSocket-Accept %q", got)
+	}
+	return &testWSClient{t: t, conn: conn, r: r}
+}
+
+// readFrame reads an (unmasked) frame from the server.
+func (c *testWSClient) readFrame() (byte, []byte) {
+	c.t.Helper()
+	var header [2]byte
+	_, err := io.ReadFull(c.r, header[:])
+	if err != nil {
+		c.t.Fatalf("error reading frame: %v", err)
+	}
+	if header[1]&0x80 != 0 {
+		c.t.Fatalf("server frame is masked")
+	}
+	length := int(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		io.ReadFull(c.r, b[:])
+		length = int(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		c.t.Fatalf("unexpectedly long frame")
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.r, payload)
+	if err != nil {
+		c.t.Fatalf("error reading payload: %v", err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+// readChange reads the next album change, skipping pings.
+func (c *testWSClient) readChange() albumChange {
+	c.t.Helper()
+	for {
+		opcode, payload := c.readFrame()
+		if opcode == wsOpPing {
+			continue
+		}
+		if opcode != wsOpText {
+			c.t.Fatalf("got opcode %#x, want text", opcode)
+		}
+		var change albumChange
+		err := json.Unmarshal(payload, &change)
+		if err != nil {
+			c.t.Fatalf("error unmarshaling change: %v", err)
+		}
+		return change
+	}
+}
+
+// readClose reads frames until a close frame, returning its code.
+func (c *testWSClient) readClose() int {
+	c.t.Helper()
+	for {
+		opcode, payload := c.readFrame()
+		if opcode == wsOpClose {
+			if len(payload) < 2 {
+				c.t.Fatalf("close frame without code")
+			}
+			return int(binary.BigEndian.Uint16(payload))
+		}
+	}
+}
+
+// writeFrame writes a masked frame, as clients must.
+func (c *testWSClient) writeFrame(opcode byte, payload []byte, masked bool) {
+	c.t.Helper()
+	frame := []byte{0x80 | opcode, byte(len(payload))}
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		frame[1] |= 0x80
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := c.conn.Write(frame)
+	if err != nil {
+		c.t.Fatalf("error writing frame: %v", err)
+	}
+}
+
+func newWSTestServer(t *testing.T, options ...Option) (*Server, *httptest.Server) {
+	t.Helper()
+	db := NewMemoryDatabase()
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
+	options = append([]Option{WithAdminToken(testAdminToken)}, options...)
+	server := NewServer(db, log.New(io.Discard, "", 0), options...)
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(func() {
+		httpServer.Close()
+		server.Close()
+	})
+	return server, httpServer
+}
+
+func TestWebSocketChanges(t *testing.T) {
+	server, httpServer := newWSTestServer(t)
+	all := dialWebSocket(t, httpServer, "/ws", nil)
+	beatles := dialWebSocket(t, httpServer, "/ws?artist=the+beatles", nil)
+
+	ensureStatus(t, serve(t, server, newRequest(t, "POST", "/albums",
+		strings.NewReader(`{"id": "a2", "title": "Abbey Road", "artist": "The Beatles", "price": 999}`))), http.StatusCreated)
+	ensureStatus(t, serve(t, server, newRequest(t, "POST", "/albums/a1/tracks",
+		strings.NewReader(`{"title": "Allegro", "duration": 900}`))), http.StatusCreated)
+	ensureStatus(t, serve(t, server, newAdminRequest(t, "DELETE", "/albums/a2", nil)), http.StatusNoContent)
+	ensureStatus(t, serve(t, server, newAdminRequest(t, "POST", "/albums/a2/restore", nil)), http.StatusOK)
+
+	for _, want := range []struct{ typ, id string }{
+		{"created", "a2"}, {"updated", "a1"}, {"deleted", "a2"}, {"restored", "a2"},
+	} {
+		change := all.readChange()
+		if change.Type != want.typ || change.Album.ID != want.id {
+			t.Fatalf("got %s %s, want %s %s", change.Type, change.Album.ID, want.typ, want.id)
+		}
+	}
+
+	// The artist-filtered client only sees the Beatles album
+	for _, typ := range []string{"created", "deleted", "restored"} {
+		change := beatles.readChange()
+		if change.Type != typ || change.Album.Title != "Abbey Road" {
+			t.Fatalf("got %s %q, want %s \"Abbey Road\"", change.Type, change.Album.Title, typ)
+		}
+	}
+}
+
+func TestWebSocketUnpublished(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	server, httpServer := newWSTestServer(t, WithClock(func() time.Time { return now }))
+	public := dialWebSocket(t, httpServer, "/ws", nil)
+	admin := dialWebSocket(t, httpServer, "/ws", http.Header{"Authorization": {"Bearer " + testAdminToken}})
+
+	ensureStatus(t, serve(t, server, newRequest(t, "POST", "/albums",
+		strings.NewReader(`{"id": "a2", "title": "Future", "artist": "X", "price": 1, "publish_at": "2030-01-01T00:00:00Z"}`))), http.StatusCreated)
+	ensureStatus(t, serve(t, server, newRequest(t, "POST", "/albums",
+		strings.NewReader(`{"id": "a3", "title": "Now", "artist": "X", "price": 1}`))), http.StatusCreated)
+
+	if change := admin.readChange(); change.Album.ID != "a2" {
+		t.Fatalf("admin got album %q, want a2", change.Album.ID)
+	}
+	if change := public.readChange(); change.Album.ID != "a3" {
+		t.Fatalf("public client got album %q, want a3", change.Album.ID)
+	}
+}
+
+func TestWebSocketHandshakeErrors(t *testing.T) {
+	server := newTestServer()
+	result := serve(t, server, newRequest(t, "GET", "/ws", nil))
+	ensureStatus(t, result, http.StatusBadRequest)
+	if got := result.Header.Get("Sec-WebSocket-Version"); got != "13" {
+		t.Fatalf("got Sec-WebSocket-Version %q, want 13", got)
+	}
+
+	request := newRequest(t, "GET", "/ws", nil)
+	request.Header.Set("Connection", "keep-alive, Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "short")
+	result = serve(t, server, request)
+	ensureError(t, result, http.StatusBadRequest, "validation", map[string]interface{}{
+		"Sec-WebSocket-Key": map[string]interface{}{"error": "invalid", "message": "Sec-WebSocket-Key must be 16 bytes, base64 encoded"},
+	})
+}
+
+func TestWebSocketPing(t *testing.T) {
+	_, httpServer := newWSTestServer(t, WithWebSocketPingInterval(20*time.Millisecond))
+	client := dialWebSocket(t, httpServer, "/ws", nil)
+
+	// The server pings, and answers pings
+	opcode, _ := client.readFrame()
+	if opcode != wsOpPing {
+		t.Fatalf("got opcode %#x, want ping", opcode)
+	}
+	client.writeFrame(wsOpPong, nil, true)
+	client.writeFrame(wsOpPing, []byte("hi"), true)
+	for {
+		opcode, payload := client.readFrame()
+		if opcode == wsOpPong {
+			if string(payload) != "hi" {
+				t.Fatalf("got pong payload %q, want \"hi\"", payload)
+			}
+			break
+		}
+	}
+
+	// A client that goes quiet is disconnected
+	time.Sleep(60 * time.Millisecond)
+	for {
+		_, err := client.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("got error %v, want EOF", err)
+		}
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	server, httpServer := newWSTestServer(t)
+
+	// A client-initiated close is answered
+	client := dialWebSocket(t, httpServer, "/ws", nil)
+	client.writeFrame(wsOpClose, []byte{0x03, 0xe8}, true)
+	if code := client.readClose(); code != wsCloseNormal {
+		t.Fatalf("got close code %d, want %d", code, wsCloseNormal)
+	}
+
+	// Unmasked client frames break the protocol
+	client = dialWebSocket(t, httpServer, "/ws", nil)
+	client.writeFrame(wsOpText, []byte("hi"), false)
+	if code := client.readClose(); code != wsCloseProtocolError {
+		t.Fatalf("got close code %d, want %d", code, wsCloseProtocolError)
+	}
+
+	// Shutting down the server closes connections, saying why
+	client = dialWebSocket(t, httpServer, "/ws", nil)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Shutdown(context.Background())
+	}()
+	if code := client.readClose(); code != wsCloseGoingAway {
+		t.Fatalf("got close code %d, want %d", code, wsCloseGoingAway)
+	}
+	client.writeFrame(wsOpClose, []byte{0x03, 0xe9}, true)
+	if err := <-done; err != nil {
+		t.Fatalf("error shutting down: %v", err)
+	}
+	if n := server.changes.len(); n != 0 {
+		t.Fatalf("got %d subscribers after shutdown, want 0", n)
+	}
+}
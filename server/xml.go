@@ -0,0 +1,174 @@
+// XML responses for clients that ask for them
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/benhoyt/web-service-stdlib/apierr"
+)
+
+const xmlContentType = "application/xml; charset=utf-8"
+
+// wantsXML reports whether the client wants an XML response, either with
+// ?format=xml or an Accept header that prefers XML to JSON. Browsers list
+// application/xml in their Accept header, but prefer HTML, so XML must
+// also be preferred to HTML; that way browsers get JSON (or the HTML view)
+// as before.
+func wantsXML(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "xml":
+		return true
+	case "json":
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	quality := acceptQuality(accept, "application/xml")
+	if q := acceptQuality(accept, "text/xml"); q > quality {
+		quality = q
+	}
+	return quality > acceptQuality(accept, "application/json") && quality > acceptQuality(accept, "text/html")
+}
+
+// xmlAlbum is a single album as an XML document.
+type xmlAlbum struct {
+	XMLName xml.Name `xml:"album"`
+	Album
+}
+
+// xmlAlbumList is a list of albums as an XML document.
+type xmlAlbumList struct {
+	XMLName xml.Name `xml:"albums"`
+	Albums  []Album  `xml:"album"`
+}
+
+// xmlError writes an error response as XML. It mirrors the JSON error
+// envelope, but the error code is in a <code> element (rather than an
+// <error> inside <error>), and the data is written as nested <field>
+// elements, because its keys aren't necessarily valid XML names:
+//
+//	<error>
+//	  <status>422</status>
+//	  <code>validation</code>
+//	  <data>
+//	    <field name="title">
+//	      <field name="error">required</field>
+//	    </field>
+//	  </data>
+//	</error>
+func (s *Server) xmlError(w http.ResponseWriter, status int, code string, data map[string]interface{}, retry *apierr.Retry) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+	err := encodeXMLError(encoder, status, code, data, retry)
+	if err != nil {
+		s.log.Printf("error marshaling XML: %v", err)
+		w.Header().Set("Content-Type", xmlContentType)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s<error><status>500</status><code>internal</code></error>\n", xml.Header)
+		return
+	}
+	buf.WriteByte('\n')
+	w.Header().Set("Content-Type", xmlContentType)
+	w.WriteHeader(status)
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		s.log.Printf("error writing XML: %v", err)
+	}
+}
+
+func encodeXMLError(encoder *xml.Encoder, status int, code string, data map[string]interface{}, retry *apierr.Retry) error {
+	root := xml.StartElement{Name: xml.Name{Local: "error"}}
+	err := encoder.EncodeToken(root)
+	if err != nil {
+		return err
+	}
+	err = encoder.EncodeElement(status, xml.StartElement{Name: xml.Name{Local: "status"}})
+	if err != nil {
+		return err
+	}
+	err = encoder.EncodeElement(code, xml.StartElement{Name: xml.Name{Local: "code"}})
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		// Convert the data to plain maps, slices, and values via JSON, so
+		// structs like validationIssue come out with their JSON names
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		var value interface{}
+		err = json.Unmarshal(b, &value)
+		if err != nil {
+			return err
+		}
+		err = encodeXMLValue(encoder, xml.StartElement{Name: xml.Name{Local: "data"}}, value)
+		if err != nil {
+			return err
+		}
+	}
+	if retry != nil {
+		err = encoder.EncodeElement(retry, xml.StartElement{Name: xml.Name{Local: "retry"}})
+		if err != nil {
+			return err
+		}
+	}
+	err = encoder.EncodeToken(root.End())
+	if err != nil {
+		return err
+	}
+	return encoder.Flush()
+}
+
+// encodeXMLValue writes a value decoded from JSON as element start: maps
+// as <field name="key"> children (sorted by key), slices as <item>
+// children, and anything else as text.
+func encodeXMLValue(encoder *xml.Encoder, start xml.StartElement, value interface{}) error {
+	err := encoder.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field := xml.StartElement{
+				Name: xml.Name{Local: "field"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: key}},
+			}
+			err := encodeXMLValue(encoder, field, value[key])
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			err := encodeXMLValue(encoder, xml.StartElement{Name: xml.Name{Local: "item"}}, item)
+			if err != nil {
+				return err
+			}
+		}
+	case string:
+		err = encoder.EncodeToken(xml.CharData(value))
+	case float64:
+		err = encoder.EncodeToken(xml.CharData(strconv.FormatFloat(value, 'f', -1, 64)))
+	case bool:
+		err = encoder.EncodeToken(xml.CharData(strconv.FormatBool(value)))
+	}
+	if err != nil {
+		return err
+	}
+	return encoder.EncodeToken(start.End())
+}
@@ -0,0 +1,198 @@
+// Tests for XML responses
+
+package server
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testXMLAlbum struct {
+	XMLName xml.Name `xml:"album"`
+	ID      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Artist  string   `xml:"artist"`
+	Price   int      `xml:"price"`
+	Tracks  []Track  `xml:"tracks>track"`
+	Genres  []string `xml:"genres>genre"`
+}
+
+type testXMLError struct {
+	XMLName xml.Name `xml:"error"`
+	Status  int      `xml:"status"`
+	Code    string   `xml:"code"`
+	Data    struct {
+		Fields []testXMLField `xml:"field"`
+	} `xml:"data"`
+}
+
+type testXMLField struct {
+	Name   string         `xml:"name,attr"`
+	Text   string         `xml:",chardata"`
+	Fields []testXMLField `xml:"field"`
+}
+
+// unmarshalXMLResponse is like unmarshalResponse, but for XML.
+func unmarshalXMLResponse(t *testing.T, response *http.Response, v interface{}) {
+	t.Helper()
+	if got := response.Header.Get("Content-Type"); got != xmlContentType {
+		t.Fatalf("bad Content-Type: got %q, want %q", got, xmlContentType)
+	}
+	b, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+	if !strings.HasPrefix(string(b), xml.Header) {
+		t.Fatalf("response doesn't start with XML header:\n%s", b)
+	}
+	err = xml.Unmarshal(b, v)
+	if err != nil {
+		t.Fatalf("error unmarshaling XML: %v\n%s", err, b)
+	}
+}
+
+func newXMLRequest(t *testing.T, method, url string, body io.Reader) *http.Request {
+	request := newRequest(t, method, url, body)
+	request.Header.Set("Accept", "application/xml")
+	return request
+}
+
+func TestGetAlbumsXML(t *testing.T) {
+	server := newTestServer()
+	var list struct {
+		XMLName xml.Name       `xml:"albums"`
+		Albums  []testXMLAlbum `xml:"album"`
+	}
+	result := serve(t, server, newXMLRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+	unmarshalXMLResponse(t, result, &list)
+	want := []testXMLAlbum{
+		{XMLName: xml.Name{Local: "album"}, ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795},
+		{XMLName: xml.Name{Local: "album"}, ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000},
+	}
+	if !reflect.DeepEqual(list.Albums, want) {
+		t.Fatalf("got albums %+v, want %+v", list.Albums, want)
+	}
+
+	// XML responses have their own ETags
+	etag := result.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("no ETag in XML response")
+	}
+	request := newXMLRequest(t, "GET", "/albums", nil)
+	request.Header.Set("If-None-Match", etag)
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusNotModified)
+	result = serve(t, server, newRequest(t, "GET", "/albums", nil))
+	ensureStatus(t, result, http.StatusOK)
+	if result.Header.Get("ETag") == etag {
+		t.Fatalf("JSON and XML responses have the same ETag %s", etag)
+	}
+
+	// Browsers get HTML, not XML
+	request = newRequest(t, "GET", "/albums", nil)
+	request.Header.Set("Accept", browserAccept)
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	if got := result.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Fatalf("bad Content-Type header for browser: got %q", got)
+	}
+}
+
+func TestGetAlbumXML(t *testing.T) {
+	db := NewMemoryDatabase()
+	db.AddGenre(Genre{ID: "classical", Name: "Classical"})
+	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven & Co", Price: 795, Genres: []string{"classical"}})
+	db.AddTrack("a1", Track{Title: "Ode to Joy", Duration: 338})
+	server := NewServer(db, newTestServer().log)
+
+	// The ?format=xml override wins over the Accept header
+	request := newRequest(t, "GET", "/albums/a1?format=xml", nil)
+	request.Header.Set("Accept", browserAccept)
+	result := serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	var album testXMLAlbum
+	unmarshalXMLResponse(t, result, &album)
+	want := testXMLAlbum{
+		XMLName: xml.Name{Local: "album"},
+		ID:      "a1",
+		Title:   "9th Symphony",
+		Artist:  "Beethoven & Co",
+		Price:   795,
+		Tracks:  []Track{{Number: 1, Title: "Ode to Joy", Duration: 338}},
+		Genres:  []string{"classical"},
+	}
+	if !reflect.DeepEqual(album, want) {
+		t.Fatalf("got album %+v, want %+v", album, want)
+	}
+
+	// And ?format=json forces JSON
+	request = newXMLRequest(t, "GET", "/albums/a1?format=json", nil)
+	result = serve(t, server, request)
+	ensureStatus(t, result, http.StatusOK)
+	var jsonAlbum testAlbum
+	unmarshalResponse(t, result, &jsonAlbum)
+}
+
+func TestXMLErrors(t *testing.T) {
+	server := newTestServer()
+
+	result := serve(t, server, newXMLRequest(t, "GET", "/albums/a3", nil))
+	ensureStatus(t, result, http.StatusNotFound)
+	var got testXMLError
+	unmarshalXMLResponse(t, result, &got)
+	if got.Status != http.StatusNotFound || got.Code != "not-found" || len(got.Data.Fields) != 0 {
+		t.Fatalf("bad error: %+v", got)
+	}
+
+	body := `{"id": "a3", "artist": "Nobody", "tracks": [{"title": ""}]}`
+	result = serve(t, server, newXMLRequest(t, "POST", "/albums", strings.NewReader(body)))
+	ensureStatus(t, result, http.StatusBadRequest)
+	got = testXMLError{}
+	unmarshalXMLResponse(t, result, &got)
+	if got.Status != http.StatusBadRequest || got.Code != "validation" {
+		t.Fatalf("bad error: %+v", got)
+	}
+	fields := make(map[string]string)
+	for _, field := range got.Data.Fields {
+		for _, sub := range field.Fields {
+			if sub.Name == "error" {
+				fields[field.Name] = sub.Text
+			}
+		}
+	}
+	if fields["title"] != "required" || fields["tracks.0.title"] != "required" {
+		t.Fatalf("bad validation fields: %+v", got.Data.Fields)
+	}
+}
+
+func TestWantsXML(t *testing.T) {
+	tests := []struct {
+		url    string
+		accept string
+		want   bool
+	}{
+		{"/albums", "", false},
+		{"/albums", "*/*", false},
+		{"/albums", "application/xml", true},
+		{"/albums", "text/xml", true},
+		{"/albums", "application/json, application/xml;q=0.9", false},
+		{"/albums", "application/xml, application/json;q=0.9", true},
+		{"/albums", browserAccept, false},
+		{"/albums?format=xml", "", true},
+		{"/albums?format=json", "application/xml", false},
+	}
+	for _, test := range tests {
+		t.Run(test.url+" "+test.accept, func(t *testing.T) {
+			request := newRequest(t, "GET", test.url, nil)
+			request.Header.Set("Accept", test.accept)
+			if got := wantsXML(request); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
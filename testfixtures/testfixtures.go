@@ -0,0 +1,269 @@
+// Package testfixtures runs the album API server in-process for
+// integration tests, so code that calls the API can be tested without a
+// deployed server or any network dependencies.
+//
+// Each fixture is a fully configured server with its own in-memory
+// database, seeded with DefaultSeed (or a seed of the test's choosing).
+// Its clock only moves when the test moves it, and it generates the IDs
+// "id1", "id2", and so on, so responses are the same on every run. The
+// server is shut down when the test finishes.
+//
+// For example:
+//
+//	f := testfixtures.New(t)
+//	f.Send("POST", "/v1/albums", `{"title": "Blue", "artist": "Joni Mitchell"}`).
+//		AssertStatus(http.StatusCreated).
+//		AssertHeader("Location", "/v1/albums/id1")
+//	f.Get("/v1/albums/nope").AssertError(http.StatusNotFound, "not-found")
+package testfixtures
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/server"
+)
+
+// AdminToken is the admin bearer token of fixture servers (see AsAdmin).
+const AdminToken = "testfixtures-admin"
+
+// StartTime is the time a fixture's clock starts at.
+var StartTime = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// DefaultSeed returns the albums and genres a fixture's database starts
+// with, unless NewSeeded gives others. They're fixed here (rather than
+// being the server's own sample data) so tests can rely on them.
+func DefaultSeed() server.DatabaseSnapshot {
+	return server.DatabaseSnapshot{
+		Albums: []server.Album{
+			{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795, Genres: []string{"classical"}},
+			{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000, Genres: []string{"rock"}},
+		},
+		Genres: []server.Genre{
+			{ID: "classical", Name: "Classical"},
+			{ID: "rock", Name: "Rock"},
+		},
+	}
+}
+
+// Fixture is an album API server running in-process, with a client to
+// make requests to it.
+type Fixture struct {
+	URL    string // base URL of the server, like "http://127.0.0.1:1234"
+	Client *http.Client
+	Server *server.Server
+	DB     *server.MemoryDatabase
+	Clock  *Clock
+
+	t testing.TB
+}
+
+// New starts a fixture server seeded with DefaultSeed. Options are applied
+// after the fixture's own (the clock, IDs, and admin token), so they can
+// add to or override them; a test that overrides the clock should use
+// that clock rather than Fixture.Clock.
+func New(t testing.TB, options ...server.Option) *Fixture {
+	t.Helper()
+	return NewSeeded(t, DefaultSeed(), options...)
+}
+
+// NewSeeded is like New, but seeds the database with seed instead.
+func NewSeeded(t testing.TB, seed server.DatabaseSnapshot, options ...server.Option) *Fixture {
+	t.Helper()
+	clock := &Clock{now: StartTime}
+	db := server.NewMemoryDatabase()
+	db.Now = clock.Now
+	err := server.LoadSeed(db, seed)
+	if err != nil {
+		t.Fatalf("error loading seed: %v", err)
+	}
+
+	options = append([]server.Option{
+		server.WithClock(clock.Now),
+		server.WithIDGenerator(&server.SequentialIDGenerator{}),
+		server.WithAdminToken(AdminToken),
+		server.WithSeed(seed),
+	}, options...)
+	s := server.NewServer(db, log.New(io.Discard, "", 0), options...)
+	httpServer := httptest.NewServer(s)
+	t.Cleanup(func() {
+		httpServer.Close()
+		err := s.Close()
+		if err != nil {
+			t.Errorf("error shutting down server: %v", err)
+		}
+	})
+	return &Fixture{
+		URL:    httpServer.URL,
+		Client: httpServer.Client(),
+		Server: s,
+		DB:     db,
+		Clock:  clock,
+		t:      t,
+	}
+}
+
+// NewRequest returns a request to the server for the given path, like
+// "/v1/albums?sort=title".
+func (f *Fixture) NewRequest(method, path string, body io.Reader) *http.Request {
+	f.t.Helper()
+	request, err := http.NewRequest(method, f.URL+path, body)
+	if err != nil {
+		f.t.Fatalf("error creating request: %v", err)
+	}
+	return request
+}
+
+// AsAdmin authorizes the request with AdminToken, and returns it.
+func (f *Fixture) AsAdmin(request *http.Request) *http.Request {
+	request.Header.Set("Authorization", "Bearer "+AdminToken)
+	return request
+}
+
+// Do sends the request and reads the whole response.
+func (f *Fixture) Do(request *http.Request) *Response {
+	f.t.Helper()
+	response, err := f.Client.Do(request)
+	if err != nil {
+		f.t.Fatalf("error sending request: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		f.t.Fatalf("error reading response: %v", err)
+	}
+	return &Response{Response: response, Bytes: body, t: f.t}
+}
+
+// Get sends a GET request for the given path.
+func (f *Fixture) Get(path string) *Response {
+	f.t.Helper()
+	return f.Do(f.NewRequest("GET", path, nil))
+}
+
+// Send sends a request with the given JSON body (none if it's "").
+func (f *Fixture) Send(method, path, body string) *Response {
+	f.t.Helper()
+	var request *http.Request
+	if body == "" {
+		request = f.NewRequest(method, path, nil)
+	} else {
+		request = f.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+	}
+	return f.Do(request)
+}
+
+// Response is a response from the fixture server, with its body already
+// read into Bytes. The Assert methods fail the test if the response isn't
+// as expected, and return the response so they can be chained.
+type Response struct {
+	*http.Response
+	Bytes []byte
+
+	t testing.TB
+}
+
+// AssertStatus checks the response's status code.
+func (r *Response) AssertStatus(status int) *Response {
+	r.t.Helper()
+	if r.StatusCode != status {
+		r.t.Fatalf("got status %d, want %d; body:\n%s", r.StatusCode, status, r.Bytes)
+	}
+	return r
+}
+
+// AssertHeader checks the value of a response header.
+func (r *Response) AssertHeader(name, value string) *Response {
+	r.t.Helper()
+	if got := r.Header.Get(name); got != value {
+		r.t.Fatalf("got %s header %q, want %q", name, got, value)
+	}
+	return r
+}
+
+// Unmarshal checks that the response is JSON, and unmarshals it into v.
+func (r *Response) Unmarshal(v interface{}) {
+	r.t.Helper()
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		r.t.Fatalf("got Content-Type %q, want JSON", r.Header.Get("Content-Type"))
+	}
+	err = json.Unmarshal(r.Bytes, v)
+	if err != nil {
+		r.t.Fatalf("error unmarshaling response: %v; body:\n%s", err, r.Bytes)
+	}
+}
+
+// AssertJSON checks that the response is JSON equal to want, ignoring
+// formatting and the order of object keys.
+func (r *Response) AssertJSON(want string) *Response {
+	r.t.Helper()
+	var wantValue interface{}
+	err := json.Unmarshal([]byte(want), &wantValue)
+	if err != nil {
+		r.t.Fatalf("error unmarshaling wanted JSON: %v", err)
+	}
+	var got interface{}
+	r.Unmarshal(&got)
+	if !reflect.DeepEqual(got, wantValue) {
+		var indented bytes.Buffer
+		_ = json.Indent(&indented, r.Bytes, "", "  ")
+		r.t.Fatalf("bad JSON response: got:\n%s\nwant:\n%s", indented.String(), want)
+	}
+	return r
+}
+
+// AssertError checks that the response is an API error with the given
+// status code and error code, like "not-found".
+func (r *Response) AssertError(status int, code string) *Response {
+	r.t.Helper()
+	r.AssertStatus(status)
+	var got struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+	r.Unmarshal(&got)
+	if got.Status != status || got.Error != code {
+		r.t.Fatalf("got error %d %q, want %d %q", got.Status, got.Error, status, code)
+	}
+	return r
+}
+
+// Clock is a fake clock that only moves when the test moves it. It's safe
+// for concurrent use.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set sets the clock to t.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
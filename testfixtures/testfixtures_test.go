@@ -0,0 +1,59 @@
+package testfixtures_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/benhoyt/web-service-stdlib/server"
+	"github.com/benhoyt/web-service-stdlib/testfixtures"
+)
+
+func TestSeeded(t *testing.T) {
+	f := testfixtures.New(t)
+	f.Get("/v1/albums").AssertStatus(http.StatusOK).AssertJSON(`[
+		{"id": "a1", "title": "9th Symphony", "artist": "Beethoven", "price": 795, "genres": ["classical"],
+		 "version": 1, "created_at": "2021-06-01T12:00:00Z", "updated_at": "2021-06-01T12:00:00Z"},
+		{"id": "a2", "title": "Hey Jude", "artist": "The Beatles", "price": 2000, "genres": ["rock"],
+		 "version": 1, "created_at": "2021-06-01T12:00:00Z", "updated_at": "2021-06-01T12:00:00Z"}
+	]`)
+	f.Get("/v1/albums/a3").AssertError(http.StatusNotFound, "not-found")
+
+	f = testfixtures.NewSeeded(t, server.DatabaseSnapshot{})
+	f.Get("/v1/albums").AssertStatus(http.StatusOK).AssertJSON(`[]`)
+}
+
+func TestDeterministic(t *testing.T) {
+	// Two fixtures give the same responses to the same requests
+	for i := 0; i < 2; i++ {
+		f := testfixtures.New(t)
+		f.Clock.Advance(time.Hour)
+		f.Send("POST", "/v1/albums", `{"title": "Blue", "artist": "Joni Mitchell", "price": 1500}`).
+			AssertStatus(http.StatusCreated).
+			AssertHeader("Location", "/v1/albums/id1").
+			AssertJSON(`{"id": "id1", "title": "Blue", "artist": "Joni Mitchell", "price": 1500,
+				"version": 1, "created_at": "2021-06-01T13:00:00Z", "updated_at": "2021-06-01T13:00:00Z"}`)
+		f.Send("POST", "/v1/albums", `{"title": "Court and Spark", "artist": "Joni Mitchell"}`).
+			AssertHeader("Location", "/v1/albums/id2")
+
+		var album server.Album
+		f.Get("/v1/albums/id1").AssertStatus(http.StatusOK).Unmarshal(&album)
+		if album.Title != "Blue" || !album.CreatedAt.Equal(testfixtures.StartTime.Add(time.Hour)) {
+			t.Fatalf("got album %+v", album)
+		}
+	}
+}
+
+func TestAsAdmin(t *testing.T) {
+	f := testfixtures.New(t)
+	f.Get("/deprecations").AssertError(http.StatusForbidden, "forbidden")
+	f.Do(f.AsAdmin(f.NewRequest("GET", "/deprecations", nil))).AssertStatus(http.StatusOK)
+}
+
+func TestOptions(t *testing.T) {
+	f := testfixtures.New(t, server.WithMode(server.ModeReadOnly, time.Minute))
+	f.Get("/v1/albums/a1").AssertStatus(http.StatusOK)
+	f.Send("DELETE", "/v1/albums/a1", "").
+		AssertError(http.StatusServiceUnavailable, "read-only").
+		AssertHeader("Retry-After", "60")
+}